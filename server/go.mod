@@ -4,4 +4,5 @@ go 1.18
 
 require (
     github.com/atsign-company/at_server v1.0.0 // Replace with the appropriate stable version
+    golang.org/x/crypto v0.14.0
 )
@@ -100,6 +100,13 @@ func (s *AtSecondaryServer) Stop() error {
 	return nil
 }
 
+// Server returns the underlying DESS server instance, or nil if the server has not been started
+func (s *AtSecondaryServer) Server() *server.AtServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server
+}
+
 // validateConfig ensures that the configuration parameters are correct and complete
 func (s *AtSecondaryServer) validateConfig() error {
 	if s.config.AtSign == "" || s.config.RootDomain == "" || s.config.ServerPort == 0 {
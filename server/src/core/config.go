@@ -9,6 +9,8 @@ import (
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Config struct holds the configuration parameters for the Nimbus Edge Server
@@ -32,10 +34,154 @@ type Config struct {
 	Email            string // Email address for SSL certificate management
 	SSLCertPath      string // Path to SSL certificate
 	SSLKeyPath       string // Path to SSL key
+	SSLCAPath        string // Optional PEM bundle of CAs trusted for outbound TLS; the system roots when empty
+
+	// Alert notification sinks; each sink is enabled only when its address is set
+	AlertWebhookURL     string // Endpoint receiving alert webhooks
+	AlertWebhookSecret  string // Shared secret for HMAC-signing webhook payloads
+	AlertSMTPAddr       string // SMTP relay in host:port form
+	AlertSMTPUsername   string
+	AlertSMTPPassword   string
+	AlertEmailFrom      string
+	AlertEmailTo        string // Comma-separated list of alert recipients
+	AlertSyslogNetwork  string // "udp" or "tcp"
+	AlertSyslogAddr     string // Syslog collector in host:port form
+	AlertMQTTBroker     string // MQTT broker in host:port form
+	AlertMQTTTopic      string
+	AlertMQTTUsername   string
+	AlertMQTTPassword   string
+	AlertOperatorAtSign string // Operator atSign notified through DESS
+	AlertMaxAttempts    int    // Delivery attempts per alert before dead-lettering
+	AlertDeadLetterPath string // JSON-lines file for undeliverable alerts
+
+	// Edge analytics
+	AnomalyThreshold      float64       // Z-score above which a value is reported as an anomaly
+	AnalyticsInterval     time.Duration // Interval between analytics processing cycles
+	IngestBufferSize      int           // Samples buffered between producers and the processing loop
+	IngestOverflowPolicy  string        // "drop-oldest", "drop-newest" or "block"
+	DataQualityEnabled    bool          // Reject invalid samples and score sensor health before analytics
+	DataQualityConfigPath string        // Optional JSON file with per-series range, stuck-value and gap checks
+	ForecastConfigPath    string        // Optional JSON file with per-series forecasting rules; forecasting is off when empty
+	CorrelationConfigPath string        // Optional JSON file with correlated series groups; cross-sensor detection is off when empty
+	PipelineConfigPath    string        // Optional JSON file declaring stream processing pipelines
+	FunctionConfigPath    string        // Optional JSON file declaring sandboxed user-defined functions
+
+	// Telemetry rollups
+	RollupsEnabled            bool   // Downsample samples into time-bucketed aggregates
+	RollupConfigPath          string // Optional JSON file with per-series rollup rules
+	RollupUpstreamResolutions string // Comma-separated resolutions forwarded upstream, e.g. "1m,1h"
+
+	// Local time-series storage
+	TimeSeriesEnabled         bool   // Persist raw samples under <StoragePath>/tsdb
+	TimeSeriesRetention       string // Default retention, e.g. "720h"; "0" keeps data forever
+	TimeSeriesRetentionConfig string // Optional JSON file with per-series retention policies
+
+	// Store-and-forward upstream sync; enabled when an upstream atSign or URL is set
+	UpstreamAtSign     string // atSign of the upstream collector
+	UpstreamURL        string // HTTPS ingestion endpoint, used instead of the atSign when set
+	UpstreamToken      string // Bearer token for the ingestion endpoint
+	OutboundQueueMaxMB int    // Disk quota for spooled outbound data, in megabytes
+
+	// Embedded MQTT broker
+	MQTTEnabled         bool   // Accept MQTT clients over TLS
+	MQTTListenAddr      string // Address the broker listens on
+	MQTTCredentialsPath string // JSON file mapping usernames to bcrypt password hashes
+	MQTTIngestTopics    string // Comma-separated topic filters whose payloads are fed to analytics
+
+	// Industrial protocols
+	ModbusConfigPath    string // Optional JSON file with Modbus TCP device maps; polling is off when empty
+	OPCUAConfigPath     string // Optional JSON file with OPC UA servers and their variables; the client is off when empty
+	GatewayMappingsPath string // Optional JSON file with protocol translation mappings; the gateway is off when empty
+
+	// Static routes
+	RouteTablePath         string        // Optional JSON file of static routes the server dials and keeps connected
+	RouteHeartbeatInterval time.Duration // Interval between heartbeats on routes
+
+	// OPC UA server exposing analytics results to SCADA systems
+	OPCUAServerEnabled         bool   // Accept OPC UA clients
+	OPCUAServerListenAddr      string // Address the server listens on
+	OPCUAServerConfigPath      string // JSON file with the series, alerts and commands exposed
+	OPCUAServerCredentialsPath string // JSON file mapping usernames to bcrypt password hashes
+
+	// Graceful shutdown
+	ShutdownTimeout time.Duration // Deadline for components to drain buffered data on shutdown
 }
 
 // LoadConfig loads configuration from environment variables and validates them
 func LoadConfig() (*Config, error) {
+	config := readConfig()
+
+	// Validate the loaded configuration
+	if err := validateConfig(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// LoadAnalyticsConfig loads configuration for offline analytics such as replay. Variables from envFile,
+// when given, override the environment for this call only. Server settings are not required.
+func LoadAnalyticsConfig(envFile string) (*Config, error) {
+	if envFile != "" {
+		overrides, err := readEnvFile(envFile)
+		if err != nil {
+			return nil, err
+		}
+		restore := make(map[string]*string, len(overrides))
+		for key, value := range overrides {
+			if previous, set := os.LookupEnv(key); set {
+				restore[key] = &previous
+			} else {
+				restore[key] = nil
+			}
+			os.Setenv(key, value)
+		}
+		defer func() {
+			for key, previous := range restore {
+				if previous == nil {
+					os.Unsetenv(key)
+				} else {
+					os.Setenv(key, *previous)
+				}
+			}
+		}()
+	}
+
+	config := readConfig()
+	if config.AnalyticsInterval <= 0 {
+		return nil, fmt.Errorf("invalid ANALYTICS_INTERVAL: %s. Must be positive", config.AnalyticsInterval)
+	}
+	return config, nil
+}
+
+// readEnvFile parses KEY=VALUE lines, ignoring blank lines, comments and a leading "export".
+func readEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read env file %s: %w", path, err)
+	}
+	values := make(map[string]string)
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, number+1)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, nil
+}
+
+// readConfig builds the configuration from environment variables without validating it
+func readConfig() *Config {
 	config := &Config{
 		AtSign:           getEnv("ATSIGN", ""),
 		RootDomain:       getEnv("ROOT_DOMAIN", "root.atsign.org"),
@@ -56,14 +202,69 @@ func LoadConfig() (*Config, error) {
 		Email:            getEnv("EMAIL", ""),        // Email for SSL certificate requests
 		SSLCertPath:      getEnv("SSL_CERT_PATH", ""),// Path to SSL certificate
 		SSLKeyPath:       getEnv("SSL_KEY_PATH", ""), // Path to SSL key
-	}
+		SSLCAPath:        getEnv("SSL_CA_PATH", ""),  // CAs trusted for outbound TLS
 
-	// Validate the loaded configuration
-	if err := validateConfig(config); err != nil {
-		return nil, err
-	}
+		AlertWebhookURL:     getEnv("ALERT_WEBHOOK_URL", ""),
+		AlertWebhookSecret:  getEnv("ALERT_WEBHOOK_SECRET", ""),
+		AlertSMTPAddr:       getEnv("ALERT_SMTP_ADDR", ""),
+		AlertSMTPUsername:   getEnv("ALERT_SMTP_USERNAME", ""),
+		AlertSMTPPassword:   getEnv("ALERT_SMTP_PASSWORD", ""),
+		AlertEmailFrom:      getEnv("ALERT_EMAIL_FROM", ""),
+		AlertEmailTo:        getEnv("ALERT_EMAIL_TO", ""),
+		AlertSyslogNetwork:  getEnv("ALERT_SYSLOG_NETWORK", "udp"),
+		AlertSyslogAddr:     getEnv("ALERT_SYSLOG_ADDR", ""),
+		AlertMQTTBroker:     getEnv("ALERT_MQTT_BROKER", ""),
+		AlertMQTTTopic:      getEnv("ALERT_MQTT_TOPIC", "nimbus/alerts"),
+		AlertMQTTUsername:   getEnv("ALERT_MQTT_USERNAME", ""),
+		AlertMQTTPassword:   getEnv("ALERT_MQTT_PASSWORD", ""),
+		AlertOperatorAtSign: getEnv("ALERT_OPERATOR_ATSIGN", ""),
+		AlertMaxAttempts:    getEnvAsInt("ALERT_MAX_ATTEMPTS", 5),
+		AlertDeadLetterPath: getEnv("ALERT_DEAD_LETTER_PATH", "./storage/alert_dead_letter.jsonl"),
 
-	return config, nil
+		AnomalyThreshold:      getEnvAsFloat("ANOMALY_THRESHOLD", 3.0),
+		AnalyticsInterval:     getEnvAsDuration("ANALYTICS_INTERVAL", 10*time.Second),
+		IngestBufferSize:      getEnvAsInt("INGEST_BUFFER_SIZE", 65536),
+		IngestOverflowPolicy:  getEnv("INGEST_OVERFLOW_POLICY", "drop-oldest"),
+		DataQualityEnabled:    getEnvAsBool("DATA_QUALITY_ENABLED", true),
+		DataQualityConfigPath: getEnv("DATA_QUALITY_CONFIG_PATH", ""),
+		ForecastConfigPath:    getEnv("FORECAST_CONFIG_PATH", ""),
+		CorrelationConfigPath: getEnv("CORRELATION_CONFIG_PATH", ""),
+		PipelineConfigPath:    getEnv("PIPELINE_CONFIG_PATH", ""),
+		FunctionConfigPath:    getEnv("USER_FUNCTIONS_CONFIG_PATH", ""),
+
+		RollupsEnabled:            getEnvAsBool("ROLLUPS_ENABLED", true),
+		RollupConfigPath:          getEnv("ROLLUP_CONFIG_PATH", ""),
+		RollupUpstreamResolutions: getEnv("ROLLUP_UPSTREAM_RESOLUTIONS", "1m,1h"),
+
+		TimeSeriesEnabled:         getEnvAsBool("TSDB_ENABLED", true),
+		TimeSeriesRetention:       getEnv("TSDB_RETENTION", "720h"),
+		TimeSeriesRetentionConfig: getEnv("TSDB_RETENTION_CONFIG", ""),
+
+		UpstreamAtSign:     getEnv("UPSTREAM_ATSIGN", ""),
+		UpstreamURL:        getEnv("UPSTREAM_URL", ""),
+		UpstreamToken:      getEnv("UPSTREAM_TOKEN", ""),
+		OutboundQueueMaxMB: getEnvAsInt("OUTBOUND_QUEUE_MAX_MB", 256),
+
+		MQTTEnabled:         getEnvAsBool("MQTT_ENABLED", false),
+		MQTTListenAddr:      getEnv("MQTT_LISTEN_ADDR", "0.0.0.0:8883"),
+		MQTTCredentialsPath: getEnv("MQTT_CREDENTIALS_PATH", ""),
+		MQTTIngestTopics:    getEnv("MQTT_INGEST_TOPICS", ""),
+
+		ModbusConfigPath:    getEnv("MODBUS_CONFIG_PATH", ""),
+		OPCUAConfigPath:     getEnv("OPCUA_CONFIG_PATH", ""),
+		GatewayMappingsPath: getEnv("GATEWAY_MAPPINGS_PATH", ""),
+
+		RouteTablePath:         getEnv("ROUTE_TABLE_PATH", ""),
+		RouteHeartbeatInterval: getEnvAsDuration("ROUTE_HEARTBEAT_INTERVAL", 10*time.Second),
+
+		OPCUAServerEnabled:         getEnvAsBool("OPCUA_SERVER_ENABLED", false),
+		OPCUAServerListenAddr:      getEnv("OPCUA_SERVER_LISTEN_ADDR", "0.0.0.0:4840"),
+		OPCUAServerConfigPath:      getEnv("OPCUA_SERVER_CONFIG_PATH", ""),
+		OPCUAServerCredentialsPath: getEnv("OPCUA_SERVER_CREDENTIALS_PATH", ""),
+
+		ShutdownTimeout: getEnvAsDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+	}
+	return config
 }
 
 // validateConfig ensures the configuration has all required fields and valid values
@@ -100,6 +301,26 @@ func validateConfig(config *Config) error {
 		return fmt.Errorf("invalid SERVER_PORT: %d. Must be between 1024 and 65535", config.ServerPort)
 	}
 
+	// Validate analytics processing interval
+	if config.AnalyticsInterval <= 0 {
+		return fmt.Errorf("invalid ANALYTICS_INTERVAL: %s. Must be positive", config.AnalyticsInterval)
+	}
+
+	// Heartbeats drive the detection of dead routes, so their interval must be positive
+	if config.RouteHeartbeatInterval <= 0 {
+		return fmt.Errorf("invalid ROUTE_HEARTBEAT_INTERVAL: %s. Must be positive", config.RouteHeartbeatInterval)
+	}
+
+	// The MQTT broker refuses every client without credentials
+	if config.MQTTEnabled && config.MQTTCredentialsPath == "" {
+		return errors.New("MQTT_CREDENTIALS_PATH is required when MQTT_ENABLED is set")
+	}
+
+	// The OPC UA server needs an address space to expose and users to log in
+	if config.OPCUAServerEnabled && (config.OPCUAServerConfigPath == "" || config.OPCUAServerCredentialsPath == "") {
+		return errors.New("OPCUA_SERVER_CONFIG_PATH and OPCUA_SERVER_CREDENTIALS_PATH are required when OPCUA_SERVER_ENABLED is set")
+	}
+
 	return nil
 }
 
@@ -148,6 +369,24 @@ func getEnvAsBool(name string, defaultVal bool) bool {
 	return defaultVal
 }
 
+// getEnvAsFloat fetches an environment variable and converts it to a float, or returns a default value
+func getEnvAsFloat(name string, defaultVal float64) float64 {
+	valStr := getEnv(name, "")
+	if val, err := strconv.ParseFloat(valStr, 64); err == nil {
+		return val
+	}
+	return defaultVal
+}
+
+// getEnvAsDuration fetches an environment variable and parses it as a duration (e.g. "10s"), or returns a default value
+func getEnvAsDuration(name string, defaultVal time.Duration) time.Duration {
+	valStr := getEnv(name, "")
+	if val, err := time.ParseDuration(valStr); err == nil {
+		return val
+	}
+	return defaultVal
+}
+
 // isValidEmail checks if an email address has a valid format
 func isValidEmail(email string) bool {
 	// Basic email validation regex pattern
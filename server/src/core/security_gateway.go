@@ -5,8 +5,10 @@ package core
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"net"
+	"os"
 	"time"
 
 	"server/utils"
@@ -17,6 +19,7 @@ type SecurityGateway struct {
 	config           *Config
 	logger           *utils.Logger
 	tlsConfig        *tls.Config
+	rootCAs          *x509.CertPool // CAs trusted for outbound TLS; nil uses the system roots
 	idsEnabled       bool // Flag to enable or disable IDS/IPS
 	ctx              context.Context
 	cancel           context.CancelFunc
@@ -87,6 +90,17 @@ func (s *SecurityGateway) initTLSConfig() error {
 		MinVersion:   tls.VersionTLS12, // Ensuring strong TLS encryption
 	}
 
+	if s.config.SSLCAPath != "" {
+		pem, err := os.ReadFile(s.config.SSLCAPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		s.rootCAs = x509.NewCertPool()
+		if !s.rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", s.config.SSLCAPath)
+		}
+	}
+
 	return nil
 }
 
@@ -149,6 +163,44 @@ func (s *SecurityGateway) SecureListener(address string) (net.Listener, error) {
 	return listener, nil
 }
 
+// DialTLS connects to address over TLS, presenting the gateway's certificate and verifying the peer's
+// against the configured CA bundle, or the system roots without one. The peer's certificate must name
+// serverName, or the host of address when serverName is empty.
+func (s *SecurityGateway) DialTLS(ctx context.Context, address, serverName string) (net.Conn, error) {
+	if s.tlsConfig == nil {
+		return nil, fmt.Errorf("TLS is not initialized")
+	}
+	config := s.tlsConfig.Clone()
+	config.RootCAs = s.rootCAs
+	config.ServerName = serverName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS address %q: %w", address, err)
+		}
+		config.ServerName = host
+	}
+	dialer := &tls.Dialer{Config: config}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s over TLS: %w", address, err)
+	}
+	return conn, nil
+}
+
+// Certificate returns the gateway's certificate and private key, or nil before Initialize has loaded them
+func (s *SecurityGateway) Certificate() *tls.Certificate {
+	if s.tlsConfig == nil || len(s.tlsConfig.Certificates) == 0 {
+		return nil
+	}
+	return &s.tlsConfig.Certificates[0]
+}
+
+// RootCAs returns the CAs loaded from SSLCAPath, or nil when none are configured
+func (s *SecurityGateway) RootCAs() *x509.CertPool {
+	return s.rootCAs
+}
+
 // Stop gracefully stops the traffic monitoring and shuts down security processes
 func (s *SecurityGateway) Stop() {
 	s.logger.Info("Stopping Security Gateway...")
@@ -2,10 +2,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"server/core"
 	"server/modules"
@@ -13,6 +19,17 @@ import (
 )
 
 func main() {
+	// Offline subcommands such as "nimbus analytics replay" run without starting the server
+	if len(os.Args) > 1 && os.Args[1] == "analytics" {
+		os.Exit(runAnalyticsCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "modbus" {
+		os.Exit(runModbusCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "opcua" {
+		os.Exit(runOPCUACommand(os.Args[2:]))
+	}
+
 	// Load configuration settings from environment or config file
 	config, err := core.LoadConfig()
 	if err != nil {
@@ -38,19 +55,151 @@ func main() {
 	}
 	defer dessServer.Stop() // Ensure the DESS server stops gracefully
 
+	// Open the store-and-forward queue that carries alerts, rollups and audit events upstream
+	outboundQueue, err := setupOutboundQueue(config, dessServer)
+	if err != nil {
+		logger.Error("Failed to open outbound queue:", err)
+		return
+	}
+
 	// Initialize Access Control for managing roles and permissions
 	accessControl := modules.NewAccessControl(log.Default(), dessServer.Server())
 	// Add any required access rules or additional logic if needed
+	if outboundQueue != nil {
+		accessControl.SetAuditHandler(func(event modules.AccessEvent) {
+			if err := outboundQueue.Enqueue("audit", event); err != nil {
+				logger.Error("Failed to spool audit event:", err)
+			}
+		})
+	}
+
+	// Initialize the alert notification sinks configured in the environment
+	notificationDispatcher := setupAlertNotifiers(config, dessServer, outboundQueue)
+	sendAlert := notificationDispatcher.AlertHandler("analytics_engine", modules.SeverityWarning)
 
 	// Initialize the Analytics Engine for processing real-time data and detecting anomalies
-	analyticsEngine := modules.NewAnalyticsEngine(config.AnomalyThreshold, log.Default(), func(msg string) {
-		// Handle anomaly alerts (e.g., log or send notifications)
+	overflowPolicy, err := modules.ParseOverflowPolicy(config.IngestOverflowPolicy)
+	if err != nil {
+		logger.Error("Invalid ingestion overflow policy:", err)
+		return
+	}
+	ingestOptions := modules.DefaultIngestOptions()
+	ingestOptions.Capacity = config.IngestBufferSize
+	ingestOptions.Overflow = overflowPolicy
+	analyticsEngine := modules.NewAnalyticsEngineWithOptions(config.AnomalyThreshold, log.Default(), func(msg string) {
+		// Handle anomaly alerts by logging them and fanning them out to the notification sinks
 		logger.Warn(msg)
-	}, dessServer.Server())
-	analyticsEngine.StartProcessing(config.AnalyticsInterval) // Start real-time analytics
+		sendAlert(msg)
+	}, dessServer.Server(), ingestOptions)
+	if err := setupAnalyticsStages(config, analyticsEngine, notificationDispatcher.Dispatch); err != nil {
+		logger.Error("Failed to set up analytics:", err)
+		return
+	}
+	rollups, err := setupRollups(config, analyticsEngine, outboundQueue)
+	if err != nil {
+		logger.Error("Failed to set up telemetry rollups:", err)
+		return
+	}
+	timeSeriesStore, err := setupTimeSeriesStore(config, analyticsEngine)
+	if err != nil {
+		logger.Error("Failed to open time-series store:", err)
+		return
+	}
+	if err := analyticsEngine.SetBaselinePath(filepath.Join(config.StoragePath, "analytics", "baselines.json")); err != nil {
+		logger.Error("Failed to load detector baselines:", err)
+		return
+	}
+	// Keep the static routes of the route table connected; their topics are shared with the broker
+	topicRouting, err := setupRouting(config, securityGateway, accessControl)
+	if err != nil {
+		logger.Error("Failed to set up routing:", err)
+		return
+	}
 
-	// Set up signal handling for graceful shutdown
-	setupSignalHandler(dessServer, securityGateway, analyticsEngine, logger)
+	// Translate values between industrial protocols on the topics of the routes
+	protocolGateway, err := setupProtocolGateway(config, accessControl, topicRouting)
+	if err != nil {
+		logger.Error("Failed to start protocol gateway:", err)
+		return
+	}
+
+	// Start the embedded MQTT broker, whose clients authenticate against AccessControl roles
+	mqttBroker, err := setupMQTTBroker(config, securityGateway, accessControl, topicRouting, analyticsEngine)
+	if err != nil {
+		logger.Error("Failed to start MQTT broker:", err)
+		return
+	}
+	publish := topicPublisher(mqttBroker, topicRouting)
+
+	// Start polling the Modbus devices in the configured device maps
+	modbusPoller, err := setupModbusPoller(config, accessControl, analyticsEngine, protocolGateway)
+	if err != nil {
+		logger.Error("Failed to start Modbus poller:", err)
+		return
+	}
+
+	// Subscribe to the variables of the configured OPC UA servers, publishing their values to the topics
+	opcuaClient, err := setupOPCUAClient(config, securityGateway, analyticsEngine, publish)
+	if err != nil {
+		logger.Error("Failed to start OPC UA client:", err)
+		return
+	}
+
+	// Expose analytics results to SCADA systems over OPC UA; written commands are published to the topics
+	opcuaServer, err := setupOPCUAServer(config, securityGateway, accessControl, analyticsEngine, rollups, notificationDispatcher, publish)
+	if err != nil {
+		logger.Error("Failed to start OPC UA server:", err)
+		return
+	}
+
+	// Start real-time analytics once every stage and observer is attached
+	analyticsEngine.StartProcessing(context.Background(), config.AnalyticsInterval)
+
+	// Set up signal handling for graceful shutdown; components stop in this order so that
+	// data flushed by one step can still be accepted by the steps after it
+	var shutdownSteps []shutdownStep
+	if modbusPoller != nil {
+		shutdownSteps = append(shutdownSteps, shutdownStep{"Modbus poller", modbusPoller.Stop})
+	}
+	if opcuaClient != nil {
+		shutdownSteps = append(shutdownSteps, shutdownStep{"OPC UA client", opcuaClient.Stop})
+	}
+	if opcuaServer != nil {
+		shutdownSteps = append(shutdownSteps, shutdownStep{"OPC UA server", func(context.Context) error { return opcuaServer.Close() }})
+	}
+	if protocolGateway != nil {
+		// Stop translating once the sources have stopped, before the broker that carries the results
+		shutdownSteps = append(shutdownSteps, shutdownStep{"protocol gateway", protocolGateway.Stop})
+	}
+	if topicRouting != nil {
+		// Close the static routes; undelivered acknowledged messages stay in the outbox
+		shutdownSteps = append(shutdownSteps, shutdownStep{"routing manager", func(context.Context) error { return topicRouting.Close() }})
+	}
+	if mqttBroker != nil {
+		// Stop MQTT ingestion before the analytics engine drains, and save sessions and retained messages
+		shutdownSteps = append(shutdownSteps, shutdownStep{"MQTT broker", func(context.Context) error { return mqttBroker.Close() }})
+	}
+	shutdownSteps = append(shutdownSteps, shutdownStep{"analytics engine", analyticsEngine.Stop})
+	if timeSeriesStore != nil {
+		// Seal buffered samples to disk so the WAL does not need replaying on the next start
+		shutdownSteps = append(shutdownSteps, shutdownStep{"time-series store", func(context.Context) error { return timeSeriesStore.Close() }})
+	}
+	// Deliver any alerts still queued for the notification sinks
+	shutdownSteps = append(shutdownSteps, shutdownStep{"notification dispatcher", notificationDispatcher.Stop})
+	// Spool the audit events still waiting for the forwarder before the outbound queue closes
+	shutdownSteps = append(shutdownSteps, shutdownStep{"audit forwarder", accessControl.StopAudit})
+	if outboundQueue != nil {
+		// Close the outbound spool; undelivered messages are replayed on the next start
+		shutdownSteps = append(shutdownSteps, shutdownStep{"outbound queue", func(context.Context) error { return outboundQueue.Close() }})
+	}
+	shutdownSteps = append(shutdownSteps,
+		shutdownStep{"security gateway", func(context.Context) error {
+			securityGateway.Stop()
+			return nil
+		}},
+		shutdownStep{"DESS server", func(context.Context) error { return dessServer.Stop() }},
+	)
+	setupSignalHandler(shutdownSteps, config.ShutdownTimeout, logger)
 
 	// Log that the server is running
 	logger.Info("Nimbus Edge Server is running...")
@@ -59,8 +208,411 @@ func main() {
 	select {}
 }
 
+// setupOutboundQueue opens the durable upstream queue; it returns nil when no upstream is configured
+func setupOutboundQueue(config *core.Config, dessServer *core.AtSecondaryServer) (*modules.OutboundQueue, error) {
+	var transport modules.OutboundTransport
+	switch {
+	case config.UpstreamURL != "":
+		transport = modules.NewHTTPTransport(config.UpstreamURL, config.UpstreamToken, 30*time.Second)
+	case config.UpstreamAtSign != "":
+		transport = modules.NewAtSignTransport(dessServer.Server(), config.UpstreamAtSign, config.Namespace)
+	default:
+		return nil, nil
+	}
+
+	options := modules.DefaultOutboundQueueOptions()
+	options.MaxBytes = int64(config.OutboundQueueMaxMB) << 20
+	return modules.OpenOutboundQueue(filepath.Join(config.StoragePath, "outbound"), options, transport, log.Default())
+}
+
+// setupAlertNotifiers creates the notification dispatcher and registers every alert sink that has been configured
+func setupAlertNotifiers(config *core.Config, dessServer *core.AtSecondaryServer, outboundQueue *modules.OutboundQueue) *modules.NotificationDispatcher {
+	policy := modules.DefaultRetryPolicy()
+	policy.MaxAttempts = config.AlertMaxAttempts
+	dispatcher := modules.NewNotificationDispatcher(log.Default(), policy, config.AlertDeadLetterPath)
+
+	if config.AlertWebhookURL != "" {
+		dispatcher.Register(modules.NewWebhookNotifier(config.AlertWebhookURL, config.AlertWebhookSecret, 10*time.Second))
+	}
+	if config.AlertSMTPAddr != "" {
+		recipients := strings.Split(config.AlertEmailTo, ",")
+		for i := range recipients {
+			recipients[i] = strings.TrimSpace(recipients[i])
+		}
+		dispatcher.Register(modules.NewSMTPNotifier(config.AlertSMTPAddr, config.AlertSMTPUsername, config.AlertSMTPPassword, config.AlertEmailFrom, recipients))
+	}
+	if config.AlertSyslogAddr != "" {
+		dispatcher.Register(modules.NewSyslogNotifier(config.AlertSyslogNetwork, config.AlertSyslogAddr, config.Namespace))
+	}
+	if config.AlertMQTTBroker != "" {
+		clientID := strings.TrimPrefix(config.AtSign, "@") + "-alerts"
+		dispatcher.Register(modules.NewMQTTNotifier(config.AlertMQTTBroker, clientID, config.AlertMQTTTopic, config.AlertMQTTUsername, config.AlertMQTTPassword, 1))
+	}
+	if config.AlertOperatorAtSign != "" {
+		dispatcher.Register(modules.NewAtSignNotifier(dessServer.Server(), config.AlertOperatorAtSign, config.Namespace))
+	}
+	if outboundQueue != nil {
+		dispatcher.Register(outboundQueue.AlertNotifier())
+	}
+
+	return dispatcher
+}
+
+// setupRollups attaches a rollup aggregator to the analytics engine that stores aggregates locally and optionally forwards them upstream; it returns nil when rollups are disabled
+func setupRollups(config *core.Config, analyticsEngine *modules.AnalyticsEngine, outboundQueue *modules.OutboundQueue) (*modules.RollupAggregator, error) {
+	if !config.RollupsEnabled {
+		return nil, nil
+	}
+
+	rollupConfigs := []modules.RollupConfig{modules.DefaultRollupConfig()}
+	if config.RollupConfigPath != "" {
+		loaded, err := modules.LoadRollupConfigs(config.RollupConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		rollupConfigs = loaded
+	}
+
+	rollups, err := modules.NewRollupAggregator(log.Default(), rollupConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := modules.NewFileRollupStore(filepath.Join(config.StoragePath, "rollups"))
+	if err != nil {
+		return nil, err
+	}
+	rollups.AddSink(store)
+
+	if outboundQueue != nil {
+		resolutions := strings.Split(config.RollupUpstreamResolutions, ",")
+		rollups.AddSink(modules.NewUpstreamRollupForwarder(outboundQueue, resolutions))
+	}
+
+	analyticsEngine.SetRollupAggregator(rollups)
+	return rollups, nil
+}
+
+// setupAnalyticsStages attaches data-quality screening and the configured analytics stages to the engine.
+// The replay command uses it too, so recorded data is analysed exactly as in production.
+func setupAnalyticsStages(config *core.Config, analyticsEngine *modules.AnalyticsEngine, alert func(modules.Alert)) error {
+	if err := setupDataQuality(config, analyticsEngine, alert); err != nil {
+		return fmt.Errorf("data quality checks: %w", err)
+	}
+	if err := setupForecasting(config, analyticsEngine, alert); err != nil {
+		return fmt.Errorf("forecasting: %w", err)
+	}
+	if err := setupCorrelationDetection(config, analyticsEngine, alert); err != nil {
+		return fmt.Errorf("correlation detection: %w", err)
+	}
+	if err := setupPipelines(config, analyticsEngine, alert); err != nil {
+		return fmt.Errorf("stream pipelines: %w", err)
+	}
+	if err := setupUserFunctions(config, analyticsEngine); err != nil {
+		return fmt.Errorf("user functions: %w", err)
+	}
+	return nil
+}
+
+// setupDataQuality screens samples before they reach the analytics engine; sensor faults go to the notification sinks
+func setupDataQuality(config *core.Config, analyticsEngine *modules.AnalyticsEngine, alert func(modules.Alert)) error {
+	if !config.DataQualityEnabled {
+		return nil
+	}
+
+	var rules []modules.DataQualityConfig
+	if config.DataQualityConfigPath != "" {
+		var err error
+		if rules, err = modules.LoadDataQualityConfigs(config.DataQualityConfigPath); err != nil {
+			return err
+		}
+	}
+	monitor, err := modules.NewDataQualityMonitor(log.Default(), rules, alert)
+	if err != nil {
+		return err
+	}
+	analyticsEngine.SetDataQualityMonitor(monitor)
+	return nil
+}
+
+// setupForecasting attaches predictive models to the analytics engine; predicted limit crossings are sent to the alert sinks
+func setupForecasting(config *core.Config, analyticsEngine *modules.AnalyticsEngine, alert func(modules.Alert)) error {
+	if config.ForecastConfigPath == "" {
+		return nil
+	}
+
+	forecastConfigs, err := modules.LoadForecastConfigs(config.ForecastConfigPath)
+	if err != nil {
+		return err
+	}
+	forecaster, err := modules.NewForecaster(log.Default(), forecastConfigs, alert)
+	if err != nil {
+		return err
+	}
+	analyticsEngine.AddStage(forecaster)
+	return nil
+}
+
+// setupCorrelationDetection attaches cross-sensor anomaly detection for the configured series groups
+func setupCorrelationDetection(config *core.Config, analyticsEngine *modules.AnalyticsEngine, alert func(modules.Alert)) error {
+	if config.CorrelationConfigPath == "" {
+		return nil
+	}
+
+	groups, err := modules.LoadCorrelationGroups(config.CorrelationConfigPath)
+	if err != nil {
+		return err
+	}
+	detector, err := modules.NewCorrelationDetector(log.Default(), groups, alert)
+	if err != nil {
+		return err
+	}
+	analyticsEngine.AddStage(detector)
+	return nil
+}
+
+// setupPipelines starts the configured stream processing pipelines; derived series are fed back into the analytics engine
+func setupPipelines(config *core.Config, analyticsEngine *modules.AnalyticsEngine, alert func(modules.Alert)) error {
+	if config.PipelineConfigPath == "" {
+		return nil
+	}
+
+	pipelines, err := modules.LoadPipelineConfigs(config.PipelineConfigPath)
+	if err != nil {
+		return err
+	}
+	processor, err := modules.NewStreamProcessor(log.Default(), pipelines, analyticsEngine.AddDerived, alert)
+	if err != nil {
+		return err
+	}
+	analyticsEngine.AddStage(processor)
+	return nil
+}
+
+// setupUserFunctions compiles the configured user-defined functions; their results are fed back into the analytics engine as derived series
+func setupUserFunctions(config *core.Config, analyticsEngine *modules.AnalyticsEngine) error {
+	if config.FunctionConfigPath == "" {
+		return nil
+	}
+
+	functions, err := modules.LoadUserFunctionConfigs(config.FunctionConfigPath)
+	if err != nil {
+		return err
+	}
+	userFunctions, err := modules.NewUserFunctions(log.Default(), functions, analyticsEngine.AddDerived)
+	if err != nil {
+		return err
+	}
+	analyticsEngine.AddStage(userFunctions)
+	return nil
+}
+
+// setupTimeSeriesStore opens the embedded time-series store and attaches it to the analytics engine; it returns nil when storage is disabled
+func setupTimeSeriesStore(config *core.Config, analyticsEngine *modules.AnalyticsEngine) (*modules.TimeSeriesStore, error) {
+	if !config.TimeSeriesEnabled {
+		return nil, nil
+	}
+
+	options := modules.DefaultTimeSeriesStoreOptions()
+	retention, err := time.ParseDuration(config.TimeSeriesRetention)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TSDB_RETENTION %q: %w", config.TimeSeriesRetention, err)
+	}
+	options.DefaultRetention = retention
+	if config.TimeSeriesRetentionConfig != "" {
+		policies, err := modules.LoadRetentionPolicies(config.TimeSeriesRetentionConfig)
+		if err != nil {
+			return nil, err
+		}
+		options.Retention = policies
+	}
+
+	store, err := modules.OpenTimeSeriesStore(filepath.Join(config.StoragePath, "tsdb"), options, log.Default())
+	if err != nil {
+		return nil, err
+	}
+	analyticsEngine.SetTimeSeriesStore(store)
+	return store, nil
+}
+
+// setupModbusPoller starts polling the devices in the Modbus device maps; it returns nil when none are configured
+func setupModbusPoller(config *core.Config, accessControl *modules.AccessControl, analyticsEngine *modules.AnalyticsEngine, gateway *modules.ProtocolGateway) (*modules.ModbusPoller, error) {
+	if config.ModbusConfigPath == "" {
+		return nil, nil
+	}
+
+	devices, err := modules.LoadModbusConfigs(config.ModbusConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	ingest := analyticsEngine.AddBatch
+	if gateway != nil {
+		// The gateway translates the polled values too, and writes the Modbus targets of its mappings
+		ingest = func(samples []modules.Sample) {
+			analyticsEngine.AddBatch(samples)
+			gateway.ObserveSamples(samples)
+		}
+	}
+	poller, err := modules.NewModbusPoller(log.Default(), devices, accessControl, ingest)
+	if err != nil {
+		return nil, err
+	}
+	if gateway != nil {
+		gateway.SetModbusWriter(poller.WritePoint)
+	}
+	poller.Start()
+	return poller, nil
+}
+
+// setupOPCUAClient subscribes to the variables of the configured OPC UA servers, identifying itself with the
+// gateway's certificate; it returns nil when none are configured
+func setupOPCUAClient(config *core.Config, securityGateway *core.SecurityGateway, analyticsEngine *modules.AnalyticsEngine, publish func(topic string, envelope modules.Envelope) (int, error)) (*modules.OPCUAClient, error) {
+	if config.OPCUAConfigPath == "" {
+		return nil, nil
+	}
+
+	servers, err := modules.LoadOPCUAConfigs(config.OPCUAConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	// Values are published as telemetry only when there are topics to publish them to
+	client, err := modules.NewOPCUAClient(log.Default(), servers, securityGateway.Certificate(), securityGateway.RootCAs(), analyticsEngine.AddBatch, publish)
+	if err != nil {
+		return nil, err
+	}
+	client.Start()
+	return client, nil
+}
+
+// setupOPCUAServer starts the OPC UA server facade, identifying itself with the gateway's certificate, and
+// attaches it to analytics, rollups and alerts; it returns nil when the server is disabled
+func setupOPCUAServer(config *core.Config, securityGateway *core.SecurityGateway, accessControl *modules.AccessControl, analyticsEngine *modules.AnalyticsEngine, rollups *modules.RollupAggregator, dispatcher *modules.NotificationDispatcher, publish func(topic string, envelope modules.Envelope) (int, error)) (*modules.OPCUAServer, error) {
+	if !config.OPCUAServerEnabled {
+		return nil, nil
+	}
+
+	facade, err := modules.LoadOPCUAFacadeConfig(config.OPCUAServerConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	users, err := modules.LoadOPCUAUsers(config.OPCUAServerCredentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	options := modules.DefaultOPCUAServerOptions()
+	options.Certificate = securityGateway.Certificate()
+	options.Authenticate = users.Authenticate
+	options.ClientCAs = securityGateway.RootCAs()
+	options.Health = analyticsEngine.SensorHealth
+	// Commands can be written only when there are topics to publish them to
+	server, err := modules.NewOPCUAServer(options, facade, accessControl, publish, log.Default())
+	if err != nil {
+		return nil, err
+	}
+	// OPC UA secures its own channels, so the listener is plain TCP
+	listener, err := net.Listen("tcp", config.OPCUAServerListenAddr)
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	analyticsEngine.AddStage(server)
+	analyticsEngine.SetAnomalyObserver(server.ObserveAnomaly)
+	if rollups != nil {
+		rollups.AddSink(server)
+	}
+	dispatcher.Register(server)
+	go server.Serve(listener)
+	return server, nil
+}
+
+// setupMQTTBroker starts the embedded MQTT broker on a TLS listener; it returns nil when the broker is disabled
+func setupMQTTBroker(config *core.Config, securityGateway *core.SecurityGateway, accessControl *modules.AccessControl, topicRouting *modules.RoutingManager, analyticsEngine *modules.AnalyticsEngine) (*modules.MQTTBroker, error) {
+	if !config.MQTTEnabled {
+		return nil, nil
+	}
+
+	credentials, err := modules.LoadMQTTCredentials(config.MQTTCredentialsPath)
+	if err != nil {
+		return nil, err
+	}
+	options := modules.DefaultMQTTBrokerOptions()
+	options.Authenticate = credentials.Authenticate
+	options.StatePath = filepath.Join(config.StoragePath, "mqtt", "state.json")
+	for _, filter := range strings.Split(config.MQTTIngestTopics, ",") {
+		if filter = strings.TrimSpace(filter); filter != "" {
+			options.IngestTopics = append(options.IngestTopics, filter)
+		}
+	}
+
+	// Topics are shared with the routes, so messages reach static routes and the protocol gateway
+	broker, err := modules.NewMQTTBroker(options, accessControl, topicRouting, analyticsEngine.AddBatch, log.Default())
+	if err != nil {
+		return nil, err
+	}
+	listener, err := securityGateway.SecureListener(config.MQTTListenAddr)
+	if err != nil {
+		broker.Close()
+		return nil, err
+	}
+	go broker.Serve(listener)
+	return broker, nil
+}
+
+// setupRouting creates the RoutingManager that maintains the static routes of the route table and carries
+// the topics of the protocol gateway; it returns nil when neither is configured
+func setupRouting(config *core.Config, securityGateway *core.SecurityGateway, accessControl *modules.AccessControl) (*modules.RoutingManager, error) {
+	if config.RouteTablePath == "" && config.GatewayMappingsPath == "" {
+		return nil, nil
+	}
+
+	// Static routes are declared by the operator, so they are not checked against DESS
+	routing := modules.NewRoutingManager(log.Default(), nil)
+	routing.SetAccessControl(accessControl)
+	// TLS routes trust the configured CA bundle and present the gateway's certificate to peers that ask for one
+	routing.SetTLSDialer(securityGateway.DialTLS)
+	if config.RouteTablePath != "" {
+		if err := routing.OpenRouteTable(config.RouteTablePath); err != nil {
+			return nil, err
+		}
+		routing.MonitorRoutes(config.RouteHeartbeatInterval)
+	}
+	return routing, nil
+}
+
+// setupProtocolGateway loads the protocol translation mappings and starts the gateway on the topics of the
+// routes; it returns nil when no mappings are configured
+func setupProtocolGateway(config *core.Config, accessControl *modules.AccessControl, routing *modules.RoutingManager) (*modules.ProtocolGateway, error) {
+	if config.GatewayMappingsPath == "" {
+		return nil, nil
+	}
+
+	mappings, err := modules.LoadGatewayMappings(config.GatewayMappingsPath)
+	if err != nil {
+		return nil, err
+	}
+	return modules.NewProtocolGateway(modules.DefaultProtocolGatewayOptions(), mappings, accessControl, routing, log.Default())
+}
+
+// topicPublisher returns the function OPC UA values and commands are published with: the MQTT broker's,
+// which passes messages on to the routes, or the routes' own without a broker; nil without either
+func topicPublisher(mqttBroker *modules.MQTTBroker, topicRouting *modules.RoutingManager) func(topic string, envelope modules.Envelope) (int, error) {
+	switch {
+	case mqttBroker != nil:
+		return mqttBroker.Publish
+	case topicRouting != nil:
+		return topicRouting.Publish
+	}
+	return nil
+}
+
+// shutdownStep is a named component stopped during graceful shutdown
+type shutdownStep struct {
+	name string                          // Component name used in shutdown logs
+	stop func(ctx context.Context) error // Stops the component, honouring the shutdown deadline where supported
+}
+
 // setupSignalHandler captures OS signals (e.g., SIGINT, SIGTERM) to gracefully shut down the server
-func setupSignalHandler(dessServer *core.AtSecondaryServer, securityGateway *core.SecurityGateway, analyticsEngine *modules.AnalyticsEngine, logger *utils.Logger) {
+func setupSignalHandler(steps []shutdownStep, timeout time.Duration, logger *utils.Logger) {
 	// Create a channel to listen for termination signals
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -70,15 +622,14 @@ func setupSignalHandler(dessServer *core.AtSecondaryServer, securityGateway *cor
 		<-sigs
 		logger.Info("Shutdown signal received. Shutting down Nimbus Edge Server...")
 
-		// Stop the Analytics Engine to halt real-time data processing
-		analyticsEngine.Stop()
-
-		// Stop the Security Gateway (e.g., stop monitoring and encryption services)
-		securityGateway.Stop()
+		// All steps share one deadline so a stuck component cannot hold up shutdown indefinitely
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
 
-		// Stop the DESS server gracefully
-		if err := dessServer.Stop(); err != nil {
-			logger.Error("Error stopping DESS server:", err)
+		for _, step := range steps {
+			if err := step.stop(ctx); err != nil {
+				logger.Error("Error stopping "+step.name+":", err)
+			}
 		}
 
 		logger.Info("Nimbus Edge Server shutdown complete.")
@@ -0,0 +1,100 @@
+// server/src/modbus_command.go
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"server/modules"
+)
+
+// runModbusCommand dispatches "nimbus modbus <subcommand>" and returns the process exit code.
+func runModbusCommand(args []string) int {
+	if len(args) == 0 || args[0] != "simulate" {
+		fmt.Fprintln(os.Stderr, "usage: nimbus modbus simulate [flags]")
+		return 2
+	}
+	if err := runModbusSimulator(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "simulate:", err)
+		return 1
+	}
+	return 0
+}
+
+// runModbusSimulator serves simulated Modbus devices. With a device map, the input registers and
+// discrete inputs it names follow a sine wave, so the poller has changing values to read; holding
+// registers and coils keep whatever is written to them.
+func runModbusSimulator(args []string) error {
+	flags := flag.NewFlagSet("nimbus modbus simulate", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:5020", "address to serve Modbus TCP on")
+	configPath := flags.String("config", "", "Modbus device map (JSON) whose read-only points are animated")
+	period := flags.Duration("period", time.Minute, "period of the simulated sine wave")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *period <= 0 {
+		return fmt.Errorf("-period must be positive")
+	}
+
+	var devices []modules.ModbusDeviceConfig
+	if *configPath != "" {
+		var err error
+		if devices, err = modules.LoadModbusConfigs(*configPath); err != nil {
+			return err
+		}
+		// Reject the device maps the server would reject
+		if _, err := modules.NewModbusPoller(log.Default(), devices, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	simulator := modules.NewModbusSimulator(log.Default())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		simulator.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		start := time.Now()
+		for {
+			// The wave runs from 0 to 100 in engineering units; bits are set for its upper half
+			phase := 2 * math.Pi * float64(time.Since(start)) / float64(*period)
+			value := 50 + 50*math.Sin(phase)
+			for _, device := range devices {
+				for _, point := range device.Points {
+					if point.Table != modules.ModbusInputRegister && point.Table != modules.ModbusDiscreteInput {
+						continue
+					}
+					pointValue := value
+					if point.Table == modules.ModbusDiscreteInput {
+						pointValue = math.Round(value / 100)
+					}
+					if err := simulator.SetPointValue(device, point.Name, pointValue); err != nil {
+						log.Printf("Modbus simulator: %s.%s: %v\n", device.Name, point.Name, err)
+					}
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return simulator.Serve(listener)
+}
@@ -2,9 +2,11 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/atsign-foundation/at_server/server" // Assuming this is the correct import path for DESS server package
@@ -22,21 +24,51 @@ const (
 
 // AccessControl manages permissions, roles, and secure access to the server.
 type AccessControl struct {
-	permissions    sync.Map         // Stores access permissions for devices with associated roles
-	logger         *log.Logger      // Logger for recording access control activities
-	auditLog       []AccessEvent    // Stores audit logs for access events
-	auditMutex     sync.Mutex       // Mutex for concurrent access to audit logs
-	dessServer     *server.AtServer // Reference to the DESS server for authentication and access control
+	permissions    sync.Map          // Stores access permissions for devices with associated roles
+	logger         *log.Logger       // Logger for recording access control activities
+	auditLog       []AccessEvent     // Stores audit logs for access events
+	auditMutex     sync.Mutex        // Mutex for concurrent access to audit logs
+	auditHandler   func(AccessEvent) // Optional handler receiving forwarded audit events, e.g. for upstream forwarding
+	auditPending   []AccessEvent     // Events waiting for the audit handler, oldest first
+	auditWake      *sync.Cond        // Signals the audit forwarder; nil until a handler is set
+	auditStopped   bool              // Set by StopAudit; later events are only recorded locally
+	auditDone      chan struct{}     // Closed when the audit forwarder has handed over every pending event
+	topicRules     []TopicRule       // Roles required to subscribe and publish to topics
+	topicMutex     sync.RWMutex      // Read-write mutex for the topic rules
+	rulesVersion   uint64            // Incremented whenever a grant or topic rule changes
+	dessServer     *server.AtServer  // Reference to the DESS server for authentication and access control
 }
 
 // AccessEvent represents an access attempt or change
 type AccessEvent struct {
-	DeviceID  string
-	Timestamp time.Time
-	Action    string
-	Role      Role
+	DeviceID  string    `json:"device_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Role      Role      `json:"role"`
 }
 
+// TopicAction is an operation on a topic that AccessControl authorizes
+type TopicAction string
+
+const (
+	TopicSubscribe TopicAction = "subscribe"
+	TopicPublish   TopicAction = "publish"
+)
+
+// DefaultTopicRole is the role required for topics that no topic rule covers
+const DefaultTopicRole = UserRole
+
+// TopicRule sets the roles required to subscribe and publish to the topics matching a filter. An empty
+// role stands for DefaultTopicRole.
+type TopicRule struct {
+	Filter    string `json:"filter"`
+	Subscribe Role   `json:"subscribe"`
+	Publish   Role   `json:"publish"`
+}
+
+// maxAuditLogEvents caps the in-memory audit log; the oldest events are discarded first
+const maxAuditLogEvents = 10000
+
 // NewAccessControl initializes a new AccessControl instance with logging and DESS server integration
 func NewAccessControl(logger *log.Logger, dessServer *server.AtServer) *AccessControl {
 	return &AccessControl{
@@ -46,9 +78,69 @@ func NewAccessControl(logger *log.Logger, dessServer *server.AtServer) *AccessCo
 	}
 }
 
+// SetAuditHandler registers a handler that receives every audit event, in order, on a goroutine of its
+// own so a slow handler never delays access checks. Events are never dropped; call StopAudit on shutdown
+// to wait until the handler has received all of them.
+func (ac *AccessControl) SetAuditHandler(handler func(AccessEvent)) {
+	ac.auditMutex.Lock()
+	defer ac.auditMutex.Unlock()
+	ac.auditHandler = handler
+	if ac.auditWake == nil {
+		ac.auditWake = sync.NewCond(&ac.auditMutex)
+		ac.auditDone = make(chan struct{})
+		go ac.forwardAuditEvents()
+	}
+}
+
+// StopAudit stops forwarding after the audit handler has received every event recorded so far. Events
+// recorded afterwards are kept in the audit log only.
+func (ac *AccessControl) StopAudit(ctx context.Context) error {
+	ac.auditMutex.Lock()
+	done := ac.auditDone
+	ac.auditStopped = true
+	if ac.auditWake != nil {
+		ac.auditWake.Broadcast()
+	}
+	ac.auditMutex.Unlock()
+
+	if done == nil {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("audit events still pending: %w", ctx.Err())
+	}
+}
+
+// forwardAuditEvents hands pending audit events to the audit handler until StopAudit has been called
+// and nothing is left
+func (ac *AccessControl) forwardAuditEvents() {
+	defer close(ac.auditDone)
+	for {
+		ac.auditMutex.Lock()
+		for len(ac.auditPending) == 0 && !ac.auditStopped {
+			ac.auditWake.Wait()
+		}
+		batch := ac.auditPending
+		ac.auditPending = nil
+		handler := ac.auditHandler
+		ac.auditMutex.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		for _, event := range batch {
+			handler(event)
+		}
+	}
+}
+
 // GrantAccess grants access to a specific device ID with a specified role
 func (ac *AccessControl) GrantAccess(deviceID string, role Role) {
 	ac.permissions.Store(deviceID, role)
+	atomic.AddUint64(&ac.rulesVersion, 1)
 	ac.logger.Printf("Access granted to device %s with role %s\n", deviceID, role)
 	ac.logAccessEvent(deviceID, "granted access", role)
 }
@@ -56,6 +148,7 @@ func (ac *AccessControl) GrantAccess(deviceID string, role Role) {
 // RevokeAccess revokes access for a specific device ID
 func (ac *AccessControl) RevokeAccess(deviceID string) {
 	ac.permissions.Delete(deviceID)
+	atomic.AddUint64(&ac.rulesVersion, 1)
 	ac.logger.Printf("Access revoked for device %s\n", deviceID)
 	ac.logAccessEvent(deviceID, "revoked access", NoAccess)
 }
@@ -100,11 +193,8 @@ func (ac *AccessControl) roleSufficient(currentRole, requiredRole Role) bool {
 	return roles[currentRole] >= roles[requiredRole]
 }
 
-// logAccessEvent records access events to the audit log
+// logAccessEvent records access events to the audit log and queues them for the audit handler
 func (ac *AccessControl) logAccessEvent(deviceID, action string, role Role) {
-	ac.auditMutex.Lock()
-	defer ac.auditMutex.Unlock()
-
 	event := AccessEvent{
 		DeviceID:  deviceID,
 		Timestamp: time.Now(),
@@ -112,13 +202,131 @@ func (ac *AccessControl) logAccessEvent(deviceID, action string, role Role) {
 		Role:      role,
 	}
 
+	ac.auditMutex.Lock()
 	ac.auditLog = append(ac.auditLog, event)
+	// Trim in batches so the oldest events are not shifted out one append at a time
+	if excess := len(ac.auditLog) - maxAuditLogEvents; excess >= maxAuditLogEvents/4 {
+		ac.auditLog = ac.auditLog[:copy(ac.auditLog, ac.auditLog[excess:])]
+	}
+	if ac.auditWake != nil && !ac.auditStopped {
+		ac.auditPending = append(ac.auditPending, event)
+		ac.auditWake.Signal()
+	}
+	ac.auditMutex.Unlock()
 	ac.logger.Printf("Audit log recorded: %v", event)
 }
 
-// GetAuditLog returns a copy of the audit log for review
+// GetAuditLog returns a copy of the recent audit log, which keeps at least the last maxAuditLogEvents events, for review
 func (ac *AccessControl) GetAuditLog() []AccessEvent {
 	ac.auditMutex.Lock()
 	defer ac.auditMutex.Unlock()
 	return append([]AccessEvent(nil), ac.auditLog...) // Returns a copy of the audit log
 }
+
+// SetTopicRule adds a topic rule, replacing any rule with the same filter
+func (ac *AccessControl) SetTopicRule(rule TopicRule) error {
+	if err := ValidateTopicFilter(rule.Filter); err != nil {
+		return err
+	}
+	ac.topicMutex.Lock()
+	defer ac.topicMutex.Unlock()
+	defer atomic.AddUint64(&ac.rulesVersion, 1)
+	for i, existing := range ac.topicRules {
+		if existing.Filter == rule.Filter {
+			ac.topicRules[i] = rule
+			return nil
+		}
+	}
+	ac.topicRules = append(ac.topicRules, rule)
+	return nil
+}
+
+// RulesVersion returns a counter that changes whenever a grant or topic rule changes, so callers can
+// cache authorization decisions until it moves
+func (ac *AccessControl) RulesVersion() uint64 {
+	return atomic.LoadUint64(&ac.rulesVersion)
+}
+
+// RemoveTopicRule removes the topic rule with the given filter
+func (ac *AccessControl) RemoveTopicRule(filter string) {
+	ac.topicMutex.Lock()
+	defer ac.topicMutex.Unlock()
+	for i, existing := range ac.topicRules {
+		if existing.Filter == filter {
+			ac.topicRules = append(ac.topicRules[:i], ac.topicRules[i+1:]...)
+			atomic.AddUint64(&ac.rulesVersion, 1)
+			return
+		}
+	}
+}
+
+// CheckTopicAccess checks if a device may publish or subscribe to a topic. The most specific topic rule
+// covering the topic decides the role required.
+func (ac *AccessControl) CheckTopicAccess(deviceID, topic string, action TopicAction) bool {
+	required, _ := ac.topicRoles(topic, action)
+	if !ac.CheckAccess(deviceID, required) {
+		ac.logger.Printf("Topic access denied: device %s may not %s %s\n", deviceID, action, topic)
+		return false
+	}
+	return true
+}
+
+// AuthorizeSubscription checks if a device may subscribe to a topic filter, which the most specific
+// rule covering all of its topics decides. Narrower rules inside the filter may require a role the
+// device lacks; their filters are returned, and topics matching them must not be delivered to it.
+func (ac *AccessControl) AuthorizeSubscription(deviceID, filter string) ([]string, bool) {
+	required, narrower := ac.topicRoles(filter, TopicSubscribe)
+	if !ac.CheckAccess(deviceID, required) {
+		ac.logger.Printf("Topic access denied: device %s may not subscribe to %s\n", deviceID, filter)
+		return nil, false
+	}
+	value, _ := ac.permissions.Load(deviceID)
+	role, _ := value.(Role)
+
+	var excluded []string
+	for _, rule := range narrower {
+		if !ac.roleSufficient(role, rule.role(TopicSubscribe)) {
+			excluded = append(excluded, rule.Filter)
+		}
+	}
+	if len(excluded) > 0 {
+		ac.logger.Printf("Subscription of device %s to %s excludes %v\n", deviceID, filter, excluded)
+	}
+	return excluded, true
+}
+
+// topicRoles returns the role required for an action on a topic filter, and the rules that cover only
+// part of the filter
+func (ac *AccessControl) topicRoles(filter string, action TopicAction) (Role, []TopicRule) {
+	ac.topicMutex.RLock()
+	defer ac.topicMutex.RUnlock()
+
+	required, specificity := DefaultTopicRole, -1
+	var narrower []TopicRule
+	for _, rule := range ac.topicRules {
+		switch {
+		case topicFilterCovers(rule.Filter, filter):
+			// Between equally specific rules the stricter one wins
+			score := topicSpecificity(rule.Filter)
+			role := rule.role(action)
+			if score > specificity || score == specificity && !ac.roleSufficient(required, role) {
+				required, specificity = role, score
+			}
+		case topicFiltersOverlap(rule.Filter, filter):
+			narrower = append(narrower, rule)
+		}
+	}
+	return required, narrower
+}
+
+// role returns the role the rule requires for an action
+func (rule TopicRule) role(action TopicAction) Role {
+	role := rule.Subscribe
+	if action == TopicPublish {
+		role = rule.Publish
+	}
+	if role == "" {
+		return DefaultTopicRole
+	}
+	return role
+}
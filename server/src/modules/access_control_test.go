@@ -0,0 +1,74 @@
+// server/src/modules/access_control_test.go
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuditForwardingKeepsEveryEventInOrder(t *testing.T) {
+	access := NewAccessControl(log.New(io.Discard, "", 0), nil)
+
+	var mutex sync.Mutex
+	var forwarded []string
+	release := make(chan struct{})
+	access.SetAuditHandler(func(event AccessEvent) {
+		<-release // A stalled upstream spool must not cost events
+		mutex.Lock()
+		forwarded = append(forwarded, event.DeviceID)
+		mutex.Unlock()
+	})
+
+	const events = 3000
+	for i := 0; i < events; i++ {
+		access.GrantAccess(fmt.Sprintf("device-%d", i), UserRole)
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := access.StopAudit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(forwarded) != events {
+		t.Fatalf("forwarded %d of %d events", len(forwarded), events)
+	}
+	for i, deviceID := range forwarded {
+		if deviceID != fmt.Sprintf("device-%d", i) {
+			t.Fatalf("event %d forwarded for %s", i, deviceID)
+		}
+	}
+
+	// After StopAudit events stay in the local log only
+	access.RevokeAccess("device-0")
+	if len(forwarded) != events || len(access.GetAuditLog()) != events+1 {
+		t.Fatalf("event after StopAudit forwarded")
+	}
+}
+
+func TestStopAuditHonoursDeadline(t *testing.T) {
+	access := NewAccessControl(log.New(io.Discard, "", 0), nil)
+	if err := access.StopAudit(context.Background()); err != nil {
+		t.Fatalf("StopAudit without a handler returned %v", err)
+	}
+
+	access = NewAccessControl(log.New(io.Discard, "", 0), nil)
+	release := make(chan struct{})
+	defer close(release)
+	access.SetAuditHandler(func(AccessEvent) { <-release })
+	access.GrantAccess("device", UserRole)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := access.StopAudit(ctx); err == nil {
+		t.Fatal("StopAudit returned before the handler took the pending event")
+	}
+}
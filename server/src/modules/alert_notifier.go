@@ -0,0 +1,286 @@
+// server/src/modules/alert_notifier.go
+
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+// AlertSeverity classifies how urgently an alert needs operator attention.
+type AlertSeverity string
+
+const (
+	SeverityInfo     AlertSeverity = "info"
+	SeverityWarning  AlertSeverity = "warning"
+	SeverityCritical AlertSeverity = "critical"
+)
+
+// Alert is a structured notification raised by a Nimbus component.
+type Alert struct {
+	ID        string                 `json:"id"`
+	Source    string                 `json:"source"`
+	Severity  AlertSeverity          `json:"severity"`
+	Message   string                 `json:"message"`
+	Timestamp time.Time              `json:"timestamp"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// AlertNotifier delivers alerts to a single external sink (webhook, email, syslog, ...).
+type AlertNotifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// RetryPolicy controls how often and how quickly failed deliveries are retried.
+type RetryPolicy struct {
+	MaxAttempts    int           // Total delivery attempts per alert, including the first
+	Backoff        utils.Backoff // Delay schedule between attempts
+	AttemptTimeout time.Duration // Deadline for a single delivery attempt
+	QueueSize      int           // Pending alerts buffered per notifier
+}
+
+// DefaultRetryPolicy returns the retry policy used when none is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		Backoff:        utils.Backoff{Initial: time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.2},
+		AttemptTimeout: 10 * time.Second,
+		QueueSize:      256,
+	}
+}
+
+// deadLetter is the record written for alerts that could not be delivered.
+type deadLetter struct {
+	Notifier string    `json:"notifier"`
+	Alert    Alert     `json:"alert"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// notifierWorker pairs a notifier with its pending-alert queue.
+type notifierWorker struct {
+	notifier AlertNotifier
+	queue    chan Alert
+}
+
+// NotificationDispatcher fans alerts out to registered notifiers, retrying failures and dead-lettering what cannot be delivered.
+type NotificationDispatcher struct {
+	workers         []*notifierWorker // One worker per registered notifier
+	workersMutex    sync.RWMutex      // Guards workers and the stopped flag
+	stopped         bool              // Set once Stop has been called
+	policy          RetryPolicy       // Retry behaviour shared by all notifiers
+	deadLetterPath  string            // JSON-lines file receiving undeliverable alerts
+	deadLetterMutex sync.Mutex        // Serialises writes to the dead-letter file
+	logger          *log.Logger       // Logger for tracking delivery events
+	wg              sync.WaitGroup    // Tracks running workers so Stop can drain them
+	ctx             context.Context   // Cancelled when Stop gives up draining, abandoning retries
+	cancel          context.CancelFunc
+}
+
+// NewNotificationDispatcher creates a dispatcher with the given retry policy and dead-letter file.
+func NewNotificationDispatcher(logger *log.Logger, policy RetryPolicy, deadLetterPath string) *NotificationDispatcher {
+	defaults := DefaultRetryPolicy()
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.AttemptTimeout <= 0 {
+		policy.AttemptTimeout = defaults.AttemptTimeout
+	}
+	if policy.QueueSize <= 0 {
+		policy.QueueSize = defaults.QueueSize
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &NotificationDispatcher{
+		workers:        make([]*notifierWorker, 0),
+		policy:         policy,
+		deadLetterPath: deadLetterPath,
+		logger:         logger,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+// Register adds a notifier and starts its delivery worker.
+func (nd *NotificationDispatcher) Register(notifier AlertNotifier) {
+	nd.workersMutex.Lock()
+	defer nd.workersMutex.Unlock()
+
+	if nd.stopped {
+		nd.logger.Printf("Notifier %s not registered: dispatcher is stopped\n", notifier.Name())
+		return
+	}
+
+	worker := &notifierWorker{
+		notifier: notifier,
+		queue:    make(chan Alert, nd.policy.QueueSize),
+	}
+	nd.workers = append(nd.workers, worker)
+
+	nd.wg.Add(1)
+	go nd.run(worker)
+	nd.logger.Printf("Alert notifier %s registered\n", notifier.Name())
+}
+
+// Dispatch queues an alert for delivery to every registered notifier without blocking the caller.
+func (nd *NotificationDispatcher) Dispatch(alert Alert) {
+	if alert.ID == "" {
+		alert.ID = newRandomID()
+	}
+	if alert.Timestamp.IsZero() {
+		alert.Timestamp = time.Now()
+	}
+	if alert.Severity == "" {
+		alert.Severity = SeverityWarning
+	}
+
+	nd.workersMutex.RLock()
+	defer nd.workersMutex.RUnlock()
+
+	if nd.stopped {
+		nd.logger.Printf("Alert %s dropped: dispatcher is stopped\n", alert.ID)
+		return
+	}
+
+	for _, worker := range nd.workers {
+		select {
+		case worker.queue <- alert:
+		default:
+			// A stalled sink must never back up the component raising the alert
+			nd.writeDeadLetter(worker.notifier.Name(), alert, fmt.Errorf("notifier queue full"))
+		}
+	}
+}
+
+// AlertHandler adapts the dispatcher to the func(string) alert handlers used by the analytics engine.
+func (nd *NotificationDispatcher) AlertHandler(source string, severity AlertSeverity) func(string) {
+	return func(message string) {
+		nd.Dispatch(Alert{
+			Source:   source,
+			Severity: severity,
+			Message:  message,
+		})
+	}
+}
+
+// Stop stops accepting alerts and waits until all queued alerts are delivered or dead-lettered. When
+// ctx ends first, pending retries are abandoned, the alerts still queued are dead-lettered and
+// ctx.Err() is returned.
+func (nd *NotificationDispatcher) Stop(ctx context.Context) error {
+	nd.workersMutex.Lock()
+	if !nd.stopped {
+		nd.stopped = true
+		for _, worker := range nd.workers {
+			close(worker.queue)
+		}
+	}
+	nd.workersMutex.Unlock()
+
+	nd.logger.Println("Stopping notification dispatcher, draining pending alerts...")
+	done := make(chan struct{})
+	go func() {
+		nd.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		nd.logger.Println("Notification dispatcher stopped.")
+		return nil
+	case <-ctx.Done():
+		nd.cancel()
+		return fmt.Errorf("notification dispatcher did not finish draining: %w", ctx.Err())
+	}
+}
+
+// run delivers queued alerts for a single notifier until its queue is closed.
+func (nd *NotificationDispatcher) run(worker *notifierWorker) {
+	defer nd.wg.Done()
+	for alert := range worker.queue {
+		nd.deliver(worker.notifier, alert)
+	}
+}
+
+// deliver attempts delivery with exponential backoff, dead-lettering the alert once all attempts fail
+// or Stop abandons the retries.
+func (nd *NotificationDispatcher) deliver(notifier AlertNotifier, alert Alert) {
+	var err error
+	for attempt := 0; attempt < nd.policy.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			timer := time.NewTimer(nd.policy.Backoff.Duration(attempt - 1))
+			select {
+			case <-timer.C:
+			case <-nd.ctx.Done():
+				timer.Stop()
+			}
+		}
+		if nd.ctx.Err() != nil {
+			if err == nil {
+				err = errors.New("dispatcher stopped")
+			}
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(nd.ctx, nd.policy.AttemptTimeout)
+		err = notifier.Notify(ctx, alert)
+		cancel()
+		if err == nil {
+			return
+		}
+		nd.logger.Printf("Notifier %s failed to deliver alert %s (attempt %d/%d): %v\n", notifier.Name(), alert.ID, attempt+1, nd.policy.MaxAttempts, err)
+	}
+
+	nd.writeDeadLetter(notifier.Name(), alert, err)
+}
+
+// writeDeadLetter appends an undeliverable alert to the dead-letter file.
+func (nd *NotificationDispatcher) writeDeadLetter(notifierName string, alert Alert, cause error) {
+	nd.logger.Printf("Alert %s dead-lettered for notifier %s: %v\n", alert.ID, notifierName, cause)
+	if nd.deadLetterPath == "" {
+		return
+	}
+
+	record, err := json.Marshal(deadLetter{
+		Notifier: notifierName,
+		Alert:    alert,
+		Error:    cause.Error(),
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		nd.logger.Printf("Failed to encode dead letter for alert %s: %v\n", alert.ID, err)
+		return
+	}
+
+	nd.deadLetterMutex.Lock()
+	defer nd.deadLetterMutex.Unlock()
+
+	file, err := os.OpenFile(nd.deadLetterPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		nd.logger.Printf("Failed to open dead-letter file %s: %v\n", nd.deadLetterPath, err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(record, '\n')); err != nil {
+		nd.logger.Printf("Failed to write dead letter for alert %s: %v\n", alert.ID, err)
+	}
+}
+
+// newRandomID generates a random identifier used to correlate alerts and messages across sinks.
+func newRandomID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,503 @@
+// server/src/modules/alert_notifier_test.go
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"server/utils"
+)
+
+// testRetryPolicy retries quickly so delivery tests do not wait on the real backoff schedule.
+func testRetryPolicy(attempts int) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    attempts,
+		Backoff:        utils.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond},
+		AttemptTimeout: time.Second,
+		QueueSize:      8,
+	}
+}
+
+// readDeadLetters returns the records written to a dead-letter file.
+func readDeadLetters(t *testing.T, path string) []deadLetter {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []deadLetter
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record deadLetter
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad dead letter %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestWebhookNotifierSignsPayload(t *testing.T) {
+	received := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		want := "sha256=" + SignWebhookPayload([]byte("s3cret"), timestamp, body)
+		switch {
+		case timestamp == "":
+			received <- errors.New("missing timestamp header")
+		case r.Header.Get(webhookSignatureHeader) != want:
+			received <- errors.New("signature mismatch")
+		default:
+			received <- nil
+		}
+	}))
+	defer server.Close()
+
+	notifier := NewWebhookNotifier(server.URL, "s3cret", time.Second)
+	if err := notifier.Notify(context.Background(), Alert{ID: "a1", Message: "pump stalled", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDispatcherRetriesUntilDelivered(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), testRetryPolicy(3), deadLetters)
+	dispatcher.Register(NewWebhookNotifier(server.URL, "", time.Second))
+	dispatcher.Dispatch(Alert{Source: "test", Message: "retry me"})
+	if err := dispatcher.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Fatalf("webhook called %d times, want 3", got)
+	}
+	if records := readDeadLetters(t, deadLetters); len(records) != 0 {
+		t.Fatalf("delivered alert was dead-lettered: %+v", records)
+	}
+}
+
+func TestDispatcherDeadLettersAfterLastAttempt(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), testRetryPolicy(2), deadLetters)
+	dispatcher.Register(NewWebhookNotifier(server.URL, "", time.Second))
+	dispatcher.Dispatch(Alert{ID: "dl1", Source: "test", Message: "never delivered"})
+	if err := dispatcher.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("webhook called %d times, want 2", got)
+	}
+	records := readDeadLetters(t, deadLetters)
+	if len(records) != 1 || records[0].Alert.ID != "dl1" || records[0].Notifier != "webhook" {
+		t.Fatalf("unexpected dead letters: %+v", records)
+	}
+	if !strings.Contains(records[0].Error, "500") {
+		t.Fatalf("dead letter error %q does not name the status", records[0].Error)
+	}
+}
+
+func TestDispatcherStopAbandonsRetriesAtDeadline(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	policy := testRetryPolicy(5)
+	policy.Backoff = utils.Backoff{Initial: time.Hour, Max: time.Hour}
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), policy, deadLetters)
+	dispatcher.Register(NewWebhookNotifier(server.URL, "", time.Second))
+	dispatcher.Dispatch(Alert{ID: "slow", Source: "test", Message: "stuck in backoff"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := dispatcher.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop returned %v, want the deadline error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Stop took %s", elapsed)
+	}
+
+	// The abandoned alert is dead-lettered by its worker once the backoff wait is cut short
+	deadline := time.Now().Add(2 * time.Second)
+	for len(readDeadLetters(t, deadLetters)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("abandoned alert was not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// smtpStandIn is a minimal SMTP server that accepts every message and records its DATA section.
+type smtpStandIn struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStandIn{listener: listener}
+	go s.serve()
+	t.Cleanup(func() { listener.Close() })
+	return s
+}
+
+func (s *smtpStandIn) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *smtpStandIn) session(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	io.WriteString(conn, "220 localhost ESMTP stand-in\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			io.WriteString(conn, "250 localhost\r\n")
+		case strings.HasPrefix(command, "DATA"):
+			io.WriteString(conn, "354 end with .\r\n")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mutex.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mutex.Unlock()
+			io.WriteString(conn, "250 queued\r\n")
+		case strings.HasPrefix(command, "QUIT"):
+			io.WriteString(conn, "221 bye\r\n")
+			return
+		default:
+			io.WriteString(conn, "250 ok\r\n")
+		}
+	}
+}
+
+func TestSMTPNotifierDeliversMessage(t *testing.T) {
+	server := newSMTPStandIn(t)
+	notifier := NewSMTPNotifier(server.listener.Addr().String(), "", "", "nimbus@example.com", []string{"ops@example.com"})
+	alert := Alert{ID: "m1", Source: "analytics_engine", Severity: SeverityCritical, Message: "boiler over temperature", Timestamp: time.Now()}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.messages) != 1 {
+		t.Fatalf("stand-in received %d messages, want 1", len(server.messages))
+	}
+	message := server.messages[0]
+	for _, want := range []string{"Subject: [Nimbus] CRITICAL alert from analytics_engine", "boiler over temperature", "Message-ID: <m1@nimbus>"} {
+		if !strings.Contains(message, want) {
+			t.Errorf("message lacks %q:\n%s", want, message)
+		}
+	}
+}
+
+func TestSMTPNotifierDeadLettersWhenServerIsDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), testRetryPolicy(2), deadLetters)
+	dispatcher.Register(NewSMTPNotifier(addr, "", "", "nimbus@example.com", []string{"ops@example.com"}))
+	dispatcher.Dispatch(Alert{ID: "m2", Source: "test", Message: "unreachable"})
+	if err := dispatcher.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if records := readDeadLetters(t, deadLetters); len(records) != 1 || records[0].Notifier != "smtp" {
+		t.Fatalf("unexpected dead letters: %+v", records)
+	}
+}
+
+func TestSyslogNotifierUDP(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	notifier := NewSyslogNotifier("udp", collector.LocalAddr().String(), "nimbus-test")
+	alert := Alert{ID: "s1", Source: "test", Severity: SeverityCritical, Message: "line stopped", Timestamp: time.Now()}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatal(err)
+	}
+
+	collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := string(buf[:n])
+	// local0 (16) * 8 + critical (2)
+	if !strings.HasPrefix(message, "<130>1 ") || !strings.Contains(message, "nimbus-test") || !strings.HasSuffix(message, "line stopped") {
+		t.Fatalf("unexpected syslog message %q", message)
+	}
+}
+
+func TestSyslogNotifierTCPOctetCounting(t *testing.T) {
+	collector, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := collector.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		received <- string(data)
+	}()
+
+	notifier := NewSyslogNotifier("tcp", collector.Addr().String(), "")
+	if err := notifier.Notify(context.Background(), Alert{ID: "s2", Source: "test", Severity: SeverityInfo, Message: "multi\nline", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := <-received
+	length, message, found := strings.Cut(frame, " ")
+	if !found {
+		t.Fatalf("frame %q lacks an octet count", frame)
+	}
+	if n, err := strconv.Atoi(length); err != nil || n != len(message) {
+		t.Fatalf("octet count %q does not match message length %d", length, len(message))
+	}
+}
+
+// startNotifierBroker serves the embedded MQTT broker on a loopback port, accepting any username with
+// the password "secret".
+func startNotifierBroker(t *testing.T) string {
+	t.Helper()
+	options := DefaultMQTTBrokerOptions()
+	options.Authenticate = func(username string, password []byte) bool { return string(password) == "secret" }
+	broker, err := NewMQTTBroker(options, nil, nil, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go broker.Serve(listener)
+	t.Cleanup(func() { broker.Close() })
+	return listener.Addr().String()
+}
+
+// subscribeAlerts connects a subscriber to the broker and returns the payloads published to topic.
+func subscribeAlerts(t *testing.T, broker, topic string) <-chan []byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", broker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+	conn.Write(encodeMQTTConnect("watcher", "watcher", "secret", 30))
+	if packetType, body, err := readMQTTPacket(reader); err != nil || packetType != mqttConnAck || body[1] != 0 {
+		t.Fatalf("subscriber not connected: type %d %v", packetType, err)
+	}
+	subscribe := append([]byte{0, 1}, appendMQTTString(nil, topic)...)
+	conn.Write(encodeMQTTPacket(mqttSubscribe<<4|0x02, append(subscribe, 1)))
+	if packetType, _, err := readMQTTPacket(reader); err != nil || packetType != mqttSubAck {
+		t.Fatalf("subscription not acknowledged: type %d %v", packetType, err)
+	}
+
+	payloads := make(chan []byte, 4)
+	go func() {
+		defer close(payloads)
+		for {
+			header, body, err := readMQTTPacketLimit(reader, 0)
+			if err != nil {
+				return
+			}
+			if header>>4 != mqttPublish {
+				continue
+			}
+			d := &mqttDecoder{data: body}
+			d.string()
+			if header>>1&0x03 > 0 {
+				packetID := d.uint16()
+				conn.Write(encodeMQTTPacket(mqttPubAck<<4, []byte{byte(packetID >> 8), byte(packetID)}))
+			}
+			payloads <- d.data
+		}
+	}()
+	return payloads
+}
+
+func TestMQTTNotifierPublishesToEmbeddedBroker(t *testing.T) {
+	broker := startNotifierBroker(t)
+	payloads := subscribeAlerts(t, broker, "alerts/#")
+
+	notifier := NewMQTTNotifier(broker, "nimbus-alerts", "alerts/site1", "nimbus", "secret", 1)
+	alert := Alert{ID: "q1", Source: "analytics_engine", Severity: SeverityWarning, Message: "vibration rising", Timestamp: time.Now()}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case payload := <-payloads:
+		var received Alert
+		if err := json.Unmarshal(payload, &received); err != nil {
+			t.Fatalf("payload %q is not an alert: %v", payload, err)
+		}
+		if received.ID != "q1" || received.Message != "vibration rising" {
+			t.Fatalf("unexpected alert %+v", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber received no alert")
+	}
+}
+
+func TestMQTTNotifierDeadLettersWhenRefused(t *testing.T) {
+	broker := startNotifierBroker(t)
+
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), testRetryPolicy(2), deadLetters)
+	dispatcher.Register(NewMQTTNotifier(broker, "nimbus-alerts", "alerts/site1", "nimbus", "wrong", 1))
+	dispatcher.Dispatch(Alert{ID: "q2", Source: "test", Message: "bad credentials"})
+	if err := dispatcher.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records := readDeadLetters(t, deadLetters)
+	if len(records) != 1 || records[0].Notifier != "mqtt" || !strings.Contains(records[0].Error, "refused") {
+		t.Fatalf("unexpected dead letters: %+v", records)
+	}
+}
+
+// fakeDESSServer stands in for the DESS server, recording notifications and failing the first few.
+type fakeDESSServer struct {
+	mutex    sync.Mutex
+	failures int // Notifications still to fail
+	sent     []fakeNotification
+}
+
+type fakeNotification struct {
+	atSign, key, value string
+}
+
+func (s *fakeDESSServer) Notify(atSign, key, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("secondary server unreachable")
+	}
+	s.sent = append(s.sent, fakeNotification{atSign, key, value})
+	return nil
+}
+
+func TestAtSignNotifierRetriesThroughDESS(t *testing.T) {
+	dess := &fakeDESSServer{failures: 1}
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), testRetryPolicy(3), deadLetters)
+	dispatcher.Register(newAtSignNotifier(dess, "operator", "nimbus"))
+	dispatcher.Dispatch(Alert{ID: "n1", Source: "test", Message: "tank low"})
+	if err := dispatcher.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dess.sent) != 1 {
+		t.Fatalf("DESS received %d notifications, want 1", len(dess.sent))
+	}
+	sent := dess.sent[0]
+	var received Alert
+	if err := json.Unmarshal([]byte(sent.value), &received); err != nil {
+		t.Fatal(err)
+	}
+	if sent.atSign != "@operator" || sent.key != "alert.n1.nimbus" || received.Message != "tank low" {
+		t.Fatalf("unexpected notification %+v", sent)
+	}
+	if records := readDeadLetters(t, deadLetters); len(records) != 0 {
+		t.Fatalf("delivered alert was dead-lettered: %+v", records)
+	}
+}
+
+func TestAtSignNotifierDeadLettersWhenDESSFails(t *testing.T) {
+	dess := &fakeDESSServer{failures: 10}
+	deadLetters := filepath.Join(t.TempDir(), "dead.jsonl")
+	dispatcher := NewNotificationDispatcher(log.New(io.Discard, "", 0), testRetryPolicy(2), deadLetters)
+	dispatcher.Register(newAtSignNotifier(dess, "@operator", "nimbus"))
+	dispatcher.Dispatch(Alert{ID: "n2", Source: "test", Message: "never delivered"})
+	if err := dispatcher.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records := readDeadLetters(t, deadLetters)
+	if len(records) != 1 || records[0].Notifier != "atsign" || !strings.Contains(records[0].Error, "unreachable") {
+		t.Fatalf("unexpected dead letters: %+v", records)
+	}
+	if dess.failures != 8 {
+		t.Fatalf("DESS was asked %d times, want 2", 10-dess.failures)
+	}
+}
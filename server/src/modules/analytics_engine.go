@@ -2,6 +2,7 @@
 package modules
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -11,81 +12,372 @@ import (
 	"github.com/atsign-foundation/at_server/server" // Assuming this is the correct import path for DESS server package
 )
 
+// DefaultSeries is the series name used for values added without one via AddData.
+const DefaultSeries = "default"
+
+// Sample is a single timestamped measurement belonging to a named series.
+type Sample struct {
+	Series    string
+	Timestamp time.Time
+	Value     float64
+}
+
+// Anomaly is a value whose Z-score exceeded the anomaly threshold.
+type Anomaly struct {
+	Series    string    `json:"series"`
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+	ZScore    float64   `json:"z_score"`
+	Mean      float64   `json:"mean"`    // Reference mean the value was judged against
+	StdDev    float64   `json:"std_dev"` // Reference standard deviation the value was judged against
+}
+
+// AnalyticsStage is an optional analysis that sees every sample and runs once per processing cycle.
+// Stages report their findings through their own alert callbacks.
+type AnalyticsStage interface {
+	Add(series string, timestamp time.Time, value float64)
+	Evaluate(now time.Time)
+}
+
 // AnalyticsEngine handles real-time data processing, analytics, and anomaly detection.
 type AnalyticsEngine struct {
-	dataMutex        sync.Mutex        // Mutex for thread-safe access to data
-	dataStore        []float64         // Stores incoming data for processing
+	ingest           *sampleRing       // Bounded buffer of samples waiting for the next processing cycle
+	lastStats        IngestStats       // Ingestion counters at the end of the previous cycle, for drop reporting
+	sinksMutex       sync.RWMutex      // Guards the optional sinks below
 	anomalyThreshold float64           // Threshold for Z-score anomaly detection
 	logger           *log.Logger       // Logger for tracking analytics events
 	alertHandler     func(string)      // Handler function for sending alerts
 	dessServer       *server.AtServer  // Reference to the DESS server for extended security and logging
+	rollups          *RollupAggregator // Optional downsampling of samples into time-bucketed rollups
+	sampleStore      *TimeSeriesStore  // Optional local persistence of raw samples
+	stages           []AnalyticsStage  // Additional analytics such as forecasting and cross-sensor detection
+
+	quality *DataQualityMonitor // Optional screening of samples before they reach analytics; guarded by sinksMutex
+
+	clock           func() time.Time // Source of the current time; replaced by a virtual clock during replay
+	anomalyObserver func(Anomaly)    // Optional receiver of every anomaly decision
+
+	baselineMutex   sync.Mutex                 // Guards the detector baselines
+	baselines       map[string]*SeriesBaseline // Long-running per-series statistics used as the anomaly reference
+	baselinePath    string                     // File the baselines are persisted to; empty keeps them in memory only
+	baselineSavedAt time.Time                  // Time the baselines were last written to disk
+
+	lifecycleMutex sync.Mutex         // Guards the processing loop state
+	cancel         context.CancelFunc // Cancels the processing loop
+	done           chan struct{}      // Closed once the processing loop has flushed and exited
 }
 
+// baselineSaveInterval limits how often baselines are written to disk during normal operation.
+const baselineSaveInterval = time.Minute
+
 // NewAnalyticsEngine initializes a new AnalyticsEngine with an anomaly threshold, logger, alert handler, and DESS server integration.
 func NewAnalyticsEngine(anomalyThreshold float64, logger *log.Logger, alertHandler func(string), dessServer *server.AtServer) *AnalyticsEngine {
+	return NewAnalyticsEngineWithOptions(anomalyThreshold, logger, alertHandler, dessServer, DefaultIngestOptions())
+}
+
+// NewAnalyticsEngineWithOptions initializes an AnalyticsEngine whose ingestion buffer is sized by the given options.
+func NewAnalyticsEngineWithOptions(anomalyThreshold float64, logger *log.Logger, alertHandler func(string), dessServer *server.AtServer, options IngestOptions) *AnalyticsEngine {
 	return &AnalyticsEngine{
-		dataStore:        make([]float64, 0),
+		ingest:           newSampleRing(options),
 		anomalyThreshold: anomalyThreshold,
 		logger:           logger,
 		alertHandler:     alertHandler,
 		dessServer:       dessServer,
+		baselines:        make(map[string]*SeriesBaseline),
+		clock:            time.Now,
 	}
 }
 
-// AddData appends new data to the internal store, ensuring thread-safety with a mutex.
+// SetClock replaces the time source of the engine and its data-quality monitor. It must be called
+// before samples are added; replay uses it to drive processing cycles, stage evaluation and baseline
+// ageing from recorded timestamps.
+func (ae *AnalyticsEngine) SetClock(clock func() time.Time) {
+	ae.sinksMutex.Lock()
+	defer ae.sinksMutex.Unlock()
+	ae.clock = clock
+	if ae.quality != nil {
+		ae.quality.SetClock(clock)
+	}
+}
+
+// SetAnomalyObserver registers a function that receives every anomaly with its full context, in
+// addition to the alert handler. It must be called before processing starts.
+func (ae *AnalyticsEngine) SetAnomalyObserver(observer func(Anomaly)) {
+	ae.anomalyObserver = observer
+}
+
+// SetBaselinePath loads previously persisted detector baselines from path and saves them there from now on.
+func (ae *AnalyticsEngine) SetBaselinePath(path string) error {
+	baselines, err := loadBaselines(path)
+	if err != nil {
+		return fmt.Errorf("loading detector baselines: %w", err)
+	}
+
+	ae.baselineMutex.Lock()
+	defer ae.baselineMutex.Unlock()
+	ae.baselines = baselines
+	ae.baselinePath = path
+	ae.baselineSavedAt = ae.clock()
+	ae.logger.Printf("Loaded detector baselines for %d series from %s\n", len(baselines), path)
+	return nil
+}
+
+// SetRollupAggregator enables rollups; every sample added afterwards is also folded into the aggregator.
+func (ae *AnalyticsEngine) SetRollupAggregator(rollups *RollupAggregator) {
+	ae.sinksMutex.Lock()
+	defer ae.sinksMutex.Unlock()
+	ae.rollups = rollups
+}
+
+// SetTimeSeriesStore enables local persistence; every sample added afterwards is also written to the store.
+func (ae *AnalyticsEngine) SetTimeSeriesStore(store *TimeSeriesStore) {
+	ae.sinksMutex.Lock()
+	defer ae.sinksMutex.Unlock()
+	ae.sampleStore = store
+}
+
+// SetDataQualityMonitor enables data-quality screening; samples added afterwards that fail the checks
+// are dropped before they reach the buffer, rollups, stages or storage.
+func (ae *AnalyticsEngine) SetDataQualityMonitor(monitor *DataQualityMonitor) {
+	ae.sinksMutex.Lock()
+	defer ae.sinksMutex.Unlock()
+	monitor.SetClock(ae.clock)
+	ae.quality = monitor
+}
+
+// AddStage registers an analytics stage; every sample added afterwards is passed to it, and it is
+// evaluated at the end of each processing cycle.
+func (ae *AnalyticsEngine) AddStage(stage AnalyticsStage) {
+	ae.sinksMutex.Lock()
+	defer ae.sinksMutex.Unlock()
+	ae.stages = append(ae.stages, stage)
+}
+
+// AddData appends a value to the default series, timestamped now.
 func (ae *AnalyticsEngine) AddData(data float64) {
-	ae.dataMutex.Lock()
-	defer ae.dataMutex.Unlock()
-	ae.dataStore = append(ae.dataStore, data)
-	ae.logger.Printf("Data added: %.2f\n", data)
+	ae.AddSample(DefaultSeries, ae.clock(), data)
+}
+
+// AddSample appends a timestamped value for a named series to the ingestion buffer.
+func (ae *AnalyticsEngine) AddSample(series string, timestamp time.Time, value float64) {
+	ae.AddBatch([]Sample{{Series: series, Timestamp: timestamp, Value: value}})
+}
+
+// AddBatch appends several samples with a single buffer lock acquisition. When the buffer is
+// full the configured overflow policy applies; rollups and local storage still see every sample
+// that passed the data-quality checks.
+func (ae *AnalyticsEngine) AddBatch(samples []Sample) {
+	ae.addBatch(samples, ae.ingest.push)
+}
+
+// AddDerived appends samples computed by analytics stages, like AddBatch except that it never waits
+// for buffer space: stages evaluate on the processing goroutine, which is the only one draining the
+// buffer. Under OverflowBlock derived samples that do not fit are dropped and counted as DroppedNewest.
+func (ae *AnalyticsEngine) AddDerived(samples []Sample) {
+	ae.addBatch(samples, ae.ingest.pushNonBlocking)
+}
+
+// addBatch screens samples, buffers them with push and hands them to rollups, stages and storage.
+func (ae *AnalyticsEngine) addBatch(samples []Sample, push func([]Sample)) {
+	ae.sinksMutex.RLock()
+	quality := ae.quality
+	rollups := ae.rollups
+	sampleStore := ae.sampleStore
+	stages := ae.stages
+	ae.sinksMutex.RUnlock()
+
+	if quality != nil {
+		if samples = quality.Filter(samples); len(samples) == 0 {
+			return
+		}
+	}
+	push(samples)
+
+	for _, sample := range samples {
+		if rollups != nil {
+			rollups.Add(sample.Series, sample.Timestamp, sample.Value)
+		}
+		for _, stage := range stages {
+			stage.Add(sample.Series, sample.Timestamp, sample.Value)
+		}
+		if sampleStore != nil {
+			if err := sampleStore.Append(sample.Series, sample.Timestamp, sample.Value); err != nil {
+				ae.logger.Printf("Error persisting sample for %s: %v\n", sample.Series, err)
+			}
+		}
+	}
 }
 
-// ProcessData processes the stored data to calculate mean and standard deviation, and checks for anomalies.
+// IngestStats returns the ingestion buffer counters, including samples dropped on overflow.
+func (ae *AnalyticsEngine) IngestStats() IngestStats {
+	return ae.ingest.stats()
+}
+
+// SensorHealth returns the data-quality health of a series, if screening is enabled and the series
+// has been seen.
+func (ae *AnalyticsEngine) SensorHealth(series string) (SensorHealth, bool) {
+	ae.sinksMutex.RLock()
+	quality := ae.quality
+	ae.sinksMutex.RUnlock()
+	if quality == nil {
+		return SensorHealth{}, false
+	}
+	return quality.HealthOf(series)
+}
+
+// ProcessData processes the stored data to calculate mean and standard deviation per series, and checks for anomalies.
 func (ae *AnalyticsEngine) ProcessData() {
-	ae.dataMutex.Lock()
-	defer ae.dataMutex.Unlock()
+	samples := ae.ingest.drain()
+	ae.reportDrops()
+
+	ae.sinksMutex.RLock()
+	quality := ae.quality
+	rollups := ae.rollups
+	stages := ae.stages
+	ae.sinksMutex.RUnlock()
 
-	if len(ae.dataStore) == 0 {
+	now := ae.clock()
+
+	// Report sensors that have gone silent
+	if quality != nil {
+		quality.Evaluate(now)
+	}
+
+	// Close rollup buckets whose window has ended, even if no new samples arrived
+	if rollups != nil {
+		rollups.Flush(now)
+	}
+
+	// Run forecasting, cross-sensor detection and other stages
+	for _, stage := range stages {
+		stage.Evaluate(now)
+	}
+
+	if len(samples) == 0 {
 		ae.logger.Println("No data to process.")
 		return
 	}
 
-	mean := ae.calculateMean()
-	stdDev := ae.calculateStdDev(mean)
+	for series, seriesSamples := range groupBySeries(samples) {
+		values := make([]float64, len(seriesSamples))
+		for i, sample := range seriesSamples {
+			values[i] = sample.Value
+		}
+		mean := ae.calculateMean(values)
+		stdDev := ae.calculateStdDev(values, mean)
 
-	ae.logger.Printf("Real-time Analytics - Mean: %.2f, Std Dev: %.2f\n", mean, stdDev)
+		ae.logger.Printf("Real-time Analytics [%s] - Mean: %.2f, Std Dev: %.2f\n", series, mean, stdDev)
 
-	// Detect anomalies using Z-score
-	ae.detectAnomalies(mean, stdDev)
+		// Detect anomalies using Z-score against the series baseline once it is established
+		referenceMean, referenceStdDev := ae.referenceStats(series, values, mean, stdDev, now)
+		ae.detectAnomalies(seriesSamples, referenceMean, referenceStdDev)
+	}
 
-	// Clear data after processing
-	ae.dataStore = ae.dataStore[:0]
+	if now.Sub(ae.lastBaselineSave()) >= baselineSaveInterval {
+		ae.saveBaselines()
+	}
 }
 
-// calculateMean calculates the average of the data points in the store.
-func (ae *AnalyticsEngine) calculateMean() float64 {
+// referenceStats returns the mean and standard deviation that values are judged against, then folds the
+// values into the series baseline. Until the baseline has enough samples the cycle's own statistics are used.
+func (ae *AnalyticsEngine) referenceStats(series string, values []float64, mean, stdDev float64, now time.Time) (float64, float64) {
+	ae.baselineMutex.Lock()
+	defer ae.baselineMutex.Unlock()
+
+	baseline, exists := ae.baselines[series]
+	if !exists {
+		baseline = &SeriesBaseline{}
+		ae.baselines[series] = baseline
+	}
+	if baseline.Ready() {
+		mean, stdDev = baseline.Mean, baseline.StdDev()
+	}
+	baseline.Merge(values, now)
+	return mean, stdDev
+}
+
+// lastBaselineSave returns when the baselines were last persisted.
+func (ae *AnalyticsEngine) lastBaselineSave() time.Time {
+	ae.baselineMutex.Lock()
+	defer ae.baselineMutex.Unlock()
+	return ae.baselineSavedAt
+}
+
+// saveBaselines persists the detector baselines if a baseline path is set.
+func (ae *AnalyticsEngine) saveBaselines() {
+	ae.baselineMutex.Lock()
+	defer ae.baselineMutex.Unlock()
+
+	if ae.baselinePath == "" {
+		return
+	}
+	if err := saveBaselines(ae.baselinePath, ae.baselines); err != nil {
+		ae.logger.Printf("Error saving detector baselines: %v\n", err)
+		return
+	}
+	ae.baselineSavedAt = ae.clock()
+}
+
+// reportDrops logs how many samples the ingestion buffer dropped since the previous cycle.
+func (ae *AnalyticsEngine) reportDrops() {
+	stats := ae.ingest.stats()
+	droppedOldest := stats.DroppedOldest - ae.lastStats.DroppedOldest
+	droppedNewest := stats.DroppedNewest - ae.lastStats.DroppedNewest
+	ae.lastStats = stats
+
+	if droppedOldest > 0 || droppedNewest > 0 {
+		ae.logger.Printf("Ingestion buffer overflow: dropped %d oldest and %d newest samples since last cycle\n", droppedOldest, droppedNewest)
+	}
+}
+
+// groupBySeries splits samples into per-series slices, preserving arrival order.
+func groupBySeries(samples []Sample) map[string][]Sample {
+	grouped := make(map[string][]Sample)
+	for _, sample := range samples {
+		grouped[sample.Series] = append(grouped[sample.Series], sample)
+	}
+	return grouped
+}
+
+// calculateMean calculates the average of the given data points.
+func (ae *AnalyticsEngine) calculateMean(values []float64) float64 {
 	sum := 0.0
-	for _, value := range ae.dataStore {
+	for _, value := range values {
 		sum += value
 	}
-	return sum / float64(len(ae.dataStore))
+	return sum / float64(len(values))
 }
 
 // calculateStdDev calculates the standard deviation of the data points based on the provided mean.
-func (ae *AnalyticsEngine) calculateStdDev(mean float64) float64 {
+func (ae *AnalyticsEngine) calculateStdDev(values []float64, mean float64) float64 {
 	varianceSum := 0.0
-	for _, value := range ae.dataStore {
+	for _, value := range values {
 		varianceSum += math.Pow(value-mean, 2)
 	}
-	return math.Sqrt(varianceSum / float64(len(ae.dataStore)))
+	return math.Sqrt(varianceSum / float64(len(values)))
 }
 
+// minAnomalyStdDevRatio sets the smallest standard deviation Z-scores are computed with, relative to the
+// magnitude of the reference mean. A flat reference, such as a sensor stuck at a constant, would
+// otherwise give no Z-score at all, and the excursion that ends it would never be reported.
+const minAnomalyStdDevRatio = 1e-6
+
+// minAnomalyStdDev is the floor for references whose mean is zero.
+const minAnomalyStdDev = 1e-9
+
 // detectAnomalies identifies data points that exceed the anomaly threshold using the Z-score method.
-func (ae *AnalyticsEngine) detectAnomalies(mean, stdDev float64) {
-	for _, value := range ae.dataStore {
-		zScore := math.Abs((value - mean) / stdDev)
+// The reference standard deviation is floored, so any real deviation from a flat reference is anomalous.
+func (ae *AnalyticsEngine) detectAnomalies(samples []Sample, mean, stdDev float64) {
+	if floor := math.Max(math.Abs(mean)*minAnomalyStdDevRatio, minAnomalyStdDev); stdDev < floor {
+		stdDev = floor
+	}
+	for _, sample := range samples {
+		zScore := math.Abs((sample.Value - mean) / stdDev)
 		if zScore > ae.anomalyThreshold {
-			message := fmt.Sprintf("Anomaly detected: Value %.2f with Z-score %.2f", value, zScore)
+			if ae.anomalyObserver != nil {
+				ae.anomalyObserver(Anomaly{Series: sample.Series, Timestamp: sample.Timestamp, Value: sample.Value, ZScore: zScore, Mean: mean, StdDev: stdDev})
+			}
+			message := fmt.Sprintf("Anomaly detected in %s: Value %.2f with Z-score %.2f", sample.Series, sample.Value, zScore)
 			ae.logger.Println(message)
 			ae.handleAnomaly(message)
 		}
@@ -106,18 +398,86 @@ func (ae *AnalyticsEngine) handleAnomaly(message string) {
 	}
 }
 
-// StartProcessing starts a ticker that processes data at regular intervals.
-func (ae *AnalyticsEngine) StartProcessing(interval time.Duration) {
+// StartProcessing starts a ticker that processes data at regular intervals until ctx is cancelled or Stop is called.
+// On exit the loop runs a final flush so buffered samples, rollups and baselines are not lost.
+func (ae *AnalyticsEngine) StartProcessing(ctx context.Context, interval time.Duration) {
+	ae.lifecycleMutex.Lock()
+	defer ae.lifecycleMutex.Unlock()
+
+	if ae.done != nil {
+		ae.logger.Println("Analytics Engine processing already started.")
+		return
+	}
+	ctx, ae.cancel = context.WithCancel(ctx)
+	ae.done = make(chan struct{})
+	go ae.run(ctx, interval, ae.done)
+}
+
+// run is the processing loop started by StartProcessing.
+func (ae *AnalyticsEngine) run(ctx context.Context, interval time.Duration, done chan struct{}) {
+	defer close(done)
 	ticker := time.NewTicker(interval)
-	go func() {
-		for range ticker.C {
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ae.finalFlush()
+			return
+		case <-ticker.C:
 			ae.ProcessData()
 		}
-	}()
+	}
 }
 
-// Stop stops the analytics engine by logging the stop event. Cleanup actions can be added if necessary.
-func (ae *AnalyticsEngine) Stop() {
+// finalFlush rejects further samples, processes whatever is still buffered, closes stages that hold
+// goroutines, emits partially filled rollup buckets and persists the detector baselines.
+func (ae *AnalyticsEngine) finalFlush() {
+	ae.ingest.close()
+	ae.ProcessData()
+
+	ae.sinksMutex.RLock()
+	rollups := ae.rollups
+	stages := ae.stages
+	ae.sinksMutex.RUnlock()
+
+	for _, stage := range stages {
+		if closer, ok := stage.(interface{ Close() error }); ok {
+			if err := closer.Close(); err != nil {
+				ae.logger.Printf("Error closing analytics stage: %v\n", err)
+			}
+		}
+	}
+	if rollups != nil {
+		rollups.FlushAll()
+	}
+
+	ae.saveBaselines()
+}
+
+// Stop stops the processing loop and blocks until the final flush has completed or ctx expires.
+func (ae *AnalyticsEngine) Stop(ctx context.Context) error {
 	ae.logger.Println("Stopping Analytics Engine...")
-	// Implement any cleanup if necessary
+
+	ae.lifecycleMutex.Lock()
+	if ae.done == nil {
+		// Processing was never started; flush in the background so the deadline still applies
+		ae.done = make(chan struct{})
+		go func(done chan struct{}) {
+			defer close(done)
+			ae.finalFlush()
+		}(ae.done)
+	} else if ae.cancel != nil {
+		ae.cancel()
+	}
+	done := ae.done
+	ae.lifecycleMutex.Unlock()
+
+	select {
+	case <-done:
+		ae.logger.Println("Analytics Engine stopped.")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("analytics engine did not finish flushing: %w", ctx.Err())
+	}
 }
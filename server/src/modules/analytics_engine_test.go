@@ -0,0 +1,31 @@
+// server/src/modules/analytics_engine_test.go
+
+package modules
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExcursionFromFlatBaselineIsAnomalous(t *testing.T) {
+	engine := newTestEngine(1024, OverflowDropOldest)
+	var anomalies []Anomaly
+	engine.SetAnomalyObserver(func(anomaly Anomaly) { anomalies = append(anomalies, anomaly) })
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < baselineMinSamples; i++ {
+		engine.AddSample("tank.level", start.Add(time.Duration(i)*time.Second), 42)
+	}
+	engine.ProcessData()
+	if len(anomalies) != 0 {
+		t.Fatalf("flat values flagged while the baseline formed: %+v", anomalies)
+	}
+
+	// The sensor was stuck at 42; it now reports 42 again and then jumps
+	engine.AddSample("tank.level", start.Add(time.Minute), 42)
+	engine.AddSample("tank.level", start.Add(time.Minute+time.Second), 47.5)
+	engine.ProcessData()
+	if len(anomalies) != 1 || anomalies[0].Value != 47.5 {
+		t.Fatalf("excursion from a flat baseline not reported exactly once: %+v", anomalies)
+	}
+}
@@ -0,0 +1,327 @@
+// server/src/modules/analytics_replay.go
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VirtualClock is a settable time source used to replay recorded telemetry faster than real time.
+type VirtualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// Now returns the current virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Set moves the virtual clock; it never moves backwards.
+func (c *VirtualClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if now.After(c.now) {
+		c.now = now
+	}
+}
+
+// ReplayEvent is a decision the analytics would have made: an anomaly or an alert from a stage.
+type ReplayEvent struct {
+	Time     time.Time              `json:"time"`
+	Kind     string                 `json:"kind"` // "anomaly" or "alert"
+	Source   string                 `json:"source"`
+	Severity AlertSeverity          `json:"severity,omitempty"`
+	Series   string                 `json:"series,omitempty"`
+	Message  string                 `json:"message"`
+	Details  map[string]interface{} `json:"details,omitempty"`
+}
+
+// key identifies the same decision across two replays, ignoring values such as scores that may
+// legitimately differ between configurations.
+func (e ReplayEvent) key() string {
+	subject := e.Series
+	if subject == "" {
+		subject = e.Message
+	}
+	if fault, ok := e.Details["fault"]; ok {
+		subject += fmt.Sprintf("/%v", fault)
+	}
+	return fmt.Sprintf("%s|%s|%s|%d", e.Kind, e.Source, subject, e.Time.UnixNano())
+}
+
+// ReplayRecorder collects the decisions made during a replay. Stages may report from their own goroutines.
+type ReplayRecorder struct {
+	mutex  sync.Mutex
+	events []ReplayEvent
+}
+
+// Anomaly records an anomaly decision; pass it to AnalyticsEngine.SetAnomalyObserver.
+func (r *ReplayRecorder) Anomaly(anomaly Anomaly) {
+	r.record(ReplayEvent{
+		Time:    anomaly.Timestamp,
+		Kind:    "anomaly",
+		Source:  "analytics_engine",
+		Series:  anomaly.Series,
+		Message: fmt.Sprintf("Anomaly detected in %s: Value %.2f with Z-score %.2f", anomaly.Series, anomaly.Value, anomaly.ZScore),
+		Details: map[string]interface{}{"value": anomaly.Value, "z_score": anomaly.ZScore, "mean": anomaly.Mean, "std_dev": anomaly.StdDev},
+	})
+}
+
+// Alert records an alert raised by a stage; pass it wherever production code takes an alert callback.
+func (r *ReplayRecorder) Alert(alert Alert) {
+	series, _ := alert.Details["series"].(string)
+	r.record(ReplayEvent{
+		Time:     alert.Timestamp,
+		Kind:     "alert",
+		Source:   alert.Source,
+		Severity: alert.Severity,
+		Series:   series,
+		Message:  alert.Message,
+		Details:  alert.Details,
+	})
+}
+
+func (r *ReplayRecorder) record(event ReplayEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns the recorded decisions in time order.
+func (r *ReplayRecorder) Events() []ReplayEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	events := append([]ReplayEvent(nil), r.events...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// ReplayOptions controls how recorded samples are fed to the engine.
+type ReplayOptions struct {
+	Interval time.Duration // Virtual time between processing cycles, normally the production ANALYTICS_INTERVAL
+	Speed    float64       // Multiple of real time to replay at; 0 replays as fast as possible
+	FlushAt  int           // Buffered samples that trigger an early cycle, standing in for blocked producers; 0 disables
+}
+
+// ReplayAnalytics feeds samples through engine in timestamp order, advancing clock to each sample and
+// running a processing cycle whenever an interval of virtual time has elapsed. The engine is stopped
+// at the end, so buffered samples and stages are flushed as in a production shutdown.
+func ReplayAnalytics(ctx context.Context, engine *AnalyticsEngine, clock *VirtualClock, samples []Sample, options ReplayOptions) error {
+	if options.Interval <= 0 {
+		return fmt.Errorf("replay interval must be positive")
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp.Before(samples[j].Timestamp) })
+
+	if len(samples) > 0 {
+		first := samples[0].Timestamp
+		clock.Set(first)
+		nextCycle := first.Truncate(options.Interval).Add(options.Interval)
+		started := time.Now()
+
+		for i, sample := range samples {
+			if i%1024 == 0 && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if options.Speed > 0 {
+				due := started.Add(time.Duration(float64(sample.Timestamp.Sub(first)) / options.Speed))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}
+
+			for !sample.Timestamp.Before(nextCycle) {
+				clock.Set(nextCycle)
+				engine.ProcessData()
+				nextCycle = nextCycle.Add(options.Interval)
+				// Across long silences one cycle is enough to report gaps; skip the idle cycles
+				if sample.Timestamp.Sub(nextCycle) > options.Interval {
+					nextCycle = sample.Timestamp.Truncate(options.Interval)
+				}
+			}
+			if options.FlushAt > 0 && engine.IngestStats().Buffered >= options.FlushAt {
+				engine.ProcessData()
+			}
+			clock.Set(sample.Timestamp)
+			engine.AddSample(sample.Series, sample.Timestamp, sample.Value)
+		}
+		clock.Set(nextCycle)
+	}
+	return engine.Stop(ctx)
+}
+
+// ReplayDiff compares the decisions of two replays of the same data.
+type ReplayDiff struct {
+	OnlyA  []ReplayEvent `json:"only_a"` // Decisions made only under the first configuration
+	OnlyB  []ReplayEvent `json:"only_b"` // Decisions made only under the second configuration
+	Common int           `json:"common"` // Decisions made under both
+}
+
+// DiffReplays matches decisions by kind, source, series and time.
+func DiffReplays(a, b []ReplayEvent) ReplayDiff {
+	remaining := make(map[string]int)
+	for _, event := range b {
+		remaining[event.key()]++
+	}
+	diff := ReplayDiff{}
+	for _, event := range a {
+		if remaining[event.key()] > 0 {
+			remaining[event.key()]--
+			diff.Common++
+			continue
+		}
+		diff.OnlyA = append(diff.OnlyA, event)
+	}
+	for _, event := range b {
+		if remaining[event.key()] > 0 {
+			remaining[event.key()]--
+			diff.OnlyB = append(diff.OnlyB, event)
+		}
+	}
+	return diff
+}
+
+// ReadReplayCSV reads samples from CSV with timestamp, series and value columns. A header row naming
+// the columns (timestamp or time, series or name, value) may reorder them.
+func ReadReplayCSV(r io.Reader) ([]Sample, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	columns := [3]int{0, 1, 2} // timestamp, series, value
+	samples := make([]Sample, 0)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if line == 1 && isReplayHeader(record, &columns) {
+			continue
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if len(record) <= columns[0] || len(record) <= columns[1] || len(record) <= columns[2] {
+			return nil, fmt.Errorf("line %d: expected timestamp, series and value", line)
+		}
+		timestamp, err := parseReplayTimestamp(record[columns[0]])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[columns[2]]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid value %q", line, record[columns[2]])
+		}
+		samples = append(samples, Sample{Series: strings.TrimSpace(record[columns[1]]), Timestamp: timestamp, Value: value})
+	}
+}
+
+// isReplayHeader reports whether record is a header row, updating the column positions it names.
+func isReplayHeader(record []string, columns *[3]int) bool {
+	found := [3]int{-1, -1, -1}
+	for i, name := range record {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "timestamp", "time":
+			found[0] = i
+		case "series", "name":
+			found[1] = i
+		case "value":
+			found[2] = i
+		}
+	}
+	if found[0] < 0 || found[1] < 0 || found[2] < 0 {
+		return false
+	}
+	*columns = found
+	return true
+}
+
+// ReadReplayJSONL reads samples from JSON lines of the form {"series": ..., "timestamp": ..., "value": ...}.
+func ReadReplayJSONL(r io.Reader) ([]Sample, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	samples := make([]Sample, 0)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record struct {
+			Series    string          `json:"series"`
+			Timestamp json.RawMessage `json:"timestamp"`
+			Value     float64         `json:"value"`
+		}
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		timestamp, err := parseReplayTimestamp(strings.Trim(string(record.Timestamp), `"`))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		samples = append(samples, Sample{Series: record.Series, Timestamp: timestamp, Value: record.Value})
+	}
+	return samples, scanner.Err()
+}
+
+// ReadReplayStore reads the samples of every stored series matching pattern with timestamps in [from, to].
+func ReadReplayStore(store *TimeSeriesStore, pattern string, from, to time.Time) ([]Sample, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid series pattern %q: %w", pattern, err)
+	}
+	names, err := store.Series()
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]Sample, 0)
+	for _, name := range names {
+		if matched, _ := path.Match(pattern, name); !matched {
+			continue
+		}
+		stored, err := store.Query(name, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", name, err)
+		}
+		samples = append(samples, stored...)
+	}
+	return samples, nil
+}
+
+// parseReplayTimestamp accepts RFC 3339 timestamps and Unix times in seconds or, for values above
+// 1e12, milliseconds.
+func parseReplayTimestamp(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	if number, err := strconv.ParseFloat(text, 64); err == nil {
+		if math.Abs(number) > 1e12 {
+			return time.UnixMilli(int64(number)), nil
+		}
+		seconds, fraction := math.Modf(number)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", text)
+	}
+	return timestamp, nil
+}
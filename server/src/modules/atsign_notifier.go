@@ -0,0 +1,74 @@
+// server/src/modules/atsign_notifier.go
+
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/atsign-foundation/at_server/server" // Assuming this is the correct import path for DESS server package
+)
+
+// atSignSender is the part of the DESS server that delivers notifications.
+type atSignSender interface {
+	Notify(atSign, key, value string) error
+}
+
+// AtSignNotifier sends alerts as atProtocol notifications to an operator's atSign through the DESS server.
+type AtSignNotifier struct {
+	dessServer     atSignSender // DESS server used to deliver the notification
+	operatorAtSign string       // atSign of the operator receiving alerts
+	namespace      string       // Namespace appended to notification keys
+}
+
+// NewAtSignNotifier creates a notifier that delivers alerts to the given operator atSign.
+func NewAtSignNotifier(dessServer *server.AtServer, operatorAtSign, namespace string) *AtSignNotifier {
+	var sender atSignSender
+	if dessServer != nil {
+		sender = dessServer
+	}
+	return newAtSignNotifier(sender, operatorAtSign, namespace)
+}
+
+// newAtSignNotifier creates a notifier that delivers alerts through sender.
+func newAtSignNotifier(dessServer atSignSender, operatorAtSign, namespace string) *AtSignNotifier {
+	if !strings.HasPrefix(operatorAtSign, "@") {
+		operatorAtSign = "@" + operatorAtSign
+	}
+	return &AtSignNotifier{
+		dessServer:     dessServer,
+		operatorAtSign: operatorAtSign,
+		namespace:      namespace,
+	}
+}
+
+// Name identifies the notifier in logs and dead letters.
+func (an *AtSignNotifier) Name() string {
+	return "atsign"
+}
+
+// Notify shares the alert with the operator atSign as an encrypted atProtocol notification.
+func (an *AtSignNotifier) Notify(ctx context.Context, alert Alert) error {
+	if an.dessServer == nil {
+		return fmt.Errorf("DESS server not available")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	// Keys follow the atProtocol "<key>.<namespace>" convention so the operator's app can filter on them
+	key := fmt.Sprintf("alert.%s.%s", alert.ID, an.namespace)
+
+	// Hypothetical method to push a notification to another atSign via DESS
+	if err := an.dessServer.Notify(an.operatorAtSign, key, string(payload)); err != nil {
+		return fmt.Errorf("failed to notify %s: %w", an.operatorAtSign, err)
+	}
+	return nil
+}
@@ -0,0 +1,467 @@
+// server/src/modules/correlation_detector.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+// CorrelationGroupConfig describes a set of series that are analysed together, e.g. the sensors of one pump.
+type CorrelationGroupConfig struct {
+	Name             string   `json:"name"`              // Group name used in alerts
+	Series           []string `json:"series"`            // Series forming each vector, at least two
+	Step             string   `json:"step"`              // Width of the buckets samples are averaged into, default "10s"
+	Window           int      `json:"window"`            // Vectors in the baseline window, default 360
+	RecentWindow     int      `json:"recent_window"`     // Vectors in the recent window compared against the baseline, default 30
+	Threshold        float64  `json:"threshold"`         // Mahalanobis distance alert level; defaults to the 99.9% chi-square quantile
+	MinCorrelation   float64  `json:"min_correlation"`   // Baseline |r| above which a pair is expected to stay correlated, default 0.6
+	CorrelationBreak float64  `json:"correlation_break"` // Drop in |r| between baseline and recent windows reported as a break, default 0.5
+	Repeat           string   `json:"repeat"`            // Minimum time between repeated alerts for one group, default "5m"
+}
+
+// LoadCorrelationGroups reads correlation groups from a JSON file containing an array of CorrelationGroupConfig.
+func LoadCorrelationGroups(filePath string) ([]CorrelationGroupConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read correlation config %s: %w", filePath, err)
+	}
+	var configs []CorrelationGroupConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse correlation config %s: %w", filePath, err)
+	}
+	return configs, nil
+}
+
+// SeriesContribution is one series' share of a multivariate anomaly, reported in alert details.
+type SeriesContribution struct {
+	Series       string  `json:"series"`
+	Value        float64 `json:"value"`        // Observed bucket mean
+	Expected     float64 `json:"expected"`     // Baseline mean
+	ZScore       float64 `json:"z_score"`      // Univariate deviation, for comparison
+	Contribution float64 `json:"contribution"` // Share of the squared Mahalanobis distance; the shares sum to 1
+}
+
+// correlationGroup is the rolling state of one configured group.
+type correlationGroup struct {
+	config      CorrelationGroupConfig
+	index       map[string]int // Series name to vector position
+	step        time.Duration
+	repeat      time.Duration
+	threshold   float64
+	bucketStart time.Time // Start of the open bucket, by the samples' timestamps
+	bucketSums  []float64
+	bucketCount []int
+	last        []float64 // Last bucket mean per series, carried forward when a series skips a bucket
+	seen        []bool
+	vectors     [][]float64 // Circular window of completed vectors
+	next        int
+	count       int
+	lastAlert   time.Time
+	brokenPairs map[[2]int]bool // Pairs already reported as broken, cleared when they recover
+}
+
+// CorrelationDetector maintains rolling covariance and correlation between grouped series and flags
+// vectors that are unusual as a whole (Mahalanobis distance) or pairs that stop moving together.
+type CorrelationDetector struct {
+	groups   []*correlationGroup
+	bySeries map[string][]*correlationGroup // Groups each series belongs to
+	alert    func(Alert)                    // Receives detected anomalies
+	mutex    sync.Mutex                     // Guards all group state
+	logger   *log.Logger                    // Logger for tracking detection events
+}
+
+// NewCorrelationDetector validates the groups and creates a detector that reports anomalies to alert.
+func NewCorrelationDetector(logger *log.Logger, configs []CorrelationGroupConfig, alert func(Alert)) (*CorrelationDetector, error) {
+	detector := &CorrelationDetector{
+		bySeries: make(map[string][]*correlationGroup),
+		alert:    alert,
+		logger:   logger,
+	}
+	for _, config := range configs {
+		group, err := newCorrelationGroup(config)
+		if err != nil {
+			return nil, err
+		}
+		detector.groups = append(detector.groups, group)
+		for _, series := range config.Series {
+			detector.bySeries[series] = append(detector.bySeries[series], group)
+		}
+	}
+	return detector, nil
+}
+
+// newCorrelationGroup applies defaults and validates a group.
+func newCorrelationGroup(config CorrelationGroupConfig) (*correlationGroup, error) {
+	dimensions := len(config.Series)
+	if dimensions < 2 {
+		return nil, fmt.Errorf("correlation group %q needs at least two series", config.Name)
+	}
+	index := make(map[string]int, dimensions)
+	for i, series := range config.Series {
+		if _, duplicate := index[series]; duplicate {
+			return nil, fmt.Errorf("correlation group %q lists %s twice", config.Name, series)
+		}
+		index[series] = i
+	}
+	if config.Window <= 0 {
+		config.Window = 360
+	}
+	if config.RecentWindow <= 0 {
+		config.RecentWindow = 30
+	}
+	if config.Window < 2*dimensions || config.RecentWindow >= config.Window {
+		return nil, fmt.Errorf("correlation group %q needs a window of at least %d vectors and larger than its recent window", config.Name, 2*dimensions)
+	}
+	if config.MinCorrelation <= 0 {
+		config.MinCorrelation = 0.6
+	}
+	if config.CorrelationBreak <= 0 {
+		config.CorrelationBreak = 0.5
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = math.Sqrt(chiSquareQuantile999(dimensions))
+	}
+
+	step, err := utils.ParsePositiveDuration(config.Step, "10s")
+	if err != nil {
+		return nil, fmt.Errorf("invalid step for correlation group %q: %w", config.Name, err)
+	}
+	repeat, err := utils.ParsePositiveDuration(config.Repeat, "5m")
+	if err != nil {
+		return nil, fmt.Errorf("invalid repeat for correlation group %q: %w", config.Name, err)
+	}
+
+	vectors := make([][]float64, config.Window)
+	for i := range vectors {
+		vectors[i] = make([]float64, dimensions)
+	}
+	return &correlationGroup{
+		config:      config,
+		index:       index,
+		step:        step,
+		repeat:      repeat,
+		threshold:   config.Threshold,
+		bucketSums:  make([]float64, dimensions),
+		bucketCount: make([]int, dimensions),
+		last:        make([]float64, dimensions),
+		seen:        make([]bool, dimensions),
+		vectors:     vectors,
+		brokenPairs: make(map[[2]int]bool),
+	}, nil
+}
+
+// chiSquareQuantile999 approximates the 99.9% quantile of the chi-square distribution with k degrees
+// of freedom using the Wilson-Hilferty transformation.
+func chiSquareQuantile999(k int) float64 {
+	const z = 3.090232 // Standard normal 99.9% quantile
+	df := float64(k)
+	term := 1 - 2/(9*df) + z*math.Sqrt(2/(9*df))
+	return df * term * term * term
+}
+
+// Add feeds a sample into every group containing its series. The first sample of a later bucket closes
+// the open one, which is scored immediately, so buckets follow the samples' clock rather than the
+// server's and samples arriving late are still counted in their own bucket.
+func (cd *CorrelationDetector) Add(series string, timestamp time.Time, value float64) {
+	cd.mutex.Lock()
+	groups := cd.bySeries[series]
+	alerts := make([]Alert, 0)
+	for _, group := range groups {
+		bucket := timestamp.Truncate(group.step)
+		if bucket.Before(group.bucketStart) {
+			continue // Late sample for a bucket that has already been scored
+		}
+		if bucket.After(group.bucketStart) {
+			if alert, raised := group.closeBucket(timestamp); raised {
+				alerts = append(alerts, alert)
+			}
+			group.bucketStart = bucket
+		}
+		position := group.index[series]
+		group.bucketSums[position] += value
+		group.bucketCount[position]++
+	}
+	cd.mutex.Unlock()
+
+	cd.raise(alerts)
+}
+
+// Evaluate checks every group for correlation breaks. Buckets are left to Add: a step without samples
+// yields no vector.
+func (cd *CorrelationDetector) Evaluate(now time.Time) {
+	cd.mutex.Lock()
+	alerts := make([]Alert, 0)
+	for _, group := range cd.groups {
+		alerts = append(alerts, group.checkCorrelations(now)...)
+	}
+	cd.mutex.Unlock()
+
+	cd.raise(alerts)
+}
+
+// raise logs and forwards alerts outside the detector lock.
+func (cd *CorrelationDetector) raise(alerts []Alert) {
+	for _, alert := range alerts {
+		cd.logger.Println(alert.Message)
+		if cd.alert != nil {
+			cd.alert(alert)
+		}
+	}
+}
+
+// closeBucket turns the bucket into a vector, scores it against the window and then adds it to the window.
+// A bucket no series reported in is skipped rather than filled with carried-forward values.
+func (g *correlationGroup) closeBucket(now time.Time) (Alert, bool) {
+	reported := false
+	for _, count := range g.bucketCount {
+		reported = reported || count > 0
+	}
+	if !reported {
+		return Alert{}, false
+	}
+	vector := make([]float64, len(g.config.Series))
+	for i := range vector {
+		if g.bucketCount[i] > 0 {
+			g.last[i] = g.bucketSums[i] / float64(g.bucketCount[i])
+			g.seen[i] = true
+		}
+		vector[i] = g.last[i]
+		g.bucketSums[i] = 0
+		g.bucketCount[i] = 0
+	}
+	for _, seen := range g.seen {
+		if !seen {
+			return Alert{}, false // Wait until every series has reported at least once
+		}
+	}
+
+	alert, raised := g.score(vector, now)
+	copy(g.vectors[g.next], vector)
+	g.next = (g.next + 1) % len(g.vectors)
+	if g.count < len(g.vectors) {
+		g.count++
+	}
+	return alert, raised
+}
+
+// score computes the Mahalanobis distance of vector from the baseline window.
+func (g *correlationGroup) score(vector []float64, now time.Time) (Alert, bool) {
+	if g.count < len(g.vectors) {
+		return Alert{}, false // Only score against a full baseline window
+	}
+	mean, covariance := g.statistics(0, g.count)
+	inverse, ok := invertMatrix(regularise(covariance))
+	if !ok {
+		return Alert{}, false
+	}
+
+	dimensions := len(vector)
+	deviation := make([]float64, dimensions)
+	for i := range vector {
+		deviation[i] = vector[i] - mean[i]
+	}
+	weighted := make([]float64, dimensions)
+	squared := 0.0
+	for i := 0; i < dimensions; i++ {
+		for j := 0; j < dimensions; j++ {
+			weighted[i] += inverse[i][j] * deviation[j]
+		}
+		squared += deviation[i] * weighted[i]
+	}
+	distance := math.Sqrt(math.Max(squared, 0))
+	if distance <= g.threshold {
+		return Alert{}, false
+	}
+	if !g.lastAlert.IsZero() && now.Sub(g.lastAlert) < g.repeat {
+		return Alert{}, false
+	}
+	g.lastAlert = now
+
+	contributions := make([]SeriesContribution, dimensions)
+	for i, series := range g.config.Series {
+		contributions[i] = SeriesContribution{
+			Series:       series,
+			Value:        vector[i],
+			Expected:     mean[i],
+			Contribution: deviation[i] * weighted[i] / squared,
+		}
+		if covariance[i][i] > 0 {
+			contributions[i].ZScore = deviation[i] / math.Sqrt(covariance[i][i])
+		}
+	}
+	sort.Slice(contributions, func(i, j int) bool { return contributions[i].Contribution > contributions[j].Contribution })
+
+	return Alert{
+		Source:   "correlation_detector",
+		Severity: SeverityWarning,
+		Message: fmt.Sprintf("Multivariate anomaly in %s: Mahalanobis distance %.2f exceeds %.2f, led by %s",
+			g.config.Name, distance, g.threshold, contributions[0].Series),
+		Timestamp: now,
+		Details: map[string]interface{}{
+			"group":         g.config.Name,
+			"distance":      distance,
+			"threshold":     g.threshold,
+			"contributions": contributions,
+		},
+	}, true
+}
+
+// checkCorrelations compares pairwise correlation in the recent window with the rest of the baseline window.
+func (g *correlationGroup) checkCorrelations(now time.Time) []Alert {
+	alerts := make([]Alert, 0)
+	if g.count < len(g.vectors) {
+		return alerts
+	}
+	recent := g.config.RecentWindow
+	_, baselineCovariance := g.statistics(recent, g.count)
+	_, recentCovariance := g.statistics(0, recent)
+	baseline := correlationMatrix(baselineCovariance)
+	current := correlationMatrix(recentCovariance)
+
+	for i := 0; i < len(g.config.Series); i++ {
+		for j := i + 1; j < len(g.config.Series); j++ {
+			pair := [2]int{i, j}
+			expected, observed := baseline[i][j], current[i][j]
+			broken := math.Abs(expected) >= g.config.MinCorrelation && math.Abs(expected)-math.Abs(observed) >= g.config.CorrelationBreak
+			if !broken {
+				delete(g.brokenPairs, pair)
+				continue
+			}
+			if g.brokenPairs[pair] {
+				continue
+			}
+			g.brokenPairs[pair] = true
+			alerts = append(alerts, Alert{
+				Source:   "correlation_detector",
+				Severity: SeverityWarning,
+				Message: fmt.Sprintf("Correlation break in %s: %s and %s moved from r=%.2f to r=%.2f",
+					g.config.Name, g.config.Series[i], g.config.Series[j], expected, observed),
+				Timestamp: now,
+				Details: map[string]interface{}{
+					"group":                g.config.Name,
+					"series":               []string{g.config.Series[i], g.config.Series[j]},
+					"baseline_correlation": expected,
+					"recent_correlation":   observed,
+				},
+			})
+		}
+	}
+	return alerts
+}
+
+// statistics returns the mean and covariance of the window vectors from age skip (0 = newest) up to age limit.
+func (g *correlationGroup) statistics(skip, limit int) ([]float64, [][]float64) {
+	dimensions := len(g.config.Series)
+	mean := make([]float64, dimensions)
+	covariance := make([][]float64, dimensions)
+	for i := range covariance {
+		covariance[i] = make([]float64, dimensions)
+	}
+
+	size := len(g.vectors)
+	n := float64(limit - skip)
+	for age := skip; age < limit; age++ {
+		vector := g.vectors[(g.next-1-age+2*size)%size]
+		for i := range mean {
+			mean[i] += vector[i] / n
+		}
+	}
+	for age := skip; age < limit; age++ {
+		vector := g.vectors[(g.next-1-age+2*size)%size]
+		for i := 0; i < dimensions; i++ {
+			for j := i; j < dimensions; j++ {
+				covariance[i][j] += (vector[i] - mean[i]) * (vector[j] - mean[j]) / (n - 1)
+			}
+		}
+	}
+	for i := 0; i < dimensions; i++ {
+		for j := 0; j < i; j++ {
+			covariance[i][j] = covariance[j][i]
+		}
+	}
+	return mean, covariance
+}
+
+// correlationMatrix converts a covariance matrix into Pearson correlations; constant series correlate as 0.
+func correlationMatrix(covariance [][]float64) [][]float64 {
+	correlation := make([][]float64, len(covariance))
+	for i := range covariance {
+		correlation[i] = make([]float64, len(covariance))
+		for j := range covariance {
+			denominator := math.Sqrt(covariance[i][i] * covariance[j][j])
+			if denominator > 0 {
+				correlation[i][j] = covariance[i][j] / denominator
+			}
+		}
+	}
+	return correlation
+}
+
+// regularise adds a small ridge to the diagonal so perfectly correlated or constant series stay invertible.
+func regularise(covariance [][]float64) [][]float64 {
+	trace := 0.0
+	for i := range covariance {
+		trace += covariance[i][i]
+	}
+	ridge := 1e-6 * trace / float64(len(covariance))
+	if ridge == 0 {
+		ridge = 1e-9
+	}
+	for i := range covariance {
+		covariance[i][i] += ridge
+	}
+	return covariance
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination with partial pivoting.
+func invertMatrix(matrix [][]float64) ([][]float64, bool) {
+	n := len(matrix)
+	work := make([][]float64, n)
+	for i := range matrix {
+		work[i] = make([]float64, 2*n)
+		copy(work[i], matrix[i])
+		work[i][n+i] = 1
+	}
+
+	for column := 0; column < n; column++ {
+		pivot := column
+		for row := column + 1; row < n; row++ {
+			if math.Abs(work[row][column]) > math.Abs(work[pivot][column]) {
+				pivot = row
+			}
+		}
+		if math.Abs(work[pivot][column]) < 1e-12 {
+			return nil, false
+		}
+		work[column], work[pivot] = work[pivot], work[column]
+
+		scale := work[column][column]
+		for k := range work[column] {
+			work[column][k] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == column {
+				continue
+			}
+			factor := work[row][column]
+			for k := range work[row] {
+				work[row][k] -= factor * work[column][k]
+			}
+		}
+	}
+
+	inverse := make([][]float64, n)
+	for i := range work {
+		inverse[i] = work[i][n:]
+	}
+	return inverse, true
+}
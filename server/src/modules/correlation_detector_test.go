@@ -0,0 +1,45 @@
+// server/src/modules/correlation_detector_test.go
+
+package modules
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestCorrelationBucketsFollowSampleTimestamps(t *testing.T) {
+	detector, err := NewCorrelationDetector(log.New(io.Discard, "", 0), []CorrelationGroupConfig{{Name: "pump1", Series: []string{"flow", "vibration"}, Step: "10s", Window: 20, RecentWindow: 5}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := detector.groups[0]
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	serverNow := start.Add(time.Hour) // The device's samples arrive an hour behind the server clock
+
+	for i := 0; i < 10; i++ {
+		timestamp := start.Add(time.Duration(i) * 10 * time.Second)
+		detector.Add("flow", timestamp, float64(50+i))
+		detector.Evaluate(serverNow.Add(time.Duration(i) * 10 * time.Second))
+		detector.Add("vibration", timestamp.Add(time.Second), float64(5+i))
+	}
+	if group.count != 9 {
+		t.Fatalf("%d vectors from 9 closed buckets of lagging samples", group.count)
+	}
+	for age := 0; age < group.count; age++ {
+		vector := group.vectors[(group.next-1-age+len(group.vectors))%len(group.vectors)]
+		if i := 8 - age; vector[0] != float64(50+i) || vector[1] != float64(5+i) {
+			t.Fatalf("bucket %d became %v", i, vector)
+		}
+	}
+
+	// An hour without samples adds one vector, for the bucket it closes, not one per empty step
+	for i := 0; i < 360; i++ {
+		detector.Evaluate(serverNow.Add(time.Duration(i) * 10 * time.Second))
+	}
+	detector.Add("flow", start.Add(2*time.Hour), 70)
+	if group.count != 10 {
+		t.Fatalf("%d vectors after a gap, want 10", group.count)
+	}
+}
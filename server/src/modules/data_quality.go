@@ -0,0 +1,389 @@
+// server/src/modules/data_quality.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+// Sensor fault kinds reported by the data-quality monitor.
+const (
+	FaultInvalidValue = "invalid_value" // NaN or infinite reading
+	FaultOutOfRange   = "out_of_range"  // Reading outside the physical range of the sensor
+	FaultTimestamp    = "timestamp"     // Timestamp before the previous one, a duplicate, or too far in the future
+	FaultStuck        = "stuck"         // Reading frozen at the same value
+	FaultGap          = "gap"           // No reading for longer than expected
+
+	healthSmoothing = 0.02 // Weight of each sample in the health score, roughly a 50-sample memory
+)
+
+// DataQualityConfig sets the quality checks for series matching a pattern. NaN/Inf rejection and
+// timestamp checks apply to every series; the remaining checks are enabled by their fields.
+type DataQualityConfig struct {
+	Series         string   `json:"series"`          // path.Match pattern on series names
+	Min            *float64 `json:"min"`             // Lowest physically possible reading
+	Max            *float64 `json:"max"`             // Highest physically possible reading
+	StuckCount     int      `json:"stuck_count"`     // Consecutive unchanged readings that mark the sensor stuck; 0 disables
+	StuckDuration  string   `json:"stuck_duration"`  // Minimum time the reading must stay unchanged as well, e.g. "10m"
+	StuckTolerance float64  `json:"stuck_tolerance"` // Largest change still treated as unchanged, default 0
+	MaxGap         string   `json:"max_gap"`         // Longest expected silence between readings, e.g. "5m"; empty disables
+}
+
+// LoadDataQualityConfigs reads quality rules from a JSON file containing an array of DataQualityConfig.
+func LoadDataQualityConfigs(filePath string) ([]DataQualityConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data quality config %s: %w", filePath, err)
+	}
+	var configs []DataQualityConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse data quality config %s: %w", filePath, err)
+	}
+	return configs, nil
+}
+
+// SensorHealth summarises the data quality of one series.
+type SensorHealth struct {
+	Series   string         `json:"series"`
+	Score    float64        `json:"score"`    // 0 (unusable) to 100 (every recent reading valid)
+	Accepted uint64         `json:"accepted"` // Readings passed on to analytics
+	Rejected map[string]int `json:"rejected"` // Rejected readings per fault kind
+	Faults   []string       `json:"faults"`   // Fault kinds currently active
+	LastSeen time.Time      `json:"last_seen"`
+}
+
+// qualityRule is a validated DataQualityConfig.
+type qualityRule struct {
+	config        DataQualityConfig
+	stuckDuration time.Duration
+	maxGap        time.Duration
+}
+
+// sensorState is the quality state of one series.
+type sensorState struct {
+	rule       *qualityRule
+	quality    float64   // Exponentially weighted share of valid readings
+	lastTime   time.Time // Timestamp of the last accepted reading
+	lastValue  float64   // Value of the last accepted reading
+	runValue   float64   // Value the current run of unchanged readings started at
+	runStart   time.Time
+	runCount   int
+	accepted   uint64
+	rejected   map[string]int
+	active     map[string]time.Time // Active faults and when they started
+	lastRaised map[string]time.Time // When each fault kind was last reported
+}
+
+// DataQualityMonitor screens samples before they reach analytics, scores sensor health and reports
+// sensor faults. Faults are raised with source "data_quality" so they can be routed apart from process anomalies.
+type DataQualityMonitor struct {
+	rules      []qualityRule           // Rules in priority order; the first match wins
+	sensors    map[string]*sensorState // Per-series quality state
+	futureSkew time.Duration           // How far ahead of the local clock a timestamp may be
+	repeat     time.Duration           // Minimum time between reports of the same fault on one series
+	now        func() time.Time        // Clock used for future-timestamp and gap checks
+	alert      func(Alert)             // Receives sensor fault and recovery events
+	pending    []Alert                 // Events raised under the mutex, delivered after it is released
+	mutex      sync.Mutex              // Guards sensors and pending
+	logger     *log.Logger             // Logger for tracking data-quality events
+}
+
+// NewDataQualityMonitor validates the quality rules and creates a monitor that reports faults to alert.
+func NewDataQualityMonitor(logger *log.Logger, configs []DataQualityConfig, alert func(Alert)) (*DataQualityMonitor, error) {
+	rules := make([]qualityRule, 0, len(configs))
+	for _, config := range configs {
+		if _, err := path.Match(config.Series, ""); err != nil {
+			return nil, fmt.Errorf("invalid data quality series pattern %q: %w", config.Series, err)
+		}
+		if config.Min != nil && config.Max != nil && *config.Min > *config.Max {
+			return nil, fmt.Errorf("data quality range for %s has min above max", config.Series)
+		}
+		rule := qualityRule{config: config}
+		var err error
+		if config.StuckDuration != "" {
+			if rule.stuckDuration, err = utils.ParsePositiveDuration(config.StuckDuration, ""); err != nil {
+				return nil, fmt.Errorf("invalid stuck duration for %s: %w", config.Series, err)
+			}
+		}
+		if config.MaxGap != "" {
+			if rule.maxGap, err = utils.ParsePositiveDuration(config.MaxGap, ""); err != nil {
+				return nil, fmt.Errorf("invalid max gap for %s: %w", config.Series, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+
+	return &DataQualityMonitor{
+		rules:      rules,
+		sensors:    make(map[string]*sensorState),
+		futureSkew: 5 * time.Minute,
+		repeat:     15 * time.Minute,
+		now:        time.Now,
+		alert:      alert,
+		logger:     logger,
+	}, nil
+}
+
+// SetClock replaces the time source used for future-timestamp checks, for example with a replay's virtual clock.
+func (m *DataQualityMonitor) SetClock(now func() time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.now = now
+}
+
+// sensor returns the state of a series, creating it with its matching rule on first use.
+func (m *DataQualityMonitor) sensor(series string) *sensorState {
+	state, exists := m.sensors[series]
+	if exists {
+		return state
+	}
+	state = &sensorState{
+		quality:    1,
+		rejected:   make(map[string]int),
+		active:     make(map[string]time.Time),
+		lastRaised: make(map[string]time.Time),
+	}
+	for i := range m.rules {
+		if matched, _ := path.Match(m.rules[i].config.Series, series); matched {
+			state.rule = &m.rules[i]
+			break
+		}
+	}
+	m.sensors[series] = state
+	return state
+}
+
+// Filter checks each sample and returns those fit for analytics. The input slice is not modified.
+func (m *DataQualityMonitor) Filter(samples []Sample) []Sample {
+	m.mutex.Lock()
+	accepted := make([]Sample, 0, len(samples))
+	for _, sample := range samples {
+		state := m.sensor(sample.Series)
+		fault, detail := m.check(state, sample)
+		if fault == "" {
+			accepted = append(accepted, sample)
+			state.accepted++
+			state.quality += healthSmoothing * (1 - state.quality)
+			m.clear(state, sample.Series, sample.Timestamp, FaultInvalidValue, FaultOutOfRange, FaultTimestamp, FaultGap)
+			continue
+		}
+		state.rejected[fault]++
+		state.quality -= healthSmoothing * state.quality
+		m.raise(state, sample.Series, fault, detail, sample.Timestamp)
+	}
+	m.deliver()
+	return accepted
+}
+
+// deliver releases the mutex and sends the events raised while it was held.
+func (m *DataQualityMonitor) deliver() {
+	events := m.pending
+	m.pending = nil
+	m.mutex.Unlock()
+
+	for _, event := range events {
+		m.alert(event)
+	}
+}
+
+// check applies the quality rules to a sample, updating the per-series tracking for accepted readings.
+// It returns the fault kind that rejects the sample, or "" when it is accepted.
+func (m *DataQualityMonitor) check(state *sensorState, sample Sample) (string, string) {
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return FaultInvalidValue, fmt.Sprintf("reading %v", sample.Value)
+	}
+	// Equal timestamps are allowed for coarse clocks, but an exact repeat is a duplicate delivery
+	if sample.Timestamp.Before(state.lastTime) || (sample.Timestamp.Equal(state.lastTime) && sample.Value == state.lastValue) {
+		return FaultTimestamp, fmt.Sprintf("timestamp %s is not after %s", sample.Timestamp.Format(time.RFC3339Nano), state.lastTime.Format(time.RFC3339Nano))
+	}
+	if sample.Timestamp.After(m.now().Add(m.futureSkew)) {
+		return FaultTimestamp, fmt.Sprintf("timestamp %s is in the future", sample.Timestamp.Format(time.RFC3339Nano))
+	}
+
+	rule := state.rule
+	if rule != nil {
+		if rule.config.Min != nil && sample.Value < *rule.config.Min {
+			return FaultOutOfRange, fmt.Sprintf("reading %.4g below physical minimum %.4g", sample.Value, *rule.config.Min)
+		}
+		if rule.config.Max != nil && sample.Value > *rule.config.Max {
+			return FaultOutOfRange, fmt.Sprintf("reading %.4g above physical maximum %.4g", sample.Value, *rule.config.Max)
+		}
+	}
+
+	// The timestamp is valid from here on, so a late arrival after a long silence is a gap
+	previous := state.lastTime
+	state.lastTime, state.lastValue = sample.Timestamp, sample.Value
+	if rule != nil && rule.maxGap > 0 && !previous.IsZero() {
+		if silence := sample.Timestamp.Sub(previous); silence > rule.maxGap {
+			// Gaps only seen on arrival (e.g. after a restart of the collector) are reported once here
+			if _, active := state.active[FaultGap]; !active {
+				m.report(state, sample.Series, FaultGap, fmt.Sprintf("no readings for %s", silence.Round(time.Second)), sample.Timestamp)
+			}
+		}
+	}
+
+	if rule == nil || rule.config.StuckCount <= 0 {
+		return "", ""
+	}
+	if state.runCount > 0 && math.Abs(sample.Value-state.runValue) <= rule.config.StuckTolerance {
+		state.runCount++
+	} else {
+		state.runValue, state.runStart, state.runCount = sample.Value, sample.Timestamp, 1
+		m.clear(state, sample.Series, sample.Timestamp, FaultStuck)
+		return "", ""
+	}
+	if state.runCount >= rule.config.StuckCount && sample.Timestamp.Sub(state.runStart) >= rule.stuckDuration {
+		return FaultStuck, fmt.Sprintf("reading frozen at %.4g for %d samples since %s", state.runValue, state.runCount, state.runStart.Format(time.RFC3339))
+	}
+	return "", ""
+}
+
+// raise marks a fault active and reports it unless the same fault was reported recently.
+func (m *DataQualityMonitor) raise(state *sensorState, series, fault, detail string, timestamp time.Time) {
+	if _, active := state.active[fault]; !active {
+		state.active[fault] = timestamp
+	}
+	if last, reported := state.lastRaised[fault]; reported && timestamp.Sub(last) < m.repeat && timestamp.After(last) {
+		return
+	}
+	state.lastRaised[fault] = timestamp
+	m.report(state, series, fault, detail, timestamp)
+}
+
+// report queues a sensor fault event.
+func (m *DataQualityMonitor) report(state *sensorState, series, fault, detail string, timestamp time.Time) {
+	m.logger.Printf("Sensor fault on %s (%s): %s\n", series, fault, detail)
+	m.pending = append(m.pending, m.faultAlert(state, series, fault, detail, timestamp))
+}
+
+// clear ends the given faults if they are active, queuing a recovery event for each one whose
+// fault event was sent; faults suppressed as repeats recover silently.
+func (m *DataQualityMonitor) clear(state *sensorState, series string, timestamp time.Time, faults ...string) {
+	for _, fault := range faults {
+		since, active := state.active[fault]
+		if !active {
+			continue
+		}
+		delete(state.active, fault)
+		if state.lastRaised[fault].Before(since) {
+			continue
+		}
+		m.logger.Printf("Sensor %s recovered from %s\n", series, fault)
+		m.pending = append(m.pending, m.recoveryAlert(state, series, fault, timestamp))
+	}
+}
+
+// faultAlert builds a sensor fault event.
+func (m *DataQualityMonitor) faultAlert(state *sensorState, series, fault, detail string, timestamp time.Time) Alert {
+	return Alert{
+		Source:    "data_quality",
+		Severity:  SeverityWarning,
+		Message:   fmt.Sprintf("Sensor fault on %s (%s): %s", series, fault, detail),
+		Timestamp: timestamp,
+		Details: map[string]interface{}{
+			"event":  "sensor_fault",
+			"series": series,
+			"fault":  fault,
+			"health": healthScore(state),
+		},
+	}
+}
+
+// recoveryAlert builds the event sent when a sensor fault clears.
+func (m *DataQualityMonitor) recoveryAlert(state *sensorState, series, fault string, timestamp time.Time) Alert {
+	return Alert{
+		Source:    "data_quality",
+		Severity:  SeverityInfo,
+		Message:   fmt.Sprintf("Sensor %s recovered from %s", series, fault),
+		Timestamp: timestamp,
+		Details: map[string]interface{}{
+			"event":  "sensor_recovered",
+			"series": series,
+			"fault":  fault,
+			"health": healthScore(state),
+		},
+	}
+}
+
+// Evaluate raises gap faults for sensors that have been silent for longer than their rule allows.
+// The fault clears when the next valid reading arrives.
+func (m *DataQualityMonitor) Evaluate(now time.Time) {
+	m.mutex.Lock()
+	for series, state := range m.sensors {
+		if state.rule == nil || state.rule.maxGap == 0 || state.lastTime.IsZero() {
+			continue
+		}
+		if _, active := state.active[FaultGap]; active {
+			continue
+		}
+		if silence := now.Sub(state.lastTime); silence > state.rule.maxGap {
+			m.raise(state, series, FaultGap, fmt.Sprintf("no readings for %s", silence.Round(time.Second)), now)
+		}
+	}
+	m.deliver()
+}
+
+// healthScore combines the share of valid readings with the faults currently active into a 0-100 score.
+func healthScore(state *sensorState) float64 {
+	score := 100 * state.quality
+	if _, gap := state.active[FaultGap]; gap {
+		score /= 2 // A silent sensor's last readings say little about its current state
+	}
+	return math.Round(score*10) / 10
+}
+
+// Health returns the health of every series seen so far, ordered by series name.
+func (m *DataQualityMonitor) Health() []SensorHealth {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	health := make([]SensorHealth, 0, len(m.sensors))
+	for series, state := range m.sensors {
+		health = append(health, sensorHealth(series, state))
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Series < health[j].Series })
+	return health
+}
+
+// HealthOf returns the health of one series.
+func (m *DataQualityMonitor) HealthOf(series string) (SensorHealth, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	state, exists := m.sensors[series]
+	if !exists {
+		return SensorHealth{}, false
+	}
+	return sensorHealth(series, state), true
+}
+
+// sensorHealth snapshots the state of a series.
+func sensorHealth(series string, state *sensorState) SensorHealth {
+	rejected := make(map[string]int, len(state.rejected))
+	for fault, count := range state.rejected {
+		rejected[fault] = count
+	}
+	faults := make([]string, 0, len(state.active))
+	for fault := range state.active {
+		faults = append(faults, fault)
+	}
+	sort.Strings(faults)
+	return SensorHealth{
+		Series:   series,
+		Score:    healthScore(state),
+		Accepted: state.accepted,
+		Rejected: rejected,
+		Faults:   faults,
+		LastSeen: state.lastTime,
+	}
+}
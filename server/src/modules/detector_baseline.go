@@ -0,0 +1,102 @@
+// server/src/modules/detector_baseline.go
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	baselineMinSamples = 30    // Samples required before a baseline replaces per-cycle statistics
+	baselineMaxWeight  = 10000 // Cap on the effective sample count so old behaviour is gradually forgotten
+)
+
+// SeriesBaseline is the long-running mean and variance of a series, used as the reference for anomaly detection.
+type SeriesBaseline struct {
+	Count     float64   `json:"count"`      // Effective number of samples, capped at baselineMaxWeight
+	Mean      float64   `json:"mean"`       // Running mean
+	M2        float64   `json:"m2"`         // Sum of squared deviations from the mean
+	UpdatedAt time.Time `json:"updated_at"` // Time of the last merge
+}
+
+// Ready reports whether enough samples have been seen for the baseline to be trusted.
+func (b *SeriesBaseline) Ready() bool {
+	return b.Count >= baselineMinSamples
+}
+
+// StdDev returns the population standard deviation of the baseline.
+func (b *SeriesBaseline) StdDev() float64 {
+	if b.Count == 0 {
+		return 0
+	}
+	return math.Sqrt(b.M2 / b.Count)
+}
+
+// Merge folds a batch of values into the baseline using the parallel form of Welford's algorithm.
+func (b *SeriesBaseline) Merge(values []float64, now time.Time) {
+	if len(values) == 0 {
+		return
+	}
+
+	batchCount := float64(len(values))
+	batchMean := 0.0
+	for _, value := range values {
+		batchMean += value
+	}
+	batchMean /= batchCount
+	batchM2 := 0.0
+	for _, value := range values {
+		batchM2 += (value - batchMean) * (value - batchMean)
+	}
+
+	total := b.Count + batchCount
+	delta := batchMean - b.Mean
+	b.Mean += delta * batchCount / total
+	b.M2 += batchM2 + delta*delta*b.Count*batchCount/total
+	b.Count = total
+
+	// Scale down rather than reset so the baseline tracks slow drift without losing its variance
+	if b.Count > baselineMaxWeight {
+		scale := baselineMaxWeight / b.Count
+		b.Count *= scale
+		b.M2 *= scale
+	}
+	b.UpdatedAt = now
+}
+
+// loadBaselines reads persisted baselines; a missing file yields an empty set.
+func loadBaselines(path string) (map[string]*SeriesBaseline, error) {
+	baselines := make(map[string]*SeriesBaseline)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return baselines, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &baselines); err != nil {
+		return nil, err
+	}
+	return baselines, nil
+}
+
+// saveBaselines writes baselines atomically so a crash mid-write never leaves a truncated file.
+func saveBaselines(path string, baselines map[string]*SeriesBaseline) error {
+	data, err := json.MarshalIndent(baselines, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
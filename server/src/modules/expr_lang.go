@@ -0,0 +1,760 @@
+// server/src/modules/expr_lang.go
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// This file implements the small expression language used by user-defined analytics functions.
+// A program is a sequence of statements separated by ";" or newlines:
+//
+//	state.total = state.total + flow * dt   # persistent across invocations
+//	rate = flow * 60                        # local variable
+//	total > 1000 ? rate : nan               # the last statement is the result
+//
+// Values are numbers or, in window mode, arrays of numbers. There are no loops or user-defined
+// functions, and evaluation is metered: every node costs a step, array functions cost one step per
+// element, and arrays, variables and state entries are charged against a memory budget.
+
+var (
+	// ErrExprStepLimit is returned when a program exceeds its evaluation step budget.
+	ErrExprStepLimit = errors.New("expression step limit exceeded")
+	// ErrExprMemoryLimit is returned when a program exceeds its memory budget.
+	ErrExprMemoryLimit = errors.New("expression memory limit exceeded")
+	// ErrExprTimeout is returned when a program runs past its deadline.
+	ErrExprTimeout = errors.New("expression deadline exceeded")
+)
+
+// exprValue is a number or an array of numbers.
+type exprValue struct {
+	number float64
+	array  []float64
+	isList bool
+}
+
+// scalar wraps a number.
+func scalar(number float64) exprValue {
+	return exprValue{number: number}
+}
+
+// truth converts a boolean to the language's 1/0 representation.
+func truth(condition bool) exprValue {
+	if condition {
+		return scalar(1)
+	}
+	return scalar(0)
+}
+
+// exprLimits bounds the resources a single evaluation may use.
+type exprLimits struct {
+	maxSteps  int
+	maxMemory int // Bytes
+	timeout   time.Duration
+}
+
+// exprContext holds the variables and metering of one evaluation.
+type exprContext struct {
+	limits   exprLimits
+	steps    int
+	memory   int
+	deadline time.Time
+	vars     map[string]exprValue
+	state    map[string]float64 // Persistent across evaluations; owned by the caller
+}
+
+// newExprContext creates a context, charging the memory of the persisted state up front.
+func newExprContext(limits exprLimits, state map[string]float64) *exprContext {
+	ctx := &exprContext{
+		limits:   limits,
+		deadline: time.Now().Add(limits.timeout),
+		vars:     make(map[string]exprValue),
+		state:    state,
+	}
+	for name := range state {
+		ctx.memory += 16 + len(name)
+	}
+	return ctx
+}
+
+// step charges n evaluation steps and checks the deadline periodically.
+func (ctx *exprContext) step(n int) error {
+	ctx.steps += n
+	if ctx.steps > ctx.limits.maxSteps {
+		return ErrExprStepLimit
+	}
+	if ctx.steps&0x3ff < n && ctx.limits.timeout > 0 && time.Now().After(ctx.deadline) {
+		return ErrExprTimeout
+	}
+	return nil
+}
+
+// charge accounts for bytes of memory.
+func (ctx *exprContext) charge(bytes int) error {
+	ctx.memory += bytes
+	if ctx.memory > ctx.limits.maxMemory {
+		return ErrExprMemoryLimit
+	}
+	return nil
+}
+
+// bind sets a variable, charging for new names and array contents.
+func (ctx *exprContext) bind(name string, value exprValue) error {
+	cost := 0
+	if _, exists := ctx.vars[name]; !exists {
+		cost += 16 + len(name)
+	}
+	if value.isList {
+		cost += 8 * len(value.array)
+	}
+	if err := ctx.charge(cost); err != nil {
+		return err
+	}
+	ctx.vars[name] = value
+	return nil
+}
+
+// exprNode is a node of a parsed program.
+type exprNode interface {
+	eval(ctx *exprContext) (exprValue, error)
+}
+
+// exprProgram is a parsed, reusable program.
+type exprProgram struct {
+	statements []exprNode
+	reads      map[string]bool // Variable names the program reads, for validating inputs
+	assigns    map[string]bool // Local variable names the program assigns
+}
+
+// run evaluates every statement and returns the value of the last one.
+func (p *exprProgram) run(ctx *exprContext) (exprValue, error) {
+	var result exprValue
+	for _, statement := range p.statements {
+		value, err := statement.eval(ctx)
+		if err != nil {
+			return exprValue{}, err
+		}
+		result = value
+	}
+	return result, nil
+}
+
+type numberNode struct{ value float64 }
+
+func (n *numberNode) eval(ctx *exprContext) (exprValue, error) {
+	return scalar(n.value), ctx.step(1)
+}
+
+type variableNode struct{ name string }
+
+func (n *variableNode) eval(ctx *exprContext) (exprValue, error) {
+	if err := ctx.step(1); err != nil {
+		return exprValue{}, err
+	}
+	value, exists := ctx.vars[n.name]
+	if !exists {
+		return exprValue{}, fmt.Errorf("undefined variable %q", n.name)
+	}
+	return value, nil
+}
+
+type stateNode struct{ name string }
+
+func (n *stateNode) eval(ctx *exprContext) (exprValue, error) {
+	// Unset state reads as 0 so accumulators need no initialisation
+	return scalar(ctx.state[n.name]), ctx.step(1)
+}
+
+type assignNode struct {
+	name    string
+	toState bool
+	value   exprNode
+}
+
+func (n *assignNode) eval(ctx *exprContext) (exprValue, error) {
+	value, err := n.value.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if err := ctx.step(1); err != nil {
+		return exprValue{}, err
+	}
+	if !n.toState {
+		return value, ctx.bind(n.name, value)
+	}
+	if value.isList {
+		return exprValue{}, fmt.Errorf("state.%s can only hold a number", n.name)
+	}
+	if _, exists := ctx.state[n.name]; !exists {
+		if err := ctx.charge(16 + len(n.name)); err != nil {
+			return exprValue{}, err
+		}
+	}
+	ctx.state[n.name] = value.number
+	return value, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(ctx *exprContext) (exprValue, error) {
+	value, err := n.operand.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if err := ctx.step(1); err != nil {
+		return exprValue{}, err
+	}
+	if value.isList {
+		return exprValue{}, fmt.Errorf("operator %s needs a number", n.op)
+	}
+	if n.op == "!" {
+		return truth(value.number == 0), nil
+	}
+	return scalar(-value.number), nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(ctx *exprContext) (exprValue, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+	// Short-circuit logical operators
+	if n.op == "&&" && !left.isList && left.number == 0 {
+		return scalar(0), ctx.step(1)
+	}
+	if n.op == "||" && !left.isList && left.number != 0 {
+		return scalar(1), ctx.step(1)
+	}
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if err := ctx.step(1); err != nil {
+		return exprValue{}, err
+	}
+	if left.isList || right.isList {
+		return exprValue{}, fmt.Errorf("operator %s needs numbers; reduce arrays with sum, mean, last, ...", n.op)
+	}
+
+	a, b := left.number, right.number
+	switch n.op {
+	case "+":
+		return scalar(a + b), nil
+	case "-":
+		return scalar(a - b), nil
+	case "*":
+		return scalar(a * b), nil
+	case "/":
+		return scalar(a / b), nil
+	case "%":
+		return scalar(math.Mod(a, b)), nil
+	case "^":
+		return scalar(math.Pow(a, b)), nil
+	case "==":
+		return truth(a == b), nil
+	case "!=":
+		return truth(a != b), nil
+	case "<":
+		return truth(a < b), nil
+	case "<=":
+		return truth(a <= b), nil
+	case ">":
+		return truth(a > b), nil
+	case ">=":
+		return truth(a >= b), nil
+	case "&&", "||":
+		return truth(b != 0), nil
+	}
+	return exprValue{}, fmt.Errorf("unknown operator %s", n.op)
+}
+
+type conditionalNode struct {
+	condition, then, otherwise exprNode
+}
+
+func (n *conditionalNode) eval(ctx *exprContext) (exprValue, error) {
+	condition, err := n.condition.eval(ctx)
+	if err != nil {
+		return exprValue{}, err
+	}
+	if err := ctx.step(1); err != nil {
+		return exprValue{}, err
+	}
+	if condition.isList {
+		return exprValue{}, fmt.Errorf("condition needs a number")
+	}
+	if condition.number != 0 {
+		return n.then.eval(ctx)
+	}
+	return n.otherwise.eval(ctx)
+}
+
+type callNode struct {
+	name     string
+	function exprFunction
+	args     []exprNode
+}
+
+func (n *callNode) eval(ctx *exprContext) (exprValue, error) {
+	args := make([]exprValue, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return exprValue{}, err
+		}
+		args[i] = value
+	}
+	cost := 1
+	for _, arg := range args {
+		cost += len(arg.array)
+	}
+	if err := ctx.step(cost); err != nil {
+		return exprValue{}, err
+	}
+	value, err := n.function.call(args)
+	if err != nil {
+		return exprValue{}, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return value, nil
+}
+
+// exprFunction is a built-in function.
+type exprFunction struct {
+	minArgs, maxArgs int // maxArgs < 0 means variadic
+	call             func(args []exprValue) (exprValue, error)
+}
+
+// numericFunction adapts a float function of fixed arity.
+func numericFunction(arity int, fn func(args []float64) float64) exprFunction {
+	return exprFunction{minArgs: arity, maxArgs: arity, call: func(args []exprValue) (exprValue, error) {
+		numbers := make([]float64, len(args))
+		for i, arg := range args {
+			if arg.isList {
+				return exprValue{}, fmt.Errorf("argument %d must be a number", i+1)
+			}
+			numbers[i] = arg.number
+		}
+		return scalar(fn(numbers)), nil
+	}}
+}
+
+// reducingFunction adapts a reduction over all numbers in the arguments, flattening arrays.
+func reducingFunction(fn func(values []float64) float64) exprFunction {
+	return exprFunction{minArgs: 1, maxArgs: -1, call: func(args []exprValue) (exprValue, error) {
+		values := make([]float64, 0, len(args))
+		for _, arg := range args {
+			if arg.isList {
+				values = append(values, arg.array...)
+			} else {
+				values = append(values, arg.number)
+			}
+		}
+		if len(values) == 0 {
+			return scalar(math.NaN()), nil
+		}
+		return scalar(fn(values)), nil
+	}}
+}
+
+// exprFunctions lists the built-in functions.
+var exprFunctions = map[string]exprFunction{
+	"abs":   numericFunction(1, func(a []float64) float64 { return math.Abs(a[0]) }),
+	"sqrt":  numericFunction(1, func(a []float64) float64 { return math.Sqrt(a[0]) }),
+	"exp":   numericFunction(1, func(a []float64) float64 { return math.Exp(a[0]) }),
+	"ln":    numericFunction(1, func(a []float64) float64 { return math.Log(a[0]) }),
+	"log10": numericFunction(1, func(a []float64) float64 { return math.Log10(a[0]) }),
+	"pow":   numericFunction(2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }),
+	"round": numericFunction(1, func(a []float64) float64 { return math.Round(a[0]) }),
+	"floor": numericFunction(1, func(a []float64) float64 { return math.Floor(a[0]) }),
+	"ceil":  numericFunction(1, func(a []float64) float64 { return math.Ceil(a[0]) }),
+	"sin":   numericFunction(1, func(a []float64) float64 { return math.Sin(a[0]) }),
+	"cos":   numericFunction(1, func(a []float64) float64 { return math.Cos(a[0]) }),
+	"clamp": numericFunction(3, func(a []float64) float64 { return math.Max(a[1], math.Min(a[2], a[0])) }),
+	"isnan": numericFunction(1, func(a []float64) float64 {
+		if math.IsNaN(a[0]) {
+			return 1
+		}
+		return 0
+	}),
+	"min": reducingFunction(func(v []float64) float64 {
+		result := v[0]
+		for _, x := range v[1:] {
+			result = math.Min(result, x)
+		}
+		return result
+	}),
+	"max": reducingFunction(func(v []float64) float64 {
+		result := v[0]
+		for _, x := range v[1:] {
+			result = math.Max(result, x)
+		}
+		return result
+	}),
+	"sum": reducingFunction(func(v []float64) float64 {
+		result := 0.0
+		for _, x := range v {
+			result += x
+		}
+		return result
+	}),
+	"mean": reducingFunction(func(v []float64) float64 {
+		result := 0.0
+		for _, x := range v {
+			result += x
+		}
+		return result / float64(len(v))
+	}),
+	"stddev": reducingFunction(func(v []float64) float64 {
+		mean, squares := 0.0, 0.0
+		for _, x := range v {
+			mean += x
+		}
+		mean /= float64(len(v))
+		for _, x := range v {
+			squares += (x - mean) * (x - mean)
+		}
+		return math.Sqrt(squares / float64(len(v)))
+	}),
+	"count": reducingFunction(func(v []float64) float64 { return float64(len(v)) }),
+	"first": reducingFunction(func(v []float64) float64 { return v[0] }),
+	"last":  reducingFunction(func(v []float64) float64 { return v[len(v)-1] }),
+}
+
+// exprConstants are predefined, read-only names.
+var exprConstants = map[string]float64{
+	"pi":  math.Pi,
+	"e":   math.E,
+	"nan": math.NaN(),
+	"inf": math.Inf(1),
+}
+
+// exprToken is a lexical token.
+type exprToken struct {
+	kind  string // "number", "ident", "op", "sep" or "eof"
+	text  string
+	value float64
+	pos   int
+}
+
+// lexExpr splits source into tokens. Newlines and ";" become statement separators; "#" starts a comment.
+func lexExpr(source string) ([]exprToken, error) {
+	tokens := make([]exprToken, 0)
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '#':
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '\n' || c == ';':
+			tokens = append(tokens, exprToken{kind: "sep", text: string(c), pos: i})
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.' ||
+				source[i] == 'e' || source[i] == 'E' ||
+				(source[i] == '-' || source[i] == '+') && (source[i-1] == 'e' || source[i-1] == 'E')) {
+				i++
+			}
+			value, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d", source[start:i], start)
+			}
+			tokens = append(tokens, exprToken{kind: "number", text: source[start:i], value: value, pos: start})
+		case c == '_' || unicode.IsLetter(rune(c)):
+			start := i
+			for i < len(source) && (source[i] == '_' || unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i]))) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: source[start:i], pos: start})
+		default:
+			op := string(c)
+			if i+1 < len(source) {
+				switch pair := source[i : i+2]; pair {
+				case "==", "!=", "<=", ">=", "&&", "||":
+					op = pair
+				}
+			}
+			if !strings.Contains("+-*/%^()<>=!?:,.&&||", op[:1]) {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: "op", text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, exprToken{kind: "eof", pos: len(source)}), nil
+}
+
+// exprParser is a recursive-descent parser over a token list.
+type exprParser struct {
+	tokens  []exprToken
+	pos     int
+	reads   map[string]bool
+	assigns map[string]bool
+}
+
+// compileExpr parses source into a program.
+func compileExpr(source string) (*exprProgram, error) {
+	tokens, err := lexExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &exprParser{tokens: tokens, reads: make(map[string]bool), assigns: make(map[string]bool)}
+	program := &exprProgram{reads: parser.reads, assigns: parser.assigns}
+	for {
+		for parser.peek().kind == "sep" {
+			parser.pos++
+		}
+		if parser.peek().kind == "eof" {
+			break
+		}
+		statement, err := parser.statement()
+		if err != nil {
+			return nil, err
+		}
+		program.statements = append(program.statements, statement)
+		if next := parser.peek(); next.kind != "sep" && next.kind != "eof" {
+			return nil, fmt.Errorf("unexpected %q at %d", next.text, next.pos)
+		}
+	}
+	if len(program.statements) == 0 {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	return program, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is the given operator.
+func (p *exprParser) accept(op string) bool {
+	if token := p.peek(); token.kind == "op" && token.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// expect consumes the given operator or fails.
+func (p *exprParser) expect(op string) error {
+	if !p.accept(op) {
+		token := p.peek()
+		return fmt.Errorf("expected %q at %d, found %q", op, token.pos, token.text)
+	}
+	return nil
+}
+
+// statement parses an assignment or an expression.
+func (p *exprParser) statement() (exprNode, error) {
+	start := p.pos
+	if token := p.peek(); token.kind == "ident" {
+		p.pos++
+		toState, name := false, token.text
+		if name == "state" && p.accept(".") {
+			field := p.next()
+			if field.kind != "ident" {
+				return nil, fmt.Errorf("expected a state field name at %d", field.pos)
+			}
+			toState, name = true, field.text
+		}
+		if p.accept("=") {
+			if !toState {
+				if _, constant := exprConstants[name]; constant || name == "state" {
+					return nil, fmt.Errorf("cannot assign to %s", name)
+				}
+			}
+			value, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			if !toState {
+				p.assigns[name] = true
+			}
+			return &assignNode{name: name, toState: toState, value: value}, nil
+		}
+		p.pos = start
+	}
+	return p.expression()
+}
+
+// expression parses a conditional expression.
+func (p *exprParser) expression() (exprNode, error) {
+	condition, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if !p.accept("?") {
+		return condition, nil
+	}
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &conditionalNode{condition: condition, then: then, otherwise: otherwise}, nil
+}
+
+// exprPrecedence lists binary operator precedence levels, lowest first.
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses left-associative binary operators at the given precedence level and above.
+func (p *exprParser) binary(level int) (exprNode, error) {
+	if level == len(exprPrecedence) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		token := p.peek()
+		matched := false
+		if token.kind == "op" {
+			for _, op := range exprPrecedence[level] {
+				if token.text == op {
+					matched = true
+					break
+				}
+			}
+		}
+		if !matched {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: token.text, left: left, right: right}
+	}
+}
+
+// unary parses prefix operators and exponentiation, which is right-associative and binds tighter.
+func (p *exprParser) unary() (exprNode, error) {
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: "-", operand: operand}, nil
+	}
+	if p.accept("!") {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: "!", operand: operand}, nil
+	}
+	base, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("^") {
+		exponent, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &binaryNode{op: "^", left: base, right: exponent}, nil
+	}
+	return base, nil
+}
+
+// primary parses numbers, names, state fields, calls and parenthesised expressions.
+func (p *exprParser) primary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case "number":
+		return &numberNode{value: token.value}, nil
+	case "ident":
+		if token.text == "state" {
+			if err := p.expect("."); err != nil {
+				return nil, err
+			}
+			field := p.next()
+			if field.kind != "ident" {
+				return nil, fmt.Errorf("expected a state field name at %d", field.pos)
+			}
+			return &stateNode{name: field.text}, nil
+		}
+		if p.accept("(") {
+			function, known := exprFunctions[token.text]
+			if !known {
+				return nil, fmt.Errorf("unknown function %q at %d", token.text, token.pos)
+			}
+			args := make([]exprNode, 0)
+			if !p.accept(")") {
+				for {
+					arg, err := p.expression()
+					if err != nil {
+						return nil, err
+					}
+					args = append(args, arg)
+					if p.accept(")") {
+						break
+					}
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if len(args) < function.minArgs || (function.maxArgs >= 0 && len(args) > function.maxArgs) {
+				return nil, fmt.Errorf("wrong number of arguments to %s at %d", token.text, token.pos)
+			}
+			return &callNode{name: token.text, function: function, args: args}, nil
+		}
+		if value, constant := exprConstants[token.text]; constant {
+			return &numberNode{value: value}, nil
+		}
+		p.reads[token.text] = true
+		return &variableNode{name: token.text}, nil
+	case "op":
+		if token.text == "(" {
+			inner, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		}
+	}
+	if token.kind == "eof" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", token.text, token.pos)
+}
@@ -0,0 +1,253 @@
+// server/src/modules/forecast_models.go
+
+package modules
+
+import (
+	"math"
+)
+
+// forecastPoint is a predicted value with its prediction band.
+type forecastPoint struct {
+	value float64
+	lower float64
+	upper float64
+}
+
+// forecastModel is a per-series model fed with points on a grid of forecast steps. Steps without a
+// point are skipped, so models must place each point by its time.
+type forecastModel interface {
+	// observe adds the point of a later step; t is in seconds since the series was first seen
+	observe(t, value float64)
+	// ready reports whether enough points have been observed to forecast
+	ready() bool
+	// predict forecasts the value steps ahead of the last observed point, with a band of sigma standard deviations
+	predict(steps int, sigma float64) forecastPoint
+}
+
+// linearTrendModel fits an ordinary least-squares line over a sliding window of points.
+type linearTrendModel struct {
+	times  []float64  // Circular window of point times, in seconds
+	values []float64  // Circular window of point values
+	next   int        // Index the next point is written to
+	count  int        // Number of points held
+	step   float64    // Seconds between points
+	fit    *linearFit // Cached fit, cleared whenever a point is observed
+}
+
+// linearFit is a least-squares line with the statistics needed for its prediction interval.
+type linearFit struct {
+	slope          float64
+	intercept      float64
+	meanT          float64
+	sxx            float64 // Sum of squared deviations of the times from meanT
+	residualStdDev float64
+	lastT          float64
+	n              float64
+}
+
+// newLinearTrendModel creates a linear model over the last window points.
+func newLinearTrendModel(window int, step float64) *linearTrendModel {
+	return &linearTrendModel{
+		times:  make([]float64, window),
+		values: make([]float64, window),
+		step:   step,
+	}
+}
+
+// observe adds a point, evicting the oldest one when the window is full.
+func (m *linearTrendModel) observe(t, value float64) {
+	m.times[m.next] = t
+	m.values[m.next] = value
+	m.next = (m.next + 1) % len(m.times)
+	if m.count < len(m.times) {
+		m.count++
+	}
+	m.fit = nil
+}
+
+// ready reports whether enough points are held for a meaningful fit.
+func (m *linearTrendModel) ready() bool {
+	return m.count >= 10
+}
+
+// predict extrapolates the fitted line with a least-squares prediction interval.
+func (m *linearTrendModel) predict(steps int, sigma float64) forecastPoint {
+	if m.fit == nil {
+		m.fit = m.fitLine()
+	}
+	fit := m.fit
+	if fit.sxx == 0 {
+		return forecastPoint{value: fit.intercept, lower: fit.intercept, upper: fit.intercept}
+	}
+
+	t := fit.lastT + float64(steps)*m.step
+	value := fit.intercept + fit.slope*t
+	// Prediction interval widens with distance from the centre of the fitted window
+	width := sigma * fit.residualStdDev * math.Sqrt(1+1/fit.n+(t-fit.meanT)*(t-fit.meanT)/fit.sxx)
+	return forecastPoint{value: value, lower: value - width, upper: value + width}
+}
+
+// fitLine computes the least-squares fit over the points in the window.
+func (m *linearTrendModel) fitLine() *linearFit {
+	fit := &linearFit{n: float64(m.count), lastT: math.Inf(-1)}
+	meanV := 0.0
+	for i := 0; i < m.count; i++ {
+		fit.meanT += m.times[i]
+		meanV += m.values[i]
+		fit.lastT = math.Max(fit.lastT, m.times[i])
+	}
+	fit.meanT /= fit.n
+	meanV /= fit.n
+
+	sxy := 0.0
+	for i := 0; i < m.count; i++ {
+		dt := m.times[i] - fit.meanT
+		fit.sxx += dt * dt
+		sxy += dt * (m.values[i] - meanV)
+	}
+	if fit.sxx == 0 {
+		fit.intercept = meanV // A single distinct time: forecast the mean
+		return fit
+	}
+	fit.slope = sxy / fit.sxx
+	fit.intercept = meanV - fit.slope*fit.meanT
+
+	residualSum := 0.0
+	for i := 0; i < m.count; i++ {
+		residual := m.values[i] - (fit.intercept + fit.slope*m.times[i])
+		residualSum += residual * residual
+	}
+	fit.residualStdDev = math.Sqrt(residualSum / math.Max(fit.n-2, 1))
+	return fit
+}
+
+// holtWintersModel is an additive Holt-Winters (triple exponential smoothing) model.
+type holtWintersModel struct {
+	alpha, beta, gamma float64   // Smoothing factors for level, trend and season
+	step               float64   // Seconds between points
+	seasonal           []float64 // Seasonal offsets, one per step of the season
+	level              float64
+	trend              float64
+	errorVariance      float64   // Exponentially weighted variance of one-step-ahead errors
+	initial            []float64 // Points buffered until two full seasons are available for initialisation
+	index              int       // Season position of the next point
+	lastT              float64   // Time of the last point, buffered ones included
+	initialised        bool
+}
+
+// newHoltWintersModel creates a model with a season of seasonLength steps of step seconds.
+func newHoltWintersModel(seasonLength int, step, alpha, beta, gamma float64) *holtWintersModel {
+	return &holtWintersModel{
+		alpha:    alpha,
+		beta:     beta,
+		gamma:    gamma,
+		step:     step,
+		seasonal: make([]float64, seasonLength),
+		initial:  make([]float64, 0, 2*seasonLength),
+	}
+}
+
+// observe updates level, trend and season with the point at t. Steps missed since the last point are
+// filled in first, so the season stays aligned with time: before initialisation by interpolating, and
+// after it by advancing the model as forecast. After a gap of more than two seasons the model is stale
+// and starts again from this point.
+func (m *holtWintersModel) observe(t, value float64) {
+	length := len(m.seasonal)
+	missed := 0
+	if m.initialised || len(m.initial) > 0 {
+		missed = int(math.Round((t-m.lastT)/m.step)) - 1
+		if missed < 0 {
+			return // Not a later step
+		}
+	}
+	m.lastT = t
+	if missed > 2*length {
+		m.reset()
+		missed = 0
+	}
+
+	for k := 1; k <= missed; k++ {
+		if m.initialised {
+			m.level += m.trend
+			m.index = (m.index + 1) % length
+			continue
+		}
+		previous := m.initial[len(m.initial)-1] // missed-k+2 steps before value
+		m.buffer(previous + (value-previous)/float64(missed-k+2))
+	}
+	if !m.initialised {
+		m.buffer(value)
+		return
+	}
+
+	season := m.seasonal[m.index]
+	predicted := m.level + m.trend + season
+	forecastError := value - predicted
+	m.errorVariance = 0.9*m.errorVariance + 0.1*forecastError*forecastError
+
+	previousLevel := m.level
+	m.level = m.alpha*(value-season) + (1-m.alpha)*(m.level+m.trend)
+	m.trend = m.beta*(m.level-previousLevel) + (1-m.beta)*m.trend
+	m.seasonal[m.index] = m.gamma*(value-m.level) + (1-m.gamma)*season
+	m.index = (m.index + 1) % length
+}
+
+// buffer adds a point to those awaiting initialisation, initialising once two seasons are held.
+func (m *holtWintersModel) buffer(value float64) {
+	m.initial = append(m.initial, value)
+	if len(m.initial) == 2*len(m.seasonal) {
+		m.initialise()
+	}
+}
+
+// reset discards everything learnt, so the model initialises again from the next points.
+func (m *holtWintersModel) reset() {
+	m.initial = make([]float64, 0, 2*len(m.seasonal))
+	m.level, m.trend, m.errorVariance, m.index = 0, 0, 0, 0
+	m.initialised = false
+}
+
+// initialise derives the starting level, trend and season from the first two seasons.
+func (m *holtWintersModel) initialise() {
+	length := len(m.seasonal)
+	first, second := 0.0, 0.0
+	for i := 0; i < length; i++ {
+		first += m.initial[i]
+		second += m.initial[length+i]
+	}
+	first /= float64(length)
+	second /= float64(length)
+
+	m.trend = (second - first) / float64(length)
+	// trendLevel is the deseasonalised level at a position in the initial points
+	trendLevel := func(i int) float64 {
+		return first + m.trend*(float64(i)-float64(length-1)/2)
+	}
+	for i := 0; i < length; i++ {
+		m.seasonal[i] = (m.initial[i] - trendLevel(i) + m.initial[length+i] - trendLevel(length+i)) / 2
+	}
+	m.level = trendLevel(2*length - 1)
+
+	residualSum := 0.0
+	for i, value := range m.initial {
+		fitted := trendLevel(i) + m.seasonal[i%length]
+		residualSum += (value - fitted) * (value - fitted)
+	}
+	m.errorVariance = residualSum / float64(len(m.initial))
+
+	m.initial = nil
+	m.index = 0
+	m.initialised = true
+}
+
+// ready reports whether the model has been initialised.
+func (m *holtWintersModel) ready() bool {
+	return m.initialised
+}
+
+// predict forecasts steps ahead; the band grows with the square root of the horizon.
+func (m *holtWintersModel) predict(steps int, sigma float64) forecastPoint {
+	value := m.level + float64(steps)*m.trend + m.seasonal[(m.index+steps-1)%len(m.seasonal)]
+	width := sigma * math.Sqrt(m.errorVariance*float64(steps))
+	return forecastPoint{value: value, lower: value - width, upper: value + width}
+}
@@ -0,0 +1,65 @@
+// server/src/modules/forecast_models_test.go
+
+package modules
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLinearTrendModelExtrapolates(t *testing.T) {
+	model := newLinearTrendModel(30, 60)
+	for i := 0; i < 40; i++ {
+		noise := 0.2 * float64(i%3-1) // Deterministic residuals of -0.2, 0 and 0.2
+		model.observe(float64(i)*60, 10+0.5*float64(i)+noise)
+	}
+	if !model.ready() {
+		t.Fatal("model not ready after a full window")
+	}
+
+	// Only the last 30 points are fitted, and the line continues from the last one
+	near, far := model.predict(1, 2), model.predict(20, 2)
+	if math.Abs(near.value-(10+0.5*40)) > 0.1 || math.Abs(far.value-(10+0.5*59)) > 0.2 {
+		t.Fatalf("predicted %.2f and %.2f, want about 30 and 39.5", near.value, far.value)
+	}
+	if !(near.lower < near.value && near.value < near.upper) || far.upper-far.lower <= near.upper-near.lower {
+		t.Fatalf("bands %+v and %+v do not widen with the horizon", near, far)
+	}
+}
+
+// seasonalValue is a daily-shaped cycle of 24 steps on a slow upward trend.
+func seasonalValue(step int) float64 {
+	return 100 + 0.05*float64(step) + 10*math.Sin(2*math.Pi*float64(step)/24)
+}
+
+func TestHoltWintersKeepsSeasonAcrossGaps(t *testing.T) {
+	model := newHoltWintersModel(24, 60, 0.3, 0.05, 0.1)
+	for step := 0; step < 120; step++ {
+		// Steps missed during initialisation and after it must not shift the season
+		if (step >= 10 && step < 13) || (step >= 70 && step < 81) {
+			continue
+		}
+		model.observe(float64(step)*60, seasonalValue(step))
+	}
+	if !model.ready() {
+		t.Fatal("model not initialised after five seasons")
+	}
+	for k := 1; k <= 24; k++ {
+		if predicted := model.predict(k, 2).value; math.Abs(predicted-seasonalValue(119+k)) > 1 {
+			t.Fatalf("%d steps ahead predicted %.2f, want %.2f", k, predicted, seasonalValue(119+k))
+		}
+	}
+
+	// A point at or before the last one is not a new step
+	level := model.level
+	model.observe(119*60, 500)
+	if model.level != level {
+		t.Fatal("repeated step changed the model")
+	}
+
+	// After more than two seasons without points the model starts over
+	model.observe(200*60, seasonalValue(200))
+	if model.ready() {
+		t.Fatal("model kept forecasting after a gap of three seasons")
+	}
+}
@@ -0,0 +1,380 @@
+// server/src/modules/forecaster.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+const (
+	ForecastModelLinear      = "linear"       // Least-squares trend with residual prediction bands
+	ForecastModelHoltWinters = "holt-winters" // Additive seasonal exponential smoothing
+
+	forecastMaxSeasonSteps = 1440 // Caps Holt-Winters memory at 1440 floats per series
+)
+
+// ForecastConfig selects the forecasting model and limit for series matching a pattern.
+type ForecastConfig struct {
+	Series    string  `json:"series"`    // path.Match pattern on series names
+	Model     string  `json:"model"`     // "linear" (default) or "holt-winters"
+	Limit     float64 `json:"limit"`     // Threshold whose crossing is predicted
+	Direction string  `json:"direction"` // "above" (default) when rising past Limit is a failure, "below" when falling is
+	Step      string  `json:"step"`      // Width of the averaged points fed to the model, default "1m"
+	Window    int     `json:"window"`    // Points the linear model is fitted over, default 360
+	Season    string  `json:"season"`    // Seasonal period for Holt-Winters, default "24h"
+	Alpha     float64 `json:"alpha"`     // Holt-Winters level smoothing, default 0.3
+	Beta      float64 `json:"beta"`      // Holt-Winters trend smoothing, default 0.05
+	Gamma     float64 `json:"gamma"`     // Holt-Winters seasonal smoothing, default 0.1
+	Horizon   string  `json:"horizon"`   // How far ahead crossings are looked for, default "72h"
+	Sigma     float64 `json:"sigma"`     // Prediction band width in standard deviations, default 2
+	Repeat    string  `json:"repeat"`    // Minimum time between repeated predictions for one series, default "1h"
+}
+
+// LoadForecastConfigs reads forecasting rules from a JSON file containing an array of ForecastConfig.
+func LoadForecastConfigs(filePath string) ([]ForecastConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read forecast config %s: %w", filePath, err)
+	}
+	var configs []ForecastConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse forecast config %s: %w", filePath, err)
+	}
+	return configs, nil
+}
+
+// Forecast is the latest prediction for a series.
+type Forecast struct {
+	Series      string    `json:"series"`
+	Model       string    `json:"model"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Limit       float64   `json:"limit"`
+	Direction   string    `json:"direction"`
+	Expected    float64   `json:"expected"` // Point forecast at the end of the horizon
+	Lower       float64   `json:"lower"`    // Lower prediction band at the end of the horizon
+	Upper       float64   `json:"upper"`    // Upper prediction band at the end of the horizon
+	// WillCross is set when the point forecast reaches Limit within the horizon; TimeToLimit is then
+	// the remaining useful life. EarliestTimeToLimit is when the prediction band first reaches Limit.
+	WillCross           bool          `json:"will_cross"`
+	TimeToLimit         time.Duration `json:"time_to_limit"`
+	BandCrosses         bool          `json:"band_crosses"`
+	EarliestTimeToLimit time.Duration `json:"earliest_time_to_limit"`
+}
+
+// forecastRule is a validated ForecastConfig.
+type forecastRule struct {
+	config      ForecastConfig
+	step        time.Duration
+	seasonSteps int
+	horizon     time.Duration
+	repeat      time.Duration
+	below       bool
+}
+
+// seriesForecast is the forecasting state of a single series.
+type seriesForecast struct {
+	rule        *forecastRule
+	model       forecastModel
+	origin      time.Time // Start of the first point, used as the model's time origin
+	bucketStart time.Time // Start of the point currently being averaged
+	bucketSum   float64
+	bucketCount int
+	lastPoint   time.Time // Start of the last point fed to the model
+	lastAlert   time.Time // When a crossing was last reported
+	latest      *Forecast
+}
+
+// Forecaster maintains per-series forecasting models and reports predicted limit crossings as alerts.
+type Forecaster struct {
+	rules  []forecastRule             // Rules in priority order; the first match wins
+	plans  map[string]*forecastRule   // Cached rule lookup per series (nil when no rule matches)
+	series map[string]*seriesForecast // Per-series model state
+	alert  func(Alert)                // Receives predicted crossings
+	mutex  sync.Mutex                 // Guards plans and series
+	logger *log.Logger                // Logger for tracking forecasting events
+}
+
+// NewForecaster validates the forecasting rules and creates a forecaster that reports crossings to alert.
+func NewForecaster(logger *log.Logger, configs []ForecastConfig, alert func(Alert)) (*Forecaster, error) {
+	rules := make([]forecastRule, 0, len(configs))
+	for _, config := range configs {
+		rule, err := parseForecastConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return &Forecaster{
+		rules:  rules,
+		plans:  make(map[string]*forecastRule),
+		series: make(map[string]*seriesForecast),
+		alert:  alert,
+		logger: logger,
+	}, nil
+}
+
+// parseForecastConfig applies defaults and validates a forecasting rule.
+func parseForecastConfig(config ForecastConfig) (forecastRule, error) {
+	if _, err := path.Match(config.Series, ""); err != nil {
+		return forecastRule{}, fmt.Errorf("invalid forecast series pattern %q: %w", config.Series, err)
+	}
+	if config.Model == "" {
+		config.Model = ForecastModelLinear
+	}
+	if config.Model != ForecastModelLinear && config.Model != ForecastModelHoltWinters {
+		return forecastRule{}, fmt.Errorf("unknown forecast model %q for %s", config.Model, config.Series)
+	}
+	if config.Direction == "" {
+		config.Direction = "above"
+	}
+	if config.Direction != "above" && config.Direction != "below" {
+		return forecastRule{}, fmt.Errorf("forecast direction for %s must be \"above\" or \"below\"", config.Series)
+	}
+	if config.Window <= 0 {
+		config.Window = 360
+	}
+	if config.Alpha <= 0 {
+		config.Alpha = 0.3
+	}
+	if config.Beta <= 0 {
+		config.Beta = 0.05
+	}
+	if config.Gamma <= 0 {
+		config.Gamma = 0.1
+	}
+	if config.Sigma <= 0 {
+		config.Sigma = 2
+	}
+
+	rule := forecastRule{config: config, below: config.Direction == "below"}
+	var err error
+	if rule.step, err = utils.ParsePositiveDuration(config.Step, "1m"); err != nil {
+		return forecastRule{}, fmt.Errorf("invalid forecast step for %s: %w", config.Series, err)
+	}
+	if rule.horizon, err = utils.ParsePositiveDuration(config.Horizon, "72h"); err != nil {
+		return forecastRule{}, fmt.Errorf("invalid forecast horizon for %s: %w", config.Series, err)
+	}
+	if rule.repeat, err = utils.ParsePositiveDuration(config.Repeat, "1h"); err != nil {
+		return forecastRule{}, fmt.Errorf("invalid forecast repeat for %s: %w", config.Series, err)
+	}
+	if config.Model == ForecastModelHoltWinters {
+		season, err := utils.ParsePositiveDuration(config.Season, "24h")
+		if err != nil {
+			return forecastRule{}, fmt.Errorf("invalid forecast season for %s: %w", config.Series, err)
+		}
+		rule.seasonSteps = int(season / rule.step)
+		if rule.seasonSteps < 2 || rule.seasonSteps > forecastMaxSeasonSteps {
+			return forecastRule{}, fmt.Errorf("forecast season for %s must span 2 to %d steps, got %d", config.Series, forecastMaxSeasonSteps, rule.seasonSteps)
+		}
+	}
+	return rule, nil
+}
+
+// Add feeds a sample to the model of its series; samples for points already fed to the model are ignored.
+func (f *Forecaster) Add(series string, timestamp time.Time, value float64) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	state := f.stateFor(series)
+	if state == nil {
+		return
+	}
+
+	bucket := timestamp.Truncate(state.rule.step)
+	if state.bucketCount > 0 {
+		if bucket.Before(state.bucketStart) {
+			return
+		}
+		if bucket.After(state.bucketStart) {
+			state.closeBucket()
+		}
+	} else if !state.lastPoint.IsZero() && !bucket.After(state.lastPoint) {
+		return // The point was closed by Evaluate before this sample arrived
+	}
+	if state.bucketCount == 0 {
+		state.bucketStart = bucket
+		if state.origin.IsZero() {
+			state.origin = bucket
+		}
+	}
+	state.bucketSum += value
+	state.bucketCount++
+}
+
+// stateFor returns the state of a series, creating it on first use; nil when no rule matches.
+func (f *Forecaster) stateFor(series string) *seriesForecast {
+	if state, exists := f.series[series]; exists {
+		return state
+	}
+
+	rule, cached := f.plans[series]
+	if !cached {
+		for i := range f.rules {
+			if matched, _ := path.Match(f.rules[i].config.Series, series); matched {
+				rule = &f.rules[i]
+				break
+			}
+		}
+		f.plans[series] = rule
+	}
+	if rule == nil {
+		return nil
+	}
+
+	state := &seriesForecast{rule: rule}
+	if rule.config.Model == ForecastModelHoltWinters {
+		state.model = newHoltWintersModel(rule.seasonSteps, rule.step.Seconds(), rule.config.Alpha, rule.config.Beta, rule.config.Gamma)
+	} else {
+		state.model = newLinearTrendModel(rule.config.Window, rule.step.Seconds())
+	}
+	f.series[series] = state
+	return state
+}
+
+// closeBucket feeds the averaged point to the model.
+func (s *seriesForecast) closeBucket() {
+	s.model.observe(s.bucketStart.Sub(s.origin).Seconds(), s.bucketSum/float64(s.bucketCount))
+	s.lastPoint = s.bucketStart
+	s.bucketSum = 0
+	s.bucketCount = 0
+}
+
+// Evaluate closes points whose step has ended, refreshes every forecast and reports predicted crossings.
+func (f *Forecaster) Evaluate(now time.Time) {
+	f.mutex.Lock()
+	alerts := make([]Alert, 0)
+	for series, state := range f.series {
+		if state.bucketCount > 0 && !now.Before(state.bucketStart.Add(state.rule.step)) {
+			state.closeBucket()
+		}
+		if !state.model.ready() {
+			continue
+		}
+
+		forecast := state.forecast(series, now)
+		state.latest = &forecast
+		if !forecast.WillCross {
+			state.lastAlert = time.Time{} // Report the next crossing straight away
+			continue
+		}
+		if !state.lastAlert.IsZero() && now.Sub(state.lastAlert) < state.rule.repeat {
+			continue
+		}
+		state.lastAlert = now
+		alerts = append(alerts, forecastAlert(forecast))
+	}
+	f.mutex.Unlock()
+
+	for _, alert := range alerts {
+		f.logger.Println(alert.Message)
+		if f.alert != nil {
+			f.alert(alert)
+		}
+	}
+}
+
+// forecast steps through the horizon looking for the first point and band crossings of the limit.
+func (s *seriesForecast) forecast(series string, now time.Time) Forecast {
+	rule := s.rule
+	forecast := Forecast{
+		Series:      series,
+		Model:       rule.config.Model,
+		GeneratedAt: now,
+		Limit:       rule.config.Limit,
+		Direction:   rule.config.Direction,
+	}
+
+	// untilStep converts a step offset from the last point into time remaining from now
+	untilStep := func(steps int) time.Duration {
+		remaining := s.lastPoint.Add(time.Duration(steps) * rule.step).Sub(now)
+		if remaining < 0 {
+			return 0
+		}
+		return remaining
+	}
+
+	steps := int(rule.horizon / rule.step)
+	var point forecastPoint
+	for k := 1; k <= steps; k++ {
+		point = s.model.predict(k, rule.config.Sigma)
+		bandEdge := point.upper
+		if rule.below {
+			bandEdge = point.lower
+		}
+		if !forecast.BandCrosses && crossesLimit(bandEdge, rule.config.Limit, rule.below) {
+			forecast.BandCrosses = true
+			forecast.EarliestTimeToLimit = untilStep(k)
+		}
+		if crossesLimit(point.value, rule.config.Limit, rule.below) {
+			forecast.WillCross = true
+			forecast.TimeToLimit = untilStep(k)
+			break // Later points are not needed once the expected crossing is known
+		}
+	}
+	forecast.Expected, forecast.Lower, forecast.Upper = point.value, point.lower, point.upper
+	return forecast
+}
+
+// crossesLimit reports whether value is at or beyond limit in the failure direction.
+func crossesLimit(value, limit float64, below bool) bool {
+	if below {
+		return value <= limit
+	}
+	return value >= limit
+}
+
+// forecastAlert builds the alert raised for a predicted crossing.
+func forecastAlert(forecast Forecast) Alert {
+	return Alert{
+		Source:   "forecaster",
+		Severity: SeverityWarning,
+		Message: fmt.Sprintf("Forecast: %s will cross %.2f in %.1f hours (%s model, earliest %.1f hours)",
+			forecast.Series, forecast.Limit, forecast.TimeToLimit.Hours(), forecast.Model, forecast.EarliestTimeToLimit.Hours()),
+		Timestamp: forecast.GeneratedAt,
+		Details: map[string]interface{}{
+			"series":                  forecast.Series,
+			"model":                   forecast.Model,
+			"limit":                   forecast.Limit,
+			"direction":               forecast.Direction,
+			"hours_to_limit":          forecast.TimeToLimit.Hours(),
+			"earliest_hours_to_limit": forecast.EarliestTimeToLimit.Hours(),
+		},
+	}
+}
+
+// Latest returns the most recent forecast for a series.
+func (f *Forecaster) Latest(series string) (Forecast, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	state, exists := f.series[series]
+	if !exists || state.latest == nil {
+		return Forecast{}, false
+	}
+	return *state.latest, true
+}
+
+// Forecasts returns the most recent forecast of every series, sorted by series name.
+func (f *Forecaster) Forecasts() []Forecast {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	forecasts := make([]Forecast, 0, len(f.series))
+	for _, state := range f.series {
+		if state.latest != nil {
+			forecasts = append(forecasts, *state.latest)
+		}
+	}
+	sort.Slice(forecasts, func(i, j int) bool { return forecasts[i].Series < forecasts[j].Series })
+	return forecasts
+}
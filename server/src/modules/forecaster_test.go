@@ -0,0 +1,80 @@
+// server/src/modules/forecaster_test.go
+
+package modules
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// newTestForecaster creates a forecaster for one rule that collects its alerts.
+func newTestForecaster(t *testing.T, config ForecastConfig) (*Forecaster, *[]Alert) {
+	t.Helper()
+	var alerts []Alert
+	forecaster, err := NewForecaster(log.New(io.Discard, "", 0), []ForecastConfig{config}, func(alert Alert) { alerts = append(alerts, alert) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return forecaster, &alerts
+}
+
+func TestForecasterAlertsTimeToLimit(t *testing.T) {
+	forecaster, alerts := newTestForecaster(t, ForecastConfig{Series: "pump1.*", Limit: 100, Step: "1m", Horizon: "2h"})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for minute := 0; minute < 60; minute++ {
+		// Two samples per step, averaged into one point
+		forecaster.Add("pump1.bearing_temp", start.Add(time.Duration(minute)*time.Minute), 49.75+0.5*float64(minute))
+		forecaster.Add("pump1.bearing_temp", start.Add(time.Duration(minute)*time.Minute+30*time.Second), 50.25+0.5*float64(minute))
+	}
+	forecaster.Add("other.temp", start, 500) // No rule matches
+	now := start.Add(time.Hour)
+	forecaster.Evaluate(now)
+
+	// The last point, at 59 minutes, is 79.5; 100 is reached 41 steps later, 40 minutes from now
+	if len(*alerts) != 1 {
+		t.Fatalf("%d alerts, want 1", len(*alerts))
+	}
+	forecast, ok := forecaster.Latest("pump1.bearing_temp")
+	if !ok || !forecast.WillCross || forecast.TimeToLimit != 40*time.Minute {
+		t.Fatalf("forecast %+v, want a crossing in 40m", forecast)
+	}
+	if !forecast.BandCrosses || forecast.EarliestTimeToLimit > forecast.TimeToLimit {
+		t.Fatalf("band crossing %v at %s is not before the expected one", forecast.BandCrosses, forecast.EarliestTimeToLimit)
+	}
+	if hours := (*alerts)[0].Details["hours_to_limit"]; hours != forecast.TimeToLimit.Hours() {
+		t.Fatalf("alert gives %v hours to limit", hours)
+	}
+	if _, ok := forecaster.Latest("other.temp"); ok || len(forecaster.Forecasts()) != 1 {
+		t.Fatal("forecast made for a series without a rule")
+	}
+
+	// Repeats are held back, and a late sample for a closed point is ignored
+	forecaster.Add("pump1.bearing_temp", start.Add(59*time.Minute), 1000)
+	forecaster.Evaluate(now.Add(time.Minute))
+	if len(*alerts) != 1 {
+		t.Fatalf("%d alerts after a repeat within the hour", len(*alerts))
+	}
+	if latest, _ := forecaster.Latest("pump1.bearing_temp"); latest.TimeToLimit != 39*time.Minute {
+		t.Fatalf("late sample moved the crossing to %s", latest.TimeToLimit)
+	}
+}
+
+func TestForecasterHoltWintersPredictsSeasonalPeak(t *testing.T) {
+	forecaster, alerts := newTestForecaster(t, ForecastConfig{Series: "line3.load", Model: ForecastModelHoltWinters, Limit: 112, Step: "1h", Season: "24h", Horizon: "24h"})
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for hour := 0; hour < 24*4; hour++ {
+		forecaster.Add("line3.load", start.Add(time.Duration(hour)*time.Hour), seasonalValue(hour))
+	}
+	forecaster.Evaluate(start.Add(96 * time.Hour))
+
+	// The cycle peaks at step 6 of each day; with the trend, the next peak at step 102 is about 115
+	forecast, ok := forecaster.Latest("line3.load")
+	if !ok || !forecast.WillCross || len(*alerts) != 1 {
+		t.Fatalf("forecast %+v and %d alerts, want the next peak to cross", forecast, len(*alerts))
+	}
+	if forecast.TimeToLimit < 3*time.Hour || forecast.TimeToLimit > 6*time.Hour {
+		t.Fatalf("crossing expected in %s, want before the peak in 6h", forecast.TimeToLimit)
+	}
+}
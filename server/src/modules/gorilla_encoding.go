@@ -0,0 +1,275 @@
+// server/src/modules/gorilla_encoding.go
+
+package modules
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+)
+
+// errChunkExhausted is returned when a chunk is read past its last encoded bit.
+var errChunkExhausted = errors.New("chunk data exhausted")
+
+// bitWriter appends individual bits to a byte slice.
+type bitWriter struct {
+	data  []byte
+	count uint8 // Number of bits still free in the last byte
+}
+
+// writeBit appends a single bit.
+func (w *bitWriter) writeBit(bit bool) {
+	if w.count == 0 {
+		w.data = append(w.data, 0)
+		w.count = 8
+	}
+	w.count--
+	if bit {
+		w.data[len(w.data)-1] |= 1 << w.count
+	}
+}
+
+// writeBits appends the low nbits of value, most significant bit first.
+func (w *bitWriter) writeBits(value uint64, nbits int) {
+	for nbits > 0 {
+		nbits--
+		w.writeBit((value>>uint(nbits))&1 == 1)
+	}
+}
+
+// bitReader reads individual bits from a byte slice.
+type bitReader struct {
+	data []byte
+	pos  int // Bit position of the next read
+}
+
+// readBit reads a single bit.
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.data)*8 {
+		return false, errChunkExhausted
+	}
+	bit := r.data[r.pos/8]&(0x80>>uint(r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+// readBits reads nbits and returns them as the low bits of a uint64.
+func (r *bitReader) readBits(nbits int) (uint64, error) {
+	var value uint64
+	for i := 0; i < nbits; i++ {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		value <<= 1
+		if bit {
+			value |= 1
+		}
+	}
+	return value, nil
+}
+
+// gorillaEncoder compresses a stream of (millisecond timestamp, value) pairs using the
+// delta-of-delta timestamp and XOR value encodings from Facebook's Gorilla paper.
+type gorillaEncoder struct {
+	writer       bitWriter
+	count        int
+	prevTime     int64
+	prevDelta    int64
+	prevValue    uint64
+	prevLeading  int
+	prevTrailing int
+}
+
+// Append encodes the next sample; timestamps must not decrease.
+func (e *gorillaEncoder) Append(timestamp int64, value float64) {
+	valueBits := math.Float64bits(value)
+
+	if e.count == 0 {
+		e.writer.writeBits(uint64(timestamp), 64)
+		e.writer.writeBits(valueBits, 64)
+		e.prevTime = timestamp
+		e.prevValue = valueBits
+		e.prevLeading = -1
+		e.count++
+		return
+	}
+
+	delta := timestamp - e.prevTime
+	e.writeDeltaOfDelta(delta - e.prevDelta)
+	e.writeXOR(valueBits)
+
+	e.prevTime = timestamp
+	e.prevDelta = delta
+	e.prevValue = valueBits
+	e.count++
+}
+
+// Bytes returns the encoded chunk data.
+func (e *gorillaEncoder) Bytes() []byte {
+	return e.writer.data
+}
+
+// Count returns the number of samples encoded.
+func (e *gorillaEncoder) Count() int {
+	return e.count
+}
+
+// writeDeltaOfDelta encodes a timestamp delta-of-delta using variable-width buckets.
+func (e *gorillaEncoder) writeDeltaOfDelta(dod int64) {
+	switch {
+	case dod == 0:
+		e.writer.writeBit(false)
+	case dod >= -64 && dod <= 63:
+		e.writer.writeBits(0b10, 2)
+		e.writer.writeBits(uint64(dod), 7)
+	case dod >= -256 && dod <= 255:
+		e.writer.writeBits(0b110, 3)
+		e.writer.writeBits(uint64(dod), 9)
+	case dod >= -2048 && dod <= 2047:
+		e.writer.writeBits(0b1110, 4)
+		e.writer.writeBits(uint64(dod), 12)
+	default:
+		e.writer.writeBits(0b1111, 4)
+		e.writer.writeBits(uint64(dod), 64)
+	}
+}
+
+// writeXOR encodes a value as the XOR against the previous value, reusing the previous bit window when possible.
+func (e *gorillaEncoder) writeXOR(valueBits uint64) {
+	xor := valueBits ^ e.prevValue
+	if xor == 0 {
+		e.writer.writeBit(false)
+		return
+	}
+	e.writer.writeBit(true)
+
+	leading := bits.LeadingZeros64(xor)
+	trailing := bits.TrailingZeros64(xor)
+	if leading > 31 {
+		leading = 31 // Leading zero count is stored in 5 bits
+	}
+
+	if e.prevLeading >= 0 && leading >= e.prevLeading && trailing >= e.prevTrailing {
+		e.writer.writeBit(false)
+		e.writer.writeBits(xor>>uint(e.prevTrailing), 64-e.prevLeading-e.prevTrailing)
+		return
+	}
+
+	significant := 64 - leading - trailing
+	e.writer.writeBit(true)
+	e.writer.writeBits(uint64(leading), 5)
+	e.writer.writeBits(uint64(significant%64), 6) // 64 significant bits is stored as 0
+	e.writer.writeBits(xor>>uint(trailing), significant)
+	e.prevLeading = leading
+	e.prevTrailing = trailing
+}
+
+// decodeGorillaChunk decodes count samples from data produced by gorillaEncoder.
+func decodeGorillaChunk(series string, data []byte, count int) ([]Sample, error) {
+	samples := make([]Sample, 0, count)
+	if count == 0 {
+		return samples, nil
+	}
+	reader := &bitReader{data: data}
+
+	firstTime, err := reader.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	firstValue, err := reader.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := int64(firstTime)
+	valueBits := firstValue
+	samples = append(samples, Sample{Series: series, Timestamp: millisToTime(timestamp), Value: math.Float64frombits(valueBits)})
+
+	var delta int64
+	leading, trailing := 0, 0
+	for len(samples) < count {
+		dod, err := readDeltaOfDelta(reader)
+		if err != nil {
+			return nil, err
+		}
+		delta += dod
+		timestamp += delta
+
+		changed, err := reader.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := reader.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				l, err := reader.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				s, err := reader.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				significant := int(s)
+				if significant == 0 {
+					significant = 64
+				}
+				leading = int(l)
+				trailing = 64 - leading - significant
+			}
+			meaningful, err := reader.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			valueBits ^= meaningful << uint(trailing)
+		}
+
+		samples = append(samples, Sample{Series: series, Timestamp: millisToTime(timestamp), Value: math.Float64frombits(valueBits)})
+	}
+	return samples, nil
+}
+
+// readDeltaOfDelta decodes a delta-of-delta written by writeDeltaOfDelta.
+func readDeltaOfDelta(reader *bitReader) (int64, error) {
+	prefix := 0
+	for prefix < 4 {
+		bit, err := reader.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			break
+		}
+		prefix++
+	}
+
+	var width int
+	switch prefix {
+	case 0:
+		return 0, nil
+	case 1:
+		width = 7
+	case 2:
+		width = 9
+	case 3:
+		width = 12
+	default:
+		width = 64
+	}
+
+	raw, err := reader.readBits(width)
+	if err != nil {
+		return 0, err
+	}
+	if width == 64 {
+		return int64(raw), nil
+	}
+	// Sign-extend the two's complement value
+	if raw&(1<<uint(width-1)) != 0 {
+		return int64(raw) - (1 << uint(width)), nil
+	}
+	return int64(raw), nil
+}
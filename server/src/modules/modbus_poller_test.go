@@ -0,0 +1,185 @@
+// server/src/modules/modbus_poller_test.go
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingListener counts the responses written on its connections, one per Modbus request.
+type countingListener struct {
+	net.Listener
+	writes int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn, writes: &l.writes}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// startModbusSimulator serves a simulator on a loopback port for the duration of a test.
+func startModbusSimulator(t *testing.T) (*ModbusSimulator, *countingListener) {
+	t.Helper()
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: inner}
+	simulator := NewModbusSimulator(log.New(io.Discard, "", 0))
+	go simulator.Serve(listener)
+	t.Cleanup(func() { simulator.Close() })
+	return simulator, listener
+}
+
+// pollOnce starts a poller, waits for its first cycle and stops it.
+func pollOnce(t *testing.T, config ModbusDeviceConfig, access *AccessControl) map[string]float64 {
+	t.Helper()
+	received := make(chan []Sample, 1)
+	poller, err := NewModbusPoller(log.New(io.Discard, "", 0), []ModbusDeviceConfig{config}, access, func(samples []Sample) {
+		select {
+		case received <- samples:
+		default:
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.Start()
+	defer poller.Stop(context.Background())
+
+	select {
+	case samples := <-received:
+		values := make(map[string]float64, len(samples))
+		for _, sample := range samples {
+			values[sample.Series] = sample.Value
+		}
+		return values
+	case <-time.After(3 * time.Second):
+		t.Fatal("poller delivered no samples")
+	}
+	return nil
+}
+
+func TestModbusPollerBatchesNearbyPoints(t *testing.T) {
+	simulator, listener := startModbusSimulator(t)
+	config := ModbusDeviceConfig{
+		Name:     "press",
+		Address:  listener.Addr().String(),
+		Interval: "1h",
+		Points: []ModbusPointConfig{
+			{Name: "speed", Address: 0},
+			{Name: "load", Address: 2},
+			{Name: "temp", Address: 5},
+			{Name: "far", Address: 100},
+			{Name: "running", Table: ModbusCoil, Address: 3},
+		},
+	}
+	if err := simulator.SetRegisters(1, ModbusHoldingRegister, 0, []uint16{11, 0, 22, 0, 0, 33}); err != nil {
+		t.Fatal(err)
+	}
+	simulator.SetRegisters(1, ModbusHoldingRegister, 100, []uint16{44})
+	simulator.SetBits(1, ModbusCoil, 3, []bool{true})
+
+	values := pollOnce(t, config, nil)
+	want := map[string]float64{"press.speed": 11, "press.load": 22, "press.temp": 33, "press.far": 44, "press.running": 1}
+	for series, value := range want {
+		if values[series] != value {
+			t.Errorf("%s = %v, want %v", series, values[series], value)
+		}
+	}
+	// Registers 0-5 share one read; register 100 is past max_gap and the coil is in another table
+	if requests := atomic.LoadInt64(&listener.writes); requests != 3 {
+		t.Fatalf("poll used %d requests, want 3", requests)
+	}
+}
+
+func TestModbusPollerDecodesWordOrderAndScaling(t *testing.T) {
+	simulator, listener := startModbusSimulator(t)
+	config := ModbusDeviceConfig{
+		Name:     "boiler",
+		Address:  listener.Addr().String(),
+		Interval: "1h",
+		Points: []ModbusPointConfig{
+			{Name: "flow_big", Type: "float32", Address: 0},
+			{Name: "flow_little", Type: "float32", Address: 2, WordOrder: "little"},
+			{Name: "pressure", Type: "int32", Address: 4, Scale: 0.1},
+			{Name: "temp", Type: "uint16", Address: 6, Scale: 0.1, Offset: -40},
+			{Name: "level", Type: "uint16", Address: 7, ByteOrder: "little"},
+		},
+	}
+	// 12.5 is 0x41480000 as a float32; -1234 is 0xfffffb2e as an int32
+	registers := []uint16{0x4148, 0x0000, 0x0000, 0x4148, 0xffff, 0xfb2e, 500, 0x3412}
+	if err := simulator.SetRegisters(1, ModbusHoldingRegister, 0, registers); err != nil {
+		t.Fatal(err)
+	}
+
+	values := pollOnce(t, config, nil)
+	want := map[string]float64{
+		"boiler.flow_big":    12.5,
+		"boiler.flow_little": 12.5,
+		"boiler.pressure":    -123.4,
+		"boiler.temp":        10,
+		"boiler.level":       0x1234,
+	}
+	for series, value := range want {
+		if math.Abs(values[series]-value) > 1e-9 {
+			t.Errorf("%s = %v, want %v", series, values[series], value)
+		}
+	}
+}
+
+func TestModbusPollerRefusesUnauthorizedWrite(t *testing.T) {
+	simulator, listener := startModbusSimulator(t)
+	config := ModbusDeviceConfig{
+		Name:    "valve",
+		Address: listener.Addr().String(),
+		Points: []ModbusPointConfig{
+			{Name: "setpoint", Address: 10, Scale: 0.5, Writable: true},
+			{Name: "position", Address: 11},
+		},
+	}
+	// Without AccessControl no identity holds the write role
+	poller, err := NewModbusPoller(log.New(io.Discard, "", 0), []ModbusDeviceConfig{config}, nil, func([]Sample) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer poller.Stop(context.Background())
+
+	if err := poller.WritePoint("@intruder", "valve", "setpoint", 21); !errors.Is(err, ErrModbusWriteDenied) {
+		t.Fatalf("write returned %v, want ErrModbusWriteDenied", err)
+	}
+	if err := poller.WritePoint("@intruder", "valve", "position", 21); !errors.Is(err, ErrModbusNotWritable) {
+		t.Fatalf("write to a read-only point returned %v", err)
+	}
+	registers, err := simulator.Registers(1, ModbusHoldingRegister, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if registers[0] != 0 || registers[1] != 0 {
+		t.Fatalf("refused write reached the device: %v", registers)
+	}
+	if requests := atomic.LoadInt64(&listener.writes); requests != 0 {
+		t.Fatalf("refused write sent %d requests", requests)
+	}
+}
@@ -0,0 +1,288 @@
+// server/src/modules/modbus_protocol.go
+
+package modules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Modbus function codes
+const (
+	modbusReadCoils              = 0x01
+	modbusReadDiscreteInputs     = 0x02
+	modbusReadHoldingRegisters   = 0x03
+	modbusReadInputRegisters     = 0x04
+	modbusWriteSingleCoil        = 0x05
+	modbusWriteSingleRegister    = 0x06
+	modbusWriteMultipleCoils     = 0x0F
+	modbusWriteMultipleRegisters = 0x10
+)
+
+// Modbus exception codes
+const (
+	modbusIllegalFunction     = 0x01
+	modbusIllegalDataAddress  = 0x02
+	modbusIllegalDataValue    = 0x03
+	modbusServerDeviceFailure = 0x04
+)
+
+// Protocol limits on the quantity of a single request
+const (
+	modbusMaxReadRegisters  = 125
+	modbusMaxReadBits       = 2000
+	modbusMaxWriteRegisters = 123
+	modbusMaxWriteBits      = 1968
+	modbusMaxPDU            = 253
+)
+
+// ModbusTable names one of the four Modbus data tables.
+type ModbusTable string
+
+const (
+	ModbusCoil            ModbusTable = "coil"             // Read-write bits
+	ModbusDiscreteInput   ModbusTable = "discrete_input"   // Read-only bits
+	ModbusHoldingRegister ModbusTable = "holding_register" // Read-write 16-bit registers
+	ModbusInputRegister   ModbusTable = "input_register"   // Read-only 16-bit registers
+)
+
+// readFunction returns the function code that reads the table.
+func (t ModbusTable) readFunction() byte {
+	switch t {
+	case ModbusCoil:
+		return modbusReadCoils
+	case ModbusDiscreteInput:
+		return modbusReadDiscreteInputs
+	case ModbusHoldingRegister:
+		return modbusReadHoldingRegisters
+	case ModbusInputRegister:
+		return modbusReadInputRegisters
+	}
+	return 0
+}
+
+// bits reports whether the table holds bits rather than registers.
+func (t ModbusTable) bits() bool {
+	return t == ModbusCoil || t == ModbusDiscreteInput
+}
+
+// writable reports whether masters can write to the table.
+func (t ModbusTable) writable() bool {
+	return t == ModbusCoil || t == ModbusHoldingRegister
+}
+
+// ErrModbusResponse is returned when a device answers with a malformed or mismatched response.
+var ErrModbusResponse = errors.New("invalid Modbus response")
+
+// ModbusException is an exception response from a Modbus device.
+type ModbusException struct {
+	Function byte // Function code of the request
+	Code     byte // Exception code
+}
+
+func (e *ModbusException) Error() string {
+	names := map[byte]string{
+		modbusIllegalFunction:     "illegal function",
+		modbusIllegalDataAddress:  "illegal data address",
+		modbusIllegalDataValue:    "illegal data value",
+		modbusServerDeviceFailure: "server device failure",
+	}
+	name, known := names[e.Code]
+	if !known {
+		name = fmt.Sprintf("exception %d", e.Code)
+	}
+	return fmt.Sprintf("Modbus %s for function %d", name, e.Function)
+}
+
+// encodeModbusADU frames a PDU for Modbus TCP with the MBAP header.
+func encodeModbusADU(transaction uint16, unit byte, pdu []byte) []byte {
+	adu := make([]byte, 7, 7+len(pdu))
+	binary.BigEndian.PutUint16(adu[0:], transaction)
+	binary.BigEndian.PutUint16(adu[4:], uint16(len(pdu)+1))
+	adu[6] = unit
+	return append(adu, pdu...)
+}
+
+// readModbusADU reads one Modbus TCP frame and returns its transaction ID, unit ID and PDU.
+func readModbusADU(reader io.Reader) (uint16, byte, []byte, error) {
+	var header [7]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > modbusMaxPDU+1 {
+		return 0, 0, nil, fmt.Errorf("%w: bad MBAP header", ErrModbusResponse)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(reader, pdu); err != nil {
+		return 0, 0, nil, err
+	}
+	return binary.BigEndian.Uint16(header[0:]), header[6], pdu, nil
+}
+
+// packModbusBits packs bits into bytes, least significant bit first.
+func packModbusBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+	return packed
+}
+
+// unpackModbusBits unpacks count bits packed least significant bit first.
+func unpackModbusBits(packed []byte, count int) []bool {
+	bits := make([]bool, count)
+	for i := range bits {
+		bits[i] = packed[i/8]&(1<<(i%8)) != 0
+	}
+	return bits
+}
+
+// modbusClient is a Modbus TCP master connection to one unit. Requests are sent one at a time; the
+// connection is opened on first use and reopened after a failure.
+type modbusClient struct {
+	address     string
+	unit        byte
+	timeout     time.Duration
+	conn        net.Conn
+	transaction uint16
+	mutex       sync.Mutex // Serializes requests
+}
+
+func newModbusClient(address string, unit byte, timeout time.Duration) *modbusClient {
+	return &modbusClient{address: address, unit: unit, timeout: timeout}
+}
+
+// request sends a PDU and returns the response PDU. Exception responses are returned as a
+// *ModbusException and leave the connection open; any other failure closes it.
+func (c *modbusClient) request(pdu []byte) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn = conn
+	}
+	c.transaction++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(encodeModbusADU(c.transaction, c.unit, pdu)); err != nil {
+		c.closeLocked()
+		return nil, err
+	}
+	transaction, unit, response, err := readModbusADU(c.conn)
+	if err != nil {
+		c.closeLocked()
+		return nil, err
+	}
+	switch {
+	case transaction != c.transaction || unit != c.unit:
+		c.closeLocked()
+		return nil, fmt.Errorf("%w: transaction %d from unit %d, expected %d from unit %d", ErrModbusResponse, transaction, unit, c.transaction, c.unit)
+	case response[0] == pdu[0]|0x80 && len(response) == 2:
+		return nil, &ModbusException{Function: pdu[0], Code: response[1]}
+	case response[0] != pdu[0]:
+		c.closeLocked()
+		return nil, fmt.Errorf("%w: function %d in answer to %d", ErrModbusResponse, response[0], pdu[0])
+	}
+	return response, nil
+}
+
+// readBits reads coils or discrete inputs.
+func (c *modbusClient) readBits(function byte, address uint16, count int) ([]bool, error) {
+	response, err := c.request(modbusReadRequest(function, address, count))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) != 2+(count+7)/8 || int(response[1]) != (count+7)/8 {
+		return nil, fmt.Errorf("%w: %d bytes for %d bits", ErrModbusResponse, len(response), count)
+	}
+	return unpackModbusBits(response[2:], count), nil
+}
+
+// readRegisters reads holding or input registers.
+func (c *modbusClient) readRegisters(function byte, address uint16, count int) ([]uint16, error) {
+	response, err := c.request(modbusReadRequest(function, address, count))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) != 2+2*count || int(response[1]) != 2*count {
+		return nil, fmt.Errorf("%w: %d bytes for %d registers", ErrModbusResponse, len(response), count)
+	}
+	registers := make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(response[2+2*i:])
+	}
+	return registers, nil
+}
+
+// writeCoil sets a single coil.
+func (c *modbusClient) writeCoil(address uint16, value bool) error {
+	pdu := []byte{modbusWriteSingleCoil, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	if value {
+		pdu[3] = 0xFF
+	}
+	response, err := c.request(pdu)
+	if err == nil && string(response) != string(pdu) {
+		err = fmt.Errorf("%w: write of coil %d not echoed", ErrModbusResponse, address)
+	}
+	return err
+}
+
+// writeRegisters writes one register with function 6, or several with function 16.
+func (c *modbusClient) writeRegisters(address uint16, values []uint16) error {
+	if len(values) == 1 {
+		pdu := []byte{modbusWriteSingleRegister, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(pdu[1:], address)
+		binary.BigEndian.PutUint16(pdu[3:], values[0])
+		response, err := c.request(pdu)
+		if err == nil && string(response) != string(pdu) {
+			err = fmt.Errorf("%w: write of register %d not echoed", ErrModbusResponse, address)
+		}
+		return err
+	}
+
+	pdu := modbusReadRequest(modbusWriteMultipleRegisters, address, len(values))
+	pdu = append(pdu, byte(2*len(values)))
+	for _, value := range values {
+		pdu = append(pdu, byte(value>>8), byte(value))
+	}
+	response, err := c.request(pdu)
+	if err == nil && string(response) != string(pdu[:5]) {
+		err = fmt.Errorf("%w: write of registers %d-%d not confirmed", ErrModbusResponse, address, int(address)+len(values)-1)
+	}
+	return err
+}
+
+// close closes the connection; the next request reopens it.
+func (c *modbusClient) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closeLocked()
+}
+
+func (c *modbusClient) closeLocked() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// modbusReadRequest encodes a request made of a function code, start address and quantity, which is
+// how reads and the multiple-write requests begin.
+func modbusReadRequest(function byte, address uint16, count int) []byte {
+	pdu := []byte{function, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(pdu[1:], address)
+	binary.BigEndian.PutUint16(pdu[3:], uint16(count))
+	return pdu
+}
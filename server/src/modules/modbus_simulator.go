@@ -0,0 +1,300 @@
+// server/src/modules/modbus_simulator.go
+
+package modules
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// modbusBank holds the four tables of one simulated unit.
+type modbusBank struct {
+	coils    []bool
+	discrete []bool
+	holding  []uint16
+	input    []uint16
+}
+
+func newModbusBank() *modbusBank {
+	return &modbusBank{
+		coils:    make([]bool, 65536),
+		discrete: make([]bool, 65536),
+		holding:  make([]uint16, 65536),
+		input:    make([]uint16, 65536),
+	}
+}
+
+// ModbusSimulator is a Modbus TCP server backed by in-memory tables, for trying device maps and
+// setpoint writes without a PLC. Every unit ID is served, each with its own tables, all zero at first.
+type ModbusSimulator struct {
+	units    map[byte]*modbusBank
+	mutex    sync.Mutex
+	logger   *log.Logger
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+}
+
+// NewModbusSimulator creates a simulator with empty tables.
+func NewModbusSimulator(logger *log.Logger) *ModbusSimulator {
+	return &ModbusSimulator{
+		units:  make(map[byte]*modbusBank),
+		logger: logger,
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// bank returns the tables of a unit, creating them on first use; the caller must hold the mutex.
+func (s *ModbusSimulator) bank(unit byte) *modbusBank {
+	bank, exists := s.units[unit]
+	if !exists {
+		bank = newModbusBank()
+		s.units[unit] = bank
+	}
+	return bank
+}
+
+// SetRegisters stores values in the holding or input registers of a unit from address on.
+func (s *ModbusSimulator) SetRegisters(unit byte, table ModbusTable, address int, values []uint16) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	registers, err := s.registerTable(unit, table, address, len(values))
+	if err != nil {
+		return err
+	}
+	copy(registers[address:], values)
+	return nil
+}
+
+// Registers returns count holding or input registers of a unit from address on.
+func (s *ModbusSimulator) Registers(unit byte, table ModbusTable, address, count int) ([]uint16, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	registers, err := s.registerTable(unit, table, address, count)
+	if err != nil {
+		return nil, err
+	}
+	return append([]uint16(nil), registers[address:address+count]...), nil
+}
+
+// SetBits stores values in the coils or discrete inputs of a unit from address on.
+func (s *ModbusSimulator) SetBits(unit byte, table ModbusTable, address int, values []bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bits, err := s.bitTable(unit, table, address, len(values))
+	if err != nil {
+		return err
+	}
+	copy(bits[address:], values)
+	return nil
+}
+
+// Bits returns count coils or discrete inputs of a unit from address on.
+func (s *ModbusSimulator) Bits(unit byte, table ModbusTable, address, count int) ([]bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bits, err := s.bitTable(unit, table, address, count)
+	if err != nil {
+		return nil, err
+	}
+	return append([]bool(nil), bits[address:address+count]...), nil
+}
+
+// SetPointValue stores a value, in engineering units, where a point of a device map reads it from,
+// encoded as the poller decodes it.
+func (s *ModbusSimulator) SetPointValue(device ModbusDeviceConfig, point string, value float64) error {
+	parsed, err := parseModbusDeviceConfig(device)
+	if err != nil {
+		return err
+	}
+	target := parsed.byName[point]
+	if target == nil {
+		return fmt.Errorf("%w: %s.%s", ErrModbusUnknownPoint, device.Name, point)
+	}
+	raw := (value - target.config.Offset) / target.config.Scale
+	if target.config.Table.bits() {
+		return s.SetBits(byte(parsed.config.UnitID), target.config.Table, target.config.Address, []bool{raw != 0})
+	}
+	registers, err := target.encode(raw)
+	if err != nil {
+		return err
+	}
+	return s.SetRegisters(byte(parsed.config.UnitID), target.config.Table, target.config.Address, registers)
+}
+
+func (s *ModbusSimulator) registerTable(unit byte, table ModbusTable, address, count int) ([]uint16, error) {
+	if address < 0 || count < 0 || address+count > 65536 {
+		return nil, fmt.Errorf("Modbus address range %d+%d out of range", address, count)
+	}
+	switch table {
+	case ModbusHoldingRegister:
+		return s.bank(unit).holding, nil
+	case ModbusInputRegister:
+		return s.bank(unit).input, nil
+	}
+	return nil, fmt.Errorf("Modbus table %q does not hold registers", table)
+}
+
+func (s *ModbusSimulator) bitTable(unit byte, table ModbusTable, address, count int) ([]bool, error) {
+	if address < 0 || count < 0 || address+count > 65536 {
+		return nil, fmt.Errorf("Modbus address range %d+%d out of range", address, count)
+	}
+	switch table {
+	case ModbusCoil:
+		return s.bank(unit).coils, nil
+	case ModbusDiscreteInput:
+		return s.bank(unit).discrete, nil
+	}
+	return nil, fmt.Errorf("Modbus table %q does not hold bits", table)
+}
+
+// Serve answers Modbus TCP requests on listener until Close is called.
+func (s *ModbusSimulator) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return errors.New("Modbus simulator closed")
+	}
+	s.listener = listener
+	s.mutex.Unlock()
+	s.logger.Printf("Modbus simulator listening on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			s.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mutex.Lock()
+		s.conns[conn] = struct{}{}
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+// Close stops the listener and closes every connection.
+func (s *ModbusSimulator) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// handle answers the requests of one connection in order.
+func (s *ModbusSimulator) handle(conn net.Conn) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	for {
+		transaction, unit, pdu, err := readModbusADU(conn)
+		if err != nil {
+			return
+		}
+		response := s.execute(unit, pdu)
+		if _, err := conn.Write(encodeModbusADU(transaction, unit, response)); err != nil {
+			return
+		}
+	}
+}
+
+// execute applies a request PDU to a unit's tables and returns the response PDU.
+func (s *ModbusSimulator) execute(unit byte, pdu []byte) []byte {
+	function := pdu[0]
+	exception := func(code byte) []byte { return []byte{function | 0x80, code} }
+	if len(pdu) < 5 {
+		return exception(modbusIllegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(pdu[1:]))
+	quantity := int(binary.BigEndian.Uint16(pdu[3:]))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	bank := s.bank(unit)
+
+	switch function {
+	case modbusReadCoils, modbusReadDiscreteInputs:
+		if quantity < 1 || quantity > modbusMaxReadBits {
+			return exception(modbusIllegalDataValue)
+		}
+		if address+quantity > 65536 {
+			return exception(modbusIllegalDataAddress)
+		}
+		bits := bank.coils
+		if function == modbusReadDiscreteInputs {
+			bits = bank.discrete
+		}
+		packed := packModbusBits(bits[address : address+quantity])
+		return append([]byte{function, byte(len(packed))}, packed...)
+
+	case modbusReadHoldingRegisters, modbusReadInputRegisters:
+		if quantity < 1 || quantity > modbusMaxReadRegisters {
+			return exception(modbusIllegalDataValue)
+		}
+		if address+quantity > 65536 {
+			return exception(modbusIllegalDataAddress)
+		}
+		registers := bank.holding
+		if function == modbusReadInputRegisters {
+			registers = bank.input
+		}
+		response := []byte{function, byte(2 * quantity)}
+		for _, register := range registers[address : address+quantity] {
+			response = append(response, byte(register>>8), byte(register))
+		}
+		return response
+
+	case modbusWriteSingleCoil:
+		if quantity != 0 && quantity != 0xFF00 {
+			return exception(modbusIllegalDataValue)
+		}
+		bank.coils[address] = quantity == 0xFF00
+		s.logger.Printf("Modbus simulator: unit %d coil %d set to %t\n", unit, address, bank.coils[address])
+		return pdu[:5]
+
+	case modbusWriteSingleRegister:
+		bank.holding[address] = uint16(quantity)
+		s.logger.Printf("Modbus simulator: unit %d holding register %d set to %d\n", unit, address, quantity)
+		return pdu[:5]
+
+	case modbusWriteMultipleCoils, modbusWriteMultipleRegisters:
+		size := (quantity + 7) / 8
+		limit := modbusMaxWriteBits
+		if function == modbusWriteMultipleRegisters {
+			size, limit = 2*quantity, modbusMaxWriteRegisters
+		}
+		if quantity < 1 || quantity > limit || len(pdu) != 6+size || int(pdu[5]) != size {
+			return exception(modbusIllegalDataValue)
+		}
+		if address+quantity > 65536 {
+			return exception(modbusIllegalDataAddress)
+		}
+		if function == modbusWriteMultipleCoils {
+			copy(bank.coils[address:], unpackModbusBits(pdu[6:], quantity))
+		} else {
+			for i := 0; i < quantity; i++ {
+				bank.holding[address+i] = binary.BigEndian.Uint16(pdu[6+2*i:])
+			}
+		}
+		s.logger.Printf("Modbus simulator: unit %d wrote %d values from address %d with function %d\n", unit, quantity, address, function)
+		return pdu[:5]
+	}
+	return exception(modbusIllegalFunction)
+}
@@ -0,0 +1,1313 @@
+// server/src/modules/mqtt_broker.go
+
+package modules
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MQTTBrokerOptions tunes the embedded MQTT broker.
+type MQTTBrokerOptions struct {
+	MaxPacketSize     int                                         // Largest packet accepted from a client, in bytes
+	MaxInflight       int                                         // QoS 1 and 2 messages sent to a client and not yet acknowledged
+	MaxQueuedMessages int                                         // Messages held per session for a client that is offline or behind
+	MaxSessionExpiry  time.Duration                               // Longest a session outlives its connection
+	ConnectTimeout    time.Duration                               // Time a new connection has to send CONNECT
+	WriteTimeout      time.Duration                               // Deadline for writing a packet; a client that misses it is disconnected
+	StatePath         string                                      // File retained messages and sessions are saved to; empty keeps them in memory only
+	SaveInterval      time.Duration                               // How often changed state is saved, and expired sessions are removed
+	IngestTopics      []string                                    // Filters of the topics whose numeric payloads are fed to analytics
+	Authenticate      func(username string, password []byte) bool // Checks client credentials; nil refuses every client
+}
+
+// DefaultMQTTBrokerOptions returns the broker options used unless others are configured.
+func DefaultMQTTBrokerOptions() MQTTBrokerOptions {
+	return MQTTBrokerOptions{
+		MaxPacketSize:     1 << 20,
+		MaxInflight:       32,
+		MaxQueuedMessages: 1000,
+		MaxSessionExpiry:  7 * 24 * time.Hour,
+		ConnectTimeout:    10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		SaveInterval:      30 * time.Second,
+	}
+}
+
+// ErrBrokerClosed is returned by Serve once the broker has been closed.
+var ErrBrokerClosed = errors.New("MQTT broker closed")
+
+// MQTTBroker is an MQTT 3.1.1 and 5 broker. Clients authenticate with a username and password, and
+// AccessControl decides what they may subscribe and publish to. Topics are shared with the routes of a
+// RoutingManager in both directions, and numeric payloads on the ingest topics feed analytics.
+type MQTTBroker struct {
+	options MQTTBrokerOptions
+	access  *AccessControl  // Authorizes clients and their topics; nil allows any authenticated client
+	routing *RoutingManager // Routes that share the broker's topics; may be nil
+	ingest  func([]Sample)  // Receives samples parsed from the ingest topics; may be nil
+	logger  *log.Logger
+
+	mutex       sync.Mutex
+	sessions    map[string]*mqttSession // Sessions by client ID
+	topics      *topicTree              // Subscriptions, keyed by client ID
+	retained    map[string]*mqttMessage // Retained message of each topic
+	listeners   map[net.Listener]struct{}
+	dirty       bool       // State changed since it was last saved
+	authorized  bool       // Subscriptions were authorized at authVersion, restored ones included
+	authVersion uint64     // AccessControl.RulesVersion the subscriptions were last authorized at
+	authMutex   sync.Mutex // Serializes authorizing the subscriptions again
+	closed      bool
+	stop        chan struct{} // Closed by Close to stop maintenance
+	done        chan struct{} // Closed once maintenance has stopped
+}
+
+// NewMQTTBroker creates a broker and restores the state saved at StatePath, if any. Either routing or
+// ingest may be nil.
+func NewMQTTBroker(options MQTTBrokerOptions, access *AccessControl, routing *RoutingManager, ingest func([]Sample), logger *log.Logger) (*MQTTBroker, error) {
+	for _, filter := range options.IngestTopics {
+		if err := ValidateTopicFilter(filter); err != nil {
+			return nil, fmt.Errorf("ingest topics: %w", err)
+		}
+	}
+	broker := &MQTTBroker{
+		options:   options,
+		access:    access,
+		routing:   routing,
+		ingest:    ingest,
+		logger:    logger,
+		sessions:  make(map[string]*mqttSession),
+		topics:    newTopicTree(),
+		retained:  make(map[string]*mqttMessage),
+		listeners: make(map[net.Listener]struct{}),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := broker.load(); err != nil {
+		return nil, err
+	}
+	if routing != nil {
+		routing.SetPublishBridge(broker.publishFromRoutes)
+	}
+	go broker.maintain()
+	return broker, nil
+}
+
+// Serve accepts MQTT connections on listener until the broker is closed. Pass a listener from
+// SecurityGateway.SecureListener so clients connect over TLS.
+func (b *MQTTBroker) Serve(listener net.Listener) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrBrokerClosed
+	}
+	b.listeners[listener] = struct{}{}
+	b.mutex.Unlock()
+	b.logger.Printf("MQTT broker listening on %s\n", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			b.mutex.Lock()
+			closed := b.closed
+			delete(b.listeners, listener)
+			b.mutex.Unlock()
+			if closed {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		go b.handle(conn)
+	}
+}
+
+// Close stops accepting connections, disconnects every client and saves the broker state.
+func (b *MQTTBroker) Close() error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	b.closed = true
+	for listener := range b.listeners {
+		listener.Close()
+	}
+	var clients []*mqttClient
+	for _, session := range b.sessions {
+		if session.client != nil {
+			clients = append(clients, session.client)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, client := range clients {
+		client.kick(mqttServerShuttingDown)
+	}
+	close(b.stop)
+	<-b.done
+	return b.save(true)
+}
+
+// mqttClient is one client connection.
+type mqttClient struct {
+	broker      *MQTTBroker
+	conn        net.Conn
+	reader      *bufio.Reader
+	session     *mqttSession
+	version     byte
+	username    string
+	keepAlive   time.Duration
+	receiveMax  int                // QoS 1 and 2 messages the client accepts in flight
+	maxPacket   int                // Largest packet the client accepts; 0 means no limit
+	will        *mqttMessage       // Published if the connection ends without a DISCONNECT
+	willDelay   time.Duration      // MQTT 5 delay before the will is published
+	publishable publishPermissions // Publish permission of topics seen on this connection
+	writeMutex  sync.Mutex         // Serializes writes from the reader and writer goroutines
+	wake        chan struct{}      // Signals the writer that messages are queued
+	done        chan struct{}      // Closed when the connection is closed
+	closeOnce   sync.Once
+}
+
+// mqttError ends a connection for breaking the protocol. MQTT 5 clients are sent the reason code first.
+type mqttError struct {
+	code   byte
+	reason string
+}
+
+func (e *mqttError) Error() string {
+	return e.reason
+}
+
+// handle runs a connection from CONNECT to close.
+func (b *MQTTBroker) handle(conn net.Conn) {
+	client := &mqttClient{
+		broker: b,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	defer client.close()
+
+	conn.SetReadDeadline(time.Now().Add(b.options.ConnectTimeout))
+	header, body, err := readMQTTPacketLimit(client.reader, b.options.MaxPacketSize)
+	if err != nil {
+		b.logger.Printf("MQTT connection from %s closed before CONNECT: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+	if header>>4 != mqttConnect {
+		b.logger.Printf("MQTT connection from %s sent packet type %d before CONNECT\n", conn.RemoteAddr(), header>>4)
+		return
+	}
+	if !b.connect(client, body) {
+		return
+	}
+
+	go client.writeLoop()
+	err = client.readLoop()
+	graceful := false
+	var protocolErr *mqttError
+	switch {
+	case err == nil:
+		graceful = true
+	case errors.As(err, &protocolErr):
+		b.logger.Printf("MQTT client %s broke the protocol: %v\n", client.session.ClientID, err)
+		if client.version == mqttV5 {
+			client.write(encodeMQTTDisconnect(protocolErr.code))
+		}
+	}
+	b.disconnected(client, graceful)
+}
+
+// connect reads a CONNECT packet, authenticates the client and attaches its session. It reports
+// whether the connection was accepted.
+func (b *MQTTBroker) connect(client *mqttClient, body []byte) bool {
+	d := &mqttDecoder{data: body}
+	protocol := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := d.uint16()
+	if d.err == nil && (protocol != "MQTT" || level != mqttV311 && level != mqttV5) {
+		// MQTT 3.1 and 3.1.1 clients both understand this CONNACK
+		client.write([]byte{mqttConnAck << 4, 2, 0, mqttV3BadVersion})
+		b.logger.Printf("MQTT client at %s refused: unsupported protocol %s level %d\n", client.conn.RemoteAddr(), protocol, level)
+		return false
+	}
+	client.version = level
+
+	var props mqttProperties
+	if level == mqttV5 {
+		props = d.properties()
+	}
+	clientID := d.string()
+	willQoS := flags >> 3 & 0x03
+	if flags&0x04 != 0 {
+		will := &mqttMessage{QoS: willQoS, Retain: flags&0x20 != 0}
+		if level == mqttV5 {
+			willProps := d.properties()
+			client.willDelay = time.Duration(willProps.willDelay) * time.Second
+			applyMQTTMessageProperties(will, willProps, time.Now())
+		}
+		will.Topic = d.string()
+		will.Payload = d.binary()
+		client.will = will
+	}
+	var username string
+	var password []byte
+	if flags&0x80 != 0 {
+		username = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = d.binary()
+	}
+	malformed := d.err != nil || len(d.data) > 0 || flags&0x01 != 0 || willQoS == 3 ||
+		flags&0x04 == 0 && flags&0x38 != 0 || level == mqttV311 && flags&0x40 != 0 && flags&0x80 == 0
+	if malformed {
+		b.logger.Printf("MQTT client at %s sent a malformed CONNECT\n", client.conn.RemoteAddr())
+		return false
+	}
+
+	clean := flags&0x02 != 0
+	refuse := func(v3Code, v5Code byte, reason string) bool {
+		if level == mqttV5 {
+			client.write(encodeMQTTConnAck(false, v5Code, nil))
+		} else {
+			client.write([]byte{mqttConnAck << 4, 2, 0, v3Code})
+		}
+		b.logger.Printf("MQTT client %q at %s refused: %s\n", clientID, client.conn.RemoteAddr(), reason)
+		return false
+	}
+	var assigned string
+	switch {
+	case props.authMethod != "":
+		return refuse(mqttV3NotAuthorized, mqttBadAuthMethod, "enhanced authentication is not supported")
+	case clientID == "" && level == mqttV311 && !clean:
+		return refuse(mqttV3IdentifierRejected, mqttIdentifierNotValid, "empty client ID with a persistent session")
+	case clientID == "":
+		assigned = newMQTTClientID()
+		clientID = assigned
+	}
+	if username == "" || b.options.Authenticate == nil || !b.options.Authenticate(username, password) {
+		return refuse(mqttV3BadCredentials, mqttBadCredentials, "bad username or password")
+	}
+	if b.access != nil && !b.access.CheckAccess(username, GuestRole) {
+		return refuse(mqttV3NotAuthorized, mqttNotAuthorized, "not authorized")
+	}
+	client.username = username
+	if client.will != nil && !client.mayPublish(client.will.Topic) {
+		return refuse(mqttV3NotAuthorized, mqttNotAuthorized, "will topic not authorized")
+	}
+	client.keepAlive = time.Duration(keepAlive) * time.Second
+	client.receiveMax = b.options.MaxInflight
+	if props.receiveMaximum > 0 && int(props.receiveMaximum) < client.receiveMax {
+		client.receiveMax = int(props.receiveMaximum)
+	}
+	client.maxPacket = int(props.maximumPacketSize)
+
+	// Persistent MQTT 3.1.1 sessions never expire by the protocol; both versions are capped here
+	expiry := time.Duration(0)
+	switch {
+	case level == mqttV311 && !clean:
+		expiry = b.options.MaxSessionExpiry
+	case level == mqttV5:
+		expiry = time.Duration(props.sessionExpiry) * time.Second
+		if props.sessionExpiry == math.MaxUint32 || expiry > b.options.MaxSessionExpiry {
+			expiry = b.options.MaxSessionExpiry
+		}
+	}
+
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return refuse(mqttV3NotAuthorized, mqttServerShuttingDown, "broker is shutting down")
+	}
+	session := b.sessions[clientID]
+	if session != nil && session.Username != username {
+		b.mutex.Unlock()
+		return refuse(mqttV3IdentifierRejected, mqttNotAuthorized, "client ID belongs to another user")
+	}
+	var previous *mqttClient
+	if session != nil {
+		previous = session.client
+		if session.willTimer != nil {
+			session.willTimer.Stop()
+			session.willTimer = nil
+		}
+		if clean {
+			b.endSession(session)
+			session = nil
+		}
+	}
+	present := session != nil
+	if session == nil {
+		session = newMQTTSession(clientID, username)
+		b.sessions[clientID] = session
+	}
+	session.Expiry = expiry
+	session.client = client
+	client.session = session
+	b.dirty = true
+
+	var connAckProps mqttPropertyWriter
+	if level == mqttV5 {
+		connAckProps.string(mqttPropAssignedClientID, assigned)
+		if expiry != time.Duration(props.sessionExpiry)*time.Second {
+			connAckProps.uint32(mqttPropSessionExpiry, uint32(expiry/time.Second))
+		}
+		connAckProps.uint32(mqttPropMaximumPacketSize, uint32(b.options.MaxPacketSize))
+		connAckProps.byte(mqttPropSharedAvailable, 0)
+	}
+	// CONNACK goes first, before the writer starts and before messages left in flight are resent
+	client.write(encodeMQTTConnAck(present, mqttSuccess, &connAckProps))
+	resend := session.resume(client, time.Now())
+	b.mutex.Unlock()
+
+	if previous != nil {
+		previous.kick(mqttSessionTakenOver)
+	}
+	for _, packet := range resend {
+		client.write(packet)
+	}
+	b.logger.Printf("MQTT client %s connected as %s (MQTT %s, session present: %t)\n",
+		clientID, username, map[byte]string{mqttV311: "3.1.1", mqttV5: "5"}[level], present)
+	return true
+}
+
+// readLoop handles packets until the client disconnects, which returns nil, or the connection fails.
+func (c *mqttClient) readLoop() error {
+	for {
+		if c.keepAlive > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			c.conn.SetReadDeadline(time.Time{})
+		}
+		header, body, err := readMQTTPacketLimit(c.reader, c.broker.options.MaxPacketSize)
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, errMQTTPacketTooLarge):
+				return &mqttError{mqttPacketTooLarge, err.Error()}
+			case errors.As(err, &netErr) && netErr.Timeout():
+				return &mqttError{mqttKeepAliveTimeout, "keep alive timeout"}
+			}
+			return err
+		}
+
+		switch header >> 4 {
+		case mqttPublish:
+			err = c.handlePublish(header, body)
+		case mqttPubAck, mqttPubRec, mqttPubComp:
+			err = c.handleAck(header>>4, body)
+		case mqttPubRel:
+			err = c.handleRelease(body)
+		case mqttSubscribe:
+			err = c.handleSubscribe(header, body)
+		case mqttUnsubscribe:
+			err = c.handleUnsubscribe(header, body)
+		case mqttPingReq:
+			err = c.write([]byte{mqttPingResp << 4, 0})
+		case mqttDisconnect:
+			return c.handleDisconnect(body)
+		default:
+			err = &mqttError{mqttProtocolError, fmt.Sprintf("unexpected packet type %d", header>>4)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handlePublish accepts a message from the client, answering as its QoS requires.
+func (c *mqttClient) handlePublish(header byte, body []byte) error {
+	qos := header >> 1 & 0x03
+	if qos == 3 {
+		return &mqttError{mqttMalformedPacket, "PUBLISH with QoS 3"}
+	}
+	d := &mqttDecoder{data: body}
+	message := &mqttMessage{Topic: d.string(), QoS: qos, Retain: header&mqttFlagRetain != 0, Origin: c.session.ClientID}
+	var packetID uint16
+	if qos > 0 {
+		packetID = d.uint16()
+	}
+	now := time.Now()
+	if c.version == mqttV5 {
+		props := d.properties()
+		if props.topicAlias != 0 {
+			return &mqttError{mqttTopicAliasInvalid, "topic aliases are not supported"}
+		}
+		applyMQTTMessageProperties(message, props, now)
+	}
+	if d.err != nil {
+		return &mqttError{mqttMalformedPacket, d.err.Error()}
+	}
+	if qos > 0 && packetID == 0 {
+		return &mqttError{mqttProtocolError, "PUBLISH without a packet ID"}
+	}
+	if err := ValidateTopic(message.Topic); err != nil {
+		return &mqttError{mqttTopicNameInvalid, err.Error()}
+	}
+	message.Payload = append([]byte(nil), d.data...)
+
+	reason := mqttSuccess
+	if !c.mayPublish(message.Topic) {
+		reason = mqttNotAuthorized
+	}
+	switch qos {
+	case 0:
+		if reason == mqttSuccess {
+			c.broker.publish(message, false)
+		}
+		return nil
+	case 1:
+		if reason == mqttSuccess {
+			c.broker.publish(message, false)
+		}
+		return c.write(encodeMQTTAck(mqttPubAck<<4, packetID, reason, c.version))
+	}
+
+	// QoS 2: the message is published on the first PUBLISH and its packet ID remembered until PUBREL,
+	// so retransmissions are not published again
+	c.broker.mutex.Lock()
+	duplicate := c.session.Incoming[packetID]
+	if !duplicate && reason == mqttSuccess {
+		c.session.Incoming[packetID] = true
+		c.broker.dirty = true
+	}
+	c.broker.mutex.Unlock()
+	if !duplicate && reason == mqttSuccess {
+		c.broker.publish(message, false)
+	}
+	return c.write(encodeMQTTAck(mqttPubRec<<4, packetID, reason, c.version))
+}
+
+// handleAck applies the client's acknowledgement of a message the broker sent.
+func (c *mqttClient) handleAck(packetType byte, body []byte) error {
+	d := &mqttDecoder{data: body}
+	packetID := d.uint16()
+	reason := mqttSuccess
+	if len(d.data) > 0 {
+		reason = d.byte()
+	}
+	if d.err != nil {
+		return &mqttError{mqttMalformedPacket, d.err.Error()}
+	}
+
+	c.broker.mutex.Lock()
+	found, release := c.session.acknowledge(packetType, packetID, reason)
+	if found {
+		c.broker.dirty = true
+	}
+	c.broker.mutex.Unlock()
+
+	if release {
+		return c.write(encodeMQTTAck(mqttPubRel<<4|0x02, packetID, mqttSuccess, c.version))
+	}
+	// A message left the window, so the writer may send the next
+	c.notify()
+	return nil
+}
+
+// handleRelease completes a QoS 2 message from the client.
+func (c *mqttClient) handleRelease(body []byte) error {
+	d := &mqttDecoder{data: body}
+	packetID := d.uint16()
+	if d.err != nil {
+		return &mqttError{mqttMalformedPacket, d.err.Error()}
+	}
+	c.broker.mutex.Lock()
+	reason := mqttSuccess
+	if !c.session.Incoming[packetID] {
+		reason = mqttPacketIDNotFound
+	}
+	delete(c.session.Incoming, packetID)
+	c.broker.dirty = true
+	c.broker.mutex.Unlock()
+	return c.write(encodeMQTTAck(mqttPubComp<<4, packetID, reason, c.version))
+}
+
+// handleSubscribe adds the requested subscriptions that AccessControl allows and sends the retained
+// messages they match after the SUBACK.
+func (c *mqttClient) handleSubscribe(header byte, body []byte) error {
+	if header&0x0F != 0x02 {
+		return &mqttError{mqttMalformedPacket, "SUBSCRIBE with invalid flags"}
+	}
+	d := &mqttDecoder{data: body}
+	packetID := d.uint16()
+	var identifier uint32
+	if c.version == mqttV5 {
+		if props := d.properties(); len(props.subscriptionIDs) > 0 {
+			identifier = props.subscriptionIDs[0]
+		}
+	}
+	type request struct {
+		filter  string
+		options byte
+	}
+	var requests []request
+	for d.err == nil && len(d.data) > 0 {
+		requests = append(requests, request{d.string(), d.byte()})
+	}
+	if d.err != nil || len(requests) == 0 {
+		return &mqttError{mqttMalformedPacket, "malformed SUBSCRIBE"}
+	}
+
+	codes := make([]byte, len(requests))
+	var granted []*mqttSubscription
+	var sendRetained []bool
+	for i, req := range requests {
+		reserved := req.options & 0xFC
+		if c.version == mqttV5 {
+			reserved = req.options & 0xC0
+		}
+		if reserved != 0 || req.options&0x03 == 3 || req.options>>4&0x03 == 3 {
+			return &mqttError{mqttMalformedPacket, "invalid subscription options"}
+		}
+		code := c.subscribeCode(req.filter)
+		if code != mqttSuccess {
+			codes[i] = code
+			continue
+		}
+		sub := &mqttSubscription{Filter: req.filter, QoS: req.options & 0x03, Identifier: identifier}
+		retainHandling := byte(0)
+		if c.version == mqttV5 {
+			sub.NoLocal = req.options&0x04 != 0
+			sub.RetainAsPublished = req.options&0x08 != 0
+			retainHandling = req.options >> 4 & 0x03
+		}
+
+		if !c.authorizeSubscription(sub) { // Leaves the broker mutex locked
+			c.broker.mutex.Unlock()
+			codes[i] = c.failureCode(mqttNotAuthorized)
+			continue
+		}
+		_, existed := c.session.Subscriptions[req.filter]
+		c.session.Subscriptions[req.filter] = sub
+		c.broker.topics.add(c.session.ClientID, req.filter, sub.Excluded)
+		c.broker.dirty = true
+		c.broker.mutex.Unlock()
+
+		codes[i] = sub.QoS
+		granted = append(granted, sub)
+		sendRetained = append(sendRetained, retainHandling == 0 || retainHandling == 1 && !existed)
+	}
+
+	ack := appendMQTTUint16(nil, packetID)
+	if c.version == mqttV5 {
+		ack = append(ack, 0) // No properties
+	}
+	if err := c.write(encodeMQTTPacket(mqttSubAck<<4, append(ack, codes...))); err != nil {
+		return err
+	}
+	for i, sub := range granted {
+		if sendRetained[i] {
+			c.broker.sendRetained(c.session, sub)
+		}
+	}
+	return nil
+}
+
+// subscribeCode checks that a filter can be subscribed to, returning a failure code if not.
+func (c *mqttClient) subscribeCode(filter string) byte {
+	switch {
+	case ValidateTopicFilter(filter) != nil:
+		return c.failureCode(mqttTopicFilterInvalid)
+	case strings.HasPrefix(filter, "$share/"):
+		return c.failureCode(mqttSharedSubsNotSupported)
+	}
+	return mqttSuccess
+}
+
+// failureCode returns an MQTT 5 reason code, or the single failure code of MQTT 3.1.1.
+func (c *mqttClient) failureCode(code byte) byte {
+	if c.version == mqttV5 {
+		return code
+	}
+	return mqttV3SubscribeFailure
+}
+
+// handleUnsubscribe removes subscriptions.
+func (c *mqttClient) handleUnsubscribe(header byte, body []byte) error {
+	if header&0x0F != 0x02 {
+		return &mqttError{mqttMalformedPacket, "UNSUBSCRIBE with invalid flags"}
+	}
+	d := &mqttDecoder{data: body}
+	packetID := d.uint16()
+	if c.version == mqttV5 {
+		d.properties()
+	}
+	var filters []string
+	for d.err == nil && len(d.data) > 0 {
+		filters = append(filters, d.string())
+	}
+	if d.err != nil || len(filters) == 0 {
+		return &mqttError{mqttMalformedPacket, "malformed UNSUBSCRIBE"}
+	}
+
+	ack := appendMQTTUint16(nil, packetID)
+	if c.version == mqttV5 {
+		ack = append(ack, 0) // No properties
+	}
+	c.broker.mutex.Lock()
+	for _, filter := range filters {
+		code := mqttNoSubscriptionExisted
+		if _, exists := c.session.Subscriptions[filter]; exists {
+			delete(c.session.Subscriptions, filter)
+			c.broker.topics.remove(c.session.ClientID, filter)
+			c.broker.dirty = true
+			code = mqttSuccess
+		}
+		if c.version == mqttV5 {
+			ack = append(ack, code)
+		}
+	}
+	c.broker.mutex.Unlock()
+	return c.write(encodeMQTTPacket(mqttUnsubAck<<4, ack))
+}
+
+// handleDisconnect applies a DISCONNECT. An MQTT 5 client may ask for its will to be published anyway,
+// which is reported as an error so the connection ends as if it had failed.
+func (c *mqttClient) handleDisconnect(body []byte) error {
+	if c.version != mqttV5 || len(body) == 0 {
+		return nil
+	}
+	d := &mqttDecoder{data: body}
+	reason := d.byte()
+	if len(d.data) > 0 {
+		if props := d.properties(); props.hasSessionExpiry {
+			c.broker.mutex.Lock()
+			c.session.Expiry = time.Duration(props.sessionExpiry) * time.Second
+			if props.sessionExpiry == math.MaxUint32 || c.session.Expiry > c.broker.options.MaxSessionExpiry {
+				c.session.Expiry = c.broker.options.MaxSessionExpiry
+			}
+			c.broker.mutex.Unlock()
+		}
+	}
+	if reason == mqttDisconnectWithWill {
+		return errors.New("client disconnected with its will")
+	}
+	return nil
+}
+
+// authorizeSubscription asks AccessControl whether the client may subscribe to sub's filter and sets the
+// topics the subscription leaves out. It returns with the broker mutex held, once the rules have not
+// changed since they were consulted.
+func (c *mqttClient) authorizeSubscription(sub *mqttSubscription) bool {
+	access := c.broker.access
+	for {
+		var version uint64
+		allowed := true
+		if access != nil {
+			version = access.RulesVersion()
+			sub.Excluded, allowed = access.AuthorizeSubscription(c.username, sub.Filter)
+		}
+		c.broker.mutex.Lock()
+		if access == nil || access.RulesVersion() == version {
+			return allowed
+		}
+		c.broker.mutex.Unlock()
+	}
+}
+
+// mayPublish reports whether the client may publish to a topic, asking AccessControl the first time
+// each topic is used on the connection and again after the access rules change.
+func (c *mqttClient) mayPublish(topic string) bool {
+	permitted, _ := c.publishable.check(c.broker.access, c.username, topic)
+	return permitted
+}
+
+// writeLoop sends queued messages until the connection closes.
+func (c *mqttClient) writeLoop() {
+	for {
+		c.broker.mutex.Lock()
+		var packets [][]byte
+		if c.session.client == c {
+			packets = c.session.take(c, time.Now())
+			if len(packets) > 0 {
+				c.broker.dirty = true
+			}
+		}
+		c.broker.mutex.Unlock()
+
+		for _, packet := range packets {
+			if err := c.write(packet); err != nil {
+				c.close()
+				return
+			}
+		}
+		if len(packets) > 0 {
+			continue
+		}
+		select {
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// write sends a packet under the write deadline.
+func (c *mqttClient) write(packet []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.broker.options.WriteTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.broker.options.WriteTimeout))
+	}
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+// notify wakes the writer.
+func (c *mqttClient) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// kick disconnects the client, telling MQTT 5 clients why.
+func (c *mqttClient) kick(reason byte) {
+	if c.version == mqttV5 {
+		c.write(encodeMQTTDisconnect(reason))
+	}
+	c.close()
+}
+
+// close closes the connection; the reader then ends the session's attachment to it.
+func (c *mqttClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// disconnected detaches a closed connection from its session. The will is published unless the client
+// disconnected gracefully, at once or after its will delay, and the session ends if it does not outlive
+// the connection.
+func (b *MQTTBroker) disconnected(client *mqttClient, graceful bool) {
+	client.close()
+	b.mutex.Lock()
+	session := client.session
+	if session.client != client {
+		// Taken over by a new connection, which now owns the session
+		b.mutex.Unlock()
+		return
+	}
+	session.client = nil
+	session.DisconnectedAt = time.Now()
+	b.dirty = true
+	will := client.will
+	if graceful {
+		will = nil
+	}
+	delay := client.willDelay
+	if session.Expiry < delay {
+		delay = session.Expiry
+	}
+	if will != nil && delay > 0 {
+		session.willTimer = time.AfterFunc(delay, func() {
+			b.mutex.Lock()
+			pending := session.willTimer != nil
+			session.willTimer = nil
+			b.mutex.Unlock()
+			if pending {
+				b.publishWill(client, will)
+			}
+		})
+		will = nil
+	}
+	if session.Expiry == 0 {
+		b.endSession(session)
+	}
+	b.mutex.Unlock()
+
+	b.logger.Printf("MQTT client %s disconnected\n", session.ClientID)
+	if will != nil {
+		b.publishWill(client, will)
+	}
+}
+
+// publishWill publishes a client's will if the client may still publish to its topic.
+func (b *MQTTBroker) publishWill(client *mqttClient, will *mqttMessage) {
+	if !client.mayPublish(will.Topic) {
+		b.logger.Printf("Will of MQTT client %s dropped: it may no longer publish to %s\n", client.session.ClientID, will.Topic)
+		return
+	}
+	b.publish(will, false)
+}
+
+// authorizeSubscriptions checks the subscriptions of every session again, restored ones included, when
+// the access rules changed since they were last checked. It updates the topics each leaves out and drops
+// those no longer allowed.
+func (b *MQTTBroker) authorizeSubscriptions() {
+	if b.access == nil {
+		return
+	}
+	b.authMutex.Lock()
+	defer b.authMutex.Unlock()
+
+	version := b.access.RulesVersion()
+	type decision struct {
+		session  *mqttSession
+		sub      *mqttSubscription
+		excluded []string
+		allowed  bool
+	}
+	var decisions []decision
+	b.mutex.Lock()
+	if b.authorized && b.authVersion == version {
+		b.mutex.Unlock()
+		return
+	}
+	for _, session := range b.sessions {
+		for _, sub := range session.Subscriptions {
+			decisions = append(decisions, decision{session: session, sub: sub})
+		}
+	}
+	b.mutex.Unlock()
+
+	for i := range decisions {
+		d := &decisions[i]
+		d.excluded, d.allowed = b.access.AuthorizeSubscription(d.session.Username, d.sub.Filter)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, d := range decisions {
+		if b.sessions[d.session.ClientID] != d.session || d.session.Subscriptions[d.sub.Filter] != d.sub {
+			continue // Ended or replaced meanwhile, and checked when it was replaced
+		}
+		if d.allowed {
+			d.sub.Excluded = d.excluded
+			b.topics.add(d.session.ClientID, d.sub.Filter, d.excluded)
+		} else {
+			delete(d.session.Subscriptions, d.sub.Filter)
+			b.topics.remove(d.session.ClientID, d.sub.Filter)
+			b.logger.Printf("Subscription of MQTT client %s to %s dropped: the access rules no longer allow it\n", d.session.ClientID, d.sub.Filter)
+		}
+		b.dirty = true
+	}
+	b.authorized, b.authVersion = true, version
+}
+
+// endSession discards a session and its subscriptions; the caller must hold the mutex.
+func (b *MQTTBroker) endSession(session *mqttSession) {
+	b.topics.removeDevice(session.ClientID)
+	if b.sessions[session.ClientID] == session {
+		delete(b.sessions, session.ClientID)
+	}
+	b.dirty = true
+}
+
+// Publish publishes an envelope on a topic as if a client had: subscribers receive it, the ingest topics
+// feed analytics and, with a RoutingManager, routes receive it too. It returns the number of sessions
+// the message was queued for.
+func (b *MQTTBroker) Publish(topic string, envelope Envelope) (int, error) {
+	envelope, err := publishedEnvelope(topic, envelope)
+	if err != nil {
+		return 0, err
+	}
+	return b.publish(mqttMessageFromEnvelope(envelope), false), nil
+}
+
+// publish stores a retained message, sends the message to matching subscribers and feeds the ingest
+// topics to analytics. Messages that did not come from the routes are passed on to them. It returns the
+// number of sessions the message was queued for.
+func (b *MQTTBroker) publish(message *mqttMessage, fromRoutes bool) int {
+	b.authorizeSubscriptions()
+	now := time.Now()
+	queued := 0
+	b.mutex.Lock()
+	if message.Retain {
+		if len(message.Payload) == 0 {
+			delete(b.retained, message.Topic)
+		} else {
+			b.retained[message.Topic] = message
+		}
+		b.dirty = true
+	}
+	for _, clientID := range b.topics.match(message.Topic) {
+		session := b.sessions[clientID]
+		out := session.outgoingFor(message)
+		if out == nil {
+			continue
+		}
+		if session.enqueue(out, b.options.MaxQueuedMessages) {
+			queued++
+		} else if out.QoS > 0 || session.client != nil {
+			b.logger.Printf("MQTT queue of client %s is full; dropping message on %s\n", clientID, message.Topic)
+		}
+		b.dirty = b.dirty || out.QoS > 0
+	}
+	b.mutex.Unlock()
+
+	if b.ingest != nil {
+		for _, filter := range b.options.IngestTopics {
+			if TopicMatches(filter, message.Topic) {
+				if samples := telemetrySamples(message.Topic, message.Payload, now); len(samples) > 0 {
+					b.ingest(samples)
+				}
+				break
+			}
+		}
+	}
+	if !fromRoutes && b.routing != nil && !message.expired(now) {
+		if _, err := b.routing.PublishToRoutes(message.Topic, envelopeFromMQTT(message, now)); err != nil {
+			b.logger.Printf("Error passing MQTT message on %s to routes: %v\n", message.Topic, err)
+		}
+	}
+	return queued
+}
+
+// publishFromRoutes is the RoutingManager's publish bridge: messages published on routes reach MQTT
+// subscribers and analytics.
+func (b *MQTTBroker) publishFromRoutes(envelope Envelope) {
+	b.publish(mqttMessageFromEnvelope(envelope), true)
+}
+
+// sendRetained queues the retained messages matching a new subscription.
+func (b *MQTTBroker) sendRetained(session *mqttSession, sub *mqttSubscription) {
+	now := time.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for topic, message := range b.retained {
+		if message.expired(now) {
+			delete(b.retained, topic)
+			continue
+		}
+		if !TopicMatches(sub.Filter, topic) || topicExcluded(sub.Excluded, topic) {
+			continue
+		}
+		out := &mqttOutgoing{Message: message, QoS: message.QoS, Retain: true}
+		if sub.QoS < out.QoS {
+			out.QoS = sub.QoS
+		}
+		if sub.Identifier != 0 {
+			out.SubscriptionIDs = []uint32{sub.Identifier}
+		}
+		session.enqueue(out, b.options.MaxQueuedMessages)
+	}
+}
+
+// maintain removes expired sessions and saves changed state every SaveInterval until the broker closes.
+func (b *MQTTBroker) maintain() {
+	defer close(b.done)
+	interval := b.options.SaveInterval
+	if interval <= 0 {
+		interval = DefaultMQTTBrokerOptions().SaveInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case now := <-ticker.C:
+			b.expireSessions(now)
+			if err := b.save(false); err != nil {
+				b.logger.Printf("Error saving MQTT broker state: %v\n", err)
+			}
+		}
+	}
+}
+
+// expireSessions ends the offline sessions whose expiry interval has passed.
+func (b *MQTTBroker) expireSessions(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, session := range b.sessions {
+		if session.client == nil && now.Sub(session.DisconnectedAt) >= session.Expiry {
+			b.logger.Printf("MQTT session of client %s expired\n", session.ClientID)
+			b.endSession(session)
+		}
+	}
+}
+
+// mqttBrokerState is the content of the state file.
+type mqttBrokerState struct {
+	Retained []*mqttMessage `json:"retained"`
+	Sessions []*mqttSession `json:"sessions"`
+}
+
+// save writes the retained messages and sessions to the state file if they changed, or always when
+// force is set. The file is replaced atomically.
+func (b *MQTTBroker) save(force bool) error {
+	if b.options.StatePath == "" {
+		return nil
+	}
+	b.mutex.Lock()
+	if !b.dirty && !force {
+		b.mutex.Unlock()
+		return nil
+	}
+	state := mqttBrokerState{}
+	for _, message := range b.retained {
+		state.Retained = append(state.Retained, message)
+	}
+	for _, session := range b.sessions {
+		if session.Expiry > 0 {
+			state.Sessions = append(state.Sessions, session)
+		}
+	}
+	data, err := json.Marshal(state)
+	b.dirty = false
+	b.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(b.options.StatePath), 0750); err != nil {
+		return err
+	}
+	tmpPath := b.options.StatePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, b.options.StatePath)
+}
+
+// load restores the state file, if there is one. Sessions come back offline, counting from now.
+func (b *MQTTBroker) load() error {
+	if b.options.StatePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.options.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read MQTT broker state: %w", err)
+	}
+	var state mqttBrokerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to parse MQTT broker state %s: %w", b.options.StatePath, err)
+	}
+
+	now := time.Now()
+	for _, message := range state.Retained {
+		if !message.expired(now) {
+			b.retained[message.Topic] = message
+		}
+	}
+	for _, session := range state.Sessions {
+		if session.Subscriptions == nil {
+			session.Subscriptions = make(map[string]*mqttSubscription)
+		}
+		if session.Incoming == nil {
+			session.Incoming = make(map[uint16]bool)
+		}
+		session.DisconnectedAt = now
+		for _, out := range session.Inflight {
+			if out.PacketID > session.lastID {
+				session.lastID = out.PacketID
+			}
+		}
+		for filter, sub := range session.Subscriptions {
+			b.topics.add(session.ClientID, filter, sub.Excluded)
+		}
+		b.sessions[session.ClientID] = session
+	}
+	if len(state.Sessions) > 0 || len(state.Retained) > 0 {
+		b.logger.Printf("MQTT broker restored %d sessions and %d retained messages\n", len(b.sessions), len(b.retained))
+	}
+	return nil
+}
+
+// applyMQTTMessageProperties copies the MQTT 5 properties that travel with a message.
+func applyMQTTMessageProperties(message *mqttMessage, props mqttProperties, now time.Time) {
+	message.PayloadFormat = props.payloadFormat
+	message.ContentType = props.contentType
+	message.ResponseTopic = props.responseTopic
+	message.CorrelationData = props.correlationData
+	message.UserProperties = props.userProperties
+	if props.hasMessageExpiry {
+		message.Expires = now.Add(time.Duration(props.messageExpiry) * time.Second)
+	}
+}
+
+// encodeMQTTConnAck encodes a CONNACK; props is nil for MQTT 3.1.1, where the code is a return code.
+func encodeMQTTConnAck(sessionPresent bool, code byte, props *mqttPropertyWriter) []byte {
+	flags := byte(0)
+	if sessionPresent {
+		flags = 1
+	}
+	body := []byte{flags, code}
+	if props != nil {
+		body = props.appendTo(body)
+	}
+	return encodeMQTTPacket(mqttConnAck<<4, body)
+}
+
+// encodeMQTTDisconnect encodes an MQTT 5 DISCONNECT with a reason code.
+func encodeMQTTDisconnect(reason byte) []byte {
+	return encodeMQTTPacket(mqttDisconnect<<4, []byte{reason, 0})
+}
+
+// newMQTTClientID returns an identifier for a client that connected without one.
+func newMQTTClientID() string {
+	var random [8]byte
+	rand.Read(random[:])
+	return "nimbus-" + hex.EncodeToString(random[:])
+}
+
+// envelopeFromMQTT converts a message published over MQTT for delivery on routes. It is telemetry
+// unless a "priority" user property names another traffic class, and QoS 1 and 2 messages are
+// delivered at least once.
+func envelopeFromMQTT(message *mqttMessage, now time.Time) Envelope {
+	envelope := Envelope{
+		Type:        MessageData,
+		Priority:    ClassTelemetry,
+		Timestamp:   now,
+		ContentType: message.ContentType,
+		Payload:     message.Payload,
+		RequireAck:  message.QoS > 0,
+		Topic:       message.Topic,
+	}
+	for _, pair := range message.UserProperties {
+		if pair[0] == "priority" {
+			if class, err := ParseTrafficClass(pair[1]); err == nil {
+				envelope.Priority = class
+			}
+		}
+	}
+	if !message.Expires.IsZero() {
+		envelope.TTL = message.Expires.Sub(now)
+	}
+	return envelope
+}
+
+// mqttMessageFromEnvelope converts a message published on a route for MQTT subscribers. Messages that
+// require acknowledgement are sent at QoS 1.
+func mqttMessageFromEnvelope(envelope Envelope) *mqttMessage {
+	message := &mqttMessage{Topic: envelope.Topic, Payload: envelope.Payload, ContentType: envelope.ContentType}
+	if envelope.RequireAck {
+		message.QoS = 1
+	}
+	if envelope.TTL > 0 {
+		message.Expires = envelope.Timestamp.Add(envelope.TTL)
+	}
+	return message
+}
+
+// telemetrySamples parses a payload published to an ingest topic. A bare number is a sample of the
+// series named by the topic. A JSON object yields a sample for each numeric field, in the series
+// topic/field, or the topic itself for a field named "value"; a "timestamp" field in Unix milliseconds
+// or RFC 3339 replaces the time of receipt.
+func telemetrySamples(topic string, payload []byte, now time.Time) []Sample {
+	text := strings.TrimSpace(string(payload))
+	if value, err := strconv.ParseFloat(text, 64); err == nil {
+		return []Sample{{Series: topic, Timestamp: now, Value: value}}
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil
+	}
+	timestamp := now
+	switch ts := fields["timestamp"].(type) {
+	case float64:
+		timestamp = time.UnixMilli(int64(ts))
+	case string:
+		if parsed, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			timestamp = parsed
+		}
+	}
+	var samples []Sample
+	for name, raw := range fields {
+		value, ok := raw.(float64)
+		if !ok || name == "timestamp" {
+			continue
+		}
+		series := topic + "/" + name
+		if name == "value" {
+			series = topic
+		}
+		samples = append(samples, Sample{Series: series, Timestamp: timestamp, Value: value})
+	}
+	return samples
+}
+
+// minPasswordCost is the lowest bcrypt cost accepted in credentials files.
+const minPasswordCost = bcrypt.DefaultCost
+
+// MQTTCredentials maps MQTT usernames to the bcrypt hashes of their passwords.
+type MQTTCredentials map[string][]byte
+
+// LoadMQTTCredentials reads a JSON object mapping each username, usually a device atSign, to the
+// bcrypt hash of its password.
+func LoadMQTTCredentials(path string) (MQTTCredentials, error) {
+	hashes, err := loadPasswordHashes(path, "MQTT credentials")
+	return MQTTCredentials(hashes), err
+}
+
+// loadPasswordHashes reads a JSON object mapping usernames to bcrypt password hashes, each of at least
+// minPasswordCost.
+func loadPasswordHashes(path, what string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", what, err)
+	}
+	var hashes map[string]string
+	if err := json.Unmarshal(data, &hashes); err != nil {
+		return nil, fmt.Errorf("failed to parse %s %s: %w", what, path, err)
+	}
+	decoded := make(map[string][]byte, len(hashes))
+	for username, hash := range hashes {
+		cost, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: invalid bcrypt hash for %s: %w", what, path, username, err)
+		}
+		if cost < minPasswordCost {
+			return nil, fmt.Errorf("%s %s: bcrypt cost %d for %s is below %d", what, path, cost, username, minPasswordCost)
+		}
+		decoded[username] = []byte(hash)
+	}
+	return decoded, nil
+}
+
+var (
+	unknownUserHash     []byte
+	unknownUserHashOnce sync.Once
+)
+
+// checkPassword reports whether the password matches the username's bcrypt hash. Unknown usernames are
+// checked against a hash of their own, so the time taken does not tell which usernames exist.
+func checkPassword(hashes map[string][]byte, username string, password []byte) bool {
+	hash, exists := hashes[username]
+	if !exists {
+		unknownUserHashOnce.Do(func() {
+			unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte(newRandomID()), minPasswordCost)
+		})
+		hash = unknownUserHash
+	}
+	return bcrypt.CompareHashAndPassword(hash, password) == nil && exists
+}
+
+// Authenticate reports whether the password matches the username's hash.
+func (mc MQTTCredentials) Authenticate(username string, password []byte) bool {
+	return checkPassword(mc, username, password)
+}
@@ -0,0 +1,302 @@
+// server/src/modules/mqtt_broker_test.go
+
+package modules
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeCredentials writes a credentials file mapping usernames to hashes.
+func writeCredentials(t *testing.T, entries ...string) string {
+	t.Helper()
+	pairs := make([]string, 0, len(entries)/2)
+	for i := 0; i+1 < len(entries); i += 2 {
+		pairs = append(pairs, `"`+entries[i]+`": "`+entries[i+1]+`"`)
+	}
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, []byte("{"+strings.Join(pairs, ", ")+"}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMQTTCredentialsUseBcrypt(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), minPasswordCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := LoadMQTTCredentials(writeCredentials(t, "@press4", string(hash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !credentials.Authenticate("@press4", []byte("s3cret")) {
+		t.Fatal("right password refused")
+	}
+	if credentials.Authenticate("@press4", []byte("s3cret!")) || credentials.Authenticate("@press5", []byte("s3cret")) {
+		t.Fatal("wrong password or user accepted")
+	}
+
+	cheap, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	for name, hash := range map[string]string{
+		"unsalted digest": "b5d899d12a1605e9e45346b92a615d2ac185b44818e9dc0efffaee45c6aa87e5",
+		"low cost":        string(cheap),
+	} {
+		if _, err := LoadMQTTCredentials(writeCredentials(t, "@press4", hash)); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+// mqttTestPacket is a control packet a test client received.
+type mqttTestPacket struct {
+	header byte
+	body   []byte
+}
+
+// mqttTestClient is an MQTT 3.1.1 client speaking to a broker over a pipe.
+type mqttTestClient struct {
+	t        *testing.T
+	conn     net.Conn
+	received chan mqttTestPacket // Closed when the broker closes the connection
+}
+
+// dialTestBroker connects a client to the broker, without sending CONNECT.
+func dialTestBroker(t *testing.T, broker *MQTTBroker) *mqttTestClient {
+	t.Helper()
+	local, remote := net.Pipe()
+	go broker.handle(remote)
+	client := &mqttTestClient{t: t, conn: local, received: make(chan mqttTestPacket, 100)}
+	go func() {
+		reader := bufio.NewReader(local)
+		for {
+			header, body, err := readMQTTPacketLimit(reader, 0)
+			if err != nil {
+				close(client.received)
+				return
+			}
+			client.received <- mqttTestPacket{header, body}
+		}
+	}()
+	t.Cleanup(func() { local.Close() })
+	return client
+}
+
+func (c *mqttTestClient) send(header byte, body []byte) {
+	if _, err := c.conn.Write(encodeMQTTPacket(header, body)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// next returns the next packet of the given type, failing on anything else.
+func (c *mqttTestClient) next(packetType byte) mqttTestPacket {
+	c.t.Helper()
+	select {
+	case packet, ok := <-c.received:
+		if !ok {
+			c.t.Fatalf("connection closed waiting for packet type %d", packetType)
+		}
+		if packet.header>>4 != packetType {
+			c.t.Fatalf("packet type %d received, want %d", packet.header>>4, packetType)
+		}
+		return packet
+	case <-time.After(2 * time.Second):
+		c.t.Fatalf("no packet of type %d", packetType)
+	}
+	return mqttTestPacket{}
+}
+
+// quiet checks that nothing arrives for a while.
+func (c *mqttTestClient) quiet() {
+	c.t.Helper()
+	select {
+	case packet, ok := <-c.received:
+		if ok {
+			c.t.Fatalf("unexpected packet type %d", packet.header>>4)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// connect logs in and returns whether the broker had a session for the client.
+func (c *mqttTestClient) connect(clientID string, clean bool) bool {
+	c.t.Helper()
+	flags := byte(0xC0) // Username and password
+	if clean {
+		flags |= 0x02
+	}
+	body := append(appendMQTTString(nil, "MQTT"), mqttV311, flags, 0, 60)
+	body = appendMQTTString(body, clientID)
+	body = appendMQTTString(body, "sensor")
+	body = appendMQTTBinary(body, []byte("s3cret"))
+	c.send(mqttConnect<<4, body)
+	ack := c.next(mqttConnAck)
+	if ack.body[1] != 0 {
+		c.t.Fatalf("connection refused with code %d", ack.body[1])
+	}
+	return ack.body[0]&1 != 0
+}
+
+func (c *mqttTestClient) subscribe(packetID uint16, filter string, qos byte) {
+	c.t.Helper()
+	c.send(mqttSubscribe<<4|2, append(appendMQTTString(appendMQTTUint16(nil, packetID), filter), qos))
+	if ack := c.next(mqttSubAck); ack.body[2] != qos {
+		c.t.Fatalf("subscription to %s granted code %d", filter, ack.body[2])
+	}
+}
+
+func (c *mqttTestClient) publish(packetID uint16, topic string, qos byte, payload string) {
+	body := appendMQTTString(nil, topic)
+	if qos > 0 {
+		body = appendMQTTUint16(body, packetID)
+	}
+	c.send(mqttPublish<<4|qos<<1, append(body, payload...))
+}
+
+// acknowledge checks that the next packet acknowledges packetID with the given type.
+func (c *mqttTestClient) acknowledge(packetType byte, packetID uint16) {
+	c.t.Helper()
+	if ack := c.next(packetType); binary.BigEndian.Uint16(ack.body) != packetID {
+		c.t.Fatalf("packet %d acknowledged, want %d", binary.BigEndian.Uint16(ack.body), packetID)
+	}
+}
+
+// mqttTestMessage is a PUBLISH a test client received.
+type mqttTestMessage struct {
+	topic    string
+	qos      byte
+	dup      bool
+	packetID uint16
+	payload  string
+}
+
+func (c *mqttTestClient) receive() mqttTestMessage {
+	c.t.Helper()
+	packet := c.next(mqttPublish)
+	decoder := &mqttDecoder{data: packet.body}
+	message := mqttTestMessage{topic: decoder.string(), qos: packet.header >> 1 & 3, dup: packet.header&0x08 != 0}
+	if message.qos > 0 {
+		message.packetID = decoder.uint16()
+	}
+	message.payload = string(decoder.data)
+	return message
+}
+
+// newTestBroker creates a broker that lets any client in as sensor/s3cret and saves its state at
+// statePath.
+func newTestBroker(t *testing.T, statePath string) *MQTTBroker {
+	t.Helper()
+	options := DefaultMQTTBrokerOptions()
+	options.Authenticate = func(username string, password []byte) bool { return string(password) == "s3cret" }
+	options.StatePath = statePath
+	broker, err := NewMQTTBroker(options, nil, nil, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return broker
+}
+
+func TestMQTTQoSFlows(t *testing.T) {
+	broker := newTestBroker(t, "")
+	defer broker.Close()
+	subscriber := dialTestBroker(t, broker)
+	subscriber.connect("dashboard", true)
+	subscriber.subscribe(1, "plant/#", 2)
+	publisher := dialTestBroker(t, broker)
+	publisher.connect("press4", true)
+
+	// QoS 1: PUBACK to the publisher, delivered at QoS 1
+	publisher.publish(7, "plant/temp", 1, "21.5")
+	publisher.acknowledge(mqttPubAck, 7)
+	message := subscriber.receive()
+	if message.topic != "plant/temp" || message.qos != 1 || message.payload != "21.5" {
+		t.Fatalf("QoS 1 message received as %+v", message)
+	}
+	subscriber.send(mqttPubAck<<4, appendMQTTUint16(nil, message.packetID))
+
+	// QoS 2: a PUBLISH sent again before PUBREL is not delivered twice
+	publisher.publish(8, "plant/pressure", 2, "3.2")
+	publisher.acknowledge(mqttPubRec, 8)
+	publisher.publish(8, "plant/pressure", 2, "3.2")
+	publisher.acknowledge(mqttPubRec, 8)
+	publisher.send(mqttPubRel<<4|2, appendMQTTUint16(nil, 8))
+	publisher.acknowledge(mqttPubComp, 8)
+	message = subscriber.receive()
+	if message.topic != "plant/pressure" || message.qos != 2 || message.payload != "3.2" {
+		t.Fatalf("QoS 2 message received as %+v", message)
+	}
+	subscriber.send(mqttPubRec<<4, appendMQTTUint16(nil, message.packetID))
+	subscriber.acknowledge(mqttPubRel, message.packetID)
+	subscriber.send(mqttPubComp<<4, appendMQTTUint16(nil, message.packetID))
+	subscriber.quiet()
+
+	// Delivery is capped at the subscription's QoS
+	subscriber.subscribe(2, "plant/#", 0)
+	publisher.publish(9, "plant/temp", 2, "22.0")
+	publisher.acknowledge(mqttPubRec, 9)
+	publisher.send(mqttPubRel<<4|2, appendMQTTUint16(nil, 9))
+	publisher.acknowledge(mqttPubComp, 9)
+	if message = subscriber.receive(); message.qos != 0 || message.payload != "22.0" {
+		t.Fatalf("message on a QoS 0 subscription received as %+v", message)
+	}
+}
+
+func TestMQTTSessionRestoredAfterRestart(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "mqtt", "state.json")
+	broker := newTestBroker(t, statePath)
+	client := dialTestBroker(t, broker)
+	if client.connect("historian", false) {
+		t.Fatal("new client given an existing session")
+	}
+	client.subscribe(1, "alerts/#", 1)
+	client.send(mqttDisconnect<<4, nil)
+
+	publisher := dialTestBroker(t, broker)
+	publisher.connect("press4", true)
+	publisher.publish(1, "alerts/overheat", 1, "fire")
+	publisher.acknowledge(mqttPubAck, 1)
+	publisher.publish(0, "alerts/info", 0, "lost")
+	time.Sleep(50 * time.Millisecond) // Let the broker queue the QoS 1 message before closing
+	if err := broker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	broker = newTestBroker(t, statePath)
+	defer broker.Close()
+	client = dialTestBroker(t, broker)
+	if !client.connect("historian", false) {
+		t.Fatal("session lost over the restart")
+	}
+	message := client.receive()
+	if message.topic != "alerts/overheat" || message.payload != "fire" {
+		t.Fatalf("queued message received as %+v", message)
+	}
+	client.quiet() // QoS 0 messages are not queued for offline clients
+
+	// Unacknowledged messages are sent again, marked as duplicates, when the client returns
+	client.conn.Close()
+	client = dialTestBroker(t, broker)
+	client.connect("historian", false)
+	if again := client.receive(); again.payload != "fire" || !again.dup || again.packetID != message.packetID {
+		t.Fatalf("unacknowledged message sent again as %+v", again)
+	}
+	client.send(mqttPubAck<<4, appendMQTTUint16(nil, message.packetID))
+
+	publisher = dialTestBroker(t, broker)
+	publisher.connect("press4", true)
+	publisher.publish(2, "alerts/overheat", 1, "again")
+	publisher.acknowledge(mqttPubAck, 2)
+	if message = client.receive(); message.payload != "again" {
+		t.Fatalf("restored subscription delivered %+v", message)
+	}
+}
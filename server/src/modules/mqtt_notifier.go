@@ -0,0 +1,107 @@
+// server/src/modules/mqtt_notifier.go
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// MQTTNotifier publishes alerts as JSON to a topic on an MQTT broker.
+type MQTTNotifier struct {
+	broker   string // Broker address in host:port form
+	clientID string // MQTT client identifier
+	topic    string // Topic alerts are published to
+	username string // Optional broker username
+	password string // Optional broker password
+	qos      byte   // Publish QoS (0 or 1)
+}
+
+// NewMQTTNotifier creates a notifier that publishes alerts to the given broker and topic.
+func NewMQTTNotifier(broker, clientID, topic, username, password string, qos byte) *MQTTNotifier {
+	if qos > 1 {
+		qos = 1 // QoS 2 adds nothing for idempotent alert delivery
+	}
+	return &MQTTNotifier{
+		broker:   broker,
+		clientID: clientID,
+		topic:    topic,
+		username: username,
+		password: password,
+		qos:      qos,
+	}
+}
+
+// Name identifies the notifier in logs and dead letters.
+func (mn *MQTTNotifier) Name() string {
+	return "mqtt"
+}
+
+// Notify connects to the broker, publishes the alert and disconnects.
+func (mn *MQTTNotifier) Notify(ctx context.Context, alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", mn.broker)
+	if err != nil {
+		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+
+	if _, err := conn.Write(mn.connectPacket()); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+	packetType, body, err := readMQTTPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if packetType != mqttConnAck || len(body) < 2 {
+		return fmt.Errorf("unexpected MQTT packet type %d while waiting for CONNACK", packetType)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("MQTT broker refused connection with return code %d", body[1])
+	}
+
+	const packetID = 1
+	if _, err := conn.Write(mn.publishPacket(packetID, payload)); err != nil {
+		return fmt.Errorf("failed to send PUBLISH: %w", err)
+	}
+	if mn.qos == 1 {
+		packetType, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return fmt.Errorf("failed to read PUBACK: %w", err)
+		}
+		if packetType != mqttPubAck || len(body) < 2 || binary.BigEndian.Uint16(body) != packetID {
+			return fmt.Errorf("unexpected MQTT packet type %d while waiting for PUBACK", packetType)
+		}
+	}
+
+	conn.Write([]byte{mqttDisconnect << 4, 0})
+	return nil
+}
+
+// connectPacket builds an MQTT 3.1.1 CONNECT packet with a clean session.
+func (mn *MQTTNotifier) connectPacket() []byte {
+	return encodeMQTTConnect(mn.clientID, mn.username, mn.password, 30)
+}
+
+// publishPacket builds a PUBLISH packet carrying the alert payload.
+func (mn *MQTTNotifier) publishPacket(packetID uint16, payload []byte) []byte {
+	body := appendMQTTString(nil, mn.topic)
+	if mn.qos > 0 {
+		body = append(body, byte(packetID>>8), byte(packetID))
+	}
+	body = append(body, payload...)
+	return encodeMQTTPacket(mqttPublish<<4|mn.qos<<1, body)
+}
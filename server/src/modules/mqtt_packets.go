@@ -0,0 +1,440 @@
+// server/src/modules/mqtt_packets.go
+
+package modules
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// MQTT control packet types, shared by the notifier and the broker.
+const (
+	mqttConnect     byte = 1
+	mqttConnAck     byte = 2
+	mqttPublish     byte = 3
+	mqttPubAck      byte = 4
+	mqttPubRec      byte = 5
+	mqttPubRel      byte = 6
+	mqttPubComp     byte = 7
+	mqttSubscribe   byte = 8
+	mqttSubAck      byte = 9
+	mqttUnsubscribe byte = 10
+	mqttUnsubAck    byte = 11
+	mqttPingReq     byte = 12
+	mqttPingResp    byte = 13
+	mqttDisconnect  byte = 14
+	mqttAuth        byte = 15
+)
+
+// MQTT protocol levels accepted by the broker.
+const (
+	mqttV311 byte = 4
+	mqttV5   byte = 5
+)
+
+// PUBLISH fixed header flags.
+const (
+	mqttFlagDup    byte = 0x08
+	mqttFlagRetain byte = 0x01
+)
+
+// MQTT 3.1.1 CONNACK return codes.
+const (
+	mqttV3BadVersion         byte = 1
+	mqttV3IdentifierRejected byte = 2
+	mqttV3BadCredentials     byte = 4
+	mqttV3NotAuthorized      byte = 5
+	mqttV3SubscribeFailure   byte = 0x80 // SUBACK return code
+)
+
+// MQTT 5 reason codes used by the broker.
+const (
+	mqttSuccess                byte = 0x00
+	mqttGrantedQoS1            byte = 0x01
+	mqttGrantedQoS2            byte = 0x02
+	mqttDisconnectWithWill     byte = 0x04
+	mqttNoMatchingSubscribers  byte = 0x10
+	mqttNoSubscriptionExisted  byte = 0x11
+	mqttUnspecifiedError       byte = 0x80
+	mqttMalformedPacket        byte = 0x81
+	mqttProtocolError          byte = 0x82
+	mqttUnsupportedVersion     byte = 0x84
+	mqttIdentifierNotValid     byte = 0x85
+	mqttBadCredentials         byte = 0x86
+	mqttNotAuthorized          byte = 0x87
+	mqttServerShuttingDown     byte = 0x8B
+	mqttBadAuthMethod          byte = 0x8C
+	mqttKeepAliveTimeout       byte = 0x8D
+	mqttSessionTakenOver       byte = 0x8E
+	mqttTopicFilterInvalid     byte = 0x8F
+	mqttTopicNameInvalid       byte = 0x90
+	mqttPacketIDNotFound       byte = 0x92
+	mqttTopicAliasInvalid      byte = 0x94
+	mqttPacketTooLarge         byte = 0x95
+	mqttQuotaExceeded          byte = 0x97
+	mqttSharedSubsNotSupported byte = 0x9E
+)
+
+// MQTT 5 property identifiers.
+const (
+	mqttPropPayloadFormat      = 0x01
+	mqttPropMessageExpiry      = 0x02
+	mqttPropContentType        = 0x03
+	mqttPropResponseTopic      = 0x08
+	mqttPropCorrelationData    = 0x09
+	mqttPropSubscriptionID     = 0x0B
+	mqttPropSessionExpiry      = 0x11
+	mqttPropAssignedClientID   = 0x12
+	mqttPropServerKeepAlive    = 0x13
+	mqttPropAuthMethod         = 0x15
+	mqttPropAuthData           = 0x16
+	mqttPropRequestProblemInfo = 0x17
+	mqttPropWillDelay          = 0x18
+	mqttPropRequestRespInfo    = 0x19
+	mqttPropResponseInfo       = 0x1A
+	mqttPropServerReference    = 0x1C
+	mqttPropReasonString       = 0x1F
+	mqttPropReceiveMaximum     = 0x21
+	mqttPropTopicAliasMaximum  = 0x22
+	mqttPropTopicAlias         = 0x23
+	mqttPropMaximumQoS         = 0x24
+	mqttPropRetainAvailable    = 0x25
+	mqttPropUserProperty       = 0x26
+	mqttPropMaximumPacketSize  = 0x27
+	mqttPropWildcardAvailable  = 0x28
+	mqttPropSubIDAvailable     = 0x29
+	mqttPropSharedAvailable    = 0x2A
+)
+
+// errMalformedMQTTPacket is returned for packets that break the MQTT encoding rules.
+var errMalformedMQTTPacket = errors.New("malformed MQTT packet")
+
+// errMQTTPacketTooLarge is returned for packets longer than the reader's limit.
+var errMQTTPacketTooLarge = errors.New("MQTT packet too large")
+
+// encodeMQTTPacket prefixes a packet body with its fixed header.
+func encodeMQTTPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// encodeMQTTConnect builds an MQTT 3.1.1 CONNECT packet with a clean session. The password is sent
+// only with a username; keepAlive is in seconds.
+func encodeMQTTConnect(clientID, username, password string, keepAlive uint16) []byte {
+	flags := byte(0x02) // Clean session
+	if username != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, mqttV311, flags)
+	body = appendMQTTUint16(body, keepAlive)
+	body = appendMQTTString(body, clientID)
+	if username != "" {
+		body = appendMQTTString(body, username)
+		if password != "" {
+			body = appendMQTTString(body, password)
+		}
+	}
+	return encodeMQTTPacket(mqttConnect<<4, body)
+}
+
+// appendMQTTString appends a length-prefixed UTF-8 string.
+func appendMQTTString(buf []byte, value string) []byte {
+	buf = appendMQTTUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// appendMQTTBinary appends length-prefixed binary data.
+func appendMQTTBinary(buf []byte, value []byte) []byte {
+	buf = appendMQTTUint16(buf, uint16(len(value)))
+	return append(buf, value...)
+}
+
+// appendMQTTUint16 appends a big-endian two byte integer.
+func appendMQTTUint16(buf []byte, value uint16) []byte {
+	return append(buf, byte(value>>8), byte(value))
+}
+
+// appendMQTTUint32 appends a big-endian four byte integer.
+func appendMQTTUint32(buf []byte, value uint32) []byte {
+	return append(buf, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// appendMQTTVarint appends a variable byte integer.
+func appendMQTTVarint(buf []byte, value uint32) []byte {
+	for {
+		digit := byte(value % 128)
+		value /= 128
+		if value > 0 {
+			digit |= 0x80
+		}
+		buf = append(buf, digit)
+		if value == 0 {
+			return buf
+		}
+	}
+}
+
+// readMQTTPacket reads one control packet and returns its type and body.
+func readMQTTPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, body, err := readMQTTPacketLimit(reader, 0)
+	return header >> 4, body, err
+}
+
+// readMQTTPacketLimit reads one control packet and returns its first byte, holding the packet type and
+// flags, and its body. Packets whose body exceeds limit are refused unless limit is 0.
+func readMQTTPacketLimit(reader *bufio.Reader, limit int) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT remaining length")
+		}
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	if limit > 0 && length > limit {
+		return 0, nil, fmt.Errorf("%w: %d bytes", errMQTTPacketTooLarge, length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// mqttDecoder reads the fields of a packet body. The first error sticks, so a packet can be decoded
+// field by field and checked once at the end.
+type mqttDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *mqttDecoder) fail(reason string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: %s", errMalformedMQTTPacket, reason)
+	}
+}
+
+func (d *mqttDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.data) < n {
+		d.fail("truncated")
+		return nil
+	}
+	field := d.data[:n]
+	d.data = d.data[n:]
+	return field
+}
+
+func (d *mqttDecoder) byte() byte {
+	if field := d.take(1); field != nil {
+		return field[0]
+	}
+	return 0
+}
+
+func (d *mqttDecoder) uint16() uint16 {
+	if field := d.take(2); field != nil {
+		return binary.BigEndian.Uint16(field)
+	}
+	return 0
+}
+
+func (d *mqttDecoder) uint32() uint32 {
+	if field := d.take(4); field != nil {
+		return binary.BigEndian.Uint32(field)
+	}
+	return 0
+}
+
+func (d *mqttDecoder) varint() uint32 {
+	value, multiplier := uint32(0), uint32(1)
+	for i := 0; i < 4; i++ {
+		digit := d.byte()
+		if d.err != nil {
+			return 0
+		}
+		value += uint32(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			return value
+		}
+		multiplier *= 128
+	}
+	d.fail("variable byte integer too long")
+	return 0
+}
+
+func (d *mqttDecoder) binary() []byte {
+	length := d.uint16()
+	return append([]byte(nil), d.take(int(length))...)
+}
+
+// string reads a UTF-8 string, refusing the encodings MQTT forbids.
+func (d *mqttDecoder) string() string {
+	length := d.uint16()
+	field := d.take(int(length))
+	if d.err != nil {
+		return ""
+	}
+	for _, r := range string(field) {
+		if r == 0 || r == utf8.RuneError {
+			d.fail("invalid UTF-8 string")
+			return ""
+		}
+	}
+	return string(field)
+}
+
+// mqttProperties holds the MQTT 5 properties the broker acts on or forwards.
+type mqttProperties struct {
+	payloadFormat     byte
+	messageExpiry     uint32
+	hasMessageExpiry  bool
+	contentType       string
+	responseTopic     string
+	correlationData   []byte
+	subscriptionIDs   []uint32
+	sessionExpiry     uint32
+	hasSessionExpiry  bool
+	authMethod        string
+	willDelay         uint32
+	receiveMaximum    uint16
+	topicAlias        uint16
+	maximumPacketSize uint32
+	reasonString      string
+	userProperties    [][2]string
+}
+
+// properties reads an MQTT 5 property block. Properties the broker does not use are checked and skipped.
+func (d *mqttDecoder) properties() mqttProperties {
+	var props mqttProperties
+	length := d.varint()
+	block := &mqttDecoder{data: d.take(int(length))}
+	for d.err == nil && block.err == nil && len(block.data) > 0 {
+		switch id := block.varint(); id {
+		case mqttPropPayloadFormat:
+			props.payloadFormat = block.byte()
+		case mqttPropMessageExpiry:
+			props.messageExpiry, props.hasMessageExpiry = block.uint32(), true
+		case mqttPropContentType:
+			props.contentType = block.string()
+		case mqttPropResponseTopic:
+			props.responseTopic = block.string()
+		case mqttPropCorrelationData:
+			props.correlationData = block.binary()
+		case mqttPropSubscriptionID:
+			props.subscriptionIDs = append(props.subscriptionIDs, block.varint())
+		case mqttPropSessionExpiry:
+			props.sessionExpiry, props.hasSessionExpiry = block.uint32(), true
+		case mqttPropAuthMethod:
+			props.authMethod = block.string()
+		case mqttPropWillDelay:
+			props.willDelay = block.uint32()
+		case mqttPropReceiveMaximum:
+			props.receiveMaximum = block.uint16()
+		case mqttPropTopicAlias:
+			props.topicAlias = block.uint16()
+		case mqttPropMaximumPacketSize:
+			props.maximumPacketSize = block.uint32()
+		case mqttPropReasonString:
+			props.reasonString = block.string()
+		case mqttPropUserProperty:
+			key := block.string()
+			props.userProperties = append(props.userProperties, [2]string{key, block.string()})
+		case mqttPropRequestProblemInfo, mqttPropRequestRespInfo, mqttPropMaximumQoS, mqttPropRetainAvailable,
+			mqttPropWildcardAvailable, mqttPropSubIDAvailable, mqttPropSharedAvailable:
+			block.byte()
+		case mqttPropServerKeepAlive, mqttPropTopicAliasMaximum:
+			block.uint16()
+		case mqttPropAssignedClientID, mqttPropResponseInfo, mqttPropServerReference:
+			block.string()
+		case mqttPropAuthData:
+			block.binary()
+		default:
+			block.fail(fmt.Sprintf("unknown property 0x%02x", id))
+		}
+	}
+	if d.err == nil {
+		d.err = block.err
+	}
+	return props
+}
+
+// mqttPropertyWriter builds an MQTT 5 property block.
+type mqttPropertyWriter struct {
+	buf []byte
+}
+
+func (w *mqttPropertyWriter) byte(id, value byte) {
+	w.buf = append(w.buf, id, value)
+}
+
+func (w *mqttPropertyWriter) uint16(id byte, value uint16) {
+	w.buf = appendMQTTUint16(append(w.buf, id), value)
+}
+
+func (w *mqttPropertyWriter) uint32(id byte, value uint32) {
+	w.buf = appendMQTTUint32(append(w.buf, id), value)
+}
+
+func (w *mqttPropertyWriter) varint(id byte, value uint32) {
+	w.buf = appendMQTTVarint(append(w.buf, id), value)
+}
+
+func (w *mqttPropertyWriter) string(id byte, value string) {
+	if value != "" {
+		w.buf = appendMQTTString(append(w.buf, id), value)
+	}
+}
+
+func (w *mqttPropertyWriter) binary(id byte, value []byte) {
+	if len(value) > 0 {
+		w.buf = appendMQTTBinary(append(w.buf, id), value)
+	}
+}
+
+func (w *mqttPropertyWriter) userProperties(pairs [][2]string) {
+	for _, pair := range pairs {
+		w.buf = appendMQTTString(appendMQTTString(append(w.buf, mqttPropUserProperty), pair[0]), pair[1])
+	}
+}
+
+// appendTo appends the property block, length first.
+func (w *mqttPropertyWriter) appendTo(buf []byte) []byte {
+	return append(appendMQTTVarint(buf, uint32(len(w.buf))), w.buf...)
+}
@@ -0,0 +1,248 @@
+// server/src/modules/mqtt_session.go
+
+package modules
+
+import (
+	"time"
+)
+
+// mqttMessage is an application message passing through the broker. Its fields are exported for the
+// state file.
+type mqttMessage struct {
+	Topic           string      `json:"topic"`
+	Payload         []byte      `json:"payload,omitempty"`
+	QoS             byte        `json:"qos,omitempty"`
+	Retain          bool        `json:"retain,omitempty"`
+	Expires         time.Time   `json:"expires,omitempty"` // Zero when the message never expires
+	PayloadFormat   byte        `json:"payload_format,omitempty"`
+	ContentType     string      `json:"content_type,omitempty"`
+	ResponseTopic   string      `json:"response_topic,omitempty"`
+	CorrelationData []byte      `json:"correlation_data,omitempty"`
+	UserProperties  [][2]string `json:"user_properties,omitempty"`
+	Origin          string      `json:"origin,omitempty"` // Client ID of the publisher; empty for messages from routes
+}
+
+// expired reports whether the message has outlived its expiry interval.
+func (m *mqttMessage) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// mqttSubscription is one topic filter of a session with its subscription options.
+type mqttSubscription struct {
+	Filter            string   `json:"filter"`
+	QoS               byte     `json:"qos"`
+	NoLocal           bool     `json:"no_local,omitempty"`            // Messages the client publishes itself are not sent back
+	RetainAsPublished bool     `json:"retain_as_published,omitempty"` // Forwarded messages keep their retain flag
+	Identifier        uint32   `json:"identifier,omitempty"`          // MQTT 5 subscription identifier; 0 when none
+	Excluded          []string `json:"excluded,omitempty"`            // Filters AccessControl carved out of this one
+}
+
+// mqttOutgoing is a message on its way to one client.
+type mqttOutgoing struct {
+	Message         *mqttMessage `json:"message"`
+	QoS             byte         `json:"qos"`
+	Retain          bool         `json:"retain,omitempty"`
+	SubscriptionIDs []uint32     `json:"subscription_ids,omitempty"`
+	PacketID        uint16       `json:"packet_id,omitempty"` // Assigned when a QoS 1 or 2 message is first sent
+	Released        bool         `json:"released,omitempty"`  // PUBREC received and PUBREL sent; awaiting PUBCOMP
+}
+
+// mqttSession is the state the broker keeps for a client ID, which may outlive the connection. All of
+// it is guarded by the broker mutex.
+type mqttSession struct {
+	ClientID       string                       `json:"client_id"`
+	Username       string                       `json:"username"`
+	Subscriptions  map[string]*mqttSubscription `json:"subscriptions,omitempty"`
+	Queue          []*mqttOutgoing              `json:"queue,omitempty"`    // Messages not yet sent
+	Inflight       []*mqttOutgoing              `json:"inflight,omitempty"` // QoS 1 and 2 messages sent and not yet acknowledged, in send order
+	Incoming       map[uint16]bool              `json:"incoming,omitempty"` // QoS 2 packet IDs received and awaiting PUBREL
+	Expiry         time.Duration                `json:"expiry"`             // How long the session outlives its connection
+	DisconnectedAt time.Time                    `json:"disconnected_at"`
+
+	client    *mqttClient // Current connection; nil while offline
+	lastID    uint16      // Last packet ID handed out
+	willTimer *time.Timer // Pending delayed will message
+}
+
+func newMQTTSession(clientID, username string) *mqttSession {
+	return &mqttSession{
+		ClientID:      clientID,
+		Username:      username,
+		Subscriptions: make(map[string]*mqttSubscription),
+		Incoming:      make(map[uint16]bool),
+	}
+}
+
+// outgoingFor builds the copy of a message the session should receive, or returns nil when none of its
+// subscriptions take it. Overlapping subscriptions yield a single copy at the highest QoS they grant.
+func (s *mqttSession) outgoingFor(message *mqttMessage) *mqttOutgoing {
+	var out *mqttOutgoing
+	for _, sub := range s.Subscriptions {
+		if !TopicMatches(sub.Filter, message.Topic) || topicExcluded(sub.Excluded, message.Topic) ||
+			sub.NoLocal && message.Origin == s.ClientID {
+			continue
+		}
+		if out == nil {
+			out = &mqttOutgoing{Message: message}
+		}
+		qos := message.QoS
+		if sub.QoS < qos {
+			qos = sub.QoS
+		}
+		if qos > out.QoS {
+			out.QoS = qos
+		}
+		if sub.RetainAsPublished && message.Retain {
+			out.Retain = true
+		}
+		if sub.Identifier != 0 {
+			out.SubscriptionIDs = append(out.SubscriptionIDs, sub.Identifier)
+		}
+	}
+	return out
+}
+
+// enqueue adds a message for the client and reports whether it was accepted. QoS 0 messages are not
+// kept for offline clients, and nothing is added beyond limit messages.
+func (s *mqttSession) enqueue(out *mqttOutgoing, limit int) bool {
+	if s.client == nil && out.QoS == 0 || limit > 0 && len(s.Queue) >= limit {
+		return false
+	}
+	s.Queue = append(s.Queue, out)
+	if s.client != nil {
+		s.client.notify()
+	}
+	return true
+}
+
+// nextPacketID returns a packet ID not used by any message in flight.
+func (s *mqttSession) nextPacketID() uint16 {
+	for {
+		s.lastID++
+		if s.lastID == 0 {
+			continue
+		}
+		inUse := false
+		for _, out := range s.Inflight {
+			if out.PacketID == s.lastID {
+				inUse = true
+				break
+			}
+		}
+		if !inUse {
+			return s.lastID
+		}
+	}
+}
+
+// take removes the messages that can be sent now from the queue and returns them encoded for client.
+// QoS 1 and 2 messages wait while the client's receive maximum is in flight. Expired messages and
+// those larger than the client accepts are dropped.
+func (s *mqttSession) take(client *mqttClient, now time.Time) [][]byte {
+	var packets [][]byte
+	for len(s.Queue) > 0 {
+		out := s.Queue[0]
+		if out.QoS > 0 && len(s.Inflight) >= client.receiveMax {
+			break
+		}
+		s.Queue = s.Queue[1:]
+		if out.Message.expired(now) {
+			continue
+		}
+		if out.QoS > 0 {
+			out.PacketID = s.nextPacketID()
+		}
+		packet := encodeMQTTPublish(out, client.version, false, now)
+		if client.maxPacket > 0 && len(packet) > client.maxPacket {
+			continue
+		}
+		if out.QoS > 0 {
+			s.Inflight = append(s.Inflight, out)
+		}
+		packets = append(packets, packet)
+	}
+	return packets
+}
+
+// resume returns the packets to resend when a session is resumed: a PUBREL for each released QoS 2
+// message and the PUBLISH, flagged as a duplicate, of the others.
+func (s *mqttSession) resume(client *mqttClient, now time.Time) [][]byte {
+	packets := make([][]byte, 0, len(s.Inflight))
+	for _, out := range s.Inflight {
+		if out.Released {
+			packets = append(packets, encodeMQTTAck(mqttPubRel<<4|0x02, out.PacketID, mqttSuccess, client.version))
+		} else {
+			packets = append(packets, encodeMQTTPublish(out, client.version, true, now))
+		}
+	}
+	return packets
+}
+
+// acknowledge applies a PUBACK, PUBREC or PUBCOMP from the client. It reports whether a message in
+// flight had the packet ID, and for a PUBREC whether a PUBREL should follow.
+func (s *mqttSession) acknowledge(packetType byte, packetID uint16, reason byte) (found, release bool) {
+	for i, out := range s.Inflight {
+		if out.PacketID != packetID {
+			continue
+		}
+		switch {
+		case packetType == mqttPubAck && out.QoS == 1,
+			packetType == mqttPubComp && out.QoS == 2 && out.Released,
+			packetType == mqttPubRec && out.QoS == 2 && reason >= mqttUnspecifiedError:
+			s.Inflight = append(s.Inflight[:i], s.Inflight[i+1:]...)
+			return true, false
+		case packetType == mqttPubRec && out.QoS == 2:
+			out.Released = true
+			return true, true
+		}
+		return false, false
+	}
+	return false, false
+}
+
+// encodeMQTTPublish encodes a PUBLISH packet for a client of the given protocol version.
+func encodeMQTTPublish(out *mqttOutgoing, version byte, dup bool, now time.Time) []byte {
+	message := out.Message
+	header := mqttPublish<<4 | out.QoS<<1
+	if out.Retain {
+		header |= mqttFlagRetain
+	}
+	if dup && out.QoS > 0 {
+		header |= mqttFlagDup
+	}
+
+	body := appendMQTTString(make([]byte, 0, 32+len(message.Topic)+len(message.Payload)), message.Topic)
+	if out.QoS > 0 {
+		body = appendMQTTUint16(body, out.PacketID)
+	}
+	if version == mqttV5 {
+		var props mqttPropertyWriter
+		if message.PayloadFormat != 0 {
+			props.byte(mqttPropPayloadFormat, message.PayloadFormat)
+		}
+		if !message.Expires.IsZero() {
+			// The remaining lifetime, rounded up so the message does not expire early
+			remaining := (message.Expires.Sub(now) + time.Second - 1) / time.Second
+			props.uint32(mqttPropMessageExpiry, uint32(remaining))
+		}
+		props.string(mqttPropContentType, message.ContentType)
+		props.string(mqttPropResponseTopic, message.ResponseTopic)
+		props.binary(mqttPropCorrelationData, message.CorrelationData)
+		props.userProperties(message.UserProperties)
+		for _, id := range out.SubscriptionIDs {
+			props.varint(mqttPropSubscriptionID, id)
+		}
+		body = props.appendTo(body)
+	}
+	return encodeMQTTPacket(header, append(body, message.Payload...))
+}
+
+// encodeMQTTAck encodes a PUBACK, PUBREC, PUBREL or PUBCOMP. MQTT 5 acks carry a reason code unless
+// it is success.
+func encodeMQTTAck(header byte, packetID uint16, reason byte, version byte) []byte {
+	body := appendMQTTUint16(make([]byte, 0, 3), packetID)
+	if version == mqttV5 && reason != mqttSuccess {
+		body = append(body, reason)
+	}
+	return encodeMQTTPacket(header, body)
+}
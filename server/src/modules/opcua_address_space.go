@@ -0,0 +1,462 @@
+// server/src/modules/opcua_address_space.go
+
+package modules
+
+import (
+	"sync"
+	"time"
+)
+
+// Standard nodes the server provides beyond those the client needs
+const (
+	opcuaNodeReferences                = 31
+	opcuaNodeNonHierarchicalReferences = 32
+	opcuaNodeHasChild                  = 34
+	opcuaNodeAggregates                = 44
+	opcuaNodeHasSubtype                = 45
+	opcuaNodeBaseObjectType            = 58
+	opcuaNodeBaseVariableType          = 62
+	opcuaNodePropertyType              = 68
+	opcuaNodeRootFolder                = 84
+	opcuaNodeTypesFolder               = 86
+	opcuaNodeViewsFolder               = 87
+	opcuaNodeObjectTypesFolder         = 88
+	opcuaNodeVariableTypesFolder       = 89
+	opcuaNodeDataTypesFolder           = 90
+	opcuaNodeReferenceTypesFolder      = 91
+	opcuaNodeServerType                = 2004
+	opcuaNodeServerStatusType          = 2138
+	opcuaNodeServerArray               = 2254
+	opcuaNodeNamespaceArray            = 2255
+	opcuaNodeServerStatus              = 2256
+	opcuaNodeServerStartTime           = 2257
+	opcuaNodeServerCurrentTime         = 2258
+	opcuaNodeServerState               = 2259
+	opcuaNodeServiceLevel              = 2267
+	opcuaDataTypeServerState           = 852
+	opcuaDataTypeServerStatus          = 862
+)
+
+// opcuaNimbusNamespace is the index of the namespace of the nodes generated from the configuration.
+const (
+	opcuaNimbusNamespace    = 1
+	opcuaNimbusNamespaceURI = "urn:nimbus:analytics"
+)
+
+// Access level bits
+const (
+	opcuaAccessRead  = 1
+	opcuaAccessWrite = 2
+)
+
+// opcuaTypeDefinition describes a node of the standard type hierarchies.
+type opcuaTypeDefinition struct {
+	id        uint32
+	class     int32
+	name      string
+	supertype uint32 // 0 for the root of a hierarchy
+	abstract  bool
+	inverse   string // Inverse name of reference types
+}
+
+// opcuaStandardTypes are the types the nodes of the server refer to, with their supertypes, so that
+// clients can resolve them and filter references by type.
+var opcuaStandardTypes = []opcuaTypeDefinition{
+	{opcuaNodeReferences, opcuaNodeClassReferenceType, "References", 0, true, ""},
+	{opcuaNodeHierarchicalReferences, opcuaNodeClassReferenceType, "HierarchicalReferences", opcuaNodeReferences, true, ""},
+	{opcuaNodeNonHierarchicalReferences, opcuaNodeClassReferenceType, "NonHierarchicalReferences", opcuaNodeReferences, true, ""},
+	{opcuaNodeHasChild, opcuaNodeClassReferenceType, "HasChild", opcuaNodeHierarchicalReferences, true, "ChildOf"},
+	{opcuaNodeOrganizes, opcuaNodeClassReferenceType, "Organizes", opcuaNodeHierarchicalReferences, false, "OrganizedBy"},
+	{opcuaNodeAggregates, opcuaNodeClassReferenceType, "Aggregates", opcuaNodeHasChild, true, "AggregatedBy"},
+	{opcuaNodeHasSubtype, opcuaNodeClassReferenceType, "HasSubtype", opcuaNodeHasChild, false, "HasSupertype"},
+	{opcuaNodeHasProperty, opcuaNodeClassReferenceType, "HasProperty", opcuaNodeAggregates, false, "PropertyOf"},
+	{opcuaNodeHasComponent, opcuaNodeClassReferenceType, "HasComponent", opcuaNodeAggregates, false, "ComponentOf"},
+	{opcuaNodeHasTypeDefinition, opcuaNodeClassReferenceType, "HasTypeDefinition", opcuaNodeNonHierarchicalReferences, false, "TypeDefinitionOf"},
+	{opcuaNodeBaseObjectType, opcuaNodeClassObjectType, "BaseObjectType", 0, false, ""},
+	{opcuaNodeFolderType, opcuaNodeClassObjectType, "FolderType", opcuaNodeBaseObjectType, false, ""},
+	{opcuaNodeServerType, opcuaNodeClassObjectType, "ServerType", opcuaNodeBaseObjectType, false, ""},
+	{opcuaNodeBaseVariableType, opcuaNodeClassVariableType, "BaseVariableType", 0, true, ""},
+	{opcuaNodeBaseDataVariableType, opcuaNodeClassVariableType, "BaseDataVariableType", opcuaNodeBaseVariableType, false, ""},
+	{opcuaNodePropertyType, opcuaNodeClassVariableType, "PropertyType", opcuaNodeBaseVariableType, false, ""},
+	{opcuaNodeServerStatusType, opcuaNodeClassVariableType, "ServerStatusType", opcuaNodeBaseDataVariableType, false, ""},
+	{24, opcuaNodeClassDataType, "BaseDataType", 0, true, ""},
+	{opcuaTypeBoolean, opcuaNodeClassDataType, "Boolean", 24, false, ""},
+	{26, opcuaNodeClassDataType, "Number", 24, true, ""},
+	{opcuaTypeDouble, opcuaNodeClassDataType, "Double", 26, false, ""},
+	{27, opcuaNodeClassDataType, "Integer", 26, true, ""},
+	{opcuaTypeInt32, opcuaNodeClassDataType, "Int32", 27, false, ""},
+	{28, opcuaNodeClassDataType, "UInteger", 26, true, ""},
+	{opcuaTypeByte, opcuaNodeClassDataType, "Byte", 28, false, ""},
+	{opcuaTypeUInt32, opcuaNodeClassDataType, "UInt32", 28, false, ""},
+	{opcuaTypeString, opcuaNodeClassDataType, "String", 24, false, ""},
+	{opcuaTypeDateTime, opcuaNodeClassDataType, "DateTime", 24, false, ""},
+	{22, opcuaNodeClassDataType, "Structure", 24, true, ""},
+	{opcuaDataTypeServerStatus, opcuaNodeClassDataType, "ServerStatusDataType", 22, false, ""},
+	{29, opcuaNodeClassDataType, "Enumeration", 24, true, ""},
+	{opcuaDataTypeServerState, opcuaNodeClassDataType, "ServerState", 29, false, ""},
+}
+
+// opcuaTypeFolders names the folder each type hierarchy is organized in.
+var opcuaTypeFolders = map[int32]uint32{
+	opcuaNodeClassReferenceType: opcuaNodeReferenceTypesFolder,
+	opcuaNodeClassObjectType:    opcuaNodeObjectTypesFolder,
+	opcuaNodeClassVariableType:  opcuaNodeVariableTypesFolder,
+	opcuaNodeClassDataType:      opcuaNodeDataTypesFolder,
+}
+
+// opcuaNode is a node of the server's address space. Everything but the value of a variable is fixed
+// once the address space is built.
+type opcuaNode struct {
+	id          opcuaNodeID
+	class       int32
+	browseName  opcuaQualifiedName
+	displayName string
+	description string
+	typeDef     uint32 // Type definition of objects and variables
+	references  []opcuaReference
+
+	// Types
+	isAbstract  bool
+	symmetric   bool
+	inverseName string
+
+	// Variables
+	dataType  uint32
+	valueRank int32 // -1 for scalars, 1 for arrays
+	readRole  Role  // Role needed to read the value; empty for any session
+	writeRole Role  // Role needed to write the value; empty for read-only variables
+	write     func(session *opcuaServerSession, value *opcuaVariant) opcuaStatusCode
+	compute   func(now time.Time) opcuaDataValue // Computes the value on every read instead of holding one
+	value     opcuaDataValue                     // Guarded by the address space's mutex
+}
+
+// opcuaReference is a reference from a node, kept on both of the nodes it connects.
+type opcuaReference struct {
+	typeID  uint32
+	forward bool
+	target  *opcuaNode
+}
+
+// opcuaAddressSpace holds the nodes of the server.
+type opcuaAddressSpace struct {
+	nodes map[string]*opcuaNode // By node ID in standard notation
+	mutex sync.RWMutex          // Guards the values of variables
+}
+
+// newOPCUAAddressSpace creates an address space holding the standard folders, types and Server object.
+// namespaces lists the namespace URIs, the standard one first.
+func newOPCUAAddressSpace(namespaces []string, applicationURI string, status func(now time.Time) *opcuaServerStatus) *opcuaAddressSpace {
+	a := &opcuaAddressSpace{nodes: make(map[string]*opcuaNode)}
+	// The folders holding the types come first; their type definitions are referenced once FolderType
+	// exists
+	var folders []*opcuaNode
+	folder := func(id uint32, name string, parent *opcuaNode) *opcuaNode {
+		node := opcuaStandardNode(id, opcuaNodeClassObject, name)
+		if parent != nil {
+			a.add(parent, opcuaNodeOrganizes, node)
+		} else {
+			a.nodes[node.id.String()] = node
+		}
+		folders = append(folders, node)
+		return node
+	}
+	root := folder(opcuaNodeRootFolder, "Root", nil)
+	folder(opcuaNodeObjectsFolder, "Objects", root)
+	types := folder(opcuaNodeTypesFolder, "Types", root)
+	folder(opcuaNodeViewsFolder, "Views", root)
+	folder(opcuaNodeObjectTypesFolder, "ObjectTypes", types)
+	folder(opcuaNodeVariableTypesFolder, "VariableTypes", types)
+	folder(opcuaNodeDataTypesFolder, "DataTypes", types)
+	folder(opcuaNodeReferenceTypesFolder, "ReferenceTypes", types)
+
+	for _, definition := range opcuaStandardTypes {
+		node := opcuaStandardNode(definition.id, definition.class, definition.name)
+		node.isAbstract, node.inverseName = definition.abstract, definition.inverse
+		node.symmetric = definition.id == opcuaNodeReferences
+		if definition.class == opcuaNodeClassVariableType {
+			node.dataType, node.valueRank = 24, -2
+		}
+		if definition.supertype == 0 {
+			a.add(a.standard(opcuaTypeFolders[definition.class]), opcuaNodeOrganizes, node)
+		} else {
+			a.add(a.standard(definition.supertype), opcuaNodeHasSubtype, node)
+		}
+	}
+	for _, node := range folders {
+		node.typeDef = opcuaNodeFolderType
+		a.reference(node, opcuaNodeHasTypeDefinition, a.standard(opcuaNodeFolderType))
+	}
+
+	server := opcuaStandardNode(opcuaNodeServer, opcuaNodeClassObject, "Server")
+	server.typeDef = opcuaNodeServerType
+	a.add(a.standard(opcuaNodeObjectsFolder), opcuaNodeOrganizes, server)
+	constant := func(value opcuaVariant) func(time.Time) opcuaDataValue {
+		return func(time.Time) opcuaDataValue { return opcuaDataValue{Value: &value} }
+	}
+	property := func(id uint32, name string, dataType uint32, valueRank int32, compute func(time.Time) opcuaDataValue) {
+		node := opcuaStandardNode(id, opcuaNodeClassVariable, name)
+		node.typeDef, node.dataType, node.valueRank, node.compute = opcuaNodePropertyType, dataType, valueRank, compute
+		a.add(server, opcuaNodeHasProperty, node)
+	}
+	names := make([]interface{}, len(namespaces))
+	for i, namespace := range namespaces {
+		names[i] = namespace
+	}
+	property(opcuaNodeServerArray, "ServerArray", opcuaTypeString, 1, constant(opcuaVariant{Type: opcuaTypeString, Value: []interface{}{applicationURI}}))
+	property(opcuaNodeNamespaceArray, "NamespaceArray", opcuaTypeString, 1, constant(opcuaVariant{Type: opcuaTypeString, Value: names}))
+	property(opcuaNodeServiceLevel, "ServiceLevel", opcuaTypeByte, -1, constant(opcuaVariant{Type: opcuaTypeByte, Value: byte(255)}))
+
+	serverStatus := opcuaStandardNode(opcuaNodeServerStatus, opcuaNodeClassVariable, "ServerStatus")
+	serverStatus.typeDef, serverStatus.dataType, serverStatus.valueRank = opcuaNodeServerStatusType, opcuaDataTypeServerStatus, -1
+	serverStatus.compute = func(now time.Time) opcuaDataValue {
+		return opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeExtensionObject, Value: newOPCUAExtensionObject(status(now))}, SourceTimestamp: now}
+	}
+	a.add(server, opcuaNodeHasComponent, serverStatus)
+	statusField := func(id uint32, name string, dataType uint32, field func(*opcuaServerStatus) opcuaVariant) {
+		node := opcuaStandardNode(id, opcuaNodeClassVariable, name)
+		node.typeDef, node.dataType, node.valueRank = opcuaNodeBaseDataVariableType, dataType, -1
+		node.compute = func(now time.Time) opcuaDataValue {
+			value := field(status(now))
+			return opcuaDataValue{Value: &value, SourceTimestamp: now}
+		}
+		a.add(serverStatus, opcuaNodeHasComponent, node)
+	}
+	statusField(opcuaNodeServerStartTime, "StartTime", opcuaTypeDateTime, func(s *opcuaServerStatus) opcuaVariant {
+		return opcuaVariant{Type: opcuaTypeDateTime, Value: s.StartTime}
+	})
+	statusField(opcuaNodeServerCurrentTime, "CurrentTime", opcuaTypeDateTime, func(s *opcuaServerStatus) opcuaVariant {
+		return opcuaVariant{Type: opcuaTypeDateTime, Value: s.CurrentTime}
+	})
+	statusField(opcuaNodeServerState, "State", opcuaDataTypeServerState, func(s *opcuaServerStatus) opcuaVariant {
+		return opcuaVariant{Type: opcuaTypeInt32, Value: s.State}
+	})
+	return a
+}
+
+// opcuaStandardNode creates a node of the standard namespace.
+func opcuaStandardNode(id uint32, class int32, name string) *opcuaNode {
+	return &opcuaNode{id: opcuaNumericNodeID(0, id), class: class, browseName: opcuaQualifiedName{Name: name}, displayName: name}
+}
+
+// opcuaNimbusNode creates a node of the Nimbus namespace, identified by its path from the Nimbus folder.
+func opcuaNimbusNode(path, name string, class int32) *opcuaNode {
+	return &opcuaNode{
+		id:          opcuaNodeID{Namespace: opcuaNimbusNamespace, Type: opcuaStringID, Text: path},
+		class:       class,
+		browseName:  opcuaQualifiedName{Namespace: opcuaNimbusNamespace, Name: name},
+		displayName: name,
+	}
+}
+
+// standard returns a node of the standard namespace.
+func (a *opcuaAddressSpace) standard(id uint32) *opcuaNode {
+	return a.nodes[opcuaNumericNodeID(0, id).String()]
+}
+
+// node returns the node with an ID, or nil.
+func (a *opcuaAddressSpace) node(id opcuaNodeID) *opcuaNode {
+	return a.nodes[id.String()]
+}
+
+// add adds a node with a reference to it from parent, and the type definition reference of objects and
+// variables. It reports false, adding nothing, when a node with the same ID exists.
+func (a *opcuaAddressSpace) add(parent *opcuaNode, referenceType uint32, node *opcuaNode) bool {
+	key := node.id.String()
+	if _, exists := a.nodes[key]; exists {
+		return false
+	}
+	a.nodes[key] = node
+	a.reference(parent, referenceType, node)
+	if node.typeDef != 0 {
+		a.reference(node, opcuaNodeHasTypeDefinition, a.standard(node.typeDef))
+	}
+	return true
+}
+
+// reference adds a reference, and its inverse on the target.
+func (a *opcuaAddressSpace) reference(source *opcuaNode, referenceType uint32, target *opcuaNode) {
+	source.references = append(source.references, opcuaReference{typeID: referenceType, forward: true, target: target})
+	target.references = append(target.references, opcuaReference{typeID: referenceType, forward: false, target: source})
+}
+
+// isSubtype reports whether a reference type is ancestor or one of its subtypes.
+func (a *opcuaAddressSpace) isSubtype(referenceType, ancestor uint32) bool {
+	for node := a.standard(referenceType); node != nil; {
+		if node.id.Numeric == ancestor {
+			return true
+		}
+		var supertype *opcuaNode
+		for _, ref := range node.references {
+			if ref.typeID == opcuaNodeHasSubtype && !ref.forward {
+				supertype = ref.target
+				break
+			}
+		}
+		node = supertype
+	}
+	return false
+}
+
+// browse returns the references of a node that a browse description selects.
+func (a *opcuaAddressSpace) browse(description *opcuaBrowseDescription) ([]opcuaReferenceDescription, opcuaStatusCode) {
+	node := a.node(description.NodeID)
+	if node == nil {
+		return nil, opcuaBadNodeIDUnknown
+	}
+	if description.BrowseDirection < 0 || description.BrowseDirection > 2 {
+		return nil, opcuaBadBrowseDirectionInvalid
+	}
+	var referenceType *opcuaNode
+	if !description.ReferenceTypeID.isNull() {
+		referenceType = a.node(description.ReferenceTypeID)
+		if referenceType == nil || referenceType.class != opcuaNodeClassReferenceType {
+			return nil, opcuaBadReferenceTypeIDInvalid
+		}
+	}
+
+	var found []opcuaReferenceDescription
+	for _, ref := range node.references {
+		if description.BrowseDirection == 0 && !ref.forward || description.BrowseDirection == 1 && ref.forward {
+			continue
+		}
+		if referenceType != nil && ref.typeID != referenceType.id.Numeric && !(description.IncludeSubtypes && a.isSubtype(ref.typeID, referenceType.id.Numeric)) {
+			continue
+		}
+		if description.NodeClassMask != 0 && description.NodeClassMask&uint32(ref.target.class) == 0 {
+			continue
+		}
+		result := opcuaReferenceDescription{NodeID: opcuaExpandedNodeID{NodeID: ref.target.id}}
+		mask := description.ResultMask
+		if mask&0x01 != 0 {
+			result.ReferenceTypeID = opcuaNumericNodeID(0, ref.typeID)
+		}
+		if mask&0x02 != 0 {
+			result.IsForward = ref.forward
+		}
+		if mask&0x04 != 0 {
+			result.NodeClass = ref.target.class
+		}
+		if mask&0x08 != 0 {
+			result.BrowseName = ref.target.browseName
+		}
+		if mask&0x10 != 0 {
+			result.DisplayName = opcuaLocalizedText{Text: ref.target.displayName}
+		}
+		if mask&0x20 != 0 && ref.target.typeDef != 0 {
+			result.TypeDefinition = opcuaExpandedNodeID{NodeID: opcuaNumericNodeID(0, ref.target.typeDef)}
+		}
+		found = append(found, result)
+	}
+	return found, opcuaGood
+}
+
+// value returns a copy of the current value of a variable; encoding a variant writes to it, so
+// responses must not share one.
+func (a *opcuaAddressSpace) value(node *opcuaNode, now time.Time) opcuaDataValue {
+	var value opcuaDataValue
+	if node.compute != nil {
+		value = node.compute(now)
+	} else {
+		a.mutex.RLock()
+		value = node.value
+		a.mutex.RUnlock()
+	}
+	if value.Value != nil {
+		variant := *value.Value
+		if values, isArray := variant.Value.([]interface{}); isArray {
+			variant.Value = append([]interface{}{}, values...)
+		}
+		value.Value = &variant
+	}
+	return value
+}
+
+// setValue replaces the value of a variable.
+func (a *opcuaAddressSpace) setValue(node *opcuaNode, value opcuaDataValue) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	node.value = value
+}
+
+// accessLevel returns the access level of a variable, or the part of it the session's roles allow.
+func (a *opcuaAddressSpace) accessLevel(node *opcuaNode, session *opcuaServerSession) byte {
+	level := byte(0)
+	if session == nil || session.allowed(node.readRole) {
+		level |= opcuaAccessRead
+	}
+	if node.write != nil && (session == nil || session.allowed(node.writeRole)) {
+		level |= opcuaAccessWrite
+	}
+	return level
+}
+
+// read returns an attribute of a node as a session may see it; values carry both timestamps.
+func (a *opcuaAddressSpace) read(session *opcuaServerSession, node *opcuaNode, attribute uint32, now time.Time) opcuaDataValue {
+	scalar := func(typeID byte, value interface{}) opcuaDataValue {
+		return opcuaDataValue{Value: &opcuaVariant{Type: typeID, Value: value}}
+	}
+	variable := node.class == opcuaNodeClassVariable
+	isType := node.class&(opcuaNodeClassObjectType|opcuaNodeClassVariableType|opcuaNodeClassReferenceType|opcuaNodeClassDataType) != 0
+	switch {
+	case attribute == opcuaAttributeNodeID:
+		return scalar(opcuaTypeNodeID, node.id)
+	case attribute == opcuaAttributeNodeClass:
+		return scalar(opcuaTypeInt32, node.class)
+	case attribute == opcuaAttributeBrowseName:
+		return scalar(opcuaTypeQualifiedName, node.browseName)
+	case attribute == opcuaAttributeDisplayName:
+		return scalar(opcuaTypeLocalizedText, opcuaLocalizedText{Text: node.displayName})
+	case attribute == opcuaAttributeDescription:
+		return scalar(opcuaTypeLocalizedText, opcuaLocalizedText{Text: node.description})
+	case attribute == opcuaAttributeWriteMask, attribute == opcuaAttributeUserWriteMask:
+		return scalar(opcuaTypeUInt32, uint32(0))
+	case attribute == opcuaAttributeIsAbstract && isType:
+		return scalar(opcuaTypeBoolean, node.isAbstract)
+	case attribute == opcuaAttributeSymmetric && node.class == opcuaNodeClassReferenceType:
+		return scalar(opcuaTypeBoolean, node.symmetric)
+	case attribute == opcuaAttributeInverseName && node.class == opcuaNodeClassReferenceType:
+		return scalar(opcuaTypeLocalizedText, opcuaLocalizedText{Text: node.inverseName})
+	case attribute == opcuaAttributeEventNotifier && node.class == opcuaNodeClassObject:
+		return scalar(opcuaTypeByte, byte(0))
+	case attribute == opcuaAttributeValue && variable:
+		if session != nil && !session.allowed(node.readRole) {
+			return opcuaDataValue{Status: opcuaBadUserAccessDenied}
+		}
+		value := a.value(node, now)
+		value.ServerTimestamp = now
+		return value
+	case attribute == opcuaAttributeDataType && (variable || node.class == opcuaNodeClassVariableType):
+		return scalar(opcuaTypeNodeID, opcuaNumericNodeID(0, node.dataType))
+	case attribute == opcuaAttributeValueRank && (variable || node.class == opcuaNodeClassVariableType):
+		return scalar(opcuaTypeInt32, node.valueRank)
+	case attribute == opcuaAttributeArrayDimensions && (variable || node.class == opcuaNodeClassVariableType):
+		dimensions := []interface{}{}
+		if node.valueRank == 1 {
+			dimensions = []interface{}{uint32(0)}
+		}
+		return scalar(opcuaTypeUInt32, dimensions)
+	case attribute == opcuaAttributeAccessLevel && variable:
+		return scalar(opcuaTypeByte, a.accessLevel(node, nil))
+	case attribute == opcuaAttributeUserAccessLevel && variable:
+		return scalar(opcuaTypeByte, a.accessLevel(node, session))
+	case attribute == opcuaAttributeMinimumSamplingInterval && variable:
+		return scalar(opcuaTypeDouble, float64(0))
+	case attribute == opcuaAttributeHistorizing && variable:
+		return scalar(opcuaTypeBoolean, false)
+	}
+	return opcuaDataValue{Status: opcuaBadAttributeIDInvalid}
+}
+
+// opcuaWithTimestamps keeps the timestamps of a value that a client asked for.
+func opcuaWithTimestamps(value opcuaDataValue, timestamps int32) opcuaDataValue {
+	switch timestamps {
+	case opcuaTimestampsSource:
+		value.ServerTimestamp = time.Time{}
+	case opcuaTimestampsServer:
+		value.SourceTimestamp = time.Time{}
+	case opcuaTimestampsNeither:
+		value.SourceTimestamp, value.ServerTimestamp = time.Time{}, time.Time{}
+	}
+	value.SourcePicos, value.ServerPicos = 0, 0
+	return value
+}
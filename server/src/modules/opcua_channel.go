@@ -0,0 +1,1035 @@
+// server/src/modules/opcua_channel.go
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Security policy URIs
+const (
+	opcuaPolicyNone           = "http://opcfoundation.org/UA/SecurityPolicy#None"
+	opcuaPolicyBasic256Sha256 = "http://opcfoundation.org/UA/SecurityPolicy#Basic256Sha256"
+)
+
+// Algorithm URIs of Basic256Sha256, used in session signatures and encrypted passwords
+const (
+	opcuaAlgorithmRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	opcuaAlgorithmRSAOAEP   = "http://www.w3.org/2001/04/xmlenc#rsa-oaep"
+)
+
+const opcuaTransportProfile = "http://opcfoundation.org/UA-Profile/Transport/uatcp-uasc-uabinary"
+
+// Transport limits. The buffer size bounds a single chunk in either direction; messages are split
+// into chunks and reassembled up to the message size.
+const (
+	opcuaBufferSize       = 65536
+	opcuaMinBufferSize    = 8192
+	opcuaMaxMessageSize   = 16 << 20
+	opcuaMaxChunkCount    = 1024
+	opcuaTokenLifetime    = time.Hour
+	opcuaWriteTimeout     = 30 * time.Second
+	opcuaDefaultPort      = "4840"
+	opcuaNonceLength      = 32
+	opcuaHMACSize         = sha256.Size
+	opcuaAESBlockSize     = aes.BlockSize
+	opcuaOAEPOverhead     = 2*sha1.Size + 2
+	opcuaSequenceWrapFrom = 4294966271
+)
+
+var errOPCUAChannelClosed = errors.New("OPC UA secure channel closed")
+
+// opcuaSecurityPolicyURI returns the URI of a security policy named in configuration.
+func opcuaSecurityPolicyURI(name string) (string, error) {
+	switch name {
+	case "", "None":
+		return opcuaPolicyNone, nil
+	case "Basic256Sha256":
+		return opcuaPolicyBasic256Sha256, nil
+	}
+	return "", fmt.Errorf("unsupported OPC UA security policy %q (supported: None, Basic256Sha256)", name)
+}
+
+// opcuaSecurityMode returns the message security mode named in configuration.
+func opcuaSecurityMode(name string, policyURI string) (int32, error) {
+	mode := int32(0)
+	switch name {
+	case "":
+		mode = opcuaSecurityModeSignAndEncrypt
+		if policyURI == opcuaPolicyNone {
+			mode = opcuaSecurityModeNone
+		}
+	case "None":
+		mode = opcuaSecurityModeNone
+	case "Sign":
+		mode = opcuaSecurityModeSign
+	case "SignAndEncrypt":
+		mode = opcuaSecurityModeSignAndEncrypt
+	default:
+		return 0, fmt.Errorf("unsupported OPC UA security mode %q (supported: None, Sign, SignAndEncrypt)", name)
+	}
+	if (mode == opcuaSecurityModeNone) != (policyURI == opcuaPolicyNone) {
+		return 0, fmt.Errorf("OPC UA security mode %q does not fit security policy %s", name, policyURI)
+	}
+	return mode, nil
+}
+
+// opcuaKeys are the keys one side of a secure channel signs and encrypts with.
+type opcuaKeys struct {
+	signing    []byte
+	encrypting []byte
+	iv         []byte
+}
+
+// deriveOPCUAKeys derives a key set with P_SHA256, as Basic256Sha256 specifies: 32 bytes of signing
+// key, 32 of encryption key and a 16-byte initialization vector.
+func deriveOPCUAKeys(secret, seed []byte) opcuaKeys {
+	output := make([]byte, 0, 96)
+	a := seed
+	for len(output) < 80 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		output = mac.Sum(output)
+	}
+	return opcuaKeys{signing: output[0:32], encrypting: output[32:64], iv: output[64:80]}
+}
+
+// opcuaToken holds the keys of one security token: local ones to send with and remote ones to check
+// what the peer sends.
+type opcuaToken struct {
+	local   opcuaKeys
+	remote  opcuaKeys
+	expires time.Time
+	pending bool // Renewed by a server but not yet used by the client; sending stays on the old token until then
+}
+
+// opcuaRawMessage is a reassembled message of the secure conversation.
+type opcuaRawMessage struct {
+	messageType string // "OPN", "MSG" or "CLO"
+	requestID   uint32
+	body        []byte
+	aborted     error // Set when the sender aborted the message; body is then empty
+}
+
+// opcuaConn is the secure conversation over one TCP connection, shared by clients and servers. It
+// splits messages into chunks and applies the security of the channel to each: asymmetric RSA for
+// OPN messages, symmetric keys derived from the exchanged nonces for everything else.
+type opcuaConn struct {
+	conn          net.Conn
+	policyURI     string // Empty on a server until the first OPN request names it
+	mode          int32
+	localCert     []byte // DER
+	localKey      *rsa.PrivateKey
+	remoteCert    *x509.Certificate
+	remoteCertDER []byte
+
+	sendBufferSize uint32 // Largest chunk the peer accepts
+	maxSendMessage uint32 // Largest message the peer accepts; 0 for no limit
+	maxSendChunks  uint32 // Most chunks the peer accepts in a message; 0 for no limit
+
+	mutex        sync.Mutex // Guards the fields below and serializes writes
+	channelID    uint32
+	tokenID      uint32 // Token used for sending
+	tokens       map[uint32]*opcuaToken
+	sendSequence uint32
+
+	// Used only by the single reader
+	receiveSequence uint32
+	received        bool
+	partial         map[uint32][][]byte
+	partialSize     int
+}
+
+func newOPCUAConn(conn net.Conn, localCert []byte, localKey *rsa.PrivateKey) *opcuaConn {
+	return &opcuaConn{
+		conn:           conn,
+		localCert:      localCert,
+		localKey:       localKey,
+		sendBufferSize: opcuaBufferSize,
+		tokens:         make(map[uint32]*opcuaToken),
+		partial:        make(map[uint32][][]byte),
+	}
+}
+
+// secure reports whether the channel signs its messages.
+func (c *opcuaConn) secure() bool {
+	return c.policyURI == opcuaPolicyBasic256Sha256
+}
+
+// setRemoteCertificate sets the certificate of the peer, whose key checks and decrypts what it sends.
+// Only the first certificate of a chain is used.
+func (c *opcuaConn) setRemoteCertificate(der []byte) error {
+	certs, err := x509.ParseCertificates(der)
+	if err != nil || len(certs) == 0 {
+		return fmt.Errorf("%w: unreadable certificate", opcuaBadCertificateInvalid)
+	}
+	if _, isRSA := certs[0].PublicKey.(*rsa.PublicKey); !isRSA {
+		return fmt.Errorf("%w: certificate key is not RSA", opcuaBadCertificateInvalid)
+	}
+	c.remoteCert, c.remoteCertDER = certs[0], certs[0].Raw
+	return nil
+}
+
+func (c *opcuaConn) remoteKey() *rsa.PublicKey {
+	return c.remoteCert.PublicKey.(*rsa.PublicKey)
+}
+
+// addToken installs the keys of a new security token, derived from both nonces, and forgets tokens
+// that have expired. A client sends with the new token at once; a server renewing a token keeps
+// sending with the old one until the client has used the new one, as the client may not have it yet.
+func (c *opcuaConn) addToken(tokenID uint32, lifetime time.Duration, localNonce, remoteNonce []byte, use bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	for id, token := range c.tokens {
+		if now.After(token.expires) {
+			delete(c.tokens, id)
+		}
+	}
+	token := &opcuaToken{expires: now.Add(lifetime + lifetime/4)}
+	if c.secure() {
+		token.local = deriveOPCUAKeys(remoteNonce, localNonce)
+		token.remote = deriveOPCUAKeys(localNonce, remoteNonce)
+	}
+	c.tokens[tokenID] = token
+	if use {
+		c.tokenID = tokenID
+	} else {
+		token.pending = true
+	}
+}
+
+// writeFrame writes a transport message that is not part of the secure conversation: HEL, ACK or ERR.
+func (c *opcuaConn) writeFrame(messageType string, body []byte) error {
+	frame := make([]byte, 8, 8+len(body))
+	copy(frame, messageType)
+	frame[3] = 'F'
+	binary.LittleEndian.PutUint32(frame[4:], uint32(8+len(body)))
+	frame = append(frame, body...)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(opcuaWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readFrame reads one transport message and returns its type, chunk type and the bytes after the
+// 8-byte header.
+func (c *opcuaConn) readFrame() (string, byte, []byte, []byte, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return "", 0, nil, nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[4:])
+	if size < 8 || size > opcuaBufferSize {
+		return "", 0, nil, nil, fmt.Errorf("%w: chunk of %d bytes", opcuaBadTCPMessageTooLarge, size)
+	}
+	rest := make([]byte, size-8)
+	if _, err := io.ReadFull(c.conn, rest); err != nil {
+		return "", 0, nil, nil, err
+	}
+	return string(header[:3]), header[3], header, rest, nil
+}
+
+// writeError sends an ERR message; the connection should be closed afterwards.
+func (c *opcuaConn) writeError(status opcuaStatusCode, reason string) error {
+	e := newOPCUAEncoder()
+	e.statusCode(&status)
+	e.string(&reason)
+	return c.writeFrame("ERR", e.buf)
+}
+
+// opcuaTransportError decodes the body of an ERR message.
+func opcuaTransportError(body []byte) error {
+	d := newOPCUADecoder(body)
+	var status opcuaStatusCode
+	var reason string
+	d.statusCode(&status)
+	d.string(&reason)
+	if d.err != nil {
+		return d.err
+	}
+	if reason != "" {
+		return fmt.Errorf("%w: %s", status, reason)
+	}
+	return status
+}
+
+// opcuaHello holds the fields of the HEL and ACK messages that open a connection.
+type opcuaHello struct {
+	ProtocolVersion   uint32
+	ReceiveBufferSize uint32
+	SendBufferSize    uint32
+	MaxMessageSize    uint32
+	MaxChunkCount     uint32
+	EndpointURL       string // HEL only
+}
+
+func (h *opcuaHello) code(c *opcuaCodec, withURL bool) {
+	c.uint32(&h.ProtocolVersion)
+	c.uint32(&h.ReceiveBufferSize)
+	c.uint32(&h.SendBufferSize)
+	c.uint32(&h.MaxMessageSize)
+	c.uint32(&h.MaxChunkCount)
+	if withURL {
+		c.string(&h.EndpointURL)
+	}
+}
+
+// localHello returns the limits this side announces.
+func localOPCUAHello(endpointURL string) opcuaHello {
+	return opcuaHello{
+		ReceiveBufferSize: opcuaBufferSize,
+		SendBufferSize:    opcuaBufferSize,
+		MaxMessageSize:    opcuaMaxMessageSize,
+		MaxChunkCount:     opcuaMaxChunkCount,
+		EndpointURL:       endpointURL,
+	}
+}
+
+// applyHello adopts the limits the peer announced.
+func (c *opcuaConn) applyHello(peer opcuaHello) error {
+	if peer.ReceiveBufferSize < opcuaMinBufferSize {
+		return fmt.Errorf("%w: peer receive buffer of %d bytes", opcuaBadTCPInternalError, peer.ReceiveBufferSize)
+	}
+	if peer.ReceiveBufferSize < c.sendBufferSize {
+		c.sendBufferSize = peer.ReceiveBufferSize
+	}
+	c.maxSendMessage, c.maxSendChunks = peer.MaxMessageSize, peer.MaxChunkCount
+	return nil
+}
+
+// hello sends HEL and waits for the server's ACK.
+func (c *opcuaConn) hello(endpointURL string) error {
+	hello := localOPCUAHello(endpointURL)
+	e := newOPCUAEncoder()
+	hello.code(e, true)
+	if err := c.writeFrame("HEL", e.buf); err != nil {
+		return err
+	}
+	messageType, _, _, body, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	switch messageType {
+	case "ACK":
+	case "ERR":
+		return opcuaTransportError(body)
+	default:
+		return fmt.Errorf("%w: %s in answer to HEL", opcuaBadTCPMessageTypeInvalid, messageType)
+	}
+	var ack opcuaHello
+	d := newOPCUADecoder(body)
+	ack.code(d, false)
+	if d.err != nil {
+		return d.err
+	}
+	return c.applyHello(ack)
+}
+
+// writeMessage sends a message of the secure conversation, split into as many chunks as it needs.
+// OPN messages must fit in one chunk.
+func (c *opcuaConn) writeMessage(messageType string, requestID uint32, body []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.maxSendMessage != 0 && uint32(len(body)) > c.maxSendMessage {
+		return fmt.Errorf("%w: %d bytes", opcuaBadRequestTooLarge, len(body))
+	}
+	if messageType == "OPN" {
+		chunk, err := c.encodeAsymmetricChunk(requestID, body)
+		if err != nil {
+			return err
+		}
+		return c.writeChunk(chunk)
+	}
+
+	// Room for the body in a chunk: header, token ID and sequence header first, then padding and
+	// signature after it, all within whole cipher blocks when encrypting
+	maxBody := int(c.sendBufferSize) - 24
+	switch c.mode {
+	case opcuaSecurityModeSign:
+		maxBody -= opcuaHMACSize
+	case opcuaSecurityModeSignAndEncrypt:
+		maxBody = (int(c.sendBufferSize)-16)/opcuaAESBlockSize*opcuaAESBlockSize - 8 - opcuaHMACSize - 1
+	}
+	chunks := (len(body) + maxBody - 1) / maxBody
+	if chunks == 0 {
+		chunks = 1
+	}
+	if c.maxSendChunks != 0 && uint32(chunks) > c.maxSendChunks {
+		return fmt.Errorf("%w: %d chunks", opcuaBadRequestTooLarge, chunks)
+	}
+	for i := 0; i < chunks; i++ {
+		part := body[i*maxBody:]
+		chunkType := byte('F')
+		if len(part) > maxBody {
+			part, chunkType = part[:maxBody], 'C'
+		}
+		chunk, err := c.encodeSymmetricChunk(messageType, chunkType, requestID, part)
+		if err != nil {
+			return err
+		}
+		if err := c.writeChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *opcuaConn) writeChunk(chunk []byte) error {
+	c.conn.SetWriteDeadline(time.Now().Add(opcuaWriteTimeout))
+	_, err := c.conn.Write(chunk)
+	return err
+}
+
+// nextSequenceHeader returns the sequence header of the next chunk sent; the caller holds the mutex.
+func (c *opcuaConn) nextSequenceHeader(requestID uint32) []byte {
+	c.sendSequence++
+	if c.sendSequence > opcuaSequenceWrapFrom {
+		c.sendSequence = 1
+	}
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header, c.sendSequence)
+	binary.LittleEndian.PutUint32(header[4:], requestID)
+	return header
+}
+
+// opcuaPad appends the padding that makes plaintext and signature a whole number of cipher blocks.
+// Every padding byte holds the padding size; keys over 2048 bits add its high byte at the end.
+func opcuaPad(plain []byte, blockSize, signatureSize int, extra bool) []byte {
+	overhead := 1
+	if extra {
+		overhead = 2
+	}
+	size := blockSize - (len(plain)+overhead+signatureSize)%blockSize
+	if size == blockSize {
+		size = 0
+	}
+	for i := 0; i <= size; i++ {
+		plain = append(plain, byte(size))
+	}
+	if extra {
+		plain = append(plain, byte(size>>8))
+	}
+	return plain
+}
+
+// opcuaUnpad returns the body of decrypted plaintext that starts with the sequence header and ends
+// with padding followed by a signature of signatureSize bytes.
+func opcuaUnpad(plain []byte, signatureSize int, extra bool) ([]byte, error) {
+	end := len(plain) - signatureSize
+	if end < 9 {
+		return nil, fmt.Errorf("%w: chunk too short", opcuaBadSecurityChecksFailed)
+	}
+	size, overhead := int(plain[end-1]), 1
+	if extra {
+		size, overhead = size<<8|int(plain[end-2]), 2
+	}
+	bodyEnd := end - overhead - size
+	if bodyEnd < 8 {
+		return nil, fmt.Errorf("%w: invalid padding", opcuaBadSecurityChecksFailed)
+	}
+	for _, b := range plain[bodyEnd : end-overhead] {
+		if b != byte(size) {
+			return nil, fmt.Errorf("%w: invalid padding", opcuaBadSecurityChecksFailed)
+		}
+	}
+	return plain[:bodyEnd], nil
+}
+
+// encodeAsymmetricChunk encodes an OPN message in one chunk. With a secure policy the chunk is signed
+// with the local key and encrypted for the peer's, whatever the message security mode.
+func (c *opcuaConn) encodeAsymmetricChunk(requestID uint32, body []byte) ([]byte, error) {
+	secure := c.secure()
+	security := newOPCUAEncoder()
+	policy := c.policyURI
+	security.string(&policy)
+	var sender, thumbprint []byte
+	if secure {
+		if c.localKey == nil || c.remoteCert == nil {
+			return nil, fmt.Errorf("%w: no certificate to secure the channel with", opcuaBadSecurityChecksFailed)
+		}
+		digest := sha1.Sum(c.remoteCertDER)
+		sender, thumbprint = c.localCert, digest[:]
+	}
+	security.byteString(&sender)
+	security.byteString(&thumbprint)
+
+	plain := append(c.nextSequenceHeader(requestID), body...)
+	size := 12 + len(security.buf) + len(plain)
+	var plainBlock, cipherBlock, signatureSize int
+	if secure {
+		cipherBlock = c.remoteKey().Size()
+		plainBlock = cipherBlock - opcuaOAEPOverhead
+		signatureSize = c.localKey.Size()
+		plain = opcuaPad(plain, plainBlock, signatureSize, cipherBlock > 256)
+		size = 12 + len(security.buf) + (len(plain)+signatureSize)/plainBlock*cipherBlock
+	}
+	if size > int(c.sendBufferSize) {
+		return nil, fmt.Errorf("%w: OPN chunk of %d bytes", opcuaBadRequestTooLarge, size)
+	}
+
+	chunk := make([]byte, 12, size)
+	copy(chunk, "OPNF")
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(size))
+	binary.LittleEndian.PutUint32(chunk[8:], c.channelID)
+	chunk = append(chunk, security.buf...)
+	if !secure {
+		return append(chunk, plain...), nil
+	}
+
+	digest := sha256.Sum256(append(append([]byte(nil), chunk...), plain...))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.localKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	plain = append(plain, signature...)
+	for len(plain) > 0 {
+		block, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, c.remoteKey(), plain[:plainBlock], nil)
+		if err != nil {
+			return nil, err
+		}
+		chunk = append(chunk, block...)
+		plain = plain[plainBlock:]
+	}
+	return chunk, nil
+}
+
+// encodeSymmetricChunk encodes a chunk of an MSG or CLO message with the keys of the current token.
+func (c *opcuaConn) encodeSymmetricChunk(messageType string, chunkType byte, requestID uint32, body []byte) ([]byte, error) {
+	plain := append(c.nextSequenceHeader(requestID), body...)
+	token := c.tokens[c.tokenID]
+	if c.mode != opcuaSecurityModeNone && token == nil {
+		return nil, fmt.Errorf("%w: no security token", opcuaBadSecureChannelTokenUnknown)
+	}
+	if c.mode == opcuaSecurityModeSignAndEncrypt {
+		plain = opcuaPad(plain, opcuaAESBlockSize, opcuaHMACSize, false)
+	}
+	size := 16 + len(plain)
+	if c.mode != opcuaSecurityModeNone {
+		size += opcuaHMACSize
+	}
+
+	chunk := make([]byte, 16, size)
+	copy(chunk, messageType)
+	chunk[3] = chunkType
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(size))
+	binary.LittleEndian.PutUint32(chunk[8:], c.channelID)
+	binary.LittleEndian.PutUint32(chunk[12:], c.tokenID)
+	if c.mode == opcuaSecurityModeNone {
+		return append(chunk, plain...), nil
+	}
+
+	mac := hmac.New(sha256.New, token.local.signing)
+	mac.Write(chunk)
+	mac.Write(plain)
+	plain = mac.Sum(plain)
+	if c.mode == opcuaSecurityModeSignAndEncrypt {
+		block, err := aes.NewCipher(token.local.encrypting)
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, token.local.iv).CryptBlocks(plain, plain)
+	}
+	return append(chunk, plain...), nil
+}
+
+// readMessage reads chunks until a message is complete and returns it. Failures of the transport or
+// of security checks are returned as errors, after which the connection must be closed.
+func (c *opcuaConn) readMessage() (opcuaRawMessage, error) {
+	for {
+		messageType, chunkType, header, rest, err := c.readFrame()
+		if err != nil {
+			return opcuaRawMessage{}, err
+		}
+		var requestID uint32
+		var body []byte
+		switch messageType {
+		case "ERR":
+			return opcuaRawMessage{}, opcuaTransportError(rest)
+		case "OPN":
+			requestID, body, err = c.decodeAsymmetricChunk(header, rest)
+		case "MSG", "CLO":
+			requestID, body, err = c.decodeSymmetricChunk(header, rest)
+		default:
+			err = fmt.Errorf("%w: %q", opcuaBadTCPMessageTypeInvalid, messageType)
+		}
+		if err != nil {
+			return opcuaRawMessage{}, err
+		}
+
+		switch chunkType {
+		case 'C':
+			c.partial[requestID] = append(c.partial[requestID], body)
+			c.partialSize += len(body)
+			if c.partialSize > opcuaMaxMessageSize || len(c.partial[requestID]) >= opcuaMaxChunkCount {
+				return opcuaRawMessage{}, fmt.Errorf("%w: message too large", opcuaBadTCPMessageTooLarge)
+			}
+		case 'A':
+			c.dropPartial(requestID)
+			aborted := opcuaTransportError(body)
+			return opcuaRawMessage{messageType: messageType, requestID: requestID, aborted: aborted}, nil
+		case 'F':
+			if parts := c.partial[requestID]; parts != nil {
+				c.dropPartial(requestID)
+				body = bytes.Join(append(parts, body), nil)
+			}
+			return opcuaRawMessage{messageType: messageType, requestID: requestID, body: body}, nil
+		default:
+			return opcuaRawMessage{}, fmt.Errorf("%w: chunk type %q", opcuaBadTCPMessageTypeInvalid, chunkType)
+		}
+	}
+}
+
+func (c *opcuaConn) dropPartial(requestID uint32) {
+	for _, part := range c.partial[requestID] {
+		c.partialSize -= len(part)
+	}
+	delete(c.partial, requestID)
+}
+
+// checkSequence checks the sequence header at the start of plaintext and returns the request ID.
+func (c *opcuaConn) checkSequence(plain []byte) (uint32, error) {
+	if len(plain) < 8 {
+		return 0, fmt.Errorf("%w: chunk too short", opcuaBadTCPMessageTypeInvalid)
+	}
+	sequence := binary.LittleEndian.Uint32(plain)
+	if c.received && sequence != c.receiveSequence+1 && !(c.receiveSequence > opcuaSequenceWrapFrom && sequence < 1024) {
+		return 0, fmt.Errorf("%w: %d after %d", opcuaBadSequenceNumberInvalid, sequence, c.receiveSequence)
+	}
+	c.receiveSequence, c.received = sequence, true
+	return binary.LittleEndian.Uint32(plain[4:]), nil
+}
+
+// checkChannelID checks the channel ID of a received chunk. A client learns it from the first OPN
+// response and a server assigns it, so 0 is accepted until then.
+func (c *opcuaConn) checkChannelID(id uint32) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.channelID != 0 && id != c.channelID {
+		return fmt.Errorf("%w: %d", opcuaBadTCPSecureChannelUnknown, id)
+	}
+	return nil
+}
+
+// decodeAsymmetricChunk checks and decrypts an OPN chunk. A server takes the security policy and the
+// client certificate from its first one.
+func (c *opcuaConn) decodeAsymmetricChunk(header, rest []byte) (uint32, []byte, error) {
+	d := newOPCUADecoder(rest)
+	var channelID uint32
+	var policy string
+	var sender, thumbprint []byte
+	d.uint32(&channelID)
+	d.string(&policy)
+	d.byteString(&sender)
+	d.byteString(&thumbprint)
+	if d.err != nil {
+		return 0, nil, d.err
+	}
+	if err := c.checkChannelID(channelID); err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case c.policyURI == "" && (policy == opcuaPolicyNone || policy == opcuaPolicyBasic256Sha256):
+		c.policyURI = policy
+	case policy != c.policyURI:
+		return 0, nil, fmt.Errorf("%w: %s", opcuaBadSecurityPolicyRejected, policy)
+	}
+	encrypted := d.data
+	signed := append(append([]byte(nil), header...), rest[:len(rest)-len(encrypted)]...)
+	if !c.secure() {
+		requestID, err := c.checkSequence(encrypted)
+		if err != nil {
+			return 0, nil, err
+		}
+		return requestID, encrypted[8:], nil
+	}
+
+	if c.localKey == nil {
+		return 0, nil, fmt.Errorf("%w: no certificate to secure the channel with", opcuaBadSecurityPolicyRejected)
+	}
+	if c.remoteCert == nil {
+		if err := c.setRemoteCertificate(sender); err != nil {
+			return 0, nil, err
+		}
+	} else if certs, err := x509.ParseCertificates(sender); err != nil || len(certs) == 0 || !bytes.Equal(certs[0].Raw, c.remoteCertDER) {
+		return 0, nil, fmt.Errorf("%w: sender certificate changed", opcuaBadCertificateInvalid)
+	}
+	if digest := sha1.Sum(c.localCert); !bytes.Equal(thumbprint, digest[:]) {
+		return 0, nil, fmt.Errorf("%w: encrypted for another certificate", opcuaBadCertificateInvalid)
+	}
+
+	cipherBlock := c.localKey.Size()
+	if len(encrypted) == 0 || len(encrypted)%cipherBlock != 0 {
+		return 0, nil, fmt.Errorf("%w: ciphertext of %d bytes", opcuaBadSecurityChecksFailed, len(encrypted))
+	}
+	var plain []byte
+	for i := 0; i < len(encrypted); i += cipherBlock {
+		block, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, c.localKey, encrypted[i:i+cipherBlock], nil)
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: decryption failed", opcuaBadSecurityChecksFailed)
+		}
+		plain = append(plain, block...)
+	}
+	signatureSize := c.remoteKey().Size()
+	if len(plain) < signatureSize {
+		return 0, nil, fmt.Errorf("%w: chunk too short", opcuaBadSecurityChecksFailed)
+	}
+	signedPlain := plain[:len(plain)-signatureSize]
+	digest := sha256.Sum256(append(signed, signedPlain...))
+	if rsa.VerifyPKCS1v15(c.remoteKey(), crypto.SHA256, digest[:], plain[len(signedPlain):]) != nil {
+		return 0, nil, fmt.Errorf("%w: invalid signature", opcuaBadSecurityChecksFailed)
+	}
+	plain, err := opcuaUnpad(plain, signatureSize, cipherBlock > 256)
+	if err != nil {
+		return 0, nil, err
+	}
+	requestID, err := c.checkSequence(plain)
+	if err != nil {
+		return 0, nil, err
+	}
+	return requestID, plain[8:], nil
+}
+
+// decodeSymmetricChunk checks and decrypts an MSG or CLO chunk with the keys of the token it names.
+func (c *opcuaConn) decodeSymmetricChunk(header, rest []byte) (uint32, []byte, error) {
+	if len(rest) < 8 {
+		return 0, nil, fmt.Errorf("%w: chunk too short", opcuaBadTCPMessageTypeInvalid)
+	}
+	if err := c.checkChannelID(binary.LittleEndian.Uint32(rest)); err != nil {
+		return 0, nil, err
+	}
+	tokenID := binary.LittleEndian.Uint32(rest[4:])
+	c.mutex.Lock()
+	token := c.tokens[tokenID]
+	if token != nil && token.pending {
+		token.pending = false
+		c.tokenID = tokenID
+	}
+	c.mutex.Unlock()
+	if token == nil || time.Now().After(token.expires) {
+		return 0, nil, fmt.Errorf("%w: %d", opcuaBadSecureChannelTokenUnknown, tokenID)
+	}
+
+	plain := append([]byte(nil), rest[8:]...)
+	if c.mode == opcuaSecurityModeNone {
+		requestID, err := c.checkSequence(plain)
+		if err != nil {
+			return 0, nil, err
+		}
+		return requestID, plain[8:], nil
+	}
+	if c.mode == opcuaSecurityModeSignAndEncrypt {
+		if len(plain) == 0 || len(plain)%opcuaAESBlockSize != 0 {
+			return 0, nil, fmt.Errorf("%w: ciphertext of %d bytes", opcuaBadSecurityChecksFailed, len(plain))
+		}
+		block, err := aes.NewCipher(token.remote.encrypting)
+		if err != nil {
+			return 0, nil, err
+		}
+		cipher.NewCBCDecrypter(block, token.remote.iv).CryptBlocks(plain, plain)
+	}
+	if len(plain) < opcuaHMACSize+8 {
+		return 0, nil, fmt.Errorf("%w: chunk too short", opcuaBadSecurityChecksFailed)
+	}
+	signed := plain[:len(plain)-opcuaHMACSize]
+	mac := hmac.New(sha256.New, token.remote.signing)
+	mac.Write(header)
+	mac.Write(rest[:8])
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), plain[len(signed):]) {
+		return 0, nil, fmt.Errorf("%w: invalid signature", opcuaBadSecurityChecksFailed)
+	}
+	if c.mode == opcuaSecurityModeSignAndEncrypt {
+		var err error
+		if plain, err = opcuaUnpad(plain, opcuaHMACSize, false); err != nil {
+			return 0, nil, err
+		}
+	} else {
+		plain = signed
+	}
+	requestID, err := c.checkSequence(plain)
+	if err != nil {
+		return 0, nil, err
+	}
+	return requestID, plain[8:], nil
+}
+
+// opcuaEndpointAddress returns the TCP address of an opc.tcp:// endpoint URL.
+func opcuaEndpointAddress(endpointURL string) (string, error) {
+	parsed, err := url.Parse(endpointURL)
+	if err != nil || parsed.Scheme != "opc.tcp" || parsed.Hostname() == "" {
+		return "", fmt.Errorf("%w: %q", opcuaBadTCPEndpointURLInvalid, endpointURL)
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = opcuaDefaultPort
+	}
+	return net.JoinHostPort(parsed.Hostname(), port), nil
+}
+
+// opcuaClientChannel is the client side of a secure channel. Requests may be issued concurrently; a
+// single reader matches responses to them by request ID. The security token is renewed in the
+// background before it expires.
+type opcuaClientChannel struct {
+	conn    *opcuaConn
+	timeout time.Duration
+	logger  *log.Logger
+
+	mutex         sync.Mutex
+	pending       map[uint32]chan opcuaRawMessage
+	requestID     uint32
+	requestHandle uint32
+	renewal       *time.Timer
+	done          chan struct{}
+	err           error
+}
+
+// dialOPCUAChannel connects to an endpoint and opens a secure channel with the given policy and
+// mode. serverCert is required for secure policies; localCert and localKey identify this side.
+func dialOPCUAChannel(ctx context.Context, endpointURL, policyURI string, mode int32, localCert []byte, localKey *rsa.PrivateKey, serverCert []byte, timeout time.Duration, logger *log.Logger) (*opcuaClientChannel, error) {
+	address, err := opcuaEndpointAddress(endpointURL)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn := newOPCUAConn(netConn, localCert, localKey)
+	conn.policyURI, conn.mode = policyURI, mode
+	if conn.secure() {
+		if localKey == nil {
+			netConn.Close()
+			return nil, fmt.Errorf("%w: %s needs a client certificate", opcuaBadSecurityPolicyRejected, policyURI)
+		}
+		if err := conn.setRemoteCertificate(serverCert); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+
+	netConn.SetReadDeadline(time.Now().Add(timeout))
+	if err := conn.hello(endpointURL); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	netConn.SetReadDeadline(time.Time{})
+
+	channel := &opcuaClientChannel{
+		conn:    conn,
+		timeout: timeout,
+		logger:  logger,
+		pending: make(map[uint32]chan opcuaRawMessage),
+		done:    make(chan struct{}),
+	}
+	go channel.readLoop()
+	if err := channel.open(ctx, false); err != nil {
+		channel.fail(err)
+		return nil, err
+	}
+	return channel, nil
+}
+
+// open issues or renews the security token and schedules the next renewal at three quarters of its
+// lifetime.
+func (ch *opcuaClientChannel) open(ctx context.Context, renew bool) error {
+	var nonce []byte
+	if ch.conn.secure() {
+		nonce = make([]byte, opcuaNonceLength)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+	}
+	request := &opcuaOpenSecureChannelRequest{
+		SecurityMode:      ch.conn.mode,
+		ClientNonce:       nonce,
+		RequestedLifetime: uint32(opcuaTokenLifetime / time.Millisecond),
+	}
+	if renew {
+		request.RequestType = 1
+	}
+	response, err := ch.roundTrip(ctx, "OPN", request)
+	if err != nil {
+		return err
+	}
+	opened, ok := response.(*opcuaOpenSecureChannelResponse)
+	if !ok {
+		return fmt.Errorf("%w: %T in answer to OpenSecureChannel", opcuaBadUnexpectedError, response)
+	}
+	if ch.conn.secure() && len(opened.ServerNonce) != opcuaNonceLength {
+		return fmt.Errorf("%w: server nonce of %d bytes", opcuaBadNonceInvalid, len(opened.ServerNonce))
+	}
+	lifetime := time.Duration(opened.SecurityToken.RevisedLifetime) * time.Millisecond
+	if lifetime <= 0 {
+		lifetime = opcuaTokenLifetime
+	}
+	ch.conn.mutex.Lock()
+	ch.conn.channelID = opened.SecurityToken.ChannelID
+	ch.conn.mutex.Unlock()
+	ch.conn.addToken(opened.SecurityToken.TokenID, lifetime, nonce, opened.ServerNonce, true)
+
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.err == nil {
+		ch.renewal = time.AfterFunc(lifetime*3/4, ch.renew)
+	}
+	return nil
+}
+
+// renew renews the security token; a channel that cannot be renewed is closed.
+func (ch *opcuaClientChannel) renew() {
+	ctx, cancel := context.WithTimeout(context.Background(), ch.timeout)
+	defer cancel()
+	if err := ch.open(ctx, true); err != nil {
+		ch.logger.Printf("OPC UA: renewing the secure channel failed: %v\n", err)
+		ch.fail(err)
+	}
+}
+
+// request sends a service request and returns its response. A ServiceFault, or a response whose
+// header carries a bad service result, is returned as an error.
+func (ch *opcuaClientChannel) request(ctx context.Context, request opcuaRequest) (opcuaResponse, error) {
+	return ch.roundTrip(ctx, "MSG", request)
+}
+
+func (ch *opcuaClientChannel) roundTrip(ctx context.Context, messageType string, request opcuaRequest) (opcuaResponse, error) {
+	ch.mutex.Lock()
+	if ch.err != nil {
+		err := ch.err
+		ch.mutex.Unlock()
+		return nil, err
+	}
+	ch.requestID++
+	ch.requestHandle++
+	requestID := ch.requestID
+	header := request.requestHeader()
+	header.Timestamp = time.Now()
+	header.RequestHandle = ch.requestHandle
+	header.TimeoutHint = uint32(ch.timeout / time.Millisecond)
+	if deadline, ok := ctx.Deadline(); ok {
+		header.TimeoutHint = uint32(time.Until(deadline) / time.Millisecond)
+	}
+	reply := make(chan opcuaRawMessage, 1)
+	ch.pending[requestID] = reply
+	ch.mutex.Unlock()
+	defer func() {
+		ch.mutex.Lock()
+		delete(ch.pending, requestID)
+		ch.mutex.Unlock()
+	}()
+
+	body, err := encodeOPCUAMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.conn.writeMessage(messageType, requestID, body); err != nil {
+		ch.fail(err)
+		return nil, err
+	}
+
+	var raw opcuaRawMessage
+	select {
+	case raw = <-reply:
+	case <-ch.done:
+		return nil, ch.closedErr()
+	case <-ctx.Done():
+		return nil, opcuaBadTimeout
+	}
+	if raw.aborted != nil {
+		return nil, raw.aborted
+	}
+	message, err := decodeOPCUAMessage(raw.body)
+	if err != nil {
+		return nil, err
+	}
+	response, ok := message.(opcuaResponse)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not a response", opcuaBadUnexpectedError, message)
+	}
+	if result := response.responseHeader().ServiceResult; result.isBad() {
+		return response, result
+	}
+	return response, nil
+}
+
+// readLoop delivers responses to the requests waiting for them until the connection fails.
+func (ch *opcuaClientChannel) readLoop() {
+	for {
+		message, err := ch.conn.readMessage()
+		if err != nil {
+			ch.fail(err)
+			return
+		}
+		ch.mutex.Lock()
+		reply := ch.pending[message.requestID]
+		ch.mutex.Unlock()
+		// Responses to requests that timed out are dropped
+		if reply != nil {
+			reply <- message
+		}
+	}
+}
+
+// fail closes the channel with an error that every pending and later request returns.
+func (ch *opcuaClientChannel) fail(err error) {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	if ch.err != nil {
+		return
+	}
+	ch.err = err
+	if ch.renewal != nil {
+		ch.renewal.Stop()
+	}
+	close(ch.done)
+	ch.conn.conn.Close()
+}
+
+func (ch *opcuaClientChannel) closedErr() error {
+	ch.mutex.Lock()
+	defer ch.mutex.Unlock()
+	return ch.err
+}
+
+// close sends CloseSecureChannel, which has no response, and closes the connection.
+func (ch *opcuaClientChannel) close() {
+	ch.mutex.Lock()
+	open := ch.err == nil
+	ch.requestID++
+	requestID := ch.requestID
+	ch.mutex.Unlock()
+	if open {
+		request := &opcuaCloseSecureChannelRequest{}
+		request.Header.Timestamp = time.Now()
+		if body, err := encodeOPCUAMessage(request); err == nil {
+			ch.conn.writeMessage("CLO", requestID, body)
+		}
+	}
+	ch.fail(errOPCUAChannelClosed)
+}
@@ -0,0 +1,1047 @@
+// server/src/modules/opcua_client.go
+
+package modules
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+// OPCUANodeConfig maps a variable of an OPC UA server to an analytics series.
+type OPCUANodeConfig struct {
+	NodeID   string  `json:"node_id"`  // Node ID in standard notation, e.g. "ns=2;s=Line3.Temperature"
+	Name     string  `json:"name"`     // Series suffix; the series is "<server>.<name>"
+	Deadband float64 `json:"deadband"` // Absolute change below which the server does not report; 0 reports every change
+}
+
+// OPCUABrowseConfig discovers the variables below a node of an OPC UA server and maps each to a series
+// named after its browse path.
+type OPCUABrowseConfig struct {
+	Root     string  `json:"root"`      // Node to browse from, default the Objects folder "i=85"
+	Prefix   string  `json:"prefix"`    // Prepended to browse paths to name series; none by default
+	MaxDepth int     `json:"max_depth"` // Levels of objects to descend, default 3
+	Deadband float64 `json:"deadband"`  // Absolute deadband of the variables found
+}
+
+// OPCUAServerConfig describes an OPC UA server and the variables collected from it.
+type OPCUAServerConfig struct {
+	Name               string              `json:"name"`                // Series prefix
+	EndpointURL        string              `json:"endpoint_url"`        // opc.tcp://host:port/path
+	SecurityPolicy     string              `json:"security_policy"`     // "None" (default) or "Basic256Sha256"
+	SecurityMode       string              `json:"security_mode"`       // "Sign" or "SignAndEncrypt"; default "SignAndEncrypt", or "None" with no policy
+	ServerCertificate  string              `json:"server_certificate"`  // PEM or DER file the server's certificate must match
+	Username           string              `json:"username"`            // User to log in as; anonymous when empty
+	PasswordEnv        string              `json:"password_env"`        // Environment variable holding the user's password
+	PublishingInterval string              `json:"publishing_interval"` // How often the server reports changes, default "1s"
+	SamplingInterval   string              `json:"sampling_interval"`   // How often the server samples values; the publishing interval by default
+	Timeout            string              `json:"timeout"`             // Deadline for each service call, default "10s"
+	Topic              string              `json:"topic"`               // Topic prefix values are published under, default "opcua/<name>"
+	Nodes              []OPCUANodeConfig   `json:"nodes"`
+	Browse             []OPCUABrowseConfig `json:"browse"`
+}
+
+// LoadOPCUAConfigs reads server descriptions from a JSON file containing an array of OPCUAServerConfig.
+func LoadOPCUAConfigs(filePath string) ([]OPCUAServerConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OPC UA config %s: %w", filePath, err)
+	}
+	var configs []OPCUAServerConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse OPC UA config %s: %w", filePath, err)
+	}
+	return configs, nil
+}
+
+// ErrOPCUAUnknownServer is returned by Browse for a server that is not configured.
+var ErrOPCUAUnknownServer = errors.New("unknown OPC UA server")
+
+// OPCUANode is a node found by browsing.
+type OPCUANode struct {
+	NodeID      string `json:"node_id"`
+	BrowsePath  string `json:"browse_path"` // Browse names from the root, joined with "."
+	DisplayName string `json:"display_name"`
+	NodeClass   string `json:"node_class"` // "Object" or "Variable"
+}
+
+// Client behaviour
+const (
+	opcuaPublishRequests   = 3    // Publish requests kept outstanding per session
+	opcuaKeepAliveCount    = 10   // Publishing intervals without changes before the server sends a keep-alive
+	opcuaLifetimeCount     = 60   // Publishing intervals without Publish requests before the server drops the subscription
+	opcuaMonitoredBatch    = 500  // Monitored items created per request
+	opcuaBrowseBatch       = 100  // Nodes browsed per request
+	opcuaMaxBrowsedNodes   = 5000 // Variables a browse rule may map
+	opcuaSessionTimeout    = time.Minute
+	opcuaReconnectMin      = time.Second
+	opcuaReconnectMax      = 30 * time.Second
+	opcuaApplicationURI    = "urn:nimbus:gateway"
+	opcuaProductURI        = "urn:nimbus"
+	opcuaQueueSize         = 10
+	opcuaTelemetryMimeType = "application/json"
+)
+
+// opcuaItem is a variable monitored for a series.
+type opcuaItem struct {
+	node     opcuaNodeID
+	name     string // Series suffix and topic suffix
+	series   string
+	topic    string
+	deadband float64
+	bad      bool // Last value had a bad status; logged once until it recovers
+}
+
+// opcuaBrowseRule is a validated OPCUABrowseConfig.
+type opcuaBrowseRule struct {
+	root     opcuaNodeID
+	prefix   string
+	maxDepth int
+	deadband float64
+}
+
+// opcuaSource is a validated OPCUAServerConfig with its connection state.
+type opcuaSource struct {
+	config     OPCUAServerConfig
+	policyURI  string
+	mode       int32
+	pinned     []byte // DER of the expected server certificate; nil verifies it against the client's CAs
+	password   string
+	publishing time.Duration
+	sampling   time.Duration
+	timeout    time.Duration
+	topic      string
+	nodes      []*opcuaItem
+	browse     []opcuaBrowseRule
+
+	mutex   sync.Mutex // Guards session and the items being reported
+	session *opcuaSession
+	items   map[uint32]*opcuaItem // Monitored items of the session by client handle
+	failing string                // Last connection error, logged once until it changes
+}
+
+// opcuaIdentity is the application instance certificate this side presents.
+type opcuaIdentity struct {
+	cert           []byte // DER
+	key            *rsa.PrivateKey
+	applicationURI string
+}
+
+// OPCUAClient subscribes to variables of OPC UA servers and feeds their values to analytics as named
+// series. Values are also published as telemetry on a topic per series, so routes and MQTT subscribers
+// receive them like values from any device. Connections are re-established with backoff, and the
+// subscriptions restored, after failures.
+type OPCUAClient struct {
+	sources  map[string]*opcuaSource
+	identity opcuaIdentity
+	roots    *x509.CertPool                                     // CAs that vouch for servers without a pinned certificate; may be nil
+	ingest   func([]Sample)                                     // Receives the values
+	publish  func(topic string, envelope Envelope) (int, error) // Publishes the values as telemetry; may be nil
+	logger   *log.Logger
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// NewOPCUAClient validates the server descriptions and creates a client that sends samples to ingest
+// and, when publish is not nil, publishes them. certificate, usually the gateway's, identifies the
+// client to servers using Basic256Sha256 and must have an RSA key; it may be nil if none do. The
+// certificates of such servers must be pinned or signed by one of roots, usually the gateway's CAs.
+func NewOPCUAClient(logger *log.Logger, configs []OPCUAServerConfig, certificate *tls.Certificate, roots *x509.CertPool, ingest func([]Sample), publish func(topic string, envelope Envelope) (int, error)) (*OPCUAClient, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client := &OPCUAClient{
+		sources:  make(map[string]*opcuaSource),
+		identity: opcuaIdentity{applicationURI: opcuaApplicationURI},
+		roots:    roots,
+		ingest:   ingest,
+		publish:  publish,
+		logger:   logger,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if certificate != nil && len(certificate.Certificate) > 0 {
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid OPC UA client certificate: %w", err)
+		}
+		if key, isRSA := certificate.PrivateKey.(*rsa.PrivateKey); isRSA {
+			client.identity.cert, client.identity.key = leaf.Raw, key
+		}
+		// Servers check that the application URI matches the one in the certificate
+		if len(leaf.URIs) > 0 {
+			client.identity.applicationURI = leaf.URIs[0].String()
+		}
+	}
+
+	for _, config := range configs {
+		source, err := parseOPCUAServerConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := client.sources[config.Name]; exists {
+			return nil, fmt.Errorf("duplicate OPC UA server %q", config.Name)
+		}
+		if source.policyURI != opcuaPolicyNone && client.identity.key == nil {
+			return nil, fmt.Errorf("OPC UA server %s uses %s, which needs a certificate with an RSA key", config.Name, config.SecurityPolicy)
+		}
+		if source.policyURI != opcuaPolicyNone && source.pinned == nil && roots == nil {
+			return nil, fmt.Errorf("OPC UA server %s uses %s but its certificate cannot be verified: set server_certificate or a CA bundle", config.Name, config.SecurityPolicy)
+		}
+		client.sources[config.Name] = source
+	}
+	return client, nil
+}
+
+// parseOPCUAServerConfig applies defaults and validates a server description.
+func parseOPCUAServerConfig(config OPCUAServerConfig) (*opcuaSource, error) {
+	if config.Name == "" {
+		return nil, errors.New("OPC UA server without a name")
+	}
+	if _, err := opcuaEndpointAddress(config.EndpointURL); err != nil {
+		return nil, fmt.Errorf("OPC UA server %s: %w", config.Name, err)
+	}
+	source := &opcuaSource{config: config, items: make(map[uint32]*opcuaItem)}
+	var err error
+	if source.policyURI, err = opcuaSecurityPolicyURI(config.SecurityPolicy); err != nil {
+		return nil, fmt.Errorf("OPC UA server %s: %w", config.Name, err)
+	}
+	if source.mode, err = opcuaSecurityMode(config.SecurityMode, source.policyURI); err != nil {
+		return nil, fmt.Errorf("OPC UA server %s: %w", config.Name, err)
+	}
+	if config.ServerCertificate != "" {
+		if source.pinned, err = loadOPCUACertificate(config.ServerCertificate); err != nil {
+			return nil, fmt.Errorf("OPC UA server %s: %w", config.Name, err)
+		}
+	}
+	if config.PasswordEnv != "" {
+		if config.Username == "" {
+			return nil, fmt.Errorf("OPC UA server %s has a password but no username", config.Name)
+		}
+		source.password = os.Getenv(config.PasswordEnv)
+		if source.password == "" {
+			return nil, fmt.Errorf("OPC UA password variable %s of %s is not set", config.PasswordEnv, config.Name)
+		}
+	}
+	if source.publishing, err = utils.ParsePositiveDuration(config.PublishingInterval, "1s"); err != nil {
+		return nil, fmt.Errorf("invalid OPC UA publishing interval for %s: %w", config.Name, err)
+	}
+	source.sampling = source.publishing
+	if config.SamplingInterval != "" {
+		if source.sampling, err = utils.ParsePositiveDuration(config.SamplingInterval, ""); err != nil {
+			return nil, fmt.Errorf("invalid OPC UA sampling interval for %s: %w", config.Name, err)
+		}
+	}
+	if source.timeout, err = utils.ParsePositiveDuration(config.Timeout, "10s"); err != nil {
+		return nil, fmt.Errorf("invalid OPC UA timeout for %s: %w", config.Name, err)
+	}
+	source.topic = config.Topic
+	if source.topic == "" {
+		source.topic = "opcua/" + config.Name
+	}
+	if err := ValidateTopic(source.topic); err != nil {
+		return nil, fmt.Errorf("invalid OPC UA topic for %s: %w", config.Name, err)
+	}
+
+	names := make(map[string]bool)
+	for _, node := range config.Nodes {
+		id, err := parseOPCUANodeID(node.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("OPC UA server %s: %w", config.Name, err)
+		}
+		if node.Name == "" {
+			return nil, fmt.Errorf("OPC UA node %s of %s has no name", node.NodeID, config.Name)
+		}
+		if names[node.Name] {
+			return nil, fmt.Errorf("duplicate OPC UA node name %s.%s", config.Name, node.Name)
+		}
+		names[node.Name] = true
+		item := source.newItem(id, node.Name, node.Deadband)
+		if err := ValidateTopic(item.topic); err != nil {
+			return nil, fmt.Errorf("OPC UA node name %s.%s does not fit in a topic: %w", config.Name, node.Name, err)
+		}
+		source.nodes = append(source.nodes, item)
+	}
+	for _, browse := range config.Browse {
+		rule := opcuaBrowseRule{root: opcuaNumericNodeID(0, opcuaNodeObjectsFolder), prefix: browse.Prefix, maxDepth: browse.MaxDepth, deadband: browse.Deadband}
+		if browse.Root != "" {
+			if rule.root, err = parseOPCUANodeID(browse.Root); err != nil {
+				return nil, fmt.Errorf("OPC UA server %s: %w", config.Name, err)
+			}
+		}
+		if rule.maxDepth == 0 {
+			rule.maxDepth = 3
+		}
+		if rule.maxDepth < 0 {
+			return nil, fmt.Errorf("OPC UA browse depth of %s must not be negative", config.Name)
+		}
+		source.browse = append(source.browse, rule)
+	}
+	if len(source.nodes) == 0 && len(source.browse) == 0 {
+		return nil, fmt.Errorf("OPC UA server %s has neither nodes nor browse rules", config.Name)
+	}
+	return source, nil
+}
+
+// loadOPCUACertificate reads a certificate from a PEM or DER file.
+func loadOPCUACertificate(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate %s: %w", path, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate %s: %w", path, err)
+	}
+	return cert.Raw, nil
+}
+
+func (s *opcuaSource) newItem(node opcuaNodeID, name string, deadband float64) *opcuaItem {
+	return &opcuaItem{
+		node:     node,
+		name:     name,
+		series:   s.config.Name + "." + name,
+		topic:    s.topic + "/" + name,
+		deadband: deadband,
+	}
+}
+
+// Start connects to every server.
+func (c *OPCUAClient) Start() {
+	for _, source := range c.sources {
+		c.wg.Add(1)
+		go c.run(source)
+	}
+}
+
+// Stop closes the sessions and connections, waiting for them until ctx is done.
+func (c *OPCUAClient) Stop(ctx context.Context) error {
+	c.cancel()
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run keeps a subscription to a server's variables, reconnecting with backoff after failures.
+func (c *OPCUAClient) run(source *opcuaSource) {
+	defer c.wg.Done()
+	backoff := opcuaReconnectMin
+	for {
+		session, err := c.connect(c.ctx, source)
+		if err == nil {
+			var count int
+			count, err = c.subscribe(c.ctx, source, session)
+			if err == nil {
+				c.logger.Printf("OPC UA server %s connected; monitoring %d variables\n", source.config.Name, count)
+				source.mutex.Lock()
+				source.failing = ""
+				source.mutex.Unlock()
+				backoff = opcuaReconnectMin
+				err = c.receive(source, session)
+			}
+			source.mutex.Lock()
+			source.session = nil
+			source.mutex.Unlock()
+			c.closeSession(session)
+		}
+		if c.ctx.Err() != nil {
+			return
+		}
+
+		source.mutex.Lock()
+		if message := err.Error(); message != source.failing {
+			c.logger.Printf("OPC UA server %s at %s is unavailable: %v\n", source.config.Name, source.config.EndpointURL, err)
+			source.failing = message
+		}
+		source.mutex.Unlock()
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > opcuaReconnectMax {
+			backoff = opcuaReconnectMax
+		}
+	}
+}
+
+// opcuaSession is an activated session on a secure channel.
+type opcuaSession struct {
+	channel     *opcuaClientChannel
+	authToken   opcuaNodeID
+	serverNonce []byte
+	timeout     time.Duration
+}
+
+// call sends a request within the session and waits at most the session's timeout for the response.
+func (s *opcuaSession) call(ctx context.Context, request opcuaRequest) (opcuaResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	request.requestHeader().AuthenticationToken = s.authToken
+	return s.channel.request(ctx, request)
+}
+
+// connect discovers the endpoint matching the configured security, opens a secure channel to it and
+// creates and activates a session.
+func (c *OPCUAClient) connect(ctx context.Context, source *opcuaSource) (*opcuaSession, error) {
+	endpoint, err := c.discover(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := dialOPCUAChannel(ctx, source.config.EndpointURL, source.policyURI, source.mode, c.identity.cert, c.identity.key, endpoint.ServerCertificate, source.timeout, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	session := &opcuaSession{channel: channel, timeout: source.timeout}
+	if err := c.activate(ctx, source, session, endpoint); err != nil {
+		channel.close()
+		return nil, err
+	}
+	source.mutex.Lock()
+	source.session = session
+	source.mutex.Unlock()
+	return session, nil
+}
+
+// discover asks the server for its endpoints over an unsecured channel and returns the one with the
+// configured policy and mode, after checking its certificate against the pinned one.
+func (c *OPCUAClient) discover(ctx context.Context, source *opcuaSource) (*opcuaEndpointDescription, error) {
+	channel, err := dialOPCUAChannel(ctx, source.config.EndpointURL, opcuaPolicyNone, opcuaSecurityModeNone, nil, nil, nil, source.timeout, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	defer channel.close()
+	callCtx, cancel := context.WithTimeout(ctx, source.timeout)
+	defer cancel()
+	response, err := channel.request(callCtx, &opcuaGetEndpointsRequest{EndpointURL: source.config.EndpointURL})
+	if err != nil {
+		return nil, fmt.Errorf("GetEndpoints: %w", err)
+	}
+	endpoints, ok := response.(*opcuaGetEndpointsResponse)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T in answer to GetEndpoints", opcuaBadUnexpectedError, response)
+	}
+
+	var offered []string
+	for i := range endpoints.Endpoints {
+		endpoint := &endpoints.Endpoints[i]
+		if endpoint.TransportProfileURI != "" && endpoint.TransportProfileURI != opcuaTransportProfile {
+			continue
+		}
+		offered = append(offered, fmt.Sprintf("%s/%d", strings.TrimPrefix(endpoint.SecurityPolicyURI, "http://opcfoundation.org/UA/SecurityPolicy#"), endpoint.SecurityMode))
+		if endpoint.SecurityPolicyURI != source.policyURI || endpoint.SecurityMode != source.mode {
+			continue
+		}
+		if source.policyURI != opcuaPolicyNone {
+			if err := c.checkServerCertificate(source, endpoint.ServerCertificate); err != nil {
+				return nil, err
+			}
+		}
+		return endpoint, nil
+	}
+	return nil, fmt.Errorf("%w: no endpoint with security policy %s and mode %d (offered: %s)", opcuaBadSecurityPolicyRejected, source.policyURI, source.mode, strings.Join(offered, ", "))
+}
+
+// checkServerCertificate compares the server's certificate with the pinned one or, without a pinned
+// certificate, verifies it against the client's CAs. A certificate neither vouches for is refused, and
+// its thumbprint given so it can be checked and pinned.
+func (c *OPCUAClient) checkServerCertificate(source *opcuaSource, chain []byte) error {
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil || len(certs) == 0 {
+		return fmt.Errorf("%w: unreadable server certificate", opcuaBadCertificateInvalid)
+	}
+	cert := certs[0]
+	thumbprint := sha1.Sum(cert.Raw)
+	switch {
+	case source.pinned != nil:
+		if string(cert.Raw) != string(source.pinned) {
+			return fmt.Errorf("%w: server certificate (SHA-1 %s) does not match %s", opcuaBadCertificateUntrusted, hex.EncodeToString(thumbprint[:]), source.config.ServerCertificate)
+		}
+	case c.roots != nil:
+		intermediates := x509.NewCertPool()
+		for _, intermediate := range certs[1:] {
+			intermediates.AddCert(intermediate)
+		}
+		// OPC UA application certificates need not carry the TLS server usage
+		options := x509.VerifyOptions{Roots: c.roots, Intermediates: intermediates, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+		if _, err := cert.Verify(options); err != nil {
+			return fmt.Errorf("%w: server certificate %s (SHA-1 %s): %v", opcuaBadCertificateUntrusted, cert.Subject, hex.EncodeToString(thumbprint[:]), err)
+		}
+	default:
+		return fmt.Errorf("%w: server certificate %s (SHA-1 %s) cannot be verified without server_certificate or a CA bundle", opcuaBadCertificateUntrusted, cert.Subject, hex.EncodeToString(thumbprint[:]))
+	}
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("%w: server certificate is valid from %s to %s", opcuaBadCertificateInvalid, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// activate creates a session, checking the server's proof of its key, and activates it with the
+// configured user identity.
+func (c *OPCUAClient) activate(ctx context.Context, source *opcuaSource, session *opcuaSession, endpoint *opcuaEndpointDescription) error {
+	secure := source.policyURI != opcuaPolicyNone
+	nonce := make([]byte, opcuaNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	create := &opcuaCreateSessionRequest{
+		ClientDescription: opcuaApplicationDescription{
+			ApplicationURI:  c.identity.applicationURI,
+			ProductURI:      opcuaProductURI,
+			ApplicationName: opcuaLocalizedText{Text: "Nimbus gateway"},
+			ApplicationType: 1,
+		},
+		EndpointURL:             source.config.EndpointURL,
+		SessionName:             "nimbus-" + source.config.Name,
+		ClientNonce:             nonce,
+		RequestedSessionTimeout: float64(opcuaSessionTimeout / time.Millisecond),
+		MaxResponseMessageSize:  opcuaMaxMessageSize,
+	}
+	if secure {
+		create.ClientCertificate = c.identity.cert
+	}
+	response, err := session.call(ctx, create)
+	if err != nil {
+		return fmt.Errorf("CreateSession: %w", err)
+	}
+	created, ok := response.(*opcuaCreateSessionResponse)
+	if !ok {
+		return fmt.Errorf("%w: %T in answer to CreateSession", opcuaBadUnexpectedError, response)
+	}
+	session.authToken = created.AuthenticationToken
+	session.serverNonce = created.ServerNonce
+
+	activate := &opcuaActivateSessionRequest{}
+	if secure {
+		conn := session.channel.conn
+		if len(created.ServerNonce) < opcuaNonceLength {
+			return fmt.Errorf("%w: server nonce of %d bytes", opcuaBadNonceInvalid, len(created.ServerNonce))
+		}
+		if certs, err := x509.ParseCertificates(created.ServerCertificate); err != nil || len(certs) == 0 || string(certs[0].Raw) != string(conn.remoteCertDER) {
+			return fmt.Errorf("%w: session certificate differs from the channel's", opcuaBadCertificateInvalid)
+		}
+		digest := sha256.Sum256(append(append([]byte(nil), c.identity.cert...), nonce...))
+		if created.ServerSignature.Algorithm != opcuaAlgorithmRSASHA256 || rsa.VerifyPKCS1v15(conn.remoteKey(), crypto.SHA256, digest[:], created.ServerSignature.Signature) != nil {
+			return fmt.Errorf("%w: invalid server signature", opcuaBadApplicationSignatureInvalid)
+		}
+		digest = sha256.Sum256(append(append([]byte(nil), created.ServerCertificate...), created.ServerNonce...))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, c.identity.key, crypto.SHA256, digest[:])
+		if err != nil {
+			return err
+		}
+		activate.ClientSignature = opcuaSignatureData{Algorithm: opcuaAlgorithmRSASHA256, Signature: signature}
+	}
+	if activate.UserIdentityToken, err = c.identityToken(source, endpoint, created.ServerNonce); err != nil {
+		return err
+	}
+	response, err = session.call(ctx, activate)
+	if err != nil {
+		return fmt.Errorf("ActivateSession: %w", err)
+	}
+	if activated, ok := response.(*opcuaActivateSessionResponse); ok {
+		session.serverNonce = activated.ServerNonce
+	}
+	return nil
+}
+
+// identityToken builds the user identity token: anonymous without a username, otherwise the password
+// encrypted for the server as the endpoint's user token policy specifies.
+func (c *OPCUAClient) identityToken(source *opcuaSource, endpoint *opcuaEndpointDescription, serverNonce []byte) (opcuaExtensionObject, error) {
+	tokenType := int32(opcuaTokenAnonymous)
+	if source.config.Username != "" {
+		tokenType = opcuaTokenUserName
+	}
+	var policy *opcuaUserTokenPolicy
+	for i := range endpoint.UserIdentityTokens {
+		if endpoint.UserIdentityTokens[i].TokenType == tokenType {
+			policy = &endpoint.UserIdentityTokens[i]
+			break
+		}
+	}
+	if policy == nil {
+		return opcuaExtensionObject{}, fmt.Errorf("%w: the endpoint does not accept %s users", opcuaBadIdentityTokenRejected, map[int32]string{opcuaTokenAnonymous: "anonymous", opcuaTokenUserName: "named"}[tokenType])
+	}
+	if tokenType == opcuaTokenAnonymous {
+		return newOPCUAExtensionObject(&opcuaAnonymousIdentityToken{PolicyID: policy.PolicyID}), nil
+	}
+
+	token := &opcuaUserNameIdentityToken{PolicyID: policy.PolicyID, UserName: source.config.Username, Password: []byte(source.password)}
+	tokenPolicy := policy.SecurityPolicyURI
+	if tokenPolicy == "" {
+		tokenPolicy = endpoint.SecurityPolicyURI
+	}
+	switch tokenPolicy {
+	case opcuaPolicyNone:
+		// The password travels as is, so only an encrypted channel may carry it
+		if source.mode != opcuaSecurityModeSignAndEncrypt {
+			return opcuaExtensionObject{}, fmt.Errorf("%w: refusing to send the password of %s unencrypted", opcuaBadIdentityTokenRejected, source.config.Username)
+		}
+	case opcuaPolicyBasic256Sha256:
+		certs, err := x509.ParseCertificates(endpoint.ServerCertificate)
+		if err != nil || len(certs) == 0 {
+			return opcuaExtensionObject{}, fmt.Errorf("%w: unreadable server certificate", opcuaBadCertificateInvalid)
+		}
+		// Over a secure channel discovery has checked the certificate already
+		if source.policyURI == opcuaPolicyNone {
+			if err := c.checkServerCertificate(source, endpoint.ServerCertificate); err != nil {
+				return opcuaExtensionObject{}, err
+			}
+		}
+		key, isRSA := certs[0].PublicKey.(*rsa.PublicKey)
+		if !isRSA {
+			return opcuaExtensionObject{}, fmt.Errorf("%w: server certificate key is not RSA", opcuaBadCertificateInvalid)
+		}
+		plain := make([]byte, 4, 4+len(source.password)+len(serverNonce))
+		binary.LittleEndian.PutUint32(plain, uint32(len(source.password)+len(serverNonce)))
+		plain = append(append(plain, source.password...), serverNonce...)
+		blockSize := key.Size() - opcuaOAEPOverhead
+		var encrypted []byte
+		for len(plain) > 0 {
+			n := blockSize
+			if n > len(plain) {
+				n = len(plain)
+			}
+			block, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, plain[:n], nil)
+			if err != nil {
+				return opcuaExtensionObject{}, err
+			}
+			encrypted = append(encrypted, block...)
+			plain = plain[n:]
+		}
+		token.Password, token.EncryptionAlgorithm = encrypted, opcuaAlgorithmRSAOAEP
+	default:
+		return opcuaExtensionObject{}, fmt.Errorf("%w: user token policy %s", opcuaBadSecurityPolicyRejected, tokenPolicy)
+	}
+	return newOPCUAExtensionObject(token), nil
+}
+
+// closeSession closes a session and its channel, without waiting long for a server that is gone.
+func (c *OPCUAClient) closeSession(session *opcuaSession) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	session.call(ctx, &opcuaCloseSessionRequest{DeleteSubscriptions: true})
+	session.channel.close()
+}
+
+// resolve returns the configured nodes and the variables found by the browse rules.
+func (c *OPCUAClient) resolve(ctx context.Context, source *opcuaSource, session *opcuaSession) ([]*opcuaItem, error) {
+	items := append([]*opcuaItem(nil), source.nodes...)
+	seen := make(map[string]bool)
+	for _, item := range items {
+		seen[item.node.String()] = true
+	}
+	for _, rule := range source.browse {
+		nodes, truncated, err := session.browse(ctx, rule.root, rule.maxDepth, opcuaMaxBrowsedNodes)
+		if err != nil {
+			return nil, fmt.Errorf("browsing %s: %w", rule.root, err)
+		}
+		if truncated {
+			c.logger.Printf("Warning: browsing %s on OPC UA server %s stopped after %d variables\n", rule.root, source.config.Name, opcuaMaxBrowsedNodes)
+		}
+		for _, node := range nodes {
+			if node.NodeClass != "Variable" || seen[node.NodeID] {
+				continue
+			}
+			seen[node.NodeID] = true
+			id, err := parseOPCUANodeID(node.NodeID)
+			if err != nil {
+				continue
+			}
+			name := node.BrowsePath
+			if rule.prefix != "" {
+				name = rule.prefix + "." + name
+			}
+			items = append(items, source.newItem(id, name, rule.deadband))
+		}
+	}
+	return items, nil
+}
+
+// subscribe creates a subscription with a monitored item for every variable and returns how many
+// the server accepted. Variables it rejects are logged and left out.
+func (c *OPCUAClient) subscribe(ctx context.Context, source *opcuaSource, session *opcuaSession) (int, error) {
+	items, err := c.resolve(ctx, source, session)
+	if err != nil {
+		return 0, err
+	}
+	response, err := session.call(ctx, &opcuaCreateSubscriptionRequest{
+		RequestedPublishingInterval: float64(source.publishing / time.Millisecond),
+		RequestedLifetimeCount:      opcuaLifetimeCount,
+		RequestedMaxKeepAliveCount:  opcuaKeepAliveCount,
+		PublishingEnabled:           true,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("CreateSubscription: %w", err)
+	}
+	subscription, ok := response.(*opcuaCreateSubscriptionResponse)
+	if !ok {
+		return 0, fmt.Errorf("%w: %T in answer to CreateSubscription", opcuaBadUnexpectedError, response)
+	}
+	keepAlive := time.Duration(subscription.RevisedPublishingInterval*float64(subscription.RevisedMaxKeepAliveCount)) * time.Millisecond
+	if keepAlive <= 0 {
+		keepAlive = source.publishing * opcuaKeepAliveCount
+	}
+
+	monitored := make(map[uint32]*opcuaItem)
+	for start := 0; start < len(items); start += opcuaMonitoredBatch {
+		batch := items[start:]
+		if len(batch) > opcuaMonitoredBatch {
+			batch = batch[:opcuaMonitoredBatch]
+		}
+		request := &opcuaCreateMonitoredItemsRequest{SubscriptionID: subscription.SubscriptionID, TimestampsToReturn: opcuaTimestampsBoth}
+		for i, item := range batch {
+			create := opcuaMonitoredItemCreateRequest{
+				ItemToMonitor:    opcuaReadValueID{NodeID: item.node, AttributeID: opcuaAttributeValue},
+				MonitoringMode:   2,
+				ClientHandle:     uint32(start + i + 1),
+				SamplingInterval: float64(source.sampling / time.Millisecond),
+				QueueSize:        opcuaQueueSize,
+				DiscardOldest:    true,
+			}
+			if item.deadband > 0 {
+				create.Filter = newOPCUAExtensionObject(&opcuaDataChangeFilter{Trigger: 1, DeadbandType: 1, DeadbandValue: item.deadband})
+			}
+			request.ItemsToCreate = append(request.ItemsToCreate, create)
+		}
+		response, err := session.call(ctx, request)
+		if err != nil {
+			return 0, fmt.Errorf("CreateMonitoredItems: %w", err)
+		}
+		created, ok := response.(*opcuaCreateMonitoredItemsResponse)
+		if !ok || len(created.Results) != len(batch) {
+			return 0, fmt.Errorf("%w: unexpected answer to CreateMonitoredItems", opcuaBadUnexpectedError)
+		}
+		for i, result := range created.Results {
+			if result.Status.isBad() {
+				c.logger.Printf("OPC UA server %s cannot monitor %s (%s): %v\n", source.config.Name, batch[i].node, batch[i].series, result.Status)
+				continue
+			}
+			monitored[uint32(start+i+1)] = batch[i]
+		}
+	}
+	if len(monitored) == 0 {
+		return 0, fmt.Errorf("%w: none of the %d variables can be monitored", opcuaBadNothingToDo, len(items))
+	}
+
+	source.mutex.Lock()
+	source.items = monitored
+	source.mutex.Unlock()
+	// Publish requests wait for a keep-alive at worst, behind the requests queued before them
+	session.timeout = keepAlive*(opcuaPublishRequests+1) + source.timeout
+	return len(monitored), nil
+}
+
+// receive keeps Publish requests outstanding and reports the values they return until the session
+// fails or the client stops.
+func (c *OPCUAClient) receive(source *opcuaSource, session *opcuaSession) error {
+	var acks []opcuaSubscriptionAcknowledgement
+	var ackMutex sync.Mutex
+	failed := make(chan error, opcuaPublishRequests)
+	var wg sync.WaitGroup
+	for i := 0; i < opcuaPublishRequests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.ctx.Err() == nil {
+				ackMutex.Lock()
+				request := &opcuaPublishRequest{Acknowledgements: acks}
+				acks = nil
+				ackMutex.Unlock()
+				response, err := session.call(c.ctx, request)
+				if errors.Is(err, opcuaBadTooManyPublishRequests) {
+					// The server keeps fewer requests queued; the others carry on
+					return
+				}
+				if err != nil {
+					failed <- err
+					return
+				}
+				published, ok := response.(*opcuaPublishResponse)
+				if !ok {
+					failed <- fmt.Errorf("%w: %T in answer to Publish", opcuaBadUnexpectedError, response)
+					return
+				}
+				if len(published.NotificationMessage.NotificationData) > 0 {
+					ackMutex.Lock()
+					acks = append(acks, opcuaSubscriptionAcknowledgement{SubscriptionID: published.SubscriptionID, SequenceNumber: published.NotificationMessage.SequenceNumber})
+					ackMutex.Unlock()
+				}
+				if err := c.report(source, published.NotificationMessage); err != nil {
+					failed <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+	select {
+	case err = <-failed:
+		// Failing the channel ends the Publish requests still waiting; on Stop they end with the context
+		session.channel.fail(err)
+	case <-c.ctx.Done():
+	}
+	wg.Wait()
+	return err
+}
+
+// report turns the value changes of a notification message into samples and telemetry. A status
+// change means the subscription is gone, which is returned as an error.
+func (c *OPCUAClient) report(source *opcuaSource, message opcuaNotificationMessage) error {
+	now := time.Now()
+	var samples []Sample
+	var topics []string
+	source.mutex.Lock()
+	for _, data := range message.NotificationData {
+		decoded, err := decodeOPCUAExtensionObject(data)
+		if err != nil {
+			source.mutex.Unlock()
+			return err
+		}
+		switch notification := decoded.(type) {
+		case *opcuaStatusChangeNotification:
+			source.mutex.Unlock()
+			return fmt.Errorf("subscription ended: %w", notification.Status)
+		case *opcuaDataChangeNotification:
+			for _, change := range notification.MonitoredItems {
+				item := source.items[change.ClientHandle]
+				if item == nil {
+					continue
+				}
+				if change.Value.Status.isBad() {
+					if !item.bad {
+						c.logger.Printf("OPC UA variable %s (%s) reports %v\n", item.series, item.node, change.Value.Status)
+						item.bad = true
+					}
+					continue
+				}
+				value, numeric := opcuaNumber(change.Value.Value)
+				if !numeric {
+					continue
+				}
+				if item.bad {
+					c.logger.Printf("OPC UA variable %s is good again\n", item.series)
+					item.bad = false
+				}
+				timestamp := change.Value.SourceTimestamp
+				if timestamp.IsZero() {
+					timestamp = change.Value.ServerTimestamp
+				}
+				if timestamp.IsZero() {
+					timestamp = now
+				}
+				samples = append(samples, Sample{Series: item.series, Timestamp: timestamp, Value: value})
+				topics = append(topics, item.topic)
+			}
+		}
+	}
+	source.mutex.Unlock()
+
+	if len(samples) > 0 && c.ingest != nil {
+		c.ingest(samples)
+	}
+	if c.publish != nil {
+		for i, sample := range samples {
+			payload, _ := json.Marshal(map[string]interface{}{"value": sample.Value, "timestamp": sample.Timestamp.Format(time.RFC3339Nano)})
+			envelope := Envelope{Type: MessageData, Priority: ClassTelemetry, Timestamp: now, ContentType: opcuaTelemetryMimeType, Payload: payload}
+			if _, err := c.publish(topics[i], envelope); err != nil {
+				c.logger.Printf("Error publishing OPC UA value of %s: %v\n", sample.Series, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Browse lists the objects and variables below a node of a configured server, descending depth levels
+// of objects. It uses the server's session when connected and opens a temporary one otherwise. An
+// empty root browses the Objects folder.
+func (c *OPCUAClient) Browse(ctx context.Context, server, root string, depth int) ([]OPCUANode, error) {
+	source := c.sources[server]
+	if source == nil {
+		return nil, fmt.Errorf("%w: %s", ErrOPCUAUnknownServer, server)
+	}
+	rootID := opcuaNumericNodeID(0, opcuaNodeObjectsFolder)
+	if root != "" {
+		var err error
+		if rootID, err = parseOPCUANodeID(root); err != nil {
+			return nil, err
+		}
+	}
+
+	source.mutex.Lock()
+	session := source.session
+	source.mutex.Unlock()
+	if session == nil {
+		var err error
+		if session, err = c.connect(ctx, source); err != nil {
+			return nil, err
+		}
+		defer func() {
+			source.mutex.Lock()
+			if source.session == session {
+				source.session = nil
+			}
+			source.mutex.Unlock()
+			c.closeSession(session)
+		}()
+	}
+	nodes, _, err := session.browse(ctx, rootID, depth, opcuaMaxBrowsedNodes)
+	return nodes, err
+}
+
+// browse walks the hierarchical references from root breadth first, descending into objects up to
+// maxDepth levels, and returns the objects and variables found, up to limit variables. Browse paths
+// join the browse names, with characters that do not belong in series names replaced by "_".
+func (s *opcuaSession) browse(ctx context.Context, root opcuaNodeID, maxDepth, limit int) ([]OPCUANode, bool, error) {
+	type pending struct {
+		id   opcuaNodeID
+		path string
+	}
+	var nodes []OPCUANode
+	variables := 0
+	visited := map[string]bool{root.String(): true}
+	level := []pending{{id: root}}
+	for depth := 0; depth < maxDepth && len(level) > 0; depth++ {
+		var next []pending
+		for start := 0; start < len(level); start += opcuaBrowseBatch {
+			batch := level[start:]
+			if len(batch) > opcuaBrowseBatch {
+				batch = batch[:opcuaBrowseBatch]
+			}
+			request := &opcuaBrowseRequest{RequestedMaxReferencesPerNode: 1000}
+			for _, parent := range batch {
+				request.NodesToBrowse = append(request.NodesToBrowse, opcuaBrowseDescription{
+					NodeID:          parent.id,
+					ReferenceTypeID: opcuaNumericNodeID(0, opcuaNodeHierarchicalReferences),
+					IncludeSubtypes: true,
+					NodeClassMask:   opcuaNodeClassObject | opcuaNodeClassVariable,
+					ResultMask:      0x3F,
+				})
+			}
+			results, err := s.browseAll(ctx, request)
+			if err != nil {
+				return nil, false, err
+			}
+			for i, refs := range results {
+				for _, ref := range refs {
+					id := ref.NodeID.NodeID
+					// References to other servers, and the diagnostics of the Server object, are skipped
+					if ref.NodeID.ServerIndex != 0 || ref.NodeID.NamespaceURI != "" || visited[id.String()] || id.equal(opcuaNumericNodeID(0, opcuaNodeServer)) {
+						continue
+					}
+					visited[id.String()] = true
+					path := opcuaPathElement(ref.BrowseName.Name)
+					if batch[i].path != "" {
+						path = batch[i].path + "." + path
+					}
+					node := OPCUANode{NodeID: id.String(), BrowsePath: path, DisplayName: ref.DisplayName.Text}
+					switch ref.NodeClass {
+					case opcuaNodeClassObject:
+						node.NodeClass = "Object"
+						next = append(next, pending{id: id, path: path})
+					case opcuaNodeClassVariable:
+						if variables >= limit {
+							return nodes, true, nil
+						}
+						node.NodeClass = "Variable"
+						variables++
+					default:
+						continue
+					}
+					nodes = append(nodes, node)
+				}
+			}
+		}
+		level = next
+	}
+	return nodes, false, nil
+}
+
+// browseAll sends a Browse request and follows continuation points until every node's references
+// have been returned.
+func (s *opcuaSession) browseAll(ctx context.Context, request *opcuaBrowseRequest) ([][]opcuaReferenceDescription, error) {
+	response, err := s.call(ctx, request)
+	if err != nil {
+		return nil, fmt.Errorf("Browse: %w", err)
+	}
+	browsed, ok := response.(*opcuaBrowseResponse)
+	if !ok || len(browsed.Results) != len(request.NodesToBrowse) {
+		return nil, fmt.Errorf("%w: unexpected answer to Browse", opcuaBadUnexpectedError)
+	}
+	refs := make([][]opcuaReferenceDescription, len(browsed.Results))
+	results := browsed.Results
+	indexes := make([]int, len(results))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	for len(results) > 0 {
+		next := &opcuaBrowseNextRequest{}
+		var nextIndexes []int
+		for i, result := range results {
+			// Nodes that cannot be browsed contribute nothing
+			if result.Status.isBad() {
+				continue
+			}
+			refs[indexes[i]] = append(refs[indexes[i]], result.References...)
+			if len(result.ContinuationPoint) > 0 {
+				next.ContinuationPoints = append(next.ContinuationPoints, result.ContinuationPoint)
+				nextIndexes = append(nextIndexes, indexes[i])
+			}
+		}
+		if len(nextIndexes) == 0 {
+			break
+		}
+		response, err := s.call(ctx, next)
+		if err != nil {
+			return nil, fmt.Errorf("BrowseNext: %w", err)
+		}
+		continued, ok := response.(*opcuaBrowseNextResponse)
+		if !ok || len(continued.Results) != len(nextIndexes) {
+			return nil, fmt.Errorf("%w: unexpected answer to BrowseNext", opcuaBadUnexpectedError)
+		}
+		results, indexes = continued.Results, nextIndexes
+	}
+	return refs, nil
+}
+
+// opcuaPathElement makes a browse name usable in series names and topics.
+func opcuaPathElement(name string) string {
+	element := []rune(name)
+	for i, r := range element {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			element[i] = '_'
+		}
+	}
+	if len(element) == 0 {
+		return "_"
+	}
+	return string(element)
+}
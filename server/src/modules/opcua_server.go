@@ -0,0 +1,1465 @@
+// server/src/modules/opcua_server.go
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OPCUAFacadeSeries exposes an analytics series, its anomaly flag and health, and some of its rollups.
+type OPCUAFacadeSeries struct {
+	Series   string              `json:"series"`    // Analytics series name
+	Rollups  map[string][]string `json:"rollups"`   // Aggregations exposed per rollup resolution, e.g. {"1m": ["mean", "max"]}
+	ReadRole Role                `json:"read_role"` // Role required to read the series' variables, default "guest"
+}
+
+// OPCUAFacadeAlerts exposes the latest alert of a source.
+type OPCUAFacadeAlerts struct {
+	Source   string `json:"source"`    // Alert source, e.g. "analytics" or "data_quality"; "*" for any source
+	ReadRole Role   `json:"read_role"` // Role required to read the alert, default "guest"
+}
+
+// OPCUAFacadeCommand is a writable variable; every value written is published on a topic as a command.
+type OPCUAFacadeCommand struct {
+	Name      string `json:"name"`       // Variable name under the Commands folder
+	Topic     string `json:"topic"`      // Topic the written values are published to
+	DataType  string `json:"data_type"`  // "Double" (default), "Int32", "Boolean" or "String"
+	WriteRole Role   `json:"write_role"` // Role required to write, default "admin"
+	ReadRole  Role   `json:"read_role"`  // Role required to read the last value written, default "guest"
+}
+
+// OPCUAFacadeConfig describes the address space of the OPC UA server and the security it offers.
+type OPCUAFacadeConfig struct {
+	Security            []string             `json:"security"`             // "None", "Basic256Sha256/Sign" or "Basic256Sha256/SignAndEncrypt" (the default)
+	TrustedCertificates []string             `json:"trusted_certificates"` // PEM or DER files of client certificates accepted besides those signed by the client CAs
+	Series              []OPCUAFacadeSeries  `json:"series"`
+	Alerts              []OPCUAFacadeAlerts  `json:"alerts"`
+	Commands            []OPCUAFacadeCommand `json:"commands"`
+}
+
+// LoadOPCUAFacadeConfig reads the address space and security of the OPC UA server from a JSON file
+// containing an OPCUAFacadeConfig.
+func LoadOPCUAFacadeConfig(filePath string) (OPCUAFacadeConfig, error) {
+	var config OPCUAFacadeConfig
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return config, fmt.Errorf("failed to read OPC UA server config %s: %w", filePath, err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse OPC UA server config %s: %w", filePath, err)
+	}
+	return config, nil
+}
+
+// OPCUAUsers maps the usernames of OPC UA clients to the bcrypt hashes of their passwords, in the
+// format of MQTTCredentials.
+type OPCUAUsers map[string][]byte
+
+// LoadOPCUAUsers reads a JSON object mapping each username to the bcrypt hash of its password.
+func LoadOPCUAUsers(path string) (OPCUAUsers, error) {
+	hashes, err := loadPasswordHashes(path, "OPC UA users")
+	return OPCUAUsers(hashes), err
+}
+
+// Authenticate reports whether the password matches the username's hash.
+func (ou OPCUAUsers) Authenticate(username string, password []byte) bool {
+	return checkPassword(ou, username, password)
+}
+
+// OPCUAServerOptions holds the identity and limits of the OPC UA server.
+type OPCUAServerOptions struct {
+	Certificate           *tls.Certificate                            // Application instance certificate; its key must be RSA
+	Authenticate          func(username string, password []byte) bool // Checks the passwords of users logging in
+	ClientCAs             *x509.CertPool                              // CAs that vouch for client certificates not in trusted_certificates; may be nil
+	Health                func(series string) (SensorHealth, bool)    // Health of a series; nil leaves out the health variables
+	MaxConnections        int                                         // Open connections, including discovery ones
+	MaxSessions           int                                         // Sessions over all connections
+	MaxSubscriptions      int                                         // Subscriptions per session
+	MaxMonitoredItems     int                                         // Monitored items per session
+	MaxSessionTimeout     time.Duration                               // Longest session timeout granted
+	MinPublishingInterval time.Duration                               // Shortest publishing interval granted
+	MinSamplingInterval   time.Duration                               // Shortest sampling interval granted
+}
+
+// DefaultOPCUAServerOptions returns the server limits used unless others are configured.
+func DefaultOPCUAServerOptions() OPCUAServerOptions {
+	return OPCUAServerOptions{
+		MaxConnections:        100,
+		MaxSessions:           50,
+		MaxSubscriptions:      10,
+		MaxMonitoredItems:     10000,
+		MaxSessionTimeout:     time.Hour,
+		MinPublishingInterval: 100 * time.Millisecond,
+		MinSamplingInterval:   100 * time.Millisecond,
+	}
+}
+
+// ErrOPCUAServerClosed is returned by Serve once the server has been closed.
+var ErrOPCUAServerClosed = errors.New("OPC UA server closed")
+
+// Server behaviour
+const (
+	opcuaServerApplicationURI = "urn:nimbus:server"
+	opcuaUserTokenPolicyID    = "username"
+	opcuaHelloTimeout         = 10 * time.Second
+	opcuaMinTokenLifetime     = 10 * time.Second
+	opcuaMinSessionTimeout    = 10 * time.Second
+	opcuaMaxOperations        = 1000 // Nodes per Browse, Read, Write or CreateMonitoredItems request
+	opcuaMaxContinuations     = 10   // Browse continuation points per session
+	opcuaCommandMimeType      = "application/json"
+)
+
+// opcuaSecurity is a security policy and mode pair that endpoints offer.
+type opcuaSecurity struct {
+	policyURI string
+	mode      int32
+}
+
+// opcuaSeriesNodes are the variables of a series.
+type opcuaSeriesNodes struct {
+	value, anomaly, zScore, health, faults *opcuaNode
+	rollups                                map[string]map[string]*opcuaNode // By resolution, then aggregation
+
+	// Guarded by the server's stateMutex
+	anomalous    bool
+	anomalyCycle uint64 // Processing cycle of the latest anomaly
+}
+
+// opcuaAlertNodes are the variables of the latest alert of a source.
+type opcuaAlertNodes struct {
+	message, severity, time, count *opcuaNode
+	received                       uint32 // Guarded by the server's stateMutex
+}
+
+// opcuaCommand is a validated OPCUAFacadeCommand.
+type opcuaCommand struct {
+	name      string
+	topic     string
+	dataType  byte
+	writeRole Role
+	node      *opcuaNode
+}
+
+// OPCUAServer exposes Nimbus analytics to SCADA systems as an OPC UA server. Its address space holds,
+// under Objects/Nimbus, a variable per configured series for the latest value, the anomaly flag and
+// Z-score, the health score and faults, and selected rollups, the latest alert of configured sources,
+// and writable command variables whose values are published as commands on routed topics.
+//
+// Clients log in with a username and password, sent encrypted for the server's certificate, and
+// AccessControl roles decide which variables each user may read and write. The server is an analytics
+// stage, an anomaly observer, a rollup sink and an alert notifier, so its variables follow analytics as
+// results come in; clients read them or subscribe to their changes.
+type OPCUAServer struct {
+	options        OPCUAServerOptions
+	access         *AccessControl
+	publish        func(topic string, envelope Envelope) (int, error) // Publishes written commands; may be nil without commands
+	logger         *log.Logger
+	cert           []byte // DER
+	key            *rsa.PrivateKey
+	applicationURI string
+	security       []opcuaSecurity
+	trusted        [][]byte // DER of client certificates accepted whatever signed them
+	space          *opcuaAddressSpace
+	series         map[string]*opcuaSeriesNodes
+	alerts         map[string]*opcuaAlertNodes // By source; "*" receives every alert
+	started        time.Time
+
+	stateMutex sync.Mutex // Guards the processing cycle and the anomaly and alert state of the nodes
+	cycle      uint64     // Processing cycles evaluated
+
+	mutex          sync.Mutex // Guards everything below, and the sessions' subscriptions
+	conns          map[*opcuaServerConn]struct{}
+	sessions       map[string]*opcuaServerSession // By authentication token
+	listeners      map[net.Listener]struct{}
+	channelID      uint32
+	subscriptionID uint32
+	itemID         uint32
+	closed         bool
+	stop           chan struct{} // Closed by Close to stop the publishing loop
+	done           chan struct{} // Closed once the publishing loop has stopped
+}
+
+// NewOPCUAServer validates the configuration and builds the address space. access authorizes users and
+// must not be nil; publish may be nil only when no commands are configured.
+func NewOPCUAServer(options OPCUAServerOptions, config OPCUAFacadeConfig, access *AccessControl, publish func(topic string, envelope Envelope) (int, error), logger *log.Logger) (*OPCUAServer, error) {
+	if options.Certificate == nil || len(options.Certificate.Certificate) == 0 {
+		return nil, errors.New("OPC UA server needs a certificate")
+	}
+	leaf, err := x509.ParseCertificate(options.Certificate.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid OPC UA server certificate: %w", err)
+	}
+	key, isRSA := options.Certificate.PrivateKey.(*rsa.PrivateKey)
+	if !isRSA {
+		return nil, errors.New("OPC UA server certificate needs an RSA key")
+	}
+	if options.Authenticate == nil {
+		return nil, errors.New("OPC UA server needs a way to authenticate users")
+	}
+	if access == nil {
+		return nil, errors.New("OPC UA server needs access control")
+	}
+	if len(config.Commands) > 0 && publish == nil {
+		return nil, errors.New("OPC UA server commands need a publisher")
+	}
+
+	s := &OPCUAServer{
+		options:        options,
+		access:         access,
+		publish:        publish,
+		logger:         logger,
+		cert:           leaf.Raw,
+		key:            key,
+		applicationURI: opcuaServerApplicationURI,
+		series:         make(map[string]*opcuaSeriesNodes),
+		alerts:         make(map[string]*opcuaAlertNodes),
+		started:        time.Now(),
+		conns:          make(map[*opcuaServerConn]struct{}),
+		sessions:       make(map[string]*opcuaServerSession),
+		listeners:      make(map[net.Listener]struct{}),
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	// Clients check that the application URI matches the one in the certificate
+	if len(leaf.URIs) > 0 {
+		s.applicationURI = leaf.URIs[0].String()
+	}
+
+	security := config.Security
+	if len(security) == 0 {
+		security = []string{"Basic256Sha256/SignAndEncrypt"}
+	}
+	for _, entry := range security {
+		policy, mode, _ := strings.Cut(entry, "/")
+		if policy == "" {
+			return nil, fmt.Errorf("invalid OPC UA server security %q", entry)
+		}
+		var offered opcuaSecurity
+		if offered.policyURI, err = opcuaSecurityPolicyURI(policy); err != nil {
+			return nil, err
+		}
+		if offered.mode, err = opcuaSecurityMode(mode, offered.policyURI); err != nil {
+			return nil, err
+		}
+		if !s.offers(offered.policyURI, offered.mode) {
+			s.security = append(s.security, offered)
+		}
+	}
+	for _, path := range config.TrustedCertificates {
+		cert, err := loadOPCUACertificate(path)
+		if err != nil {
+			return nil, err
+		}
+		s.trusted = append(s.trusted, cert)
+	}
+	if s.trusted == nil && options.ClientCAs == nil {
+		for _, offered := range s.security {
+			if offered.policyURI != opcuaPolicyNone {
+				return nil, errors.New("the OPC UA server offers secure endpoints but cannot verify clients: list trusted_certificates or set a CA bundle")
+			}
+		}
+	}
+
+	s.space = newOPCUAAddressSpace([]string{"http://opcfoundation.org/UA/", opcuaNimbusNamespaceURI}, s.applicationURI, s.status)
+	if err := s.buildAddressSpace(config); err != nil {
+		return nil, err
+	}
+	go s.maintain()
+	return s, nil
+}
+
+// offers reports whether an endpoint with a security policy and mode is offered.
+func (s *OPCUAServer) offers(policyURI string, mode int32) bool {
+	for _, offered := range s.security {
+		if offered.policyURI == policyURI && offered.mode == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// opcuaFacadeRole applies the default of a configured role and checks it.
+func opcuaFacadeRole(role, fallback Role, kind, name string) (Role, error) {
+	if role == "" {
+		return fallback, nil
+	}
+	if role != AdminRole && role != UserRole && role != GuestRole {
+		return "", fmt.Errorf("unknown %s role %q for %s", kind, role, name)
+	}
+	return role, nil
+}
+
+// opcuaCommandTypes maps the configurable command data types to built-in types.
+var opcuaCommandTypes = map[string]byte{
+	"":        opcuaTypeDouble,
+	"Double":  opcuaTypeDouble,
+	"Int32":   opcuaTypeInt32,
+	"Boolean": opcuaTypeBoolean,
+	"String":  opcuaTypeString,
+}
+
+// buildAddressSpace adds the Nimbus folder and the nodes of the configured series, alerts and commands.
+func (s *OPCUAServer) buildAddressSpace(config OPCUAFacadeConfig) error {
+	nimbus, err := s.object(s.space.standard(opcuaNodeObjectsFolder), opcuaNodeOrganizes, "Nimbus", "Nimbus", opcuaNodeFolderType)
+	if err != nil {
+		return err
+	}
+	seriesFolder, err := s.object(nimbus, opcuaNodeOrganizes, "Series", "Series", opcuaNodeFolderType)
+	if err != nil {
+		return err
+	}
+	alertsFolder, err := s.object(nimbus, opcuaNodeOrganizes, "Alerts", "Alerts", opcuaNodeFolderType)
+	if err != nil {
+		return err
+	}
+	commandsFolder, err := s.object(nimbus, opcuaNodeOrganizes, "Commands", "Commands", opcuaNodeFolderType)
+	if err != nil {
+		return err
+	}
+
+	for _, series := range config.Series {
+		if series.Series == "" {
+			return errors.New("OPC UA server series without a name")
+		}
+		if s.series[series.Series] != nil {
+			return fmt.Errorf("duplicate OPC UA server series %s", series.Series)
+		}
+		role, err := opcuaFacadeRole(series.ReadRole, GuestRole, "read", series.Series)
+		if err != nil {
+			return err
+		}
+		path := "Series/" + series.Series
+		object, err := s.object(seriesFolder, opcuaNodeOrganizes, path, series.Series, opcuaNodeBaseObjectType)
+		if err != nil {
+			return err
+		}
+		nodes := &opcuaSeriesNodes{rollups: make(map[string]map[string]*opcuaNode)}
+		if nodes.value, err = s.variable(object, path+"/Value", "Value", opcuaTypeDouble, -1, role, "Latest sample"); err != nil {
+			return err
+		}
+		if nodes.anomaly, err = s.variable(object, path+"/Anomaly", "Anomaly", opcuaTypeBoolean, -1, role, "Whether the latest processing cycle found an anomaly"); err != nil {
+			return err
+		}
+		nodes.anomaly.value = opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeBoolean, Value: false}, SourceTimestamp: s.started}
+		if nodes.zScore, err = s.variable(object, path+"/AnomalyZScore", "AnomalyZScore", opcuaTypeDouble, -1, role, "Z-score of the latest anomaly"); err != nil {
+			return err
+		}
+		if s.options.Health != nil {
+			if nodes.health, err = s.variable(object, path+"/Health", "Health", opcuaTypeDouble, -1, role, "Data-quality score from 0 to 100"); err != nil {
+				return err
+			}
+			if nodes.faults, err = s.variable(object, path+"/Faults", "Faults", opcuaTypeString, 1, role, "Active sensor faults"); err != nil {
+				return err
+			}
+		}
+		if len(series.Rollups) > 0 {
+			rollups, err := s.object(object, opcuaNodeHasComponent, path+"/Rollups", "Rollups", opcuaNodeFolderType)
+			if err != nil {
+				return err
+			}
+			for resolution, aggregations := range series.Rollups {
+				width, err := time.ParseDuration(resolution)
+				if err != nil || width <= 0 {
+					return fmt.Errorf("invalid rollup resolution %q for OPC UA server series %s", resolution, series.Series)
+				}
+				name := formatResolution(width)
+				if nodes.rollups[name] != nil {
+					return fmt.Errorf("duplicate rollup resolution %s for OPC UA server series %s", name, series.Series)
+				}
+				folder, err := s.object(rollups, opcuaNodeOrganizes, path+"/Rollups/"+name, name, opcuaNodeFolderType)
+				if err != nil {
+					return err
+				}
+				nodes.rollups[name] = make(map[string]*opcuaNode)
+				for _, aggregation := range aggregations {
+					if !rollupBasicAggregations[aggregation] && !percentilePattern.MatchString(aggregation) {
+						return fmt.Errorf("unknown rollup aggregation %q for OPC UA server series %s", aggregation, series.Series)
+					}
+					node, err := s.variable(folder, path+"/Rollups/"+name+"/"+aggregation, aggregation, opcuaTypeDouble, -1, role, "Latest "+name+" rollup")
+					if err != nil {
+						return err
+					}
+					nodes.rollups[name][aggregation] = node
+				}
+			}
+		}
+		s.series[series.Series] = nodes
+	}
+
+	for _, alerts := range config.Alerts {
+		name := alerts.Source
+		if name == "*" {
+			name = "All"
+		}
+		if name == "" {
+			return errors.New("OPC UA server alerts without a source")
+		}
+		if s.alerts[alerts.Source] != nil {
+			return fmt.Errorf("duplicate OPC UA server alert source %s", alerts.Source)
+		}
+		role, err := opcuaFacadeRole(alerts.ReadRole, GuestRole, "read", "alerts of "+alerts.Source)
+		if err != nil {
+			return err
+		}
+		path := "Alerts/" + name
+		object, err := s.object(alertsFolder, opcuaNodeOrganizes, path, name, opcuaNodeBaseObjectType)
+		if err != nil {
+			return err
+		}
+		nodes := &opcuaAlertNodes{}
+		if nodes.message, err = s.variable(object, path+"/Message", "Message", opcuaTypeString, -1, role, "Message of the latest alert"); err != nil {
+			return err
+		}
+		if nodes.severity, err = s.variable(object, path+"/Severity", "Severity", opcuaTypeString, -1, role, "Severity of the latest alert"); err != nil {
+			return err
+		}
+		if nodes.time, err = s.variable(object, path+"/Time", "Time", opcuaTypeDateTime, -1, role, "Time of the latest alert"); err != nil {
+			return err
+		}
+		if nodes.count, err = s.variable(object, path+"/Count", "Count", opcuaTypeUInt32, -1, role, "Alerts received since the server started"); err != nil {
+			return err
+		}
+		nodes.count.value = opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeUInt32, Value: uint32(0)}, SourceTimestamp: s.started}
+		s.alerts[alerts.Source] = nodes
+	}
+
+	for _, config := range config.Commands {
+		if config.Name == "" {
+			return errors.New("OPC UA server command without a name")
+		}
+		if err := ValidateTopic(config.Topic); err != nil {
+			return fmt.Errorf("invalid topic for OPC UA server command %s: %w", config.Name, err)
+		}
+		dataType, known := opcuaCommandTypes[config.DataType]
+		if !known {
+			return fmt.Errorf("unsupported data type %q for OPC UA server command %s (supported: Double, Int32, Boolean, String)", config.DataType, config.Name)
+		}
+		readRole, err := opcuaFacadeRole(config.ReadRole, GuestRole, "read", config.Name)
+		if err != nil {
+			return err
+		}
+		writeRole, err := opcuaFacadeRole(config.WriteRole, AdminRole, "write", config.Name)
+		if err != nil {
+			return err
+		}
+		command := &opcuaCommand{name: config.Name, topic: config.Topic, dataType: dataType, writeRole: writeRole}
+		if command.node, err = s.variable(commandsFolder, "Commands/"+config.Name, config.Name, uint32(dataType), -1, readRole, "Published to "+config.Topic+" when written"); err != nil {
+			return err
+		}
+		command.node.writeRole = writeRole
+		command.node.write = func(session *opcuaServerSession, value *opcuaVariant) opcuaStatusCode {
+			return s.writeCommand(command, session, value)
+		}
+	}
+	return nil
+}
+
+// object adds an object of the Nimbus namespace.
+func (s *OPCUAServer) object(parent *opcuaNode, referenceType uint32, path, name string, typeDef uint32) (*opcuaNode, error) {
+	node := opcuaNimbusNode(path, name, opcuaNodeClassObject)
+	node.typeDef = typeDef
+	if !s.space.add(parent, referenceType, node) {
+		return nil, fmt.Errorf("duplicate OPC UA server node %s", path)
+	}
+	return node, nil
+}
+
+// variable adds a variable of the Nimbus namespace, waiting for its first value.
+func (s *OPCUAServer) variable(parent *opcuaNode, path, name string, dataType uint32, valueRank int32, readRole Role, description string) (*opcuaNode, error) {
+	node := opcuaNimbusNode(path, name, opcuaNodeClassVariable)
+	node.typeDef, node.dataType, node.valueRank, node.readRole, node.description = opcuaNodeBaseDataVariableType, dataType, valueRank, readRole, description
+	node.value = opcuaDataValue{Status: opcuaBadWaitingForInitialData}
+	referenceType := uint32(opcuaNodeHasComponent)
+	if parent.typeDef == opcuaNodeFolderType {
+		referenceType = opcuaNodeOrganizes
+	}
+	if !s.space.add(parent, referenceType, node) {
+		return nil, fmt.Errorf("duplicate OPC UA server node %s", path)
+	}
+	return node, nil
+}
+
+// status returns the value of the ServerStatus variable.
+func (s *OPCUAServer) status(now time.Time) *opcuaServerStatus {
+	return &opcuaServerStatus{
+		StartTime:   s.started,
+		CurrentTime: now,
+		BuildInfo: opcuaBuildInfo{
+			ProductURI:       opcuaProductURI,
+			ManufacturerName: "Nimbus",
+			ProductName:      "Nimbus OPC UA server",
+			BuildDate:        s.started,
+		},
+	}
+}
+
+// Add updates the Value variable of a configured series; it makes the server an AnalyticsStage.
+func (s *OPCUAServer) Add(series string, timestamp time.Time, value float64) {
+	if nodes := s.series[series]; nodes != nil {
+		s.space.setValue(nodes.value, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeDouble, Value: value}, SourceTimestamp: timestamp})
+	}
+}
+
+// Evaluate clears the anomaly flags that no anomaly raised in the previous processing cycle and
+// refreshes the health variables.
+func (s *OPCUAServer) Evaluate(now time.Time) {
+	s.stateMutex.Lock()
+	s.cycle++
+	for _, nodes := range s.series {
+		// Stages are evaluated before anomaly detection, so an anomaly found in the previous cycle is
+		// still the latest
+		if nodes.anomalous && nodes.anomalyCycle+1 < s.cycle {
+			nodes.anomalous = false
+			s.space.setValue(nodes.anomaly, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeBoolean, Value: false}, SourceTimestamp: now})
+		}
+	}
+	s.stateMutex.Unlock()
+
+	if s.options.Health == nil {
+		return
+	}
+	for series, nodes := range s.series {
+		health, known := s.options.Health(series)
+		if !known {
+			continue
+		}
+		faults := make([]interface{}, len(health.Faults))
+		for i, fault := range health.Faults {
+			faults[i] = fault
+		}
+		s.space.setValue(nodes.health, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeDouble, Value: health.Score}, SourceTimestamp: now})
+		s.space.setValue(nodes.faults, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeString, Value: faults}, SourceTimestamp: now})
+	}
+}
+
+// ObserveAnomaly raises the anomaly flag of a configured series; pass it to
+// AnalyticsEngine.SetAnomalyObserver.
+func (s *OPCUAServer) ObserveAnomaly(anomaly Anomaly) {
+	nodes := s.series[anomaly.Series]
+	if nodes == nil {
+		return
+	}
+	s.stateMutex.Lock()
+	nodes.anomalous, nodes.anomalyCycle = true, s.cycle
+	s.stateMutex.Unlock()
+	s.space.setValue(nodes.anomaly, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeBoolean, Value: true}, SourceTimestamp: anomaly.Timestamp})
+	s.space.setValue(nodes.zScore, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeDouble, Value: anomaly.ZScore}, SourceTimestamp: anomaly.Timestamp})
+}
+
+// WriteRollups updates the rollup variables of configured series; it makes the server a RollupSink.
+func (s *OPCUAServer) WriteRollups(rollups []Rollup) error {
+	for _, rollup := range rollups {
+		nodes := s.series[rollup.Series]
+		if nodes == nil {
+			continue
+		}
+		for aggregation, node := range nodes.rollups[rollup.Resolution] {
+			if value, exists := rollup.Values[aggregation]; exists {
+				s.space.setValue(node, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeDouble, Value: value}, SourceTimestamp: rollup.End})
+			}
+		}
+	}
+	return nil
+}
+
+// Name identifies the server among alert notifiers.
+func (s *OPCUAServer) Name() string {
+	return "opcua_server"
+}
+
+// Notify updates the alert variables of the alert's source and of "*"; it makes the server an
+// AlertNotifier.
+func (s *OPCUAServer) Notify(ctx context.Context, alert Alert) error {
+	for _, source := range []string{alert.Source, "*"} {
+		nodes := s.alerts[source]
+		if nodes == nil {
+			continue
+		}
+		s.stateMutex.Lock()
+		nodes.received++
+		count := nodes.received
+		s.stateMutex.Unlock()
+		s.space.setValue(nodes.message, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeString, Value: alert.Message}, SourceTimestamp: alert.Timestamp})
+		s.space.setValue(nodes.severity, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeString, Value: string(alert.Severity)}, SourceTimestamp: alert.Timestamp})
+		s.space.setValue(nodes.time, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeDateTime, Value: alert.Timestamp}, SourceTimestamp: alert.Timestamp})
+		s.space.setValue(nodes.count, opcuaDataValue{Value: &opcuaVariant{Type: opcuaTypeUInt32, Value: count}, SourceTimestamp: alert.Timestamp})
+	}
+	return nil
+}
+
+// writeCommand publishes a value written to a command variable on behalf of the session's user, who
+// must hold the command's write role and may publish to its topic.
+func (s *OPCUAServer) writeCommand(command *opcuaCommand, session *opcuaServerSession, variant *opcuaVariant) opcuaStatusCode {
+	value, status := opcuaCommandValue(command.dataType, variant)
+	if status.isBad() {
+		return status
+	}
+	user := session.username()
+	if !s.access.CheckAccess(user, command.writeRole) || !s.access.CheckTopicAccess(user, command.topic, TopicPublish) {
+		s.logger.Printf("OPC UA write of %v to command %s by %s denied\n", value, command.name, user)
+		return opcuaBadUserAccessDenied
+	}
+	now := time.Now()
+	payload, _ := json.Marshal(map[string]interface{}{"value": value, "user": user})
+	envelope := Envelope{Type: MessageCommand, Priority: ClassControl, Timestamp: now, ContentType: opcuaCommandMimeType, Payload: payload}
+	if _, err := s.publish(command.topic, envelope); err != nil {
+		s.logger.Printf("Error publishing OPC UA command %s to %s: %v\n", command.name, command.topic, err)
+		return opcuaBadCommunicationError
+	}
+	s.space.setValue(command.node, opcuaDataValue{Value: &opcuaVariant{Type: command.dataType, Value: value}, SourceTimestamp: now})
+	s.logger.Printf("OPC UA command %s set to %v by %s\n", command.name, value, user)
+	return opcuaGood
+}
+
+// opcuaCommandValue converts a written value to the data type of a command. Numbers convert between
+// numeric types as long as they fit.
+func opcuaCommandValue(dataType byte, variant *opcuaVariant) (interface{}, opcuaStatusCode) {
+	if variant == nil || variant.Value == nil {
+		return nil, opcuaBadTypeMismatch
+	}
+	if _, isArray := variant.Value.([]interface{}); isArray {
+		return nil, opcuaBadTypeMismatch
+	}
+	switch dataType {
+	case opcuaTypeBoolean:
+		if value, ok := variant.Value.(bool); ok {
+			return value, opcuaGood
+		}
+	case opcuaTypeString:
+		if value, ok := variant.Value.(string); ok {
+			return value, opcuaGood
+		}
+	case opcuaTypeDouble, opcuaTypeInt32:
+		if variant.Type == opcuaTypeBoolean {
+			break
+		}
+		number, numeric := opcuaNumber(variant)
+		if !numeric {
+			break
+		}
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, opcuaBadOutOfRange
+		}
+		if dataType == opcuaTypeDouble {
+			return number, opcuaGood
+		}
+		if number != math.Trunc(number) || number < math.MinInt32 || number > math.MaxInt32 {
+			return nil, opcuaBadOutOfRange
+		}
+		return int32(number), opcuaGood
+	}
+	return nil, opcuaBadTypeMismatch
+}
+
+// Serve accepts OPC UA connections on listener until the server is closed.
+func (s *OPCUAServer) Serve(listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return ErrOPCUAServerClosed
+	}
+	s.listeners[listener] = struct{}{}
+	s.mutex.Unlock()
+	s.logger.Printf("OPC UA server listening on %s\n", listener.Addr())
+
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			s.mutex.Lock()
+			closed := s.closed
+			delete(s.listeners, listener)
+			s.mutex.Unlock()
+			if closed {
+				return ErrOPCUAServerClosed
+			}
+			return err
+		}
+		c := &opcuaServerConn{server: s, conn: newOPCUAConn(netConn, s.cert, s.key), remote: netConn.RemoteAddr().String()}
+		s.mutex.Lock()
+		full := s.closed || len(s.conns) >= s.options.MaxConnections
+		if !full {
+			s.conns[c] = struct{}{}
+		}
+		s.mutex.Unlock()
+		if full {
+			c.conn.writeError(opcuaBadTCPNotEnoughResources, "too many connections")
+			netConn.Close()
+			continue
+		}
+		go c.serve()
+	}
+}
+
+// Close stops accepting connections and closes every connection and session.
+func (s *OPCUAServer) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	for c := range s.conns {
+		c.conn.conn.Close()
+	}
+	s.sessions = make(map[string]*opcuaServerSession)
+	s.mutex.Unlock()
+	close(s.stop)
+	<-s.done
+	return nil
+}
+
+// opcuaServerConn is one client connection and its secure channel.
+type opcuaServerConn struct {
+	server *OPCUAServer
+	conn   *opcuaConn
+	remote string
+
+	// Used only by the connection's goroutine
+	opened   bool
+	tokenID  uint32
+	lifetime time.Duration
+}
+
+// opcuaServerReply is a response to send on a connection.
+type opcuaServerReply struct {
+	conn      *opcuaServerConn
+	requestID uint32
+	response  opcuaResponse
+}
+
+// serve runs a connection from HEL to close.
+func (c *opcuaServerConn) serve() {
+	s := c.server
+	defer func() {
+		c.conn.conn.Close()
+		s.mutex.Lock()
+		delete(s.conns, c)
+		for _, session := range s.sessions {
+			session.dropPublishRequests(c)
+		}
+		s.mutex.Unlock()
+	}()
+
+	if err := c.hello(); err != nil {
+		c.fail(err)
+		return
+	}
+	for {
+		deadline := opcuaHelloTimeout
+		if c.opened {
+			deadline = c.lifetime + c.lifetime/4
+		}
+		c.conn.conn.SetReadDeadline(time.Now().Add(deadline))
+		raw, err := c.conn.readMessage()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if raw.aborted != nil {
+			continue
+		}
+		switch raw.messageType {
+		case "OPN":
+			err = c.open(raw)
+		case "CLO":
+			return
+		case "MSG":
+			if !c.opened {
+				err = fmt.Errorf("%w: message before OpenSecureChannel", opcuaBadSecureChannelIDInvalid)
+				break
+			}
+			for _, reply := range c.dispatch(raw) {
+				reply.conn.send(reply.requestID, reply.response)
+			}
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// hello answers the client's HEL with the limits of both sides.
+func (c *opcuaServerConn) hello() error {
+	c.conn.conn.SetReadDeadline(time.Now().Add(opcuaHelloTimeout))
+	messageType, _, _, body, err := c.conn.readFrame()
+	if err != nil {
+		return err
+	}
+	if messageType != "HEL" {
+		return fmt.Errorf("%w: %s before HEL", opcuaBadTCPMessageTypeInvalid, messageType)
+	}
+	var hello opcuaHello
+	d := newOPCUADecoder(body)
+	hello.code(d, true)
+	if d.err != nil {
+		return d.err
+	}
+	if hello.SendBufferSize < opcuaMinBufferSize {
+		return fmt.Errorf("%w: client send buffer of %d bytes", opcuaBadTCPInternalError, hello.SendBufferSize)
+	}
+	if err := c.conn.applyHello(hello); err != nil {
+		return err
+	}
+	ack := localOPCUAHello("")
+	if hello.SendBufferSize < ack.ReceiveBufferSize {
+		ack.ReceiveBufferSize = hello.SendBufferSize
+	}
+	e := newOPCUAEncoder()
+	ack.code(e, false)
+	return c.conn.writeFrame("ACK", e.buf)
+}
+
+// fail tells the client why its connection is being closed, unless the connection itself failed.
+func (c *opcuaServerConn) fail(err error) {
+	var status opcuaStatusCode
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || !errors.As(err, &status) {
+		return
+	}
+	c.server.logger.Printf("Closing OPC UA connection from %s: %v\n", c.remote, err)
+	c.conn.writeError(status, err.Error())
+}
+
+// open issues or renews the security token of the channel.
+func (c *opcuaServerConn) open(raw opcuaRawMessage) error {
+	s := c.server
+	message, err := decodeOPCUAMessage(raw.body)
+	if err != nil {
+		return err
+	}
+	request, ok := message.(*opcuaOpenSecureChannelRequest)
+	if !ok {
+		return fmt.Errorf("%w: %T in an OPN message", opcuaBadTCPMessageTypeInvalid, message)
+	}
+	renew := request.RequestType == 1
+	if renew != c.opened {
+		return fmt.Errorf("%w: unexpected request type %d", opcuaBadSecurityChecksFailed, request.RequestType)
+	}
+	secure := c.conn.secure()
+	if renew {
+		if request.SecurityMode != c.conn.mode {
+			return fmt.Errorf("%w: security mode changed", opcuaBadSecurityModeRejected)
+		}
+	} else {
+		switch {
+		case !secure && request.SecurityMode != opcuaSecurityModeNone, secure && request.SecurityMode != opcuaSecurityModeSign && request.SecurityMode != opcuaSecurityModeSignAndEncrypt:
+			return fmt.Errorf("%w: mode %d with %s", opcuaBadSecurityModeRejected, request.SecurityMode, c.conn.policyURI)
+		case secure && !s.offers(c.conn.policyURI, request.SecurityMode):
+			return fmt.Errorf("%w: %s with mode %d is not offered", opcuaBadSecurityPolicyRejected, c.conn.policyURI, request.SecurityMode)
+		}
+		// Unsecured channels are always accepted for discovery; sessions need an offered endpoint
+		if secure {
+			if err := s.checkClientCertificate(c.conn.remoteCert); err != nil {
+				return err
+			}
+		}
+	}
+	var nonce []byte
+	if secure {
+		if len(request.ClientNonce) != opcuaNonceLength {
+			return fmt.Errorf("%w: client nonce of %d bytes", opcuaBadNonceInvalid, len(request.ClientNonce))
+		}
+		if nonce, err = opcuaRandom(opcuaNonceLength); err != nil {
+			return err
+		}
+	}
+
+	lifetime := time.Duration(request.RequestedLifetime) * time.Millisecond
+	if lifetime <= 0 || lifetime > opcuaTokenLifetime {
+		lifetime = opcuaTokenLifetime
+	}
+	if lifetime < opcuaMinTokenLifetime {
+		lifetime = opcuaMinTokenLifetime
+	}
+	if !renew {
+		s.mutex.Lock()
+		s.channelID++
+		channelID := s.channelID
+		s.mutex.Unlock()
+		c.conn.mutex.Lock()
+		c.conn.mode, c.conn.channelID = request.SecurityMode, channelID
+		c.conn.mutex.Unlock()
+	}
+	c.tokenID++
+	response := &opcuaOpenSecureChannelResponse{
+		Header: opcuaServerResponseHeader(&request.Header, opcuaGood),
+		SecurityToken: opcuaChannelSecurityToken{
+			ChannelID:       c.conn.channelID,
+			TokenID:         c.tokenID,
+			CreatedAt:       time.Now(),
+			RevisedLifetime: uint32(lifetime / time.Millisecond),
+		},
+		ServerNonce: nonce,
+	}
+	body, err := encodeOPCUAMessage(response)
+	if err != nil {
+		return err
+	}
+	// A renewed token is used for sending once the client has used it
+	c.conn.addToken(c.tokenID, lifetime, nonce, request.ClientNonce, !renew)
+	if err := c.conn.writeMessage("OPN", raw.requestID, body); err != nil {
+		return err
+	}
+	c.opened, c.lifetime = true, lifetime
+	return nil
+}
+
+// checkClientCertificate checks the certificate a client opened a secure channel with. It must be one
+// of the trusted certificates or be signed by one of the client CAs.
+func (s *OPCUAServer) checkClientCertificate(cert *x509.Certificate) error {
+	if now := time.Now(); now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("%w: client certificate is valid from %s to %s", opcuaBadCertificateTimeInvalid, cert.NotBefore.Format(time.RFC3339), cert.NotAfter.Format(time.RFC3339))
+	}
+	for _, trusted := range s.trusted {
+		if bytes.Equal(trusted, cert.Raw) {
+			return nil
+		}
+	}
+	digest := sha1.Sum(cert.Raw)
+	thumbprint := hex.EncodeToString(digest[:])
+	if s.options.ClientCAs == nil {
+		return fmt.Errorf("%w: client certificate %s (SHA-1 %s) is not trusted", opcuaBadCertificateUntrusted, cert.Subject, thumbprint)
+	}
+	// OPC UA application certificates need not carry the TLS client usage
+	options := x509.VerifyOptions{Roots: s.options.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}
+	if _, err := cert.Verify(options); err != nil {
+		return fmt.Errorf("%w: client certificate %s (SHA-1 %s): %v", opcuaBadCertificateUntrusted, cert.Subject, thumbprint, err)
+	}
+	return nil
+}
+
+// opcuaRandom returns n random bytes.
+func opcuaRandom(n int) ([]byte, error) {
+	data := make([]byte, n)
+	_, err := rand.Read(data)
+	return data, err
+}
+
+// opcuaServerResponseHeader returns the header of a response to a request.
+func opcuaServerResponseHeader(request *opcuaRequestHeader, status opcuaStatusCode) opcuaResponseHeader {
+	return opcuaResponseHeader{Timestamp: time.Now(), RequestHandle: request.RequestHandle, ServiceResult: status}
+}
+
+// opcuaFault returns the response to a request that failed as a whole.
+func opcuaFault(request *opcuaRequestHeader, status opcuaStatusCode) *opcuaServiceFault {
+	return &opcuaServiceFault{Header: opcuaServerResponseHeader(request, status)}
+}
+
+// opcuaRequestHandle reads the request handle of a request that could not be decoded, so the fault can
+// be matched to it.
+func opcuaRequestHandle(body []byte) uint32 {
+	d := newOPCUADecoder(body)
+	var typeID opcuaNodeID
+	var header opcuaRequestHeader
+	d.nodeID(&typeID)
+	d.nodeID(&header.AuthenticationToken)
+	d.dateTime(&header.Timestamp)
+	d.uint32(&header.RequestHandle)
+	return header.RequestHandle
+}
+
+// send sends a response, or a fault when the response cannot be sent.
+func (c *opcuaServerConn) send(requestID uint32, response opcuaResponse) {
+	body, err := encodeOPCUAMessage(response)
+	if err == nil {
+		err = c.conn.writeMessage("MSG", requestID, body)
+	}
+	if err == nil {
+		return
+	}
+	status := opcuaBadEncodingError
+	if errors.Is(err, opcuaBadRequestTooLarge) {
+		status = opcuaBadResponseTooLarge
+	} else if !errors.Is(err, errOPCUADecode) {
+		// Writing failed; the reader notices the closed connection
+		c.conn.conn.Close()
+		return
+	}
+	fault := &opcuaServiceFault{Header: *response.responseHeader()}
+	fault.Header.ServiceResult = status
+	if body, err = encodeOPCUAMessage(fault); err == nil {
+		c.conn.writeMessage("MSG", requestID, body)
+	}
+}
+
+// dispatch serves a service request and returns the responses to send. A Publish request may be
+// answered later; answering it can release responses to other Publish requests.
+func (c *opcuaServerConn) dispatch(raw opcuaRawMessage) []opcuaServerReply {
+	s := c.server
+	reply := func(response opcuaResponse) []opcuaServerReply {
+		return []opcuaServerReply{{conn: c, requestID: raw.requestID, response: response}}
+	}
+	message, err := decodeOPCUAMessage(raw.body)
+	if err != nil {
+		status := opcuaBadDecodingError
+		errors.As(err, &status)
+		return reply(&opcuaServiceFault{Header: opcuaResponseHeader{Timestamp: time.Now(), RequestHandle: opcuaRequestHandle(raw.body), ServiceResult: status}})
+	}
+	request, ok := message.(opcuaRequest)
+	if !ok {
+		return reply(&opcuaServiceFault{Header: opcuaResponseHeader{Timestamp: time.Now(), RequestHandle: opcuaRequestHandle(raw.body), ServiceResult: opcuaBadServiceUnsupported}})
+	}
+
+	switch request := request.(type) {
+	case *opcuaGetEndpointsRequest:
+		return reply(&opcuaGetEndpointsResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Endpoints: s.endpoints(request.EndpointURL)})
+	case *opcuaCreateSessionRequest:
+		return reply(s.createSession(c, request))
+	case *opcuaActivateSessionRequest:
+		return reply(s.activateSession(c, request))
+	case *opcuaCloseSessionRequest:
+		return append(s.closeSession(c, request), reply(&opcuaCloseSessionResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood)})...)
+	}
+
+	header := request.requestHeader()
+	session, status := s.session(c, header)
+	if status.isBad() {
+		return reply(opcuaFault(header, status))
+	}
+	switch request := request.(type) {
+	case *opcuaBrowseRequest:
+		return reply(s.browse(session, request))
+	case *opcuaBrowseNextRequest:
+		return reply(s.browseNext(session, request))
+	case *opcuaReadRequest:
+		return reply(s.read(session, request))
+	case *opcuaWriteRequest:
+		return reply(s.write(session, request))
+	case *opcuaCreateSubscriptionRequest:
+		return reply(s.createSubscription(session, request))
+	case *opcuaCreateMonitoredItemsRequest:
+		return reply(s.createMonitoredItems(session, request))
+	case *opcuaDeleteMonitoredItemsRequest:
+		return reply(s.deleteMonitoredItems(session, request))
+	case *opcuaDeleteSubscriptionsRequest:
+		return s.deleteSubscriptions(c, raw.requestID, session, request)
+	case *opcuaPublishRequest:
+		return s.publishRequest(c, raw.requestID, session, request)
+	case *opcuaRepublishRequest:
+		return reply(s.republish(session, request))
+	}
+	return reply(opcuaFault(header, opcuaBadServiceUnsupported))
+}
+
+// endpoints describes the offered endpoints at the URL a client used.
+func (s *OPCUAServer) endpoints(endpointURL string) []opcuaEndpointDescription {
+	var endpoints []opcuaEndpointDescription
+	for _, offered := range s.security {
+		endpoints = append(endpoints, opcuaEndpointDescription{
+			EndpointURL: endpointURL,
+			Server: opcuaApplicationDescription{
+				ApplicationURI:  s.applicationURI,
+				ProductURI:      opcuaProductURI,
+				ApplicationName: opcuaLocalizedText{Text: "Nimbus"},
+				DiscoveryURLs:   []string{endpointURL},
+			},
+			ServerCertificate: s.cert,
+			SecurityMode:      offered.mode,
+			SecurityPolicyURI: offered.policyURI,
+			// Passwords are always encrypted for the server's certificate, even over unsecured channels
+			UserIdentityTokens:  []opcuaUserTokenPolicy{{PolicyID: opcuaUserTokenPolicyID, TokenType: opcuaTokenUserName, SecurityPolicyURI: opcuaPolicyBasic256Sha256}},
+			TransportProfileURI: opcuaTransportProfile,
+			SecurityLevel:       byte(offered.mode),
+		})
+	}
+	return endpoints
+}
+
+// opcuaServerSession is a session created by a client. Apart from the identity, its fields are guarded
+// by the server's mutex.
+type opcuaServerSession struct {
+	server     *OPCUAServer
+	id         opcuaNodeID
+	authToken  opcuaNodeID
+	name       string
+	conn       *opcuaServerConn // Connection the session was last activated on
+	clientCert []byte
+	nonce      []byte
+	timeout    time.Duration
+	lastUsed   time.Time
+	activated  bool
+
+	continuations map[string][]opcuaReferenceDescription // Remaining browse results by continuation point
+	browseLimit   map[string]int                         // References per result of each continuation point
+	subscriptions map[uint32]*opcuaSubscription
+	items         int // Monitored items of all subscriptions
+	publishQueue  []*opcuaPublishSlot
+	statusChanges []opcuaStatusChange // Ended subscriptions to report on the next Publish requests
+
+	identityMutex sync.Mutex // Guards user and roles, which services read without the server's mutex
+	user          string
+	roles         map[Role]bool // Outcomes of AccessControl.CheckAccess for user
+	rolesVersion  uint64        // AccessControl.RulesVersion the roles were checked at
+}
+
+// username returns the user the session was activated by.
+func (ss *opcuaServerSession) username() string {
+	ss.identityMutex.Lock()
+	defer ss.identityMutex.Unlock()
+	return ss.user
+}
+
+// allowed reports whether the session's user holds a role. Results are cached until the access rules
+// change, as every check is logged and audited.
+func (ss *opcuaServerSession) allowed(role Role) bool {
+	if role == "" {
+		return true
+	}
+	ss.identityMutex.Lock()
+	defer ss.identityMutex.Unlock()
+	access := ss.server.access
+	if version := access.RulesVersion(); version != ss.rolesVersion {
+		ss.roles, ss.rolesVersion = make(map[Role]bool), version
+	}
+	granted, cached := ss.roles[role]
+	if !cached {
+		granted = access.CheckAccess(ss.user, role)
+		ss.roles[role] = granted
+	}
+	return granted
+}
+
+// session returns the activated session a request names, which must be bound to the connection.
+func (s *OPCUAServer) session(c *opcuaServerConn, header *opcuaRequestHeader) (*opcuaServerSession, opcuaStatusCode) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session := s.sessions[header.AuthenticationToken.String()]
+	switch {
+	case session == nil:
+		return nil, opcuaBadSessionIDInvalid
+	case !session.activated:
+		return nil, opcuaBadSessionNotActivated
+	case session.conn != c:
+		return nil, opcuaBadSecureChannelIDInvalid
+	}
+	session.lastUsed = time.Now()
+	return session, opcuaGood
+}
+
+// createSession creates a session, proving the server holds its certificate's key.
+func (s *OPCUAServer) createSession(c *opcuaServerConn, request *opcuaCreateSessionRequest) opcuaResponse {
+	if !s.offers(c.conn.policyURI, c.conn.mode) {
+		return opcuaFault(&request.Header, opcuaBadSecurityPolicyRejected)
+	}
+	secure := c.conn.secure()
+	if secure {
+		if len(request.ClientNonce) < opcuaNonceLength {
+			return opcuaFault(&request.Header, opcuaBadNonceInvalid)
+		}
+		if certs, err := x509.ParseCertificates(request.ClientCertificate); err != nil || len(certs) == 0 || !bytes.Equal(certs[0].Raw, c.conn.remoteCertDER) {
+			return opcuaFault(&request.Header, opcuaBadCertificateInvalid)
+		}
+	}
+	timeout := time.Duration(request.RequestedSessionTimeout * float64(time.Millisecond))
+	if timeout <= 0 || timeout > s.options.MaxSessionTimeout {
+		timeout = s.options.MaxSessionTimeout
+	}
+	if timeout < opcuaMinSessionTimeout {
+		timeout = opcuaMinSessionTimeout
+	}
+	nonce, err := opcuaRandom(opcuaNonceLength)
+	if err != nil {
+		return opcuaFault(&request.Header, opcuaBadInternalError)
+	}
+	guid, err := opcuaRandom(16)
+	if err != nil {
+		return opcuaFault(&request.Header, opcuaBadInternalError)
+	}
+	token, err := opcuaRandom(32)
+	if err != nil {
+		return opcuaFault(&request.Header, opcuaBadInternalError)
+	}
+	response := &opcuaCreateSessionResponse{
+		Header:                opcuaServerResponseHeader(&request.Header, opcuaGood),
+		SessionID:             opcuaNodeID{Namespace: opcuaNimbusNamespace, Type: opcuaGUIDID, Bytes: guid},
+		AuthenticationToken:   opcuaNodeID{Type: opcuaOpaqueID, Bytes: token},
+		RevisedSessionTimeout: float64(timeout / time.Millisecond),
+		ServerNonce:           nonce,
+		ServerCertificate:     s.cert,
+		ServerEndpoints:       s.endpoints(request.EndpointURL),
+		MaxRequestMessageSize: opcuaMaxMessageSize,
+	}
+	if secure {
+		digest := sha256.Sum256(append(append([]byte(nil), request.ClientCertificate...), request.ClientNonce...))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+		if err != nil {
+			return opcuaFault(&request.Header, opcuaBadInternalError)
+		}
+		response.ServerSignature = opcuaSignatureData{Algorithm: opcuaAlgorithmRSASHA256, Signature: signature}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sessions) >= s.options.MaxSessions {
+		return opcuaFault(&request.Header, opcuaBadTooManySessions)
+	}
+	s.sessions[response.AuthenticationToken.String()] = &opcuaServerSession{
+		server:        s,
+		id:            response.SessionID,
+		authToken:     response.AuthenticationToken,
+		name:          request.SessionName,
+		conn:          c,
+		clientCert:    c.conn.remoteCertDER,
+		nonce:         nonce,
+		timeout:       timeout,
+		lastUsed:      time.Now(),
+		continuations: make(map[string][]opcuaReferenceDescription),
+		browseLimit:   make(map[string]int),
+		subscriptions: make(map[uint32]*opcuaSubscription),
+		roles:         make(map[Role]bool),
+	}
+	return response
+}
+
+// activateSession logs a user into a session, or moves an activated session to a new channel. Only
+// encrypted username tokens are accepted, and the user must hold at least the guest role.
+func (s *OPCUAServer) activateSession(c *opcuaServerConn, request *opcuaActivateSessionRequest) opcuaResponse {
+	s.mutex.Lock()
+	session := s.sessions[request.Header.AuthenticationToken.String()]
+	var nonce []byte
+	if session != nil {
+		nonce = session.nonce
+	}
+	s.mutex.Unlock()
+	if session == nil {
+		return opcuaFault(&request.Header, opcuaBadSessionIDInvalid)
+	}
+	if session.conn != c && !bytes.Equal(session.clientCert, c.conn.remoteCertDER) {
+		return opcuaFault(&request.Header, opcuaBadSecurityChecksFailed)
+	}
+	if c.conn.secure() {
+		digest := sha256.Sum256(append(append([]byte(nil), s.cert...), nonce...))
+		if request.ClientSignature.Algorithm != opcuaAlgorithmRSASHA256 || rsa.VerifyPKCS1v15(c.conn.remoteKey(), crypto.SHA256, digest[:], request.ClientSignature.Signature) != nil {
+			return opcuaFault(&request.Header, opcuaBadApplicationSignatureInvalid)
+		}
+	}
+
+	decoded, err := decodeOPCUAExtensionObject(request.UserIdentityToken)
+	token, isUserName := decoded.(*opcuaUserNameIdentityToken)
+	if err != nil || !isUserName || token.PolicyID != opcuaUserTokenPolicyID || token.EncryptionAlgorithm != opcuaAlgorithmRSAOAEP {
+		return opcuaFault(&request.Header, opcuaBadIdentityTokenInvalid)
+	}
+	password, ok := s.decryptPassword(token.Password, nonce)
+	if !ok {
+		return opcuaFault(&request.Header, opcuaBadIdentityTokenInvalid)
+	}
+	if !s.options.Authenticate(token.UserName, password) {
+		s.logger.Printf("OPC UA login as %s from %s failed\n", token.UserName, c.remote)
+		return opcuaFault(&request.Header, opcuaBadIdentityTokenRejected)
+	}
+	if !s.access.CheckAccess(token.UserName, GuestRole) {
+		return opcuaFault(&request.Header, opcuaBadUserAccessDenied)
+	}
+	next, err := opcuaRandom(opcuaNonceLength)
+	if err != nil {
+		return opcuaFault(&request.Header, opcuaBadInternalError)
+	}
+
+	s.mutex.Lock()
+	if s.sessions[session.authToken.String()] != session {
+		s.mutex.Unlock()
+		return opcuaFault(&request.Header, opcuaBadSessionClosed)
+	}
+	if session.conn != c {
+		session.dropPublishRequests(session.conn)
+	}
+	session.conn, session.nonce, session.activated, session.lastUsed = c, next, true, time.Now()
+	s.mutex.Unlock()
+	session.identityMutex.Lock()
+	if session.user != token.UserName {
+		session.user, session.roles = token.UserName, make(map[Role]bool)
+	}
+	session.identityMutex.Unlock()
+	s.logger.Printf("OPC UA session %q activated by %s from %s\n", session.name, token.UserName, c.remote)
+	return &opcuaActivateSessionResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), ServerNonce: next}
+}
+
+// decryptPassword decrypts a password encrypted with RSA-OAEP for the server's key, checking that the
+// server nonce follows it.
+func (s *OPCUAServer) decryptPassword(encrypted, nonce []byte) ([]byte, bool) {
+	blockSize := s.key.Size()
+	if len(encrypted) == 0 || len(encrypted)%blockSize != 0 {
+		return nil, false
+	}
+	var plain []byte
+	for i := 0; i < len(encrypted); i += blockSize {
+		block, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, s.key, encrypted[i:i+blockSize], nil)
+		if err != nil {
+			return nil, false
+		}
+		plain = append(plain, block...)
+	}
+	if len(plain) < 4 || int(binary.LittleEndian.Uint32(plain)) != len(plain)-4 || len(plain)-4 < len(nonce) {
+		return nil, false
+	}
+	secret := plain[4:]
+	if !bytes.Equal(secret[len(secret)-len(nonce):], nonce) {
+		return nil, false
+	}
+	return secret[:len(secret)-len(nonce)], true
+}
+
+// closeSession closes a session and answers its waiting Publish requests.
+func (s *OPCUAServer) closeSession(c *opcuaServerConn, request *opcuaCloseSessionRequest) []opcuaServerReply {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := request.Header.AuthenticationToken.String()
+	session := s.sessions[key]
+	if session == nil || session.conn != c {
+		return nil
+	}
+	delete(s.sessions, key)
+	return session.answerPublishRequests(opcuaBadSessionClosed)
+}
+
+// browse lists the references of nodes, keeping a continuation point for results beyond the requested
+// number of references.
+func (s *OPCUAServer) browse(session *opcuaServerSession, request *opcuaBrowseRequest) opcuaResponse {
+	switch {
+	case !request.ViewID.isNull():
+		return opcuaFault(&request.Header, opcuaBadViewIDUnknown)
+	case len(request.NodesToBrowse) == 0:
+		return opcuaFault(&request.Header, opcuaBadNothingToDo)
+	case len(request.NodesToBrowse) > opcuaMaxOperations:
+		return opcuaFault(&request.Header, opcuaBadTooManyOperations)
+	}
+	limit := int(request.RequestedMaxReferencesPerNode)
+	response := &opcuaBrowseResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaBrowseResult, len(request.NodesToBrowse))}
+	for i := range request.NodesToBrowse {
+		references, status := s.space.browse(&request.NodesToBrowse[i])
+		response.Results[i] = s.browseResult(session, references, status, limit)
+	}
+	return response
+}
+
+// browseResult returns up to limit references, keeping the rest behind a continuation point.
+func (s *OPCUAServer) browseResult(session *opcuaServerSession, references []opcuaReferenceDescription, status opcuaStatusCode, limit int) opcuaBrowseResult {
+	if status.isBad() || limit <= 0 || len(references) <= limit {
+		return opcuaBrowseResult{Status: status, References: references}
+	}
+	point, err := opcuaRandom(16)
+	if err != nil {
+		return opcuaBrowseResult{Status: opcuaBadInternalError}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(session.continuations) >= opcuaMaxContinuations {
+		return opcuaBrowseResult{Status: opcuaBadNoContinuationPoints}
+	}
+	session.continuations[string(point)] = references[limit:]
+	session.browseLimit[string(point)] = limit
+	return opcuaBrowseResult{Status: opcuaGood, ContinuationPoint: point, References: references[:limit]}
+}
+
+// browseNext continues or releases browses.
+func (s *OPCUAServer) browseNext(session *opcuaServerSession, request *opcuaBrowseNextRequest) opcuaResponse {
+	if len(request.ContinuationPoints) == 0 {
+		return opcuaFault(&request.Header, opcuaBadNothingToDo)
+	}
+	response := &opcuaBrowseNextResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaBrowseResult, len(request.ContinuationPoints))}
+	for i, point := range request.ContinuationPoints {
+		s.mutex.Lock()
+		references, exists := session.continuations[string(point)]
+		limit := session.browseLimit[string(point)]
+		delete(session.continuations, string(point))
+		delete(session.browseLimit, string(point))
+		s.mutex.Unlock()
+		switch {
+		case !exists:
+			response.Results[i].Status = opcuaBadContinuationPointInvalid
+		case !request.ReleaseContinuationPoints:
+			response.Results[i] = s.browseResult(session, references, opcuaGood, limit)
+		}
+	}
+	return response
+}
+
+// read reads attributes of nodes.
+func (s *OPCUAServer) read(session *opcuaServerSession, request *opcuaReadRequest) opcuaResponse {
+	switch {
+	case request.MaxAge < 0 || math.IsNaN(request.MaxAge):
+		return opcuaFault(&request.Header, opcuaBadMaxAgeInvalid)
+	case request.TimestampsToReturn < opcuaTimestampsSource || request.TimestampsToReturn > opcuaTimestampsNeither:
+		return opcuaFault(&request.Header, opcuaBadTimestampsToReturnInvalid)
+	case len(request.NodesToRead) == 0:
+		return opcuaFault(&request.Header, opcuaBadNothingToDo)
+	case len(request.NodesToRead) > opcuaMaxOperations:
+		return opcuaFault(&request.Header, opcuaBadTooManyOperations)
+	}
+	now := time.Now()
+	response := &opcuaReadResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaDataValue, len(request.NodesToRead))}
+	for i := range request.NodesToRead {
+		response.Results[i] = s.readAttribute(session, &request.NodesToRead[i], request.TimestampsToReturn, now)
+	}
+	return response
+}
+
+// readAttribute reads one attribute; values carry the timestamps asked for.
+func (s *OPCUAServer) readAttribute(session *opcuaServerSession, id *opcuaReadValueID, timestamps int32, now time.Time) opcuaDataValue {
+	node := s.space.node(id.NodeID)
+	switch {
+	case node == nil:
+		return opcuaDataValue{Status: opcuaBadNodeIDUnknown}
+	case id.IndexRange != "":
+		return opcuaDataValue{Status: opcuaBadIndexRangeInvalid}
+	case id.DataEncoding.Name != "" && id.DataEncoding.Name != "Default Binary":
+		return opcuaDataValue{Status: opcuaBadDataEncodingUnsupported}
+	}
+	value := s.space.read(session, node, id.AttributeID, now)
+	if id.AttributeID != opcuaAttributeValue {
+		return value
+	}
+	return opcuaWithTimestamps(value, timestamps)
+}
+
+// write writes the values of command variables, the only writable attributes.
+func (s *OPCUAServer) write(session *opcuaServerSession, request *opcuaWriteRequest) opcuaResponse {
+	switch {
+	case len(request.NodesToWrite) == 0:
+		return opcuaFault(&request.Header, opcuaBadNothingToDo)
+	case len(request.NodesToWrite) > opcuaMaxOperations:
+		return opcuaFault(&request.Header, opcuaBadTooManyOperations)
+	}
+	response := &opcuaWriteResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaStatusCode, len(request.NodesToWrite))}
+	for i := range request.NodesToWrite {
+		write := &request.NodesToWrite[i]
+		node := s.space.node(write.NodeID)
+		switch {
+		case node == nil:
+			response.Results[i] = opcuaBadNodeIDUnknown
+		case write.AttributeID != opcuaAttributeValue || node.write == nil:
+			response.Results[i] = opcuaBadNotWritable
+		case write.IndexRange != "":
+			response.Results[i] = opcuaBadIndexRangeInvalid
+		case write.Value.Status != opcuaGood || !write.Value.SourceTimestamp.IsZero() || !write.Value.ServerTimestamp.IsZero():
+			response.Results[i] = opcuaBadWriteNotSupported
+		default:
+			response.Results[i] = node.write(session, write.Value.Value)
+		}
+	}
+	return response
+}
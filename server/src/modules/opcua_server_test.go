@@ -0,0 +1,230 @@
+// server/src/modules/opcua_server_test.go
+
+package modules
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testAuthority issues application instance certificates for tests.
+type testAuthority struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testAuthority{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate for the application URI, signed by the authority or, when it is nil,
+// self-signed.
+func (a *testAuthority) issue(t *testing.T, applicationURI string) *tls.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse(applicationURI)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: applicationURI},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+		URIs:         []*url.URL{uri},
+	}
+	parent, signer := template, key
+	if a != nil {
+		parent, signer = a.cert, a.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTestOPCUAServer serves an OPC UA server offering both Basic256Sha256 modes and returns its URL.
+func startTestOPCUAServer(t *testing.T, cert *tls.Certificate, clientCAs *x509.CertPool, trusted ...string) string {
+	t.Helper()
+	options := DefaultOPCUAServerOptions()
+	options.Certificate = cert
+	options.ClientCAs = clientCAs
+	options.Authenticate = func(string, []byte) bool { return false }
+	config := OPCUAFacadeConfig{
+		Security:            []string{"None", "Basic256Sha256/Sign", "Basic256Sha256/SignAndEncrypt"},
+		TrustedCertificates: trusted,
+	}
+	logger := log.New(io.Discard, "", 0)
+	server, err := NewOPCUAServer(options, config, NewAccessControl(logger, nil), nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return "opc.tcp://" + listener.Addr().String()
+}
+
+// openTestChannel discovers the endpoint configured for the client's server, opens a secure channel to
+// it and makes a request over the channel.
+func openTestChannel(client *OPCUAClient) error {
+	ctx := context.Background()
+	for _, source := range client.sources {
+		endpoint, err := client.discover(ctx, source)
+		if err != nil {
+			return err
+		}
+		channel, err := dialOPCUAChannel(ctx, source.config.EndpointURL, source.policyURI, source.mode, client.identity.cert, client.identity.key, endpoint.ServerCertificate, source.timeout, client.logger)
+		if err != nil {
+			return err
+		}
+		defer channel.close()
+		response, err := channel.request(ctx, &opcuaGetEndpointsRequest{EndpointURL: source.config.EndpointURL})
+		if err != nil {
+			return err
+		}
+		if endpoints, ok := response.(*opcuaGetEndpointsResponse); !ok || len(endpoints.Endpoints) != 3 {
+			return errors.New("unexpected GetEndpoints response over the secure channel")
+		}
+	}
+	return nil
+}
+
+// writeTestCertificate writes the DER of a certificate to a file and returns its path.
+func writeTestCertificate(t *testing.T, cert *tls.Certificate) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cert.der")
+	if err := os.WriteFile(path, cert.Certificate[0], 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestOPCUASecureChannelHandshake(t *testing.T) {
+	authority := newTestAuthority(t)
+	serverCert := authority.issue(t, "urn:nimbus:server")
+	clientCert := authority.issue(t, opcuaApplicationURI)
+	url := startTestOPCUAServer(t, serverCert, authority.pool)
+
+	for _, mode := range []string{"Sign", "SignAndEncrypt"} {
+		config := OPCUAServerConfig{Name: "nimbus", EndpointURL: url, SecurityPolicy: "Basic256Sha256", SecurityMode: mode, Timeout: "3s", Browse: []OPCUABrowseConfig{{}}}
+		client, err := NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, clientCert, authority.pool, func([]Sample) {}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := openTestChannel(client); err != nil {
+			t.Errorf("Basic256Sha256/%s: %v", mode, err)
+		}
+	}
+}
+
+func TestOPCUAServerRefusesUntrustedClients(t *testing.T) {
+	authority := newTestAuthority(t)
+	serverCert := authority.issue(t, "urn:nimbus:server")
+	stranger := (*testAuthority)(nil).issue(t, opcuaApplicationURI)
+	config := OPCUAServerConfig{Name: "nimbus", SecurityPolicy: "Basic256Sha256", Timeout: "3s", Browse: []OPCUABrowseConfig{{}}}
+
+	config.EndpointURL = startTestOPCUAServer(t, serverCert, authority.pool)
+	client, err := NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, stranger, authority.pool, func([]Sample) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := openTestChannel(client); !errors.Is(err, opcuaBadCertificateUntrusted) {
+		t.Fatalf("client certificate from another issuer: %v", err)
+	}
+
+	// Listing the certificate trusts it whatever signed it
+	config.EndpointURL = startTestOPCUAServer(t, serverCert, nil, writeTestCertificate(t, stranger))
+	client, err = NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, stranger, authority.pool, func([]Sample) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := openTestChannel(client); err != nil {
+		t.Fatalf("trusted client certificate refused: %v", err)
+	}
+
+	options := DefaultOPCUAServerOptions()
+	options.Certificate = serverCert
+	if _, err := NewOPCUAServer(options, OPCUAFacadeConfig{}, NewAccessControl(log.New(io.Discard, "", 0), nil), nil, log.New(io.Discard, "", 0)); err == nil {
+		t.Fatal("server started with secure endpoints and no way to verify clients")
+	}
+}
+
+func TestOPCUAClientRefusesUntrustedServers(t *testing.T) {
+	authority := newTestAuthority(t)
+	clientCert := authority.issue(t, opcuaApplicationURI)
+	serverCert := (*testAuthority)(nil).issue(t, "urn:nimbus:server")
+	config := OPCUAServerConfig{Name: "nimbus", EndpointURL: startTestOPCUAServer(t, serverCert, authority.pool), SecurityPolicy: "Basic256Sha256", Timeout: "3s", Browse: []OPCUABrowseConfig{{}}}
+
+	client, err := NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, clientCert, authority.pool, func([]Sample) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := openTestChannel(client); !errors.Is(err, opcuaBadCertificateUntrusted) {
+		t.Fatalf("server certificate from another issuer: %v", err)
+	}
+
+	// A pinned certificate needs no CA
+	config.ServerCertificate = writeTestCertificate(t, serverCert)
+	client, err = NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, clientCert, nil, func([]Sample) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := openTestChannel(client); err != nil {
+		t.Fatalf("pinned server certificate refused: %v", err)
+	}
+	config.ServerCertificate = writeTestCertificate(t, authority.issue(t, "urn:nimbus:server"))
+	client, err = NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, clientCert, authority.pool, func([]Sample) {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := openTestChannel(client); !errors.Is(err, opcuaBadCertificateUntrusted) {
+		t.Fatalf("server certificate other than the pinned one: %v", err)
+	}
+
+	config.ServerCertificate = ""
+	if _, err := NewOPCUAClient(log.New(io.Discard, "", 0), []OPCUAServerConfig{config}, clientCert, nil, func([]Sample) {}, nil); err == nil {
+		t.Fatal("client created for a secured server it cannot verify")
+	}
+}
@@ -0,0 +1,1264 @@
+// server/src/modules/opcua_services.go
+
+package modules
+
+import (
+	"fmt"
+	"time"
+)
+
+// Node IDs of the default binary encodings of the services and structures used here
+const (
+	opcuaIDAnonymousIdentityToken       = 321
+	opcuaIDUserNameIdentityToken        = 324
+	opcuaIDX509IdentityToken            = 327
+	opcuaIDServiceFault                 = 397
+	opcuaIDGetEndpointsRequest          = 428
+	opcuaIDGetEndpointsResponse         = 431
+	opcuaIDOpenSecureChannelRequest     = 446
+	opcuaIDOpenSecureChannelResponse    = 449
+	opcuaIDCloseSecureChannelRequest    = 452
+	opcuaIDCloseSecureChannelResponse   = 455
+	opcuaIDCreateSessionRequest         = 461
+	opcuaIDCreateSessionResponse        = 464
+	opcuaIDActivateSessionRequest       = 467
+	opcuaIDActivateSessionResponse      = 470
+	opcuaIDCloseSessionRequest          = 473
+	opcuaIDCloseSessionResponse         = 476
+	opcuaIDBrowseRequest                = 527
+	opcuaIDBrowseResponse               = 530
+	opcuaIDBrowseNextRequest            = 533
+	opcuaIDBrowseNextResponse           = 536
+	opcuaIDReadRequest                  = 631
+	opcuaIDReadResponse                 = 634
+	opcuaIDWriteRequest                 = 673
+	opcuaIDWriteResponse                = 676
+	opcuaIDDataChangeFilter             = 724
+	opcuaIDCreateMonitoredItemsRequest  = 751
+	opcuaIDCreateMonitoredItemsResponse = 754
+	opcuaIDDeleteMonitoredItemsRequest  = 781
+	opcuaIDDeleteMonitoredItemsResponse = 784
+	opcuaIDCreateSubscriptionRequest    = 787
+	opcuaIDCreateSubscriptionResponse   = 790
+	opcuaIDDataChangeNotification       = 811
+	opcuaIDStatusChangeNotification     = 820
+	opcuaIDPublishRequest               = 826
+	opcuaIDPublishResponse              = 829
+	opcuaIDRepublishRequest             = 832
+	opcuaIDRepublishResponse            = 835
+	opcuaIDDeleteSubscriptionsRequest   = 847
+	opcuaIDDeleteSubscriptionsResponse  = 850
+	opcuaIDServerStatusDataType         = 864
+	opcuaIDEventNotificationList        = 916
+)
+
+// Well-known nodes of the standard address space
+const (
+	opcuaNodeObjectsFolder          = 85
+	opcuaNodeHierarchicalReferences = 33
+	opcuaNodeOrganizes              = 35
+	opcuaNodeHasComponent           = 47
+	opcuaNodeHasProperty            = 46
+	opcuaNodeHasTypeDefinition      = 40
+	opcuaNodeFolderType             = 61
+	opcuaNodeBaseDataVariableType   = 63
+	opcuaNodeServer                 = 2253
+)
+
+// Attribute IDs
+const (
+	opcuaAttributeNodeID                  = 1
+	opcuaAttributeNodeClass               = 2
+	opcuaAttributeBrowseName              = 3
+	opcuaAttributeDisplayName             = 4
+	opcuaAttributeDescription             = 5
+	opcuaAttributeWriteMask               = 6
+	opcuaAttributeUserWriteMask           = 7
+	opcuaAttributeIsAbstract              = 8
+	opcuaAttributeSymmetric               = 9
+	opcuaAttributeInverseName             = 10
+	opcuaAttributeEventNotifier           = 12
+	opcuaAttributeValue                   = 13
+	opcuaAttributeDataType                = 14
+	opcuaAttributeValueRank               = 15
+	opcuaAttributeArrayDimensions         = 16
+	opcuaAttributeAccessLevel             = 17
+	opcuaAttributeUserAccessLevel         = 18
+	opcuaAttributeMinimumSamplingInterval = 19
+	opcuaAttributeHistorizing             = 20
+)
+
+// Node classes, as browse masks
+const (
+	opcuaNodeClassObject        = 1
+	opcuaNodeClassVariable      = 2
+	opcuaNodeClassObjectType    = 8
+	opcuaNodeClassVariableType  = 16
+	opcuaNodeClassReferenceType = 32
+	opcuaNodeClassDataType      = 64
+)
+
+// Message security modes
+const (
+	opcuaSecurityModeNone           = 1
+	opcuaSecurityModeSign           = 2
+	opcuaSecurityModeSignAndEncrypt = 3
+)
+
+// User identity token types
+const (
+	opcuaTokenAnonymous   = 0
+	opcuaTokenUserName    = 1
+	opcuaTokenCertificate = 2
+)
+
+// Timestamps to return with values
+const (
+	opcuaTimestampsSource  = 0
+	opcuaTimestampsServer  = 1
+	opcuaTimestampsBoth    = 2
+	opcuaTimestampsNeither = 3
+)
+
+// opcuaMessage is a service request or response, or a structure carried in an extension object.
+type opcuaMessage interface {
+	encodingID() uint32
+	code(c *opcuaCodec)
+}
+
+// opcuaRequest is a service request.
+type opcuaRequest interface {
+	opcuaMessage
+	requestHeader() *opcuaRequestHeader
+}
+
+// opcuaResponse is a service response.
+type opcuaResponse interface {
+	opcuaMessage
+	responseHeader() *opcuaResponseHeader
+}
+
+// opcuaMessageTypes creates an empty message for each encoding this package decodes.
+var opcuaMessageTypes = map[uint32]func() opcuaMessage{
+	opcuaIDServiceFault:                 func() opcuaMessage { return &opcuaServiceFault{} },
+	opcuaIDGetEndpointsRequest:          func() opcuaMessage { return &opcuaGetEndpointsRequest{} },
+	opcuaIDGetEndpointsResponse:         func() opcuaMessage { return &opcuaGetEndpointsResponse{} },
+	opcuaIDOpenSecureChannelRequest:     func() opcuaMessage { return &opcuaOpenSecureChannelRequest{} },
+	opcuaIDOpenSecureChannelResponse:    func() opcuaMessage { return &opcuaOpenSecureChannelResponse{} },
+	opcuaIDCloseSecureChannelRequest:    func() opcuaMessage { return &opcuaCloseSecureChannelRequest{} },
+	opcuaIDCloseSecureChannelResponse:   func() opcuaMessage { return &opcuaCloseSecureChannelResponse{} },
+	opcuaIDCreateSessionRequest:         func() opcuaMessage { return &opcuaCreateSessionRequest{} },
+	opcuaIDCreateSessionResponse:        func() opcuaMessage { return &opcuaCreateSessionResponse{} },
+	opcuaIDActivateSessionRequest:       func() opcuaMessage { return &opcuaActivateSessionRequest{} },
+	opcuaIDActivateSessionResponse:      func() opcuaMessage { return &opcuaActivateSessionResponse{} },
+	opcuaIDCloseSessionRequest:          func() opcuaMessage { return &opcuaCloseSessionRequest{} },
+	opcuaIDCloseSessionResponse:         func() opcuaMessage { return &opcuaCloseSessionResponse{} },
+	opcuaIDBrowseRequest:                func() opcuaMessage { return &opcuaBrowseRequest{} },
+	opcuaIDBrowseResponse:               func() opcuaMessage { return &opcuaBrowseResponse{} },
+	opcuaIDBrowseNextRequest:            func() opcuaMessage { return &opcuaBrowseNextRequest{} },
+	opcuaIDBrowseNextResponse:           func() opcuaMessage { return &opcuaBrowseNextResponse{} },
+	opcuaIDReadRequest:                  func() opcuaMessage { return &opcuaReadRequest{} },
+	opcuaIDReadResponse:                 func() opcuaMessage { return &opcuaReadResponse{} },
+	opcuaIDWriteRequest:                 func() opcuaMessage { return &opcuaWriteRequest{} },
+	opcuaIDWriteResponse:                func() opcuaMessage { return &opcuaWriteResponse{} },
+	opcuaIDCreateMonitoredItemsRequest:  func() opcuaMessage { return &opcuaCreateMonitoredItemsRequest{} },
+	opcuaIDCreateMonitoredItemsResponse: func() opcuaMessage { return &opcuaCreateMonitoredItemsResponse{} },
+	opcuaIDDeleteMonitoredItemsRequest:  func() opcuaMessage { return &opcuaDeleteMonitoredItemsRequest{} },
+	opcuaIDDeleteMonitoredItemsResponse: func() opcuaMessage { return &opcuaDeleteMonitoredItemsResponse{} },
+	opcuaIDCreateSubscriptionRequest:    func() opcuaMessage { return &opcuaCreateSubscriptionRequest{} },
+	opcuaIDCreateSubscriptionResponse:   func() opcuaMessage { return &opcuaCreateSubscriptionResponse{} },
+	opcuaIDPublishRequest:               func() opcuaMessage { return &opcuaPublishRequest{} },
+	opcuaIDPublishResponse:              func() opcuaMessage { return &opcuaPublishResponse{} },
+	opcuaIDRepublishRequest:             func() opcuaMessage { return &opcuaRepublishRequest{} },
+	opcuaIDRepublishResponse:            func() opcuaMessage { return &opcuaRepublishResponse{} },
+	opcuaIDDeleteSubscriptionsRequest:   func() opcuaMessage { return &opcuaDeleteSubscriptionsRequest{} },
+	opcuaIDDeleteSubscriptionsResponse:  func() opcuaMessage { return &opcuaDeleteSubscriptionsResponse{} },
+	opcuaIDAnonymousIdentityToken:       func() opcuaMessage { return &opcuaAnonymousIdentityToken{} },
+	opcuaIDUserNameIdentityToken:        func() opcuaMessage { return &opcuaUserNameIdentityToken{} },
+	opcuaIDX509IdentityToken:            func() opcuaMessage { return &opcuaX509IdentityToken{} },
+	opcuaIDDataChangeFilter:             func() opcuaMessage { return &opcuaDataChangeFilter{} },
+	opcuaIDDataChangeNotification:       func() opcuaMessage { return &opcuaDataChangeNotification{} },
+	opcuaIDStatusChangeNotification:     func() opcuaMessage { return &opcuaStatusChangeNotification{} },
+}
+
+// encodeOPCUAMessage encodes a message preceded by the node ID of its encoding, as service messages
+// travel.
+func encodeOPCUAMessage(message opcuaMessage) ([]byte, error) {
+	c := newOPCUAEncoder()
+	typeID := opcuaNumericNodeID(0, message.encodingID())
+	c.nodeID(&typeID)
+	message.code(c)
+	return c.buf, c.err
+}
+
+// decodeOPCUAMessage decodes a message preceded by the node ID of its encoding.
+func decodeOPCUAMessage(data []byte) (opcuaMessage, error) {
+	c := newOPCUADecoder(data)
+	var typeID opcuaNodeID
+	c.nodeID(&typeID)
+	if c.err != nil {
+		return nil, c.err
+	}
+	create, known := opcuaMessageTypes[typeID.Numeric]
+	if typeID.Namespace != 0 || typeID.Type != opcuaNumericID || !known {
+		return nil, fmt.Errorf("%w: unsupported message type %s", opcuaBadServiceUnsupported, typeID)
+	}
+	message := create()
+	message.code(c)
+	if c.err == nil && len(c.data) != 0 {
+		c.fail("%d bytes after %T", len(c.data), message)
+	}
+	return message, c.err
+}
+
+// newOPCUAExtensionObject wraps a structure in an extension object.
+func newOPCUAExtensionObject(message opcuaMessage) opcuaExtensionObject {
+	c := newOPCUAEncoder()
+	message.code(c)
+	return opcuaExtensionObject{TypeID: opcuaNumericNodeID(0, message.encodingID()), Body: c.buf}
+}
+
+// decodeOPCUAExtensionObject decodes the structure in an extension object. It returns nil without an
+// error for empty objects and for structures this package does not know.
+func decodeOPCUAExtensionObject(object opcuaExtensionObject) (opcuaMessage, error) {
+	create, known := opcuaMessageTypes[object.TypeID.Numeric]
+	if object.Body == nil || object.TypeID.Namespace != 0 || object.TypeID.Type != opcuaNumericID || !known {
+		return nil, nil
+	}
+	message := create()
+	c := newOPCUADecoder(object.Body)
+	message.code(c)
+	return message, c.err
+}
+
+// opcuaRequestHeader starts every service request.
+type opcuaRequestHeader struct {
+	AuthenticationToken opcuaNodeID
+	Timestamp           time.Time
+	RequestHandle       uint32
+	ReturnDiagnostics   uint32
+	AuditEntryID        string
+	TimeoutHint         uint32 // Milliseconds
+	AdditionalHeader    opcuaExtensionObject
+}
+
+func (h *opcuaRequestHeader) code(c *opcuaCodec) {
+	c.nodeID(&h.AuthenticationToken)
+	c.dateTime(&h.Timestamp)
+	c.uint32(&h.RequestHandle)
+	c.uint32(&h.ReturnDiagnostics)
+	c.string(&h.AuditEntryID)
+	c.uint32(&h.TimeoutHint)
+	c.extensionObject(&h.AdditionalHeader)
+}
+
+// opcuaResponseHeader starts every service response.
+type opcuaResponseHeader struct {
+	Timestamp          time.Time
+	RequestHandle      uint32
+	ServiceResult      opcuaStatusCode
+	ServiceDiagnostics *opcuaDiagnosticInfo
+	StringTable        []string
+	AdditionalHeader   opcuaExtensionObject
+}
+
+func (h *opcuaResponseHeader) code(c *opcuaCodec) {
+	c.dateTime(&h.Timestamp)
+	c.uint32(&h.RequestHandle)
+	c.statusCode(&h.ServiceResult)
+	c.diagnosticInfo(&h.ServiceDiagnostics)
+	c.strings(&h.StringTable)
+	c.extensionObject(&h.AdditionalHeader)
+}
+
+// opcuaServiceFault is the response to a request that failed as a whole.
+type opcuaServiceFault struct {
+	Header opcuaResponseHeader
+}
+
+func (m *opcuaServiceFault) encodingID() uint32                   { return opcuaIDServiceFault }
+func (m *opcuaServiceFault) responseHeader() *opcuaResponseHeader { return &m.Header }
+func (m *opcuaServiceFault) code(c *opcuaCodec)                   { m.Header.code(c) }
+
+// opcuaApplicationDescription describes a client or server application.
+type opcuaApplicationDescription struct {
+	ApplicationURI      string
+	ProductURI          string
+	ApplicationName     opcuaLocalizedText
+	ApplicationType     int32 // 0 server, 1 client, 2 client and server, 3 discovery server
+	GatewayServerURI    string
+	DiscoveryProfileURI string
+	DiscoveryURLs       []string
+}
+
+func (d *opcuaApplicationDescription) code(c *opcuaCodec) {
+	c.string(&d.ApplicationURI)
+	c.string(&d.ProductURI)
+	c.localizedText(&d.ApplicationName)
+	c.enum(&d.ApplicationType)
+	c.string(&d.GatewayServerURI)
+	c.string(&d.DiscoveryProfileURI)
+	c.strings(&d.DiscoveryURLs)
+}
+
+// opcuaUserTokenPolicy describes a kind of user identity an endpoint accepts.
+type opcuaUserTokenPolicy struct {
+	PolicyID          string
+	TokenType         int32
+	IssuedTokenType   string
+	IssuerEndpointURL string
+	SecurityPolicyURI string // Policy securing the token; empty for the endpoint's own
+}
+
+func (p *opcuaUserTokenPolicy) code(c *opcuaCodec) {
+	c.string(&p.PolicyID)
+	c.enum(&p.TokenType)
+	c.string(&p.IssuedTokenType)
+	c.string(&p.IssuerEndpointURL)
+	c.string(&p.SecurityPolicyURI)
+}
+
+// opcuaEndpointDescription describes an endpoint of a server and how to secure a connection to it.
+type opcuaEndpointDescription struct {
+	EndpointURL         string
+	Server              opcuaApplicationDescription
+	ServerCertificate   []byte
+	SecurityMode        int32
+	SecurityPolicyURI   string
+	UserIdentityTokens  []opcuaUserTokenPolicy
+	TransportProfileURI string
+	SecurityLevel       byte
+}
+
+func (d *opcuaEndpointDescription) code(c *opcuaCodec) {
+	c.string(&d.EndpointURL)
+	d.Server.code(c)
+	c.byteString(&d.ServerCertificate)
+	c.enum(&d.SecurityMode)
+	c.string(&d.SecurityPolicyURI)
+	n := c.arrayLength(len(d.UserIdentityTokens))
+	if c.decoding {
+		d.UserIdentityTokens = make([]opcuaUserTokenPolicy, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		d.UserIdentityTokens[i].code(c)
+	}
+	c.string(&d.TransportProfileURI)
+	c.uint8(&d.SecurityLevel)
+}
+
+func (c *opcuaCodec) endpointDescriptions(v *[]opcuaEndpointDescription) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]opcuaEndpointDescription, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		(*v)[i].code(c)
+	}
+}
+
+// opcuaGetEndpointsRequest asks a server for its endpoints.
+type opcuaGetEndpointsRequest struct {
+	Header      opcuaRequestHeader
+	EndpointURL string
+	LocaleIDs   []string
+	ProfileURIs []string
+}
+
+func (m *opcuaGetEndpointsRequest) encodingID() uint32                 { return opcuaIDGetEndpointsRequest }
+func (m *opcuaGetEndpointsRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaGetEndpointsRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.string(&m.EndpointURL)
+	c.strings(&m.LocaleIDs)
+	c.strings(&m.ProfileURIs)
+}
+
+type opcuaGetEndpointsResponse struct {
+	Header    opcuaResponseHeader
+	Endpoints []opcuaEndpointDescription
+}
+
+func (m *opcuaGetEndpointsResponse) encodingID() uint32                   { return opcuaIDGetEndpointsResponse }
+func (m *opcuaGetEndpointsResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaGetEndpointsResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.endpointDescriptions(&m.Endpoints)
+}
+
+// opcuaOpenSecureChannelRequest issues or renews the security token of a secure channel.
+type opcuaOpenSecureChannelRequest struct {
+	Header                opcuaRequestHeader
+	ClientProtocolVersion uint32
+	RequestType           int32 // 0 issue, 1 renew
+	SecurityMode          int32
+	ClientNonce           []byte
+	RequestedLifetime     uint32 // Milliseconds
+}
+
+func (m *opcuaOpenSecureChannelRequest) encodingID() uint32                 { return opcuaIDOpenSecureChannelRequest }
+func (m *opcuaOpenSecureChannelRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaOpenSecureChannelRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.ClientProtocolVersion)
+	c.enum(&m.RequestType)
+	c.enum(&m.SecurityMode)
+	c.byteString(&m.ClientNonce)
+	c.uint32(&m.RequestedLifetime)
+}
+
+// opcuaChannelSecurityToken identifies the keys of a secure channel and how long they last.
+type opcuaChannelSecurityToken struct {
+	ChannelID       uint32
+	TokenID         uint32
+	CreatedAt       time.Time
+	RevisedLifetime uint32 // Milliseconds
+}
+
+type opcuaOpenSecureChannelResponse struct {
+	Header                opcuaResponseHeader
+	ServerProtocolVersion uint32
+	SecurityToken         opcuaChannelSecurityToken
+	ServerNonce           []byte
+}
+
+func (m *opcuaOpenSecureChannelResponse) encodingID() uint32                   { return opcuaIDOpenSecureChannelResponse }
+func (m *opcuaOpenSecureChannelResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaOpenSecureChannelResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.ServerProtocolVersion)
+	c.uint32(&m.SecurityToken.ChannelID)
+	c.uint32(&m.SecurityToken.TokenID)
+	c.dateTime(&m.SecurityToken.CreatedAt)
+	c.uint32(&m.SecurityToken.RevisedLifetime)
+	c.byteString(&m.ServerNonce)
+}
+
+type opcuaCloseSecureChannelRequest struct {
+	Header opcuaRequestHeader
+}
+
+func (m *opcuaCloseSecureChannelRequest) encodingID() uint32                 { return opcuaIDCloseSecureChannelRequest }
+func (m *opcuaCloseSecureChannelRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+func (m *opcuaCloseSecureChannelRequest) code(c *opcuaCodec)                 { m.Header.code(c) }
+
+type opcuaCloseSecureChannelResponse struct {
+	Header opcuaResponseHeader
+}
+
+func (m *opcuaCloseSecureChannelResponse) encodingID() uint32 {
+	return opcuaIDCloseSecureChannelResponse
+}
+func (m *opcuaCloseSecureChannelResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+func (m *opcuaCloseSecureChannelResponse) code(c *opcuaCodec)                   { m.Header.code(c) }
+
+// opcuaSignatureData is a signature with the URI of its algorithm.
+type opcuaSignatureData struct {
+	Algorithm string
+	Signature []byte
+}
+
+func (s *opcuaSignatureData) code(c *opcuaCodec) {
+	c.string(&s.Algorithm)
+	c.byteString(&s.Signature)
+}
+
+// opcuaSignedSoftwareCertificate is carried by session services and always empty in practice.
+type opcuaSignedSoftwareCertificate struct {
+	CertificateData []byte
+	Signature       []byte
+}
+
+func (c *opcuaCodec) softwareCertificates(v *[]opcuaSignedSoftwareCertificate) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]opcuaSignedSoftwareCertificate, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.byteString(&(*v)[i].CertificateData)
+		c.byteString(&(*v)[i].Signature)
+	}
+}
+
+// opcuaCreateSessionRequest creates a session, which must then be activated.
+type opcuaCreateSessionRequest struct {
+	Header                  opcuaRequestHeader
+	ClientDescription       opcuaApplicationDescription
+	ServerURI               string
+	EndpointURL             string
+	SessionName             string
+	ClientNonce             []byte
+	ClientCertificate       []byte
+	RequestedSessionTimeout float64 // Milliseconds
+	MaxResponseMessageSize  uint32
+}
+
+func (m *opcuaCreateSessionRequest) encodingID() uint32                 { return opcuaIDCreateSessionRequest }
+func (m *opcuaCreateSessionRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaCreateSessionRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	m.ClientDescription.code(c)
+	c.string(&m.ServerURI)
+	c.string(&m.EndpointURL)
+	c.string(&m.SessionName)
+	c.byteString(&m.ClientNonce)
+	c.byteString(&m.ClientCertificate)
+	c.float64(&m.RequestedSessionTimeout)
+	c.uint32(&m.MaxResponseMessageSize)
+}
+
+type opcuaCreateSessionResponse struct {
+	Header                     opcuaResponseHeader
+	SessionID                  opcuaNodeID
+	AuthenticationToken        opcuaNodeID
+	RevisedSessionTimeout      float64
+	ServerNonce                []byte
+	ServerCertificate          []byte
+	ServerEndpoints            []opcuaEndpointDescription
+	ServerSoftwareCertificates []opcuaSignedSoftwareCertificate
+	ServerSignature            opcuaSignatureData
+	MaxRequestMessageSize      uint32
+}
+
+func (m *opcuaCreateSessionResponse) encodingID() uint32                   { return opcuaIDCreateSessionResponse }
+func (m *opcuaCreateSessionResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaCreateSessionResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.nodeID(&m.SessionID)
+	c.nodeID(&m.AuthenticationToken)
+	c.float64(&m.RevisedSessionTimeout)
+	c.byteString(&m.ServerNonce)
+	c.byteString(&m.ServerCertificate)
+	c.endpointDescriptions(&m.ServerEndpoints)
+	c.softwareCertificates(&m.ServerSoftwareCertificates)
+	m.ServerSignature.code(c)
+	c.uint32(&m.MaxRequestMessageSize)
+}
+
+// opcuaActivateSessionRequest proves the client holds its certificate's key and presents the user
+// identity.
+type opcuaActivateSessionRequest struct {
+	Header                     opcuaRequestHeader
+	ClientSignature            opcuaSignatureData
+	ClientSoftwareCertificates []opcuaSignedSoftwareCertificate
+	LocaleIDs                  []string
+	UserIdentityToken          opcuaExtensionObject
+	UserTokenSignature         opcuaSignatureData
+}
+
+func (m *opcuaActivateSessionRequest) encodingID() uint32                 { return opcuaIDActivateSessionRequest }
+func (m *opcuaActivateSessionRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaActivateSessionRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	m.ClientSignature.code(c)
+	c.softwareCertificates(&m.ClientSoftwareCertificates)
+	c.strings(&m.LocaleIDs)
+	c.extensionObject(&m.UserIdentityToken)
+	m.UserTokenSignature.code(c)
+}
+
+type opcuaActivateSessionResponse struct {
+	Header          opcuaResponseHeader
+	ServerNonce     []byte
+	Results         []opcuaStatusCode
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaActivateSessionResponse) encodingID() uint32                   { return opcuaIDActivateSessionResponse }
+func (m *opcuaActivateSessionResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaActivateSessionResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.byteString(&m.ServerNonce)
+	c.statusCodes(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+type opcuaCloseSessionRequest struct {
+	Header              opcuaRequestHeader
+	DeleteSubscriptions bool
+}
+
+func (m *opcuaCloseSessionRequest) encodingID() uint32                 { return opcuaIDCloseSessionRequest }
+func (m *opcuaCloseSessionRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaCloseSessionRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.boolean(&m.DeleteSubscriptions)
+}
+
+type opcuaCloseSessionResponse struct {
+	Header opcuaResponseHeader
+}
+
+func (m *opcuaCloseSessionResponse) encodingID() uint32                   { return opcuaIDCloseSessionResponse }
+func (m *opcuaCloseSessionResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+func (m *opcuaCloseSessionResponse) code(c *opcuaCodec)                   { m.Header.code(c) }
+
+// opcuaAnonymousIdentityToken presents no user identity.
+type opcuaAnonymousIdentityToken struct {
+	PolicyID string
+}
+
+func (m *opcuaAnonymousIdentityToken) encodingID() uint32 { return opcuaIDAnonymousIdentityToken }
+func (m *opcuaAnonymousIdentityToken) code(c *opcuaCodec) { c.string(&m.PolicyID) }
+
+// opcuaUserNameIdentityToken presents a user name and a password, encrypted unless the token policy
+// and channel are both unsecured.
+type opcuaUserNameIdentityToken struct {
+	PolicyID            string
+	UserName            string
+	Password            []byte
+	EncryptionAlgorithm string
+}
+
+func (m *opcuaUserNameIdentityToken) encodingID() uint32 { return opcuaIDUserNameIdentityToken }
+
+func (m *opcuaUserNameIdentityToken) code(c *opcuaCodec) {
+	c.string(&m.PolicyID)
+	c.string(&m.UserName)
+	c.byteString(&m.Password)
+	c.string(&m.EncryptionAlgorithm)
+}
+
+// opcuaX509IdentityToken presents a user certificate; it is decoded only to be rejected.
+type opcuaX509IdentityToken struct {
+	PolicyID        string
+	CertificateData []byte
+}
+
+func (m *opcuaX509IdentityToken) encodingID() uint32 { return opcuaIDX509IdentityToken }
+
+func (m *opcuaX509IdentityToken) code(c *opcuaCodec) {
+	c.string(&m.PolicyID)
+	c.byteString(&m.CertificateData)
+}
+
+// opcuaBrowseDescription selects the references of a node to browse.
+type opcuaBrowseDescription struct {
+	NodeID          opcuaNodeID
+	BrowseDirection int32 // 0 forward, 1 inverse, 2 both
+	ReferenceTypeID opcuaNodeID
+	IncludeSubtypes bool
+	NodeClassMask   uint32
+	ResultMask      uint32
+}
+
+// opcuaReferenceDescription is a reference found by browsing.
+type opcuaReferenceDescription struct {
+	ReferenceTypeID opcuaNodeID
+	IsForward       bool
+	NodeID          opcuaExpandedNodeID
+	BrowseName      opcuaQualifiedName
+	DisplayName     opcuaLocalizedText
+	NodeClass       int32
+	TypeDefinition  opcuaExpandedNodeID
+}
+
+// opcuaBrowseResult holds the references found for one node, and a continuation point when there are
+// more.
+type opcuaBrowseResult struct {
+	Status            opcuaStatusCode
+	ContinuationPoint []byte
+	References        []opcuaReferenceDescription
+}
+
+func (c *opcuaCodec) browseResults(v *[]opcuaBrowseResult) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]opcuaBrowseResult, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		result := &(*v)[i]
+		c.statusCode(&result.Status)
+		c.byteString(&result.ContinuationPoint)
+		refs := c.arrayLength(len(result.References))
+		if c.decoding {
+			result.References = make([]opcuaReferenceDescription, refs)
+		}
+		for j := 0; j < refs && c.err == nil; j++ {
+			ref := &result.References[j]
+			c.nodeID(&ref.ReferenceTypeID)
+			c.boolean(&ref.IsForward)
+			c.expandedNodeID(&ref.NodeID)
+			c.qualifiedName(&ref.BrowseName)
+			c.localizedText(&ref.DisplayName)
+			c.enum(&ref.NodeClass)
+			c.expandedNodeID(&ref.TypeDefinition)
+		}
+	}
+}
+
+// opcuaBrowseRequest lists the references of nodes.
+type opcuaBrowseRequest struct {
+	Header                        opcuaRequestHeader
+	ViewID                        opcuaNodeID
+	ViewTimestamp                 time.Time
+	ViewVersion                   uint32
+	RequestedMaxReferencesPerNode uint32
+	NodesToBrowse                 []opcuaBrowseDescription
+}
+
+func (m *opcuaBrowseRequest) encodingID() uint32                 { return opcuaIDBrowseRequest }
+func (m *opcuaBrowseRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaBrowseRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.nodeID(&m.ViewID)
+	c.dateTime(&m.ViewTimestamp)
+	c.uint32(&m.ViewVersion)
+	c.uint32(&m.RequestedMaxReferencesPerNode)
+	n := c.arrayLength(len(m.NodesToBrowse))
+	if c.decoding {
+		m.NodesToBrowse = make([]opcuaBrowseDescription, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		node := &m.NodesToBrowse[i]
+		c.nodeID(&node.NodeID)
+		c.enum(&node.BrowseDirection)
+		c.nodeID(&node.ReferenceTypeID)
+		c.boolean(&node.IncludeSubtypes)
+		c.uint32(&node.NodeClassMask)
+		c.uint32(&node.ResultMask)
+	}
+}
+
+type opcuaBrowseResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaBrowseResult
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaBrowseResponse) encodingID() uint32                   { return opcuaIDBrowseResponse }
+func (m *opcuaBrowseResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaBrowseResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.browseResults(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaBrowseNextRequest continues or releases browses that returned continuation points.
+type opcuaBrowseNextRequest struct {
+	Header                    opcuaRequestHeader
+	ReleaseContinuationPoints bool
+	ContinuationPoints        [][]byte
+}
+
+func (m *opcuaBrowseNextRequest) encodingID() uint32                 { return opcuaIDBrowseNextRequest }
+func (m *opcuaBrowseNextRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaBrowseNextRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.boolean(&m.ReleaseContinuationPoints)
+	c.byteStrings(&m.ContinuationPoints)
+}
+
+type opcuaBrowseNextResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaBrowseResult
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaBrowseNextResponse) encodingID() uint32                   { return opcuaIDBrowseNextResponse }
+func (m *opcuaBrowseNextResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaBrowseNextResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.browseResults(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaReadValueID names an attribute of a node.
+type opcuaReadValueID struct {
+	NodeID       opcuaNodeID
+	AttributeID  uint32
+	IndexRange   string
+	DataEncoding opcuaQualifiedName
+}
+
+func (r *opcuaReadValueID) code(c *opcuaCodec) {
+	c.nodeID(&r.NodeID)
+	c.uint32(&r.AttributeID)
+	c.string(&r.IndexRange)
+	c.qualifiedName(&r.DataEncoding)
+}
+
+// opcuaReadRequest reads attributes of nodes.
+type opcuaReadRequest struct {
+	Header             opcuaRequestHeader
+	MaxAge             float64
+	TimestampsToReturn int32
+	NodesToRead        []opcuaReadValueID
+}
+
+func (m *opcuaReadRequest) encodingID() uint32                 { return opcuaIDReadRequest }
+func (m *opcuaReadRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaReadRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.float64(&m.MaxAge)
+	c.enum(&m.TimestampsToReturn)
+	n := c.arrayLength(len(m.NodesToRead))
+	if c.decoding {
+		m.NodesToRead = make([]opcuaReadValueID, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		m.NodesToRead[i].code(c)
+	}
+}
+
+type opcuaReadResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaDataValue
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaReadResponse) encodingID() uint32                   { return opcuaIDReadResponse }
+func (m *opcuaReadResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaReadResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	n := c.arrayLength(len(m.Results))
+	if c.decoding {
+		m.Results = make([]opcuaDataValue, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.dataValue(&m.Results[i])
+	}
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaWriteValue is a value to write to an attribute.
+type opcuaWriteValue struct {
+	NodeID      opcuaNodeID
+	AttributeID uint32
+	IndexRange  string
+	Value       opcuaDataValue
+}
+
+// opcuaWriteRequest writes attributes of nodes.
+type opcuaWriteRequest struct {
+	Header       opcuaRequestHeader
+	NodesToWrite []opcuaWriteValue
+}
+
+func (m *opcuaWriteRequest) encodingID() uint32                 { return opcuaIDWriteRequest }
+func (m *opcuaWriteRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaWriteRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	n := c.arrayLength(len(m.NodesToWrite))
+	if c.decoding {
+		m.NodesToWrite = make([]opcuaWriteValue, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		write := &m.NodesToWrite[i]
+		c.nodeID(&write.NodeID)
+		c.uint32(&write.AttributeID)
+		c.string(&write.IndexRange)
+		c.dataValue(&write.Value)
+	}
+}
+
+type opcuaWriteResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaStatusCode
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaWriteResponse) encodingID() uint32                   { return opcuaIDWriteResponse }
+func (m *opcuaWriteResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaWriteResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.statusCodes(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaCreateSubscriptionRequest creates a subscription that reports changes of monitored items.
+type opcuaCreateSubscriptionRequest struct {
+	Header                      opcuaRequestHeader
+	RequestedPublishingInterval float64 // Milliseconds
+	RequestedLifetimeCount      uint32
+	RequestedMaxKeepAliveCount  uint32
+	MaxNotificationsPerPublish  uint32
+	PublishingEnabled           bool
+	Priority                    byte
+}
+
+func (m *opcuaCreateSubscriptionRequest) encodingID() uint32                 { return opcuaIDCreateSubscriptionRequest }
+func (m *opcuaCreateSubscriptionRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaCreateSubscriptionRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.float64(&m.RequestedPublishingInterval)
+	c.uint32(&m.RequestedLifetimeCount)
+	c.uint32(&m.RequestedMaxKeepAliveCount)
+	c.uint32(&m.MaxNotificationsPerPublish)
+	c.boolean(&m.PublishingEnabled)
+	c.uint8(&m.Priority)
+}
+
+type opcuaCreateSubscriptionResponse struct {
+	Header                    opcuaResponseHeader
+	SubscriptionID            uint32
+	RevisedPublishingInterval float64
+	RevisedLifetimeCount      uint32
+	RevisedMaxKeepAliveCount  uint32
+}
+
+func (m *opcuaCreateSubscriptionResponse) encodingID() uint32 {
+	return opcuaIDCreateSubscriptionResponse
+}
+func (m *opcuaCreateSubscriptionResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaCreateSubscriptionResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.SubscriptionID)
+	c.float64(&m.RevisedPublishingInterval)
+	c.uint32(&m.RevisedLifetimeCount)
+	c.uint32(&m.RevisedMaxKeepAliveCount)
+}
+
+// opcuaDataChangeFilter sets what counts as a change of a monitored value.
+type opcuaDataChangeFilter struct {
+	Trigger       int32  // 0 status, 1 status or value, 2 status, value or source timestamp
+	DeadbandType  uint32 // 0 none, 1 absolute, 2 percent
+	DeadbandValue float64
+}
+
+func (m *opcuaDataChangeFilter) encodingID() uint32 { return opcuaIDDataChangeFilter }
+
+func (m *opcuaDataChangeFilter) code(c *opcuaCodec) {
+	c.enum(&m.Trigger)
+	c.uint32(&m.DeadbandType)
+	c.float64(&m.DeadbandValue)
+}
+
+// opcuaMonitoredItemCreateRequest asks for an attribute to be sampled and its changes reported.
+type opcuaMonitoredItemCreateRequest struct {
+	ItemToMonitor    opcuaReadValueID
+	MonitoringMode   int32 // 0 disabled, 1 sampling, 2 reporting
+	ClientHandle     uint32
+	SamplingInterval float64 // Milliseconds
+	Filter           opcuaExtensionObject
+	QueueSize        uint32
+	DiscardOldest    bool
+}
+
+// opcuaMonitoredItemCreateResult is the outcome of creating one monitored item.
+type opcuaMonitoredItemCreateResult struct {
+	Status                  opcuaStatusCode
+	MonitoredItemID         uint32
+	RevisedSamplingInterval float64
+	RevisedQueueSize        uint32
+	FilterResult            opcuaExtensionObject
+}
+
+type opcuaCreateMonitoredItemsRequest struct {
+	Header             opcuaRequestHeader
+	SubscriptionID     uint32
+	TimestampsToReturn int32
+	ItemsToCreate      []opcuaMonitoredItemCreateRequest
+}
+
+func (m *opcuaCreateMonitoredItemsRequest) encodingID() uint32 {
+	return opcuaIDCreateMonitoredItemsRequest
+}
+func (m *opcuaCreateMonitoredItemsRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaCreateMonitoredItemsRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.SubscriptionID)
+	c.enum(&m.TimestampsToReturn)
+	n := c.arrayLength(len(m.ItemsToCreate))
+	if c.decoding {
+		m.ItemsToCreate = make([]opcuaMonitoredItemCreateRequest, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		item := &m.ItemsToCreate[i]
+		item.ItemToMonitor.code(c)
+		c.enum(&item.MonitoringMode)
+		c.uint32(&item.ClientHandle)
+		c.float64(&item.SamplingInterval)
+		c.extensionObject(&item.Filter)
+		c.uint32(&item.QueueSize)
+		c.boolean(&item.DiscardOldest)
+	}
+}
+
+type opcuaCreateMonitoredItemsResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaMonitoredItemCreateResult
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaCreateMonitoredItemsResponse) encodingID() uint32 {
+	return opcuaIDCreateMonitoredItemsResponse
+}
+func (m *opcuaCreateMonitoredItemsResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaCreateMonitoredItemsResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	n := c.arrayLength(len(m.Results))
+	if c.decoding {
+		m.Results = make([]opcuaMonitoredItemCreateResult, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		result := &m.Results[i]
+		c.statusCode(&result.Status)
+		c.uint32(&result.MonitoredItemID)
+		c.float64(&result.RevisedSamplingInterval)
+		c.uint32(&result.RevisedQueueSize)
+		c.extensionObject(&result.FilterResult)
+	}
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+type opcuaDeleteMonitoredItemsRequest struct {
+	Header           opcuaRequestHeader
+	SubscriptionID   uint32
+	MonitoredItemIDs []uint32
+}
+
+func (m *opcuaDeleteMonitoredItemsRequest) encodingID() uint32 {
+	return opcuaIDDeleteMonitoredItemsRequest
+}
+func (m *opcuaDeleteMonitoredItemsRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaDeleteMonitoredItemsRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.SubscriptionID)
+	c.uint32s(&m.MonitoredItemIDs)
+}
+
+type opcuaDeleteMonitoredItemsResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaStatusCode
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaDeleteMonitoredItemsResponse) encodingID() uint32 {
+	return opcuaIDDeleteMonitoredItemsResponse
+}
+func (m *opcuaDeleteMonitoredItemsResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaDeleteMonitoredItemsResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.statusCodes(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaSubscriptionAcknowledgement acknowledges a notification message, so the server can discard it.
+type opcuaSubscriptionAcknowledgement struct {
+	SubscriptionID uint32
+	SequenceNumber uint32
+}
+
+// opcuaPublishRequest hands the server a slot for the next notification message of any subscription
+// of the session.
+type opcuaPublishRequest struct {
+	Header           opcuaRequestHeader
+	Acknowledgements []opcuaSubscriptionAcknowledgement
+}
+
+func (m *opcuaPublishRequest) encodingID() uint32                 { return opcuaIDPublishRequest }
+func (m *opcuaPublishRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaPublishRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	n := c.arrayLength(len(m.Acknowledgements))
+	if c.decoding {
+		m.Acknowledgements = make([]opcuaSubscriptionAcknowledgement, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.uint32(&m.Acknowledgements[i].SubscriptionID)
+		c.uint32(&m.Acknowledgements[i].SequenceNumber)
+	}
+}
+
+// opcuaNotificationMessage carries the notifications of one publishing cycle; keep-alives have none.
+type opcuaNotificationMessage struct {
+	SequenceNumber   uint32
+	PublishTime      time.Time
+	NotificationData []opcuaExtensionObject
+}
+
+func (m *opcuaNotificationMessage) code(c *opcuaCodec) {
+	c.uint32(&m.SequenceNumber)
+	c.dateTime(&m.PublishTime)
+	n := c.arrayLength(len(m.NotificationData))
+	if c.decoding {
+		m.NotificationData = make([]opcuaExtensionObject, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.extensionObject(&m.NotificationData[i])
+	}
+}
+
+type opcuaPublishResponse struct {
+	Header                   opcuaResponseHeader
+	SubscriptionID           uint32
+	AvailableSequenceNumbers []uint32
+	MoreNotifications        bool
+	NotificationMessage      opcuaNotificationMessage
+	Results                  []opcuaStatusCode // Outcome of each acknowledgement
+	DiagnosticInfos          []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaPublishResponse) encodingID() uint32                   { return opcuaIDPublishResponse }
+func (m *opcuaPublishResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaPublishResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.SubscriptionID)
+	c.uint32s(&m.AvailableSequenceNumbers)
+	c.boolean(&m.MoreNotifications)
+	m.NotificationMessage.code(c)
+	c.statusCodes(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaRepublishRequest asks again for a notification message that has not been acknowledged.
+type opcuaRepublishRequest struct {
+	Header                   opcuaRequestHeader
+	SubscriptionID           uint32
+	RetransmitSequenceNumber uint32
+}
+
+func (m *opcuaRepublishRequest) encodingID() uint32                 { return opcuaIDRepublishRequest }
+func (m *opcuaRepublishRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaRepublishRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32(&m.SubscriptionID)
+	c.uint32(&m.RetransmitSequenceNumber)
+}
+
+type opcuaRepublishResponse struct {
+	Header              opcuaResponseHeader
+	NotificationMessage opcuaNotificationMessage
+}
+
+func (m *opcuaRepublishResponse) encodingID() uint32                   { return opcuaIDRepublishResponse }
+func (m *opcuaRepublishResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaRepublishResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	m.NotificationMessage.code(c)
+}
+
+type opcuaDeleteSubscriptionsRequest struct {
+	Header          opcuaRequestHeader
+	SubscriptionIDs []uint32
+}
+
+func (m *opcuaDeleteSubscriptionsRequest) encodingID() uint32 {
+	return opcuaIDDeleteSubscriptionsRequest
+}
+func (m *opcuaDeleteSubscriptionsRequest) requestHeader() *opcuaRequestHeader { return &m.Header }
+
+func (m *opcuaDeleteSubscriptionsRequest) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.uint32s(&m.SubscriptionIDs)
+}
+
+type opcuaDeleteSubscriptionsResponse struct {
+	Header          opcuaResponseHeader
+	Results         []opcuaStatusCode
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaDeleteSubscriptionsResponse) encodingID() uint32 {
+	return opcuaIDDeleteSubscriptionsResponse
+}
+func (m *opcuaDeleteSubscriptionsResponse) responseHeader() *opcuaResponseHeader { return &m.Header }
+
+func (m *opcuaDeleteSubscriptionsResponse) code(c *opcuaCodec) {
+	m.Header.code(c)
+	c.statusCodes(&m.Results)
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaMonitoredItemNotification is a new value of a monitored item.
+type opcuaMonitoredItemNotification struct {
+	ClientHandle uint32
+	Value        opcuaDataValue
+}
+
+// opcuaDataChangeNotification carries the value changes of one publishing cycle.
+type opcuaDataChangeNotification struct {
+	MonitoredItems  []opcuaMonitoredItemNotification
+	DiagnosticInfos []*opcuaDiagnosticInfo
+}
+
+func (m *opcuaDataChangeNotification) encodingID() uint32 { return opcuaIDDataChangeNotification }
+
+func (m *opcuaDataChangeNotification) code(c *opcuaCodec) {
+	n := c.arrayLength(len(m.MonitoredItems))
+	if c.decoding {
+		m.MonitoredItems = make([]opcuaMonitoredItemNotification, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.uint32(&m.MonitoredItems[i].ClientHandle)
+		c.dataValue(&m.MonitoredItems[i].Value)
+	}
+	c.diagnosticInfos(&m.DiagnosticInfos)
+}
+
+// opcuaStatusChangeNotification reports a change in the state of a subscription, such as its timeout.
+type opcuaStatusChangeNotification struct {
+	Status         opcuaStatusCode
+	DiagnosticInfo *opcuaDiagnosticInfo
+}
+
+func (m *opcuaStatusChangeNotification) encodingID() uint32 { return opcuaIDStatusChangeNotification }
+
+func (m *opcuaStatusChangeNotification) code(c *opcuaCodec) {
+	c.statusCode(&m.Status)
+	c.diagnosticInfo(&m.DiagnosticInfo)
+}
+
+// opcuaBuildInfo describes the server software.
+type opcuaBuildInfo struct {
+	ProductURI       string
+	ManufacturerName string
+	ProductName      string
+	SoftwareVersion  string
+	BuildNumber      string
+	BuildDate        time.Time
+}
+
+// opcuaServerStatus is the value of the Server object's ServerStatus variable.
+type opcuaServerStatus struct {
+	StartTime           time.Time
+	CurrentTime         time.Time
+	State               int32 // 0 running
+	BuildInfo           opcuaBuildInfo
+	SecondsTillShutdown uint32
+	ShutdownReason      opcuaLocalizedText
+}
+
+func (m *opcuaServerStatus) encodingID() uint32 { return opcuaIDServerStatusDataType }
+
+func (m *opcuaServerStatus) code(c *opcuaCodec) {
+	c.dateTime(&m.StartTime)
+	c.dateTime(&m.CurrentTime)
+	c.enum(&m.State)
+	c.string(&m.BuildInfo.ProductURI)
+	c.string(&m.BuildInfo.ManufacturerName)
+	c.string(&m.BuildInfo.ProductName)
+	c.string(&m.BuildInfo.SoftwareVersion)
+	c.string(&m.BuildInfo.BuildNumber)
+	c.dateTime(&m.BuildInfo.BuildDate)
+	c.uint32(&m.SecondsTillShutdown)
+	c.localizedText(&m.ShutdownReason)
+}
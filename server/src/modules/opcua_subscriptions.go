@@ -0,0 +1,628 @@
+// server/src/modules/opcua_subscriptions.go
+
+package modules
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Subscription behaviour of the OPC UA server
+const (
+	opcuaServerTick            = 50 * time.Millisecond // Resolution of sampling and publishing
+	opcuaMaxPublishingInterval = time.Hour
+	opcuaDefaultKeepAliveCount = 10
+	opcuaMaxKeepAliveCount     = 10000
+	opcuaMaxQueueSize          = 100 // Values queued per monitored item
+	opcuaMaxRetransmit         = 10  // Unacknowledged messages kept per subscription for Republish
+	opcuaMaxPublishQueue       = 10  // Publish requests waiting per session
+	opcuaOverflowBits          = 0x480
+)
+
+// opcuaPublishSlot is a Publish request waiting for a notification message.
+type opcuaPublishSlot struct {
+	conn      *opcuaServerConn
+	requestID uint32
+	header    opcuaRequestHeader
+	results   []opcuaStatusCode // Outcome of the request's acknowledgements
+	deadline  time.Time         // Zero without a timeout hint
+}
+
+// opcuaStatusChange is the end of a subscription still to be reported.
+type opcuaStatusChange struct {
+	subscriptionID uint32
+	sequence       uint32 // Sequence number of the last message sent
+	status         opcuaStatusCode
+}
+
+// opcuaMonitoredItem samples an attribute of a node and queues its changes.
+type opcuaMonitoredItem struct {
+	id            uint32
+	clientHandle  uint32
+	node          *opcuaNode
+	attribute     uint32
+	timestamps    int32
+	mode          int32 // 0 disabled, 1 sampling, 2 reporting
+	interval      time.Duration
+	nextSample    time.Time
+	filter        opcuaDataChangeFilter
+	queueSize     int
+	discardOldest bool
+	last          opcuaDataValue // Latest sample queued, with both timestamps
+	sampled       bool
+	queue         []opcuaDataValue
+}
+
+// opcuaSubscription sends the changes of its monitored items every publishing interval, or a
+// keep-alive after keepAliveCount empty intervals. It ends once lifetimeCount intervals pass without a
+// Publish request to answer.
+type opcuaSubscription struct {
+	id               uint32
+	session          *opcuaServerSession
+	interval         time.Duration
+	lifetimeCount    uint32
+	keepAliveCount   uint32
+	maxNotifications int
+	enabled          bool
+	items            map[uint32]*opcuaMonitoredItem
+	sequence         uint32 // Sequence number of the last data message
+	next             time.Time
+	keepAliveCounter uint32
+	lifetimeCounter  uint32
+	retransmit       []opcuaNotificationMessage // Unacknowledged data messages
+	late             bool                       // A message is due but no Publish request was waiting
+}
+
+// maintain runs the sampling and publishing cycles until the server is closed.
+func (s *OPCUAServer) maintain() {
+	defer close(s.done)
+	ticker := time.NewTicker(opcuaServerTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			for _, reply := range s.tick(now) {
+				reply.conn.send(reply.requestID, reply.response)
+			}
+		}
+	}
+}
+
+// tick expires sessions and Publish requests, samples monitored items and runs the publishing cycles
+// that are due, returning the responses to send.
+func (s *OPCUAServer) tick(now time.Time) []opcuaServerReply {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var replies []opcuaServerReply
+	for key, session := range s.sessions {
+		if now.Sub(session.lastUsed) > session.timeout {
+			delete(s.sessions, key)
+			replies = append(replies, session.answerPublishRequests(opcuaBadSessionClosed)...)
+			s.logger.Printf("OPC UA session %q of %s timed out\n", session.name, session.username())
+			continue
+		}
+
+		kept := session.publishQueue[:0]
+		for _, slot := range session.publishQueue {
+			if !slot.deadline.IsZero() && now.After(slot.deadline) {
+				replies = append(replies, slot.fault(opcuaBadTimeout))
+				continue
+			}
+			kept = append(kept, slot)
+		}
+		session.publishQueue = kept
+
+		for _, subscription := range session.sortedSubscriptions() {
+			for _, item := range subscription.items {
+				if item.mode != 0 && !now.Before(item.nextSample) {
+					s.sample(session, item, now)
+				}
+			}
+			if now.Before(subscription.next) {
+				continue
+			}
+			subscription.next = subscription.next.Add(subscription.interval)
+			if subscription.next.Before(now) {
+				subscription.next = now.Add(subscription.interval)
+			}
+			reply, expired := subscription.cycle(now)
+			if reply != nil {
+				replies = append(replies, *reply)
+			}
+			if expired {
+				session.endSubscription(subscription, opcuaBadTimeout)
+				s.logger.Printf("OPC UA subscription %d of session %q timed out\n", subscription.id, session.name)
+			}
+		}
+		replies = append(replies, session.settle(now)...)
+	}
+	return replies
+}
+
+// sample reads a monitored attribute and queues the value if it changed.
+func (s *OPCUAServer) sample(session *opcuaServerSession, item *opcuaMonitoredItem, now time.Time) {
+	item.nextSample = now.Add(item.interval)
+	value := s.space.read(session, item.node, item.attribute, now)
+	if item.sampled && !item.changed(value) {
+		return
+	}
+	item.last, item.sampled = value, true
+	if item.attribute == opcuaAttributeValue {
+		value = opcuaWithTimestamps(value, item.timestamps)
+	}
+	if len(item.queue) < item.queueSize {
+		item.queue = append(item.queue, value)
+		return
+	}
+	// The queue is full: drop the oldest value or replace the newest one, flagging the overflow
+	if item.discardOldest {
+		item.queue = append(item.queue[1:], value)
+		if item.queueSize > 1 {
+			item.queue[0].Status |= opcuaOverflowBits
+		}
+		return
+	}
+	item.queue[len(item.queue)-1] = value
+	if item.queueSize > 1 {
+		item.queue[len(item.queue)-1].Status |= opcuaOverflowBits
+	}
+}
+
+// changed reports whether a sample differs from the last one queued, as the item's filter sees it.
+func (item *opcuaMonitoredItem) changed(value opcuaDataValue) bool {
+	last := item.last
+	if value.Status != last.Status {
+		return true
+	}
+	if item.filter.Trigger == 0 {
+		return false
+	}
+	if item.filter.Trigger == 2 && !value.SourceTimestamp.Equal(last.SourceTimestamp) {
+		return true
+	}
+	if item.filter.DeadbandType == 1 {
+		current, currentNumeric := opcuaNumber(value.Value)
+		previous, previousNumeric := opcuaNumber(last.Value)
+		if currentNumeric && previousNumeric {
+			return math.Abs(current-previous) > item.filter.DeadbandValue
+		}
+	}
+	return !reflect.DeepEqual(value.Value, last.Value)
+}
+
+// cycle runs a publishing cycle. It answers a waiting Publish request when a data message or
+// keep-alive is due, and reports whether the subscription outlived its lifetime instead.
+func (sub *opcuaSubscription) cycle(now time.Time) (*opcuaServerReply, bool) {
+	if !sub.late && !sub.pending() {
+		if sub.keepAliveCounter > 1 {
+			sub.keepAliveCounter--
+			return nil, false
+		}
+	}
+	if slot := sub.session.takeSlot(); slot != nil {
+		reply := sub.publish(slot, now)
+		return &reply, false
+	}
+	sub.late = true
+	if sub.lifetimeCounter > 0 {
+		sub.lifetimeCounter--
+	}
+	return nil, sub.lifetimeCounter == 0
+}
+
+// pending reports whether reporting items have values queued.
+func (sub *opcuaSubscription) pending() bool {
+	if !sub.enabled {
+		return false
+	}
+	for _, item := range sub.items {
+		if item.mode == 2 && len(item.queue) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// publish answers a Publish request with the queued values, up to the subscription's limit, or with a
+// keep-alive when none are queued.
+func (sub *opcuaSubscription) publish(slot *opcuaPublishSlot, now time.Time) opcuaServerReply {
+	var notifications []opcuaMonitoredItemNotification
+	more := false
+	if sub.enabled {
+		ids := make([]uint32, 0, len(sub.items))
+		for id := range sub.items {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			item := sub.items[id]
+			if item.mode != 2 {
+				continue
+			}
+			for len(item.queue) > 0 && len(notifications) < sub.maxNotifications {
+				notifications = append(notifications, opcuaMonitoredItemNotification{ClientHandle: item.clientHandle, Value: item.queue[0]})
+				item.queue = item.queue[1:]
+			}
+			if len(item.queue) > 0 {
+				more = true
+			}
+		}
+	}
+
+	message := opcuaNotificationMessage{SequenceNumber: opcuaNextSequence(sub.sequence), PublishTime: now}
+	if len(notifications) > 0 {
+		sub.sequence = message.SequenceNumber
+		message.NotificationData = []opcuaExtensionObject{newOPCUAExtensionObject(&opcuaDataChangeNotification{MonitoredItems: notifications})}
+		sub.retransmit = append(sub.retransmit, message)
+		if len(sub.retransmit) > opcuaMaxRetransmit {
+			sub.retransmit = sub.retransmit[1:]
+		}
+	}
+	sub.late = more
+	sub.keepAliveCounter, sub.lifetimeCounter = sub.keepAliveCount, sub.lifetimeCount
+
+	response := &opcuaPublishResponse{SubscriptionID: sub.id, MoreNotifications: more, NotificationMessage: message}
+	// Responses are encoded outside the server's mutex, so they must not share the retransmission queue
+	response.NotificationMessage.NotificationData = append([]opcuaExtensionObject(nil), message.NotificationData...)
+	for _, kept := range sub.retransmit {
+		response.AvailableSequenceNumbers = append(response.AvailableSequenceNumbers, kept.SequenceNumber)
+	}
+	return slot.reply(response)
+}
+
+// opcuaNextSequence returns the sequence number after another; 0 is skipped when they wrap.
+func opcuaNextSequence(sequence uint32) uint32 {
+	if sequence == math.MaxUint32 {
+		return 1
+	}
+	return sequence + 1
+}
+
+// reply answers the Publish request with a notification message.
+func (slot *opcuaPublishSlot) reply(response *opcuaPublishResponse) opcuaServerReply {
+	response.Header = opcuaServerResponseHeader(&slot.header, opcuaGood)
+	response.Results = slot.results
+	return opcuaServerReply{conn: slot.conn, requestID: slot.requestID, response: response}
+}
+
+// fault answers the Publish request with an error.
+func (slot *opcuaPublishSlot) fault(status opcuaStatusCode) opcuaServerReply {
+	return opcuaServerReply{conn: slot.conn, requestID: slot.requestID, response: opcuaFault(&slot.header, status)}
+}
+
+// takeSlot removes the oldest waiting Publish request.
+func (ss *opcuaServerSession) takeSlot() *opcuaPublishSlot {
+	if len(ss.publishQueue) == 0 {
+		return nil
+	}
+	slot := ss.publishQueue[0]
+	ss.publishQueue = ss.publishQueue[1:]
+	return slot
+}
+
+// sortedSubscriptions returns the subscriptions of the session in the order they were created.
+func (ss *opcuaServerSession) sortedSubscriptions() []*opcuaSubscription {
+	subscriptions := make([]*opcuaSubscription, 0, len(ss.subscriptions))
+	for _, subscription := range ss.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].id < subscriptions[j].id })
+	return subscriptions
+}
+
+// endSubscription deletes a subscription whose end the next Publish request reports.
+func (ss *opcuaServerSession) endSubscription(subscription *opcuaSubscription, status opcuaStatusCode) {
+	delete(ss.subscriptions, subscription.id)
+	ss.items -= len(subscription.items)
+	ss.statusChanges = append(ss.statusChanges, opcuaStatusChange{subscriptionID: subscription.id, sequence: subscription.sequence, status: status})
+}
+
+// settle answers waiting Publish requests with ended subscriptions and messages that are overdue.
+// Without subscriptions, the requests left are answered with BadNoSubscription.
+func (ss *opcuaServerSession) settle(now time.Time) []opcuaServerReply {
+	var replies []opcuaServerReply
+	for len(ss.publishQueue) > 0 && len(ss.statusChanges) > 0 {
+		change := ss.statusChanges[0]
+		ss.statusChanges = ss.statusChanges[1:]
+		notification := newOPCUAExtensionObject(&opcuaStatusChangeNotification{Status: change.status})
+		replies = append(replies, ss.takeSlot().reply(&opcuaPublishResponse{
+			SubscriptionID:      change.subscriptionID,
+			NotificationMessage: opcuaNotificationMessage{SequenceNumber: opcuaNextSequence(change.sequence), PublishTime: now, NotificationData: []opcuaExtensionObject{notification}},
+		}))
+	}
+	for _, subscription := range ss.sortedSubscriptions() {
+		if len(ss.publishQueue) == 0 {
+			break
+		}
+		if subscription.late {
+			replies = append(replies, subscription.publish(ss.takeSlot(), now))
+		}
+	}
+	if len(ss.subscriptions) == 0 && len(ss.statusChanges) == 0 {
+		replies = append(replies, ss.answerPublishRequests(opcuaBadNoSubscription)...)
+	}
+	return replies
+}
+
+// answerPublishRequests answers every waiting Publish request with an error.
+func (ss *opcuaServerSession) answerPublishRequests(status opcuaStatusCode) []opcuaServerReply {
+	var replies []opcuaServerReply
+	for _, slot := range ss.publishQueue {
+		replies = append(replies, slot.fault(status))
+	}
+	ss.publishQueue = nil
+	return replies
+}
+
+// dropPublishRequests forgets the Publish requests that came over a connection, which can no longer
+// be answered.
+func (ss *opcuaServerSession) dropPublishRequests(c *opcuaServerConn) {
+	kept := ss.publishQueue[:0]
+	for _, slot := range ss.publishQueue {
+		if slot.conn != c {
+			kept = append(kept, slot)
+		}
+	}
+	ss.publishQueue = kept
+}
+
+// createSubscription creates a subscription, revising its intervals to the server's limits.
+func (s *OPCUAServer) createSubscription(session *opcuaServerSession, request *opcuaCreateSubscriptionRequest) opcuaResponse {
+	interval := time.Duration(request.RequestedPublishingInterval * float64(time.Millisecond))
+	if math.IsNaN(request.RequestedPublishingInterval) || interval < s.options.MinPublishingInterval {
+		interval = s.options.MinPublishingInterval
+	}
+	if interval > opcuaMaxPublishingInterval {
+		interval = opcuaMaxPublishingInterval
+	}
+	keepAlive := request.RequestedMaxKeepAliveCount
+	if keepAlive == 0 {
+		keepAlive = opcuaDefaultKeepAliveCount
+	}
+	if keepAlive > opcuaMaxKeepAliveCount {
+		keepAlive = opcuaMaxKeepAliveCount
+	}
+	lifetime := request.RequestedLifetimeCount
+	if lifetime < 3*keepAlive {
+		lifetime = 3 * keepAlive
+	}
+	maxNotifications := int(request.MaxNotificationsPerPublish)
+	if maxNotifications <= 0 || maxNotifications > math.MaxInt32 {
+		maxNotifications = math.MaxInt32
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(session.subscriptions) >= s.options.MaxSubscriptions {
+		return opcuaFault(&request.Header, opcuaBadTooManySubscriptions)
+	}
+	s.subscriptionID++
+	subscription := &opcuaSubscription{
+		id:               s.subscriptionID,
+		session:          session,
+		interval:         interval,
+		lifetimeCount:    lifetime,
+		keepAliveCount:   keepAlive,
+		maxNotifications: maxNotifications,
+		enabled:          request.PublishingEnabled,
+		items:            make(map[uint32]*opcuaMonitoredItem),
+		next:             time.Now().Add(interval),
+		keepAliveCounter: 1, // The first cycle sends a keep-alive if nothing changed
+		lifetimeCounter:  lifetime,
+	}
+	session.subscriptions[subscription.id] = subscription
+	return &opcuaCreateSubscriptionResponse{
+		Header:                    opcuaServerResponseHeader(&request.Header, opcuaGood),
+		SubscriptionID:            subscription.id,
+		RevisedPublishingInterval: float64(interval) / float64(time.Millisecond),
+		RevisedLifetimeCount:      lifetime,
+		RevisedMaxKeepAliveCount:  keepAlive,
+	}
+}
+
+// createMonitoredItems adds monitored items to a subscription and takes their first samples.
+func (s *OPCUAServer) createMonitoredItems(session *opcuaServerSession, request *opcuaCreateMonitoredItemsRequest) opcuaResponse {
+	switch {
+	case request.TimestampsToReturn < opcuaTimestampsSource || request.TimestampsToReturn > opcuaTimestampsNeither:
+		return opcuaFault(&request.Header, opcuaBadTimestampsToReturnInvalid)
+	case len(request.ItemsToCreate) == 0:
+		return opcuaFault(&request.Header, opcuaBadNothingToDo)
+	case len(request.ItemsToCreate) > opcuaMaxOperations:
+		return opcuaFault(&request.Header, opcuaBadTooManyOperations)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscription := session.subscriptions[request.SubscriptionID]
+	if subscription == nil {
+		return opcuaFault(&request.Header, opcuaBadSubscriptionIDInvalid)
+	}
+	now := time.Now()
+	response := &opcuaCreateMonitoredItemsResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaMonitoredItemCreateResult, len(request.ItemsToCreate))}
+	for i := range request.ItemsToCreate {
+		create := &request.ItemsToCreate[i]
+		item, status := s.monitoredItem(session, subscription, create, request.TimestampsToReturn, now)
+		if status.isBad() {
+			response.Results[i].Status = status
+			continue
+		}
+		s.itemID++
+		item.id = s.itemID
+		subscription.items[item.id] = item
+		session.items++
+		s.sample(session, item, now)
+		response.Results[i] = opcuaMonitoredItemCreateResult{
+			MonitoredItemID:         item.id,
+			RevisedSamplingInterval: float64(item.interval) / float64(time.Millisecond),
+			RevisedQueueSize:        uint32(item.queueSize),
+		}
+	}
+	return response
+}
+
+// monitoredItem validates a monitored item to create, revising its sampling interval and queue size.
+func (s *OPCUAServer) monitoredItem(session *opcuaServerSession, subscription *opcuaSubscription, create *opcuaMonitoredItemCreateRequest, timestamps int32, now time.Time) (*opcuaMonitoredItem, opcuaStatusCode) {
+	target := &create.ItemToMonitor
+	node := s.space.node(target.NodeID)
+	switch {
+	case node == nil:
+		return nil, opcuaBadNodeIDUnknown
+	case target.IndexRange != "":
+		return nil, opcuaBadIndexRangeInvalid
+	case target.DataEncoding.Name != "" && target.DataEncoding.Name != "Default Binary":
+		return nil, opcuaBadDataEncodingUnsupported
+	case create.MonitoringMode < 0 || create.MonitoringMode > 2:
+		return nil, opcuaBadMonitoringModeInvalid
+	case session.items >= s.options.MaxMonitoredItems:
+		return nil, opcuaBadTooManyMonitoredItems
+	}
+	if status := s.space.read(session, node, target.AttributeID, now).Status; status == opcuaBadAttributeIDInvalid || status == opcuaBadUserAccessDenied {
+		return nil, status
+	}
+
+	item := &opcuaMonitoredItem{
+		clientHandle:  create.ClientHandle,
+		node:          node,
+		attribute:     target.AttributeID,
+		timestamps:    timestamps,
+		mode:          create.MonitoringMode,
+		filter:        opcuaDataChangeFilter{Trigger: 1},
+		queueSize:     int(create.QueueSize),
+		discardOldest: create.DiscardOldest,
+	}
+	decoded, err := decodeOPCUAExtensionObject(create.Filter)
+	if err != nil {
+		return nil, opcuaBadMonitoredItemFilterUnsupported
+	}
+	if decoded != nil {
+		filter, isDataChange := decoded.(*opcuaDataChangeFilter)
+		switch {
+		case !isDataChange || target.AttributeID != opcuaAttributeValue:
+			return nil, opcuaBadMonitoredItemFilterUnsupported
+		case filter.Trigger < 0 || filter.Trigger > 2:
+			return nil, opcuaBadMonitoredItemFilterUnsupported
+		case filter.DeadbandType > 1, filter.DeadbandType == 1 && !(filter.DeadbandValue >= 0):
+			// Percent deadbands need an engineering range, which the variables do not have
+			return nil, opcuaBadDeadbandFilterInvalid
+		}
+		item.filter = *filter
+	}
+
+	// Negative intervals ask for the publishing interval
+	item.interval = time.Duration(create.SamplingInterval * float64(time.Millisecond))
+	if create.SamplingInterval < 0 {
+		item.interval = subscription.interval
+	}
+	if math.IsNaN(create.SamplingInterval) || item.interval < s.options.MinSamplingInterval {
+		item.interval = s.options.MinSamplingInterval
+	}
+	if item.interval > opcuaMaxPublishingInterval {
+		item.interval = opcuaMaxPublishingInterval
+	}
+	if item.queueSize < 1 {
+		item.queueSize = 1
+	}
+	if item.queueSize > opcuaMaxQueueSize {
+		item.queueSize = opcuaMaxQueueSize
+	}
+	return item, opcuaGood
+}
+
+// deleteMonitoredItems removes monitored items from a subscription.
+func (s *OPCUAServer) deleteMonitoredItems(session *opcuaServerSession, request *opcuaDeleteMonitoredItemsRequest) opcuaResponse {
+	if len(request.MonitoredItemIDs) == 0 {
+		return opcuaFault(&request.Header, opcuaBadNothingToDo)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscription := session.subscriptions[request.SubscriptionID]
+	if subscription == nil {
+		return opcuaFault(&request.Header, opcuaBadSubscriptionIDInvalid)
+	}
+	response := &opcuaDeleteMonitoredItemsResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaStatusCode, len(request.MonitoredItemIDs))}
+	for i, id := range request.MonitoredItemIDs {
+		if subscription.items[id] == nil {
+			response.Results[i] = opcuaBadMonitoredItemIDInvalid
+			continue
+		}
+		delete(subscription.items, id)
+		session.items--
+	}
+	return response
+}
+
+// deleteSubscriptions deletes subscriptions; Publish requests left without a subscription are
+// answered too.
+func (s *OPCUAServer) deleteSubscriptions(c *opcuaServerConn, requestID uint32, session *opcuaServerSession, request *opcuaDeleteSubscriptionsRequest) []opcuaServerReply {
+	if len(request.SubscriptionIDs) == 0 {
+		return []opcuaServerReply{{conn: c, requestID: requestID, response: opcuaFault(&request.Header, opcuaBadNothingToDo)}}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	response := &opcuaDeleteSubscriptionsResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), Results: make([]opcuaStatusCode, len(request.SubscriptionIDs))}
+	for i, id := range request.SubscriptionIDs {
+		subscription := session.subscriptions[id]
+		if subscription == nil {
+			response.Results[i] = opcuaBadSubscriptionIDInvalid
+			continue
+		}
+		delete(session.subscriptions, id)
+		session.items -= len(subscription.items)
+	}
+	replies := []opcuaServerReply{{conn: c, requestID: requestID, response: response}}
+	return append(replies, session.settle(time.Now())...)
+}
+
+// publishRequest processes the acknowledgements of a Publish request and queues it for the next
+// notification message; overdue messages are sent at once.
+func (s *OPCUAServer) publishRequest(c *opcuaServerConn, requestID uint32, session *opcuaServerSession, request *opcuaPublishRequest) []opcuaServerReply {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	slot := &opcuaPublishSlot{conn: c, requestID: requestID, header: request.Header}
+	for _, ack := range request.Acknowledgements {
+		status := opcuaBadSubscriptionIDInvalid
+		if subscription := session.subscriptions[ack.SubscriptionID]; subscription != nil {
+			status = opcuaBadSequenceNumberUnknown
+			for i, message := range subscription.retransmit {
+				if message.SequenceNumber == ack.SequenceNumber {
+					subscription.retransmit = append(subscription.retransmit[:i:i], subscription.retransmit[i+1:]...)
+					status = opcuaGood
+					break
+				}
+			}
+		}
+		slot.results = append(slot.results, status)
+	}
+	if len(session.subscriptions) == 0 && len(session.statusChanges) == 0 {
+		return []opcuaServerReply{slot.fault(opcuaBadNoSubscription)}
+	}
+	if len(session.publishQueue) >= opcuaMaxPublishQueue {
+		return []opcuaServerReply{slot.fault(opcuaBadTooManyPublishRequests)}
+	}
+	now := time.Now()
+	if request.Header.TimeoutHint > 0 {
+		slot.deadline = now.Add(time.Duration(request.Header.TimeoutHint) * time.Millisecond)
+	}
+	session.publishQueue = append(session.publishQueue, slot)
+	return session.settle(now)
+}
+
+// republish sends again a notification message that has not been acknowledged.
+func (s *OPCUAServer) republish(session *opcuaServerSession, request *opcuaRepublishRequest) opcuaResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscription := session.subscriptions[request.SubscriptionID]
+	if subscription == nil {
+		return opcuaFault(&request.Header, opcuaBadSubscriptionIDInvalid)
+	}
+	for _, message := range subscription.retransmit {
+		if message.SequenceNumber == request.RetransmitSequenceNumber {
+			message.NotificationData = append([]opcuaExtensionObject(nil), message.NotificationData...)
+			return &opcuaRepublishResponse{Header: opcuaServerResponseHeader(&request.Header, opcuaGood), NotificationMessage: message}
+		}
+	}
+	return opcuaFault(&request.Header, opcuaBadMessageNotAvailable)
+}
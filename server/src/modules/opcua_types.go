@@ -0,0 +1,1135 @@
+// server/src/modules/opcua_types.go
+
+package modules
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// opcuaStatusCode is an OPC UA status code. The top two bits give the severity: 00 good, 01 uncertain,
+// 10 bad.
+type opcuaStatusCode uint32
+
+const (
+	opcuaGood                              opcuaStatusCode = 0
+	opcuaBadUnexpectedError                opcuaStatusCode = 0x80010000
+	opcuaBadInternalError                  opcuaStatusCode = 0x80020000
+	opcuaBadCommunicationError             opcuaStatusCode = 0x80050000
+	opcuaBadEncodingError                  opcuaStatusCode = 0x80060000
+	opcuaBadDecodingError                  opcuaStatusCode = 0x80070000
+	opcuaBadEncodingLimitsExceeded         opcuaStatusCode = 0x80080000
+	opcuaBadTimeout                        opcuaStatusCode = 0x800A0000
+	opcuaBadServiceUnsupported             opcuaStatusCode = 0x800B0000
+	opcuaBadShutdown                       opcuaStatusCode = 0x800C0000
+	opcuaBadNothingToDo                    opcuaStatusCode = 0x800F0000
+	opcuaBadTooManyOperations              opcuaStatusCode = 0x80100000
+	opcuaBadCertificateInvalid             opcuaStatusCode = 0x80120000
+	opcuaBadSecurityChecksFailed           opcuaStatusCode = 0x80130000
+	opcuaBadCertificateTimeInvalid         opcuaStatusCode = 0x80140000
+	opcuaBadCertificateUntrusted           opcuaStatusCode = 0x801A0000
+	opcuaBadUserAccessDenied               opcuaStatusCode = 0x801F0000
+	opcuaBadIdentityTokenInvalid           opcuaStatusCode = 0x80200000
+	opcuaBadIdentityTokenRejected          opcuaStatusCode = 0x80210000
+	opcuaBadSecureChannelIDInvalid         opcuaStatusCode = 0x80220000
+	opcuaBadNonceInvalid                   opcuaStatusCode = 0x80240000
+	opcuaBadSessionIDInvalid               opcuaStatusCode = 0x80250000
+	opcuaBadSessionClosed                  opcuaStatusCode = 0x80260000
+	opcuaBadSessionNotActivated            opcuaStatusCode = 0x80270000
+	opcuaBadSubscriptionIDInvalid          opcuaStatusCode = 0x80280000
+	opcuaBadRequestHeaderInvalid           opcuaStatusCode = 0x802A0000
+	opcuaBadTimestampsToReturnInvalid      opcuaStatusCode = 0x802B0000
+	opcuaBadWaitingForInitialData          opcuaStatusCode = 0x80320000
+	opcuaBadNodeIDInvalid                  opcuaStatusCode = 0x80330000
+	opcuaBadNodeIDUnknown                  opcuaStatusCode = 0x80340000
+	opcuaBadAttributeIDInvalid             opcuaStatusCode = 0x80350000
+	opcuaBadIndexRangeInvalid              opcuaStatusCode = 0x80360000
+	opcuaBadDataEncodingUnsupported        opcuaStatusCode = 0x80390000
+	opcuaBadNotReadable                    opcuaStatusCode = 0x803A0000
+	opcuaBadNotWritable                    opcuaStatusCode = 0x803B0000
+	opcuaBadOutOfRange                     opcuaStatusCode = 0x803C0000
+	opcuaBadNotSupported                   opcuaStatusCode = 0x803D0000
+	opcuaBadMonitoringModeInvalid          opcuaStatusCode = 0x80410000
+	opcuaBadMonitoredItemIDInvalid         opcuaStatusCode = 0x80420000
+	opcuaBadMonitoredItemFilterUnsupported opcuaStatusCode = 0x80440000
+	opcuaBadContinuationPointInvalid       opcuaStatusCode = 0x804A0000
+	opcuaBadNoContinuationPoints           opcuaStatusCode = 0x804B0000
+	opcuaBadReferenceTypeIDInvalid         opcuaStatusCode = 0x804C0000
+	opcuaBadBrowseDirectionInvalid         opcuaStatusCode = 0x804D0000
+	opcuaBadSecurityModeRejected           opcuaStatusCode = 0x80540000
+	opcuaBadSecurityPolicyRejected         opcuaStatusCode = 0x80550000
+	opcuaBadTooManySessions                opcuaStatusCode = 0x80560000
+	opcuaBadApplicationSignatureInvalid    opcuaStatusCode = 0x80580000
+	opcuaBadViewIDUnknown                  opcuaStatusCode = 0x806B0000
+	opcuaBadMaxAgeInvalid                  opcuaStatusCode = 0x80700000
+	opcuaBadWriteNotSupported              opcuaStatusCode = 0x80730000
+	opcuaBadTypeMismatch                   opcuaStatusCode = 0x80740000
+	opcuaBadTooManySubscriptions           opcuaStatusCode = 0x80770000
+	opcuaBadTooManyPublishRequests         opcuaStatusCode = 0x80780000
+	opcuaBadNoSubscription                 opcuaStatusCode = 0x80790000
+	opcuaBadSequenceNumberUnknown          opcuaStatusCode = 0x807A0000
+	opcuaBadMessageNotAvailable            opcuaStatusCode = 0x807B0000
+	opcuaBadTCPMessageTypeInvalid          opcuaStatusCode = 0x807E0000
+	opcuaBadTCPSecureChannelUnknown        opcuaStatusCode = 0x807F0000
+	opcuaBadTCPMessageTooLarge             opcuaStatusCode = 0x80800000
+	opcuaBadTCPNotEnoughResources          opcuaStatusCode = 0x80810000
+	opcuaBadTCPInternalError               opcuaStatusCode = 0x80820000
+	opcuaBadTCPEndpointURLInvalid          opcuaStatusCode = 0x80830000
+	opcuaBadSecureChannelClosed            opcuaStatusCode = 0x80860000
+	opcuaBadSecureChannelTokenUnknown      opcuaStatusCode = 0x80870000
+	opcuaBadSequenceNumberInvalid          opcuaStatusCode = 0x80880000
+	opcuaBadDeadbandFilterInvalid          opcuaStatusCode = 0x808E0000
+	opcuaBadRequestTooLarge                opcuaStatusCode = 0x80B80000
+	opcuaBadResponseTooLarge               opcuaStatusCode = 0x80B90000
+	opcuaBadTooManyMonitoredItems          opcuaStatusCode = 0x80DB0000
+)
+
+// opcuaStatusNames names the status codes this package produces or acts on, for messages.
+var opcuaStatusNames = map[opcuaStatusCode]string{
+	opcuaGood:                              "Good",
+	opcuaBadUnexpectedError:                "BadUnexpectedError",
+	opcuaBadInternalError:                  "BadInternalError",
+	opcuaBadCommunicationError:             "BadCommunicationError",
+	opcuaBadEncodingError:                  "BadEncodingError",
+	opcuaBadDecodingError:                  "BadDecodingError",
+	opcuaBadEncodingLimitsExceeded:         "BadEncodingLimitsExceeded",
+	opcuaBadTimeout:                        "BadTimeout",
+	opcuaBadServiceUnsupported:             "BadServiceUnsupported",
+	opcuaBadShutdown:                       "BadShutdown",
+	opcuaBadNothingToDo:                    "BadNothingToDo",
+	opcuaBadTooManyOperations:              "BadTooManyOperations",
+	opcuaBadCertificateInvalid:             "BadCertificateInvalid",
+	opcuaBadSecurityChecksFailed:           "BadSecurityChecksFailed",
+	opcuaBadCertificateTimeInvalid:         "BadCertificateTimeInvalid",
+	opcuaBadCertificateUntrusted:           "BadCertificateUntrusted",
+	opcuaBadUserAccessDenied:               "BadUserAccessDenied",
+	opcuaBadIdentityTokenInvalid:           "BadIdentityTokenInvalid",
+	opcuaBadIdentityTokenRejected:          "BadIdentityTokenRejected",
+	opcuaBadSecureChannelIDInvalid:         "BadSecureChannelIdInvalid",
+	opcuaBadNonceInvalid:                   "BadNonceInvalid",
+	opcuaBadSessionIDInvalid:               "BadSessionIdInvalid",
+	opcuaBadSessionClosed:                  "BadSessionClosed",
+	opcuaBadSessionNotActivated:            "BadSessionNotActivated",
+	opcuaBadSubscriptionIDInvalid:          "BadSubscriptionIdInvalid",
+	opcuaBadRequestHeaderInvalid:           "BadRequestHeaderInvalid",
+	opcuaBadTimestampsToReturnInvalid:      "BadTimestampsToReturnInvalid",
+	opcuaBadWaitingForInitialData:          "BadWaitingForInitialData",
+	opcuaBadNodeIDInvalid:                  "BadNodeIdInvalid",
+	opcuaBadNodeIDUnknown:                  "BadNodeIdUnknown",
+	opcuaBadAttributeIDInvalid:             "BadAttributeIdInvalid",
+	opcuaBadIndexRangeInvalid:              "BadIndexRangeInvalid",
+	opcuaBadDataEncodingUnsupported:        "BadDataEncodingUnsupported",
+	opcuaBadNotReadable:                    "BadNotReadable",
+	opcuaBadNotWritable:                    "BadNotWritable",
+	opcuaBadOutOfRange:                     "BadOutOfRange",
+	opcuaBadNotSupported:                   "BadNotSupported",
+	opcuaBadMonitoringModeInvalid:          "BadMonitoringModeInvalid",
+	opcuaBadMonitoredItemIDInvalid:         "BadMonitoredItemIdInvalid",
+	opcuaBadMonitoredItemFilterUnsupported: "BadMonitoredItemFilterUnsupported",
+	opcuaBadContinuationPointInvalid:       "BadContinuationPointInvalid",
+	opcuaBadNoContinuationPoints:           "BadNoContinuationPoints",
+	opcuaBadReferenceTypeIDInvalid:         "BadReferenceTypeIdInvalid",
+	opcuaBadBrowseDirectionInvalid:         "BadBrowseDirectionInvalid",
+	opcuaBadSecurityModeRejected:           "BadSecurityModeRejected",
+	opcuaBadSecurityPolicyRejected:         "BadSecurityPolicyRejected",
+	opcuaBadTooManySessions:                "BadTooManySessions",
+	opcuaBadApplicationSignatureInvalid:    "BadApplicationSignatureInvalid",
+	opcuaBadViewIDUnknown:                  "BadViewIdUnknown",
+	opcuaBadMaxAgeInvalid:                  "BadMaxAgeInvalid",
+	opcuaBadWriteNotSupported:              "BadWriteNotSupported",
+	opcuaBadTypeMismatch:                   "BadTypeMismatch",
+	opcuaBadTooManySubscriptions:           "BadTooManySubscriptions",
+	opcuaBadTooManyPublishRequests:         "BadTooManyPublishRequests",
+	opcuaBadNoSubscription:                 "BadNoSubscription",
+	opcuaBadSequenceNumberUnknown:          "BadSequenceNumberUnknown",
+	opcuaBadMessageNotAvailable:            "BadMessageNotAvailable",
+	opcuaBadTCPMessageTypeInvalid:          "BadTcpMessageTypeInvalid",
+	opcuaBadTCPSecureChannelUnknown:        "BadTcpSecureChannelUnknown",
+	opcuaBadTCPMessageTooLarge:             "BadTcpMessageTooLarge",
+	opcuaBadTCPNotEnoughResources:          "BadTcpNotEnoughResources",
+	opcuaBadTCPInternalError:               "BadTcpInternalError",
+	opcuaBadTCPEndpointURLInvalid:          "BadTcpEndpointUrlInvalid",
+	opcuaBadSecureChannelClosed:            "BadSecureChannelClosed",
+	opcuaBadSecureChannelTokenUnknown:      "BadSecureChannelTokenUnknown",
+	opcuaBadSequenceNumberInvalid:          "BadSequenceNumberInvalid",
+	opcuaBadDeadbandFilterInvalid:          "BadDeadbandFilterInvalid",
+	opcuaBadRequestTooLarge:                "BadRequestTooLarge",
+	opcuaBadResponseTooLarge:               "BadResponseTooLarge",
+	opcuaBadTooManyMonitoredItems:          "BadTooManyMonitoredItems",
+}
+
+// isBad reports whether the status code has bad severity.
+func (s opcuaStatusCode) isBad() bool {
+	return s&0x80000000 != 0
+}
+
+// Error lets a bad status code be returned as an error.
+func (s opcuaStatusCode) Error() string {
+	if name, known := opcuaStatusNames[s&0xFFFF0000]; known {
+		return "OPC UA " + name
+	}
+	return fmt.Sprintf("OPC UA status 0x%08X", uint32(s))
+}
+
+// Node ID identifier types
+const (
+	opcuaNumericID = 0
+	opcuaStringID  = 1
+	opcuaGUIDID    = 2
+	opcuaOpaqueID  = 3
+)
+
+// opcuaNodeID identifies a node in an address space.
+type opcuaNodeID struct {
+	Namespace uint16
+	Type      byte   // opcuaNumericID, opcuaStringID, opcuaGUIDID or opcuaOpaqueID
+	Numeric   uint32 // Identifier of numeric node IDs
+	Text      string // Identifier of string node IDs
+	Bytes     []byte // Identifier of GUID node IDs, in text order, and of opaque node IDs
+}
+
+// opcuaNumericNodeID returns a numeric node ID.
+func opcuaNumericNodeID(namespace uint16, id uint32) opcuaNodeID {
+	return opcuaNodeID{Namespace: namespace, Numeric: id}
+}
+
+// isNull reports whether the node ID is the null node ID, ns=0;i=0.
+func (id opcuaNodeID) isNull() bool {
+	switch id.Type {
+	case opcuaNumericID:
+		return id.Namespace == 0 && id.Numeric == 0
+	case opcuaStringID:
+		return id.Namespace == 0 && id.Text == ""
+	}
+	return id.Namespace == 0 && len(id.Bytes) == 0
+}
+
+// String formats the node ID in the standard notation, e.g. "i=85" or "ns=2;s=Line3.Temperature".
+func (id opcuaNodeID) String() string {
+	prefix := ""
+	if id.Namespace != 0 {
+		prefix = "ns=" + strconv.Itoa(int(id.Namespace)) + ";"
+	}
+	switch id.Type {
+	case opcuaStringID:
+		return prefix + "s=" + id.Text
+	case opcuaGUIDID:
+		g := hex.EncodeToString(id.Bytes)
+		if len(g) == 32 {
+			g = g[0:8] + "-" + g[8:12] + "-" + g[12:16] + "-" + g[16:20] + "-" + g[20:]
+		}
+		return prefix + "g=" + g
+	case opcuaOpaqueID:
+		return prefix + "b=" + base64.StdEncoding.EncodeToString(id.Bytes)
+	}
+	return prefix + "i=" + strconv.FormatUint(uint64(id.Numeric), 10)
+}
+
+// equal reports whether two node IDs are the same.
+func (id opcuaNodeID) equal(other opcuaNodeID) bool {
+	return id.String() == other.String()
+}
+
+// parseOPCUANodeID parses the standard notation of a node ID.
+func parseOPCUANodeID(text string) (opcuaNodeID, error) {
+	var id opcuaNodeID
+	rest := text
+	if strings.HasPrefix(rest, "ns=") {
+		end := strings.IndexByte(rest, ';')
+		if end < 0 {
+			return id, fmt.Errorf("invalid OPC UA node ID %q", text)
+		}
+		namespace, err := strconv.ParseUint(rest[3:end], 10, 16)
+		if err != nil {
+			return id, fmt.Errorf("invalid namespace in OPC UA node ID %q", text)
+		}
+		id.Namespace = uint16(namespace)
+		rest = rest[end+1:]
+	}
+	if len(rest) < 2 || rest[1] != '=' {
+		return id, fmt.Errorf("invalid OPC UA node ID %q", text)
+	}
+	value := rest[2:]
+	switch rest[0] {
+	case 'i':
+		numeric, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return id, fmt.Errorf("invalid numeric OPC UA node ID %q", text)
+		}
+		id.Numeric = uint32(numeric)
+	case 's':
+		if value == "" || !utf8.ValidString(value) {
+			return id, fmt.Errorf("invalid string OPC UA node ID %q", text)
+		}
+		id.Type, id.Text = opcuaStringID, value
+	case 'g':
+		guid, err := hex.DecodeString(strings.ReplaceAll(value, "-", ""))
+		if err != nil || len(guid) != 16 {
+			return id, fmt.Errorf("invalid GUID OPC UA node ID %q", text)
+		}
+		id.Type, id.Bytes = opcuaGUIDID, guid
+	case 'b':
+		opaque, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(opaque) == 0 {
+			return id, fmt.Errorf("invalid opaque OPC UA node ID %q", text)
+		}
+		id.Type, id.Bytes = opcuaOpaqueID, opaque
+	default:
+		return id, fmt.Errorf("invalid OPC UA node ID %q", text)
+	}
+	return id, nil
+}
+
+// opcuaExpandedNodeID is a node ID that may name its namespace by URI or live on another server.
+type opcuaExpandedNodeID struct {
+	NodeID       opcuaNodeID
+	NamespaceURI string
+	ServerIndex  uint32
+}
+
+// opcuaQualifiedName is a name qualified by a namespace index, such as a browse name.
+type opcuaQualifiedName struct {
+	Namespace uint16
+	Name      string
+}
+
+// opcuaLocalizedText is human-readable text with an optional locale.
+type opcuaLocalizedText struct {
+	Locale string
+	Text   string
+}
+
+// opcuaExtensionObject carries an encoded structure identified by the node ID of its binary encoding.
+// Body is nil when the object is empty.
+type opcuaExtensionObject struct {
+	TypeID opcuaNodeID
+	Body   []byte
+}
+
+// opcuaDiagnosticInfo is vendor diagnostic information, decoded only to be skipped.
+type opcuaDiagnosticInfo struct {
+	SymbolicID          int32
+	NamespaceURI        int32
+	LocalizedText       int32
+	Locale              int32
+	AdditionalInfo      string
+	InnerStatusCode     opcuaStatusCode
+	InnerDiagnosticInfo *opcuaDiagnosticInfo
+	mask                byte
+}
+
+// Built-in type IDs used in variants
+const (
+	opcuaTypeBoolean         = 1
+	opcuaTypeSByte           = 2
+	opcuaTypeByte            = 3
+	opcuaTypeInt16           = 4
+	opcuaTypeUInt16          = 5
+	opcuaTypeInt32           = 6
+	opcuaTypeUInt32          = 7
+	opcuaTypeInt64           = 8
+	opcuaTypeUInt64          = 9
+	opcuaTypeFloat           = 10
+	opcuaTypeDouble          = 11
+	opcuaTypeString          = 12
+	opcuaTypeDateTime        = 13
+	opcuaTypeGUID            = 14
+	opcuaTypeByteString      = 15
+	opcuaTypeXMLElement      = 16
+	opcuaTypeNodeID          = 17
+	opcuaTypeExpandedNodeID  = 18
+	opcuaTypeStatusCode      = 19
+	opcuaTypeQualifiedName   = 20
+	opcuaTypeLocalizedText   = 21
+	opcuaTypeExtensionObject = 22
+	opcuaTypeDataValue       = 23
+	opcuaTypeVariant         = 24
+	opcuaTypeDiagnosticInfo  = 25
+)
+
+// opcuaVariant holds a value of any built-in type. Value is nil for an empty variant, a Go value of the
+// matching type for a scalar (bool, int8, byte, int16, uint16, int32, uint32, int64, uint64, float32,
+// float64, string, time.Time, []byte, opcuaNodeID and so on), or a []interface{} of them for an array.
+type opcuaVariant struct {
+	Type       byte
+	Value      interface{}
+	Dimensions []int32 // Array dimensions of multi-dimensional arrays, whose Value is flattened
+}
+
+// opcuaDataValue is a value with its status and timestamps.
+type opcuaDataValue struct {
+	Value           *opcuaVariant // nil when the value is absent
+	Status          opcuaStatusCode
+	SourceTimestamp time.Time
+	ServerTimestamp time.Time
+	SourcePicos     uint16
+	ServerPicos     uint16
+}
+
+// opcuaNumber converts a numeric or boolean variant to float64.
+func opcuaNumber(variant *opcuaVariant) (float64, bool) {
+	if variant == nil {
+		return 0, false
+	}
+	switch value := variant.Value.(type) {
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	case int8:
+		return float64(value), true
+	case byte:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case float32:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// Limits protecting the decoder from hostile lengths
+const (
+	opcuaMaxArrayLength  = 1 << 20
+	opcuaMaxNestingDepth = 32
+)
+
+var errOPCUADecode = errors.New("malformed OPC UA message")
+
+// opcuaEpochSeconds is the origin of OPC UA DateTime values, 1601-01-01, in Unix seconds. DateTime
+// values count 100 nanosecond ticks from it.
+const opcuaEpochSeconds = -11644473600
+
+// opcuaCodec encodes or decodes OPC UA binary structures. Every method takes a pointer to the field
+// it handles, so a single method per structure describes both directions. Decoding errors are sticky:
+// after the first one, further calls do nothing and err keeps the cause.
+type opcuaCodec struct {
+	decoding bool
+	buf      []byte // Encoded output
+	data     []byte // Input not yet decoded
+	depth    int    // Nesting of variants and diagnostic infos being decoded
+	err      error
+}
+
+func newOPCUAEncoder() *opcuaCodec {
+	return &opcuaCodec{buf: make([]byte, 0, 256)}
+}
+
+func newOPCUADecoder(data []byte) *opcuaCodec {
+	return &opcuaCodec{decoding: true, data: data}
+}
+
+func (c *opcuaCodec) fail(format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf("%w: "+format, append([]interface{}{errOPCUADecode}, args...)...)
+	}
+}
+
+// take consumes n bytes of input.
+func (c *opcuaCodec) take(n int) []byte {
+	if c.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(c.data) {
+		c.fail("truncated")
+		return nil
+	}
+	taken := c.data[:n]
+	c.data = c.data[n:]
+	return taken
+}
+
+func (c *opcuaCodec) boolean(v *bool) {
+	b := byte(0)
+	if *v {
+		b = 1
+	}
+	c.uint8(&b)
+	*v = b != 0
+}
+
+// grow extends the buffer being encoded by n bytes and returns them.
+func (c *opcuaCodec) grow(n int) []byte {
+	c.buf = append(c.buf, make([]byte, n)...)
+	return c.buf[len(c.buf)-n:]
+}
+
+func (c *opcuaCodec) uint8(v *byte) {
+	if !c.decoding {
+		c.buf = append(c.buf, *v)
+	} else if b := c.take(1); b != nil {
+		*v = b[0]
+	}
+}
+
+func (c *opcuaCodec) int8(v *int8) {
+	b := byte(*v)
+	c.uint8(&b)
+	*v = int8(b)
+}
+
+func (c *opcuaCodec) uint16(v *uint16) {
+	if !c.decoding {
+		binary.LittleEndian.PutUint16(c.grow(2), *v)
+	} else if b := c.take(2); b != nil {
+		*v = binary.LittleEndian.Uint16(b)
+	}
+}
+
+func (c *opcuaCodec) int16(v *int16) {
+	u := uint16(*v)
+	c.uint16(&u)
+	*v = int16(u)
+}
+
+func (c *opcuaCodec) uint32(v *uint32) {
+	if !c.decoding {
+		binary.LittleEndian.PutUint32(c.grow(4), *v)
+	} else if b := c.take(4); b != nil {
+		*v = binary.LittleEndian.Uint32(b)
+	}
+}
+
+func (c *opcuaCodec) int32(v *int32) {
+	u := uint32(*v)
+	c.uint32(&u)
+	*v = int32(u)
+}
+
+func (c *opcuaCodec) uint64(v *uint64) {
+	if !c.decoding {
+		binary.LittleEndian.PutUint64(c.grow(8), *v)
+	} else if b := c.take(8); b != nil {
+		*v = binary.LittleEndian.Uint64(b)
+	}
+}
+
+func (c *opcuaCodec) int64(v *int64) {
+	u := uint64(*v)
+	c.uint64(&u)
+	*v = int64(u)
+}
+
+func (c *opcuaCodec) float32(v *float32) {
+	u := math.Float32bits(*v)
+	c.uint32(&u)
+	*v = math.Float32frombits(u)
+}
+
+func (c *opcuaCodec) float64(v *float64) {
+	u := math.Float64bits(*v)
+	c.uint64(&u)
+	*v = math.Float64frombits(u)
+}
+
+func (c *opcuaCodec) statusCode(v *opcuaStatusCode) {
+	u := uint32(*v)
+	c.uint32(&u)
+	*v = opcuaStatusCode(u)
+}
+
+// enum handles an enumeration, encoded as Int32.
+func (c *opcuaCodec) enum(v *int32) {
+	c.int32(v)
+}
+
+// byteString handles a length-prefixed byte string; nil encodes as the null byte string.
+func (c *opcuaCodec) byteString(v *[]byte) {
+	if !c.decoding {
+		if *v == nil {
+			binary.LittleEndian.PutUint32(c.grow(4), math.MaxUint32)
+			return
+		}
+		binary.LittleEndian.PutUint32(c.grow(4), uint32(len(*v)))
+		c.buf = append(c.buf, *v...)
+		return
+	}
+	var length int32
+	c.int32(&length)
+	if length < 0 {
+		*v = nil
+		return
+	}
+	if b := c.take(int(length)); b != nil {
+		*v = append([]byte{}, b...)
+	}
+}
+
+// string handles a UTF-8 string; the empty string encodes as the null string.
+func (c *opcuaCodec) string(v *string) {
+	var b []byte
+	if *v != "" {
+		b = []byte(*v)
+	}
+	c.byteString(&b)
+	if c.decoding && c.err == nil {
+		if !utf8.Valid(b) {
+			c.fail("invalid UTF-8 string")
+		}
+		*v = string(b)
+	}
+}
+
+// dateTime handles a DateTime; the zero time encodes as 0.
+func (c *opcuaCodec) dateTime(v *time.Time) {
+	var ticks int64
+	if !c.decoding && !v.IsZero() {
+		seconds := v.Unix() - opcuaEpochSeconds
+		switch {
+		case seconds < 0:
+			ticks = 0
+		case seconds >= math.MaxInt64/10000000:
+			// Times past the range saturate, which is how the standard represents them
+			ticks = math.MaxInt64
+		default:
+			ticks = seconds*1e7 + int64(v.Nanosecond()/100)
+		}
+	}
+	c.int64(&ticks)
+	if c.decoding {
+		*v = time.Time{}
+		if ticks > 0 && ticks < math.MaxInt64 {
+			*v = time.Unix(ticks/1e7+opcuaEpochSeconds, ticks%1e7*100).UTC()
+		}
+	}
+}
+
+// guid handles a GUID, kept in text order: the first three fields are little-endian on the wire.
+func (c *opcuaCodec) guid(v *[]byte) {
+	if !c.decoding {
+		g := make([]byte, 16)
+		copy(g, *v)
+		c.buf = append(c.buf, g[3], g[2], g[1], g[0], g[5], g[4], g[7], g[6])
+		c.buf = append(c.buf, g[8:]...)
+		return
+	}
+	if b := c.take(16); b != nil {
+		*v = append([]byte{b[3], b[2], b[1], b[0], b[5], b[4], b[7], b[6]}, b[8:]...)
+	}
+}
+
+// arrayLength writes the length of an array being encoded, or reads and checks the length of one being
+// decoded. Empty arrays encode as null arrays.
+func (c *opcuaCodec) arrayLength(n int) int {
+	if !c.decoding {
+		if n == 0 {
+			binary.LittleEndian.PutUint32(c.grow(4), math.MaxUint32)
+		} else {
+			binary.LittleEndian.PutUint32(c.grow(4), uint32(n))
+		}
+		return n
+	}
+	var length int32
+	c.int32(&length)
+	switch {
+	case c.err != nil || length <= 0:
+		return 0
+	case length > opcuaMaxArrayLength || int(length) > len(c.data):
+		// Every element takes at least one byte
+		c.fail("array of %d elements", length)
+		return 0
+	}
+	return int(length)
+}
+
+func (c *opcuaCodec) strings(v *[]string) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]string, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.string(&(*v)[i])
+	}
+}
+
+func (c *opcuaCodec) uint32s(v *[]uint32) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]uint32, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.uint32(&(*v)[i])
+	}
+}
+
+func (c *opcuaCodec) statusCodes(v *[]opcuaStatusCode) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]opcuaStatusCode, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.statusCode(&(*v)[i])
+	}
+}
+
+func (c *opcuaCodec) byteStrings(v *[][]byte) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([][]byte, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.byteString(&(*v)[i])
+	}
+}
+
+func (c *opcuaCodec) diagnosticInfos(v *[]*opcuaDiagnosticInfo) {
+	n := c.arrayLength(len(*v))
+	if c.decoding {
+		*v = make([]*opcuaDiagnosticInfo, n)
+	}
+	for i := 0; i < n && c.err == nil; i++ {
+		c.diagnosticInfo(&(*v)[i])
+	}
+}
+
+// nodeID handles a node ID in the most compact encoding that holds it.
+func (c *opcuaCodec) nodeID(v *opcuaNodeID) {
+	c.nodeIDFlags(v, 0)
+}
+
+// nodeIDFlags handles a node ID whose encoding byte also carries the flags of an expanded node ID, and
+// returns the flags read.
+func (c *opcuaCodec) nodeIDFlags(v *opcuaNodeID, flags byte) byte {
+	if !c.decoding {
+		switch {
+		case v.Type == opcuaNumericID && v.Namespace == 0 && v.Numeric <= 0xFF:
+			c.buf = append(c.buf, 0x00|flags, byte(v.Numeric))
+		case v.Type == opcuaNumericID && v.Namespace <= 0xFF && v.Numeric <= 0xFFFF:
+			c.buf = append(c.buf, 0x01|flags, byte(v.Namespace))
+			binary.LittleEndian.PutUint16(c.grow(2), uint16(v.Numeric))
+		case v.Type == opcuaNumericID:
+			c.buf = append(c.buf, 0x02|flags)
+			binary.LittleEndian.PutUint16(c.grow(2), v.Namespace)
+			binary.LittleEndian.PutUint32(c.grow(4), v.Numeric)
+		case v.Type == opcuaStringID:
+			c.buf = append(c.buf, 0x03|flags)
+			binary.LittleEndian.PutUint16(c.grow(2), v.Namespace)
+			c.string(&v.Text)
+		case v.Type == opcuaGUIDID:
+			c.buf = append(c.buf, 0x04|flags)
+			binary.LittleEndian.PutUint16(c.grow(2), v.Namespace)
+			c.guid(&v.Bytes)
+		default:
+			c.buf = append(c.buf, 0x05|flags)
+			binary.LittleEndian.PutUint16(c.grow(2), v.Namespace)
+			c.byteString(&v.Bytes)
+		}
+		return flags
+	}
+
+	var encoding byte
+	c.uint8(&encoding)
+	*v = opcuaNodeID{}
+	switch encoding & 0x0F {
+	case 0x00:
+		var id byte
+		c.uint8(&id)
+		v.Numeric = uint32(id)
+	case 0x01:
+		var namespace byte
+		var id uint16
+		c.uint8(&namespace)
+		c.uint16(&id)
+		v.Namespace, v.Numeric = uint16(namespace), uint32(id)
+	case 0x02:
+		c.uint16(&v.Namespace)
+		c.uint32(&v.Numeric)
+	case 0x03:
+		v.Type = opcuaStringID
+		c.uint16(&v.Namespace)
+		c.string(&v.Text)
+	case 0x04:
+		v.Type = opcuaGUIDID
+		c.uint16(&v.Namespace)
+		c.guid(&v.Bytes)
+	case 0x05:
+		v.Type = opcuaOpaqueID
+		c.uint16(&v.Namespace)
+		c.byteString(&v.Bytes)
+	default:
+		c.fail("node ID encoding %d", encoding)
+	}
+	return encoding & 0xC0
+}
+
+func (c *opcuaCodec) expandedNodeID(v *opcuaExpandedNodeID) {
+	flags := byte(0)
+	if v.NamespaceURI != "" {
+		flags |= 0x80
+	}
+	if v.ServerIndex != 0 {
+		flags |= 0x40
+	}
+	flags = c.nodeIDFlags(&v.NodeID, flags)
+	if flags&0x80 != 0 {
+		c.string(&v.NamespaceURI)
+	}
+	if flags&0x40 != 0 {
+		c.uint32(&v.ServerIndex)
+	}
+}
+
+func (c *opcuaCodec) qualifiedName(v *opcuaQualifiedName) {
+	c.uint16(&v.Namespace)
+	c.string(&v.Name)
+}
+
+func (c *opcuaCodec) localizedText(v *opcuaLocalizedText) {
+	mask := byte(0)
+	if v.Locale != "" {
+		mask |= 0x01
+	}
+	if v.Text != "" {
+		mask |= 0x02
+	}
+	c.uint8(&mask)
+	if mask&0x01 != 0 {
+		c.string(&v.Locale)
+	}
+	if mask&0x02 != 0 {
+		c.string(&v.Text)
+	}
+}
+
+// extensionObject handles an extension object with a binary body, or none. XML bodies are kept as
+// bytes but never produced.
+func (c *opcuaCodec) extensionObject(v *opcuaExtensionObject) {
+	c.nodeID(&v.TypeID)
+	encoding := byte(0)
+	if v.Body != nil {
+		encoding = 1
+	}
+	c.uint8(&encoding)
+	switch encoding {
+	case 0:
+		v.Body = nil
+	case 1, 2:
+		c.byteString(&v.Body)
+	default:
+		c.fail("extension object encoding %d", encoding)
+	}
+}
+
+// diagnosticInfo handles a diagnostic info; nil encodes as the empty one.
+func (c *opcuaCodec) diagnosticInfo(v **opcuaDiagnosticInfo) {
+	if !c.decoding {
+		if *v == nil {
+			c.buf = append(c.buf, 0)
+			return
+		}
+	} else {
+		*v = &opcuaDiagnosticInfo{}
+		c.depth++
+		defer func() { c.depth-- }()
+		if c.depth > opcuaMaxNestingDepth {
+			c.fail("diagnostic info nested too deeply")
+			return
+		}
+	}
+	info := *v
+	c.uint8(&info.mask)
+	if info.mask&0x01 != 0 {
+		c.int32(&info.SymbolicID)
+	}
+	if info.mask&0x02 != 0 {
+		c.int32(&info.NamespaceURI)
+	}
+	if info.mask&0x08 != 0 {
+		c.int32(&info.Locale)
+	}
+	if info.mask&0x04 != 0 {
+		c.int32(&info.LocalizedText)
+	}
+	if info.mask&0x10 != 0 {
+		c.string(&info.AdditionalInfo)
+	}
+	if info.mask&0x20 != 0 {
+		c.statusCode(&info.InnerStatusCode)
+	}
+	if info.mask&0x40 != 0 {
+		c.diagnosticInfo(&info.InnerDiagnosticInfo)
+	}
+}
+
+// variant handles a variant holding a scalar or an array of one built-in type.
+func (c *opcuaCodec) variant(v *opcuaVariant) {
+	if c.decoding {
+		c.depth++
+		defer func() { c.depth-- }()
+		if c.depth > opcuaMaxNestingDepth {
+			c.fail("variant nested too deeply")
+			return
+		}
+	}
+	encoding := v.Type & 0x3F
+	values, isArray := v.Value.([]interface{})
+	if isArray {
+		encoding |= 0x80
+	}
+	if len(v.Dimensions) > 0 {
+		encoding |= 0x40
+	}
+	c.uint8(&encoding)
+	v.Type = encoding & 0x3F
+	if v.Type > opcuaTypeDiagnosticInfo {
+		c.fail("variant type %d", v.Type)
+		return
+	}
+	if v.Type == 0 {
+		v.Value = nil
+		return
+	}
+
+	if encoding&0x80 == 0 {
+		if c.decoding {
+			v.Value = nil
+		}
+		v.Value = c.variantValue(v.Type, v.Value)
+	} else {
+		n := c.arrayLength(len(values))
+		if c.decoding {
+			values = make([]interface{}, n)
+		}
+		for i := 0; i < n && c.err == nil; i++ {
+			values[i] = c.variantValue(v.Type, values[i])
+		}
+		v.Value = values
+	}
+	if encoding&0x40 != 0 {
+		n := c.arrayLength(len(v.Dimensions))
+		if c.decoding {
+			v.Dimensions = make([]int32, n)
+		}
+		for i := 0; i < n && c.err == nil; i++ {
+			c.int32(&v.Dimensions[i])
+		}
+	}
+}
+
+// variantValue handles one value of a variant. When encoding, value must have the Go type matching
+// the built-in type; when decoding, the value read is returned.
+func (c *opcuaCodec) variantValue(typeID byte, value interface{}) interface{} {
+	if !c.decoding && !opcuaValueMatches(typeID, value) {
+		c.fail("variant value %T is not of type %d", value, typeID)
+		return value
+	}
+	switch typeID {
+	case opcuaTypeBoolean:
+		v, _ := value.(bool)
+		c.boolean(&v)
+		return v
+	case opcuaTypeSByte:
+		v, _ := value.(int8)
+		c.int8(&v)
+		return v
+	case opcuaTypeByte:
+		v, _ := value.(byte)
+		c.uint8(&v)
+		return v
+	case opcuaTypeInt16:
+		v, _ := value.(int16)
+		c.int16(&v)
+		return v
+	case opcuaTypeUInt16:
+		v, _ := value.(uint16)
+		c.uint16(&v)
+		return v
+	case opcuaTypeInt32:
+		v, _ := value.(int32)
+		c.int32(&v)
+		return v
+	case opcuaTypeUInt32:
+		v, _ := value.(uint32)
+		c.uint32(&v)
+		return v
+	case opcuaTypeInt64:
+		v, _ := value.(int64)
+		c.int64(&v)
+		return v
+	case opcuaTypeUInt64:
+		v, _ := value.(uint64)
+		c.uint64(&v)
+		return v
+	case opcuaTypeFloat:
+		v, _ := value.(float32)
+		c.float32(&v)
+		return v
+	case opcuaTypeDouble:
+		v, _ := value.(float64)
+		c.float64(&v)
+		return v
+	case opcuaTypeString, opcuaTypeXMLElement:
+		v, _ := value.(string)
+		c.string(&v)
+		return v
+	case opcuaTypeDateTime:
+		v, _ := value.(time.Time)
+		c.dateTime(&v)
+		return v
+	case opcuaTypeGUID:
+		v, _ := value.([]byte)
+		c.guid(&v)
+		return v
+	case opcuaTypeByteString:
+		v, _ := value.([]byte)
+		c.byteString(&v)
+		return v
+	case opcuaTypeNodeID:
+		v, _ := value.(opcuaNodeID)
+		c.nodeID(&v)
+		return v
+	case opcuaTypeExpandedNodeID:
+		v, _ := value.(opcuaExpandedNodeID)
+		c.expandedNodeID(&v)
+		return v
+	case opcuaTypeStatusCode:
+		v, _ := value.(opcuaStatusCode)
+		c.statusCode(&v)
+		return v
+	case opcuaTypeQualifiedName:
+		v, _ := value.(opcuaQualifiedName)
+		c.qualifiedName(&v)
+		return v
+	case opcuaTypeLocalizedText:
+		v, _ := value.(opcuaLocalizedText)
+		c.localizedText(&v)
+		return v
+	case opcuaTypeExtensionObject:
+		v, _ := value.(opcuaExtensionObject)
+		c.extensionObject(&v)
+		return v
+	case opcuaTypeDataValue:
+		v, _ := value.(opcuaDataValue)
+		c.dataValue(&v)
+		return v
+	case opcuaTypeVariant:
+		v, _ := value.(opcuaVariant)
+		c.variant(&v)
+		return v
+	case opcuaTypeDiagnosticInfo:
+		v, _ := value.(*opcuaDiagnosticInfo)
+		c.diagnosticInfo(&v)
+		return v
+	}
+	return nil
+}
+
+// opcuaValueMatches reports whether a Go value can be encoded as the built-in type.
+func opcuaValueMatches(typeID byte, value interface{}) bool {
+	var ok bool
+	switch typeID {
+	case opcuaTypeBoolean:
+		_, ok = value.(bool)
+	case opcuaTypeSByte:
+		_, ok = value.(int8)
+	case opcuaTypeByte:
+		_, ok = value.(byte)
+	case opcuaTypeInt16:
+		_, ok = value.(int16)
+	case opcuaTypeUInt16:
+		_, ok = value.(uint16)
+	case opcuaTypeInt32:
+		_, ok = value.(int32)
+	case opcuaTypeUInt32:
+		_, ok = value.(uint32)
+	case opcuaTypeInt64:
+		_, ok = value.(int64)
+	case opcuaTypeUInt64:
+		_, ok = value.(uint64)
+	case opcuaTypeFloat:
+		_, ok = value.(float32)
+	case opcuaTypeDouble:
+		_, ok = value.(float64)
+	case opcuaTypeString, opcuaTypeXMLElement:
+		_, ok = value.(string)
+	case opcuaTypeDateTime:
+		_, ok = value.(time.Time)
+	case opcuaTypeGUID, opcuaTypeByteString:
+		_, ok = value.([]byte)
+	case opcuaTypeNodeID:
+		_, ok = value.(opcuaNodeID)
+	case opcuaTypeExpandedNodeID:
+		_, ok = value.(opcuaExpandedNodeID)
+	case opcuaTypeStatusCode:
+		_, ok = value.(opcuaStatusCode)
+	case opcuaTypeQualifiedName:
+		_, ok = value.(opcuaQualifiedName)
+	case opcuaTypeLocalizedText:
+		_, ok = value.(opcuaLocalizedText)
+	case opcuaTypeExtensionObject:
+		_, ok = value.(opcuaExtensionObject)
+	case opcuaTypeDataValue:
+		_, ok = value.(opcuaDataValue)
+	case opcuaTypeVariant:
+		_, ok = value.(opcuaVariant)
+	case opcuaTypeDiagnosticInfo:
+		_, ok = value.(*opcuaDiagnosticInfo)
+	}
+	return ok
+}
+
+// dataValue handles a data value, encoding only the fields that are set.
+func (c *opcuaCodec) dataValue(v *opcuaDataValue) {
+	mask := byte(0)
+	if v.Value != nil {
+		mask |= 0x01
+	}
+	if v.Status != opcuaGood {
+		mask |= 0x02
+	}
+	if !v.SourceTimestamp.IsZero() {
+		mask |= 0x04
+	}
+	if !v.ServerTimestamp.IsZero() {
+		mask |= 0x08
+	}
+	if v.SourcePicos != 0 {
+		mask |= 0x10
+	}
+	if v.ServerPicos != 0 {
+		mask |= 0x20
+	}
+	c.uint8(&mask)
+	if mask&0x01 != 0 {
+		if c.decoding {
+			v.Value = &opcuaVariant{}
+		}
+		c.variant(v.Value)
+	}
+	if mask&0x02 != 0 {
+		c.statusCode(&v.Status)
+	}
+	if mask&0x04 != 0 {
+		c.dateTime(&v.SourceTimestamp)
+	}
+	if mask&0x10 != 0 {
+		c.uint16(&v.SourcePicos)
+	}
+	if mask&0x08 != 0 {
+		c.dateTime(&v.ServerTimestamp)
+	}
+	if mask&0x20 != 0 {
+		c.uint16(&v.ServerPicos)
+	}
+}
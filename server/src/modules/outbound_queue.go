@@ -0,0 +1,660 @@
+// server/src/modules/outbound_queue.go
+
+package modules
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+const (
+	queueRecordHeaderLen = 8 // payload length and CRC32
+	queueSegmentSuffix   = ".seg"
+	queueCursorFile      = "cursor"
+	queueDeadLetterFile  = "dead_letters.jsonl"
+)
+
+// ErrQueueClosed is returned when enqueueing to a closed OutboundQueue.
+var ErrQueueClosed = errors.New("outbound queue is closed")
+
+// ErrUndeliverable is wrapped by transports when upstream refuses a message in a way retrying cannot fix.
+// The queue dead-letters such messages at once instead of retrying them.
+var ErrUndeliverable = errors.New("upstream permanently refused the message")
+
+// OutboundMessage is a unit of data spooled for delivery upstream.
+type OutboundMessage struct {
+	ID        string          `json:"id"`   // Idempotency key; receivers should discard IDs they have already processed
+	Kind      string          `json:"kind"` // e.g. "alert", "rollups", "audit"
+	CreatedAt time.Time       `json:"created_at"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// OutboundTransport delivers spooled messages to an upstream peer or cloud endpoint.
+type OutboundTransport interface {
+	Send(ctx context.Context, msg OutboundMessage) error
+}
+
+// OutboundQueueOptions tunes spooling and replay of an OutboundQueue.
+type OutboundQueueOptions struct {
+	MaxBytes     int64         // Disk quota; the oldest segments are evicted once exceeded
+	SegmentBytes int64         // Size at which the active segment is rolled over
+	Backoff      utils.Backoff // Delay between delivery attempts while upstream is unreachable
+	SendTimeout  time.Duration // Deadline for a single delivery attempt
+	MaxAttempts  int           // Delivery attempts before a message is dead-lettered and skipped
+}
+
+// DefaultOutboundQueueOptions returns options suited to spooling several hours of outage on an edge box.
+func DefaultOutboundQueueOptions() OutboundQueueOptions {
+	return OutboundQueueOptions{
+		MaxBytes:     256 << 20,
+		SegmentBytes: 4 << 20,
+		Backoff:      utils.Backoff{Initial: time.Second, Max: 5 * time.Minute, Multiplier: 2, Jitter: 0.2},
+		SendTimeout:  30 * time.Second,
+		MaxAttempts:  1000, // About three and a half days at the maximum backoff
+	}
+}
+
+// queueCursor records the position of the next undelivered message.
+type queueCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// OutboundQueue is a durable FIFO that spools outbound data to disk while upstream is unreachable
+// and replays it in order with at-least-once delivery once the link returns.
+type OutboundQueue struct {
+	dir          string               // Spool directory, typically <StoragePath>/outbound
+	options      OutboundQueueOptions // Quota, segment and retry settings
+	transport    OutboundTransport    // Upstream delivery
+	segments     []int64              // Segment sequence numbers, oldest first
+	segmentSizes map[int64]int64      // Committed bytes per segment
+	totalBytes   int64                // Committed bytes across all segments
+	writeFile    *os.File             // Active segment being appended to
+	cursor       queueCursor          // Next message to deliver
+	readFile     *os.File             // Open handle on the cursor's segment
+	readSegment  int64                // Segment readFile refers to
+	evicted      int64                // Messages dropped by quota eviction
+	delivered    int64                // Messages acknowledged by the transport
+	deadLettered int64                // Messages moved to the dead-letter file
+	closed       bool                 // Set once Close has been called
+	mutex        sync.Mutex           // Guards all of the above
+	pending      chan struct{}        // Signals the delivery loop that data was enqueued
+	logger       *log.Logger          // Logger for tracking queue events
+	stop         chan struct{}        // Closed to stop the delivery loop
+	done         chan struct{}        // Closed when the delivery loop exits
+}
+
+// OpenOutboundQueue opens or creates a spool in dir and starts delivering any messages left from a previous run.
+func OpenOutboundQueue(dir string, options OutboundQueueOptions, transport OutboundTransport, logger *log.Logger) (*OutboundQueue, error) {
+	defaults := DefaultOutboundQueueOptions()
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = defaults.MaxBytes
+	}
+	if options.SegmentBytes <= 0 {
+		options.SegmentBytes = defaults.SegmentBytes
+	}
+	if options.Backoff.Initial <= 0 {
+		options.Backoff = defaults.Backoff
+	}
+	if options.SendTimeout <= 0 {
+		options.SendTimeout = defaults.SendTimeout
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = defaults.MaxAttempts
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create outbound queue directory: %w", err)
+	}
+
+	q := &OutboundQueue{
+		dir:          dir,
+		options:      options,
+		transport:    transport,
+		segmentSizes: make(map[int64]int64),
+		readSegment:  -1,
+		pending:      make(chan struct{}, 1),
+		logger:       logger,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+
+	go q.deliveryLoop()
+	q.notify()
+	return q, nil
+}
+
+// Enqueue spools a payload of the given kind under a fresh idempotency key.
+func (q *OutboundQueue) Enqueue(kind string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s payload: %w", kind, err)
+	}
+	return q.EnqueueMessage(OutboundMessage{
+		ID:        newRandomID(),
+		Kind:      kind,
+		CreatedAt: time.Now(),
+		Payload:   data,
+	})
+}
+
+// EnqueueMessage durably appends a message, evicting the oldest segments if the disk quota would be exceeded.
+func (q *OutboundQueue) EnqueueMessage(msg OutboundMessage) error {
+	record, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode outbound message: %w", err)
+	}
+	header := make([]byte, queueRecordHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(record))
+	size := int64(len(header) + len(record))
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	active := q.segments[len(q.segments)-1]
+	if q.segmentSizes[active] > 0 && q.segmentSizes[active]+size > q.options.SegmentBytes {
+		if err := q.rollSegment(); err != nil {
+			return err
+		}
+		active = q.segments[len(q.segments)-1]
+	}
+	q.enforceQuota(size)
+
+	if _, err := q.writeFile.Write(append(header, record...)); err != nil {
+		return fmt.Errorf("failed to spool outbound message: %w", err)
+	}
+	if err := q.writeFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync outbound queue: %w", err)
+	}
+	q.segmentSizes[active] += size
+	q.totalBytes += size
+
+	q.notify()
+	return nil
+}
+
+// PendingBytes returns the bytes spooled but not yet delivered.
+func (q *OutboundQueue) PendingBytes() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.totalBytes - q.cursor.Offset
+}
+
+// Stats returns the number of delivered and evicted messages since the queue was opened.
+func (q *OutboundQueue) Stats() (delivered, evicted int64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.delivered, q.evicted
+}
+
+// DeadLettered returns the number of messages dead-lettered since the queue was opened.
+func (q *OutboundQueue) DeadLettered() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.deadLettered
+}
+
+// DeadLetterPath returns the JSON-lines file receiving messages that upstream refused or that ran out of attempts.
+func (q *OutboundQueue) DeadLetterPath() string {
+	return filepath.Join(q.dir, queueDeadLetterFile)
+}
+
+// Close stops delivery and closes the spool; undelivered messages are replayed on the next open.
+func (q *OutboundQueue) Close() error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.mutex.Unlock()
+
+	close(q.stop)
+	<-q.done
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.readFile != nil {
+		q.readFile.Close()
+	}
+	err := q.writeFile.Close()
+	q.logger.Println("Outbound queue closed.")
+	return err
+}
+
+// deliveryLoop sends spooled messages in order, retrying each until the transport accepts it. A message
+// that upstream refuses permanently, or that still fails after MaxAttempts, is dead-lettered and skipped
+// so it cannot hold up the messages behind it.
+func (q *OutboundQueue) deliveryLoop() {
+	defer close(q.done)
+
+	for {
+		msg, position, next, ok, err := q.peek()
+		if err != nil {
+			q.logger.Printf("Error reading outbound queue: %v\n", err)
+			select {
+			case <-q.stop:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		if !ok {
+			select {
+			case <-q.stop:
+				return
+			case <-q.pending:
+				continue
+			}
+		}
+
+		var sendErr error
+		for attempt := 0; attempt < q.options.MaxAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-q.stop:
+					return
+				case <-time.After(q.options.Backoff.Duration(attempt - 1)):
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), q.options.SendTimeout)
+			sendErr = q.transport.Send(ctx, msg)
+			cancel()
+			if sendErr == nil || errors.Is(sendErr, ErrUndeliverable) {
+				break
+			}
+			if attempt == 0 {
+				q.logger.Printf("Upstream unavailable, spooling outbound messages: %v\n", sendErr)
+			}
+		}
+
+		if sendErr != nil {
+			q.writeDeadLetter(msg, sendErr)
+		}
+		q.ack(position, next, sendErr == nil)
+	}
+}
+
+// outboundDeadLetter is the record written for messages that could not be delivered.
+type outboundDeadLetter struct {
+	Message  OutboundMessage `json:"message"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// writeDeadLetter appends an undeliverable message to the dead-letter file. The message is skipped even
+// when the file cannot be written, as retrying it would block the queue.
+func (q *OutboundQueue) writeDeadLetter(msg OutboundMessage, cause error) {
+	q.logger.Printf("Outbound %s message %s dead-lettered: %v\n", msg.Kind, msg.ID, cause)
+
+	record, err := json.Marshal(outboundDeadLetter{Message: msg, Error: cause.Error(), FailedAt: time.Now()})
+	if err != nil {
+		q.logger.Printf("Failed to encode dead letter for outbound message %s: %v\n", msg.ID, err)
+		return
+	}
+	file, err := os.OpenFile(q.DeadLetterPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		q.logger.Printf("Failed to open outbound dead-letter file: %v\n", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(record, '\n')); err != nil {
+		q.logger.Printf("Failed to write dead letter for outbound message %s: %v\n", msg.ID, err)
+		return
+	}
+	if err := file.Sync(); err != nil {
+		q.logger.Printf("Failed to sync outbound dead-letter file: %v\n", err)
+	}
+}
+
+// peek returns the message at the cursor along with its position and the position following it.
+func (q *OutboundQueue) peek() (OutboundMessage, queueCursor, queueCursor, bool, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		size := q.segmentSizes[q.cursor.Segment]
+		active := q.segments[len(q.segments)-1]
+		if q.cursor.Offset < size {
+			break
+		}
+		if q.cursor.Segment == active {
+			return OutboundMessage{}, queueCursor{}, queueCursor{}, false, nil // Fully drained
+		}
+		// Segment fully delivered; move on and reclaim its space
+		q.removeSegment(q.cursor.Segment)
+		q.cursor = queueCursor{Segment: q.segments[0]}
+		q.persistCursor()
+	}
+
+	if q.readSegment != q.cursor.Segment {
+		if q.readFile != nil {
+			q.readFile.Close()
+		}
+		file, err := os.Open(q.segmentPath(q.cursor.Segment))
+		if err != nil {
+			q.readFile, q.readSegment = nil, -1
+			return OutboundMessage{}, queueCursor{}, queueCursor{}, false, err
+		}
+		q.readFile, q.readSegment = file, q.cursor.Segment
+	}
+
+	record, err := readQueueRecord(q.readFile, q.cursor.Offset)
+	if err != nil {
+		// An unreadable record cannot be delivered; skip the rest of the segment
+		q.logger.Printf("Skipping unreadable outbound segment %d at offset %d: %v\n", q.cursor.Segment, q.cursor.Offset, err)
+		q.cursor.Offset = q.segmentSizes[q.cursor.Segment]
+		return OutboundMessage{}, queueCursor{}, queueCursor{}, false, err
+	}
+
+	var msg OutboundMessage
+	if err := json.Unmarshal(record, &msg); err != nil {
+		q.cursor.Offset += int64(queueRecordHeaderLen + len(record))
+		return OutboundMessage{}, queueCursor{}, queueCursor{}, false, fmt.Errorf("failed to decode outbound message: %w", err)
+	}
+
+	next := queueCursor{Segment: q.cursor.Segment, Offset: q.cursor.Offset + int64(queueRecordHeaderLen+len(record))}
+	return msg, q.cursor, next, true, nil
+}
+
+// ack advances the cursor past a delivered or dead-lettered message unless eviction already moved it.
+func (q *OutboundQueue) ack(position, next queueCursor, delivered bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if delivered {
+		q.delivered++
+	} else {
+		q.deadLettered++
+	}
+	if q.cursor != position {
+		return
+	}
+	q.cursor = next
+	q.persistCursor()
+}
+
+// notify wakes the delivery loop without blocking.
+func (q *OutboundQueue) notify() {
+	select {
+	case q.pending <- struct{}{}:
+	default:
+	}
+}
+
+// enforceQuota evicts the oldest segments until an additional size bytes fit. Must be called with the mutex held.
+func (q *OutboundQueue) enforceQuota(size int64) {
+	for q.totalBytes+size > q.options.MaxBytes && len(q.segments) > 1 {
+		oldest := q.segments[0]
+		dropped := q.countMessages(oldest)
+		if oldest == q.cursor.Segment {
+			dropped = q.countMessagesFrom(oldest, q.cursor.Offset)
+		}
+		q.removeSegment(oldest)
+		q.evicted += dropped
+		q.logger.Printf("Outbound queue over quota, evicted segment %d with %d undelivered messages\n", oldest, dropped)
+
+		if oldest == q.cursor.Segment {
+			q.cursor = queueCursor{Segment: q.segments[0]}
+			q.persistCursor()
+		}
+	}
+}
+
+// rollSegment closes the active segment and starts a new one. Must be called with the mutex held.
+func (q *OutboundQueue) rollSegment() error {
+	next := int64(0)
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1] + 1
+	}
+
+	file, err := os.OpenFile(q.segmentPath(next), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create outbound segment: %w", err)
+	}
+	if q.writeFile != nil {
+		q.writeFile.Close()
+	}
+	q.writeFile = file
+	q.segments = append(q.segments, next)
+	q.segmentSizes[next] = 0
+	return nil
+}
+
+// removeSegment deletes a segment file and forgets it. Must be called with the mutex held.
+func (q *OutboundQueue) removeSegment(segment int64) {
+	if q.readSegment == segment && q.readFile != nil {
+		q.readFile.Close()
+		q.readFile, q.readSegment = nil, -1
+	}
+	if err := os.Remove(q.segmentPath(segment)); err != nil && !os.IsNotExist(err) {
+		q.logger.Printf("Failed to remove outbound segment %d: %v\n", segment, err)
+	}
+
+	q.totalBytes -= q.segmentSizes[segment]
+	delete(q.segmentSizes, segment)
+	for i, seq := range q.segments {
+		if seq == segment {
+			q.segments = append(q.segments[:i], q.segments[i+1:]...)
+			break
+		}
+	}
+	if len(q.segments) == 0 {
+		// Always keep an active segment to append to
+		if err := q.rollSegment(); err != nil {
+			q.logger.Printf("Failed to recreate outbound segment: %v\n", err)
+		}
+	}
+}
+
+// recover loads segments and the cursor from disk, truncating any torn record at the tail.
+func (q *OutboundQueue) recover() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("failed to list outbound queue directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, queueSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, queueSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, seq)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	for _, seq := range q.segments {
+		size, err := q.validSegmentSize(seq)
+		if err != nil {
+			return err
+		}
+		q.segmentSizes[seq] = size
+		q.totalBytes += size
+	}
+
+	if len(q.segments) == 0 {
+		if err := q.rollSegment(); err != nil {
+			return err
+		}
+	} else {
+		last := q.segments[len(q.segments)-1]
+		file, err := os.OpenFile(q.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("failed to open outbound segment: %w", err)
+		}
+		q.writeFile = file
+	}
+
+	q.cursor = queueCursor{Segment: q.segments[0]}
+	if data, err := os.ReadFile(filepath.Join(q.dir, queueCursorFile)); err == nil {
+		var saved queueCursor
+		if json.Unmarshal(data, &saved) == nil {
+			if _, exists := q.segmentSizes[saved.Segment]; exists && saved.Offset <= q.segmentSizes[saved.Segment] {
+				q.cursor = saved
+			}
+		}
+	}
+
+	// Segments before the cursor were fully delivered before shutdown
+	for len(q.segments) > 1 && q.segments[0] < q.cursor.Segment {
+		q.removeSegment(q.segments[0])
+	}
+
+	if pending := q.totalBytes - q.cursor.Offset; pending > 0 {
+		q.logger.Printf("Outbound queue recovered with %d bytes pending delivery\n", pending)
+	}
+	return nil
+}
+
+// validSegmentSize returns the length of the valid prefix of a segment, truncating anything after it.
+func (q *OutboundQueue) validSegmentSize(segment int64) (int64, error) {
+	file, err := os.OpenFile(q.segmentPath(segment), os.O_RDWR, 0640)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open outbound segment %d: %w", segment, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, queueRecordHeaderLen)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			break
+		}
+		record := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+		if _, err := io.ReadFull(reader, record); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(record) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+		offset += int64(queueRecordHeaderLen + len(record))
+	}
+
+	q.logger.Printf("Truncating torn record in outbound segment %d at offset %d\n", segment, offset)
+	if err := file.Truncate(offset); err != nil {
+		return 0, fmt.Errorf("failed to truncate outbound segment %d: %w", segment, err)
+	}
+	return offset, nil
+}
+
+// countMessages returns the number of records in a segment.
+func (q *OutboundQueue) countMessages(segment int64) int64 {
+	return q.countMessagesFrom(segment, 0)
+}
+
+// countMessagesFrom returns the number of records in a segment at or after offset.
+func (q *OutboundQueue) countMessagesFrom(segment, offset int64) int64 {
+	file, err := os.Open(q.segmentPath(segment))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	var count int64
+	header := make([]byte, queueRecordHeaderLen)
+	for offset < q.segmentSizes[segment] {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			break
+		}
+		offset += int64(queueRecordHeaderLen) + int64(binary.LittleEndian.Uint32(header[0:4]))
+		count++
+	}
+	return count
+}
+
+// persistCursor atomically saves the cursor. Must be called with the mutex held.
+func (q *OutboundQueue) persistCursor() {
+	data, _ := json.Marshal(q.cursor)
+	tmpPath := filepath.Join(q.dir, queueCursorFile+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0640); err != nil {
+		q.logger.Printf("Failed to save outbound queue cursor: %v\n", err)
+		return
+	}
+	if err := os.Rename(tmpPath, filepath.Join(q.dir, queueCursorFile)); err != nil {
+		q.logger.Printf("Failed to save outbound queue cursor: %v\n", err)
+	}
+}
+
+// segmentPath returns the file path of a segment.
+func (q *OutboundQueue) segmentPath(segment int64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", segment, queueSegmentSuffix))
+}
+
+// readQueueRecord reads and verifies the record at offset.
+func readQueueRecord(file *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, queueRecordHeaderLen)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.LittleEndian.Uint32(header[0:4]))
+	if _, err := file.ReadAt(record, offset+queueRecordHeaderLen); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(record) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return record, nil
+}
+
+// queuedAlertNotifier spools alerts through an OutboundQueue so they survive upstream outages.
+type queuedAlertNotifier struct {
+	queue *OutboundQueue
+}
+
+// AlertNotifier returns a notifier that forwards alerts upstream through the queue.
+func (q *OutboundQueue) AlertNotifier() AlertNotifier {
+	return &queuedAlertNotifier{queue: q}
+}
+
+// Name identifies the notifier in logs and dead letters.
+func (qn *queuedAlertNotifier) Name() string {
+	return "upstream"
+}
+
+// Notify spools the alert, reusing the alert ID as idempotency key so retries never duplicate it upstream.
+func (qn *queuedAlertNotifier) Notify(ctx context.Context, alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+	return qn.queue.EnqueueMessage(OutboundMessage{
+		ID:        alert.ID,
+		Kind:      "alert",
+		CreatedAt: alert.Timestamp,
+		Payload:   payload,
+	})
+}
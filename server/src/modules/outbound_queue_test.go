@@ -0,0 +1,167 @@
+// server/src/modules/outbound_queue_test.go
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"server/utils"
+)
+
+// recordingUpstream is an HTTP ingestion endpoint that answers each message with the status its
+// payload asks for and records the payloads it accepted.
+type recordingUpstream struct {
+	mutex    sync.Mutex
+	attempts map[string]int
+	accepted []string
+}
+
+func (u *recordingUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var msg OutboundMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var payload struct {
+		Name   string `json:"name"`
+		Status int    `json:"status"`
+	}
+	json.Unmarshal(msg.Payload, &payload)
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.attempts[payload.Name]++
+	if payload.Status != 0 {
+		w.WriteHeader(payload.Status)
+		return
+	}
+	u.accepted = append(u.accepted, payload.Name)
+}
+
+func (u *recordingUpstream) snapshot() ([]string, map[string]int) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	attempts := make(map[string]int, len(u.attempts))
+	for name, count := range u.attempts {
+		attempts[name] = count
+	}
+	return append([]string(nil), u.accepted...), attempts
+}
+
+// openTestQueue opens a queue posting to upstream with a backoff short enough for tests.
+func openTestQueue(t *testing.T, upstream http.Handler, maxAttempts int) *OutboundQueue {
+	t.Helper()
+	server := httptest.NewServer(upstream)
+	t.Cleanup(server.Close)
+	options := OutboundQueueOptions{
+		Backoff:     utils.Backoff{Initial: time.Millisecond, Max: 5 * time.Millisecond},
+		MaxAttempts: maxAttempts,
+	}
+	queue, err := OpenOutboundQueue(t.TempDir(), options, NewHTTPTransport(server.URL, "", time.Second), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue.Close() })
+	return queue
+}
+
+// waitForQueue waits until the queue has delivered or dead-lettered total messages.
+func waitForQueue(t *testing.T, queue *OutboundQueue, total int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		delivered, _ := queue.Stats()
+		if delivered+queue.DeadLettered() >= total {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queue settled %d of %d messages", delivered+queue.DeadLettered(), total)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readOutboundDeadLetters returns the records in the queue's dead-letter file.
+func readOutboundDeadLetters(t *testing.T, queue *OutboundQueue) []outboundDeadLetter {
+	t.Helper()
+	data, err := os.ReadFile(queue.DeadLetterPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []outboundDeadLetter
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record outboundDeadLetter
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("bad dead letter %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestOutboundQueueDeadLettersRefusedMessage(t *testing.T) {
+	upstream := &recordingUpstream{attempts: make(map[string]int)}
+	queue := openTestQueue(t, upstream, 50)
+
+	queue.Enqueue("test", map[string]interface{}{"name": "first"})
+	queue.Enqueue("test", map[string]interface{}{"name": "poison", "status": http.StatusRequestEntityTooLarge})
+	queue.Enqueue("test", map[string]interface{}{"name": "last"})
+	waitForQueue(t, queue, 3)
+
+	accepted, attempts := upstream.snapshot()
+	if strings.Join(accepted, ",") != "first,last" {
+		t.Fatalf("upstream accepted %v", accepted)
+	}
+	if attempts["poison"] != 1 {
+		t.Fatalf("refused message sent %d times", attempts["poison"])
+	}
+	records := readOutboundDeadLetters(t, queue)
+	if len(records) != 1 || !strings.Contains(string(records[0].Message.Payload), "poison") || !strings.Contains(records[0].Error, "413") {
+		t.Fatalf("dead letters %+v", records)
+	}
+	if queue.PendingBytes() != 0 {
+		t.Fatalf("%d bytes still pending", queue.PendingBytes())
+	}
+}
+
+func TestOutboundQueueCapsRetries(t *testing.T) {
+	upstream := &recordingUpstream{attempts: make(map[string]int)}
+	queue := openTestQueue(t, upstream, 3)
+
+	queue.Enqueue("test", map[string]interface{}{"name": "stuck", "status": http.StatusServiceUnavailable})
+	queue.Enqueue("test", map[string]interface{}{"name": "throttled", "status": http.StatusTooManyRequests})
+	queue.Enqueue("test", map[string]interface{}{"name": "next"})
+	waitForQueue(t, queue, 3)
+
+	accepted, attempts := upstream.snapshot()
+	if attempts["stuck"] != 3 || attempts["throttled"] != 3 {
+		t.Fatalf("transient failures attempted %v", attempts)
+	}
+	if len(accepted) != 1 || accepted[0] != "next" {
+		t.Fatalf("upstream accepted %v", accepted)
+	}
+	if records := readOutboundDeadLetters(t, queue); len(records) != 2 {
+		t.Fatalf("dead letters %+v", records)
+	}
+}
+
+func TestPermanentHTTPStatus(t *testing.T) {
+	for status, permanent := range map[int]bool{400: true, 401: true, 404: true, 413: true, 408: false, 425: false, 429: false, 500: false, 503: false} {
+		if permanentHTTPStatus(status) != permanent {
+			t.Errorf("status %d permanent = %v", status, !permanent)
+		}
+	}
+}
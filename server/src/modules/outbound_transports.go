@@ -0,0 +1,113 @@
+// server/src/modules/outbound_transports.go
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/atsign-foundation/at_server/server" // Assuming this is the correct import path for DESS server package
+)
+
+// AtSignTransport delivers outbound messages to an upstream atSign through the DESS server.
+type AtSignTransport struct {
+	dessServer     *server.AtServer // DESS server used to deliver messages
+	upstreamAtSign string           // atSign of the upstream collector
+	namespace      string           // Namespace appended to notification keys
+}
+
+// NewAtSignTransport creates a transport that notifies the given upstream atSign.
+func NewAtSignTransport(dessServer *server.AtServer, upstreamAtSign, namespace string) *AtSignTransport {
+	return &AtSignTransport{
+		dessServer:     dessServer,
+		upstreamAtSign: upstreamAtSign,
+		namespace:      namespace,
+	}
+}
+
+// Send notifies the upstream atSign; the message ID is part of the key, so a replayed message overwrites rather than duplicates.
+func (at *AtSignTransport) Send(ctx context.Context, msg OutboundMessage) error {
+	if at.dessServer == nil {
+		return fmt.Errorf("DESS server not available")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("%w: failed to encode outbound message: %v", ErrUndeliverable, err)
+	}
+
+	key := fmt.Sprintf("%s.%s.%s", msg.Kind, msg.ID, at.namespace)
+	// Hypothetical method to push a notification to another atSign via DESS
+	if err := at.dessServer.Notify(at.upstreamAtSign, key, string(payload)); err != nil {
+		return fmt.Errorf("failed to deliver %s to %s: %w", msg.ID, at.upstreamAtSign, err)
+	}
+	return nil
+}
+
+// HTTPTransport posts outbound messages to a cloud ingestion endpoint.
+type HTTPTransport struct {
+	url    string       // Ingestion endpoint
+	token  string       // Optional bearer token
+	client *http.Client // HTTP client used for delivery
+}
+
+// NewHTTPTransport creates a transport that posts messages to the given URL.
+func NewHTTPTransport(url, token string, timeout time.Duration) *HTTPTransport {
+	return &HTTPTransport{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Send posts the message with an Idempotency-Key header; 409 Conflict is treated as already delivered.
+// Other 4xx responses wrap ErrUndeliverable, except those that ask the client to try again later.
+func (ht *HTTPTransport) Send(ctx context.Context, msg OutboundMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("%w: failed to encode outbound message: %v", ErrUndeliverable, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ht.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build upstream request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", msg.ID)
+	if ht.token != "" {
+		req.Header.Set("Authorization", "Bearer "+ht.token)
+	}
+
+	resp, err := ht.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Drain so the connection can be reused
+
+	if resp.StatusCode == http.StatusConflict || (resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		return nil
+	}
+	if permanentHTTPStatus(resp.StatusCode) {
+		return fmt.Errorf("%w: upstream returned status %d", ErrUndeliverable, resp.StatusCode)
+	}
+	return fmt.Errorf("upstream returned status %d", resp.StatusCode)
+}
+
+// permanentHTTPStatus reports whether a status means the same request will keep being refused. Timeouts,
+// early data and rate limiting are transient, as are server errors.
+func permanentHTTPStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 400 && status <= 499
+}
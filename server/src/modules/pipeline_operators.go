@@ -0,0 +1,657 @@
+// server/src/modules/pipeline_operators.go
+
+package modules
+
+import (
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pipelineRecord is the unit of data flowing between pipeline stages.
+type pipelineRecord struct {
+	sample  Sample
+	window  []float64 // Values of a closed window, set by window stages
+	start   time.Time // Window start, set by window stages
+	message string    // Detection message, set by detect stages
+	tick    bool      // Watermark carrying only sample.Timestamp; lets windows close when data stops
+}
+
+// pipelineOperator transforms records for a single stage. Operators run on their stage's goroutine only.
+type pipelineOperator interface {
+	process(record pipelineRecord, emit func(pipelineRecord))
+}
+
+// pipelineTicker is implemented by operators holding state that must be released on watermarks.
+type pipelineTicker interface {
+	tick(now time.Time, emit func(pipelineRecord))
+}
+
+// pipelineOperatorFactory builds an operator from stage parameters.
+type pipelineOperatorFactory func(params stageParams, env *pipelineEnv) (pipelineOperator, error)
+
+// pipelineOperators lists the operators available to pipeline configs, keyed by op name.
+var pipelineOperators = map[string]pipelineOperatorFactory{
+	"source":    newSourceOperator,
+	"deadband":  newDeadbandOperator,
+	"range":     newRangeOperator,
+	"scale":     newScaleOperator,
+	"convert":   newConvertOperator,
+	"rename":    newRenameOperator,
+	"window":    newWindowOperator,
+	"aggregate": newAggregateOperator,
+	"threshold": newThresholdOperator,
+	"zscore":    newZScoreOperator,
+	"rate":      newRateOperator,
+	"derive":    newDeriveOperator,
+	"alert":     newAlertOperator,
+	"log":       newLogOperator,
+}
+
+// stageParams gives typed access to the loosely typed parameters of a stage config.
+type stageParams map[string]interface{}
+
+// float returns a numeric parameter, or fallback when it is absent.
+func (p stageParams) float(name string, fallback float64) (float64, error) {
+	raw, exists := p[name]
+	if !exists {
+		return fallback, nil
+	}
+	switch value := raw.(type) {
+	case float64:
+		return value, nil
+	case string:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, fmt.Errorf("parameter %s: %w", name, err)
+		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("parameter %s must be a number", name)
+	}
+}
+
+// optionalFloat returns a numeric parameter and whether it was set.
+func (p stageParams) optionalFloat(name string) (float64, bool, error) {
+	if _, exists := p[name]; !exists {
+		return 0, false, nil
+	}
+	value, err := p.float(name, 0)
+	return value, err == nil, err
+}
+
+// string returns a string parameter, or fallback when it is absent.
+func (p stageParams) string(name, fallback string) string {
+	if value, ok := p[name].(string); ok {
+		return value
+	}
+	return fallback
+}
+
+// strings returns a list parameter, accepting a single string, a JSON array or positional args.
+func (p stageParams) strings(name string) []string {
+	raw, exists := p[name]
+	if !exists {
+		raw = p["args"]
+	}
+	switch value := raw.(type) {
+	case string:
+		return []string{value}
+	case []string:
+		return value
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// duration returns a duration parameter, or fallback when it is absent.
+func (p stageParams) duration(name string, fallback time.Duration) (time.Duration, error) {
+	raw := p.string(name, "")
+	if raw == "" {
+		return fallback, nil
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("parameter %s must be a positive duration", name)
+	}
+	return value, nil
+}
+
+// sourceOperator passes through samples; series selection happens when samples enter the pipeline.
+type sourceOperator struct {
+	patterns []string
+}
+
+// newSourceOperator validates the series patterns of a source.
+func newSourceOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	patterns := params.strings("series")
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("source needs at least one series pattern")
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid series pattern %q: %w", pattern, err)
+		}
+	}
+	return &sourceOperator{patterns: patterns}, nil
+}
+
+// matches reports whether the source selects a series.
+func (o *sourceOperator) matches(series string) bool {
+	for _, pattern := range o.patterns {
+		if matched, _ := path.Match(pattern, series); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *sourceOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	emit(record)
+}
+
+// deadbandOperator drops values that differ from the last passed value of their series by less than band.
+type deadbandOperator struct {
+	band float64
+	last map[string]float64
+}
+
+// newDeadbandOperator creates a deadband filter.
+func newDeadbandOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	band, err := params.float("band", 0)
+	if err != nil {
+		return nil, err
+	}
+	if band <= 0 {
+		return nil, fmt.Errorf("deadband needs a positive band")
+	}
+	return &deadbandOperator{band: band, last: make(map[string]float64)}, nil
+}
+
+func (o *deadbandOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	last, seen := o.last[record.sample.Series]
+	if seen && math.Abs(record.sample.Value-last) < o.band {
+		return
+	}
+	o.last[record.sample.Series] = record.sample.Value
+	emit(record)
+}
+
+// rangeOperator drops values outside [min, max], e.g. sensor error codes.
+type rangeOperator struct {
+	min, max       float64
+	hasMin, hasMax bool
+}
+
+// newRangeOperator creates a range filter; either bound may be omitted.
+func newRangeOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	operator := &rangeOperator{}
+	var err error
+	if operator.min, operator.hasMin, err = params.optionalFloat("min"); err != nil {
+		return nil, err
+	}
+	if operator.max, operator.hasMax, err = params.optionalFloat("max"); err != nil {
+		return nil, err
+	}
+	if !operator.hasMin && !operator.hasMax {
+		return nil, fmt.Errorf("range needs min, max or both")
+	}
+	return operator, nil
+}
+
+func (o *rangeOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	value := record.sample.Value
+	if (o.hasMin && value < o.min) || (o.hasMax && value > o.max) {
+		return
+	}
+	emit(record)
+}
+
+// scaleOperator applies value*factor + offset.
+type scaleOperator struct {
+	factor, offset float64
+}
+
+// newScaleOperator creates a linear transform.
+func newScaleOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	factor, err := params.float("factor", 1)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := params.float("offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	return &scaleOperator{factor: factor, offset: offset}, nil
+}
+
+func (o *scaleOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	record.sample.Value = record.sample.Value*o.factor + o.offset
+	emit(record)
+}
+
+// unitConversion maps a unit to and from the base unit of its dimension.
+type unitConversion struct {
+	dimension string
+	toBase    func(float64) float64
+	fromBase  func(float64) float64
+}
+
+// linearUnit builds a conversion for units that differ from the base unit only by a factor.
+func linearUnit(dimension string, factor float64) unitConversion {
+	return unitConversion{
+		dimension: dimension,
+		toBase:    func(v float64) float64 { return v * factor },
+		fromBase:  func(v float64) float64 { return v / factor },
+	}
+}
+
+// pipelineUnits lists the units accepted by the convert operator.
+var pipelineUnits = map[string]unitConversion{
+	"degC": {"temperature", func(v float64) float64 { return v }, func(v float64) float64 { return v }},
+	"degF": {"temperature", func(v float64) float64 { return (v - 32) * 5 / 9 }, func(v float64) float64 { return v*9/5 + 32 }},
+	"K":    {"temperature", func(v float64) float64 { return v - 273.15 }, func(v float64) float64 { return v + 273.15 }},
+	"Pa":   linearUnit("pressure", 1),
+	"kPa":  linearUnit("pressure", 1000),
+	"bar":  linearUnit("pressure", 100000),
+	"psi":  linearUnit("pressure", 6894.757),
+	"m3/h": linearUnit("flow", 1),
+	"l/s":  linearUnit("flow", 3.6),
+	"lpm":  linearUnit("flow", 0.06),
+	"gpm":  linearUnit("flow", 0.2271247),
+	"m":    linearUnit("length", 1),
+	"mm":   linearUnit("length", 0.001),
+	"ft":   linearUnit("length", 0.3048),
+	"in":   linearUnit("length", 0.0254),
+	"kg":   linearUnit("mass", 1),
+	"lb":   linearUnit("mass", 0.45359237),
+	"W":    linearUnit("power", 1),
+	"kW":   linearUnit("power", 1000),
+	"hp":   linearUnit("power", 745.6999),
+}
+
+// convertOperator converts values between units of the same dimension.
+type convertOperator struct {
+	from, to unitConversion
+}
+
+// newConvertOperator creates a unit conversion, e.g. from degF to degC.
+func newConvertOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	fromName, toName := params.string("from", ""), params.string("to", "")
+	from, knownFrom := pipelineUnits[fromName]
+	to, knownTo := pipelineUnits[toName]
+	if !knownFrom || !knownTo {
+		return nil, fmt.Errorf("convert needs known from and to units, got %q and %q", fromName, toName)
+	}
+	if from.dimension != to.dimension {
+		return nil, fmt.Errorf("cannot convert %s (%s) to %s (%s)", fromName, from.dimension, toName, to.dimension)
+	}
+	return &convertOperator{from: from, to: to}, nil
+}
+
+func (o *convertOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	record.sample.Value = o.to.fromBase(o.from.toBase(record.sample.Value))
+	emit(record)
+}
+
+// renameOperator rewrites series names from a template in which {series} is the incoming name.
+type renameOperator struct {
+	template string
+}
+
+// newRenameOperator creates a series rename.
+func newRenameOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	template := params.string("to", "")
+	if names := params.strings("to"); template == "" && len(names) == 1 {
+		template = names[0]
+	}
+	if template == "" {
+		return nil, fmt.Errorf("rename needs a target name template")
+	}
+	return &renameOperator{template: template}, nil
+}
+
+func (o *renameOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	record.sample.Series = strings.ReplaceAll(o.template, "{series}", record.sample.Series)
+	emit(record)
+}
+
+// openWindow collects the values of one series for the current window.
+type openWindow struct {
+	start  time.Time
+	values []float64
+}
+
+// windowOperator groups samples into tumbling time windows per series.
+type windowOperator struct {
+	size    time.Duration
+	windows map[string]*openWindow
+}
+
+// newWindowOperator creates a tumbling window of the given size.
+func newWindowOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	size, err := params.duration("size", 0)
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		return nil, fmt.Errorf("window needs a size")
+	}
+	return &windowOperator{size: size, windows: make(map[string]*openWindow)}, nil
+}
+
+func (o *windowOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	series := record.sample.Series
+	start := record.sample.Timestamp.Truncate(o.size)
+	window, open := o.windows[series]
+	if open && start.After(window.start) {
+		o.emitWindow(series, window, emit)
+		open = false
+	}
+	if !open {
+		window = &openWindow{start: start}
+		o.windows[series] = window
+	} else if start.Before(window.start) {
+		return // Late sample for a window that has already been emitted
+	}
+	window.values = append(window.values, record.sample.Value)
+}
+
+// tick emits every window that ended at or before now.
+func (o *windowOperator) tick(now time.Time, emit func(pipelineRecord)) {
+	for series, window := range o.windows {
+		if !now.Before(window.start.Add(o.size)) {
+			o.emitWindow(series, window, emit)
+		}
+	}
+}
+
+// emitWindow sends a closed window downstream and forgets it.
+func (o *windowOperator) emitWindow(series string, window *openWindow, emit func(pipelineRecord)) {
+	delete(o.windows, series)
+	end := window.start.Add(o.size)
+	emit(pipelineRecord{
+		sample: Sample{Series: series, Timestamp: end},
+		window: window.values,
+		start:  window.start,
+	})
+}
+
+// aggregateOperator reduces windows to one sample per aggregation, named <series>.<aggregation>.
+type aggregateOperator struct {
+	functions []string
+}
+
+// pipelineAggregations lists the aggregations the aggregate operator supports.
+var pipelineAggregations = map[string]func([]float64) float64{
+	"min": func(values []float64) float64 {
+		result := math.Inf(1)
+		for _, value := range values {
+			result = math.Min(result, value)
+		}
+		return result
+	},
+	"max": func(values []float64) float64 {
+		result := math.Inf(-1)
+		for _, value := range values {
+			result = math.Max(result, value)
+		}
+		return result
+	},
+	"sum": func(values []float64) float64 {
+		result := 0.0
+		for _, value := range values {
+			result += value
+		}
+		return result
+	},
+	"mean": func(values []float64) float64 {
+		result := 0.0
+		for _, value := range values {
+			result += value
+		}
+		return result / float64(len(values))
+	},
+	"count": func(values []float64) float64 { return float64(len(values)) },
+	"last":  func(values []float64) float64 { return values[len(values)-1] },
+	"stddev": func(values []float64) float64 {
+		mean, squares := 0.0, 0.0
+		for _, value := range values {
+			mean += value
+		}
+		mean /= float64(len(values))
+		for _, value := range values {
+			squares += (value - mean) * (value - mean)
+		}
+		return math.Sqrt(squares / float64(len(values)))
+	},
+}
+
+// newAggregateOperator creates an aggregation of windows.
+func newAggregateOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	functions := params.strings("functions")
+	if len(functions) == 0 {
+		return nil, fmt.Errorf("aggregate needs at least one function")
+	}
+	for _, function := range functions {
+		if _, known := pipelineAggregations[function]; !known {
+			return nil, fmt.Errorf("unknown aggregation %q", function)
+		}
+	}
+	return &aggregateOperator{functions: functions}, nil
+}
+
+func (o *aggregateOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	if len(record.window) == 0 {
+		return // Aggregation needs windows; plain samples are ignored
+	}
+	for _, function := range o.functions {
+		emit(pipelineRecord{sample: Sample{
+			Series:    record.sample.Series + "." + function,
+			Timestamp: record.sample.Timestamp,
+			Value:     pipelineAggregations[function](record.window),
+		}})
+	}
+}
+
+// thresholdOperator passes on samples above or below fixed limits, annotated with a message.
+type thresholdOperator struct {
+	above, below       float64
+	hasAbove, hasBelow bool
+}
+
+// newThresholdOperator creates a fixed-limit detector.
+func newThresholdOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	operator := &thresholdOperator{}
+	var err error
+	if operator.above, operator.hasAbove, err = params.optionalFloat("above"); err != nil {
+		return nil, err
+	}
+	if operator.below, operator.hasBelow, err = params.optionalFloat("below"); err != nil {
+		return nil, err
+	}
+	if !operator.hasAbove && !operator.hasBelow {
+		return nil, fmt.Errorf("threshold needs above, below or both")
+	}
+	return operator, nil
+}
+
+func (o *thresholdOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	value := record.sample.Value
+	switch {
+	case o.hasAbove && value > o.above:
+		record.message = fmt.Sprintf("%s is %.2f, above limit %.2f", record.sample.Series, value, o.above)
+	case o.hasBelow && value < o.below:
+		record.message = fmt.Sprintf("%s is %.2f, below limit %.2f", record.sample.Series, value, o.below)
+	default:
+		return
+	}
+	emit(record)
+}
+
+// zscoreOperator passes on samples whose Z-score against a rolling count window exceeds a threshold.
+type zscoreOperator struct {
+	threshold float64
+	size      int
+	history   map[string][]float64
+}
+
+// newZScoreOperator creates a rolling Z-score detector.
+func newZScoreOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	threshold, err := params.float("threshold", 3)
+	if err != nil {
+		return nil, err
+	}
+	size, err := params.float("window", 100)
+	if err != nil {
+		return nil, err
+	}
+	if size < 2 {
+		return nil, fmt.Errorf("zscore window must hold at least 2 samples")
+	}
+	return &zscoreOperator{threshold: threshold, size: int(size), history: make(map[string][]float64)}, nil
+}
+
+func (o *zscoreOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	series, value := record.sample.Series, record.sample.Value
+	history := o.history[series]
+	if len(history) >= 2 {
+		mean, squares := 0.0, 0.0
+		for _, past := range history {
+			mean += past
+		}
+		mean /= float64(len(history))
+		for _, past := range history {
+			squares += (past - mean) * (past - mean)
+		}
+		if stdDev := math.Sqrt(squares / float64(len(history))); stdDev > 0 {
+			if zScore := math.Abs(value-mean) / stdDev; zScore > o.threshold {
+				detected := record
+				detected.message = fmt.Sprintf("%s value %.2f has Z-score %.2f", series, value, zScore)
+				emit(detected)
+			}
+		}
+	}
+	if len(history) == o.size {
+		history = history[1:]
+	}
+	o.history[series] = append(history, value)
+}
+
+// rateOperator passes on samples whose rate of change per second exceeds max.
+type rateOperator struct {
+	max  float64
+	last map[string]Sample
+}
+
+// newRateOperator creates a rate-of-change detector.
+func newRateOperator(params stageParams, _ *pipelineEnv) (pipelineOperator, error) {
+	max, err := params.float("max", 0)
+	if err != nil {
+		return nil, err
+	}
+	if max <= 0 {
+		return nil, fmt.Errorf("rate needs a positive max per second")
+	}
+	return &rateOperator{max: max, last: make(map[string]Sample)}, nil
+}
+
+func (o *rateOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	previous, seen := o.last[record.sample.Series]
+	o.last[record.sample.Series] = record.sample
+	if !seen {
+		return
+	}
+	elapsed := record.sample.Timestamp.Sub(previous.Timestamp).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	if rate := (record.sample.Value - previous.Value) / elapsed; math.Abs(rate) > o.max {
+		record.message = fmt.Sprintf("%s changing at %.2f/s, limit %.2f/s", record.sample.Series, rate, o.max)
+		emit(record)
+	}
+}
+
+// deriveOperator feeds samples back into the analytics engine as derived series.
+type deriveOperator struct {
+	env *pipelineEnv
+}
+
+// newDeriveOperator creates a sink producing derived series.
+func newDeriveOperator(_ stageParams, env *pipelineEnv) (pipelineOperator, error) {
+	return &deriveOperator{env: env}, nil
+}
+
+func (o *deriveOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	if len(record.window) > 0 {
+		return // Windows must be aggregated before they can become a series
+	}
+	o.env.derive(record.sample)
+	emit(record)
+}
+
+// alertOperator raises an alert for every record carrying a detection message.
+type alertOperator struct {
+	env      *pipelineEnv
+	severity AlertSeverity
+}
+
+// newAlertOperator creates a sink sending detections to the alert pipeline.
+func newAlertOperator(params stageParams, env *pipelineEnv) (pipelineOperator, error) {
+	severity := AlertSeverity(params.string("severity", string(SeverityWarning)))
+	if severity != SeverityInfo && severity != SeverityWarning && severity != SeverityCritical {
+		return nil, fmt.Errorf("unknown alert severity %q", severity)
+	}
+	return &alertOperator{env: env, severity: severity}, nil
+}
+
+func (o *alertOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	message := record.message
+	if message == "" {
+		message = fmt.Sprintf("%s reported %.2f", record.sample.Series, record.sample.Value)
+	}
+	o.env.raise(Alert{
+		Source:    "pipeline." + o.env.pipeline,
+		Severity:  o.severity,
+		Message:   message,
+		Timestamp: record.sample.Timestamp,
+		Details: map[string]interface{}{
+			"pipeline": o.env.pipeline,
+			"series":   record.sample.Series,
+			"value":    record.sample.Value,
+		},
+	})
+	emit(record)
+}
+
+// logOperator writes every record to the engine log, for commissioning pipelines.
+type logOperator struct {
+	env *pipelineEnv
+}
+
+// newLogOperator creates a logging sink.
+func newLogOperator(_ stageParams, env *pipelineEnv) (pipelineOperator, error) {
+	return &logOperator{env: env}, nil
+}
+
+func (o *logOperator) process(record pipelineRecord, emit func(pipelineRecord)) {
+	switch {
+	case record.message != "":
+		o.env.logger.Printf("Pipeline %s: %s\n", o.env.pipeline, record.message)
+	case len(record.window) > 0:
+		o.env.logger.Printf("Pipeline %s: window %s [%s, %s) with %d values\n", o.env.pipeline, record.sample.Series,
+			record.start.Format(time.RFC3339), record.sample.Timestamp.Format(time.RFC3339), len(record.window))
+	default:
+		o.env.logger.Printf("Pipeline %s: %s = %.4f at %s\n", o.env.pipeline, record.sample.Series, record.sample.Value, record.sample.Timestamp.Format(time.RFC3339))
+	}
+	emit(record)
+}
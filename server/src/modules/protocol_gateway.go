@@ -0,0 +1,722 @@
+// server/src/modules/protocol_gateway.go
+
+package modules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GatewayProtocol names the kind of endpoint a translation reads from or writes to.
+type GatewayProtocol string
+
+// Protocols of gateway endpoints.
+const (
+	GatewayTopic  GatewayProtocol = "topic"  // A topic shared by the routes and the MQTT broker
+	GatewayOPCUA  GatewayProtocol = "opcua"  // A variable OPCUAClient publishes; sources only
+	GatewayModbus GatewayProtocol = "modbus" // A point of a device polled by ModbusPoller
+)
+
+// GatewayEndpoint is one side of a translation mapping. Which fields apply depends on the protocol.
+type GatewayEndpoint struct {
+	Protocol GatewayProtocol `json:"protocol"` // "topic", "opcua" or "modbus"
+	Topic    string          `json:"topic"`    // topic: the topic, or a filter for sources; opcua: overrides "opcua/<server>/<node>"
+	Field    string          `json:"field"`    // JSON field holding the value, dotted for nested objects; "value" for opcua sources and topic targets by default
+	Server   string          `json:"server"`   // opcua: name of the configured server
+	Node     string          `json:"node"`     // opcua: name of the variable on that server
+	Device   string          `json:"device"`   // modbus: device name
+	Point    string          `json:"point"`    // modbus: point name
+}
+
+// GatewayMapping declares how values read from a source endpoint are converted, checked and written to
+// a target endpoint. The value is converted between units first, then scaled, offset, cast to Type and
+// finally checked against Min and Max.
+type GatewayMapping struct {
+	Name     string          `json:"name"`      // Unique name used in logs and statistics
+	Source   GatewayEndpoint `json:"source"`    // Where values come from
+	Target   GatewayEndpoint `json:"target"`    // Where converted values go; "topic" or "modbus"
+	FromUnit string          `json:"from_unit"` // Unit of source values, such as "F" or "psi"; needs ToUnit
+	ToUnit   string          `json:"to_unit"`   // Unit the target expects, of the same quantity as FromUnit
+	Scale    float64         `json:"scale"`     // Multiplier applied after unit conversion, default 1
+	Offset   float64         `json:"offset"`    // Added after scaling
+	Type     string          `json:"type"`      // "float" (default), "int" to round, or "bool" for non-zero
+	Min      *float64        `json:"min"`       // Lowest value the target accepts
+	Max      *float64        `json:"max"`       // Highest value the target accepts
+	Clamp    bool            `json:"clamp"`     // Clamps values outside Min and Max instead of dropping them
+	Rate     float64         `json:"rate"`      // Translations allowed per second; 0 for no limit
+	Burst    int             `json:"burst"`     // Translations allowed at once within the rate, default 1
+	Identity string          `json:"identity"`  // AccessControl ID the mapping reads and writes as; the gateway's by default
+}
+
+// LoadGatewayMappings reads translation mappings from a JSON file containing an array of GatewayMapping.
+func LoadGatewayMappings(filePath string) ([]GatewayMapping, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway mappings %s: %w", filePath, err)
+	}
+	var mappings []GatewayMapping
+	if err := json.Unmarshal(data, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to parse gateway mappings %s: %w", filePath, err)
+	}
+	return mappings, nil
+}
+
+// ProtocolGatewayOptions tunes the protocol gateway.
+type ProtocolGatewayOptions struct {
+	QueueSize int    // Source values waiting to be translated; more are dropped
+	Identity  string // AccessControl ID of mappings that do not name one
+}
+
+// DefaultProtocolGatewayOptions returns the gateway options used unless others are configured.
+func DefaultProtocolGatewayOptions() ProtocolGatewayOptions {
+	return ProtocolGatewayOptions{
+		QueueSize: 1000,
+		Identity:  "gateway",
+	}
+}
+
+// Errors reported for values a mapping cannot translate.
+var (
+	ErrGatewayInvalidValue = errors.New("invalid gateway value")
+	ErrGatewayOutOfRange   = errors.New("gateway value out of range")
+	ErrGatewayNoModbus     = errors.New("no Modbus poller for gateway writes")
+)
+
+// GatewayMappingStats counts what happened to the values a mapping received.
+type GatewayMappingStats struct {
+	Translated  uint64 // Values written to the target
+	RateLimited uint64 // Values dropped by the mapping's rate limit
+	Dropped     uint64 // Values dropped because the gateway's queue was full
+	Invalid     uint64 // Values that could not be read or fell outside Min and Max
+	Denied      uint64 // Values AccessControl did not let the mapping read or write
+	Failed      uint64 // Values the target could not be written with
+}
+
+// gatewayMapping is a validated GatewayMapping with its rate limit state.
+type gatewayMapping struct {
+	config       GatewayMapping
+	identity     string
+	sourceTopic  string       // Topic filter of topic and opcua sources
+	sourceField  string       // Field of the source payload holding the value
+	sourceSeries string       // "<device>.<point>" series of modbus sources
+	targetField  string       // Field of topic target payloads holding the value
+	from, to     *gatewayUnit // Unit conversion; nil for none
+	scale        float64
+	tokens       float64   // Translations left in the burst
+	refilled     time.Time // When tokens was last topped up
+	stats        GatewayMappingStats
+	grants       gatewayGrants // Resolved topic permissions, owned by the translating goroutine
+}
+
+// gatewayGrants caches what AccessControl lets a mapping's identity do with its source and target
+// topics, until the rules change.
+type gatewayGrants struct {
+	version  uint64   // AccessControl.RulesVersion the grants were resolved at
+	resolved bool     // Whether the grants were resolved yet
+	read     bool     // The identity may subscribe to the source filter
+	excluded []string // Narrower filters inside the source filter the identity may not read
+	write    bool     // The identity may publish to the target topic
+}
+
+// gatewayJob is a source value waiting to be translated.
+type gatewayJob struct {
+	mapping   *gatewayMapping
+	topic     string // Topic the value was published to; empty for Modbus samples
+	payload   []byte // Payload holding the value, for topic and opcua sources
+	value     float64
+	timestamp time.Time
+	priority  TrafficClass
+}
+
+// ProtocolGateway translates values between industrial protocols according to declarative mappings:
+// a JSON field published by an MQTT sensor can be written to a Modbus holding register, and an OPC UA
+// variable or Modbus point republished as a topic. It observes the topics of a RoutingManager, which
+// the MQTT broker and the OPC UA client publish to, and the samples of the Modbus poller. Translations
+// run on a worker of their own, so slow devices do not hold up publishers.
+type ProtocolGateway struct {
+	options  ProtocolGatewayOptions
+	mappings []*gatewayMapping
+	topical  []*gatewayMapping            // Mappings with topic and opcua sources
+	bySeries map[string][]*gatewayMapping // Mappings with modbus sources, by series
+	access   *AccessControl               // Authorizes the topics mappings read and write; nil allows all
+	routing  *RoutingManager              // Source of topic values and where topic targets are published
+	logger   *log.Logger
+
+	mutex       sync.Mutex // Guards rate limits, statistics and writeModbus
+	writeModbus func(requester, device, point string, value float64) error
+	queue       chan gatewayJob
+	stop        chan struct{}
+	done        chan struct{}
+	once        sync.Once
+}
+
+// NewProtocolGateway validates the mappings, attaches the gateway to routing as its publish observer and
+// starts translating. routing may be nil when no mapping reads or writes topics.
+func NewProtocolGateway(options ProtocolGatewayOptions, mappings []GatewayMapping, access *AccessControl, routing *RoutingManager, logger *log.Logger) (*ProtocolGateway, error) {
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultProtocolGatewayOptions().QueueSize
+	}
+	if options.Identity == "" {
+		options.Identity = DefaultProtocolGatewayOptions().Identity
+	}
+	gateway := &ProtocolGateway{
+		options:  options,
+		bySeries: make(map[string][]*gatewayMapping),
+		access:   access,
+		routing:  routing,
+		logger:   logger,
+		queue:    make(chan gatewayJob, options.QueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	names := make(map[string]bool)
+	for _, config := range mappings {
+		mapping, err := parseGatewayMapping(config, options.Identity)
+		if err != nil {
+			return nil, err
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate gateway mapping %q", config.Name)
+		}
+		names[config.Name] = true
+		usesTopics := mapping.sourceTopic != "" || config.Target.Protocol == GatewayTopic
+		if usesTopics && routing == nil {
+			return nil, fmt.Errorf("gateway mapping %s uses topics, which need a RoutingManager", config.Name)
+		}
+		gateway.mappings = append(gateway.mappings, mapping)
+		if mapping.sourceTopic != "" {
+			gateway.topical = append(gateway.topical, mapping)
+		} else {
+			gateway.bySeries[mapping.sourceSeries] = append(gateway.bySeries[mapping.sourceSeries], mapping)
+		}
+	}
+	if err := checkGatewayLoops(gateway.mappings); err != nil {
+		return nil, err
+	}
+	for _, mapping := range gateway.mappings {
+		gateway.authorize(mapping)
+	}
+
+	if routing != nil {
+		routing.SetPublishObserver(gateway.Observe)
+	}
+	go gateway.run()
+	return gateway, nil
+}
+
+// parseGatewayMapping applies defaults and validates a mapping.
+func parseGatewayMapping(config GatewayMapping, identity string) (*gatewayMapping, error) {
+	if config.Name == "" {
+		return nil, errors.New("gateway mapping without a name")
+	}
+	mapping := &gatewayMapping{config: config, identity: config.Identity, scale: config.Scale}
+	if mapping.identity == "" {
+		mapping.identity = identity
+	}
+	if mapping.scale == 0 {
+		mapping.scale = 1
+	}
+
+	source := config.Source
+	switch source.Protocol {
+	case GatewayTopic:
+		if err := ValidateTopicFilter(source.Topic); err != nil {
+			return nil, fmt.Errorf("invalid source topic for gateway mapping %s: %w", config.Name, err)
+		}
+		mapping.sourceTopic, mapping.sourceField = source.Topic, source.Field
+	case GatewayOPCUA:
+		if source.Server == "" || source.Node == "" && source.Topic == "" {
+			return nil, fmt.Errorf("OPC UA source of gateway mapping %s needs a server and a node", config.Name)
+		}
+		mapping.sourceTopic = source.Topic
+		if mapping.sourceTopic == "" {
+			mapping.sourceTopic = "opcua/" + source.Server + "/" + source.Node
+		}
+		if err := ValidateTopic(mapping.sourceTopic); err != nil {
+			return nil, fmt.Errorf("invalid OPC UA source of gateway mapping %s: %w", config.Name, err)
+		}
+		mapping.sourceField = source.Field
+		if mapping.sourceField == "" {
+			mapping.sourceField = "value"
+		}
+	case GatewayModbus:
+		if source.Device == "" || source.Point == "" {
+			return nil, fmt.Errorf("Modbus source of gateway mapping %s needs a device and a point", config.Name)
+		}
+		mapping.sourceSeries = source.Device + "." + source.Point
+	default:
+		return nil, fmt.Errorf("unknown source protocol %q for gateway mapping %s", source.Protocol, config.Name)
+	}
+
+	target := config.Target
+	switch target.Protocol {
+	case GatewayTopic:
+		if err := ValidateTopic(target.Topic); err != nil {
+			return nil, fmt.Errorf("invalid target topic for gateway mapping %s: %w", config.Name, err)
+		}
+		// $ topics are reserved for the server
+		if strings.HasPrefix(target.Topic, "$") {
+			return nil, fmt.Errorf("gateway mapping %s may not publish to %s", config.Name, target.Topic)
+		}
+		mapping.targetField = target.Field
+		if mapping.targetField == "" {
+			mapping.targetField = "value"
+		}
+	case GatewayModbus:
+		if target.Device == "" || target.Point == "" {
+			return nil, fmt.Errorf("Modbus target of gateway mapping %s needs a device and a point", config.Name)
+		}
+	case GatewayOPCUA:
+		return nil, fmt.Errorf("gateway mapping %s: OPC UA variables can only be sources", config.Name)
+	default:
+		return nil, fmt.Errorf("unknown target protocol %q for gateway mapping %s", target.Protocol, config.Name)
+	}
+
+	if config.FromUnit != "" || config.ToUnit != "" {
+		from, fromKnown := gatewayUnits[config.FromUnit]
+		to, toKnown := gatewayUnits[config.ToUnit]
+		switch {
+		case !fromKnown:
+			return nil, fmt.Errorf("unknown unit %q for gateway mapping %s", config.FromUnit, config.Name)
+		case !toKnown:
+			return nil, fmt.Errorf("unknown unit %q for gateway mapping %s", config.ToUnit, config.Name)
+		case from.quantity != to.quantity:
+			return nil, fmt.Errorf("gateway mapping %s cannot convert %s (%s) to %s (%s)", config.Name, config.FromUnit, from.quantity, config.ToUnit, to.quantity)
+		}
+		mapping.from, mapping.to = &from, &to
+	}
+	switch config.Type {
+	case "", "float", "int", "bool":
+	default:
+		return nil, fmt.Errorf("unknown value type %q for gateway mapping %s", config.Type, config.Name)
+	}
+	if config.Min != nil && config.Max != nil && *config.Min > *config.Max {
+		return nil, fmt.Errorf("gateway mapping %s has min %g above max %g", config.Name, *config.Min, *config.Max)
+	}
+	if config.Rate < 0 || config.Burst < 0 {
+		return nil, fmt.Errorf("gateway mapping %s has a negative rate limit", config.Name)
+	}
+	if mapping.config.Burst == 0 {
+		mapping.config.Burst = 1
+	}
+	mapping.tokens = float64(mapping.config.Burst)
+	return mapping, nil
+}
+
+// checkGatewayLoops refuses mappings whose topic targets feed back into their own sources, which would
+// translate values forever.
+func checkGatewayLoops(mappings []*gatewayMapping) error {
+	feeds := make(map[*gatewayMapping][]*gatewayMapping)
+	for _, from := range mappings {
+		if from.config.Target.Protocol != GatewayTopic {
+			continue
+		}
+		for _, to := range mappings {
+			if to.sourceTopic != "" && TopicMatches(to.sourceTopic, from.config.Target.Topic) {
+				feeds[from] = append(feeds[from], to)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*gatewayMapping]int)
+	var path []string
+	var visit func(mapping *gatewayMapping) error
+	visit = func(mapping *gatewayMapping) error {
+		state[mapping] = visiting
+		path = append(path, mapping.config.Name)
+		for _, next := range feeds[mapping] {
+			switch state[next] {
+			case visiting:
+				return fmt.Errorf("gateway mappings loop: %s -> %s", strings.Join(path, " -> "), next.config.Name)
+			case unvisited:
+				if err := visit(next); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[mapping] = visited
+		return nil
+	}
+	for _, mapping := range mappings {
+		if state[mapping] == unvisited {
+			if err := visit(mapping); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SetModbusWriter sets the function Modbus targets are written with, usually ModbusPoller.WritePoint.
+// Without one, translations to Modbus targets fail.
+func (g *ProtocolGateway) SetModbusWriter(write func(requester, device, point string, value float64) error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.writeModbus = write
+}
+
+// Observe queues a published message for the mappings whose source topics match it. It is the
+// RoutingManager's publish observer.
+func (g *ProtocolGateway) Observe(envelope Envelope) {
+	now := time.Now()
+	for _, mapping := range g.topical {
+		if !TopicMatches(mapping.sourceTopic, envelope.Topic) {
+			continue
+		}
+		g.enqueue(gatewayJob{
+			mapping:   mapping,
+			topic:     envelope.Topic,
+			payload:   envelope.Payload,
+			timestamp: envelope.Timestamp,
+			priority:  envelope.Priority,
+		}, now)
+	}
+}
+
+// ObserveSamples queues samples for the mappings with Modbus sources. Pass it, along with analytics,
+// the samples of the Modbus poller.
+func (g *ProtocolGateway) ObserveSamples(samples []Sample) {
+	now := time.Now()
+	for _, sample := range samples {
+		for _, mapping := range g.bySeries[sample.Series] {
+			g.enqueue(gatewayJob{
+				mapping:   mapping,
+				value:     sample.Value,
+				timestamp: sample.Timestamp,
+				priority:  ClassTelemetry,
+			}, now)
+		}
+	}
+}
+
+// enqueue queues a job once the mapping's rate limit allows it.
+func (g *ProtocolGateway) enqueue(job gatewayJob, now time.Time) {
+	select {
+	case <-g.stop:
+		return
+	default:
+	}
+	mapping := job.mapping
+	g.mutex.Lock()
+	if !mapping.allow(now) {
+		mapping.stats.RateLimited++
+		g.mutex.Unlock()
+		return
+	}
+	g.mutex.Unlock()
+
+	select {
+	case g.queue <- job:
+	default:
+		g.mutex.Lock()
+		mapping.stats.Dropped++
+		g.mutex.Unlock()
+		g.logger.Printf("Gateway queue is full; dropping value for mapping %s\n", mapping.config.Name)
+	}
+}
+
+// allow takes a token from the mapping's bucket, refilled at its rate; the caller must hold the mutex.
+func (mapping *gatewayMapping) allow(now time.Time) bool {
+	if mapping.config.Rate == 0 {
+		return true
+	}
+	if !mapping.refilled.IsZero() {
+		elapsed := now.Sub(mapping.refilled).Seconds()
+		mapping.tokens = math.Min(float64(mapping.config.Burst), mapping.tokens+elapsed*mapping.config.Rate)
+	}
+	mapping.refilled = now
+	if mapping.tokens < 1 {
+		return false
+	}
+	mapping.tokens--
+	return true
+}
+
+// run translates queued values until the gateway stops.
+func (g *ProtocolGateway) run() {
+	defer close(g.done)
+	for {
+		select {
+		case job := <-g.queue:
+			g.translate(job)
+		case <-g.stop:
+			return
+		}
+	}
+}
+
+// authorize returns the mapping's topic permissions, resolving them again if the access rules changed
+// since they were last resolved.
+func (g *ProtocolGateway) authorize(mapping *gatewayMapping) *gatewayGrants {
+	grants := &mapping.grants
+	if g.access == nil {
+		grants.read, grants.write = true, true
+		return grants
+	}
+	version := g.access.RulesVersion()
+	if grants.resolved && grants.version == version {
+		return grants
+	}
+	*grants = gatewayGrants{version: version, resolved: true}
+	if mapping.sourceTopic != "" {
+		grants.excluded, grants.read = g.access.AuthorizeSubscription(mapping.identity, mapping.sourceTopic)
+	}
+	if mapping.config.Target.Protocol == GatewayTopic {
+		grants.write = g.access.CheckTopicAccess(mapping.identity, mapping.config.Target.Topic, TopicPublish)
+	}
+	return grants
+}
+
+// translate reads, converts and authorizes a queued value and writes it to the mapping's target.
+func (g *ProtocolGateway) translate(job gatewayJob) {
+	mapping := job.mapping
+	name := mapping.config.Name
+	value := job.value
+	grants := g.authorize(mapping)
+	if mapping.sourceTopic != "" {
+		if !grants.read || topicExcluded(grants.excluded, job.topic) {
+			g.count(mapping, &mapping.stats.Denied)
+			g.logger.Printf("Gateway mapping %s: %s may not read %s\n", name, mapping.identity, job.topic)
+			return
+		}
+		var err error
+		if value, err = gatewayValue(job.payload, mapping.sourceField); err != nil {
+			g.count(mapping, &mapping.stats.Invalid)
+			g.logger.Printf("Gateway mapping %s: cannot read value on %s: %v\n", name, job.topic, err)
+			return
+		}
+	}
+	value, err := mapping.convert(value)
+	if err != nil {
+		g.count(mapping, &mapping.stats.Invalid)
+		g.logger.Printf("Gateway mapping %s: %v\n", name, err)
+		return
+	}
+
+	target := mapping.config.Target
+	switch target.Protocol {
+	case GatewayTopic:
+		if !grants.write {
+			g.count(mapping, &mapping.stats.Denied)
+			g.logger.Printf("Gateway mapping %s: %s may not publish to %s\n", name, mapping.identity, target.Topic)
+			return
+		}
+		if _, err := g.routing.Publish(target.Topic, mapping.envelope(value, job)); err != nil {
+			g.count(mapping, &mapping.stats.Failed)
+			g.logger.Printf("Gateway mapping %s: failed to publish to %s: %v\n", name, target.Topic, err)
+			return
+		}
+	case GatewayModbus:
+		g.mutex.Lock()
+		write := g.writeModbus
+		g.mutex.Unlock()
+		err := ErrGatewayNoModbus
+		if write != nil {
+			err = write(mapping.identity, target.Device, target.Point, value)
+		}
+		if errors.Is(err, ErrModbusWriteDenied) {
+			g.count(mapping, &mapping.stats.Denied)
+			return
+		}
+		if err != nil {
+			g.count(mapping, &mapping.stats.Failed)
+			g.logger.Printf("Gateway mapping %s: %v\n", name, err)
+			return
+		}
+	}
+	g.count(mapping, &mapping.stats.Translated)
+}
+
+// count increments one of a mapping's counters.
+func (g *ProtocolGateway) count(mapping *gatewayMapping, counter *uint64) {
+	g.mutex.Lock()
+	*counter++
+	g.mutex.Unlock()
+}
+
+// convert applies the mapping's unit conversion, scaling, type and range to a source value.
+func (mapping *gatewayMapping) convert(value float64) (float64, error) {
+	config := mapping.config
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("%w: %g", ErrGatewayInvalidValue, value)
+	}
+	if mapping.from != nil {
+		value = mapping.to.fromBase(mapping.from.toBase(value))
+	}
+	value = value*mapping.scale + config.Offset
+	switch config.Type {
+	case "int":
+		value = math.Round(value)
+	case "bool":
+		if value != 0 {
+			value = 1
+		}
+	}
+	if config.Min != nil && value < *config.Min {
+		if !config.Clamp {
+			return 0, fmt.Errorf("%w: %g is below %g", ErrGatewayOutOfRange, value, *config.Min)
+		}
+		value = *config.Min
+	}
+	if config.Max != nil && value > *config.Max {
+		if !config.Clamp {
+			return 0, fmt.Errorf("%w: %g is above %g", ErrGatewayOutOfRange, value, *config.Max)
+		}
+		value = *config.Max
+	}
+	return value, nil
+}
+
+// envelope builds the message a converted value is published in: a JSON object with the value in the
+// target field, typed as the mapping says, and the source's timestamp.
+func (mapping *gatewayMapping) envelope(value float64, job gatewayJob) Envelope {
+	var typed interface{} = value
+	switch mapping.config.Type {
+	case "int":
+		typed = int64(value)
+	case "bool":
+		typed = value != 0
+	}
+	timestamp := job.timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		mapping.targetField: typed,
+		"timestamp":         timestamp.Format(time.RFC3339Nano),
+	})
+	return Envelope{Type: MessageData, Priority: job.priority, Timestamp: timestamp, ContentType: "application/json", Payload: payload}
+}
+
+// gatewayValue reads a numeric value from a payload. Without a field the payload itself must be a
+// number or boolean; otherwise it is a JSON object and field names the value, with dots separating
+// the names of nested objects. Numbers held in strings are accepted.
+func gatewayValue(payload []byte, field string) (float64, error) {
+	var value interface{}
+	if err := json.Unmarshal(payload, &value); err != nil {
+		if field != "" {
+			return 0, fmt.Errorf("%w: payload is not JSON", ErrGatewayInvalidValue)
+		}
+		value = strings.TrimSpace(string(payload))
+	}
+	if field != "" {
+		for _, name := range strings.Split(field, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return 0, fmt.Errorf("%w: no field %s", ErrGatewayInvalidValue, field)
+			}
+			if value, ok = object[name]; !ok {
+				return 0, fmt.Errorf("%w: no field %s", ErrGatewayInvalidValue, field)
+			}
+		}
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return parsed, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: %v is not a number", ErrGatewayInvalidValue, value)
+}
+
+// Stats returns the counters of each mapping by name.
+func (g *ProtocolGateway) Stats() map[string]GatewayMappingStats {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	stats := make(map[string]GatewayMappingStats, len(g.mappings))
+	for _, mapping := range g.mappings {
+		stats[mapping.config.Name] = mapping.stats
+	}
+	return stats
+}
+
+// Stop stops translating, waiting for a translation in progress until ctx is done. Queued values are
+// discarded.
+func (g *ProtocolGateway) Stop(ctx context.Context) error {
+	g.once.Do(func() { close(g.stop) })
+	select {
+	case <-g.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// gatewayUnit converts a unit to the base unit of its quantity: base = value*scale + offset.
+type gatewayUnit struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+func (u *gatewayUnit) toBase(value float64) float64   { return value*u.scale + u.offset }
+func (u *gatewayUnit) fromBase(value float64) float64 { return (value - u.offset) / u.scale }
+
+// gatewayUnits are the units mappings convert between, by the symbol used in FromUnit and ToUnit.
+var gatewayUnits = map[string]gatewayUnit{
+	"C": {"temperature", 1, 0},
+	"F": {"temperature", 5.0 / 9, -32 * 5.0 / 9},
+	"K": {"temperature", 1, -273.15},
+
+	"Pa":   {"pressure", 1, 0},
+	"kPa":  {"pressure", 1e3, 0},
+	"MPa":  {"pressure", 1e6, 0},
+	"mbar": {"pressure", 100, 0},
+	"bar":  {"pressure", 1e5, 0},
+	"psi":  {"pressure", 6894.757293168, 0},
+
+	"mm": {"length", 1e-3, 0},
+	"cm": {"length", 1e-2, 0},
+	"m":  {"length", 1, 0},
+	"in": {"length", 0.0254, 0},
+	"ft": {"length", 0.3048, 0},
+
+	"l":   {"volume", 1e-3, 0},
+	"m3":  {"volume", 1, 0},
+	"gal": {"volume", 0.003785411784, 0},
+
+	"l/s":   {"flow", 1e-3, 0},
+	"l/min": {"flow", 1e-3 / 60, 0},
+	"m3/h":  {"flow", 1.0 / 3600, 0},
+	"gpm":   {"flow", 0.003785411784 / 60, 0},
+
+	"g":  {"mass", 1e-3, 0},
+	"kg": {"mass", 1, 0},
+	"lb": {"mass", 0.45359237, 0},
+
+	"W":  {"power", 1, 0},
+	"kW": {"power", 1e3, 0},
+	"hp": {"power", 745.69987158, 0},
+
+	"J":   {"energy", 1, 0},
+	"Wh":  {"energy", 3600, 0},
+	"kWh": {"energy", 3.6e6, 0},
+
+	"Hz":  {"frequency", 1, 0},
+	"rpm": {"frequency", 1.0 / 60, 0},
+
+	"%":     {"ratio", 0.01, 0},
+	"ratio": {"ratio", 1, 0},
+}
@@ -0,0 +1,348 @@
+// server/src/modules/rollup_aggregator.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// percentilePattern matches percentile aggregation names such as p50, p95 or p99.9.
+var percentilePattern = regexp.MustCompile(`^p(\d{1,2}(\.\d+)?)$`)
+
+// rollupBasicAggregations lists the non-percentile aggregations a rollup can compute.
+var rollupBasicAggregations = map[string]bool{
+	"min":   true,
+	"max":   true,
+	"mean":  true,
+	"count": true,
+	"sum":   true,
+	"last":  true,
+}
+
+// RollupConfig selects the bucket widths and aggregations computed for series matching a pattern.
+type RollupConfig struct {
+	Series       string   `json:"series"`       // path.Match pattern on series names; "*" matches every series
+	Resolutions  []string `json:"resolutions"`  // Bucket widths such as "1s", "1m" or "1h"
+	Aggregations []string `json:"aggregations"` // min, max, mean, count, sum, last and percentiles such as p95
+}
+
+// DefaultRollupConfig returns a rule rolling up every series at 1s, 1m and 1h with all aggregations.
+func DefaultRollupConfig() RollupConfig {
+	return RollupConfig{
+		Series:       "*",
+		Resolutions:  []string{"1s", "1m", "1h"},
+		Aggregations: []string{"min", "max", "mean", "count", "sum", "last", "p50", "p90", "p99"},
+	}
+}
+
+// LoadRollupConfigs reads rollup rules from a JSON file containing an array of RollupConfig.
+func LoadRollupConfigs(filePath string) ([]RollupConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollup config %s: %w", filePath, err)
+	}
+	var configs []RollupConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse rollup config %s: %w", filePath, err)
+	}
+	return configs, nil
+}
+
+// Rollup holds the aggregated values of one series over one time bucket.
+type Rollup struct {
+	Series     string             `json:"series"`
+	Resolution string             `json:"resolution"`
+	Start      time.Time          `json:"start"`
+	End        time.Time          `json:"end"`
+	Values     map[string]float64 `json:"values"` // Keyed by aggregation name, e.g. "max" or "p99"
+}
+
+// RollupSink receives completed rollups, e.g. to store them locally or forward them upstream.
+type RollupSink interface {
+	WriteRollups(rollups []Rollup) error
+}
+
+// rollupRule is a validated RollupConfig.
+type rollupRule struct {
+	pattern      string
+	resolutions  []time.Duration
+	aggregations []string
+	percentiles  map[string]float64 // Aggregation name to quantile, e.g. "p99" -> 0.99
+}
+
+// rollupKey identifies the buckets of one series at one resolution.
+type rollupKey struct {
+	series     string
+	resolution time.Duration
+}
+
+// rollupBucket accumulates samples for a single series and time bucket.
+type rollupBucket struct {
+	start  time.Time
+	count  int64
+	sum    float64
+	min    float64
+	max    float64
+	last   float64
+	digest *tDigest // Only allocated when the rule requests percentiles
+}
+
+// RollupAggregator downsamples raw samples into fixed-width time buckets per series.
+type RollupAggregator struct {
+	rules       []rollupRule                // Rules in priority order; the first match wins
+	plans       map[string]*rollupRule      // Cached rule lookup per series (nil when no rule matches)
+	buckets     map[rollupKey]*rollupBucket // Currently open buckets
+	closedUntil map[rollupKey]time.Time     // End of the last bucket emitted; samples before it are late
+	sinks       []RollupSink                // Destinations for completed rollups
+	lateSamples int64                       // Samples dropped because their bucket was already closed or emitted
+	mutex       sync.Mutex                  // Guards rules, plans, buckets and counters
+	logger      *log.Logger                 // Logger for tracking rollup events
+}
+
+// NewRollupAggregator validates the rollup rules and creates an aggregator.
+func NewRollupAggregator(logger *log.Logger, configs []RollupConfig) (*RollupAggregator, error) {
+	rules := make([]rollupRule, 0, len(configs))
+	for _, config := range configs {
+		rule, err := parseRollupConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	return &RollupAggregator{
+		rules:       rules,
+		plans:       make(map[string]*rollupRule),
+		buckets:     make(map[rollupKey]*rollupBucket),
+		closedUntil: make(map[rollupKey]time.Time),
+		logger:      logger,
+	}, nil
+}
+
+// parseRollupConfig checks a rollup rule and converts it to its runtime form.
+func parseRollupConfig(config RollupConfig) (rollupRule, error) {
+	if _, err := path.Match(config.Series, ""); err != nil {
+		return rollupRule{}, fmt.Errorf("invalid rollup series pattern %q: %w", config.Series, err)
+	}
+
+	rule := rollupRule{
+		pattern:      config.Series,
+		aggregations: config.Aggregations,
+		percentiles:  make(map[string]float64),
+	}
+	for _, resolution := range config.Resolutions {
+		duration, err := time.ParseDuration(resolution)
+		if err != nil || duration <= 0 {
+			return rollupRule{}, fmt.Errorf("invalid rollup resolution %q for series %q", resolution, config.Series)
+		}
+		rule.resolutions = append(rule.resolutions, duration)
+	}
+	for _, aggregation := range config.Aggregations {
+		if rollupBasicAggregations[aggregation] {
+			continue
+		}
+		match := percentilePattern.FindStringSubmatch(aggregation)
+		if match == nil {
+			return rollupRule{}, fmt.Errorf("unknown rollup aggregation %q for series %q", aggregation, config.Series)
+		}
+		percent, _ := strconv.ParseFloat(match[1], 64)
+		rule.percentiles[aggregation] = percent / 100
+	}
+
+	return rule, nil
+}
+
+// AddSink registers a destination for completed rollups.
+func (ra *RollupAggregator) AddSink(sink RollupSink) {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	ra.sinks = append(ra.sinks, sink)
+}
+
+// Add folds a sample into the open bucket of every configured resolution, closing buckets the sample has moved past.
+func (ra *RollupAggregator) Add(series string, timestamp time.Time, value float64) {
+	ra.mutex.Lock()
+	rule := ra.ruleFor(series)
+	if rule == nil {
+		ra.mutex.Unlock()
+		return
+	}
+
+	var completed []Rollup
+	for _, resolution := range rule.resolutions {
+		key := rollupKey{series: series, resolution: resolution}
+		start := timestamp.Truncate(resolution)
+
+		// A window that was already emitted must not be reopened and emitted again with a partial aggregate
+		bucket, exists := ra.buckets[key]
+		if exists && start.Before(bucket.start) || start.Before(ra.closedUntil[key]) {
+			ra.lateSamples++
+			continue
+		}
+		if exists && start.After(bucket.start) {
+			completed = append(completed, ra.closeBucket(key, bucket, rule))
+			exists = false
+		}
+		if !exists {
+			bucket = newRollupBucket(start, len(rule.percentiles) > 0)
+			ra.buckets[key] = bucket
+		}
+		bucket.add(value)
+	}
+	ra.mutex.Unlock()
+
+	ra.emit(completed)
+}
+
+// Flush closes every bucket whose time window ended at or before now.
+func (ra *RollupAggregator) Flush(now time.Time) {
+	ra.flush(func(key rollupKey, bucket *rollupBucket) bool {
+		return !bucket.start.Add(key.resolution).After(now)
+	})
+}
+
+// FlushAll closes every open bucket, including partial ones, e.g. during shutdown.
+func (ra *RollupAggregator) FlushAll() {
+	ra.flush(func(rollupKey, *rollupBucket) bool { return true })
+}
+
+// LateSamples returns the number of samples dropped because they arrived after their bucket closed or was emitted.
+func (ra *RollupAggregator) LateSamples() int64 {
+	ra.mutex.Lock()
+	defer ra.mutex.Unlock()
+	return ra.lateSamples
+}
+
+// flush closes the buckets selected by the predicate and emits them in time order.
+func (ra *RollupAggregator) flush(shouldClose func(rollupKey, *rollupBucket) bool) {
+	ra.mutex.Lock()
+	var completed []Rollup
+	for key, bucket := range ra.buckets {
+		if shouldClose(key, bucket) {
+			completed = append(completed, ra.closeBucket(key, bucket, ra.ruleFor(key.series)))
+		}
+	}
+	ra.mutex.Unlock()
+
+	sort.Slice(completed, func(i, j int) bool {
+		if !completed[i].Start.Equal(completed[j].Start) {
+			return completed[i].Start.Before(completed[j].Start)
+		}
+		return completed[i].Series < completed[j].Series
+	})
+	ra.emit(completed)
+}
+
+// ruleFor returns the first rule matching the series, caching the result. Must be called with the mutex held.
+func (ra *RollupAggregator) ruleFor(series string) *rollupRule {
+	if rule, cached := ra.plans[series]; cached {
+		return rule
+	}
+	var match *rollupRule
+	for i := range ra.rules {
+		if ok, _ := path.Match(ra.rules[i].pattern, series); ok {
+			match = &ra.rules[i]
+			break
+		}
+	}
+	ra.plans[series] = match
+	return match
+}
+
+// closeBucket removes an open bucket and renders it as a rollup. Must be called with the mutex held.
+func (ra *RollupAggregator) closeBucket(key rollupKey, bucket *rollupBucket, rule *rollupRule) Rollup {
+	delete(ra.buckets, key)
+	ra.closedUntil[key] = bucket.start.Add(key.resolution)
+
+	values := make(map[string]float64, len(rule.aggregations))
+	for _, aggregation := range rule.aggregations {
+		switch aggregation {
+		case "min":
+			values["min"] = bucket.min
+		case "max":
+			values["max"] = bucket.max
+		case "mean":
+			values["mean"] = bucket.sum / float64(bucket.count)
+		case "count":
+			values["count"] = float64(bucket.count)
+		case "sum":
+			values["sum"] = bucket.sum
+		case "last":
+			values["last"] = bucket.last
+		default:
+			values[aggregation] = bucket.digest.Quantile(rule.percentiles[aggregation])
+		}
+	}
+
+	return Rollup{
+		Series:     key.series,
+		Resolution: formatResolution(key.resolution),
+		Start:      bucket.start,
+		End:        bucket.start.Add(key.resolution),
+		Values:     values,
+	}
+}
+
+// emit hands completed rollups to every sink outside the aggregator lock.
+func (ra *RollupAggregator) emit(rollups []Rollup) {
+	if len(rollups) == 0 {
+		return
+	}
+
+	ra.mutex.Lock()
+	sinks := append([]RollupSink(nil), ra.sinks...)
+	ra.mutex.Unlock()
+
+	for _, sink := range sinks {
+		if err := sink.WriteRollups(rollups); err != nil {
+			ra.logger.Printf("Error writing %d rollups: %v\n", len(rollups), err)
+		}
+	}
+}
+
+// formatResolution renders a bucket width compactly, e.g. "1m" instead of "1m0s".
+func formatResolution(resolution time.Duration) string {
+	switch {
+	case resolution%time.Hour == 0:
+		return fmt.Sprintf("%dh", resolution/time.Hour)
+	case resolution%time.Minute == 0:
+		return fmt.Sprintf("%dm", resolution/time.Minute)
+	default:
+		return resolution.String()
+	}
+}
+
+// newRollupBucket creates an empty bucket starting at the given time.
+func newRollupBucket(start time.Time, withPercentiles bool) *rollupBucket {
+	bucket := &rollupBucket{
+		start: start,
+		min:   math.Inf(1),
+		max:   math.Inf(-1),
+	}
+	if withPercentiles {
+		bucket.digest = newTDigest(100)
+	}
+	return bucket
+}
+
+// add folds a value into the bucket.
+func (b *rollupBucket) add(value float64) {
+	b.count++
+	b.sum += value
+	b.min = math.Min(b.min, value)
+	b.max = math.Max(b.max, value)
+	b.last = value
+	if b.digest != nil {
+		b.digest.Add(value)
+	}
+}
@@ -0,0 +1,54 @@
+// server/src/modules/rollup_aggregator_test.go
+
+package modules
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+// rollupRecorder is a RollupSink that keeps every rollup it receives.
+type rollupRecorder struct {
+	rollups []Rollup
+}
+
+func (r *rollupRecorder) WriteRollups(rollups []Rollup) error {
+	r.rollups = append(r.rollups, rollups...)
+	return nil
+}
+
+func TestRollupLateSampleDoesNotReopenEmittedWindow(t *testing.T) {
+	aggregator, err := NewRollupAggregator(log.New(io.Discard, "", 0), []RollupConfig{{Series: "*", Resolutions: []string{"1m"}, Aggregations: []string{"count", "sum"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &rollupRecorder{}
+	aggregator.AddSink(sink)
+
+	window := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	aggregator.Add("boiler.temp", window.Add(10*time.Second), 1)
+	aggregator.Add("boiler.temp", window.Add(20*time.Second), 2)
+	aggregator.Flush(window.Add(time.Minute))
+	if len(sink.rollups) != 1 || sink.rollups[0].Values["count"] != 2 {
+		t.Fatalf("unexpected rollups after flush: %+v", sink.rollups)
+	}
+
+	// A sample for the emitted window arrives after the flush
+	aggregator.Add("boiler.temp", window.Add(30*time.Second), 3)
+	aggregator.FlushAll()
+	if len(sink.rollups) != 1 {
+		t.Fatalf("emitted window was emitted again: %+v", sink.rollups)
+	}
+	if late := aggregator.LateSamples(); late != 1 {
+		t.Fatalf("LateSamples = %d, want 1", late)
+	}
+
+	// The next window is still aggregated
+	aggregator.Add("boiler.temp", window.Add(70*time.Second), 4)
+	aggregator.FlushAll()
+	if len(sink.rollups) != 2 || !sink.rollups[1].Start.Equal(window.Add(time.Minute)) {
+		t.Fatalf("next window not emitted: %+v", sink.rollups)
+	}
+}
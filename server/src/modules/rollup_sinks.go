@@ -0,0 +1,107 @@
+// server/src/modules/rollup_sinks.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileRollupStore persists rollups locally as JSON lines, one file per resolution and UTC day.
+type FileRollupStore struct {
+	baseDir string     // Root directory, typically <StoragePath>/rollups
+	mutex   sync.Mutex // Serialises appends to the rollup files
+}
+
+// NewFileRollupStore creates a rollup store rooted at baseDir, creating the directory if needed.
+func NewFileRollupStore(baseDir string) (*FileRollupStore, error) {
+	if err := os.MkdirAll(baseDir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create rollup directory %s: %w", baseDir, err)
+	}
+	return &FileRollupStore{baseDir: baseDir}, nil
+}
+
+// WriteRollups appends each rollup to <baseDir>/<resolution>/<YYYY-MM-DD>.jsonl.
+func (fs *FileRollupStore) WriteRollups(rollups []Rollup) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// Group by file so each file is opened once per batch
+	lines := make(map[string][]byte)
+	order := make([]string, 0)
+	for _, rollup := range rollups {
+		record, err := json.Marshal(rollup)
+		if err != nil {
+			return fmt.Errorf("failed to encode rollup for series %s: %w", rollup.Series, err)
+		}
+		file := filepath.Join(fs.baseDir, rollup.Resolution, rollup.Start.UTC().Format("2006-01-02")+".jsonl")
+		if _, seen := lines[file]; !seen {
+			order = append(order, file)
+		}
+		lines[file] = append(append(lines[file], record...), '\n')
+	}
+
+	for _, file := range order {
+		if err := appendToFile(file, lines[file]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendToFile appends data to a file, creating it and its parent directory if necessary.
+func appendToFile(filePath string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0750); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", filePath, err)
+	}
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filePath, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", filePath, err)
+	}
+	return nil
+}
+
+// UpstreamRollupForwarder spools selected rollups to the outbound queue so sites can ship aggregates instead of raw samples.
+type UpstreamRollupForwarder struct {
+	queue       *OutboundQueue  // Durable queue delivering rollups upstream
+	resolutions map[string]bool // Resolutions forwarded upstream; empty forwards all
+}
+
+// NewUpstreamRollupForwarder creates a forwarder for the given resolutions (e.g. "1m", "1h").
+func NewUpstreamRollupForwarder(queue *OutboundQueue, resolutions []string) *UpstreamRollupForwarder {
+	allowed := make(map[string]bool, len(resolutions))
+	for _, resolution := range resolutions {
+		// Normalise so "60s" and "1m" refer to the same bucket width
+		if duration, err := time.ParseDuration(strings.TrimSpace(resolution)); err == nil {
+			allowed[formatResolution(duration)] = true
+		}
+	}
+	return &UpstreamRollupForwarder{
+		queue:       queue,
+		resolutions: allowed,
+	}
+}
+
+// WriteRollups spools the selected rollups as a single upstream message.
+func (uf *UpstreamRollupForwarder) WriteRollups(rollups []Rollup) error {
+	batch := make([]Rollup, 0, len(rollups))
+	for _, rollup := range rollups {
+		if len(uf.resolutions) == 0 || uf.resolutions[rollup.Resolution] {
+			batch = append(batch, rollup)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return uf.queue.Enqueue("rollups", batch)
+}
@@ -0,0 +1,469 @@
+// server/src/modules/route_codecs.go
+
+package modules
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Envelope fields share their numbers and names across codecs; zero values are omitted.
+const (
+	fieldID            = 1
+	fieldCorrelationID = 2
+	fieldType          = 3
+	fieldPriority      = 4
+	fieldTimestamp     = 5
+	fieldContentType   = 6
+	fieldTTL           = 7
+	fieldPayload       = 8
+	fieldRequireAck    = 9
+	fieldTopic         = 10
+)
+
+var errTruncated = errors.New("truncated")
+
+// envelopeTimestamp returns the timestamp in Unix milliseconds, or 0 when unset.
+func envelopeTimestamp(envelope Envelope) int64 {
+	if envelope.Timestamp.IsZero() {
+		return 0
+	}
+	return envelope.Timestamp.UnixMilli()
+}
+
+// timestampFromMillis reverses envelopeTimestamp.
+func timestampFromMillis(millis int64) time.Time {
+	if millis == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(millis)
+}
+
+// encodeEnvelopeProtobuf encodes an envelope as the protobuf message in docs/framing_protocol.md.
+func encodeEnvelopeProtobuf(envelope Envelope) []byte {
+	buffer := make([]byte, 0, 48+len(envelope.ContentType)+len(envelope.Payload)+len(envelope.Topic))
+	buffer = appendProtoVarint(buffer, fieldID, envelope.ID)
+	buffer = appendProtoVarint(buffer, fieldCorrelationID, envelope.CorrelationID)
+	buffer = appendProtoVarint(buffer, fieldType, uint64(envelope.Type))
+	buffer = appendProtoVarint(buffer, fieldPriority, uint64(envelope.Priority))
+	buffer = appendProtoVarint(buffer, fieldTimestamp, uint64(envelopeTimestamp(envelope)))
+	buffer = appendProtoBytes(buffer, fieldContentType, []byte(envelope.ContentType))
+	buffer = appendProtoVarint(buffer, fieldTTL, uint64(envelope.TTL.Milliseconds()))
+	buffer = appendProtoBytes(buffer, fieldPayload, envelope.Payload)
+	if envelope.RequireAck {
+		buffer = appendProtoVarint(buffer, fieldRequireAck, 1)
+	}
+	buffer = appendProtoBytes(buffer, fieldTopic, []byte(envelope.Topic))
+	return buffer
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buffer, scratch[:binary.PutUvarint(scratch[:], value)]...)
+}
+
+func appendProtoVarint(buffer []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buffer
+	}
+	buffer = appendUvarint(buffer, uint64(field)<<3)
+	return appendUvarint(buffer, value)
+}
+
+func appendProtoBytes(buffer []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return buffer
+	}
+	buffer = appendUvarint(buffer, uint64(field)<<3|2)
+	buffer = appendUvarint(buffer, uint64(len(value)))
+	return append(buffer, value...)
+}
+
+// decodeEnvelopeProtobuf decodes a protobuf envelope, skipping fields it does not know.
+func decodeEnvelopeProtobuf(data []byte) (Envelope, error) {
+	envelope := Envelope{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return Envelope{}, errTruncated
+		}
+		data = data[n:]
+		field, wireType := key>>3, key&7
+
+		var value uint64
+		var bytes []byte
+		switch wireType {
+		case 0:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return Envelope{}, errTruncated
+			}
+			data = data[n:]
+		case 1, 5:
+			size := 8
+			if wireType == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return Envelope{}, errTruncated
+			}
+			data = data[size:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return Envelope{}, errTruncated
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		default:
+			return Envelope{}, fmt.Errorf("unsupported wire type %d", wireType)
+		}
+
+		switch {
+		case wireType == 0:
+			setEnvelopeNumber(&envelope, int(field), value)
+		case field == fieldContentType:
+			envelope.ContentType = string(bytes)
+		case field == fieldPayload:
+			envelope.Payload = append([]byte(nil), bytes...)
+		case field == fieldTopic:
+			envelope.Topic = string(bytes)
+		}
+	}
+	return envelope, nil
+}
+
+// setEnvelopeNumber sets a numeric envelope field; other field numbers are ignored.
+func setEnvelopeNumber(envelope *Envelope, field int, value uint64) {
+	switch field {
+	case fieldID:
+		envelope.ID = value
+	case fieldCorrelationID:
+		envelope.CorrelationID = value
+	case fieldType:
+		envelope.Type = MessageType(value)
+	case fieldPriority:
+		envelope.Priority = TrafficClass(value)
+	case fieldTimestamp:
+		envelope.Timestamp = timestampFromMillis(int64(value))
+	case fieldTTL:
+		envelope.TTL = time.Duration(value) * time.Millisecond
+	case fieldRequireAck:
+		envelope.RequireAck = value != 0
+	}
+}
+
+// cborKeys are the map keys of a CBOR envelope, indexed by field number.
+var cborKeys = [...]string{
+	fieldID:            "id",
+	fieldCorrelationID: "correlation_id",
+	fieldType:          "type",
+	fieldPriority:      "priority",
+	fieldTimestamp:     "timestamp",
+	fieldContentType:   "content_type",
+	fieldTTL:           "ttl",
+	fieldPayload:       "payload",
+	fieldRequireAck:    "require_ack",
+	fieldTopic:         "topic",
+}
+
+// CBOR major types used by envelopes.
+const (
+	cborUnsigned = 0
+	cborNegative = 1
+	cborBytes    = 2
+	cborText     = 3
+	cborArray    = 4
+	cborMap      = 5
+	cborTag      = 6
+	cborSimple   = 7
+
+	cborTrue = 21 // Simple value of true
+)
+
+// encodeEnvelopeCBOR encodes an envelope as a CBOR map with text keys.
+func encodeEnvelopeCBOR(envelope Envelope) []byte {
+	timestamp := envelopeTimestamp(envelope)
+	present := [...]bool{
+		fieldID:            envelope.ID != 0,
+		fieldCorrelationID: envelope.CorrelationID != 0,
+		fieldType:          envelope.Type != 0,
+		fieldPriority:      envelope.Priority != 0,
+		fieldTimestamp:     timestamp != 0,
+		fieldContentType:   envelope.ContentType != "",
+		fieldTTL:           envelope.TTL.Milliseconds() != 0,
+		fieldPayload:       len(envelope.Payload) != 0,
+		fieldRequireAck:    envelope.RequireAck,
+		fieldTopic:         envelope.Topic != "",
+	}
+	count := 0
+	for _, ok := range present {
+		if ok {
+			count++
+		}
+	}
+
+	buffer := make([]byte, 0, 96+len(envelope.ContentType)+len(envelope.Payload)+len(envelope.Topic))
+	buffer = appendCBORHead(buffer, cborMap, uint64(count))
+	for field := fieldID; field <= fieldTopic; field++ {
+		if !present[field] {
+			continue
+		}
+		buffer = appendCBORHead(buffer, cborText, uint64(len(cborKeys[field])))
+		buffer = append(buffer, cborKeys[field]...)
+		switch field {
+		case fieldID:
+			buffer = appendCBORHead(buffer, cborUnsigned, envelope.ID)
+		case fieldCorrelationID:
+			buffer = appendCBORHead(buffer, cborUnsigned, envelope.CorrelationID)
+		case fieldType:
+			buffer = appendCBORHead(buffer, cborUnsigned, uint64(envelope.Type))
+		case fieldPriority:
+			buffer = appendCBORHead(buffer, cborUnsigned, uint64(envelope.Priority))
+		case fieldTimestamp:
+			if timestamp < 0 {
+				buffer = appendCBORHead(buffer, cborNegative, uint64(-1-timestamp))
+			} else {
+				buffer = appendCBORHead(buffer, cborUnsigned, uint64(timestamp))
+			}
+		case fieldContentType:
+			buffer = appendCBORHead(buffer, cborText, uint64(len(envelope.ContentType)))
+			buffer = append(buffer, envelope.ContentType...)
+		case fieldTTL:
+			buffer = appendCBORHead(buffer, cborUnsigned, uint64(envelope.TTL.Milliseconds()))
+		case fieldPayload:
+			buffer = appendCBORHead(buffer, cborBytes, uint64(len(envelope.Payload)))
+			buffer = append(buffer, envelope.Payload...)
+		case fieldRequireAck:
+			buffer = appendCBORHead(buffer, cborSimple, cborTrue)
+		case fieldTopic:
+			buffer = appendCBORHead(buffer, cborText, uint64(len(envelope.Topic)))
+			buffer = append(buffer, envelope.Topic...)
+		}
+	}
+	return buffer
+}
+
+// appendCBORHead appends the initial byte of a data item and its argument in the shortest form.
+func appendCBORHead(buffer []byte, major byte, argument uint64) []byte {
+	major <<= 5
+	switch {
+	case argument < 24:
+		return append(buffer, major|byte(argument))
+	case argument <= math.MaxUint8:
+		return append(buffer, major|24, byte(argument))
+	case argument <= math.MaxUint16:
+		return append(buffer, major|25, byte(argument>>8), byte(argument))
+	case argument <= math.MaxUint32:
+		buffer = append(buffer, major|26)
+		return append(buffer, byte(argument>>24), byte(argument>>16), byte(argument>>8), byte(argument))
+	}
+	buffer = append(buffer, major|27)
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], argument)
+	return append(buffer, scratch[:]...)
+}
+
+// cborReader decodes the definite-length CBOR items used by envelopes.
+type cborReader struct {
+	data []byte
+}
+
+// head reads the initial byte and argument of the next data item.
+func (r *cborReader) head() (byte, uint64, error) {
+	if len(r.data) == 0 {
+		return 0, 0, errTruncated
+	}
+	major, info := r.data[0]>>5, r.data[0]&0x1F
+	r.data = r.data[1:]
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	size := 0
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported additional information %d", info)
+	}
+	if len(r.data) < size {
+		return 0, 0, errTruncated
+	}
+	argument := uint64(0)
+	for _, b := range r.data[:size] {
+		argument = argument<<8 | uint64(b)
+	}
+	r.data = r.data[size:]
+	return major, argument, nil
+}
+
+// content reads the bytes of a byte or text string of the given length.
+func (r *cborReader) content(length uint64) ([]byte, error) {
+	if uint64(len(r.data)) < length {
+		return nil, errTruncated
+	}
+	content := r.data[:length]
+	r.data = r.data[length:]
+	return content, nil
+}
+
+// skip discards the rest of a data item whose head has been read.
+func (r *cborReader) skip(major byte, argument uint64) error {
+	switch major {
+	case cborBytes, cborText:
+		_, err := r.content(argument)
+		return err
+	case cborArray, cborMap:
+		items := argument
+		if major == cborMap {
+			items *= 2
+		}
+		for ; items > 0; items-- {
+			nested, nestedArgument, err := r.head()
+			if err != nil {
+				return err
+			}
+			if err := r.skip(nested, nestedArgument); err != nil {
+				return err
+			}
+		}
+	case cborTag:
+		nested, nestedArgument, err := r.head()
+		if err != nil {
+			return err
+		}
+		return r.skip(nested, nestedArgument)
+	}
+	return nil
+}
+
+// decodeEnvelopeCBOR decodes a CBOR envelope, skipping keys it does not know.
+func decodeEnvelopeCBOR(data []byte) (Envelope, error) {
+	reader := &cborReader{data: data}
+	major, entries, err := reader.head()
+	if err != nil {
+		return Envelope{}, err
+	}
+	if major != cborMap {
+		return Envelope{}, fmt.Errorf("expected a map, found major type %d", major)
+	}
+
+	envelope := Envelope{}
+	for ; entries > 0; entries-- {
+		major, length, err := reader.head()
+		if err != nil {
+			return Envelope{}, err
+		}
+		if major != cborText {
+			return Envelope{}, fmt.Errorf("expected a text key, found major type %d", major)
+		}
+		key, err := reader.content(length)
+		if err != nil {
+			return Envelope{}, err
+		}
+		major, argument, err := reader.head()
+		if err != nil {
+			return Envelope{}, err
+		}
+
+		field := 0
+		for candidate := fieldID; candidate <= fieldTopic; candidate++ {
+			if cborKeys[candidate] == string(key) {
+				field = candidate
+			}
+		}
+		switch {
+		case field == 0:
+			if err := reader.skip(major, argument); err != nil {
+				return Envelope{}, err
+			}
+		case (field == fieldContentType || field == fieldTopic) && major == cborText:
+			content, err := reader.content(argument)
+			if err != nil {
+				return Envelope{}, err
+			}
+			if field == fieldTopic {
+				envelope.Topic = string(content)
+			} else {
+				envelope.ContentType = string(content)
+			}
+		case field == fieldPayload && major == cborBytes:
+			content, err := reader.content(argument)
+			if err != nil {
+				return Envelope{}, err
+			}
+			envelope.Payload = append([]byte(nil), content...)
+		case field == fieldRequireAck && major == cborSimple:
+			envelope.RequireAck = argument == cborTrue
+		case field == fieldTimestamp && major == cborNegative:
+			envelope.Timestamp = timestampFromMillis(-1 - int64(argument))
+		case field != fieldContentType && field != fieldPayload && field != fieldRequireAck && field != fieldTopic && major == cborUnsigned:
+			setEnvelopeNumber(&envelope, field, argument)
+		default:
+			return Envelope{}, fmt.Errorf("unexpected major type %d for %s", major, key)
+		}
+	}
+	if len(reader.data) != 0 {
+		return Envelope{}, fmt.Errorf("%d trailing bytes", len(reader.data))
+	}
+	return envelope, nil
+}
+
+// jsonEnvelope is the JSON form of an envelope. IDs are strings because JavaScript numbers cannot
+// hold every 64-bit value; the payload is base64.
+type jsonEnvelope struct {
+	ID            uint64 `json:"id,omitempty,string"`
+	CorrelationID uint64 `json:"correlation_id,omitempty,string"`
+	Type          uint8  `json:"type,omitempty"`
+	Priority      int    `json:"priority,omitempty"`
+	Timestamp     int64  `json:"timestamp,omitempty"` // Unix milliseconds
+	ContentType   string `json:"content_type,omitempty"`
+	TTL           int64  `json:"ttl,omitempty"` // Milliseconds
+	Payload       []byte `json:"payload,omitempty"`
+	RequireAck    bool   `json:"require_ack,omitempty"`
+	Topic         string `json:"topic,omitempty"`
+}
+
+func encodeEnvelopeJSON(envelope Envelope) ([]byte, error) {
+	return json.Marshal(jsonEnvelope{
+		ID:            envelope.ID,
+		CorrelationID: envelope.CorrelationID,
+		Type:          uint8(envelope.Type),
+		Priority:      int(envelope.Priority),
+		Timestamp:     envelopeTimestamp(envelope),
+		ContentType:   envelope.ContentType,
+		TTL:           envelope.TTL.Milliseconds(),
+		Payload:       envelope.Payload,
+		RequireAck:    envelope.RequireAck,
+		Topic:         envelope.Topic,
+	})
+}
+
+func decodeEnvelopeJSON(data []byte) (Envelope, error) {
+	var decoded jsonEnvelope
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{
+		ID:            decoded.ID,
+		CorrelationID: decoded.CorrelationID,
+		Type:          MessageType(decoded.Type),
+		Priority:      TrafficClass(decoded.Priority),
+		Timestamp:     timestampFromMillis(decoded.Timestamp),
+		ContentType:   decoded.ContentType,
+		TTL:           time.Duration(decoded.TTL) * time.Millisecond,
+		Payload:       decoded.Payload,
+		RequireAck:    decoded.RequireAck,
+		Topic:         decoded.Topic,
+	}, nil
+}
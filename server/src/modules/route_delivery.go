@@ -0,0 +1,445 @@
+// server/src/modules/route_delivery.go
+
+package modules
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+// ErrMessageExpired is reported for messages whose TTL passed before they were sent or acknowledged.
+var ErrMessageExpired = errors.New("message expired")
+
+// ErrDeliveryFailed is reported for messages that were not acknowledged within the allowed attempts.
+var ErrDeliveryFailed = errors.New("message not acknowledged")
+
+// DeliveryOptions controls acknowledged delivery and duplicate suppression on routes.
+type DeliveryOptions struct {
+	Backoff        utils.Backoff  // Wait for an ack before each retransmission; Initial is the first ack timeout
+	MaxAttempts    int            // Transmissions before giving up; 0 retries until the TTL expires
+	DefaultTTL     time.Duration  // TTL given to acknowledged messages that have none
+	PersistClasses []TrafficClass // Classes whose pending messages are kept in the outbox across restarts
+	DedupWindow    time.Duration  // How long received message IDs are remembered for duplicate suppression
+	DedupSize      int            // Received message IDs remembered per device
+}
+
+// DefaultDeliveryOptions returns the delivery options applied unless others are configured.
+func DefaultDeliveryOptions() DeliveryOptions {
+	return DeliveryOptions{
+		Backoff:        utils.Backoff{Initial: 2 * time.Second, Max: time.Minute, Multiplier: 2, Jitter: 0.1},
+		DefaultTTL:     5 * time.Minute,
+		PersistClasses: []TrafficClass{ClassCritical, ClassControl},
+		DedupWindow:    10 * time.Minute,
+		DedupSize:      4096,
+	}
+}
+
+// DeliveryResult reports the outcome of an acknowledged message.
+type DeliveryResult struct {
+	DeviceID  string
+	MessageID uint64
+	Attempts  int
+	Latency   time.Duration // From the message's timestamp to its ack
+	Err       error         // Nil once the message has been acknowledged
+}
+
+// pendingDelivery is a message awaiting its ack.
+type pendingDelivery struct {
+	deviceID  string
+	envelope  Envelope
+	attempts  int
+	nextSend  time.Time // When to transmit next
+	persisted bool
+	callback  func(DeliveryResult) // May be nil
+}
+
+// deliveryTracker holds unacknowledged messages and the IDs recently received from each device.
+type deliveryTracker struct {
+	mutex   sync.Mutex
+	options DeliveryOptions
+	pending map[uint64]*pendingDelivery
+	seen    map[string]*dedupWindow
+	outbox  *routeOutbox // Nil until an outbox is opened
+	wake    chan struct{}
+	started bool // Whether the retransmission loop is running
+}
+
+func newDeliveryTracker(options DeliveryOptions) *deliveryTracker {
+	return &deliveryTracker{
+		options: options,
+		pending: make(map[uint64]*pendingDelivery),
+		seen:    make(map[string]*dedupWindow),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// add tracks a message for retransmission, persisting it when its class requires. It reports
+// whether the retransmission loop needs starting.
+func (t *deliveryTracker) add(delivery *pendingDelivery) (bool, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.outbox != nil && t.persists(delivery.envelope.Priority) {
+		if err := t.outbox.add(delivery.deviceID, delivery.envelope); err != nil {
+			return false, err
+		}
+		delivery.persisted = true
+	}
+	t.pending[delivery.envelope.ID] = delivery
+	start := !t.started
+	t.started = true
+	t.notify()
+	return start, nil
+}
+
+func (t *deliveryTracker) persists(class TrafficClass) bool {
+	for _, persisted := range t.options.PersistClasses {
+		if persisted == class {
+			return true
+		}
+	}
+	return false
+}
+
+// deliveryOutcome is a finished delivery whose result is still to be reported.
+type deliveryOutcome struct {
+	callback func(DeliveryResult)
+	result   DeliveryResult
+}
+
+// outcome builds the result of a finished delivery.
+func (d *pendingDelivery) outcome(now time.Time, err error) deliveryOutcome {
+	return deliveryOutcome{callback: d.callback, result: DeliveryResult{
+		DeviceID:  d.deviceID,
+		MessageID: d.envelope.ID,
+		Attempts:  d.attempts,
+		Latency:   now.Sub(d.envelope.Timestamp),
+		Err:       err,
+	}}
+}
+
+// due removes expired and exhausted messages and returns their outcomes, with the messages due for
+// transmission and the time of the next one.
+func (t *deliveryTracker) due(now time.Time) ([]pendingDelivery, []deliveryOutcome, time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	send := make([]pendingDelivery, 0)
+	finished := make([]deliveryOutcome, 0)
+	var next time.Time
+	for id, delivery := range t.pending {
+		var err error
+		switch {
+		case delivery.envelope.Expired(now):
+			err = ErrMessageExpired
+		case t.options.MaxAttempts > 0 && delivery.attempts >= t.options.MaxAttempts && !now.Before(delivery.nextSend):
+			err = ErrDeliveryFailed
+		}
+		if err != nil {
+			t.remove(id, delivery)
+			finished = append(finished, delivery.outcome(now, err))
+			continue
+		}
+		if !now.Before(delivery.nextSend) {
+			send = append(send, *delivery)
+		} else if next.IsZero() || delivery.nextSend.Before(next) {
+			next = delivery.nextSend
+		}
+	}
+	return send, finished, next
+}
+
+// sent schedules the retransmission of a message that has been queued on its route.
+func (t *deliveryTracker) sent(id uint64, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if delivery, exists := t.pending[id]; exists {
+		delivery.nextSend = now.Add(t.options.Backoff.Duration(delivery.attempts))
+		delivery.attempts++
+	}
+}
+
+// postpone delays a message that could not be queued, without counting an attempt.
+func (t *deliveryTracker) postpone(id uint64, until time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if delivery, exists := t.pending[id]; exists {
+		delivery.nextSend = until
+	}
+}
+
+// routeAdded makes a device's pending messages due now that it has a route.
+func (t *deliveryTracker) routeAdded(deviceID string, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, delivery := range t.pending {
+		if delivery.deviceID == deviceID {
+			delivery.nextSend = now
+		}
+	}
+	t.notify()
+}
+
+// ack completes a message acknowledged by the device it was sent to.
+func (t *deliveryTracker) ack(deviceID string, id uint64, now time.Time) (deliveryOutcome, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delivery, exists := t.pending[id]
+	if !exists || delivery.deviceID != deviceID {
+		return deliveryOutcome{}, false
+	}
+	t.remove(id, delivery)
+	return delivery.outcome(now, nil), true
+}
+
+// remove forgets a message; the caller must hold the mutex.
+func (t *deliveryTracker) remove(id uint64, delivery *pendingDelivery) {
+	delete(t.pending, id)
+	if delivery.persisted && t.outbox != nil {
+		t.outbox.done(id)
+	}
+}
+
+// firstReceipt records a message ID received from a device and reports whether it is new.
+func (t *deliveryTracker) firstReceipt(deviceID string, id uint64, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	window, exists := t.seen[deviceID]
+	if !exists {
+		window = &dedupWindow{ids: make(map[uint64]time.Time)}
+		t.seen[deviceID] = window
+	}
+	return window.record(id, now, t.options.DedupWindow, t.options.DedupSize)
+}
+
+// setOptions replaces the delivery options.
+func (t *deliveryTracker) setOptions(options DeliveryOptions) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.options = options
+}
+
+// defaultTTL returns the TTL given to messages without one.
+func (t *deliveryTracker) defaultTTL() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.options.DefaultTTL
+}
+
+// retryPause returns how long to wait before retrying a message that could not be queued.
+func (t *deliveryTracker) retryPause() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.options.Backoff.Initial
+}
+
+// useOutbox persists messages through outbox from now on and tracks the messages it recovered.
+// It reports whether the retransmission loop needs starting.
+func (t *deliveryTracker) useOutbox(outbox *routeOutbox, recovered []*pendingDelivery) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.outbox = outbox
+	for _, delivery := range recovered {
+		t.pending[delivery.envelope.ID] = delivery
+	}
+	start := !t.started
+	t.started = true
+	t.notify()
+	return start
+}
+
+// closeOutbox stops persisting messages and closes the outbox.
+func (t *deliveryTracker) closeOutbox() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.outbox == nil {
+		return nil
+	}
+	err := t.outbox.close()
+	t.outbox = nil
+	return err
+}
+
+// count returns the number of unacknowledged messages.
+func (t *deliveryTracker) count() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.pending)
+}
+
+func (t *deliveryTracker) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dedupWindow remembers recently received message IDs, oldest first.
+type dedupWindow struct {
+	ids   map[uint64]time.Time
+	order []uint64
+}
+
+// record adds id unless it is already remembered, evicting IDs older than maxAge or beyond maxSize.
+// A limit of 0 disables that bound.
+func (w *dedupWindow) record(id uint64, now time.Time, maxAge time.Duration, maxSize int) bool {
+	for len(w.order) > 0 {
+		oldest := w.order[0]
+		full := maxSize > 0 && len(w.order) >= maxSize
+		stale := maxAge > 0 && now.Sub(w.ids[oldest]) >= maxAge
+		if !full && !stale {
+			break
+		}
+		delete(w.ids, oldest)
+		w.order = w.order[1:]
+	}
+	if _, exists := w.ids[id]; exists {
+		return false
+	}
+	w.ids[id] = now
+	w.order = append(w.order, id)
+	return true
+}
+
+// outboxRecord is an entry in the outbox log: a message to deliver, or the completion of one.
+type outboxRecord struct {
+	Op       string `json:"op"` // "add" or "done"
+	ID       uint64 `json:"id"`
+	DeviceID string `json:"device_id,omitempty"`
+	Envelope []byte `json:"envelope,omitempty"` // Protobuf-encoded envelope
+}
+
+// routeOutbox persists unacknowledged messages in an append-only log, using the record format of
+// the outbound queue. The log is compacted when opened and whenever completions dominate it.
+type routeOutbox struct {
+	path    string
+	file    *os.File
+	live    map[uint64]outboxRecord
+	records int // Records in the log, live or not
+	logger  *log.Logger
+}
+
+// openRouteOutbox opens or creates the outbox at path and returns it with the messages still pending.
+func openRouteOutbox(path string, logger *log.Logger) (*routeOutbox, []outboxRecord, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, nil, fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+	outbox := &routeOutbox{path: path, live: make(map[uint64]outboxRecord), logger: logger}
+
+	if file, err := os.Open(path); err == nil {
+		var offset int64
+		for {
+			data, err := readQueueRecord(file, offset)
+			if err != nil {
+				break // End of the log, or a torn record that compaction drops
+			}
+			offset += int64(queueRecordHeaderLen + len(data))
+			var record outboxRecord
+			if json.Unmarshal(data, &record) != nil {
+				continue
+			}
+			if record.Op == "add" {
+				outbox.live[record.ID] = record
+			} else {
+				delete(outbox.live, record.ID)
+			}
+		}
+		file.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+
+	if err := outbox.compact(); err != nil {
+		return nil, nil, err
+	}
+	pending := make([]outboxRecord, 0, len(outbox.live))
+	for _, record := range outbox.live {
+		pending = append(pending, record)
+	}
+	return outbox, pending, nil
+}
+
+// add durably records a pending message.
+func (o *routeOutbox) add(deviceID string, envelope Envelope) error {
+	record := outboxRecord{Op: "add", ID: envelope.ID, DeviceID: deviceID, Envelope: encodeEnvelopeProtobuf(envelope)}
+	if err := o.append(record, true); err != nil {
+		return err
+	}
+	o.live[envelope.ID] = record
+	return nil
+}
+
+// done records that a message no longer needs delivering. It is not synced: after a crash the
+// message is at worst delivered again, which receivers suppress as a duplicate.
+func (o *routeOutbox) done(id uint64) {
+	delete(o.live, id)
+	if err := o.append(outboxRecord{Op: "done", ID: id}, false); err != nil {
+		o.logger.Printf("Failed to record delivery in outbox: %v\n", err)
+	}
+	if o.records > 1024 && o.records > 4*len(o.live) {
+		if err := o.compact(); err != nil {
+			o.logger.Printf("Failed to compact outbox: %v\n", err)
+		}
+	}
+}
+
+func (o *routeOutbox) append(record outboxRecord, sync bool) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, queueRecordHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(data))
+	if _, err := o.file.Write(append(header, data...)); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	o.records++
+	if sync {
+		if err := o.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync outbox: %w", err)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the log with only the live messages and reopens it for appending.
+func (o *routeOutbox) compact() error {
+	tmpPath := o.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	if o.file != nil {
+		o.file.Close()
+	}
+	o.file = file
+	o.records = 0
+	for _, record := range o.live {
+		if err := o.append(record, false); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync outbox: %w", err)
+	}
+	if err := os.Rename(tmpPath, o.path); err != nil {
+		return fmt.Errorf("failed to compact outbox: %w", err)
+	}
+	return nil
+}
+
+// close closes the log file.
+func (o *routeOutbox) close() error {
+	return o.file.Close()
+}
@@ -0,0 +1,266 @@
+// server/src/modules/route_delivery_test.go
+
+package modules
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"server/utils"
+)
+
+// newTestRoutingManager creates a routing manager with an outbox at path and retransmissions quick
+// enough for tests.
+func newTestRoutingManager(t *testing.T, path string) *RoutingManager {
+	t.Helper()
+	rm := NewRoutingManager(log.New(io.Discard, "", 0), nil)
+	options := DefaultDeliveryOptions()
+	options.Backoff = utils.Backoff{Initial: 20 * time.Millisecond, Max: 100 * time.Millisecond, Multiplier: 2}
+	rm.SetDeliveryOptions(options)
+	if err := rm.OpenOutbox(path); err != nil {
+		t.Fatal(err)
+	}
+	return rm
+}
+
+// connectTestDevice adds a route for deviceID, bypassing the DESS check, and returns the device's end.
+func connectTestDevice(t *testing.T, rm *RoutingManager, deviceID string) net.Conn {
+	t.Helper()
+	server, device := net.Pipe()
+	t.Cleanup(func() { device.Close() })
+	rm.routeMutex.Lock()
+	rm.addRoute(deviceID, server, 1)
+	rm.routeMutex.Unlock()
+	return device
+}
+
+// receiveTestEnvelopes reads the messages a device receives, skipping heartbeats and acks, and
+// acknowledges those that require it when ack is set.
+func receiveTestEnvelopes(device net.Conn, ack bool) <-chan Envelope {
+	received := make(chan Envelope, 100)
+	go func() {
+		defer close(received)
+		reader := NewFrameReader(device)
+		for {
+			envelope, _, err := reader.ReadEnvelope()
+			if err != nil {
+				return
+			}
+			if envelope.Type == MessagePing || envelope.Type == MessageAck {
+				continue
+			}
+			if ack && envelope.RequireAck {
+				frame, _ := EncodeFrame(Envelope{ID: envelope.ID + 1, CorrelationID: envelope.ID, Type: MessageAck}, CodecProtobuf)
+				device.Write(frame)
+			}
+			received <- envelope
+		}
+	}()
+	return received
+}
+
+func TestOutboxRedeliversAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	rm := newTestRoutingManager(t, path)
+	first, err := rm.DeliverCommand("valve7", "text/plain", []byte("open"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := rm.DeliverCommand("valve7", "text/plain", []byte("close"), nil)
+	rm.DeliverEnvelope("valve7", Envelope{Type: MessageData, Priority: ClassTelemetry, Payload: []byte("not persisted")}, nil)
+	if rm.PendingDeliveries() != 3 {
+		t.Fatalf("%d messages pending before the restart", rm.PendingDeliveries())
+	}
+	if err := rm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the classes configured as persistent survive, with their IDs, so devices can suppress repeats
+	rm = newTestRoutingManager(t, path)
+	defer rm.Close()
+	if rm.PendingDeliveries() != 2 {
+		t.Fatalf("%d messages recovered, want the 2 commands", rm.PendingDeliveries())
+	}
+	received := receiveTestEnvelopes(connectTestDevice(t, rm, "valve7"), true)
+	payloads := make(map[uint64]string)
+	for len(payloads) < 2 {
+		select {
+		case envelope := <-received:
+			payloads[envelope.ID] = string(envelope.Payload)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("redelivered %v", payloads)
+		}
+	}
+	if payloads[first] != "open" || payloads[second] != "close" {
+		t.Fatalf("redelivered %v", payloads)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for rm.PendingDeliveries() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d messages still pending after their acks", rm.PendingDeliveries())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Acknowledged messages are not recovered again
+	rm.Close()
+	_, records, err := openRouteOutbox(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("%d acknowledged messages left in the outbox", len(records))
+	}
+}
+
+func TestDuplicateMessagesDeliveredOnce(t *testing.T) {
+	rm := newTestRoutingManager(t, filepath.Join(t.TempDir(), "outbox.log"))
+	defer rm.Close()
+	var mutex sync.Mutex
+	handled := 0
+	rm.SetInboundHandler(func(string, Envelope) {
+		mutex.Lock()
+		handled++
+		mutex.Unlock()
+	})
+	device := connectTestDevice(t, rm, "press4")
+	acks := make(chan uint64, 10)
+	go func() {
+		reader := NewFrameReader(device)
+		for {
+			envelope, _, err := reader.ReadEnvelope()
+			if err != nil {
+				return
+			}
+			if envelope.Type == MessageAck {
+				acks <- envelope.CorrelationID
+			}
+		}
+	}()
+
+	frame, _ := EncodeFrame(Envelope{ID: 99, Type: MessageData, RequireAck: true, Payload: []byte("21.5")}, CodecCBOR)
+	for i := 0; i < 3; i++ {
+		device.Write(frame)
+		select {
+		case id := <-acks:
+			if id != 99 {
+				t.Fatalf("ack for %d", id)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("copy %d not acknowledged", i+1)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if handled != 1 {
+		t.Fatalf("message handled %d times", handled)
+	}
+}
+
+func TestDedupWindowBounds(t *testing.T) {
+	window := &dedupWindow{ids: make(map[uint64]time.Time)}
+	start := time.Now()
+	if !window.record(1, start, time.Minute, 3) || window.record(1, start.Add(time.Second), time.Minute, 3) {
+		t.Fatal("repeat of a remembered ID not suppressed")
+	}
+	// IDs are forgotten once older than the window
+	if !window.record(1, start.Add(time.Minute), time.Minute, 3) {
+		t.Fatal("ID remembered beyond the window")
+	}
+	// and the oldest once the size limit is reached
+	for id := uint64(2); id <= 4; id++ {
+		window.record(id, start.Add(time.Minute), time.Minute, 3)
+	}
+	if !window.record(1, start.Add(time.Minute), time.Minute, 3) || window.record(4, start.Add(time.Minute), time.Minute, 3) {
+		t.Fatal("size limit did not evict the oldest ID")
+	}
+}
+
+func TestDeliveryExpiresOrRunsOutOfAttempts(t *testing.T) {
+	outbox, _, err := openRouteOutbox(filepath.Join(t.TempDir(), "outbox.log"), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.close()
+	options := DefaultDeliveryOptions()
+	options.MaxAttempts = 2
+	options.Backoff = utils.Backoff{Initial: time.Second, Max: time.Second}
+	tracker := newDeliveryTracker(options)
+	tracker.useOutbox(outbox, nil)
+
+	now := time.Now()
+	tracker.add(&pendingDelivery{deviceID: "valve7", envelope: Envelope{ID: 1, Priority: ClassControl, Timestamp: now, TTL: time.Minute}})
+	tracker.add(&pendingDelivery{deviceID: "valve7", envelope: Envelope{ID: 2, Priority: ClassControl, Timestamp: now, TTL: time.Hour}})
+	for attempt := 0; attempt < 2; attempt++ {
+		at := now.Add(time.Duration(attempt) * time.Second)
+		send, _, _ := tracker.due(at)
+		if len(send) != 2 {
+			t.Fatalf("%d messages due for attempt %d", len(send), attempt+1)
+		}
+		for _, delivery := range send {
+			tracker.sent(delivery.envelope.ID, at)
+		}
+	}
+
+	_, finished, _ := tracker.due(now.Add(2 * time.Minute))
+	results := make(map[uint64]error)
+	for _, outcome := range finished {
+		results[outcome.result.MessageID] = outcome.result.Err
+	}
+	if !errors.Is(results[1], ErrMessageExpired) || !errors.Is(results[2], ErrDeliveryFailed) {
+		t.Fatalf("outcomes %v, want message 1 expired and 2 out of attempts", results)
+	}
+	if tracker.count() != 0 || len(outbox.live) != 0 {
+		t.Fatal("finished messages still pending")
+	}
+}
+
+func TestRouteOutboxCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.log")
+	outbox, _, err := openRouteOutbox(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := uint64(1); id <= 1200; id++ {
+		if err := outbox.add("valve7", Envelope{ID: id, Type: MessageCommand, Payload: []byte("open")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := uint64(1); id <= 1190; id++ {
+		outbox.done(id)
+	}
+	// Compaction runs once completions outnumber live messages four to one past 1024 records
+	if outbox.records >= 1200 {
+		t.Fatalf("log holds %d records for %d live messages", outbox.records, len(outbox.live))
+	}
+	outbox.close()
+
+	// A torn record at the end, as a crash mid-write leaves, is dropped when the log is reopened
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{200, 0, 0, 0, 1, 2})
+	file.Close()
+
+	outbox, records, err := openRouteOutbox(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.close()
+	if len(records) != 10 || outbox.records != 10 {
+		t.Fatalf("reopened with %d pending messages and %d records, want 10", len(records), outbox.records)
+	}
+	for _, record := range records {
+		if record.ID <= 1190 || record.DeviceID != "valve7" {
+			t.Fatalf("recovered %+v", record)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// server/src/modules/route_dialer.go
+
+package modules
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// CircuitState is the state of a static route's circuit breaker.
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // Dials follow the backoff schedule
+	CircuitOpen                         // Too many failures; no dials until the cooldown has passed
+	CircuitHalfOpen                     // The cooldown has passed; one trial dial decides
+)
+
+// String returns the name of the state.
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("circuit(%d)", int(s))
+}
+
+// MarshalText encodes the state by name in JSON.
+func (s CircuitState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// TLSDialFunc connects to address over TLS, verifying that the peer's certificate is for serverName or,
+// when it is empty, for the host of address.
+type TLSDialFunc func(ctx context.Context, address, serverName string) (net.Conn, error)
+
+// ErrCircuitOpen is returned for messages to a static route whose circuit breaker is open.
+var ErrCircuitOpen = errors.New("route circuit open")
+
+// ErrRouteBufferFull is returned for messages to a reconnecting static route whose buffer is full.
+var ErrRouteBufferFull = errors.New("route reconnect buffer full")
+
+// staticRouteStableAfter is how long a static route must stay connected before its failures are
+// forgotten. Connections lost sooner count as failed attempts, so a flapping peer backs off too.
+const staticRouteStableAfter = 30 * time.Second
+
+// bufferedEnvelope is a message held for a static route while it reconnects.
+type bufferedEnvelope struct {
+	deviceID string
+	envelope Envelope
+	callback func(SendResult)
+}
+
+// SetTLSDialer sets the function tls routes and mqtt routes with tls connect with, usually
+// SecurityGateway.DialTLS. Without one, peers are verified against the system roots and no client
+// certificate is presented.
+func (rm *RoutingManager) SetTLSDialer(dial TLSDialFunc) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.dialTLS = dial
+}
+
+// dialRoute connects to a static route's destination over its transport, within the route's timeout.
+func (rm *RoutingManager) dialRoute(route *staticRoute) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), route.timeout)
+	defer cancel()
+	config := route.config
+	var dialer net.Dialer
+	var conn net.Conn
+	var err error
+	switch {
+	case config.Transport == TransportUnix:
+		conn, err = dialer.DialContext(ctx, "unix", config.Address)
+	case config.Transport == TransportTLS, config.Transport == TransportMQTT && route.mqttTLS:
+		conn, err = rm.dialRouteTLS(ctx, config.Address, config.ServerName)
+	default:
+		conn, err = dialer.DialContext(ctx, "tcp", config.Address)
+	}
+	if err != nil || config.Transport != TransportMQTT {
+		return conn, err
+	}
+	return openMQTTRoute(conn, route.mqtt)
+}
+
+// dialRouteTLS connects over TLS with the TLS dialer, or with the system roots without one.
+func (rm *RoutingManager) dialRouteTLS(ctx context.Context, address, serverName string) (net.Conn, error) {
+	rm.routeMutex.RLock()
+	dial := rm.dialTLS
+	rm.routeMutex.RUnlock()
+	if dial != nil {
+		return dial(ctx, address, serverName)
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// staticRouteFailed records a failed dial or a connection lost before it was stable, and schedules
+// the next dial: after the backoff delay, or after the cooldown once the failures open the circuit. A
+// route that reaches its MaxAttempts is given up, and its buffered messages are returned for the
+// caller to fail once it has released the table's mutex, which the caller must hold.
+func (rm *RoutingManager) staticRouteFailed(route *staticRoute, now time.Time, reason string) []bufferedEnvelope {
+	deviceID := route.config.DeviceID
+	route.attempts++
+	route.lastError = reason
+	if route.gaveUp() {
+		rm.logger.Printf("Giving up on static route for device %s after %d attempts\n", deviceID, route.attempts)
+		discarded := route.buffer
+		route.buffer = nil
+		return discarded
+	}
+	if route.breakerThreshold > 0 && (route.circuit == CircuitHalfOpen || route.attempts >= route.breakerThreshold) {
+		route.circuit = CircuitOpen
+		route.nextDial = now.Add(route.cooldown)
+		rm.logger.Printf("Circuit of static route for device %s open after %d failures; next dial in %s\n", deviceID, route.attempts, route.cooldown)
+		return nil
+	}
+	route.nextDial = now.Add(route.backoff.Duration(route.attempts - 1))
+	return nil
+}
+
+// bufferForStaticRoute holds a message for a static route that is reconnecting, and reports whether
+// the device has such a route. Messages are refused while the route's circuit is open or its buffer is
+// full; a route that connected since the caller looked gets the message directly.
+func (rm *RoutingManager) bufferForStaticRoute(table *routeTable, deviceID string, envelope Envelope, callback func(SendResult)) (bool, error) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	route := table.routes[deviceID]
+	if route == nil || route.retired || route.gaveUp() || route.bufferSize < 0 {
+		return false, nil
+	}
+	rm.routeMutex.RLock()
+	queue, exists := rm.queues[deviceID]
+	rm.routeMutex.RUnlock()
+	switch {
+	case exists:
+		return true, queue.enqueue(envelope, callback)
+	case route.circuit == CircuitOpen:
+		return true, fmt.Errorf("%w: %s", ErrCircuitOpen, deviceID)
+	case len(route.buffer) >= route.bufferSize:
+		return true, fmt.Errorf("%w: %s", ErrRouteBufferFull, deviceID)
+	}
+	route.buffer = append(route.buffer, bufferedEnvelope{deviceID: deviceID, envelope: envelope, callback: callback})
+	return true, nil
+}
+
+// routeGrants caches the subscriptions AccessControl allows a static route's device, until the rules
+// change.
+type routeGrants struct {
+	access   *AccessControl // AccessControl the grants were resolved by; nil allows all
+	version  uint64         // AccessControl.RulesVersion the grants were resolved at
+	resolved bool           // Whether the grants were resolved yet
+	filters  []routeGrant   // Allowed filters among the route's topics
+}
+
+// routeGrant is a topic filter a static route may receive, less the narrower filters it may not.
+type routeGrant struct {
+	filter   string
+	excluded []string
+}
+
+// authorizeStaticRoutes resolves the subscriptions of static routes; the caller must hold the table's
+// mutex or own the routes.
+func (rm *RoutingManager) authorizeStaticRoutes(routes map[string]*staticRoute) {
+	rm.routeMutex.RLock()
+	access := rm.access
+	rm.routeMutex.RUnlock()
+	for _, route := range routes {
+		route.authorize(access)
+	}
+}
+
+// authorize returns the filters the route's device may receive, resolving them again if the access
+// rules changed since they were last resolved; the caller must hold the table's mutex.
+func (route *staticRoute) authorize(access *AccessControl) []routeGrant {
+	var version uint64
+	if access != nil {
+		version = access.RulesVersion()
+	}
+	if route.grants.resolved && route.grants.access == access && route.grants.version == version {
+		return route.grants.filters
+	}
+	route.grants = routeGrants{access: access, version: version, resolved: true}
+	for _, filter := range route.config.Topics {
+		grant := routeGrant{filter: filter}
+		if access != nil {
+			var ok bool
+			if grant.excluded, ok = access.AuthorizeSubscription(route.config.DeviceID, filter); !ok {
+				continue
+			}
+		}
+		route.grants.filters = append(route.grants.filters, grant)
+	}
+	return route.grants.filters
+}
+
+// staticSubscribers returns the devices, other than those already subscribed, whose static routes are
+// reconnecting, buffer messages and declare a topic filter matching topic.
+func (rm *RoutingManager) staticSubscribers(topic string, subscribed []string) []string {
+	rm.routeMutex.RLock()
+	table, access := rm.table, rm.access
+	rm.routeMutex.RUnlock()
+	if table == nil {
+		return nil
+	}
+	skip := make(map[string]bool, len(subscribed))
+	for _, deviceID := range subscribed {
+		skip[deviceID] = true
+	}
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var devices []string
+	for deviceID, route := range table.routes {
+		if skip[deviceID] || route.conn != nil || route.gaveUp() || route.bufferSize < 0 {
+			continue
+		}
+		for _, grant := range route.authorize(access) {
+			if TopicMatches(grant.filter, topic) && !topicExcluded(grant.excluded, topic) {
+				devices = append(devices, deviceID)
+				break
+			}
+		}
+	}
+	return devices
+}
+
+// flushStaticRoute queues a static route's buffered messages, in order, on the route just added for it.
+// Messages that expired meanwhile, or that its queue refuses, are returned for the caller to fail once
+// it has released the locks. The caller must hold the table's mutex and the write lock.
+func (rm *RoutingManager) flushStaticRoute(route *staticRoute, now time.Time) (expired, refused []bufferedEnvelope) {
+	queue := rm.queues[route.config.DeviceID]
+	for _, buffered := range route.buffer {
+		if buffered.envelope.Expired(now) {
+			expired = append(expired, buffered)
+			continue
+		}
+		if err := queue.enqueue(buffered.envelope, buffered.callback); err != nil {
+			refused = append(refused, buffered)
+		}
+	}
+	if flushed := len(route.buffer) - len(expired) - len(refused); flushed > 0 {
+		rm.logger.Printf("Sent %d messages buffered for device %s while it was disconnected\n", flushed, route.config.DeviceID)
+	}
+	route.buffer = nil
+	return expired, refused
+}
+
+// failBuffered reports buffered messages that will not be sent to their callbacks.
+func failBuffered(messages []bufferedEnvelope, err error) {
+	for _, buffered := range messages {
+		if buffered.callback != nil {
+			buffered.callback(SendResult{DeviceID: buffered.deviceID, MessageID: buffered.envelope.ID, Class: buffered.envelope.Priority, Err: err})
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// server/src/modules/route_framing.go
+
+package modules
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A frame is a 4-byte big-endian length followed by that many bytes: the protocol version, the codec
+// of the envelope and the encoded envelope. See docs/framing_protocol.md for the full specification.
+const (
+	FrameVersion    = 1       // Version written by this server
+	MaxFrameSize    = 1 << 20 // Largest frame accepted, excluding the length prefix
+	frameHeaderSize = 2       // Version and codec bytes
+)
+
+// ErrFrameTooLarge is returned for frames longer than MaxFrameSize.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// ErrMalformedFrame is returned for frames that cannot be decoded.
+var ErrMalformedFrame = errors.New("malformed frame")
+
+// MessageType is the kind of message an envelope carries.
+type MessageType uint8
+
+const (
+	MessageData    MessageType = 1 // Application data such as telemetry
+	MessageCommand MessageType = 2 // A command for an actuator or device
+	MessageAck     MessageType = 3 // Acknowledges the message named by CorrelationID
+	MessagePing    MessageType = 4 // Heartbeat request
+	MessagePong    MessageType = 5 // Heartbeat answer; CorrelationID names the ping
+
+	MessageSubscribe   MessageType = 6 // Subscribes the sender to the topic filter in the payload
+	MessageUnsubscribe MessageType = 7 // Cancels the subscription to the topic filter in the payload
+)
+
+// String returns the name of the message type.
+func (t MessageType) String() string {
+	switch t {
+	case MessageData:
+		return "data"
+	case MessageCommand:
+		return "command"
+	case MessageAck:
+		return "ack"
+	case MessagePing:
+		return "ping"
+	case MessagePong:
+		return "pong"
+	case MessageSubscribe:
+		return "subscribe"
+	case MessageUnsubscribe:
+		return "unsubscribe"
+	}
+	return fmt.Sprintf("type(%d)", int(t))
+}
+
+// FrameCodec is the encoding of the envelope inside a frame.
+type FrameCodec uint8
+
+const (
+	CodecProtobuf FrameCodec = 1
+	CodecCBOR     FrameCodec = 2
+	CodecJSON     FrameCodec = 3
+)
+
+// String returns the name of the codec.
+func (c FrameCodec) String() string {
+	switch c {
+	case CodecProtobuf:
+		return "protobuf"
+	case CodecCBOR:
+		return "cbor"
+	case CodecJSON:
+		return "json"
+	}
+	return fmt.Sprintf("codec(%d)", int(c))
+}
+
+// ParseFrameCodec parses a codec name as used in configuration.
+func ParseFrameCodec(name string) (FrameCodec, error) {
+	for _, codec := range []FrameCodec{CodecProtobuf, CodecCBOR, CodecJSON} {
+		if strings.EqualFold(name, codec.String()) {
+			return codec, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown frame codec %q (use protobuf, cbor or json)", name)
+}
+
+// Envelope is a message with its routing header.
+type Envelope struct {
+	ID            uint64        // Unique per sender; 0 is reserved
+	CorrelationID uint64        // ID of the message this one answers
+	Type          MessageType   // Kind of message
+	Priority      TrafficClass  // Traffic class the message is queued in
+	Timestamp     time.Time     // Creation time, carried with millisecond precision
+	ContentType   string        // MIME type of the payload
+	TTL           time.Duration // Lifetime after Timestamp, carried in milliseconds; 0 never expires
+	Payload       []byte
+	RequireAck    bool   // Whether the receiver must acknowledge the message
+	Topic         string // Topic the message was published to; empty for messages sent to one device
+}
+
+// Expired reports whether the envelope's TTL has passed at now.
+func (e Envelope) Expired(now time.Time) bool {
+	return e.TTL > 0 && !e.Timestamp.IsZero() && now.After(e.Timestamp.Add(e.TTL))
+}
+
+// EncodeFrame encodes an envelope as a complete frame, length prefix included.
+func EncodeFrame(envelope Envelope, codec FrameCodec) ([]byte, error) {
+	var body []byte
+	switch codec {
+	case CodecProtobuf:
+		body = encodeEnvelopeProtobuf(envelope)
+	case CodecCBOR:
+		body = encodeEnvelopeCBOR(envelope)
+	case CodecJSON:
+		var err error
+		if body, err = encodeEnvelopeJSON(envelope); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown frame codec %d", int(codec))
+	}
+	if frameHeaderSize+len(body) > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame := make([]byte, 4+frameHeaderSize, 4+frameHeaderSize+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(frameHeaderSize+len(body)))
+	frame[4] = FrameVersion
+	frame[5] = byte(codec)
+	return append(frame, body...), nil
+}
+
+// DecodeFrame decodes a complete frame, length prefix included, as produced by EncodeFrame.
+func DecodeFrame(frame []byte) (Envelope, FrameCodec, error) {
+	if len(frame) < 4 {
+		return Envelope{}, 0, fmt.Errorf("%w: %d bytes", ErrMalformedFrame, len(frame))
+	}
+	length := binary.BigEndian.Uint32(frame)
+	if length > MaxFrameSize {
+		return Envelope{}, 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+	if int(length) != len(frame)-4 {
+		return Envelope{}, 0, fmt.Errorf("%w: length prefix of %d bytes for %d", ErrMalformedFrame, length, len(frame)-4)
+	}
+	return decodeFrameBody(frame[4:])
+}
+
+// decodeFrameBody decodes the bytes of a frame that follow its length prefix.
+func decodeFrameBody(frame []byte) (Envelope, FrameCodec, error) {
+	if len(frame) < frameHeaderSize {
+		return Envelope{}, 0, fmt.Errorf("%w: %d bytes", ErrMalformedFrame, len(frame))
+	}
+	if frame[0] != FrameVersion {
+		return Envelope{}, 0, fmt.Errorf("%w: unsupported version %d", ErrMalformedFrame, frame[0])
+	}
+	codec := FrameCodec(frame[1])
+	body := frame[frameHeaderSize:]
+
+	var envelope Envelope
+	var err error
+	switch codec {
+	case CodecProtobuf:
+		envelope, err = decodeEnvelopeProtobuf(body)
+	case CodecCBOR:
+		envelope, err = decodeEnvelopeCBOR(body)
+	case CodecJSON:
+		envelope, err = decodeEnvelopeJSON(body)
+	default:
+		return Envelope{}, 0, fmt.Errorf("%w: unknown codec %d", ErrMalformedFrame, frame[1])
+	}
+	if err != nil {
+		return Envelope{}, 0, fmt.Errorf("%w: %s: %v", ErrMalformedFrame, codec, err)
+	}
+	return envelope, codec, nil
+}
+
+// FrameReader reads frames from a stream. It is the reference decoder for the protocol.
+type FrameReader struct {
+	reader *bufio.Reader
+}
+
+// NewFrameReader creates a FrameReader reading from r.
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{reader: bufio.NewReader(r)}
+}
+
+// ReadEnvelope reads the next frame and decodes its envelope. Errors other than those from the
+// underlying reader wrap ErrMalformedFrame or ErrFrameTooLarge; the stream cannot be resynchronised
+// after them.
+func (fr *FrameReader) ReadEnvelope() (Envelope, FrameCodec, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(fr.reader, prefix[:]); err != nil {
+		return Envelope{}, 0, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length > MaxFrameSize {
+		return Envelope{}, 0, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(fr.reader, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Envelope{}, 0, err
+	}
+	return decodeFrameBody(frame)
+}
+
+// messageIDs hands out envelope IDs. The sequence starts at a random point so IDs stay unique across restarts.
+type messageIDs struct {
+	last uint64
+}
+
+func newMessageIDs() *messageIDs {
+	var seed [8]byte
+	rand.Read(seed[:])
+	// Keep clear of the top of the range so the sequence does not wrap to the reserved 0
+	return &messageIDs{last: binary.BigEndian.Uint64(seed[:]) >> 1}
+}
+
+// next returns a new ID.
+func (ids *messageIDs) next() uint64 {
+	return atomic.AddUint64(&ids.last, 1)
+}
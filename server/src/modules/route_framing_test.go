@@ -0,0 +1,97 @@
+// server/src/modules/route_framing_test.go
+
+package modules
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// testEnvelopes covers every field, values beyond what a JSON number holds exactly, and an envelope
+// with everything optional left out.
+var testEnvelopes = []Envelope{
+	{
+		ID:            math.MaxUint64,
+		CorrelationID: 1<<53 + 1,
+		Type:          MessageCommand,
+		Priority:      ClassBulk,
+		Timestamp:     time.UnixMilli(1767225600123),
+		ContentType:   "application/json",
+		TTL:           90 * time.Second,
+		Payload:       []byte{0, 1, 0xff, '{', '"'},
+		RequireAck:    true,
+		Topic:         "plant/line3/température",
+	},
+	{ID: 7, Type: MessagePing, Priority: ClassCritical},
+}
+
+// sameEnvelope reports whether two envelopes carry the same message.
+func sameEnvelope(a, b Envelope) bool {
+	return a.ID == b.ID && a.CorrelationID == b.CorrelationID && a.Type == b.Type && a.Priority == b.Priority &&
+		a.Timestamp.Equal(b.Timestamp) && a.ContentType == b.ContentType && a.TTL == b.TTL &&
+		bytes.Equal(a.Payload, b.Payload) && a.RequireAck == b.RequireAck && a.Topic == b.Topic
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, codec := range []FrameCodec{CodecProtobuf, CodecCBOR, CodecJSON} {
+		var stream bytes.Buffer
+		for _, envelope := range testEnvelopes {
+			frame, err := EncodeFrame(envelope, codec)
+			if err != nil {
+				t.Fatalf("%s: %v", codec, err)
+			}
+			decoded, decodedCodec, err := DecodeFrame(frame)
+			if err != nil || decodedCodec != codec || !sameEnvelope(decoded, envelope) {
+				t.Fatalf("%s: DecodeFrame gave %+v, %s, %v for %+v", codec, decoded, decodedCodec, err, envelope)
+			}
+			stream.Write(frame)
+		}
+
+		reader := NewFrameReader(&stream)
+		for _, envelope := range testEnvelopes {
+			decoded, _, err := reader.ReadEnvelope()
+			if err != nil || !sameEnvelope(decoded, envelope) {
+				t.Fatalf("%s: FrameReader gave %+v, %v for %+v", codec, decoded, err, envelope)
+			}
+		}
+	}
+}
+
+func TestDecodeFrameRefusesMalformedFrames(t *testing.T) {
+	frame, err := EncodeFrame(testEnvelopes[0], CodecCBOR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badVersion := append([]byte(nil), frame...)
+	badVersion[4] = FrameVersion + 1
+	badCodec := append([]byte(nil), frame...)
+	badCodec[5] = 9
+
+	for name, data := range map[string][]byte{
+		"empty":           nil,
+		"length only":     frame[:4],
+		"truncated":       frame[:len(frame)-1],
+		"trailing bytes":  append(append([]byte(nil), frame...), 0),
+		"unknown version": badVersion,
+		"unknown codec":   badCodec,
+		"corrupted body":  append(append([]byte(nil), frame[:6]...), bytes.Repeat([]byte{0xff}, len(frame)-6)...),
+	} {
+		if _, _, err := DecodeFrame(data); !errors.Is(err, ErrMalformedFrame) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+
+	if _, _, err := DecodeFrame(frame[4:]); err == nil {
+		t.Error("frame without its length prefix decoded")
+	}
+	tooLarge := []byte{0xff, 0xff, 0xff, 0xff, FrameVersion, byte(CodecJSON)}
+	if _, _, err := DecodeFrame(tooLarge); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized length prefix: %v", err)
+	}
+	if _, err := EncodeFrame(Envelope{Type: MessageData, Payload: make([]byte, MaxFrameSize)}, CodecProtobuf); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized payload encoded: %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+// server/src/modules/route_health.go
+
+package modules
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RouteState is the health of a route as judged by its heartbeats.
+type RouteState int
+
+const (
+	RouteHealthy  RouteState = iota // Heartbeats are answered
+	RouteDegraded                   // Recent heartbeats went unanswered
+	RouteDead                       // The peer is gone; the route has been removed
+)
+
+// String returns the name of the state.
+func (s RouteState) String() string {
+	switch s {
+	case RouteHealthy:
+		return "healthy"
+	case RouteDegraded:
+		return "degraded"
+	case RouteDead:
+		return "dead"
+	}
+	return fmt.Sprintf("state(%d)", int(s))
+}
+
+// MarshalText encodes the state by name in JSON.
+func (s RouteState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// HeartbeatOptions sets when unanswered heartbeats change a route's state.
+type HeartbeatOptions struct {
+	DegradedAfter int           // Consecutive unanswered pings that mark a route degraded
+	DeadAfter     int           // Consecutive unanswered pings that mark a route dead and remove it
+	KeepAlive     time.Duration // TCP keepalive period for TCP routes; 0 keeps the system default, negative disables keepalive
+}
+
+// DefaultHeartbeatOptions returns the heartbeat options applied to routes unless others are configured.
+func DefaultHeartbeatOptions() HeartbeatOptions {
+	return HeartbeatOptions{
+		DegradedAfter: 2,
+		DeadAfter:     4,
+		KeepAlive:     15 * time.Second,
+	}
+}
+
+// RouteEvent reports a route changing state.
+type RouteEvent struct {
+	DeviceID string        `json:"device_id"`
+	From     RouteState    `json:"from"`
+	To       RouteState    `json:"to"`
+	Missed   int           `json:"missed"` // Consecutive unanswered pings
+	RTT      time.Duration `json:"rtt"`    // Last measured round trip
+	Reason   string        `json:"reason"`
+	Time     time.Time     `json:"time"`
+}
+
+// RouteStatus reports the current health of a route.
+type RouteStatus struct {
+	DeviceID string        `json:"device_id"`
+	State    RouteState    `json:"state"`
+	Missed   int           `json:"missed"`
+	RTT      time.Duration `json:"rtt"`
+	LastSeen time.Time     `json:"last_seen"` // Last time the peer sent anything
+}
+
+// routeHealth tracks the heartbeats of one route.
+type routeHealth struct {
+	deviceID string
+	conn     net.Conn
+	queue    *routeQueue
+	mutex    sync.Mutex // Guards the fields below
+	state    RouteState
+	missed   int
+	pingID   uint64    // Message ID of the last ping sent
+	awaiting bool      // Whether the last ping is unanswered
+	sentAt   time.Time // When the last ping was queued
+	rtt      time.Duration
+	lastSeen time.Time
+	active   bool // Whether the peer has sent anything since the last ping
+	stopped  bool // Whether the route has been removed
+}
+
+// tick accounts for the previous ping and records pingID as the next one. It reports whether the
+// ping should be sent, which it should not once the route is dead, and the state change if there was one.
+func (h *routeHealth) tick(now time.Time, options HeartbeatOptions, pingID uint64) (bool, *RouteEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.awaiting {
+		if h.active {
+			// Other traffic shows the peer is alive even if it does not answer pings
+			h.missed = 0
+		} else {
+			h.missed++
+		}
+	}
+	next := RouteHealthy
+	switch {
+	case options.DeadAfter > 0 && h.missed >= options.DeadAfter:
+		next = RouteDead
+	case options.DegradedAfter > 0 && h.missed >= options.DegradedAfter:
+		next = RouteDegraded
+	}
+	event := h.transition(next, now, fmt.Sprintf("%d heartbeats unanswered", h.missed))
+	if next == RouteDead {
+		return false, event
+	}
+
+	h.pingID = pingID
+	h.awaiting = true
+	h.active = false
+	h.sentAt = now
+	return true, event
+}
+
+// pong records the answer to a ping.
+func (h *routeHealth) pong(pingID uint64, now time.Time) *RouteEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.awaiting || pingID != h.pingID {
+		return nil
+	}
+	h.awaiting = false
+	h.missed = 0
+	h.rtt = now.Sub(h.sentAt)
+	return h.transition(RouteHealthy, now, "heartbeat answered")
+}
+
+// seen records that the peer sent something.
+func (h *routeHealth) seen(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.active = true
+	h.lastSeen = now
+}
+
+// transition moves to state and returns the event, or nil if the state is unchanged. Dead is final.
+// The caller must hold the mutex.
+func (h *routeHealth) transition(state RouteState, now time.Time, reason string) *RouteEvent {
+	if state == h.state || h.state == RouteDead {
+		return nil
+	}
+	event := &RouteEvent{
+		DeviceID: h.deviceID,
+		From:     h.state,
+		To:       state,
+		Missed:   h.missed,
+		RTT:      h.rtt,
+		Reason:   reason,
+		Time:     now,
+	}
+	h.state = state
+	return event
+}
+
+// kill marks the route dead.
+func (h *routeHealth) kill(now time.Time, reason string) *RouteEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.transition(RouteDead, now, reason)
+}
+
+// stop marks the route removed and wakes its reader.
+func (h *routeHealth) stop() {
+	h.mutex.Lock()
+	h.stopped = true
+	h.mutex.Unlock()
+	// The connection may outlive the route, so the reader is woken rather than the connection closed
+	h.conn.SetReadDeadline(time.Now())
+}
+
+// isStopped reports whether the route has been removed.
+func (h *routeHealth) isStopped() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.stopped
+}
+
+// status snapshots the health of the route.
+func (h *routeHealth) status() RouteStatus {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return RouteStatus{DeviceID: h.deviceID, State: h.state, Missed: h.missed, RTT: h.rtt, LastSeen: h.lastSeen}
+}
+
+// applyKeepAlive configures TCP keepalive on TCP connections.
+func applyKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || period == 0 {
+		return nil
+	}
+	if period < 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(period)
+}
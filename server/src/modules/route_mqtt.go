@@ -0,0 +1,198 @@
+// server/src/modules/route_mqtt.go
+
+package modules
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// mqttRouteOptions describes the broker session that carries an MQTT route.
+type mqttRouteOptions struct {
+	clientID       string
+	username       string
+	password       string
+	publishTopic   string        // Topic the frames written to the route are published to
+	subscribeTopic string        // Topic the frames read from the route arrive on
+	keepAlive      time.Duration // MQTT keep-alive; PINGREQ is sent at half this interval
+	timeout        time.Duration // Deadline for the CONNECT and SUBSCRIBE handshake
+}
+
+// mqttRouteConn carries a route's frame stream over an MQTT broker. Each write is published as one
+// QoS 0 message, and the payloads received on the subscribe topic are read back in order as a stream.
+// Messages lost by the broker break the stream, so the route fails and is redialed; acknowledged
+// delivery above the stream retransmits what was lost.
+type mqttRouteConn struct {
+	net.Conn          // Local end of a pipe, read by the route
+	pipe     net.Conn // Remote end of the pipe, fed with received payloads
+	broker   net.Conn
+	options  mqttRouteOptions
+	writeMu  sync.Mutex // Serializes packets written to the broker
+	closed   chan struct{}
+	once     sync.Once
+}
+
+// openMQTTRoute opens a route session on a connected broker and subscribes to the route's subscribe
+// topic. The broker connection is closed if the session cannot be set up.
+func openMQTTRoute(broker net.Conn, options mqttRouteOptions) (net.Conn, error) {
+	reader := bufio.NewReader(broker)
+	if err := mqttRouteHandshake(broker, reader, options); err != nil {
+		broker.Close()
+		return nil, err
+	}
+
+	local, remote := net.Pipe()
+	conn := &mqttRouteConn{Conn: local, pipe: remote, broker: broker, options: options, closed: make(chan struct{})}
+	go conn.readLoop(reader)
+	go conn.keepAlive()
+	return conn, nil
+}
+
+// mqttRouteHandshake sends CONNECT and SUBSCRIBE and checks the broker's answers.
+func mqttRouteHandshake(broker net.Conn, reader *bufio.Reader, options mqttRouteOptions) error {
+	broker.SetDeadline(time.Now().Add(options.timeout))
+	defer broker.SetDeadline(time.Time{})
+
+	keepAlive := uint16(options.keepAlive / time.Second)
+	if _, err := broker.Write(encodeMQTTConnect(options.clientID, options.username, options.password, keepAlive)); err != nil {
+		return fmt.Errorf("failed to send CONNECT: %w", err)
+	}
+	packetType, body, err := readMQTTPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNACK: %w", err)
+	}
+	if packetType != mqttConnAck || len(body) < 2 {
+		return fmt.Errorf("unexpected MQTT packet type %d while waiting for CONNACK", packetType)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("MQTT broker refused connection with return code %d", body[1])
+	}
+
+	const packetID = 1
+	subscribe := appendMQTTUint16(nil, packetID)
+	subscribe = appendMQTTString(subscribe, options.subscribeTopic)
+	subscribe = append(subscribe, 0) // QoS 0
+	if _, err := broker.Write(encodeMQTTPacket(mqttSubscribe<<4|0x02, subscribe)); err != nil {
+		return fmt.Errorf("failed to send SUBSCRIBE: %w", err)
+	}
+	packetType, body, err = readMQTTPacket(reader)
+	if err != nil {
+		return fmt.Errorf("failed to read SUBACK: %w", err)
+	}
+	if packetType != mqttSubAck || len(body) < 3 || binary.BigEndian.Uint16(body) != packetID {
+		return fmt.Errorf("unexpected MQTT packet type %d while waiting for SUBACK", packetType)
+	}
+	if body[2] == mqttV3SubscribeFailure {
+		return fmt.Errorf("MQTT broker refused subscription to %s", options.subscribeTopic)
+	}
+	return nil
+}
+
+// readLoop feeds the payloads published on the subscribe topic into the pipe until the broker
+// connection fails or the route is closed.
+func (c *mqttRouteConn) readLoop(reader *bufio.Reader) {
+	defer c.Close()
+	for {
+		header, body, err := readMQTTPacketLimit(reader, 0)
+		if err != nil {
+			return
+		}
+		if header>>4 != mqttPublish {
+			continue // PINGRESP, and acks of nothing
+		}
+		decoder := &mqttDecoder{data: body}
+		topic := decoder.string()
+		qos := header >> 1 & 0x03
+		var packetID uint16
+		if qos > 0 {
+			packetID = decoder.uint16()
+		}
+		if decoder.err != nil {
+			return
+		}
+		if qos == 1 {
+			c.writePacket(encodeMQTTPacket(mqttPubAck<<4, appendMQTTUint16(nil, packetID)))
+		}
+		if topic != c.options.subscribeTopic {
+			continue
+		}
+		if _, err := c.pipe.Write(decoder.data); err != nil {
+			return
+		}
+	}
+}
+
+// keepAlive pings the broker at half the keep-alive interval until the route is closed.
+func (c *mqttRouteConn) keepAlive() {
+	if c.options.keepAlive <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.options.keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writePacket([]byte{mqttPingReq << 4, 0}); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// writePacket writes a packet to the broker.
+func (c *mqttRouteConn) writePacket(packet []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.broker.Write(packet)
+	return err
+}
+
+// Write publishes b as one message on the publish topic.
+func (c *mqttRouteConn) Write(b []byte) (int, error) {
+	body := appendMQTTString(nil, c.options.publishTopic)
+	body = append(body, b...)
+	if err := c.writePacket(encodeMQTTPacket(mqttPublish<<4, body)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close disconnects from the broker and ends the stream.
+func (c *mqttRouteConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.closed)
+		c.broker.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writePacket([]byte{mqttDisconnect << 4, 0})
+		err = c.broker.Close()
+		c.pipe.Close()
+		c.Conn.Close()
+	})
+	return err
+}
+
+// LocalAddr returns the local address of the broker connection.
+func (c *mqttRouteConn) LocalAddr() net.Addr { return c.broker.LocalAddr() }
+
+// RemoteAddr returns the broker's address.
+func (c *mqttRouteConn) RemoteAddr() net.Addr { return c.broker.RemoteAddr() }
+
+// SetDeadline sets the read deadline of the stream and the write deadline of the broker connection.
+func (c *mqttRouteConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.broker.SetWriteDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for publishing to the broker.
+func (c *mqttRouteConn) SetWriteDeadline(t time.Time) error {
+	return c.broker.SetWriteDeadline(t)
+}
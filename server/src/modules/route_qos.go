@@ -0,0 +1,347 @@
+// server/src/modules/route_qos.go
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TrafficClass is the QoS class of an outbound message.
+type TrafficClass int
+
+const (
+	ClassCritical  TrafficClass = iota // Safety and alarm messages; always sent first
+	ClassControl                       // Commands and setpoints
+	ClassTelemetry                     // Routine measurements
+	ClassBulk                          // File transfers, firmware and backfill
+
+	numTrafficClasses = 4
+	drrQuantum        = 1500 // Bytes of credit per weight unit per scheduling round
+)
+
+// ErrRouteQueueFull is returned when a message is refused because its class queue is at its depth limit.
+var ErrRouteQueueFull = errors.New("route queue full")
+
+// ErrRouteClosed is returned when a message is routed to a route that has been removed.
+var ErrRouteClosed = errors.New("route closed")
+
+// String returns the name of the class.
+func (c TrafficClass) String() string {
+	switch c {
+	case ClassCritical:
+		return "critical"
+	case ClassControl:
+		return "control"
+	case ClassTelemetry:
+		return "telemetry"
+	case ClassBulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("class(%d)", int(c))
+}
+
+// ParseTrafficClass parses a class name as used in configuration.
+func ParseTrafficClass(name string) (TrafficClass, error) {
+	for class := ClassCritical; class < numTrafficClasses; class++ {
+		if strings.EqualFold(name, class.String()) {
+			return class, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown traffic class %q (use critical, control, telemetry or bulk)", name)
+}
+
+// ClassPolicy sets the scheduling share and limits of one traffic class.
+type ClassPolicy struct {
+	Weight        int   // Share of the link among control, telemetry and bulk; ignored for critical
+	MaxRate       int64 // Bandwidth cap in bytes per second; 0 means unlimited
+	MaxQueueDepth int   // Messages that may wait in the class queue before new ones are refused
+}
+
+// QoSPolicy holds the policy of every traffic class on a route.
+type QoSPolicy struct {
+	Classes [numTrafficClasses]ClassPolicy
+}
+
+// DefaultQoSPolicy returns the policy applied to routes unless one is configured.
+func DefaultQoSPolicy() QoSPolicy {
+	return QoSPolicy{Classes: [numTrafficClasses]ClassPolicy{
+		ClassCritical:  {MaxQueueDepth: 256},
+		ClassControl:   {Weight: 8, MaxQueueDepth: 1024},
+		ClassTelemetry: {Weight: 4, MaxQueueDepth: 4096},
+		ClassBulk:      {Weight: 1, MaxQueueDepth: 256},
+	}}
+}
+
+// ClassStats reports the traffic of one class on a route.
+type ClassStats struct {
+	Queued       int    `json:"queued"`
+	QueuedBytes  int    `json:"queued_bytes"`
+	SentMessages uint64 `json:"sent_messages"`
+	SentBytes    uint64 `json:"sent_bytes"`
+	Refused      uint64 `json:"refused"` // Messages refused because the queue was full
+	Failed       uint64 `json:"failed"`  // Messages whose write failed or timed out
+	Expired      uint64 `json:"expired"` // Messages dropped because their TTL passed while queued
+}
+
+// RouteQueueStats reports the traffic of a route per class.
+type RouteQueueStats struct {
+	DeviceID      string                `json:"device_id"`
+	Classes       map[string]ClassStats `json:"classes"`
+	WriteTimeouts uint64                `json:"write_timeouts"`
+	SlowConsumer  bool                  `json:"slow_consumer"` // Whether the peer has been flagged as a slow consumer
+}
+
+// outboundMessage is a message waiting in a class queue.
+type outboundMessage struct {
+	envelope Envelope
+	data     []byte // Encoded frame
+	class    TrafficClass
+	enqueued time.Time
+	callback func(SendResult) // Called once the message is written, fails or is discarded; may be nil
+}
+
+// tokenBucket enforces a byte rate. The bucket may go into debt so messages larger than a second's
+// worth of bytes are still sent; the class then waits until the debt is repaid.
+type tokenBucket struct {
+	rate    float64 // Bytes per second; 0 disables the bucket
+	tokens  float64
+	updated time.Time
+}
+
+// delay returns how long until the bucket allows another message.
+func (b *tokenBucket) delay(now time.Time) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	if !b.updated.IsZero() {
+		b.tokens += now.Sub(b.updated).Seconds() * b.rate
+	} else {
+		b.tokens = b.rate
+	}
+	if b.tokens > b.rate {
+		b.tokens = b.rate // At most one second of burst
+	}
+	b.updated = now
+	if b.tokens > 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// spend charges the bucket for a sent message.
+func (b *tokenBucket) spend(bytes int) {
+	if b.rate != 0 {
+		b.tokens -= float64(bytes)
+	}
+}
+
+// classQueue is the FIFO of one traffic class.
+type classQueue struct {
+	policy   ClassPolicy
+	messages []outboundMessage
+	bytes    int
+	deficit  int // Deficit round-robin credit in bytes
+	bucket   tokenBucket
+	stats    ClassStats
+}
+
+// routeQueue schedules the outbound messages of one route and writes them from its own goroutine, so
+// a slow connection only delays its own traffic. Critical messages preempt all other classes; the
+// remaining classes share the link by deficit round-robin in proportion to their weights.
+type routeQueue struct {
+	deviceID string
+	conn     net.Conn
+	logger   *log.Logger
+	options  RouteWriteOptions
+	codec    FrameCodec
+	onSlow   func(q *routeQueue, reason string) // Called once when the peer is found to be a slow consumer
+	classes  [numTrafficClasses]classQueue
+	current  TrafficClass // Class the round-robin is visiting
+	granted  bool         // Whether the visited class has received its quantum this visit
+	mutex    sync.Mutex   // Guards the class queues, the slow-consumer state and closed
+	timeouts int          // Consecutive timed-out writes
+	total    uint64       // Timed-out writes since the route was added
+	laggard  bool         // Whether onSlow has been called
+	wake     chan struct{}
+	closed   bool
+	done     chan struct{}
+}
+
+// newRouteQueue creates the queue of a route and starts its writer.
+func newRouteQueue(deviceID string, conn net.Conn, policy QoSPolicy, options RouteWriteOptions, codec FrameCodec, onSlow func(*routeQueue, string), logger *log.Logger) *routeQueue {
+	q := &routeQueue{
+		deviceID: deviceID,
+		conn:     conn,
+		logger:   logger,
+		options:  options,
+		codec:    codec,
+		onSlow:   onSlow,
+		current:  ClassControl,
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	for class := range q.classes {
+		q.classes[class].policy = policy.Classes[class]
+		q.classes[class].bucket.rate = float64(policy.Classes[class].MaxRate)
+	}
+	go q.run()
+	return q
+}
+
+// enqueue frames an envelope and adds it to the queue of its priority class. The callback is only
+// kept when the message is accepted.
+func (q *routeQueue) enqueue(envelope Envelope, callback func(SendResult)) error {
+	class := envelope.Priority
+	if class < 0 || class >= numTrafficClasses {
+		return fmt.Errorf("invalid traffic class %d", int(class))
+	}
+	data, err := EncodeFrame(envelope, q.codec)
+	if err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return ErrRouteClosed
+	}
+	queue := &q.classes[class]
+	if queue.policy.MaxQueueDepth > 0 && len(queue.messages) >= queue.policy.MaxQueueDepth {
+		queue.stats.Refused++
+		q.mutex.Unlock()
+		return ErrRouteQueueFull
+	}
+	queue.messages = append(queue.messages, outboundMessage{envelope: envelope, data: data, class: class, enqueued: time.Now(), callback: callback})
+	queue.bytes += len(data)
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// next picks the message to send. When every waiting class is held back by its bandwidth cap it
+// returns how long to wait instead.
+func (q *routeQueue) next(now time.Time) (outboundMessage, time.Duration, bool) {
+	if critical := &q.classes[ClassCritical]; len(critical.messages) > 0 {
+		return q.pop(critical), 0, true
+	}
+
+	var wait time.Duration
+	for {
+		eligible := false
+		for visited := 0; visited < numTrafficClasses-1; visited++ {
+			queue := &q.classes[q.current]
+			if len(queue.messages) == 0 {
+				queue.deficit = 0
+				q.advance()
+				continue
+			}
+			if delay := queue.bucket.delay(now); delay > 0 {
+				if wait == 0 || delay < wait {
+					wait = delay
+				}
+				q.advance()
+				continue
+			}
+			eligible = true
+			if !q.granted {
+				queue.deficit += drrQuantum * weightOf(queue.policy)
+				q.granted = true
+			}
+			if head := len(queue.messages[0].data); queue.deficit >= head {
+				queue.deficit -= head
+				return q.pop(queue), 0, true
+			}
+			q.advance()
+		}
+		if !eligible {
+			return outboundMessage{}, wait, false
+		}
+	}
+}
+
+// advance moves the round-robin to the next weighted class.
+func (q *routeQueue) advance() {
+	q.current++
+	if q.current >= numTrafficClasses {
+		q.current = ClassControl
+	}
+	q.granted = false
+}
+
+// pop removes the head of a class queue and charges its bandwidth cap.
+func (q *routeQueue) pop(queue *classQueue) outboundMessage {
+	message := queue.messages[0]
+	queue.messages[0] = outboundMessage{}
+	queue.messages = queue.messages[1:]
+	queue.bytes -= len(message.data)
+	queue.bucket.spend(len(message.data))
+	return message
+}
+
+// weightOf returns a class weight, treating unset weights as 1.
+func weightOf(policy ClassPolicy) int {
+	if policy.Weight <= 0 {
+		return 1
+	}
+	return policy.Weight
+}
+
+// close stops the writer after the message being written, discarding queued messages. Their
+// callbacks receive ErrRouteClosed.
+func (q *routeQueue) close() {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return
+	}
+	q.closed = true
+	discarded := make([]outboundMessage, 0)
+	for class := range q.classes {
+		discarded = append(discarded, q.classes[class].messages...)
+		q.classes[class].messages = nil
+		q.classes[class].bytes = 0
+	}
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	if len(discarded) > 0 {
+		q.logger.Printf("Discarded %d queued messages for device %s\n", len(discarded), q.deviceID)
+	}
+	for _, message := range discarded {
+		if message.callback != nil {
+			message.callback(SendResult{DeviceID: q.deviceID, MessageID: message.envelope.ID, Class: message.class, Err: ErrRouteClosed})
+		}
+	}
+}
+
+// stats snapshots the per-class counters.
+func (q *routeQueue) stats() RouteQueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := RouteQueueStats{
+		DeviceID:      q.deviceID,
+		Classes:       make(map[string]ClassStats, numTrafficClasses),
+		WriteTimeouts: q.total,
+		SlowConsumer:  q.laggard,
+	}
+	for class := range q.classes {
+		classStats := q.classes[class].stats
+		classStats.Queued = len(q.classes[class].messages)
+		classStats.QueuedBytes = q.classes[class].bytes
+		stats.Classes[TrafficClass(class).String()] = classStats
+	}
+	return stats
+}
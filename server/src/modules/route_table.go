@@ -0,0 +1,606 @@
+// server/src/modules/route_table.go
+
+package modules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+// RouteTransport is how a static route reaches its destination.
+type RouteTransport string
+
+// Transports of static routes.
+const (
+	TransportTCP  RouteTransport = "tcp"  // Plain TCP
+	TransportTLS  RouteTransport = "tls"  // TCP with TLS
+	TransportUnix RouteTransport = "unix" // Unix domain stream socket
+	TransportMQTT RouteTransport = "mqtt" // Frames published through an MQTT broker
+)
+
+// ReconnectPolicy sets how a static route is redialed. The wait between dials starts at Interval and
+// doubles with each failure up to MaxInterval; after BreakerThreshold failures in a row the circuit
+// opens and the route is left alone for BreakerCooldown, then given one trial dial.
+type ReconnectPolicy struct {
+	Interval         string   `json:"interval,omitempty"`          // First wait after a failed dial or a lost connection, default "1s"
+	MaxInterval      string   `json:"max_interval,omitempty"`      // Longest wait between dials, default "2m"
+	Jitter           *float64 `json:"jitter,omitempty"`            // Fraction of each wait randomised either way, default 0.2
+	Timeout          string   `json:"timeout,omitempty"`           // Deadline for dialing, the TLS handshake and the MQTT handshake, default "10s"
+	MaxAttempts      int      `json:"max_attempts,omitempty"`      // Failed dials in a row before the route is given up until it is redefined; 0 never gives up
+	BreakerThreshold int      `json:"breaker_threshold,omitempty"` // Failures in a row that open the circuit, default 5; negative disables the breaker
+	BreakerCooldown  string   `json:"breaker_cooldown,omitempty"`  // Time an open circuit waits before its trial dial, default "1m"
+	BufferSize       int      `json:"buffer_size,omitempty"`       // Messages held while the route reconnects, default 1000; negative disables buffering
+}
+
+// MQTTRouteConfig describes the broker session of an mqtt route.
+type MQTTRouteConfig struct {
+	ClientID       string `json:"client_id,omitempty"`       // Default "nimbus-<device_id>"
+	Username       string `json:"username,omitempty"`        // Optional broker username
+	PasswordEnv    string `json:"password_env,omitempty"`    // Environment variable holding the broker password
+	TLS            bool   `json:"tls,omitempty"`             // Connects to the broker over TLS
+	PublishTopic   string `json:"publish_topic,omitempty"`   // Topic frames for the device are published to, default "nimbus/<device_id>/down"
+	SubscribeTopic string `json:"subscribe_topic,omitempty"` // Topic the device publishes its frames to, default "nimbus/<device_id>/up"
+	KeepAlive      string `json:"keep_alive,omitempty"`      // MQTT keep-alive, default "30s"
+}
+
+// StaticRouteConfig declares an outbound route the RoutingManager dials and keeps connected itself.
+type StaticRouteConfig struct {
+	DeviceID   string           `json:"device_id"`             // Device the route carries messages for
+	Transport  RouteTransport   `json:"transport,omitempty"`   // "tcp" (default), "tls", "unix" or "mqtt"
+	Address    string           `json:"address"`               // host:port of the peer or broker, or the socket path for unix
+	Priority   int              `json:"priority"`              // Routing priority, as for AddRoute
+	ServerName string           `json:"server_name,omitempty"` // Name the peer's TLS certificate must carry; the host of Address by default
+	Topics     []string         `json:"topics,omitempty"`      // Topic filters the route is subscribed to once connected
+	Reconnect  ReconnectPolicy  `json:"reconnect"`
+	MQTT       *MQTTRouteConfig `json:"mqtt,omitempty"` // Broker session, for mqtt routes
+}
+
+// StaticRouteStatus reports the connection state of a static route.
+type StaticRouteStatus struct {
+	DeviceID  string         `json:"device_id"`
+	Transport RouteTransport `json:"transport"`
+	Address   string         `json:"address"`
+	Connected bool           `json:"connected"`
+	Attempts  int            `json:"attempts"`   // Failures since the route was last stably connected
+	LastError string         `json:"last_error"` // Error of the last failure
+	NextDial  time.Time      `json:"next_dial"`  // Earliest time of the next dial while disconnected
+	GaveUp    bool           `json:"gave_up"`    // The route reached its reconnect policy's MaxAttempts
+	Circuit   CircuitState   `json:"circuit"`    // State of the route's circuit breaker
+	Buffered  int            `json:"buffered"`   // Messages held until the route reconnects
+}
+
+// ErrNoRouteTable is returned by the static route methods before OpenRouteTable.
+var ErrNoRouteTable = errors.New("no route table open")
+
+// staticRouteCheckInterval is how often static routes are reconciled with the route table.
+const staticRouteCheckInterval = time.Second
+
+// staticRoute is a validated static route and its connection state.
+type staticRoute struct {
+	config           StaticRouteConfig
+	backoff          utils.Backoff
+	timeout          time.Duration
+	breakerThreshold int // Failures that open the circuit; 0 disables the breaker
+	cooldown         time.Duration
+	bufferSize       int              // Messages held while disconnected; negative disables buffering
+	mqtt             mqttRouteOptions // Broker session of mqtt routes
+	mqttTLS          bool
+	conn             net.Conn  // Connection of the current route; nil while disconnected
+	connectedAt      time.Time // When conn was made
+	dialing          bool      // A dial is in progress
+	retired          bool      // The route was removed or redefined; a dial in progress is discarded
+	attempts         int
+	lastError        string
+	nextDial         time.Time
+	circuit          CircuitState
+	buffer           []bufferedEnvelope // Messages waiting for the route to connect
+	grants           routeGrants        // Topics AccessControl lets the device subscribe to
+}
+
+// routeTable holds the static routes declared in the route table file.
+type routeTable struct {
+	path    string
+	modTime time.Time // Modification time of the file when last read or written
+	mutex   sync.Mutex
+	configs []StaticRouteConfig // In file order
+	routes  map[string]*staticRoute
+}
+
+// OpenRouteTable loads the static routes declared in the JSON file at path, an array of
+// StaticRouteConfig, and keeps them connected: each route is dialed, redialed by its reconnect policy
+// when it fails, and closed when it leaves the table. The file is reread when it changes, and
+// PutStaticRoute and RemoveStaticRoute save to it, so the routes survive a restart. A missing file is
+// an empty table.
+func (rm *RoutingManager) OpenRouteTable(path string) error {
+	table := &routeTable{path: path, routes: make(map[string]*staticRoute)}
+	configs, modTime, err := readRouteTable(path)
+	if err != nil {
+		return err
+	}
+	routes, err := parseStaticRoutes(configs)
+	if err != nil {
+		return fmt.Errorf("invalid route table %s: %w", path, err)
+	}
+	table.configs, table.routes, table.modTime = configs, routes, modTime
+	rm.authorizeStaticRoutes(routes)
+
+	rm.routeMutex.Lock()
+	if rm.table != nil {
+		rm.routeMutex.Unlock()
+		return errors.New("route table already open")
+	}
+	rm.table = table
+	rm.routeMutex.Unlock()
+	rm.logger.Printf("Route table %s declares %d static routes\n", path, len(configs))
+	go rm.maintainStaticRoutes(table)
+	return nil
+}
+
+// PutStaticRoute adds a static route, or redefines the one for the same device, and saves the route
+// table. A redefined route is reconnected.
+func (rm *RoutingManager) PutStaticRoute(config StaticRouteConfig) error {
+	table := rm.routeTable()
+	if table == nil {
+		return ErrNoRouteTable
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	configs := append([]StaticRouteConfig(nil), table.configs...)
+	replaced := false
+	for i := range configs {
+		if configs[i].DeviceID == config.DeviceID {
+			configs[i], replaced = config, true
+		}
+	}
+	if !replaced {
+		configs = append(configs, config)
+	}
+	return rm.updateRouteTable(table, configs)
+}
+
+// RemoveStaticRoute deletes the static route of a device, closes its connection and saves the route
+// table. It reports whether there was one.
+func (rm *RoutingManager) RemoveStaticRoute(deviceID string) (bool, error) {
+	table := rm.routeTable()
+	if table == nil {
+		return false, ErrNoRouteTable
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	configs := make([]StaticRouteConfig, 0, len(table.configs))
+	for _, config := range table.configs {
+		if config.DeviceID != deviceID {
+			configs = append(configs, config)
+		}
+	}
+	if len(configs) == len(table.configs) {
+		return false, nil
+	}
+	return true, rm.updateRouteTable(table, configs)
+}
+
+// StaticRoutes reports the state of each static route, ordered by device ID.
+func (rm *RoutingManager) StaticRoutes() []StaticRouteStatus {
+	table := rm.routeTable()
+	if table == nil {
+		return nil
+	}
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	statuses := make([]StaticRouteStatus, 0, len(table.routes))
+	for _, route := range table.routes {
+		statuses = append(statuses, StaticRouteStatus{
+			DeviceID:  route.config.DeviceID,
+			Transport: route.config.Transport,
+			Address:   route.config.Address,
+			Connected: route.conn != nil,
+			Attempts:  route.attempts,
+			LastError: route.lastError,
+			NextDial:  route.nextDial,
+			GaveUp:    route.gaveUp(),
+			Circuit:   route.circuit,
+			Buffered:  len(route.buffer),
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].DeviceID < statuses[j].DeviceID })
+	return statuses
+}
+
+// routeTable returns the open route table, or nil.
+func (rm *RoutingManager) routeTable() *routeTable {
+	rm.routeMutex.RLock()
+	defer rm.routeMutex.RUnlock()
+	return rm.table
+}
+
+// updateRouteTable validates and applies new table contents, then saves them; the caller must hold the
+// table's mutex.
+func (rm *RoutingManager) updateRouteTable(table *routeTable, configs []StaticRouteConfig) error {
+	routes, err := parseStaticRoutes(configs)
+	if err != nil {
+		return err
+	}
+	rm.applyStaticRoutes(table, configs, routes)
+	modTime, err := saveRouteTable(table.path, configs)
+	if err != nil {
+		return fmt.Errorf("failed to save route table %s: %w", table.path, err)
+	}
+	table.modTime = modTime
+	return nil
+}
+
+// applyStaticRoutes replaces the table's routes, keeping the state of those left unchanged and closing
+// those removed or redefined; the caller must hold the table's mutex. A redefined route keeps the
+// messages buffered for it, while those of a removed route are failed.
+func (rm *RoutingManager) applyStaticRoutes(table *routeTable, configs []StaticRouteConfig, routes map[string]*staticRoute) {
+	var discarded []bufferedEnvelope
+	for deviceID, old := range table.routes {
+		route, kept := routes[deviceID]
+		if kept && reflect.DeepEqual(route.config, old.config) {
+			routes[deviceID] = old
+			continue
+		}
+		old.retired = true
+		if old.conn != nil {
+			rm.closeStaticRoute(old)
+		}
+		if kept && route.bufferSize >= 0 {
+			route.buffer = old.buffer
+		} else {
+			discarded = append(discarded, old.buffer...)
+		}
+		old.buffer = nil
+		rm.logger.Printf("Static route for device %s removed or redefined\n", deviceID)
+	}
+	table.configs, table.routes = configs, routes
+	rm.authorizeStaticRoutes(routes)
+	go failBuffered(discarded, ErrRouteClosed)
+}
+
+// maintainStaticRoutes reconciles the static routes with their connections until the manager closes.
+func (rm *RoutingManager) maintainStaticRoutes(table *routeTable) {
+	ticker := time.NewTicker(staticRouteCheckInterval)
+	defer ticker.Stop()
+	for {
+		rm.reloadRouteTable(table)
+		rm.reconcileStaticRoutes(table, time.Now())
+		select {
+		case <-ticker.C:
+		case <-rm.stop:
+			return
+		}
+	}
+}
+
+// reloadRouteTable rereads the route table file if it changed since it was last read or written. A
+// file that fails to load is logged and leaves the routes as they were.
+func (rm *RoutingManager) reloadRouteTable(table *routeTable) {
+	info, err := os.Stat(table.path)
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if err != nil || info.ModTime().Equal(table.modTime) {
+		return
+	}
+	configs, modTime, err := readRouteTable(table.path)
+	if err == nil {
+		var routes map[string]*staticRoute
+		if routes, err = parseStaticRoutes(configs); err == nil {
+			rm.applyStaticRoutes(table, configs, routes)
+			rm.logger.Printf("Route table %s reloaded with %d static routes\n", table.path, len(configs))
+		}
+	}
+	if err != nil {
+		rm.logger.Printf("Error reloading route table %s: %v\n", table.path, err)
+	}
+	table.modTime = modTime
+	if modTime.IsZero() {
+		table.modTime = info.ModTime()
+	}
+}
+
+// reconcileStaticRoutes notices static routes that were lost and dials those that are due. A static
+// route is not dialed while its device has a route of its own.
+func (rm *RoutingManager) reconcileStaticRoutes(table *routeTable, now time.Time) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var discarded []bufferedEnvelope
+	for deviceID, route := range table.routes {
+		rm.routeMutex.RLock()
+		current, exists := rm.routes[deviceID]
+		rm.routeMutex.RUnlock()
+		if route.conn != nil {
+			if exists && current == route.conn {
+				if route.attempts > 0 && now.Sub(route.connectedAt) >= staticRouteStableAfter {
+					route.attempts, route.lastError = 0, ""
+				}
+				continue
+			}
+			// The route failed or was replaced; its connection has been closed
+			route.conn = nil
+			if now.Sub(route.connectedAt) < staticRouteStableAfter {
+				discarded = append(discarded, rm.staticRouteFailed(route, now, "connection lost soon after it was made")...)
+			} else {
+				route.attempts, route.lastError = 0, ""
+				route.nextDial = now.Add(route.backoff.Duration(0))
+			}
+			if !route.gaveUp() {
+				rm.logger.Printf("Static route for device %s lost; redialing in %s\n", deviceID, route.nextDial.Sub(now).Round(time.Millisecond))
+			}
+		}
+		if exists || route.dialing || route.gaveUp() || now.Before(route.nextDial) {
+			continue
+		}
+		if route.circuit == CircuitOpen {
+			route.circuit = CircuitHalfOpen
+			rm.logger.Printf("Circuit of static route for device %s half-open; trying one dial\n", deviceID)
+		}
+		route.dialing = true
+		go rm.dialStaticRoute(table, route)
+	}
+	go failBuffered(discarded, ErrRouteClosed)
+}
+
+// dialStaticRoute dials a static route and adds it to the routes, or schedules the next attempt.
+func (rm *RoutingManager) dialStaticRoute(table *routeTable, route *staticRoute) {
+	conn, err := rm.dialRoute(route)
+
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	route.dialing = false
+	deviceID := route.config.DeviceID
+	select {
+	case <-rm.stop:
+		route.retired = true
+	default:
+	}
+	if route.retired {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	now := time.Now()
+	if err != nil {
+		rm.logger.Printf("Failed to connect static route for device %s to %s (attempt %d): %v\n", deviceID, route.config.Address, route.attempts+1, err)
+		go failBuffered(rm.staticRouteFailed(route, now, err.Error()), ErrRouteClosed)
+		return
+	}
+
+	rm.routeMutex.Lock()
+	if _, exists := rm.routes[deviceID]; exists {
+		// The device connected by itself meanwhile
+		rm.routeMutex.Unlock()
+		conn.Close()
+		return
+	}
+	rm.addRoute(deviceID, conn, route.config.Priority)
+	expired, refused := rm.flushStaticRoute(route, now)
+	rm.routeMutex.Unlock()
+	go failBuffered(expired, ErrMessageExpired)
+	go failBuffered(refused, ErrRouteQueueFull)
+	route.conn, route.connectedAt = conn, now
+	if route.circuit != CircuitClosed {
+		route.circuit = CircuitClosed
+		rm.logger.Printf("Circuit of static route for device %s closed\n", deviceID)
+	}
+	rm.logger.Printf("Static route for device %s connected to %s over %s\n", deviceID, route.config.Address, route.config.Transport)
+	rm.authorizeStaticRoutes(map[string]*staticRoute{deviceID: route})
+	for _, filter := range route.config.Topics {
+		if err := rm.Subscribe(deviceID, filter); err != nil {
+			rm.logger.Printf("Error subscribing static route for device %s to %s: %v\n", deviceID, filter, err)
+		}
+	}
+}
+
+// closeStaticRoute removes a static route's route, if it is still current, and closes its connection;
+// the caller must hold the table's mutex.
+func (rm *RoutingManager) closeStaticRoute(route *staticRoute) {
+	rm.routeMutex.Lock()
+	if rm.routes[route.config.DeviceID] == route.conn {
+		rm.removeRoute(route.config.DeviceID)
+	}
+	rm.routeMutex.Unlock()
+	if err := route.conn.Close(); err != nil {
+		rm.logger.Printf("Error closing static route for device %s: %v\n", route.config.DeviceID, err)
+	}
+	route.conn = nil
+}
+
+// closeStaticRoutes closes every static route, for Close.
+func (rm *RoutingManager) closeStaticRoutes(table *routeTable) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	var discarded []bufferedEnvelope
+	for _, route := range table.routes {
+		route.retired = true
+		if route.conn != nil {
+			rm.closeStaticRoute(route)
+		}
+		discarded = append(discarded, route.buffer...)
+		route.buffer = nil
+	}
+	go failBuffered(discarded, ErrRouteClosed)
+}
+
+// gaveUp reports whether the route reached its reconnect policy's MaxAttempts.
+func (route *staticRoute) gaveUp() bool {
+	return route.config.Reconnect.MaxAttempts > 0 && route.attempts >= route.config.Reconnect.MaxAttempts
+}
+
+// parseStaticRoutes validates static routes and applies their defaults.
+func parseStaticRoutes(configs []StaticRouteConfig) (map[string]*staticRoute, error) {
+	routes := make(map[string]*staticRoute, len(configs))
+	for _, config := range configs {
+		route, err := parseStaticRoute(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := routes[config.DeviceID]; exists {
+			return nil, fmt.Errorf("duplicate static route for device %s", config.DeviceID)
+		}
+		routes[config.DeviceID] = route
+	}
+	return routes, nil
+}
+
+// parseStaticRoute validates a static route and applies its defaults.
+func parseStaticRoute(config StaticRouteConfig) (*staticRoute, error) {
+	if config.DeviceID == "" {
+		return nil, errors.New("static route without a device ID")
+	}
+	if config.Transport == "" {
+		config.Transport = TransportTCP
+	}
+	route := &staticRoute{config: config}
+	switch config.Transport {
+	case TransportTCP, TransportTLS, TransportMQTT:
+		if _, _, err := net.SplitHostPort(config.Address); err != nil {
+			return nil, fmt.Errorf("invalid address %q for static route of %s: %w", config.Address, config.DeviceID, err)
+		}
+	case TransportUnix:
+		if config.Address == "" {
+			return nil, fmt.Errorf("static route of %s needs a socket path", config.DeviceID)
+		}
+	default:
+		return nil, fmt.Errorf("unknown transport %q for static route of %s", config.Transport, config.DeviceID)
+	}
+	for _, filter := range config.Topics {
+		if err := ValidateTopicFilter(filter); err != nil {
+			return nil, fmt.Errorf("static route of %s: %w", config.DeviceID, err)
+		}
+	}
+	var err error
+	policy := config.Reconnect
+	route.backoff = utils.Backoff{Multiplier: 2, Jitter: 0.2}
+	if route.backoff.Initial, err = utils.ParsePositiveDuration(policy.Interval, "1s"); err != nil {
+		return nil, fmt.Errorf("invalid reconnect interval for static route of %s: %w", config.DeviceID, err)
+	}
+	if route.backoff.Max, err = utils.ParsePositiveDuration(policy.MaxInterval, "2m"); err != nil {
+		return nil, fmt.Errorf("invalid max reconnect interval for static route of %s: %w", config.DeviceID, err)
+	}
+	if route.backoff.Max < route.backoff.Initial {
+		route.backoff.Max = route.backoff.Initial
+	}
+	if policy.Jitter != nil {
+		if *policy.Jitter < 0 || *policy.Jitter > 1 {
+			return nil, fmt.Errorf("reconnect jitter of static route of %s must be between 0 and 1", config.DeviceID)
+		}
+		route.backoff.Jitter = *policy.Jitter
+	}
+	if route.timeout, err = utils.ParsePositiveDuration(policy.Timeout, "10s"); err != nil {
+		return nil, fmt.Errorf("invalid dial timeout for static route of %s: %w", config.DeviceID, err)
+	}
+	if policy.MaxAttempts < 0 {
+		return nil, fmt.Errorf("negative max attempts for static route of %s", config.DeviceID)
+	}
+	switch {
+	case policy.BreakerThreshold == 0:
+		route.breakerThreshold = 5
+	case policy.BreakerThreshold > 0:
+		route.breakerThreshold = policy.BreakerThreshold
+	}
+	if route.cooldown, err = utils.ParsePositiveDuration(policy.BreakerCooldown, "1m"); err != nil {
+		return nil, fmt.Errorf("invalid breaker cooldown for static route of %s: %w", config.DeviceID, err)
+	}
+	switch {
+	case policy.BufferSize == 0:
+		route.bufferSize = 1000
+	case policy.BufferSize > 0:
+		route.bufferSize = policy.BufferSize
+	default:
+		route.bufferSize = -1
+	}
+
+	if config.Transport == TransportMQTT {
+		mqtt := MQTTRouteConfig{}
+		if config.MQTT != nil {
+			mqtt = *config.MQTT
+		}
+		route.mqttTLS = mqtt.TLS
+		route.mqtt = mqttRouteOptions{
+			clientID:       mqtt.ClientID,
+			username:       mqtt.Username,
+			publishTopic:   mqtt.PublishTopic,
+			subscribeTopic: mqtt.SubscribeTopic,
+			timeout:        route.timeout,
+		}
+		if route.mqtt.clientID == "" {
+			route.mqtt.clientID = "nimbus-" + config.DeviceID
+		}
+		if route.mqtt.publishTopic == "" {
+			route.mqtt.publishTopic = "nimbus/" + config.DeviceID + "/down"
+		}
+		if route.mqtt.subscribeTopic == "" {
+			route.mqtt.subscribeTopic = "nimbus/" + config.DeviceID + "/up"
+		}
+		if err := ValidateTopic(route.mqtt.publishTopic); err != nil {
+			return nil, fmt.Errorf("invalid MQTT publish topic for static route of %s: %w", config.DeviceID, err)
+		}
+		if err := ValidateTopic(route.mqtt.subscribeTopic); err != nil {
+			return nil, fmt.Errorf("invalid MQTT subscribe topic for static route of %s: %w", config.DeviceID, err)
+		}
+		if mqtt.PasswordEnv != "" {
+			route.mqtt.password = os.Getenv(mqtt.PasswordEnv)
+		}
+		if route.mqtt.keepAlive, err = utils.ParsePositiveDuration(mqtt.KeepAlive, "30s"); err != nil {
+			return nil, fmt.Errorf("invalid MQTT keep-alive for static route of %s: %w", config.DeviceID, err)
+		}
+	}
+	return route, nil
+}
+
+// readRouteTable reads the route table file and its modification time. A missing file is empty.
+func readRouteTable(path string) ([]StaticRouteConfig, time.Time, error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read route table %s: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to read route table %s: %w", path, err)
+	}
+	var configs []StaticRouteConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse route table %s: %w", path, err)
+	}
+	return configs, info.ModTime(), nil
+}
+
+// saveRouteTable writes the route table atomically and returns its new modification time.
+func saveRouteTable(path string, configs []StaticRouteConfig) (time.Time, error) {
+	if configs == nil {
+		configs = []StaticRouteConfig{}
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return time.Time{}, err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return time.Time{}, err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
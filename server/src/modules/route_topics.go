@@ -0,0 +1,313 @@
+// server/src/modules/route_topics.go
+
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Topics are slash-separated levels such as plant/press4/line3/temperature. As in MQTT, a subscription
+// filter may use + in place of exactly one level, and # as its last level for any number of levels,
+// none included. Topics starting with $ are reserved for the server and are not matched by a wildcard
+// in the first level.
+const (
+	maxTopicLength   = 65535
+	maxPublishTopics = 1024 // Topics whose publish permission a route remembers before starting over
+)
+
+// ErrInvalidTopic is returned for malformed topics and subscription filters.
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// ErrTopicAccessDenied is returned when AccessControl refuses a subscription.
+var ErrTopicAccessDenied = errors.New("topic access denied")
+
+// ValidateTopic checks that a topic can be published to.
+func ValidateTopic(topic string) error {
+	if topic == "" || len(topic) > maxTopicLength || !utf8.ValidString(topic) || strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+	}
+	return nil
+}
+
+// ValidateTopicFilter checks that a subscription filter is well formed.
+func ValidateTopicFilter(filter string) error {
+	if filter == "" || len(filter) > maxTopicLength || !utf8.ValidString(filter) || strings.ContainsRune(filter, 0) {
+		return fmt.Errorf("%w: %q", ErrInvalidTopic, filter)
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if len(level) > 1 && strings.ContainsAny(level, "+#") || level == "#" && i != len(levels)-1 {
+			return fmt.Errorf("%w: %q", ErrInvalidTopic, filter)
+		}
+	}
+	return nil
+}
+
+// TopicMatches reports whether a topic matches a subscription filter.
+func TopicMatches(filter, topic string) bool {
+	filterLevels, topicLevels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i == len(topicLevels) || level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// topicFiltersOverlap reports whether some topic could match both filters. A topic is a filter without
+// wildcards, so this also tells whether a filter matches a topic. The $ rule is ignored, which errs
+// towards overlap.
+func topicFiltersOverlap(a, b string) bool {
+	aLevels, bLevels := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(aLevels) && i < len(bLevels); i++ {
+		if aLevels[i] == "#" || bLevels[i] == "#" {
+			return true
+		}
+		if aLevels[i] != "+" && bLevels[i] != "+" && aLevels[i] != bLevels[i] {
+			return false
+		}
+	}
+	// Equal lengths overlap; otherwise only a # after the last level of the shorter filter matches it
+	switch {
+	case len(aLevels) == len(bLevels):
+		return true
+	case len(aLevels) == len(bLevels)+1:
+		return aLevels[len(bLevels)] == "#"
+	case len(bLevels) == len(aLevels)+1:
+		return bLevels[len(aLevels)] == "#"
+	}
+	return false
+}
+
+// topicFilterCovers reports whether every topic matching filter also matches rule.
+func topicFilterCovers(rule, filter string) bool {
+	ruleLevels, filterLevels := strings.Split(rule, "/"), strings.Split(filter, "/")
+	for i, level := range filterLevels {
+		if i < len(ruleLevels) && ruleLevels[i] == "#" {
+			return true
+		}
+		if i == len(ruleLevels) || level == "#" || level == "+" && ruleLevels[i] != "+" ||
+			ruleLevels[i] != "+" && ruleLevels[i] != level {
+			return false
+		}
+	}
+	// a/# also matches a itself
+	return len(ruleLevels) == len(filterLevels) || len(ruleLevels) == len(filterLevels)+1 && ruleLevels[len(filterLevels)] == "#"
+}
+
+// topicSpecificity ranks filters so that narrower ones score higher: literal levels count twice, + once
+// and # not at all.
+func topicSpecificity(filter string) int {
+	score := 0
+	for _, level := range strings.Split(filter, "/") {
+		switch level {
+		case "#":
+		case "+":
+			score++
+		default:
+			score += 2
+		}
+	}
+	return score
+}
+
+// topicNode is one level of the subscription tree.
+type topicNode struct {
+	children    map[string]*topicNode
+	subscribers map[string][]string // Devices whose filter ends at this level, with the filters excluded from it
+}
+
+// topicTree indexes subscriptions by filter level, so a publish visits only the branches its topic can
+// match rather than every subscription.
+type topicTree struct {
+	root    topicNode
+	filters map[string]map[string]struct{} // Filters of each device, for listing and removal
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{filters: make(map[string]map[string]struct{})}
+}
+
+// add subscribes a device to a validated filter, less the topics matching any excluded filter. It
+// returns false if the device was already subscribed, in which case only the exclusions are updated.
+func (t *topicTree) add(deviceID, filter string, excluded []string) bool {
+	node := &t.root
+	for _, level := range strings.Split(filter, "/") {
+		child, exists := node.children[level]
+		if !exists {
+			if node.children == nil {
+				node.children = make(map[string]*topicNode)
+			}
+			child = &topicNode{}
+			node.children[level] = child
+		}
+		node = child
+	}
+	_, exists := node.subscribers[deviceID]
+	if node.subscribers == nil {
+		node.subscribers = make(map[string][]string)
+	}
+	node.subscribers[deviceID] = excluded
+	if exists {
+		return false
+	}
+
+	if t.filters[deviceID] == nil {
+		t.filters[deviceID] = make(map[string]struct{})
+	}
+	t.filters[deviceID][filter] = struct{}{}
+	return true
+}
+
+// remove unsubscribes a device from a filter, pruning levels left empty. It returns false if the
+// device was not subscribed.
+func (t *topicTree) remove(deviceID, filter string) bool {
+	if _, exists := t.filters[deviceID][filter]; !exists {
+		return false
+	}
+	delete(t.filters[deviceID], filter)
+	if len(t.filters[deviceID]) == 0 {
+		delete(t.filters, deviceID)
+	}
+
+	levels := strings.Split(filter, "/")
+	path := make([]*topicNode, 0, len(levels)+1)
+	node := &t.root
+	for _, level := range levels {
+		path = append(path, node)
+		node = node.children[level]
+	}
+	delete(node.subscribers, deviceID)
+	for i := len(levels) - 1; i >= 0 && len(node.subscribers) == 0 && len(node.children) == 0; i-- {
+		delete(path[i].children, levels[i])
+		node = path[i]
+	}
+	return true
+}
+
+// removeDevice drops every subscription of a device and returns how many there were.
+func (t *topicTree) removeDevice(deviceID string) int {
+	filters := t.filters[deviceID]
+	count := len(filters)
+	for filter := range filters {
+		t.remove(deviceID, filter)
+	}
+	return count
+}
+
+// subscriptions returns the filters of a device in sorted order.
+func (t *topicTree) subscriptions(deviceID string) []string {
+	filters := make([]string, 0, len(t.filters[deviceID]))
+	for filter := range t.filters[deviceID] {
+		filters = append(filters, filter)
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// all returns the filters of every subscribed device.
+func (t *topicTree) all() map[string][]string {
+	all := make(map[string][]string, len(t.filters))
+	for deviceID := range t.filters {
+		all[deviceID] = t.subscriptions(deviceID)
+	}
+	return all
+}
+
+// subscribed reports whether a device is subscribed to a filter.
+func (t *topicTree) subscribed(deviceID, filter string) bool {
+	_, exists := t.filters[deviceID][filter]
+	return exists
+}
+
+// match returns the devices with at least one filter matching a topic, each once.
+func (t *topicTree) match(topic string) []string {
+	found := make(map[string]struct{})
+	t.root.match(topic, strings.Split(topic, "/"), strings.HasPrefix(topic, "$"), found)
+	devices := make([]string, 0, len(found))
+	for deviceID := range found {
+		devices = append(devices, deviceID)
+	}
+	return devices
+}
+
+// match collects the subscribers of the filters below node matching the remaining levels of topic.
+// reserved is set at the first level of a $ topic, where wildcards do not match.
+func (node *topicNode) match(topic string, levels []string, reserved bool, found map[string]struct{}) {
+	if child, exists := node.children["#"]; exists && !reserved {
+		child.collect(topic, found)
+	}
+	if len(levels) == 0 {
+		node.collect(topic, found)
+		return
+	}
+	if child, exists := node.children[levels[0]]; exists {
+		child.match(topic, levels[1:], false, found)
+	}
+	if child, exists := node.children["+"]; exists && !reserved {
+		child.match(topic, levels[1:], false, found)
+	}
+}
+
+// collect adds the subscribers of the filter ending at node that do not exclude topic.
+func (node *topicNode) collect(topic string, found map[string]struct{}) {
+	for deviceID, excluded := range node.subscribers {
+		if !topicExcluded(excluded, topic) {
+			found[deviceID] = struct{}{}
+		}
+	}
+}
+
+// topicExcluded reports whether a topic matches any of the excluded filters.
+func topicExcluded(excluded []string, topic string) bool {
+	for _, filter := range excluded {
+		if TopicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishPermissions remembers whether a device may publish to the topics it has used, until the access
+// rules change.
+type publishPermissions struct {
+	access  *AccessControl  // AccessControl the permissions were checked by; nil allows all
+	version uint64          // AccessControl.RulesVersion the permissions were checked at
+	topics  map[string]bool // Permission of each topic checked, at most maxPublishTopics
+}
+
+// check reports whether a device may publish to a topic, asking access unless the answer is remembered
+// from the same rules. fresh is set when the answer was not remembered.
+func (p *publishPermissions) check(access *AccessControl, deviceID, topic string) (permitted, fresh bool) {
+	var version uint64
+	if access != nil {
+		version = access.RulesVersion()
+	}
+	if p.access != access || p.version != version {
+		p.access, p.version, p.topics = access, version, nil
+	}
+	if permitted, checked := p.topics[topic]; checked {
+		return permitted, false
+	}
+
+	// $ topics are reserved for the server
+	permitted = ValidateTopic(topic) == nil && !strings.HasPrefix(topic, "$")
+	if permitted && access != nil {
+		permitted = access.CheckTopicAccess(deviceID, topic, TopicPublish)
+	}
+	if p.topics == nil || len(p.topics) >= maxPublishTopics {
+		p.topics = make(map[string]bool)
+	}
+	p.topics[topic] = permitted
+	return permitted, true
+}
@@ -0,0 +1,171 @@
+// server/src/modules/route_writer.go
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RouteWriteOptions controls how route writers send messages and when they give up on a slow peer.
+type RouteWriteOptions struct {
+	WriteTimeout     time.Duration // Deadline for writing each message; 0 disables deadlines
+	MaxWriteTimeouts int           // Consecutive timed-out writes that mark the peer as a slow consumer; 0 disables
+	MaxQueueDelay    time.Duration // Time an uncapped message may wait in the queue before the peer is a slow consumer; 0 disables
+	DisconnectSlow   bool          // Whether slow consumers are disconnected and their routes removed
+}
+
+// DefaultRouteWriteOptions returns the write options applied to routes unless others are configured.
+func DefaultRouteWriteOptions() RouteWriteOptions {
+	return RouteWriteOptions{
+		WriteTimeout:     10 * time.Second,
+		MaxWriteTimeouts: 3,
+		MaxQueueDelay:    30 * time.Second,
+		DisconnectSlow:   true,
+	}
+}
+
+// SendResult reports the outcome of one routed message.
+type SendResult struct {
+	DeviceID  string
+	MessageID uint64
+	Class     TrafficClass
+	Bytes     int           // Frame bytes written, which may be fewer than the frame after a timeout
+	Queued    time.Duration // Time the message waited before its write started
+	Err       error         // Nil once the whole frame has been written
+}
+
+// SendFuture completes when a routed message has been written, has failed or has been discarded.
+type SendFuture struct {
+	done   chan struct{}
+	result SendResult
+}
+
+func newSendFuture() *SendFuture {
+	return &SendFuture{done: make(chan struct{})}
+}
+
+// complete records the result; it is used as the message callback and so is called exactly once.
+func (f *SendFuture) complete(result SendResult) {
+	f.result = result
+	close(f.done)
+}
+
+// Done returns a channel that is closed when the result is available.
+func (f *SendFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the result is available or ctx is done.
+func (f *SendFuture) Wait(ctx context.Context) (SendResult, error) {
+	select {
+	case <-f.done:
+		return f.result, f.result.Err
+	case <-ctx.Done():
+		return SendResult{}, ctx.Err()
+	}
+}
+
+// run writes messages in scheduling order until the queue is closed.
+func (q *routeQueue) run() {
+	defer close(q.done)
+	for {
+		q.mutex.Lock()
+		if q.closed {
+			q.mutex.Unlock()
+			return
+		}
+		message, wait, ok := q.next(time.Now())
+		q.mutex.Unlock()
+
+		if !ok {
+			var timer <-chan time.Time
+			if wait > 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-q.wake:
+			case <-timer:
+			}
+			continue
+		}
+		q.write(message)
+	}
+}
+
+// write sends one message under the write deadline, reports the result and checks whether the peer
+// is keeping up.
+func (q *routeQueue) write(message outboundMessage) {
+	started := time.Now()
+	if message.envelope.Expired(started) {
+		q.mutex.Lock()
+		q.classes[message.class].stats.Expired++
+		q.mutex.Unlock()
+		if message.callback != nil {
+			message.callback(SendResult{DeviceID: q.deviceID, MessageID: message.envelope.ID, Class: message.class, Queued: started.Sub(message.enqueued), Err: ErrMessageExpired})
+		}
+		return
+	}
+	if q.options.WriteTimeout > 0 {
+		if err := q.conn.SetWriteDeadline(started.Add(q.options.WriteTimeout)); err != nil {
+			q.logger.Printf("Error setting write deadline for device %s: %v\n", q.deviceID, err)
+		}
+	}
+	written, err := q.conn.Write(message.data)
+	result := SendResult{
+		DeviceID:  q.deviceID,
+		MessageID: message.envelope.ID,
+		Class:     message.class,
+		Bytes:     written,
+		Queued:    started.Sub(message.enqueued),
+		Err:       err,
+	}
+
+	q.mutex.Lock()
+	stats := &q.classes[message.class].stats
+	slow := ""
+	switch {
+	case err == nil:
+		stats.SentMessages++
+		stats.SentBytes += uint64(written)
+		q.timeouts = 0
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		stats.Failed++
+		q.timeouts++
+		q.total++
+		if written > 0 {
+			// The peer has received part of a message, so the stream can no longer be trusted
+			slow = fmt.Sprintf("write timed out after %d of %d bytes", written, len(message.data))
+		} else if q.options.MaxWriteTimeouts > 0 && q.timeouts >= q.options.MaxWriteTimeouts {
+			slow = fmt.Sprintf("%d consecutive write timeouts", q.timeouts)
+		}
+	default:
+		stats.Failed++
+	}
+	// Capped classes wait for their bandwidth by design, so only uncapped ones measure the peer
+	if slow == "" && q.options.MaxQueueDelay > 0 && q.classes[message.class].policy.MaxRate == 0 && result.Queued > q.options.MaxQueueDelay {
+		slow = fmt.Sprintf("%s message waited %s in the queue", message.class, result.Queued.Round(time.Millisecond))
+	}
+	if q.laggard {
+		slow = ""
+	} else if slow != "" {
+		q.laggard = true
+	}
+	q.mutex.Unlock()
+
+	if err != nil {
+		q.logger.Printf("Error routing %s data to device %s: %v\n", message.class, q.deviceID, err)
+	}
+	if message.callback != nil {
+		message.callback(result)
+	}
+	if slow != "" {
+		q.logger.Printf("Device %s is a slow consumer: %s\n", q.deviceID, slow)
+		if q.onSlow != nil {
+			q.onSlow(q, slow)
+		}
+	}
+}
@@ -15,11 +15,31 @@ import (
 
 // RoutingManager manages data routing between devices and external systems, with support for prioritized routing.
 type RoutingManager struct {
-	routes      map[string]net.Conn    // Maps routes to device connections
-	priorityMap map[string]int         // Priority map for routing critical data first
-	routeMutex  sync.RWMutex           // Read-write mutex for managing routes and priorities
-	logger      *log.Logger            // Logger for tracking routing events
-	dessServer  *server.AtServer       // Reference to the DESS server for extended security and routing management
+	routes      map[string]net.Conn     // Maps routes to device connections
+	priorityMap map[string]int          // Priority map for routing critical data first
+	queues      map[string]*routeQueue  // Per-route outbound queues, each with its own sender
+	qosPolicy   QoSPolicy               // Class weights, bandwidth caps and depth limits for new routes
+	writeOpts   RouteWriteOptions       // Write deadlines and slow-consumer limits for new routes
+	health      map[string]*routeHealth // Heartbeat state of each route
+	heartbeat   HeartbeatOptions        // Miss thresholds and TCP keepalive for routes
+	onEvent     func(RouteEvent)        // Receives route state changes; may be nil
+	inbound     func(string, Envelope)  // Receives messages read from routes other than heartbeats; may be nil
+	codec       FrameCodec              // Envelope encoding for new routes
+	ids         *messageIDs             // Source of envelope IDs
+	delivery    *deliveryTracker        // Messages awaiting acks, and IDs received for duplicate suppression
+	topics      *topicTree              // Topic subscriptions of each route
+	access      *AccessControl          // Authorizes subscriptions and publishes by devices; nil allows all
+	authAccess  *AccessControl          // AccessControl the subscriptions were last authorized by
+	authVersion uint64                  // AccessControl.RulesVersion the subscriptions were last authorized at
+	authMutex   sync.Mutex              // Serializes authorizing the subscriptions again
+	bridge      func(Envelope)          // Receives every published message, for other brokers; may be nil
+	observer    func(Envelope)          // Sees every message published to the topics, bridged ones included; may be nil
+	table       *routeTable             // Static routes dialed and maintained by the manager; nil until OpenRouteTable
+	dialTLS     TLSDialFunc             // Dials static routes over TLS; nil uses the system roots
+	stop        chan struct{}           // Closed by Close to stop retransmissions
+	routeMutex  sync.RWMutex            // Read-write mutex for managing routes and priorities
+	logger      *log.Logger             // Logger for tracking routing events
+	dessServer  *server.AtServer        // Reference to the DESS server for extended security and routing management
 }
 
 // NewRoutingManager creates a new RoutingManager instance with DESS integration.
@@ -27,6 +47,16 @@ func NewRoutingManager(logger *log.Logger, dessServer *server.AtServer) *Routing
 	return &RoutingManager{
 		routes:      make(map[string]net.Conn),
 		priorityMap: make(map[string]int),
+		queues:      make(map[string]*routeQueue),
+		qosPolicy:   DefaultQoSPolicy(),
+		writeOpts:   DefaultRouteWriteOptions(),
+		health:      make(map[string]*routeHealth),
+		heartbeat:   DefaultHeartbeatOptions(),
+		codec:       CodecProtobuf,
+		ids:         newMessageIDs(),
+		delivery:    newDeliveryTracker(DefaultDeliveryOptions()),
+		topics:      newTopicTree(),
+		stop:        make(chan struct{}),
 		logger:      logger,
 		dessServer:  dessServer, // Integrating DESS server reference
 	}
@@ -43,8 +73,28 @@ func (rm *RoutingManager) AddRoute(deviceID string, conn net.Conn, priority int)
 		return
 	}
 
+	if conn == nil {
+		rm.logger.Printf("Attempt to add route for device %s without a connection denied.\n", deviceID)
+		return
+	}
+	rm.addRoute(deviceID, conn, priority)
+}
+
+// addRoute adds a route, replacing any the device had; the caller must hold the write lock.
+func (rm *RoutingManager) addRoute(deviceID string, conn net.Conn, priority int) {
+	if err := applyKeepAlive(conn, rm.heartbeat.KeepAlive); err != nil {
+		rm.logger.Printf("Error setting TCP keepalive for device %s: %v\n", deviceID, err)
+	}
+
+	rm.removeRoute(deviceID)
+	queue := newRouteQueue(deviceID, conn, rm.qosPolicy, rm.writeOpts, rm.codec, rm.handleSlowConsumer, rm.logger)
+	health := &routeHealth{deviceID: deviceID, conn: conn, queue: queue, lastSeen: time.Now()}
 	rm.routes[deviceID] = conn
 	rm.priorityMap[deviceID] = priority
+	rm.queues[deviceID] = queue
+	rm.health[deviceID] = health
+	go rm.readRoute(health)
+	rm.delivery.routeAdded(deviceID, time.Now())
 	rm.logger.Printf("Route added for device %s with priority %d\n", deviceID, priority)
 }
 
@@ -52,56 +102,517 @@ func (rm *RoutingManager) AddRoute(deviceID string, conn net.Conn, priority int)
 func (rm *RoutingManager) RemoveRoute(deviceID string) {
 	rm.routeMutex.Lock()
 	defer rm.routeMutex.Unlock()
+	rm.removeRoute(deviceID)
+}
+
+// removeRoute removes a route if there is one; the caller must hold the write lock. The connection is
+// left open for its owner.
+func (rm *RoutingManager) removeRoute(deviceID string) {
+	if _, exists := rm.routes[deviceID]; !exists {
+		return
+	}
+	rm.queues[deviceID].close()
+	rm.health[deviceID].stop()
+	rm.topics.removeDevice(deviceID)
 	delete(rm.routes, deviceID)
 	delete(rm.priorityMap, deviceID)
+	delete(rm.queues, deviceID)
+	delete(rm.health, deviceID)
 	rm.logger.Printf("Route removed for device %s\n", deviceID)
 }
 
-// RouteData routes data to the specified device based on priority.
-func (rm *RoutingManager) RouteData(deviceID string, data []byte) {
-	rm.routeMutex.RLock()
-	defer rm.routeMutex.RUnlock()
+// SetQoSPolicy sets the class weights, bandwidth caps and queue-depth limits applied to routes added afterwards.
+func (rm *RoutingManager) SetQoSPolicy(policy QoSPolicy) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.qosPolicy = policy
+}
 
-	conn, exists := rm.routes[deviceID]
-	if !exists {
-		rm.logger.Printf("No route found for device %s\n", deviceID)
-		return
-	}
+// SetWriteOptions sets the write deadline and slow-consumer limits applied to routes added afterwards.
+func (rm *RoutingManager) SetWriteOptions(options RouteWriteOptions) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.writeOpts = options
+}
 
-	// Log and route data based on priority
-	priority := rm.priorityMap[deviceID]
-	rm.logger.Printf("Routing data for device %s with priority %d\n", deviceID, priority)
+// SetHeartbeatOptions sets the heartbeat miss thresholds, and the TCP keepalive applied to routes added afterwards.
+func (rm *RoutingManager) SetHeartbeatOptions(options HeartbeatOptions) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.heartbeat = options
+}
+
+// SetRouteEventHandler sets the function that receives route state changes.
+func (rm *RoutingManager) SetRouteEventHandler(handler func(RouteEvent)) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.onEvent = handler
+}
 
-	// Attempt to send data to the corresponding connection
-	_, err := conn.Write(data)
+// SetInboundHandler sets the function that receives the messages devices send on their routes, other
+// than heartbeats. Without a handler inbound messages are discarded.
+func (rm *RoutingManager) SetInboundHandler(handler func(deviceID string, envelope Envelope)) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.inbound = handler
+}
+
+// SetFrameCodec sets the envelope encoding used on routes added afterwards. Peers may reply in any codec.
+func (rm *RoutingManager) SetFrameCodec(codec FrameCodec) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.codec = codec
+}
+
+// SetDeliveryOptions sets the retransmission, TTL, persistence and duplicate suppression options.
+func (rm *RoutingManager) SetDeliveryOptions(options DeliveryOptions) {
+	rm.delivery.setOptions(options)
+}
+
+// SetAccessControl sets the AccessControl that authorizes topic subscriptions and the topics devices
+// publish to. Without one, every subscription and publish is allowed.
+func (rm *RoutingManager) SetAccessControl(access *AccessControl) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.access = access
+}
+
+// SetPublishBridge sets a function that receives every message published with Publish or by a device,
+// so another broker can share the topics of the routes. Messages the bridge passes back should use
+// PublishToRoutes, which does not call it again.
+func (rm *RoutingManager) SetPublishBridge(bridge func(envelope Envelope)) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.bridge = bridge
+}
+
+// SetPublishObserver sets a function that sees every message published to the topics, whether by
+// Publish, by a device or through PublishToRoutes from the bridge. It is called on the publisher's
+// goroutine, so it must not block.
+func (rm *RoutingManager) SetPublishObserver(observer func(envelope Envelope)) {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	rm.observer = observer
+}
+
+// OpenOutbox persists unacknowledged messages of the configured classes in the file at path, and
+// resumes delivery of those left from a previous run.
+func (rm *RoutingManager) OpenOutbox(path string) error {
+	outbox, records, err := openRouteOutbox(path, rm.logger)
 	if err != nil {
+		return err
+	}
+	recovered := make([]*pendingDelivery, 0, len(records))
+	for _, record := range records {
+		envelope, err := decodeEnvelopeProtobuf(record.Envelope)
+		if err != nil {
+			rm.logger.Printf("Discarding unreadable outbox message %d: %v\n", record.ID, err)
+			continue
+		}
+		recovered = append(recovered, &pendingDelivery{deviceID: record.DeviceID, envelope: envelope, persisted: true})
+	}
+	if len(recovered) > 0 {
+		rm.logger.Printf("Outbox recovered %d messages pending acknowledgement\n", len(recovered))
+	}
+	if rm.delivery.useOutbox(outbox, recovered) {
+		go rm.retransmitLoop()
+	}
+	return nil
+}
+
+// Close stops retransmissions, closes the outbox and closes the static routes. Other routes are left
+// in place.
+func (rm *RoutingManager) Close() error {
+	select {
+	case <-rm.stop:
+		return nil
+	default:
+		close(rm.stop)
+	}
+	if table := rm.routeTable(); table != nil {
+		rm.closeStaticRoutes(table)
+	}
+	return rm.delivery.closeOutbox()
+}
+
+// RouteData queues data for the specified device as telemetry.
+func (rm *RoutingManager) RouteData(deviceID string, data []byte) {
+	if err := rm.RouteMessage(deviceID, ClassTelemetry, data); err != nil {
 		rm.logger.Printf("Error routing data to device %s: %v\n", deviceID, err)
 	}
 }
 
-// RouteDataByPriority routes data to devices based on their priority, ensuring higher priority data is sent first.
-func (rm *RoutingManager) RouteDataByPriority(data map[string][]byte) {
+// RouteMessage queues data for the specified device in the given traffic class. It returns without
+// waiting for the write; ErrRouteQueueFull is returned when the class queue is at its depth limit.
+func (rm *RoutingManager) RouteMessage(deviceID string, class TrafficClass, data []byte) error {
+	return rm.RouteMessageFunc(deviceID, class, data, nil)
+}
+
+// RouteMessageFunc queues data like RouteMessage and calls callback with the outcome of the write. The
+// callback runs on the route's writer goroutine and must not block; it is not called when an error is returned.
+func (rm *RoutingManager) RouteMessageFunc(deviceID string, class TrafficClass, data []byte, callback func(SendResult)) error {
+	envelope := Envelope{Type: MessageData, Priority: class, ContentType: "application/octet-stream", Payload: data}
+	_, err := rm.RouteEnvelope(deviceID, envelope, callback)
+	return err
+}
+
+// RouteEnvelope queues an envelope for the specified device in the class given by its priority and
+// returns its message ID. A zero ID or timestamp is filled in. The callback is handled as by RouteMessageFunc.
+// While the device's static route is reconnecting the envelope is buffered until it connects, or
+// refused with ErrCircuitOpen or ErrRouteBufferFull.
+func (rm *RoutingManager) RouteEnvelope(deviceID string, envelope Envelope, callback func(SendResult)) (uint64, error) {
 	rm.routeMutex.RLock()
-	defer rm.routeMutex.RUnlock()
+	queue, exists := rm.queues[deviceID]
+	table := rm.table
+	rm.routeMutex.RUnlock()
 
-	// Sort device IDs by their priority
+	if envelope.ID == 0 {
+		envelope.ID = rm.ids.next()
+	}
+	if envelope.Timestamp.IsZero() {
+		envelope.Timestamp = time.Now()
+	}
+	if exists {
+		return envelope.ID, queue.enqueue(envelope, callback)
+	}
+	if table != nil {
+		if static, err := rm.bufferForStaticRoute(table, deviceID, envelope, callback); static {
+			return envelope.ID, err
+		}
+	}
+	return 0, fmt.Errorf("no route found for device %s", deviceID)
+}
+
+// RouteMessageAsync queues data like RouteMessage and returns a future for the outcome of the write.
+// A message that cannot be queued yields an already completed future.
+func (rm *RoutingManager) RouteMessageAsync(deviceID string, class TrafficClass, data []byte) *SendFuture {
+	future := newSendFuture()
+	if err := rm.RouteMessageFunc(deviceID, class, data, future.complete); err != nil {
+		future.complete(SendResult{DeviceID: deviceID, Class: class, Err: err})
+	}
+	return future
+}
+
+// RouteDataByPriority queues data for several devices, higher-priority devices first. Each route
+// sends from its own queue, so a slow device no longer holds up the others.
+func (rm *RoutingManager) RouteDataByPriority(data map[string][]byte) {
+	rm.routeMutex.RLock()
 	sortedDevices := rm.sortDevicesByPriority()
+	rm.routeMutex.RUnlock()
 
 	for _, deviceID := range sortedDevices {
-		conn, exists := rm.routes[deviceID]
+		payload, exists := data[deviceID]
 		if !exists {
-			rm.logger.Printf("No route found for device %s\n", deviceID)
 			continue
 		}
+		rm.RouteData(deviceID, payload)
+	}
+}
+
+// DeliverEnvelope sends an envelope with at-least-once delivery: it is retransmitted with exponential
+// backoff until the device acknowledges it, its TTL expires or the attempts run out. The device need
+// not have a route yet. The callback, which may be nil, receives the outcome and must not block.
+func (rm *RoutingManager) DeliverEnvelope(deviceID string, envelope Envelope, callback func(DeliveryResult)) (uint64, error) {
+	if envelope.Priority < 0 || envelope.Priority >= numTrafficClasses {
+		return 0, fmt.Errorf("invalid traffic class %d", int(envelope.Priority))
+	}
+	if envelope.ID == 0 {
+		envelope.ID = rm.ids.next()
+	}
+	if envelope.Timestamp.IsZero() {
+		envelope.Timestamp = time.Now()
+	}
+	if envelope.TTL == 0 {
+		envelope.TTL = rm.delivery.defaultTTL()
+	}
+	envelope.RequireAck = true
+
+	start, err := rm.delivery.add(&pendingDelivery{deviceID: deviceID, envelope: envelope, callback: callback})
+	if err != nil {
+		return 0, err
+	}
+	if start {
+		go rm.retransmitLoop()
+	}
+	return envelope.ID, nil
+}
+
+// DeliverCommand sends a command to a device in the control class with at-least-once delivery.
+func (rm *RoutingManager) DeliverCommand(deviceID string, contentType string, payload []byte, callback func(DeliveryResult)) (uint64, error) {
+	envelope := Envelope{Type: MessageCommand, Priority: ClassControl, ContentType: contentType, Payload: payload}
+	return rm.DeliverEnvelope(deviceID, envelope, callback)
+}
+
+// PendingDeliveries returns the number of messages awaiting acknowledgement.
+func (rm *RoutingManager) PendingDeliveries() int {
+	return rm.delivery.count()
+}
+
+// retransmitLoop sends acknowledged messages when they are due and reports those that expire or run
+// out of attempts.
+func (rm *RoutingManager) retransmitLoop() {
+	for {
+		now := time.Now()
+		send, finished, next := rm.delivery.due(now)
+		for _, outcome := range finished {
+			rm.logger.Printf("Delivery of message %d to device %s failed after %d attempts: %v\n",
+				outcome.result.MessageID, outcome.result.DeviceID, outcome.result.Attempts, outcome.result.Err)
+			if outcome.callback != nil {
+				outcome.callback(outcome.result)
+			}
+		}
+		for _, delivery := range send {
+			if _, err := rm.RouteEnvelope(delivery.deviceID, delivery.envelope, nil); err != nil {
+				// Usually no route yet; AddRoute makes the message due again
+				rm.delivery.postpone(delivery.envelope.ID, now.Add(rm.delivery.retryPause()))
+				continue
+			}
+			rm.delivery.sent(delivery.envelope.ID, now)
+		}
+		if len(send) > 0 {
+			// The messages just sent are due again later; recompute the wait with them included
+			continue
+		}
+
+		// Expiry is checked at least once a second even when nothing is due
+		wait := time.Second
+		if !next.IsZero() && next.Sub(now) < wait {
+			wait = next.Sub(now)
+		}
+		select {
+		case <-rm.delivery.wake:
+		case <-time.After(wait):
+		case <-rm.stop:
+			return
+		}
+	}
+}
 
-		priority := rm.priorityMap[deviceID]
-		rm.logger.Printf("Routing data for device %s with priority %d\n", deviceID, priority)
+// Subscribe subscribes a route to the topics matching a filter, once AccessControl has checked that
+// the device may. Topics inside the filter that need a role the device lacks are left out. Subscriptions
+// are checked again whenever the access rules change, and those no longer allowed are dropped; they
+// belong to the route and end when it is removed or replaced.
+func (rm *RoutingManager) Subscribe(deviceID, filter string) error {
+	if err := ValidateTopicFilter(filter); err != nil {
+		return err
+	}
+	for {
+		rm.routeMutex.RLock()
+		access := rm.access
+		rm.routeMutex.RUnlock()
+		var version uint64
+		var excluded []string
+		if access != nil {
+			version = access.RulesVersion()
+			var ok bool
+			if excluded, ok = access.AuthorizeSubscription(deviceID, filter); !ok {
+				return fmt.Errorf("%w: device %s may not subscribe to %s", ErrTopicAccessDenied, deviceID, filter)
+			}
+		}
 
-		// Send data to the corresponding connection
-		_, err := conn.Write(data[deviceID])
+		rm.routeMutex.Lock()
+		if rm.access != access || (access != nil && access.RulesVersion() != version) {
+			// The rules changed while the subscription was checked; check it against the new ones
+			rm.routeMutex.Unlock()
+			continue
+		}
+		_, exists := rm.routes[deviceID]
+		if exists && rm.topics.add(deviceID, filter, excluded) {
+			rm.logger.Printf("Device %s subscribed to %s\n", deviceID, filter)
+		}
+		rm.routeMutex.Unlock()
+		if !exists {
+			return fmt.Errorf("no route found for device %s", deviceID)
+		}
+		return nil
+	}
+}
+
+// authorizeSubscriptions checks every subscription again if the access rules changed since they were
+// last checked, updating the topics each leaves out and dropping those no longer allowed.
+func (rm *RoutingManager) authorizeSubscriptions() {
+	rm.authMutex.Lock()
+	defer rm.authMutex.Unlock()
+
+	rm.routeMutex.RLock()
+	access := rm.access
+	var version uint64
+	if access != nil {
+		version = access.RulesVersion()
+	}
+	if rm.authAccess == access && rm.authVersion == version {
+		rm.routeMutex.RUnlock()
+		return
+	}
+	subscribed := rm.topics.all()
+	rm.routeMutex.RUnlock()
+
+	type decision struct {
+		deviceID, filter string
+		excluded         []string
+		allowed          bool
+	}
+	var decisions []decision
+	for deviceID, filters := range subscribed {
+		for _, filter := range filters {
+			d := decision{deviceID: deviceID, filter: filter, allowed: true}
+			if access != nil {
+				d.excluded, d.allowed = access.AuthorizeSubscription(deviceID, filter)
+			}
+			decisions = append(decisions, d)
+		}
+	}
+
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	if rm.access != access {
+		return // Replaced meanwhile; the next check uses the new AccessControl
+	}
+	for _, d := range decisions {
+		switch {
+		case !rm.topics.subscribed(d.deviceID, d.filter):
+		case d.allowed:
+			rm.topics.add(d.deviceID, d.filter, d.excluded)
+		default:
+			rm.topics.remove(d.deviceID, d.filter)
+			rm.logger.Printf("Subscription of device %s to %s dropped: the access rules no longer allow it\n", d.deviceID, d.filter)
+		}
+	}
+	rm.authAccess, rm.authVersion = access, version
+}
+
+// Unsubscribe cancels a route's subscription to a filter and reports whether there was one.
+func (rm *RoutingManager) Unsubscribe(deviceID, filter string) bool {
+	rm.routeMutex.Lock()
+	defer rm.routeMutex.Unlock()
+	if !rm.topics.remove(deviceID, filter) {
+		return false
+	}
+	rm.logger.Printf("Device %s unsubscribed from %s\n", deviceID, filter)
+	return true
+}
+
+// Subscriptions returns the topic filters a route is subscribed to.
+func (rm *RoutingManager) Subscriptions(deviceID string) []string {
+	rm.authorizeSubscriptions()
+	rm.routeMutex.RLock()
+	defer rm.routeMutex.RUnlock()
+	return rm.topics.subscriptions(deviceID)
+}
+
+// Publish sends an envelope to every route subscribed to a filter matching the topic, and returns the
+// number of routes it was queued for. Each route gets its own copy with its own message ID, queued in
+// the class given by the envelope's priority. Envelopes with RequireAck set are delivered at least once
+// as by DeliverEnvelope, others at most once. The envelope is also passed to the publish bridge.
+func (rm *RoutingManager) Publish(topic string, envelope Envelope) (int, error) {
+	envelope, err := publishedEnvelope(topic, envelope)
+	if err != nil {
+		return 0, err
+	}
+	queued := rm.publishToRoutes(envelope)
+
+	rm.routeMutex.RLock()
+	bridge := rm.bridge
+	rm.routeMutex.RUnlock()
+	if bridge != nil {
+		bridge(envelope)
+	}
+	return queued, nil
+}
+
+// PublishToRoutes is Publish without the publish bridge, for messages coming from it.
+func (rm *RoutingManager) PublishToRoutes(topic string, envelope Envelope) (int, error) {
+	envelope, err := publishedEnvelope(topic, envelope)
+	if err != nil {
+		return 0, err
+	}
+	return rm.publishToRoutes(envelope), nil
+}
+
+// publishedEnvelope validates the topic and fills in the fields a published envelope needs.
+func publishedEnvelope(topic string, envelope Envelope) (Envelope, error) {
+	if err := ValidateTopic(topic); err != nil {
+		return envelope, err
+	}
+	envelope.Topic = topic
+	if envelope.Type == 0 {
+		envelope.Type = MessageData
+	}
+	if envelope.Timestamp.IsZero() {
+		envelope.Timestamp = time.Now()
+	}
+	return envelope, nil
+}
+
+// publishToRoutes queues a copy of a published envelope for each subscribed route, and shows it to the
+// publish observer.
+func (rm *RoutingManager) publishToRoutes(envelope Envelope) int {
+	rm.authorizeSubscriptions()
+	rm.routeMutex.RLock()
+	subscribers := rm.topics.match(envelope.Topic)
+	observer := rm.observer
+	rm.routeMutex.RUnlock()
+	if observer != nil {
+		observer(envelope)
+	}
+	// Static routes that are reconnecting buffer what their topics would have received
+	subscribers = append(subscribers, rm.staticSubscribers(envelope.Topic, subscribers)...)
+
+	queued := 0
+	for _, deviceID := range subscribers {
+		message := envelope
+		message.ID = 0
+		var err error
+		if message.RequireAck {
+			_, err = rm.DeliverEnvelope(deviceID, message, nil)
+		} else {
+			_, err = rm.RouteEnvelope(deviceID, message, nil)
+		}
 		if err != nil {
-			rm.logger.Printf("Error routing data to device %s: %v\n", deviceID, err)
+			rm.logger.Printf("Error publishing %s to device %s: %v\n", envelope.Topic, deviceID, err)
+			continue
 		}
+		queued++
+	}
+	return queued
+}
+
+// QueueStats returns the per-class queue depths and counters of a route.
+func (rm *RoutingManager) QueueStats(deviceID string) (RouteQueueStats, bool) {
+	rm.routeMutex.RLock()
+	queue, exists := rm.queues[deviceID]
+	rm.routeMutex.RUnlock()
+
+	if !exists {
+		return RouteQueueStats{}, false
+	}
+	return queue.stats(), true
+}
+
+// RouteHealth returns the heartbeat state of a route.
+func (rm *RoutingManager) RouteHealth(deviceID string) (RouteStatus, bool) {
+	rm.routeMutex.RLock()
+	health, exists := rm.health[deviceID]
+	rm.routeMutex.RUnlock()
+
+	if !exists {
+		return RouteStatus{}, false
+	}
+	return health.status(), true
+}
+
+// handleSlowConsumer disconnects a peer that cannot keep up with its route, unless the route has
+// since been replaced.
+func (rm *RoutingManager) handleSlowConsumer(queue *routeQueue, reason string) {
+	if !queue.options.DisconnectSlow {
+		return
+	}
+	rm.routeMutex.RLock()
+	health, exists := rm.health[queue.deviceID]
+	rm.routeMutex.RUnlock()
+
+	if exists && health.queue == queue {
+		rm.killRoute(health, "slow consumer: "+reason)
 	}
 }
 
@@ -120,7 +631,9 @@ func (rm *RoutingManager) sortDevicesByPriority() []string {
 	return devices
 }
 
-// MonitorRoutes periodically checks the health of all routes and ensures connections remain active.
+// MonitorRoutes sends a heartbeat on every route each interval. A route whose pings go unanswered for
+// HeartbeatOptions.DegradedAfter intervals becomes degraded, and after DeadAfter intervals it is
+// removed and its connection closed. Peers must answer each ping with a pong of the same sequence.
 func (rm *RoutingManager) MonitorRoutes(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
@@ -130,25 +643,160 @@ func (rm *RoutingManager) MonitorRoutes(interval time.Duration) {
 	}()
 }
 
-// checkRoutesHealth inspects the health of each route, ensuring connections are still valid.
+// checkRoutesHealth updates the state of each route from the last round of heartbeats and sends the next.
 func (rm *RoutingManager) checkRoutesHealth() {
 	rm.routeMutex.RLock()
-	defer rm.routeMutex.RUnlock()
+	routes := make([]*routeHealth, 0, len(rm.health))
+	for _, health := range rm.health {
+		routes = append(routes, health)
+	}
+	options := rm.heartbeat
+	rm.routeMutex.RUnlock()
 
-	for deviceID, conn := range rm.routes {
-		if conn == nil || rm.isConnectionClosed(conn) {
-			rm.logger.Printf("Route for device %s is inactive, removing route.\n", deviceID)
-			rm.RemoveRoute(deviceID)
-		} else {
-			rm.logger.Printf("Route for device %s is active.\n", deviceID)
+	// Routes are removed after the read lock is released; RemoveRoute needs the write lock
+	now := time.Now()
+	for _, health := range routes {
+		ping := Envelope{ID: rm.ids.next(), Type: MessagePing, Priority: ClassCritical, Timestamp: now}
+		send, event := health.tick(now, options, ping.ID)
+		if event != nil && event.To == RouteDead {
+			rm.dropRoute(health, event)
+			continue
+		}
+		rm.emit(event)
+		if !send {
+			continue
+		}
+		if err := health.queue.enqueue(ping, nil); err != nil && err != ErrRouteClosed {
+			rm.logger.Printf("Error sending heartbeat to device %s: %v\n", health.deviceID, err)
+		}
+	}
+}
+
+// readRoute reads frames from the peer until the route is removed or the connection fails. Pings are
+// answered, pongs update the route's health, acks complete deliveries and other messages go to the
+// inbound handler, once each. A frame that cannot be decoded ends the route, as the stream cannot be
+// resynchronised. Subscription requests are answered with an ack, and messages with a topic are also
+// published to its subscribers.
+func (rm *RoutingManager) readRoute(health *routeHealth) {
+	reader := NewFrameReader(health.conn)
+	var publishable publishPermissions
+	for {
+		envelope, _, err := reader.ReadEnvelope()
+		if err != nil {
+			if !health.isStopped() {
+				rm.killRoute(health, fmt.Sprintf("connection failed: %v", err))
+			}
+			return
+		}
+		now := time.Now()
+		health.seen(now)
+
+		switch envelope.Type {
+		case MessagePing:
+			pong := Envelope{ID: rm.ids.next(), CorrelationID: envelope.ID, Type: MessagePong, Priority: ClassCritical, Timestamp: now}
+			health.queue.enqueue(pong, nil)
+		case MessagePong:
+			rm.emit(health.pong(envelope.CorrelationID, now))
+		case MessageAck:
+			if outcome, ok := rm.delivery.ack(health.deviceID, envelope.CorrelationID, now); ok && outcome.callback != nil {
+				outcome.callback(outcome.result)
+			}
+		case MessageSubscribe, MessageUnsubscribe:
+			rm.answerSubscription(health, envelope, now)
+		default:
+			if envelope.Expired(now) {
+				rm.logger.Printf("Dropping expired %s message %d from device %s\n", envelope.Type, envelope.ID, health.deviceID)
+				continue
+			}
+			if envelope.RequireAck {
+				ack := Envelope{ID: rm.ids.next(), CorrelationID: envelope.ID, Type: MessageAck, Priority: ClassCritical, Timestamp: now}
+				health.queue.enqueue(ack, nil)
+				// Retransmissions are acknowledged again but delivered only once
+				if !rm.delivery.firstReceipt(health.deviceID, envelope.ID, now) {
+					continue
+				}
+			}
+			if envelope.Topic != "" {
+				rm.publishFromRoute(health.deviceID, envelope, &publishable)
+			}
+			rm.routeMutex.RLock()
+			handler := rm.inbound
+			rm.routeMutex.RUnlock()
+			if handler != nil {
+				handler(health.deviceID, envelope)
+			}
 		}
 	}
 }
 
-// isConnectionClosed checks if a given connection is closed.
-func (rm *RoutingManager) isConnectionClosed(conn net.Conn) bool {
-	// Placeholder for connection health check logic
-	// Replace with actual implementation as needed
-	_, err := conn.Write([]byte{})
-	return err != nil
+// answerSubscription applies a device's subscribe or unsubscribe request, whose payload is the topic
+// filter. The ack in reply has an empty payload on success and the reason otherwise.
+func (rm *RoutingManager) answerSubscription(health *routeHealth, request Envelope, now time.Time) {
+	filter := string(request.Payload)
+	var err error
+	if request.Type == MessageSubscribe {
+		err = rm.Subscribe(health.deviceID, filter)
+	} else {
+		rm.Unsubscribe(health.deviceID, filter)
+	}
+
+	ack := Envelope{ID: rm.ids.next(), CorrelationID: request.ID, Type: MessageAck, Priority: ClassCritical, Timestamp: now}
+	if err != nil {
+		rm.logger.Printf("Refused subscription of device %s to %q: %v\n", health.deviceID, filter, err)
+		ack.ContentType = "text/plain"
+		ack.Payload = []byte(err.Error())
+	}
+	health.queue.enqueue(ack, nil)
+}
+
+// publishFromRoute publishes a message a device sent with a topic. Whether the device may publish to a
+// topic is checked the first time it does, and remembered in allowed until the access rules change.
+func (rm *RoutingManager) publishFromRoute(deviceID string, envelope Envelope, allowed *publishPermissions) {
+	topic := envelope.Topic
+	rm.routeMutex.RLock()
+	access := rm.access
+	rm.routeMutex.RUnlock()
+	permitted, fresh := allowed.check(access, deviceID, topic)
+	if !permitted && fresh {
+		rm.logger.Printf("Device %s may not publish to %q; its messages to the topic are dropped\n", deviceID, topic)
+	}
+	if permitted {
+		rm.Publish(topic, envelope)
+	}
+}
+
+// killRoute marks a route dead, removes it and closes its connection.
+func (rm *RoutingManager) killRoute(health *routeHealth, reason string) {
+	if event := health.kill(time.Now(), reason); event != nil {
+		rm.dropRoute(health, event)
+	}
+}
+
+// dropRoute removes a dead route unless it has since been replaced, closes its connection and reports the event.
+func (rm *RoutingManager) dropRoute(health *routeHealth, event *RouteEvent) {
+	rm.routeMutex.Lock()
+	if rm.health[health.deviceID] == health {
+		rm.removeRoute(health.deviceID)
+	}
+	rm.routeMutex.Unlock()
+
+	if err := health.conn.Close(); err != nil {
+		rm.logger.Printf("Error closing connection of device %s: %v\n", health.deviceID, err)
+	}
+	rm.emit(event)
+}
+
+// emit logs a route state change and passes it to the event handler.
+func (rm *RoutingManager) emit(event *RouteEvent) {
+	if event == nil {
+		return
+	}
+	rm.logger.Printf("Route for device %s is %s: %s\n", event.DeviceID, event.To, event.Reason)
+
+	rm.routeMutex.RLock()
+	handler := rm.onEvent
+	rm.routeMutex.RUnlock()
+	if handler != nil {
+		handler(*event)
+	}
 }
@@ -0,0 +1,230 @@
+// server/src/modules/sample_ring.go
+
+package modules
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens to samples arriving while the ingestion buffer is full.
+type OverflowPolicy int
+
+const (
+	OverflowDropOldest OverflowPolicy = iota // Overwrite the oldest buffered sample
+	OverflowDropNewest                       // Discard the arriving sample
+	OverflowBlock                            // Block the producer until the buffer drains
+)
+
+// String returns the configuration name of the policy.
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowBlock:
+		return "block"
+	default:
+		return "drop-oldest"
+	}
+}
+
+// ParseOverflowPolicy parses "drop-oldest", "drop-newest" or "block".
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "drop-oldest":
+		return OverflowDropOldest, nil
+	case "drop-newest":
+		return OverflowDropNewest, nil
+	case "block":
+		return OverflowBlock, nil
+	default:
+		return OverflowDropOldest, fmt.Errorf("unknown overflow policy %q", name)
+	}
+}
+
+// IngestOptions sizes the ingestion buffer between producers and the processing loop.
+type IngestOptions struct {
+	Capacity int            // Total samples buffered across all shards
+	Shards   int            // Independently locked shards; producers are spread across them
+	Overflow OverflowPolicy // Behaviour when a shard is full
+}
+
+// DefaultIngestOptions returns the ingestion options used when none are configured.
+func DefaultIngestOptions() IngestOptions {
+	return IngestOptions{
+		Capacity: 65536,
+		Shards:   runtime.GOMAXPROCS(0),
+		Overflow: OverflowDropOldest,
+	}
+}
+
+// IngestStats reports counters for the ingestion buffer since the engine was created.
+type IngestStats struct {
+	Accepted      int64 // Samples written into the buffer
+	DroppedOldest int64 // Buffered samples overwritten by newer ones
+	DroppedNewest int64 // Arriving samples rejected because the buffer was full or closed
+	Blocked       int64 // Times a producer had to wait for space
+	Buffered      int   // Samples currently waiting to be processed
+}
+
+// ringShard is a fixed-size circular buffer guarded by its own mutex.
+type ringShard struct {
+	mutex   sync.Mutex
+	notFull *sync.Cond
+	buffer  []Sample
+	head    int // Index of the oldest sample
+	count   int // Number of buffered samples
+	closed  bool
+}
+
+// sampleRing is a bounded, sharded buffer of samples. Sharding keeps concurrent producers
+// from contending on a single lock; per-shard order is preserved, global order is not.
+type sampleRing struct {
+	accepted      int64 // Counters come first to keep them 64-bit aligned for sync/atomic
+	droppedOldest int64
+	droppedNewest int64
+	blocked       int64
+	next          uint32 // Round-robin cursor for shard selection
+	shards        []*ringShard
+	policy        OverflowPolicy
+}
+
+// newSampleRing creates a ring with the capacity split evenly across shards.
+func newSampleRing(options IngestOptions) *sampleRing {
+	defaults := DefaultIngestOptions()
+	if options.Capacity <= 0 {
+		options.Capacity = defaults.Capacity
+	}
+	if options.Shards <= 0 {
+		options.Shards = defaults.Shards
+	}
+	if options.Shards > options.Capacity {
+		options.Shards = options.Capacity
+	}
+
+	perShard := (options.Capacity + options.Shards - 1) / options.Shards
+	ring := &sampleRing{
+		shards: make([]*ringShard, options.Shards),
+		policy: options.Overflow,
+	}
+	for i := range ring.shards {
+		shard := &ringShard{buffer: make([]Sample, perShard)}
+		shard.notFull = sync.NewCond(&shard.mutex)
+		ring.shards[i] = shard
+	}
+	return ring
+}
+
+// push writes samples into a single shard under one lock acquisition and applies the overflow policy.
+func (r *sampleRing) push(samples []Sample) {
+	r.pushWith(samples, r.policy)
+}
+
+// pushNonBlocking writes samples like push, but rejects them as under OverflowDropNewest where the
+// policy would block. It is for producers on the goroutine that drains the ring, which would otherwise
+// wait for themselves.
+func (r *sampleRing) pushNonBlocking(samples []Sample) {
+	policy := r.policy
+	if policy == OverflowBlock {
+		policy = OverflowDropNewest
+	}
+	r.pushWith(samples, policy)
+}
+
+// pushWith writes samples into a single shard under one lock acquisition and applies the given overflow policy.
+func (r *sampleRing) pushWith(samples []Sample, policy OverflowPolicy) {
+	if len(samples) == 0 {
+		return
+	}
+	shard := r.shards[atomic.AddUint32(&r.next, 1)%uint32(len(r.shards))]
+	size := len(shard.buffer)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	var accepted, droppedOldest int64
+	rejected := 0
+fill:
+	for i, sample := range samples {
+		if shard.count == size && !shard.closed {
+			switch policy {
+			case OverflowDropNewest:
+				rejected = len(samples) - i
+				break fill
+			case OverflowBlock:
+				atomic.AddInt64(&r.blocked, 1)
+				for shard.count == size && !shard.closed {
+					shard.notFull.Wait()
+				}
+			default:
+				shard.head = (shard.head + 1) % size
+				shard.count--
+				droppedOldest++
+			}
+		}
+		if shard.closed {
+			rejected = len(samples) - i
+			break
+		}
+		shard.buffer[(shard.head+shard.count)%size] = sample
+		shard.count++
+		accepted++
+	}
+	atomic.AddInt64(&r.accepted, accepted)
+	atomic.AddInt64(&r.droppedOldest, droppedOldest)
+	atomic.AddInt64(&r.droppedNewest, int64(rejected))
+}
+
+// drain removes and returns every buffered sample, waking producers blocked on full shards.
+func (r *sampleRing) drain() []Sample {
+	samples := make([]Sample, 0, r.buffered())
+	for _, shard := range r.shards {
+		shard.mutex.Lock()
+		size := len(shard.buffer)
+		for i := 0; i < shard.count; i++ {
+			index := (shard.head + i) % size
+			samples = append(samples, shard.buffer[index])
+			shard.buffer[index] = Sample{} // Release the series string for the collector
+		}
+		shard.head = 0
+		shard.count = 0
+		shard.notFull.Broadcast()
+		shard.mutex.Unlock()
+	}
+	return samples
+}
+
+// buffered returns the number of samples currently held across all shards.
+func (r *sampleRing) buffered() int {
+	total := 0
+	for _, shard := range r.shards {
+		shard.mutex.Lock()
+		total += shard.count
+		shard.mutex.Unlock()
+	}
+	return total
+}
+
+// close rejects further samples and releases any blocked producers.
+func (r *sampleRing) close() {
+	for _, shard := range r.shards {
+		shard.mutex.Lock()
+		shard.closed = true
+		shard.notFull.Broadcast()
+		shard.mutex.Unlock()
+	}
+}
+
+// stats returns a snapshot of the ring's counters.
+func (r *sampleRing) stats() IngestStats {
+	return IngestStats{
+		Accepted:      atomic.LoadInt64(&r.accepted),
+		DroppedOldest: atomic.LoadInt64(&r.droppedOldest),
+		DroppedNewest: atomic.LoadInt64(&r.droppedNewest),
+		Blocked:       atomic.LoadInt64(&r.blocked),
+		Buffered:      r.buffered(),
+	}
+}
@@ -0,0 +1,159 @@
+// server/src/modules/sample_ring_test.go
+
+package modules
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestEngine creates an analytics engine with a single-shard ingestion buffer of the given capacity.
+func newTestEngine(capacity int, policy OverflowPolicy) *AnalyticsEngine {
+	options := IngestOptions{Capacity: capacity, Shards: 1, Overflow: policy}
+	return NewAnalyticsEngineWithOptions(3, log.New(io.Discard, "", 0), nil, nil, options)
+}
+
+// testSamples returns n samples of one series with values 0..n-1.
+func testSamples(n int) []Sample {
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	samples := make([]Sample, n)
+	for i := range samples {
+		samples[i] = Sample{Series: "line1.flow", Timestamp: start.Add(time.Duration(i) * time.Second), Value: float64(i)}
+	}
+	return samples
+}
+
+func TestIngestStatsDropOldest(t *testing.T) {
+	engine := newTestEngine(4, OverflowDropOldest)
+	engine.AddBatch(testSamples(6))
+
+	stats := engine.IngestStats()
+	if stats.Accepted != 6 || stats.DroppedOldest != 2 || stats.DroppedNewest != 0 || stats.Buffered != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	drained := engine.ingest.drain()
+	if len(drained) != 4 || drained[0].Value != 2 || drained[3].Value != 5 {
+		t.Fatalf("oldest samples were not the ones dropped: %+v", drained)
+	}
+}
+
+func TestIngestStatsDropNewest(t *testing.T) {
+	engine := newTestEngine(4, OverflowDropNewest)
+	engine.AddBatch(testSamples(6))
+
+	stats := engine.IngestStats()
+	if stats.Accepted != 4 || stats.DroppedNewest != 2 || stats.DroppedOldest != 0 || stats.Buffered != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	drained := engine.ingest.drain()
+	if len(drained) != 4 || drained[3].Value != 3 {
+		t.Fatalf("newest samples were not the ones dropped: %+v", drained)
+	}
+}
+
+func TestIngestStatsBlock(t *testing.T) {
+	engine := newTestEngine(4, OverflowBlock)
+	done := make(chan struct{})
+	go func() {
+		engine.AddBatch(testSamples(6))
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for engine.IngestStats().Blocked == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("producer did not block on a full buffer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	engine.ingest.drain()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("producer was not released by the drain")
+	}
+
+	stats := engine.IngestStats()
+	if stats.Accepted != 6 || stats.DroppedOldest != 0 || stats.DroppedNewest != 0 || stats.Blocked != 1 || stats.Buffered != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// derivingStage feeds derived samples back into the engine when it is evaluated, as pipelines and
+// user functions do.
+type derivingStage struct {
+	engine  *AnalyticsEngine
+	samples []Sample
+}
+
+func (s *derivingStage) Add(string, time.Time, float64) {}
+
+func (s *derivingStage) Evaluate(time.Time) {
+	s.engine.AddDerived(s.samples)
+}
+
+func TestDerivedSamplesDoNotBlockProcessing(t *testing.T) {
+	engine := newTestEngine(2, OverflowBlock)
+	engine.AddStage(&derivingStage{engine: engine, samples: testSamples(3)})
+
+	done := make(chan struct{})
+	go func() {
+		engine.ProcessData()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("processing cycle blocked on its own derived samples")
+	}
+
+	stats := engine.IngestStats()
+	if stats.Accepted != 2 || stats.DroppedNewest != 1 || stats.Blocked != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+// BenchmarkAddBatch measures concurrent producers adding batches of 64 samples while a consumer drains
+// the buffer, for each overflow policy and several shard counts.
+func BenchmarkAddBatch(b *testing.B) {
+	batch := testSamples(64)
+	for _, policy := range []OverflowPolicy{OverflowDropOldest, OverflowDropNewest, OverflowBlock} {
+		for _, shards := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("%s/shards=%d", policy, shards), func(b *testing.B) {
+				options := IngestOptions{Capacity: 65536, Shards: shards, Overflow: policy}
+				engine := NewAnalyticsEngineWithOptions(3, log.New(io.Discard, "", 0), nil, nil, options)
+
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							engine.ingest.drain()
+						}
+					}
+				}()
+
+				b.ReportAllocs()
+				b.SetBytes(int64(len(batch)))
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						engine.AddBatch(batch)
+					}
+				})
+				b.StopTimer()
+				close(stop)
+				wg.Wait()
+			})
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// server/src/modules/smtp_notifier.go
+
+package modules
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier emails alerts to a fixed list of recipients.
+type SMTPNotifier struct {
+	addr     string   // SMTP server address in host:port form
+	username string   // Username for PLAIN authentication; authentication is skipped when empty
+	password string   // Password for PLAIN authentication
+	from     string   // Envelope and header sender address
+	to       []string // Recipient addresses
+}
+
+// NewSMTPNotifier creates an email notifier that relays through the given SMTP server.
+func NewSMTPNotifier(addr, username, password, from string, to []string) *SMTPNotifier {
+	return &SMTPNotifier{
+		addr:     addr,
+		username: username,
+		password: password,
+		from:     from,
+		to:       to,
+	}
+}
+
+// Name identifies the notifier in logs and dead letters.
+func (sn *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+// Notify sends the alert as a plain-text email, upgrading to TLS when the server offers STARTTLS.
+func (sn *SMTPNotifier) Notify(ctx context.Context, alert Alert) error {
+	if len(sn.to) == 0 {
+		return fmt.Errorf("no email recipients configured")
+	}
+
+	host, _, err := net.SplitHostPort(sn.addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address %s: %w", sn.addr, err)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", sn.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("SMTP handshake failed: %w", err)
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if sn.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", sn.username, sn.password, host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(sn.from); err != nil {
+		return fmt.Errorf("SMTP MAIL FROM rejected: %w", err)
+	}
+	for _, recipient := range sn.to {
+		if err := client.Rcpt(recipient); err != nil {
+			return fmt.Errorf("SMTP RCPT TO %s rejected: %w", recipient, err)
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("SMTP DATA rejected: %w", err)
+	}
+	if _, err := writer.Write(sn.buildMessage(alert)); err != nil {
+		writer.Close()
+		return fmt.Errorf("failed to write email body: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("SMTP server rejected message: %w", err)
+	}
+
+	return client.Quit()
+}
+
+// buildMessage renders the alert as an RFC 5322 message.
+func (sn *SMTPNotifier) buildMessage(alert Alert) []byte {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", sn.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(sn.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [Nimbus] %s alert from %s\r\n", strings.ToUpper(string(alert.Severity)), alert.Source)
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@nimbus>\r\n", alert.ID)
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+
+	fmt.Fprintf(&msg, "%s\r\n\r\n", alert.Message)
+	fmt.Fprintf(&msg, "Alert ID: %s\r\n", alert.ID)
+	fmt.Fprintf(&msg, "Source:   %s\r\n", alert.Source)
+	fmt.Fprintf(&msg, "Severity: %s\r\n", alert.Severity)
+	fmt.Fprintf(&msg, "Time:     %s\r\n", alert.Timestamp.Format(time.RFC3339))
+
+	// Sort detail keys so repeated alerts render identically
+	keys := make([]string, 0, len(alert.Details))
+	for key := range alert.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&msg, "%s: %v\r\n", key, alert.Details[key])
+	}
+
+	return []byte(msg.String())
+}
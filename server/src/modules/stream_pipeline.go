@@ -0,0 +1,421 @@
+// server/src/modules/stream_pipeline.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PipelineStageConfig declares one stage of a pipeline graph.
+type PipelineStageConfig struct {
+	ID     string                 `json:"id"`     // Unique stage name within the pipeline
+	Op     string                 `json:"op"`     // Operator, e.g. source, deadband, convert, window, aggregate, threshold, alert
+	Inputs []string               `json:"inputs"` // Upstream stage IDs; several inputs merge (fan-in)
+	Params map[string]interface{} `json:"params"` // Operator parameters
+}
+
+// PipelineConfig declares a pipeline either as a linear flow string or as a stage graph.
+//
+// The flow form chains operators with "|", for example
+//
+//	source(boiler.*.temp) | convert(from=degF, to=degC) | deadband(band=0.2) | window(size=1m) | aggregate(mean, max) | derive
+//
+// The stage form lists stages with explicit inputs, so one stage can feed several others (fan-out)
+// and a stage can consume several upstream stages (fan-in).
+type PipelineConfig struct {
+	Name   string                `json:"name"`
+	Flow   string                `json:"flow,omitempty"`
+	Stages []PipelineStageConfig `json:"stages,omitempty"`
+	Buffer int                   `json:"buffer"` // Channel capacity between stages, default 1024
+}
+
+// LoadPipelineConfigs reads pipelines from a JSON file containing an array of PipelineConfig.
+func LoadPipelineConfigs(filePath string) ([]PipelineConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pipeline config %s: %w", filePath, err)
+	}
+	var configs []PipelineConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config %s: %w", filePath, err)
+	}
+	return configs, nil
+}
+
+// parsePipelineFlow expands a flow string into a linear chain of stages.
+func parsePipelineFlow(flow string) ([]PipelineStageConfig, error) {
+	steps := splitTopLevel(flow, '|')
+	stages := make([]PipelineStageConfig, 0, len(steps))
+	for i, step := range steps {
+		step = strings.TrimSpace(step)
+		op, argList := step, ""
+		if open := strings.IndexByte(step, '('); open >= 0 {
+			if !strings.HasSuffix(step, ")") {
+				return nil, fmt.Errorf("flow step %d (%q) is missing a closing parenthesis", i+1, step)
+			}
+			op, argList = strings.TrimSpace(step[:open]), step[open+1:len(step)-1]
+		}
+		if op == "" {
+			return nil, fmt.Errorf("flow step %d is empty", i+1)
+		}
+
+		params := make(map[string]interface{})
+		positional := make([]string, 0)
+		for _, arg := range splitTopLevel(argList, ',') {
+			arg = strings.TrimSpace(arg)
+			if arg == "" {
+				continue
+			}
+			if key, value, found := strings.Cut(arg, "="); found {
+				params[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			} else {
+				positional = append(positional, arg)
+			}
+		}
+		if len(positional) > 0 {
+			params["args"] = positional
+		}
+
+		stage := PipelineStageConfig{ID: fmt.Sprintf("%d-%s", i+1, op), Op: op, Params: params}
+		if i > 0 {
+			stage.Inputs = []string{stages[i-1].ID}
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// splitTopLevel splits s on sep, ignoring separators inside parentheses.
+func splitTopLevel(s string, sep byte) []string {
+	parts := make([]string, 0)
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// pipelineEnv gives operators access to the outputs of the processor they run in.
+type pipelineEnv struct {
+	pipeline string
+	logger   *log.Logger
+	derive   func(Sample)
+	raise    func(Alert)
+}
+
+// pipelineStage is a running stage: an operator, its input channel and its downstream stages.
+type pipelineStage struct {
+	id      string
+	op      pipelineOperator
+	input   chan pipelineRecord
+	outputs []*pipelineStage
+	pending int32 // Upstream producers still running; the input is closed when it reaches zero
+}
+
+// release signals that one upstream producer has finished.
+func (s *pipelineStage) release() {
+	if atomic.AddInt32(&s.pending, -1) == 0 {
+		close(s.input)
+	}
+}
+
+// streamPipeline is one running pipeline graph.
+type streamPipeline struct {
+	dropped int64 // Samples dropped because a source channel was full; first for 64-bit alignment
+	name    string
+	stages  []*pipelineStage
+	sources []*pipelineStage
+	routes  sync.Map // Series name to []*pipelineStage sources selecting it
+	loops   sync.Map // Derived series refused because the pipeline's own sources select them
+}
+
+// StreamProcessor runs configured pipelines as goroutines connected by bounded channels.
+// It is an AnalyticsStage: samples enter through Add and watermarks through Evaluate.
+type StreamProcessor struct {
+	pipelines  []*streamPipeline
+	derive     func([]Sample) // Receives derived series, normally AnalyticsEngine.AddDerived
+	alert      func(Alert)    // Receives pipeline alerts
+	closeMutex sync.RWMutex   // Guards closed against concurrent sends
+	closed     bool           // Set once Close has started
+	stageGroup sync.WaitGroup // Tracks running stage goroutines
+	logger     *log.Logger    // Logger for tracking pipeline events
+}
+
+// NewStreamProcessor validates and starts the configured pipelines.
+func NewStreamProcessor(logger *log.Logger, configs []PipelineConfig, derive func([]Sample), alert func(Alert)) (*StreamProcessor, error) {
+	processor := &StreamProcessor{derive: derive, alert: alert, logger: logger}
+
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if config.Name == "" || names[config.Name] {
+			return nil, fmt.Errorf("pipelines need unique names, got %q", config.Name)
+		}
+		names[config.Name] = true
+
+		pipeline, err := processor.buildPipeline(config)
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %w", config.Name, err)
+		}
+		processor.pipelines = append(processor.pipelines, pipeline)
+	}
+
+	for _, pipeline := range processor.pipelines {
+		for _, stage := range pipeline.stages {
+			processor.stageGroup.Add(1)
+			go processor.runStage(stage)
+		}
+		logger.Printf("Pipeline %s started with %d stages\n", pipeline.name, len(pipeline.stages))
+	}
+	return processor, nil
+}
+
+// buildPipeline creates the operators of a pipeline and wires its stages, rejecting invalid graphs.
+func (sp *StreamProcessor) buildPipeline(config PipelineConfig) (*streamPipeline, error) {
+	stageConfigs := config.Stages
+	if config.Flow != "" {
+		if len(stageConfigs) > 0 {
+			return nil, fmt.Errorf("declare either flow or stages, not both")
+		}
+		parsed, err := parsePipelineFlow(config.Flow)
+		if err != nil {
+			return nil, err
+		}
+		stageConfigs = parsed
+	}
+	if len(stageConfigs) == 0 {
+		return nil, fmt.Errorf("no stages declared")
+	}
+	buffer := config.Buffer
+	if buffer <= 0 {
+		buffer = 1024
+	}
+
+	pipeline := &streamPipeline{name: config.Name}
+	env := &pipelineEnv{
+		pipeline: config.Name,
+		logger:   sp.logger,
+		derive: func(sample Sample) {
+			// A derived series selected by the pipeline's own sources would loop forever
+			if len(pipeline.sourcesFor(sample.Series)) > 0 {
+				if _, warned := pipeline.loops.LoadOrStore(sample.Series, true); !warned {
+					sp.logger.Printf("Pipeline %s: derived series %s is selected by its own source and was not emitted; rename it first\n", pipeline.name, sample.Series)
+				}
+				return
+			}
+			if sp.derive != nil {
+				sp.derive([]Sample{sample})
+			}
+		},
+		raise: func(alert Alert) {
+			sp.logger.Println(alert.Message)
+			if sp.alert != nil {
+				sp.alert(alert)
+			}
+		},
+	}
+
+	byID := make(map[string]*pipelineStage, len(stageConfigs))
+	for _, stageConfig := range stageConfigs {
+		if stageConfig.ID == "" || byID[stageConfig.ID] != nil {
+			return nil, fmt.Errorf("stages need unique IDs, got %q", stageConfig.ID)
+		}
+		factory, known := pipelineOperators[stageConfig.Op]
+		if !known {
+			return nil, fmt.Errorf("stage %s: unknown operator %q", stageConfig.ID, stageConfig.Op)
+		}
+		op, err := factory(stageParams(stageConfig.Params), env)
+		if err != nil {
+			return nil, fmt.Errorf("stage %s: %w", stageConfig.ID, err)
+		}
+		stage := &pipelineStage{id: stageConfig.ID, op: op, input: make(chan pipelineRecord, buffer)}
+		byID[stageConfig.ID] = stage
+		pipeline.stages = append(pipeline.stages, stage)
+	}
+
+	for i, stageConfig := range stageConfigs {
+		stage := pipeline.stages[i]
+		if _, isSource := stage.op.(*sourceOperator); isSource {
+			if len(stageConfig.Inputs) > 0 {
+				return nil, fmt.Errorf("stage %s: sources cannot have inputs", stage.id)
+			}
+			stage.pending = 1 // Released by Close
+			pipeline.sources = append(pipeline.sources, stage)
+			continue
+		}
+		if len(stageConfig.Inputs) == 0 {
+			return nil, fmt.Errorf("stage %s: needs at least one input", stage.id)
+		}
+		for _, inputID := range stageConfig.Inputs {
+			upstream := byID[inputID]
+			if upstream == nil {
+				return nil, fmt.Errorf("stage %s: unknown input %q", stage.id, inputID)
+			}
+			upstream.outputs = append(upstream.outputs, stage)
+			stage.pending++
+		}
+	}
+	if len(pipeline.sources) == 0 {
+		return nil, fmt.Errorf("no source stage declared")
+	}
+	if err := checkPipelineAcyclic(pipeline.stages); err != nil {
+		return nil, err
+	}
+	return pipeline, nil
+}
+
+// checkPipelineAcyclic rejects graphs with cycles, which could deadlock on full channels.
+func checkPipelineAcyclic(stages []*pipelineStage) error {
+	indegree := make(map[*pipelineStage]int, len(stages))
+	for _, stage := range stages {
+		for _, output := range stage.outputs {
+			indegree[output]++
+		}
+	}
+	queue := make([]*pipelineStage, 0, len(stages))
+	for _, stage := range stages {
+		if indegree[stage] == 0 {
+			queue = append(queue, stage)
+		}
+	}
+	visited := 0
+	for len(queue) > 0 {
+		stage := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, output := range stage.outputs {
+			indegree[output]--
+			if indegree[output] == 0 {
+				queue = append(queue, output)
+			}
+		}
+	}
+	if visited != len(stages) {
+		return fmt.Errorf("stage inputs form a cycle")
+	}
+	return nil
+}
+
+// runStage applies a stage's operator to its input until every upstream producer has finished.
+func (sp *StreamProcessor) runStage(stage *pipelineStage) {
+	defer sp.stageGroup.Done()
+	defer func() {
+		for _, output := range stage.outputs {
+			output.release()
+		}
+	}()
+
+	emit := func(record pipelineRecord) {
+		for _, output := range stage.outputs {
+			output.input <- record
+		}
+	}
+	for record := range stage.input {
+		if record.tick {
+			if ticker, ok := stage.op.(pipelineTicker); ok {
+				ticker.tick(record.sample.Timestamp, emit)
+			}
+			emit(record) // Forward the watermark so downstream windows can close too
+			continue
+		}
+		stage.op.process(record, emit)
+	}
+}
+
+// Add routes a sample to every source that selects its series. It never blocks: samples arriving while
+// a source channel is full are dropped and counted.
+func (sp *StreamProcessor) Add(series string, timestamp time.Time, value float64) {
+	sp.closeMutex.RLock()
+	defer sp.closeMutex.RUnlock()
+	if sp.closed {
+		return
+	}
+
+	record := pipelineRecord{sample: Sample{Series: series, Timestamp: timestamp, Value: value}}
+	for _, pipeline := range sp.pipelines {
+		for _, source := range pipeline.sourcesFor(series) {
+			select {
+			case source.input <- record:
+			default:
+				atomic.AddInt64(&pipeline.dropped, 1)
+			}
+		}
+	}
+}
+
+// sourcesFor returns the source stages selecting a series, caching the result.
+func (p *streamPipeline) sourcesFor(series string) []*pipelineStage {
+	if cached, found := p.routes.Load(series); found {
+		return cached.([]*pipelineStage)
+	}
+	matches := make([]*pipelineStage, 0)
+	for _, source := range p.sources {
+		if source.op.(*sourceOperator).matches(series) {
+			matches = append(matches, source)
+		}
+	}
+	p.routes.Store(series, matches)
+	return matches
+}
+
+// Evaluate sends a watermark through every pipeline so windows whose time has passed are emitted.
+func (sp *StreamProcessor) Evaluate(now time.Time) {
+	sp.closeMutex.RLock()
+	defer sp.closeMutex.RUnlock()
+	if sp.closed {
+		return
+	}
+
+	for _, pipeline := range sp.pipelines {
+		if dropped := atomic.SwapInt64(&pipeline.dropped, 0); dropped > 0 {
+			sp.logger.Printf("Pipeline %s dropped %d samples: source buffer full\n", pipeline.name, dropped)
+		}
+		for _, source := range pipeline.sources {
+			select {
+			case source.input <- pipelineRecord{sample: Sample{Timestamp: now}, tick: true}:
+			default:
+				// The source is saturated; the next watermark will close the windows
+			}
+		}
+	}
+}
+
+// Close flushes open windows, stops accepting samples and waits for every stage to drain.
+func (sp *StreamProcessor) Close() error {
+	sp.closeMutex.Lock()
+	if sp.closed {
+		sp.closeMutex.Unlock()
+		return nil
+	}
+	sp.closed = true
+	sp.closeMutex.Unlock()
+
+	// A watermark at the end of time emits every open window before the channels close
+	final := pipelineRecord{sample: Sample{Timestamp: time.Unix(0, math.MaxInt64)}, tick: true}
+	for _, pipeline := range sp.pipelines {
+		for _, source := range pipeline.sources {
+			source.input <- final
+			source.release()
+		}
+	}
+	sp.stageGroup.Wait()
+	sp.logger.Println("Stream pipelines stopped.")
+	return nil
+}
@@ -0,0 +1,144 @@
+// server/src/modules/syslog_notifier.go
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	syslogFacilityLocal0 = 16    // Default facility for Nimbus alerts
+	syslogEnterpriseID   = 32473 // Example enterprise number reserved for documentation by RFC 5612
+)
+
+// SyslogNotifier forwards alerts to a syslog collector using the RFC 5424 message format.
+type SyslogNotifier struct {
+	network  string // "udp" or "tcp"; TCP uses RFC 6587 octet-counting framing
+	addr     string // Collector address in host:port form
+	hostname string // HOSTNAME field of each message
+	appName  string // APP-NAME field of each message
+	facility int    // Syslog facility code
+}
+
+// NewSyslogNotifier creates a syslog notifier for the given collector.
+func NewSyslogNotifier(network, addr, appName string) *SyslogNotifier {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	if appName == "" {
+		appName = "nimbus"
+	}
+	return &SyslogNotifier{
+		network:  network,
+		addr:     addr,
+		hostname: hostname,
+		appName:  appName,
+		facility: syslogFacilityLocal0,
+	}
+}
+
+// Name identifies the notifier in logs and dead letters.
+func (sn *SyslogNotifier) Name() string {
+	return "syslog"
+}
+
+// Notify writes the alert to the collector over a fresh connection.
+func (sn *SyslogNotifier) Notify(ctx context.Context, alert Alert) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, sn.network, sn.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog collector: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	message := sn.formatMessage(alert)
+	if sn.network != "udp" {
+		// Octet-counting framing lets stream transports carry messages containing newlines
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return fmt.Errorf("failed to write syslog message: %w", err)
+	}
+	return nil
+}
+
+// formatMessage renders the alert as an RFC 5424 syslog message.
+func (sn *SyslogNotifier) formatMessage(alert Alert) string {
+	priority := sn.facility*8 + syslogSeverity(alert.Severity)
+	timestamp := alert.Timestamp.UTC().Format(time.RFC3339Nano)
+
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		priority,
+		timestamp,
+		sn.hostname,
+		sn.appName,
+		os.Getpid(),
+		"ALERT",
+		sn.structuredData(alert),
+		alert.Message,
+	)
+}
+
+// structuredData encodes alert metadata as an RFC 5424 SD-ELEMENT.
+func (sn *SyslogNotifier) structuredData(alert Alert) string {
+	var sd strings.Builder
+	fmt.Fprintf(&sd, "[nimbus@%d", syslogEnterpriseID)
+	fmt.Fprintf(&sd, " id=\"%s\"", escapeSDParam(alert.ID))
+	fmt.Fprintf(&sd, " source=\"%s\"", escapeSDParam(alert.Source))
+	fmt.Fprintf(&sd, " severity=\"%s\"", escapeSDParam(string(alert.Severity)))
+
+	keys := make([]string, 0, len(alert.Details))
+	for key := range alert.Details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&sd, " %s=\"%s\"", sdParamName(key), escapeSDParam(fmt.Sprint(alert.Details[key])))
+	}
+
+	sd.WriteString("]")
+	return sd.String()
+}
+
+// syslogSeverity maps alert severities onto syslog severity codes.
+func syslogSeverity(severity AlertSeverity) int {
+	switch severity {
+	case SeverityCritical:
+		return 2 // Critical
+	case SeverityWarning:
+		return 4 // Warning
+	default:
+		return 6 // Informational
+	}
+}
+
+// escapeSDParam escapes the characters RFC 5424 reserves inside PARAM-VALUE.
+func escapeSDParam(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	return replacer.Replace(value)
+}
+
+// sdParamName strips characters that are not allowed in an SD-NAME.
+func sdParamName(name string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 || r == '=' || r == ' ' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(cleaned) > 32 {
+		cleaned = cleaned[:32]
+	}
+	return cleaned
+}
@@ -0,0 +1,125 @@
+// server/src/modules/tdigest.go
+
+package modules
+
+import (
+	"math"
+	"sort"
+)
+
+// centroid is a weighted cluster of nearby values in a t-digest.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// tDigest is a merging t-digest that estimates percentiles in bounded memory.
+// Accuracy is highest near the tails, which is where alarm limits usually sit.
+type tDigest struct {
+	compression float64    // Controls the accuracy/size trade-off; higher values keep more centroids
+	centroids   []centroid // Compressed clusters sorted by mean
+	buffer      []centroid // Unmerged incoming values
+	totalWeight float64    // Weight of all values added, merged or not
+	min         float64    // Smallest value seen
+	max         float64    // Largest value seen
+}
+
+// newTDigest creates an empty t-digest with the given compression.
+func newTDigest(compression float64) *tDigest {
+	if compression < 20 {
+		compression = 20
+	}
+	return &tDigest{
+		compression: compression,
+		buffer:      make([]centroid, 0, int(compression)*4),
+		min:         math.Inf(1),
+		max:         math.Inf(-1),
+	}
+}
+
+// Add records a single value.
+func (td *tDigest) Add(value float64) {
+	td.buffer = append(td.buffer, centroid{mean: value, weight: 1})
+	td.totalWeight++
+	td.min = math.Min(td.min, value)
+	td.max = math.Max(td.max, value)
+	if len(td.buffer) == cap(td.buffer) {
+		td.compress()
+	}
+}
+
+// Count returns the number of values added.
+func (td *tDigest) Count() float64 {
+	return td.totalWeight
+}
+
+// Quantile estimates the value at quantile q (0..1), or NaN if the digest is empty.
+func (td *tDigest) Quantile(q float64) float64 {
+	td.compress()
+	if len(td.centroids) == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return td.min
+	}
+	if q >= 1 {
+		return td.max
+	}
+	if len(td.centroids) == 1 {
+		return td.centroids[0].mean
+	}
+
+	target := q * td.totalWeight
+	cumulative := 0.0
+	for i, c := range td.centroids {
+		mid := cumulative + c.weight/2
+		if target < mid {
+			if i == 0 {
+				// Interpolate between the minimum and the first centroid
+				return td.min + (c.mean-td.min)*(target/mid)
+			}
+			prev := td.centroids[i-1]
+			prevMid := cumulative - prev.weight/2
+			return prev.mean + (c.mean-prev.mean)*(target-prevMid)/(mid-prevMid)
+		}
+		cumulative += c.weight
+	}
+
+	// Interpolate between the last centroid and the maximum
+	last := td.centroids[len(td.centroids)-1]
+	lastMid := td.totalWeight - last.weight/2
+	return last.mean + (td.max-last.mean)*(target-lastMid)/(td.totalWeight-lastMid)
+}
+
+// compress merges buffered values into the centroid list, keeping clusters small near the tails.
+func (td *tDigest) compress() {
+	if len(td.buffer) == 0 {
+		return
+	}
+
+	all := append(td.centroids, td.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(td.centroids)+1)
+	current := all[0]
+	weightSoFar := 0.0
+	for _, next := range all[1:] {
+		proposed := current.weight + next.weight
+		q0 := weightSoFar / td.totalWeight
+		q2 := (weightSoFar + proposed) / td.totalWeight
+		limit := 4 * td.totalWeight * math.Min(q0*(1-q0), q2*(1-q2)) / td.compression
+
+		if proposed <= limit {
+			current.mean += (next.mean - current.mean) * next.weight / proposed
+			current.weight = proposed
+			continue
+		}
+		weightSoFar += current.weight
+		merged = append(merged, current)
+		current = next
+	}
+	merged = append(merged, current)
+
+	td.centroids = merged
+	td.buffer = td.buffer[:0]
+}
@@ -0,0 +1,767 @@
+// server/src/modules/timeseries_store.go
+
+package modules
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	chunkMagic     = "NTSC" // Identifies Nimbus time-series chunk files
+	chunkVersion   = 1
+	chunkHeaderLen = 4 + 1 + 4 + 4 // magic, version, sample count, CRC32 of data
+	walHeaderLen   = 8             // payload length and CRC32
+	walFileName    = "wal.log"
+)
+
+// ErrOutOfOrderSample is returned when a sample is older than the last stored sample of its series.
+var ErrOutOfOrderSample = errors.New("sample timestamp is before the last stored sample")
+
+// RetentionPolicy limits how long chunks of matching series are kept.
+type RetentionPolicy struct {
+	Series string `json:"series"`  // path.Match pattern on series names
+	MaxAge string `json:"max_age"` // Duration such as "168h"; "0" keeps data forever
+}
+
+// LoadRetentionPolicies reads retention policies from a JSON file containing an array of RetentionPolicy.
+func LoadRetentionPolicies(filePath string) ([]RetentionPolicy, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retention policies %s: %w", filePath, err)
+	}
+	var policies []RetentionPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, fmt.Errorf("failed to parse retention policies %s: %w", filePath, err)
+	}
+	return policies, nil
+}
+
+// TimeSeriesStoreOptions tunes chunking, durability and retention of a TimeSeriesStore.
+type TimeSeriesStoreOptions struct {
+	ChunkSamples     int               // Samples per chunk before it is sealed to disk
+	ChunkSpan        time.Duration     // Maximum time span covered by one chunk
+	WALMaxSize       int64             // WAL size in bytes that triggers a checkpoint
+	SyncInterval     time.Duration     // How often the WAL is fsynced
+	RetentionCheck   time.Duration     // How often retention policies are applied
+	DefaultRetention time.Duration     // Retention for series without a matching policy; 0 keeps data forever
+	Retention        []RetentionPolicy // Per-series retention policies; the first match wins
+}
+
+// DefaultTimeSeriesStoreOptions returns options suited to a small edge box.
+func DefaultTimeSeriesStoreOptions() TimeSeriesStoreOptions {
+	return TimeSeriesStoreOptions{
+		ChunkSamples:     120,
+		ChunkSpan:        2 * time.Hour,
+		WALMaxSize:       64 << 20,
+		SyncInterval:     time.Second,
+		RetentionCheck:   time.Hour,
+		DefaultRetention: 30 * 24 * time.Hour,
+	}
+}
+
+// retentionRule is a validated RetentionPolicy.
+type retentionRule struct {
+	pattern string
+	maxAge  time.Duration
+}
+
+// headChunk is the open, in-memory chunk of a series.
+type headChunk struct {
+	encoder gorillaEncoder
+	minTime int64 // Unix milliseconds of the first sample
+	maxTime int64 // Unix milliseconds of the last sample
+}
+
+// TimeSeriesStore is an embedded time-series database that keeps Gorilla-compressed chunks on disk
+// and protects unsealed samples with a write-ahead log.
+type TimeSeriesStore struct {
+	dir          string                 // Root directory, typically <StoragePath>/tsdb
+	options      TimeSeriesStoreOptions // Chunking and durability settings
+	retention    []retentionRule        // Validated retention policies
+	heads        map[string]*headChunk  // Open chunk per series
+	persistedMax map[string]int64       // Newest timestamp sealed to disk per series
+	wal          *os.File               // Write-ahead log file
+	walWriter    *bufio.Writer          // Buffered writer over the WAL
+	walSize      int64                  // Current WAL size in bytes
+	outOfOrder   int64                  // Samples rejected for arriving out of order
+	sameMillis   int64                  // Samples skipped for sharing the millisecond of the previous one
+	mutex        sync.Mutex             // Guards all of the above
+	logger       *log.Logger            // Logger for tracking storage events
+	stop         chan struct{}          // Closed to stop the background loop
+	done         chan struct{}          // Closed when the background loop exits
+	closeOnce    sync.Once              // Makes Close idempotent
+	closeErr     error                  // Result of the first Close
+}
+
+// OpenTimeSeriesStore opens or creates a store in dir, replaying the WAL to recover samples not yet sealed into chunks.
+func OpenTimeSeriesStore(dir string, options TimeSeriesStoreOptions, logger *log.Logger) (*TimeSeriesStore, error) {
+	defaults := DefaultTimeSeriesStoreOptions()
+	if options.ChunkSamples <= 0 {
+		options.ChunkSamples = defaults.ChunkSamples
+	}
+	if options.ChunkSpan <= 0 {
+		options.ChunkSpan = defaults.ChunkSpan
+	}
+	if options.WALMaxSize <= 0 {
+		options.WALMaxSize = defaults.WALMaxSize
+	}
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = defaults.SyncInterval
+	}
+	if options.RetentionCheck <= 0 {
+		options.RetentionCheck = defaults.RetentionCheck
+	}
+
+	rules := make([]retentionRule, 0, len(options.Retention))
+	for _, policy := range options.Retention {
+		if _, err := path.Match(policy.Series, ""); err != nil {
+			return nil, fmt.Errorf("invalid retention series pattern %q: %w", policy.Series, err)
+		}
+		maxAge, err := time.ParseDuration(policy.MaxAge)
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("invalid retention max_age %q for series %q", policy.MaxAge, policy.Series)
+		}
+		rules = append(rules, retentionRule{pattern: policy.Series, maxAge: maxAge})
+	}
+
+	for _, sub := range []string{"chunks", "wal"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0750); err != nil {
+			return nil, fmt.Errorf("failed to create time-series directory: %w", err)
+		}
+	}
+
+	ts := &TimeSeriesStore{
+		dir:          dir,
+		options:      options,
+		retention:    rules,
+		heads:        make(map[string]*headChunk),
+		persistedMax: make(map[string]int64),
+		logger:       logger,
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+
+	if err := ts.loadChunkIndex(); err != nil {
+		return nil, err
+	}
+	if err := ts.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, "wal", walFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open WAL: %w", err)
+	}
+	info, err := wal.Stat()
+	if err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("failed to stat WAL: %w", err)
+	}
+	ts.wal = wal
+	ts.walWriter = bufio.NewWriter(wal)
+	ts.walSize = info.Size()
+
+	go ts.backgroundLoop()
+	ts.logger.Printf("Time-series store opened at %s with %d recovered series\n", dir, len(ts.heads))
+	return ts, nil
+}
+
+// Append durably records a sample. Samples must arrive in increasing timestamp order per series. The
+// store keeps one sample per series and millisecond: a sample sharing the millisecond of the previous
+// one, as coarse device clocks produce, is counted and skipped without an error.
+func (ts *TimeSeriesStore) Append(series string, timestamp time.Time, value float64) error {
+	if err := validateSeriesName(series); err != nil {
+		return err
+	}
+	millis := timestamp.UnixMilli()
+
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+
+	if ts.wal == nil {
+		return errors.New("time-series store is closed")
+	}
+	switch last := ts.lastTimestamp(series); {
+	case millis == last:
+		ts.sameMillis++
+		return nil
+	case millis < last:
+		ts.outOfOrder++
+		return ErrOutOfOrderSample
+	}
+
+	if err := ts.writeWALRecord(series, millis, value); err != nil {
+		return err
+	}
+	if err := ts.appendToHead(series, millis, value); err != nil {
+		return err
+	}
+
+	if ts.walSize >= ts.options.WALMaxSize {
+		return ts.checkpoint()
+	}
+	return nil
+}
+
+// Query returns the samples of a series with timestamps in [from, to], in time order.
+func (ts *TimeSeriesStore) Query(series string, from, to time.Time) ([]Sample, error) {
+	if err := validateSeriesName(series); err != nil {
+		return nil, err
+	}
+	fromMillis, toMillis := from.UnixMilli(), to.UnixMilli()
+
+	// List the sealed chunks and snapshot the head chunk together, so a seal in between cannot return its
+	// samples twice; decoding happens outside the lock
+	ts.mutex.Lock()
+	var headData []byte
+	var headCount int
+	if head, exists := ts.heads[series]; exists && head.maxTime >= fromMillis && head.minTime <= toMillis {
+		headData = append([]byte(nil), head.encoder.Bytes()...)
+		headCount = head.encoder.Count()
+	}
+	chunks, err := ts.listChunks(series)
+	ts.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Sample, 0)
+	for _, chunk := range chunks {
+		if chunk.maxTime < fromMillis || chunk.minTime > toMillis {
+			continue
+		}
+		samples, err := readChunkFile(chunk.path, series)
+		if errors.Is(err, os.ErrNotExist) {
+			continue // Removed by retention while we were reading
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = appendInRange(results, samples, fromMillis, toMillis)
+	}
+
+	if headCount > 0 {
+		samples, err := decodeGorillaChunk(series, headData, headCount)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode head chunk for %s: %w", series, err)
+		}
+		results = appendInRange(results, samples, fromMillis, toMillis)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Timestamp.Before(results[j].Timestamp) })
+	return results, nil
+}
+
+// Series lists every series that has stored samples.
+func (ts *TimeSeriesStore) Series() ([]string, error) {
+	names := make(map[string]bool)
+
+	ts.mutex.Lock()
+	for series := range ts.heads {
+		names[series] = true
+	}
+	ts.mutex.Unlock()
+
+	entries, err := os.ReadDir(filepath.Join(ts.dir, "chunks"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunk directory: %w", err)
+	}
+	for _, entry := range entries {
+		if series, err := url.PathUnescape(entry.Name()); err == nil && entry.IsDir() {
+			names[series] = true
+		}
+	}
+
+	series := make([]string, 0, len(names))
+	for name := range names {
+		series = append(series, name)
+	}
+	sort.Strings(series)
+	return series, nil
+}
+
+// OutOfOrderSamples returns the number of samples rejected for arriving out of order.
+func (ts *TimeSeriesStore) OutOfOrderSamples() int64 {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.outOfOrder
+}
+
+// SameMillisecondSamples returns the number of samples skipped for sharing the millisecond of the
+// previous sample of their series.
+func (ts *TimeSeriesStore) SameMillisecondSamples() int64 {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.sameMillis
+}
+
+// ApplyRetention deletes sealed chunks whose newest sample is older than their series' retention.
+func (ts *TimeSeriesStore) ApplyRetention(now time.Time) error {
+	series, err := ts.Series()
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, name := range series {
+		maxAge := ts.retentionFor(name)
+		if maxAge == 0 {
+			continue
+		}
+		cutoff := now.Add(-maxAge).UnixMilli()
+
+		chunks, err := ts.listChunks(name)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if chunk.maxTime >= cutoff {
+				continue
+			}
+			if err := os.Remove(chunk.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove expired chunk %s: %w", chunk.path, err)
+			}
+			removed++
+		}
+		// Drop the series directory once it is empty; this fails harmlessly if chunks remain
+		os.Remove(ts.seriesDir(name))
+	}
+
+	if removed > 0 {
+		ts.logger.Printf("Retention removed %d expired chunks\n", removed)
+	}
+	return nil
+}
+
+// Checkpoint seals all open chunks to disk and truncates the WAL.
+func (ts *TimeSeriesStore) Checkpoint() error {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return ts.checkpoint()
+}
+
+// Close checkpoints open chunks, closes the WAL and stops background work. Later calls return the
+// result of the first.
+func (ts *TimeSeriesStore) Close() error {
+	ts.closeOnce.Do(func() {
+		ts.mutex.Lock()
+		err := ts.checkpoint()
+		if closeErr := ts.wal.Close(); err == nil {
+			err = closeErr
+		}
+		ts.wal = nil
+		ts.mutex.Unlock()
+
+		close(ts.stop)
+		<-ts.done
+		ts.closeErr = err
+		ts.logger.Println("Time-series store closed.")
+	})
+	return ts.closeErr
+}
+
+// backgroundLoop periodically fsyncs the WAL and applies retention.
+func (ts *TimeSeriesStore) backgroundLoop() {
+	defer close(ts.done)
+
+	syncTicker := time.NewTicker(ts.options.SyncInterval)
+	defer syncTicker.Stop()
+	retentionTicker := time.NewTicker(ts.options.RetentionCheck)
+	defer retentionTicker.Stop()
+
+	for {
+		select {
+		case <-ts.stop:
+			return
+		case <-syncTicker.C:
+			ts.mutex.Lock()
+			if err := ts.syncWAL(); err != nil {
+				ts.logger.Printf("Error syncing WAL: %v\n", err)
+			}
+			ts.mutex.Unlock()
+		case now := <-retentionTicker.C:
+			if err := ts.ApplyRetention(now); err != nil {
+				ts.logger.Printf("Error applying retention: %v\n", err)
+			}
+		}
+	}
+}
+
+// lastTimestamp returns the newest stored timestamp of a series. Must be called with the mutex held.
+func (ts *TimeSeriesStore) lastTimestamp(series string) int64 {
+	last, persisted := ts.persistedMax[series]
+	if !persisted {
+		last = math.MinInt64
+	}
+	if head, exists := ts.heads[series]; exists && head.maxTime > last {
+		last = head.maxTime
+	}
+	return last
+}
+
+// appendToHead adds a sample to the series' open chunk, sealing it when full. Must be called with the mutex held.
+func (ts *TimeSeriesStore) appendToHead(series string, millis int64, value float64) error {
+	head, exists := ts.heads[series]
+	if exists && millis-head.minTime >= ts.options.ChunkSpan.Milliseconds() {
+		if err := ts.sealHead(series); err != nil {
+			return err
+		}
+		exists = false
+	}
+	if !exists {
+		head = &headChunk{minTime: millis}
+		ts.heads[series] = head
+	}
+
+	head.encoder.Append(millis, value)
+	head.maxTime = millis
+
+	if head.encoder.Count() >= ts.options.ChunkSamples {
+		return ts.sealHead(series)
+	}
+	return nil
+}
+
+// sealHead writes the series' open chunk to disk. Must be called with the mutex held.
+func (ts *TimeSeriesStore) sealHead(series string) error {
+	head, exists := ts.heads[series]
+	if !exists || head.encoder.Count() == 0 {
+		return nil
+	}
+
+	if err := ts.writeChunkFile(series, head); err != nil {
+		return err
+	}
+	ts.persistedMax[series] = head.maxTime
+	delete(ts.heads, series)
+	return nil
+}
+
+// checkpoint seals every head chunk and truncates the WAL. Must be called with the mutex held.
+func (ts *TimeSeriesStore) checkpoint() error {
+	for series := range ts.heads {
+		if err := ts.sealHead(series); err != nil {
+			return err
+		}
+	}
+
+	// Every sample in the WAL is now in a chunk; a crash before the truncate is harmless
+	// because replay skips samples older than the sealed chunks.
+	if err := ts.walWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush WAL: %w", err)
+	}
+	if err := ts.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate WAL: %w", err)
+	}
+	ts.walSize = 0
+	return ts.wal.Sync()
+}
+
+// syncWAL flushes buffered WAL records and fsyncs the file. Must be called with the mutex held.
+func (ts *TimeSeriesStore) syncWAL() error {
+	if ts.wal == nil {
+		return nil
+	}
+	if err := ts.walWriter.Flush(); err != nil {
+		return err
+	}
+	return ts.wal.Sync()
+}
+
+// writeWALRecord appends a sample to the WAL. Must be called with the mutex held.
+func (ts *TimeSeriesStore) writeWALRecord(series string, millis int64, value float64) error {
+	payload := make([]byte, binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(series)+8)
+	payload = append(payload[:binary.PutUvarint(payload, uint64(len(series)))], series...)
+	var field [binary.MaxVarintLen64]byte
+	payload = append(payload, field[:binary.PutVarint(field[:], millis)]...)
+	binary.LittleEndian.PutUint64(field[:], math.Float64bits(value))
+	payload = append(payload, field[:8]...)
+
+	header := make([]byte, walHeaderLen)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+
+	if _, err := ts.walWriter.Write(header); err != nil {
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+	if _, err := ts.walWriter.Write(payload); err != nil {
+		return fmt.Errorf("failed to write WAL record: %w", err)
+	}
+	ts.walSize += int64(len(header) + len(payload))
+	return nil
+}
+
+// replayWAL rebuilds head chunks from the WAL, truncating any torn record left by a crash.
+func (ts *TimeSeriesStore) replayWAL() error {
+	walPath := filepath.Join(ts.dir, "wal", walFileName)
+	file, err := os.OpenFile(walPath, os.O_RDWR, 0640)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open WAL for replay: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	replayed := 0
+	header := make([]byte, walHeaderLen)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				ts.logger.Printf("Truncating torn WAL record at offset %d\n", offset)
+				if err := file.Truncate(offset); err != nil {
+					return fmt.Errorf("failed to truncate WAL: %w", err)
+				}
+			}
+			break
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		var series string
+		var millis int64
+		var value float64
+		_, err := io.ReadFull(reader, payload)
+		if err == nil && crc32.ChecksumIEEE(payload) != checksum {
+			err = errors.New("checksum mismatch")
+		}
+		if err == nil {
+			series, millis, value, err = decodeWALPayload(payload)
+		}
+		if err != nil {
+			ts.logger.Printf("Truncating corrupt WAL record at offset %d: %v\n", offset, err)
+			if err := file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate WAL: %w", err)
+			}
+			break
+		}
+		offset += int64(walHeaderLen) + int64(length)
+
+		// Samples already sealed into chunks before the crash are skipped
+		if millis <= ts.lastTimestamp(series) {
+			continue
+		}
+		if err := ts.appendToHead(series, millis, value); err != nil {
+			return err
+		}
+		replayed++
+	}
+
+	if replayed > 0 {
+		ts.logger.Printf("Recovered %d samples from WAL\n", replayed)
+	}
+	return nil
+}
+
+// decodeWALPayload parses the payload of a WAL record.
+func decodeWALPayload(payload []byte) (string, int64, float64, error) {
+	nameLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < nameLen {
+		return "", 0, 0, errors.New("invalid series name length")
+	}
+	series := string(payload[n : n+int(nameLen)])
+	rest := payload[n+int(nameLen):]
+
+	millis, n := binary.Varint(rest)
+	if n <= 0 || len(rest)-n != 8 {
+		return "", 0, 0, errors.New("invalid timestamp or value")
+	}
+	value := math.Float64frombits(binary.LittleEndian.Uint64(rest[n:]))
+	return series, millis, value, nil
+}
+
+// chunkRef locates a sealed chunk file and the time range it covers.
+type chunkRef struct {
+	path    string
+	minTime int64
+	maxTime int64
+}
+
+// seriesDir returns the directory holding a series' chunks.
+func (ts *TimeSeriesStore) seriesDir(series string) string {
+	return filepath.Join(ts.dir, "chunks", url.PathEscape(series))
+}
+
+// writeChunkFile atomically writes a sealed chunk as <minTime>_<maxTime>.chunk.
+func (ts *TimeSeriesStore) writeChunkFile(series string, head *headChunk) error {
+	dir := ts.seriesDir(series)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create chunk directory for %s: %w", series, err)
+	}
+
+	data := head.encoder.Bytes()
+	buf := make([]byte, chunkHeaderLen, chunkHeaderLen+len(data))
+	copy(buf, chunkMagic)
+	buf[4] = chunkVersion
+	binary.LittleEndian.PutUint32(buf[5:9], uint32(head.encoder.Count()))
+	binary.LittleEndian.PutUint32(buf[9:13], crc32.ChecksumIEEE(data))
+	buf = append(buf, data...)
+
+	name := fmt.Sprintf("%d_%d.chunk", head.minTime, head.maxTime)
+	finalPath := filepath.Join(dir, name)
+	tmpPath := finalPath + ".tmp"
+
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to create chunk file: %w", err)
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write chunk file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync chunk file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close chunk file: %w", err)
+	}
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		return fmt.Errorf("failed to publish chunk file: %w", err)
+	}
+	return nil
+}
+
+// loadChunkIndex records the newest sealed timestamp per series and removes leftovers of interrupted chunk writes.
+func (ts *TimeSeriesStore) loadChunkIndex() error {
+	entries, err := os.ReadDir(filepath.Join(ts.dir, "chunks"))
+	if err != nil {
+		return fmt.Errorf("failed to list chunk directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		series, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		chunks, err := ts.listChunks(series)
+		if err != nil {
+			return err
+		}
+		for _, chunk := range chunks {
+			if last, exists := ts.persistedMax[series]; !exists || chunk.maxTime > last {
+				ts.persistedMax[series] = chunk.maxTime
+			}
+		}
+
+		leftovers, _ := filepath.Glob(filepath.Join(ts.seriesDir(series), "*.tmp"))
+		for _, leftover := range leftovers {
+			os.Remove(leftover)
+		}
+	}
+	return nil
+}
+
+// listChunks returns the sealed chunks of a series ordered by start time.
+func (ts *TimeSeriesStore) listChunks(series string) ([]chunkRef, error) {
+	entries, err := os.ReadDir(ts.seriesDir(series))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks for %s: %w", series, err)
+	}
+
+	chunks := make([]chunkRef, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".chunk") {
+			continue
+		}
+		bounds := strings.SplitN(strings.TrimSuffix(name, ".chunk"), "_", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		minTime, errMin := strconv.ParseInt(bounds[0], 10, 64)
+		maxTime, errMax := strconv.ParseInt(bounds[1], 10, 64)
+		if errMin != nil || errMax != nil {
+			continue
+		}
+		chunks = append(chunks, chunkRef{
+			path:    filepath.Join(ts.seriesDir(series), name),
+			minTime: minTime,
+			maxTime: maxTime,
+		})
+	}
+
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].minTime < chunks[j].minTime })
+	return chunks, nil
+}
+
+// retentionFor returns the retention period of a series.
+func (ts *TimeSeriesStore) retentionFor(series string) time.Duration {
+	for _, rule := range ts.retention {
+		if ok, _ := path.Match(rule.pattern, series); ok {
+			return rule.maxAge
+		}
+	}
+	return ts.options.DefaultRetention
+}
+
+// readChunkFile reads and verifies a sealed chunk file.
+func readChunkFile(filePath, series string) ([]Sample, error) {
+	buf, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < chunkHeaderLen || string(buf[0:4]) != chunkMagic {
+		return nil, fmt.Errorf("chunk %s has an invalid header", filePath)
+	}
+	if buf[4] != chunkVersion {
+		return nil, fmt.Errorf("chunk %s has unsupported version %d", filePath, buf[4])
+	}
+	count := int(binary.LittleEndian.Uint32(buf[5:9]))
+	checksum := binary.LittleEndian.Uint32(buf[9:13])
+	data := buf[chunkHeaderLen:]
+	if crc32.ChecksumIEEE(data) != checksum {
+		return nil, fmt.Errorf("chunk %s failed checksum verification", filePath)
+	}
+
+	return decodeGorillaChunk(series, data, count)
+}
+
+// appendInRange appends the samples whose timestamps fall within [from, to].
+func appendInRange(dst, samples []Sample, from, to int64) []Sample {
+	for _, sample := range samples {
+		millis := sample.Timestamp.UnixMilli()
+		if millis >= from && millis <= to {
+			dst = append(dst, sample)
+		}
+	}
+	return dst
+}
+
+// validateSeriesName rejects names that cannot be stored safely as a directory.
+func validateSeriesName(series string) error {
+	if series == "" || series == "." || series == ".." {
+		return fmt.Errorf("invalid series name %q", series)
+	}
+	return nil
+}
+
+// millisToTime converts Unix milliseconds to a time.Time.
+func millisToTime(millis int64) time.Time {
+	return time.UnixMilli(millis)
+}
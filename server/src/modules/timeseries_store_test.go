@@ -0,0 +1,257 @@
+// server/src/modules/timeseries_store_test.go
+
+package modules
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestStore opens a store whose background loop stays out of the way of the test.
+func openTestStore(t *testing.T, dir string, options TimeSeriesStoreOptions) *TimeSeriesStore {
+	t.Helper()
+	options.SyncInterval = time.Hour
+	options.RetentionCheck = time.Hour
+	store, err := OpenTimeSeriesStore(dir, options, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// crashCopy copies the store's files as a crash would leave them: the WAL synced, open chunks not yet
+// sealed and the store never closed.
+func crashCopy(t *testing.T, store *TimeSeriesStore) string {
+	t.Helper()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.syncWAL(); err != nil {
+		t.Fatal(err)
+	}
+	target := t.TempDir()
+	err := filepath.WalkDir(store.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, _ := filepath.Rel(store.dir, path)
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(target, relative), 0750)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(target, relative), data, 0640)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+var storeEpoch = time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+// appendSamples appends n samples of a series one second apart with values 0..n-1.
+func appendSamples(t *testing.T, store *TimeSeriesStore, series string, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := store.Append(series, storeEpoch.Add(time.Duration(i)*time.Second), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// queryAll returns every stored sample of a series.
+func queryAll(t *testing.T, store *TimeSeriesStore, series string) []Sample {
+	t.Helper()
+	samples, err := store.Query(series, storeEpoch.Add(-time.Hour), storeEpoch.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return samples
+}
+
+// checkSequence fails unless samples are exactly the n appended by appendSamples.
+func checkSequence(t *testing.T, samples []Sample, n int) {
+	t.Helper()
+	if len(samples) != n {
+		t.Fatalf("got %d samples, want %d", len(samples), n)
+	}
+	for i, sample := range samples {
+		if sample.Value != float64(i) || !sample.Timestamp.Equal(storeEpoch.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("sample %d is %+v", i, sample)
+		}
+	}
+}
+
+func TestGorillaRoundTrip(t *testing.T) {
+	timestamps := []int64{1714521600000, 1714521601000, 1714521602000, 1714521602000, 1714521602007, 1714525202007, 1714525202008, 1714525201999 + 1e6}
+	values := []float64{21.5, 21.5, 21.75, -3, 0, math.MaxFloat64, math.SmallestNonzeroFloat64, math.NaN()}
+	var encoder gorillaEncoder
+	for i := range timestamps {
+		encoder.Append(timestamps[i], values[i])
+	}
+
+	samples, err := decodeGorillaChunk("s", encoder.Bytes(), encoder.Count())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != len(timestamps) {
+		t.Fatalf("decoded %d samples, want %d", len(samples), len(timestamps))
+	}
+	for i, sample := range samples {
+		if sample.Timestamp.UnixMilli() != timestamps[i] || math.Float64bits(sample.Value) != math.Float64bits(values[i]) {
+			t.Errorf("sample %d decoded as %d=%v, want %d=%v", i, sample.Timestamp.UnixMilli(), sample.Value, timestamps[i], values[i])
+		}
+	}
+	if _, err := decodeGorillaChunk("s", encoder.Bytes()[:len(encoder.Bytes())/2], encoder.Count()); err == nil {
+		t.Fatal("truncated chunk decoded without an error")
+	}
+}
+
+func TestTimeSeriesStoreRecoversFromWALAfterCrash(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), TimeSeriesStoreOptions{ChunkSamples: 4})
+	defer store.Close()
+	// 10 samples: two chunks of 4 are sealed while the WAL still holds all 10
+	appendSamples(t, store, "boiler.temp", 10)
+	appendSamples(t, store, "boiler.flow", 3)
+
+	recovered := openTestStore(t, crashCopy(t, store), TimeSeriesStoreOptions{ChunkSamples: 4})
+	defer recovered.Close()
+	checkSequence(t, queryAll(t, recovered, "boiler.temp"), 10)
+	checkSequence(t, queryAll(t, recovered, "boiler.flow"), 3)
+
+	// Replayed samples still order later appends
+	if err := recovered.Append("boiler.flow", storeEpoch, 99); err != ErrOutOfOrderSample {
+		t.Fatalf("stale append after recovery returned %v", err)
+	}
+}
+
+func TestTimeSeriesStoreTruncatesTornWALRecord(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), TimeSeriesStoreOptions{})
+	defer store.Close()
+	appendSamples(t, store, "pump.speed", 5)
+
+	dir := crashCopy(t, store)
+	walPath := filepath.Join(dir, "wal", walFileName)
+	info, err := os.Stat(walPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The crash cut the last record short
+	if err := os.Truncate(walPath, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "chunks", "leftover.tmp"), []byte("partial"), 0640)
+
+	recovered := openTestStore(t, dir, TimeSeriesStoreOptions{})
+	checkSequence(t, queryAll(t, recovered, "pump.speed"), 4)
+	if err := recovered.Append("pump.speed", storeEpoch.Add(4*time.Second), 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestStore(t, dir, TimeSeriesStoreOptions{})
+	defer reopened.Close()
+	checkSequence(t, queryAll(t, reopened, "pump.speed"), 5)
+}
+
+func TestTimeSeriesStoreRetention(t *testing.T) {
+	options := TimeSeriesStoreOptions{
+		ChunkSamples:     2,
+		DefaultRetention: 0,
+		Retention:        []RetentionPolicy{{Series: "pump.*", MaxAge: "1h"}, {Series: "*", MaxAge: "0"}},
+	}
+	store := openTestStore(t, t.TempDir(), options)
+	defer store.Close()
+	for _, series := range []string{"pump.speed", "tank.level"} {
+		store.Append(series, storeEpoch, 1)
+		store.Append(series, storeEpoch.Add(time.Minute), 2)
+		store.Append(series, storeEpoch.Add(3*time.Hour), 3)
+		store.Append(series, storeEpoch.Add(3*time.Hour+time.Minute), 4)
+	}
+
+	if err := store.ApplyRetention(storeEpoch.Add(3*time.Hour + 30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if samples := queryAll(t, store, "pump.speed"); len(samples) != 2 || samples[0].Value != 3 {
+		t.Fatalf("pump.speed after retention: %+v", samples)
+	}
+	if samples := queryAll(t, store, "tank.level"); len(samples) != 4 {
+		t.Fatalf("tank.level kept forever lost samples: %+v", samples)
+	}
+}
+
+func TestTimeSeriesStoreSkipsSameMillisecondQuietly(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), TimeSeriesStoreOptions{})
+	defer store.Close()
+	if err := store.Append("meter.kw", storeEpoch, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append("meter.kw", storeEpoch.Add(300*time.Microsecond), 2); err != nil {
+		t.Fatalf("same-millisecond sample returned %v", err)
+	}
+	if err := store.Append("meter.kw", storeEpoch.Add(-time.Second), 0); err != ErrOutOfOrderSample {
+		t.Fatalf("older sample returned %v", err)
+	}
+	if store.SameMillisecondSamples() != 1 || store.OutOfOrderSamples() != 1 {
+		t.Fatalf("counted %d same-millisecond and %d out-of-order samples", store.SameMillisecondSamples(), store.OutOfOrderSamples())
+	}
+	if samples := queryAll(t, store, "meter.kw"); len(samples) != 1 || samples[0].Value != 1 {
+		t.Fatalf("stored %+v", samples)
+	}
+}
+
+func TestTimeSeriesStoreQueryDuringSealsReturnsEachSampleOnce(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), TimeSeriesStoreOptions{ChunkSamples: 3})
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		appendSamples(t, store, "line.rate", 300)
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		samples := queryAll(t, store, "line.rate")
+		for i := 1; i < len(samples); i++ {
+			if !samples[i].Timestamp.After(samples[i-1].Timestamp) {
+				t.Fatalf("sample at %s returned twice", samples[i].Timestamp)
+			}
+		}
+		select {
+		case <-done:
+			checkSequence(t, queryAll(t, store, "line.rate"), 300)
+			return
+		default:
+		}
+	}
+}
+
+func TestTimeSeriesStoreCloseIsIdempotent(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), TimeSeriesStoreOptions{})
+	appendSamples(t, store, "fan.rpm", 2)
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("second Close returned %v", err)
+	}
+	if err := store.Append("fan.rpm", storeEpoch.Add(time.Hour), 1); err == nil {
+		t.Fatal("append after Close succeeded")
+	}
+}
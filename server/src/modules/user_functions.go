@@ -0,0 +1,425 @@
+// server/src/modules/user_functions.go
+
+package modules
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"server/utils"
+)
+
+const (
+	UserFunctionModeSample = "sample" // Evaluated on every sample of the trigger input
+	UserFunctionModeWindow = "window" // Evaluated once per tumbling window over all buffered samples
+
+	userFunctionErrorLogInterval = time.Minute // Repeated errors of one function are logged at most this often
+)
+
+// UserFunctionConfig declares a sandboxed calculation whose result becomes a derived series.
+//
+// In sample mode each input name is bound to the latest value of its series, together with t (the
+// sample time in Unix seconds) and dt (seconds since the previous evaluation). In window mode each
+// input name is bound to the array of values received in the window, together with t (the window
+// start) and window (its length in seconds). Values persisted with state.name survive between
+// evaluations. A NaN result produces no output sample.
+type UserFunctionConfig struct {
+	Name        string            `json:"name"`
+	Output      string            `json:"output"`        // Name of the derived series
+	Mode        string            `json:"mode"`          // "sample" (default) or "window"
+	Inputs      map[string]string `json:"inputs"`        // Variable name to input series
+	Trigger     string            `json:"trigger"`       // Sample mode: input variable whose samples trigger evaluation, default any input
+	Window      string            `json:"window"`        // Window mode: window length, default "1m"
+	Expression  string            `json:"expression"`    // Program source
+	Script      string            `json:"script"`        // File holding the program source, relative to the config file
+	MaxSteps    int               `json:"max_steps"`     // Evaluation step budget per invocation, default 10000
+	MaxMemoryKB int               `json:"max_memory_kb"` // Memory budget for variables, state and window buffers, default 64
+	Timeout     string            `json:"timeout"`       // Wall-clock budget per invocation, default "10ms"
+}
+
+// LoadUserFunctionConfigs reads user functions from a JSON file containing an array of UserFunctionConfig.
+// Script paths are resolved relative to the file.
+func LoadUserFunctionConfigs(filePath string) ([]UserFunctionConfig, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user function config %s: %w", filePath, err)
+	}
+	var configs []UserFunctionConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse user function config %s: %w", filePath, err)
+	}
+	for i := range configs {
+		if configs[i].Script == "" {
+			continue
+		}
+		scriptPath := configs[i].Script
+		if !filepath.IsAbs(scriptPath) {
+			scriptPath = filepath.Join(filepath.Dir(filePath), scriptPath)
+		}
+		source, err := os.ReadFile(scriptPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read script for user function %s: %w", configs[i].Name, err)
+		}
+		configs[i].Expression = string(source)
+	}
+	return configs, nil
+}
+
+// UserFunctionStats reports how a user function has been running.
+type UserFunctionStats struct {
+	Name        string `json:"name"`
+	Invocations uint64 `json:"invocations"`
+	Outputs     uint64 `json:"outputs"`
+	Errors      uint64 `json:"errors"`
+	Dropped     uint64 `json:"dropped"` // Window samples discarded because the memory budget was exhausted
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// userFunction is a compiled UserFunctionConfig and its running state.
+type userFunction struct {
+	config    UserFunctionConfig
+	program   *exprProgram
+	limits    exprLimits
+	window    time.Duration
+	variables map[string]string // Input series to variable name
+	state     map[string]float64
+
+	// Sample mode
+	latest  map[string]float64 // Latest value per variable
+	lastRun time.Time
+
+	// Window mode
+	windowStart time.Time
+	buffered    map[string][]float64 // Values per variable in the current window
+	bufferBytes int
+
+	stats        UserFunctionStats
+	lastErrorLog time.Time
+}
+
+// UserFunctions runs sandboxed user-defined calculations and feeds their results back as derived series.
+type UserFunctions struct {
+	functions []*userFunction
+	byInput   map[string][]*userFunction // Functions consuming each input series
+	derive    func([]Sample)             // Receives derived samples
+	mutex     sync.Mutex                 // Guards all function state
+	logger    *log.Logger                // Logger for tracking function errors
+}
+
+// NewUserFunctions compiles the configured functions and checks that no output feeds back into itself.
+func NewUserFunctions(logger *log.Logger, configs []UserFunctionConfig, derive func([]Sample)) (*UserFunctions, error) {
+	uf := &UserFunctions{
+		byInput: make(map[string][]*userFunction),
+		derive:  derive,
+		logger:  logger,
+	}
+	names := make(map[string]bool)
+	for _, config := range configs {
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate user function %q", config.Name)
+		}
+		names[config.Name] = true
+		function, err := compileUserFunction(config)
+		if err != nil {
+			return nil, err
+		}
+		uf.functions = append(uf.functions, function)
+		for series := range function.variables {
+			uf.byInput[series] = append(uf.byInput[series], function)
+		}
+	}
+	if err := uf.checkAcyclic(); err != nil {
+		return nil, err
+	}
+	return uf, nil
+}
+
+// compileUserFunction validates a config and compiles its program.
+func compileUserFunction(config UserFunctionConfig) (*userFunction, error) {
+	if config.Name == "" || config.Output == "" {
+		return nil, fmt.Errorf("user function needs a name and an output series")
+	}
+	if len(config.Inputs) == 0 {
+		return nil, fmt.Errorf("user function %s has no inputs", config.Name)
+	}
+	if config.Mode == "" {
+		config.Mode = UserFunctionModeSample
+	}
+	if config.Mode != UserFunctionModeSample && config.Mode != UserFunctionModeWindow {
+		return nil, fmt.Errorf("user function %s has unknown mode %q", config.Name, config.Mode)
+	}
+	if config.MaxSteps <= 0 {
+		config.MaxSteps = 10000
+	}
+	if config.MaxMemoryKB <= 0 {
+		config.MaxMemoryKB = 64
+	}
+
+	program, err := compileExpr(config.Expression)
+	if err != nil {
+		return nil, fmt.Errorf("user function %s: %w", config.Name, err)
+	}
+	timeout, err := utils.ParsePositiveDuration(config.Timeout, "10ms")
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout for user function %s: %w", config.Name, err)
+	}
+
+	function := &userFunction{
+		config:    config,
+		program:   program,
+		limits:    exprLimits{maxSteps: config.MaxSteps, maxMemory: config.MaxMemoryKB * 1024, timeout: timeout},
+		variables: make(map[string]string, len(config.Inputs)),
+		state:     make(map[string]float64),
+		latest:    make(map[string]float64),
+		buffered:  make(map[string][]float64),
+		stats:     UserFunctionStats{Name: config.Name},
+	}
+	for variable, series := range config.Inputs {
+		if _, reserved := exprConstants[variable]; reserved || variable == "t" || variable == "dt" || variable == "window" || variable == "state" {
+			return nil, fmt.Errorf("user function %s cannot use reserved name %q as an input", config.Name, variable)
+		}
+		if other, exists := function.variables[series]; exists {
+			return nil, fmt.Errorf("user function %s binds series %s to both %s and %s", config.Name, series, other, variable)
+		}
+		function.variables[series] = variable
+	}
+	if config.Trigger != "" {
+		if _, exists := config.Inputs[config.Trigger]; !exists {
+			return nil, fmt.Errorf("user function %s triggers on unknown input %q", config.Name, config.Trigger)
+		}
+	}
+	for name := range program.reads {
+		_, input := config.Inputs[name]
+		builtin := name == "t" || (name == "dt" && config.Mode == UserFunctionModeSample) || (name == "window" && config.Mode == UserFunctionModeWindow)
+		if !input && !builtin && !program.assigns[name] {
+			return nil, fmt.Errorf("user function %s reads unknown variable %q", config.Name, name)
+		}
+	}
+	if config.Mode == UserFunctionModeWindow {
+		if function.window, err = utils.ParsePositiveDuration(config.Window, "1m"); err != nil {
+			return nil, fmt.Errorf("invalid window for user function %s: %w", config.Name, err)
+		}
+	}
+	return function, nil
+}
+
+// checkAcyclic rejects functions whose outputs, directly or through other functions, feed their own inputs.
+func (uf *UserFunctions) checkAcyclic() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := make(map[*userFunction]int)
+	var visit func(function *userFunction) error
+	visit = func(function *userFunction) error {
+		switch marks[function] {
+		case visiting:
+			return fmt.Errorf("user function %s is part of a cycle through series %s", function.config.Name, function.config.Output)
+		case done:
+			return nil
+		}
+		marks[function] = visiting
+		for _, consumer := range uf.byInput[function.config.Output] {
+			if err := visit(consumer); err != nil {
+				return err
+			}
+		}
+		marks[function] = done
+		return nil
+	}
+	for _, function := range uf.functions {
+		if err := visit(function); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add feeds a sample to the functions that consume its series and derives any results.
+func (uf *UserFunctions) Add(series string, timestamp time.Time, value float64) {
+	uf.mutex.Lock()
+	consumers := uf.byInput[series]
+	outputs := make([]Sample, 0)
+	for _, function := range consumers {
+		variable := function.variables[series]
+		if function.config.Mode == UserFunctionModeSample {
+			if sample, ok := uf.addSample(function, variable, timestamp, value); ok {
+				outputs = append(outputs, sample)
+			}
+			continue
+		}
+		if sample, ok := uf.addWindowed(function, variable, timestamp, value); ok {
+			outputs = append(outputs, sample)
+		}
+	}
+	uf.mutex.Unlock()
+
+	// Derived samples re-enter the engine, and so may reach downstream functions, outside the lock
+	if len(outputs) > 0 {
+		uf.derive(outputs)
+	}
+}
+
+// addSample records the latest value and evaluates once every input has been seen.
+func (uf *UserFunctions) addSample(function *userFunction, variable string, timestamp time.Time, value float64) (Sample, bool) {
+	function.latest[variable] = value
+	if function.config.Trigger != "" && function.config.Trigger != variable {
+		return Sample{}, false
+	}
+	if len(function.latest) < len(function.config.Inputs) {
+		return Sample{}, false
+	}
+
+	dt := 0.0
+	if !function.lastRun.IsZero() {
+		dt = timestamp.Sub(function.lastRun).Seconds()
+	}
+	function.lastRun = timestamp
+
+	bindings := map[string]exprValue{"t": scalar(unixSeconds(timestamp)), "dt": scalar(dt)}
+	for name, latest := range function.latest {
+		bindings[name] = scalar(latest)
+	}
+	return uf.invoke(function, bindings, timestamp)
+}
+
+// addWindowed buffers a value, evaluating the previous window first when the sample starts a new one.
+func (uf *UserFunctions) addWindowed(function *userFunction, variable string, timestamp time.Time, value float64) (Sample, bool) {
+	start := timestamp.Truncate(function.window)
+	var output Sample
+	var emitted bool
+	if function.windowStart.IsZero() {
+		function.windowStart = start
+	} else if start.After(function.windowStart) {
+		output, emitted = uf.closeWindow(function)
+		function.windowStart = start
+	} else if start.Before(function.windowStart) {
+		return Sample{}, false // Late for a window that has already been evaluated
+	}
+
+	// Keep headroom for the program's own variables when buffering
+	if function.bufferBytes+8 > function.limits.maxMemory/2 {
+		function.stats.Dropped++
+		return output, emitted
+	}
+	function.buffered[variable] = append(function.buffered[variable], value)
+	function.bufferBytes += 8
+	return output, emitted
+}
+
+// closeWindow evaluates the buffered window and resets the buffers.
+func (uf *UserFunctions) closeWindow(function *userFunction) (Sample, bool) {
+	if function.bufferBytes == 0 {
+		return Sample{}, false
+	}
+	bindings := map[string]exprValue{
+		"t":      scalar(unixSeconds(function.windowStart)),
+		"window": scalar(function.window.Seconds()),
+	}
+	for variable := range function.config.Inputs {
+		bindings[variable] = exprValue{array: function.buffered[variable], isList: true}
+	}
+	output, emitted := uf.invoke(function, bindings, function.windowStart.Add(function.window))
+	function.buffered = make(map[string][]float64)
+	function.bufferBytes = 0
+	return output, emitted
+}
+
+// invoke runs the program under the function's limits and converts the result into a derived sample.
+func (uf *UserFunctions) invoke(function *userFunction, bindings map[string]exprValue, timestamp time.Time) (Sample, bool) {
+	function.stats.Invocations++
+
+	// Work on a copy so a failed run leaves the persisted state untouched
+	state := make(map[string]float64, len(function.state))
+	for name, value := range function.state {
+		state[name] = value
+	}
+	ctx := newExprContext(function.limits, state)
+	names := make([]string, 0, len(bindings))
+	for name := range bindings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var err error
+	for _, name := range names {
+		if err = ctx.bind(name, bindings[name]); err != nil {
+			break
+		}
+	}
+
+	var result exprValue
+	if err == nil {
+		result, err = function.program.run(ctx)
+	}
+	if err == nil && result.isList {
+		err = fmt.Errorf("result is an array; reduce it with sum, mean, last, ...")
+	}
+	if err != nil {
+		uf.recordError(function, err, timestamp)
+		return Sample{}, false
+	}
+
+	function.state = state
+	if math.IsNaN(result.number) || math.IsInf(result.number, 0) {
+		return Sample{}, false
+	}
+	function.stats.Outputs++
+	return Sample{Series: function.config.Output, Timestamp: timestamp, Value: result.number}, true
+}
+
+// recordError counts a failed invocation and logs it, rate-limited per function.
+func (uf *UserFunctions) recordError(function *userFunction, err error, now time.Time) {
+	function.stats.Errors++
+	function.stats.LastError = err.Error()
+	if now.Sub(function.lastErrorLog) >= userFunctionErrorLogInterval {
+		function.lastErrorLog = now
+		uf.logger.Printf("User function %s failed (%d errors so far): %v\n", function.config.Name, function.stats.Errors, err)
+	}
+}
+
+// Evaluate closes windows that ended before now, so quiet inputs still produce a result.
+func (uf *UserFunctions) Evaluate(now time.Time) {
+	uf.mutex.Lock()
+	outputs := make([]Sample, 0)
+	for _, function := range uf.functions {
+		if function.config.Mode != UserFunctionModeWindow || function.windowStart.IsZero() {
+			continue
+		}
+		if end := function.windowStart.Add(function.window); !now.Before(end) {
+			if sample, ok := uf.closeWindow(function); ok {
+				outputs = append(outputs, sample)
+			}
+			function.windowStart = end
+		}
+	}
+	uf.mutex.Unlock()
+
+	if len(outputs) > 0 {
+		uf.derive(outputs)
+	}
+}
+
+// Stats returns the counters of every function.
+func (uf *UserFunctions) Stats() []UserFunctionStats {
+	uf.mutex.Lock()
+	defer uf.mutex.Unlock()
+
+	stats := make([]UserFunctionStats, 0, len(uf.functions))
+	for _, function := range uf.functions {
+		stats = append(stats, function.stats)
+	}
+	return stats
+}
+
+// unixSeconds converts a timestamp to fractional Unix seconds.
+func unixSeconds(timestamp time.Time) float64 {
+	return float64(timestamp.UnixNano()) / 1e9
+}
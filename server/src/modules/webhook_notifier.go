@@ -0,0 +1,84 @@
+// server/src/modules/webhook_notifier.go
+
+package modules
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	webhookSignatureHeader = "X-Nimbus-Signature" // HMAC-SHA256 of "<timestamp>.<body>", hex encoded
+	webhookTimestampHeader = "X-Nimbus-Timestamp" // Unix seconds at which the request was signed
+)
+
+// WebhookNotifier posts alerts as JSON to an HTTP endpoint, optionally signing them with HMAC-SHA256.
+type WebhookNotifier struct {
+	url    string       // Endpoint receiving alert POST requests
+	secret []byte       // Shared secret used to sign payloads; signing is skipped when empty
+	client *http.Client // HTTP client used for delivery
+}
+
+// NewWebhookNotifier creates a webhook notifier for the given URL and signing secret.
+func NewWebhookNotifier(url, secret string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		secret: []byte(secret),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Name identifies the notifier in logs and dead letters.
+func (wn *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+// Notify posts the alert to the webhook and treats any non-2xx response as a failure.
+func (wn *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return fmt.Errorf("failed to encode alert: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if len(wn.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+SignWebhookPayload(wn.secret, timestamp, body))
+	}
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Drain so the connection can be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignWebhookPayload computes the hex HMAC-SHA256 signature receivers use to verify a webhook body.
+func SignWebhookPayload(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
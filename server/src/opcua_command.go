@@ -0,0 +1,95 @@
+// server/src/opcua_command.go
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"text/tabwriter"
+
+	"server/modules"
+)
+
+// runOPCUACommand dispatches "nimbus opcua <subcommand>" and returns the process exit code.
+func runOPCUACommand(args []string) int {
+	if len(args) == 0 || args[0] != "browse" {
+		fmt.Fprintln(os.Stderr, "usage: nimbus opcua browse [flags]")
+		return 2
+	}
+	if err := runOPCUABrowse(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "browse:", err)
+		return 1
+	}
+	return 0
+}
+
+// runOPCUABrowse lists the objects and variables of a configured OPC UA server with the browse paths that
+// browse rules name series after, to help write the node lists of the OPC UA config.
+func runOPCUABrowse(args []string) error {
+	flags := flag.NewFlagSet("nimbus opcua browse", flag.ContinueOnError)
+	configPath := flags.String("config", os.Getenv("OPCUA_CONFIG_PATH"), "OPC UA server list (JSON)")
+	server := flags.String("server", "", "name of the server to browse (default the only one configured)")
+	root := flags.String("root", "", "node to browse from (default the Objects folder)")
+	depth := flags.Int("depth", 3, "levels of objects to descend")
+	certPath := flags.String("cert", os.Getenv("SSL_CERT_PATH"), "client certificate, needed for Basic256Sha256")
+	keyPath := flags.String("key", os.Getenv("SSL_KEY_PATH"), "private key of the client certificate")
+	caPath := flags.String("ca", os.Getenv("SSL_CA_PATH"), "CA bundle that verifies servers without server_certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *configPath == "" {
+		return fmt.Errorf("-config is required")
+	}
+
+	servers, err := modules.LoadOPCUAConfigs(*configPath)
+	if err != nil {
+		return err
+	}
+	if *server == "" {
+		if len(servers) != 1 {
+			return fmt.Errorf("-server is required when %d servers are configured", len(servers))
+		}
+		*server = servers[0].Name
+	}
+	var certificate *tls.Certificate
+	if *certPath != "" && *keyPath != "" {
+		loaded, err := tls.LoadX509KeyPair(*certPath, *keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		certificate = &loaded
+	}
+	var roots *x509.CertPool
+	if *caPath != "" {
+		pem, err := os.ReadFile(*caPath)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in CA bundle %s", *caPath)
+		}
+	}
+	client, err := modules.NewOPCUAClient(log.Default(), servers, certificate, roots, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	nodes, err := client.Browse(ctx, *server, *root, *depth)
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "CLASS\tNODE ID\tBROWSE PATH\tDISPLAY NAME")
+	for _, node := range nodes {
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", node.NodeClass, node.NodeID, node.BrowsePath, node.DisplayName)
+	}
+	return out.Flush()
+}
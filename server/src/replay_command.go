@@ -0,0 +1,245 @@
+// server/src/replay_command.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"server/core"
+	"server/modules"
+)
+
+// runAnalyticsCommand dispatches "nimbus analytics <subcommand>" and returns the process exit code.
+func runAnalyticsCommand(args []string) int {
+	if len(args) == 0 || args[0] != "replay" {
+		fmt.Fprintln(os.Stderr, "usage: nimbus analytics replay [flags]")
+		return 2
+	}
+	if err := runReplay(args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "replay:", err)
+		return 1
+	}
+	return 0
+}
+
+// runReplay feeds recorded telemetry through the production analytics configuration using a virtual
+// clock and reports every decision, or the difference in decisions between two configurations.
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("nimbus analytics replay", flag.ContinueOnError)
+	input := flags.String("input", "", "recorded telemetry file (.csv or .jsonl)")
+	format := flags.String("format", "", "input format: csv or jsonl (default from the file extension)")
+	tsdbDir := flags.String("tsdb", "", "replay from a local time-series store directory instead of a file")
+	seriesPattern := flags.String("series", "*", "series pattern to read from the time-series store")
+	fromText := flags.String("from", "", "earliest timestamp to read from the time-series store (RFC 3339)")
+	toText := flags.String("to", "", "latest timestamp to read from the time-series store (RFC 3339)")
+	configA := flags.String("config", "", "env file with the configuration to replay; the current environment when empty")
+	configB := flags.String("compare", "", "env file with a second configuration to diff against")
+	speed := flags.Float64("speed", 0, "replay speed as a multiple of real time; 0 replays as fast as possible")
+	output := flags.String("output", "", "file to write results to (default stdout)")
+	asJSON := flags.Bool("json", false, "write the comparison as JSON instead of text")
+	verbose := flags.Bool("verbose", false, "show analytics log output")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*input == "") == (*tsdbDir == "") {
+		return fmt.Errorf("exactly one of -input and -tsdb is required")
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	samples, err := loadReplaySamples(*input, *format, *tsdbDir, *seriesPattern, *fromText, *toText)
+	if err != nil {
+		return err
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no samples to replay")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	eventsA, err := replayWithConfig(ctx, *configA, samples, *speed)
+	if err != nil {
+		return err
+	}
+	if *configB == "" {
+		encoder := json.NewEncoder(out)
+		for _, event := range eventsA {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Replayed %d samples: %s\n", len(samples), summariseReplay(eventsA))
+		return nil
+	}
+
+	eventsB, err := replayWithConfig(ctx, *configB, samples, *speed)
+	if err != nil {
+		return err
+	}
+	diff := modules.DiffReplays(eventsA, eventsB)
+	if *asJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(diff)
+	}
+	writeReplayDiff(out, diff, len(samples), labelFor(*configA), labelFor(*configB), len(eventsA), len(eventsB))
+	return nil
+}
+
+// loadReplaySamples reads the recorded telemetry from a file or the local time-series store.
+func loadReplaySamples(input, format, tsdbDir, pattern, fromText, toText string) ([]modules.Sample, error) {
+	if tsdbDir != "" {
+		from, to := time.Unix(0, 0), time.Now()
+		var err error
+		if fromText != "" {
+			if from, err = time.Parse(time.RFC3339, fromText); err != nil {
+				return nil, fmt.Errorf("invalid -from: %w", err)
+			}
+		}
+		if toText != "" {
+			if to, err = time.Parse(time.RFC3339, toText); err != nil {
+				return nil, fmt.Errorf("invalid -to: %w", err)
+			}
+		}
+		store, err := modules.OpenTimeSeriesStore(tsdbDir, modules.DefaultTimeSeriesStoreOptions(), log.Default())
+		if err != nil {
+			return nil, err
+		}
+		defer store.Close()
+		return modules.ReadReplayStore(store, pattern, from, to)
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(input)), ".")
+	}
+	switch format {
+	case "csv":
+		return modules.ReadReplayCSV(file)
+	case "jsonl", "ndjson", "json":
+		return modules.ReadReplayJSONL(file)
+	}
+	return nil, fmt.Errorf("unknown input format %q; use -format csv or jsonl", format)
+}
+
+// replayWithConfig builds an analytics engine exactly as the server does for the configuration in
+// envFile, without sinks that write to disk or the network, and replays samples through it.
+func replayWithConfig(ctx context.Context, envFile string, samples []modules.Sample, speed float64) ([]modules.ReplayEvent, error) {
+	config, err := core.LoadAnalyticsConfig(envFile)
+	if err != nil {
+		return nil, err
+	}
+	overflowPolicy, err := modules.ParseOverflowPolicy(config.IngestOverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single shard keeps replay deterministic; the shard count only affects producer concurrency
+	ingestOptions := modules.DefaultIngestOptions()
+	ingestOptions.Capacity = config.IngestBufferSize
+	ingestOptions.Overflow = overflowPolicy
+	ingestOptions.Shards = 1
+
+	recorder := &modules.ReplayRecorder{}
+	clock := &modules.VirtualClock{}
+	analyticsEngine := modules.NewAnalyticsEngineWithOptions(config.AnomalyThreshold, log.Default(), nil, nil, ingestOptions)
+	analyticsEngine.SetClock(clock.Now)
+	analyticsEngine.SetAnomalyObserver(recorder.Anomaly)
+	if err := setupAnalyticsStages(config, analyticsEngine, recorder.Alert); err != nil {
+		return nil, err
+	}
+
+	// With the block policy production producers would wait for the next cycle, so replay processes
+	// early rather than deadlocking its single goroutine on a full buffer
+	options := modules.ReplayOptions{Interval: config.AnalyticsInterval, Speed: speed}
+	if overflowPolicy == modules.OverflowBlock {
+		headroom := 1024
+		if config.IngestBufferSize/2 < headroom {
+			headroom = config.IngestBufferSize / 2
+		}
+		options.FlushAt = config.IngestBufferSize - headroom
+	}
+
+	if err := modules.ReplayAnalytics(ctx, analyticsEngine, clock, append([]modules.Sample(nil), samples...), options); err != nil {
+		return nil, err
+	}
+	return recorder.Events(), nil
+}
+
+// summariseReplay counts decisions per kind and source.
+func summariseReplay(events []modules.ReplayEvent) string {
+	counts := make(map[string]int)
+	for _, event := range events {
+		counts[event.Kind+"/"+event.Source]++
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%d", key, counts[key]))
+	}
+	if len(parts) == 0 {
+		return "no decisions"
+	}
+	return fmt.Sprintf("%d decisions (%s)", len(events), strings.Join(parts, ", "))
+}
+
+// writeReplayDiff prints decisions made under only one configuration, "-" for the first and "+" for the second.
+func writeReplayDiff(out io.Writer, diff modules.ReplayDiff, sampleCount int, labelA, labelB string, countA, countB int) {
+	fmt.Fprintf(out, "Replayed %d samples\n", sampleCount)
+	fmt.Fprintf(out, "--- %s: %d decisions\n+++ %s: %d decisions\n", labelA, countA, labelB, countB)
+	fmt.Fprintf(out, "%d in common, %d only in %s, %d only in %s\n", diff.Common, len(diff.OnlyA), labelA, len(diff.OnlyB), labelB)
+
+	type line struct {
+		sign  string
+		event modules.ReplayEvent
+	}
+	lines := make([]line, 0, len(diff.OnlyA)+len(diff.OnlyB))
+	for _, event := range diff.OnlyA {
+		lines = append(lines, line{"-", event})
+	}
+	for _, event := range diff.OnlyB {
+		lines = append(lines, line{"+", event})
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].event.Time.Before(lines[j].event.Time) })
+	for _, l := range lines {
+		fmt.Fprintf(out, "%s %s %-7s %-20s %s\n", l.sign, l.event.Time.UTC().Format(time.RFC3339Nano), l.event.Kind, l.event.Source, l.event.Message)
+	}
+}
+
+// labelFor names a configuration in the diff output.
+func labelFor(envFile string) string {
+	if envFile == "" {
+		return "environment"
+	}
+	return envFile
+}
@@ -0,0 +1,42 @@
+// server/src/utils/backoff.go
+
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff computes exponential retry delays with optional random jitter.
+type Backoff struct {
+	Initial    time.Duration // Delay before the first retry
+	Max        time.Duration // Upper bound for any single delay
+	Multiplier float64       // Growth factor applied per attempt (defaults to 2)
+	Jitter     float64       // Fraction of the delay randomised in either direction (0 disables jitter)
+}
+
+// Duration returns the delay to wait before the given retry attempt, starting at attempt 0.
+func (b Backoff) Duration(attempt int) time.Duration {
+	if b.Initial <= 0 {
+		return 0
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt))
+
+	// Spread retries from many clients so they don't hit a recovering endpoint at once
+	if b.Jitter > 0 {
+		delay += delay * b.Jitter * (rand.Float64()*2 - 1)
+	}
+	if b.Max > 0 && delay > float64(b.Max) {
+		delay = float64(b.Max)
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return time.Duration(delay)
+}
@@ -0,0 +1,24 @@
+// server/src/utils/duration.go
+
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// ParsePositiveDuration parses a configured duration such as "30s", using fallback when value is empty.
+// Zero and negative durations are rejected; an empty fallback makes the value required.
+func ParsePositiveDuration(value, fallback string) (time.Duration, error) {
+	if value == "" {
+		value = fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration must be positive, got %s", value)
+	}
+	return duration, nil
+}